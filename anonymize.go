@@ -0,0 +1,242 @@
+package goharproxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// The value replacing what AnonymizePolicy scrubs, when it has no Replacement
+const DefaultAnonymizeReplacement = "[REDACTED]"
+
+// AnonymizePolicy controls what HarLog.Anonymized scrubs, see DefaultAnonymizePolicy
+type AnonymizePolicy struct {
+	// Headers whose values are replaced, in any case. Scrubbing Cookie or Set-Cookie also scrubs the values of the request's or response's cookies.
+	Headers 	[]string
+
+	// Query and form params whose values are replaced, in any case, also in the urls of the Referer, Location... headers
+	Params 		[]string
+
+	// Replaces the hosts with pseudonyms, host-1.example and so on in the order they appear, the same host always getting the same one.
+	// Hosts are replaced in urls, the Host, Origin, Referer and Location headers, cookie domains and page titles which are urls,
+	// serverIpAddress and connection are emptied. Bodies other than forms are never changed.
+	Hosts 		bool
+
+	// The value of what is scrubbed, DefaultAnonymizeReplacement when empty
+	Replacement string
+}
+
+// DefaultAnonymizePolicy scrubs credentials, the Authorization, Proxy-Authorization, Cookie and Set-Cookie headers
+// and the token, access_token, key, api_key and session params, leaving the hosts
+func DefaultAnonymizePolicy() AnonymizePolicy {
+	return AnonymizePolicy {
+		Headers : []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"},
+		Params 	: []string{"token", "access_token", "key", "api_key", "session"},
+	}
+}
+
+// Scrubs the entries of a log, consistently across them
+type anonymizer struct {
+	policy AnonymizePolicy
+	headers map[string]bool
+	params map[string]bool
+	// The pseudonyms of the hosts, by lower case host name
+	hosts map[string]string
+}
+
+func newAnonymizer(policy AnonymizePolicy) *anonymizer {
+	if policy.Replacement == "" {
+		policy.Replacement = DefaultAnonymizeReplacement
+	}
+	anonymizer := &anonymizer{policy : policy, headers : make(map[string]bool), params : make(map[string]bool), hosts : make(map[string]string)}
+	for _, name := range policy.Headers {
+		anonymizer.headers[strings.ToLower(name)] = true
+	}
+	for _, name := range policy.Params {
+		anonymizer.params[strings.ToLower(name)] = true
+	}
+	return anonymizer
+}
+
+// Anonymized returns a copy of the log scrubbed as policy says, e.g. to share it. The log isn't changed,
+// the copy's entries are those of the log when it is called and share their bodies with them.
+func (harLog *HarLog) Anonymized(policy AnonymizePolicy) *HarLog {
+	header, entries := harLog.snapshot()
+	anonymizer := newAnonymizer(policy)
+	anonymized := &HarLog{Version : header.Version, Creator : header.Creator, Browser : header.Browser, entries : make([]HarEntry, len(entries))}
+	// Pages first, so hosts are numbered in the order a reader meets them
+	if header.Pages != nil {
+		anonymized.Pages = make([]HarPage, len(header.Pages))
+		for i, page := range header.Pages {
+			if parsed, err := url.Parse(page.Title); err == nil && parsed.IsAbs() && parsed.Host != "" {
+				page.Title = anonymizer.url(page.Title)
+			}
+			anonymized.Pages[i] = page
+		}
+	}
+	for i := range entries {
+		anonymized.entries[i] = anonymizer.entry(entries[i])
+	}
+	return anonymized
+}
+
+func (anonymizer *anonymizer) entry(entry HarEntry) HarEntry {
+	if anonymizer.policy.Hosts {
+		entry.ServerIpAddress, entry.Connection = "", ""
+		if entry.LocationRewrite != nil {
+			entry.LocationRewrite = &LocationRewrite{Original : anonymizer.url(entry.LocationRewrite.Original), Rewritten : anonymizer.url(entry.LocationRewrite.Rewritten)}
+		}
+	}
+	if entry.Request != nil {
+		request := *entry.Request
+		request.Url = anonymizer.url(request.Url)
+		if request.OriginalUrl != "" {
+			request.OriginalUrl = anonymizer.url(request.OriginalUrl)
+		}
+		if request.RewrittenTo != "" {
+			request.RewrittenTo = anonymizer.url(request.RewrittenTo)
+		}
+		request.Headers = anonymizer.headerValues(request.Headers)
+		request.Cookies = anonymizer.cookies(request.Cookies, "cookie")
+		request.QueryString = anonymizer.paramValues(request.QueryString)
+		if request.PostData != nil {
+			postData := *request.PostData
+			if postData.Params != nil {
+				postData.Params = make([]HarPostDataParam, len(request.PostData.Params))
+				for i, param := range request.PostData.Params {
+					if anonymizer.params[strings.ToLower(param.Name)] {
+						param.Value = anonymizer.policy.Replacement
+					}
+					postData.Params[i] = param
+				}
+			}
+			if strings.HasPrefix(strings.ToLower(postData.MimeType), "application/x-www-form-urlencoded") {
+				postData.Text = anonymizer.query(postData.Text)
+			}
+			request.PostData = &postData
+		}
+		entry.Request = &request
+	}
+	if entry.Response != nil {
+		response := *entry.Response
+		response.Headers = anonymizer.headerValues(response.Headers)
+		response.Cookies = anonymizer.cookies(response.Cookies, "set-cookie")
+		response.RedirectUrl = anonymizer.url(response.RedirectUrl)
+		entry.Response = &response
+	}
+	return entry
+}
+
+func (anonymizer *anonymizer) headerValues(headers []HarNameValuePair) []HarNameValuePair {
+	if headers == nil {
+		return nil
+	}
+	scrubbed := make([]HarNameValuePair, len(headers))
+	for i, header := range headers {
+		switch name := strings.ToLower(header.Name); {
+		case anonymizer.headers[name]:
+			header.Value = anonymizer.policy.Replacement
+		case name == "origin" || name == "referer" || name == "location" || name == "content-location" || name == ":path":
+			header.Value = anonymizer.url(header.Value)
+		case anonymizer.policy.Hosts && (name == "host" || name == ":authority"):
+			header.Value = anonymizer.hostPort(header.Value)
+		}
+		scrubbed[i] = header
+	}
+	return scrubbed
+}
+
+func (anonymizer *anonymizer) paramValues(params []HarNameValuePair) []HarNameValuePair {
+	if params == nil {
+		return nil
+	}
+	scrubbed := make([]HarNameValuePair, len(params))
+	for i, param := range params {
+		if anonymizer.params[strings.ToLower(param.Name)] {
+			param.Value = anonymizer.policy.Replacement
+		}
+		scrubbed[i] = param
+	}
+	return scrubbed
+}
+
+// The cookies with their values scrubbed if header is, and their domains replaced with pseudonyms
+func (anonymizer *anonymizer) cookies(cookies []HarCookie, header string) []HarCookie {
+	if cookies == nil {
+		return nil
+	}
+	scrubbed := make([]HarCookie, len(cookies))
+	for i, cookie := range cookies {
+		if anonymizer.headers[header] {
+			cookie.Value = anonymizer.policy.Replacement
+		}
+		if anonymizer.policy.Hosts && cookie.Domain != "" {
+			cookie.Domain = strings.Repeat(".", len(cookie.Domain) - len(strings.TrimLeft(cookie.Domain, "."))) + anonymizer.host(strings.TrimLeft(cookie.Domain, "."))
+		}
+		scrubbed[i] = cookie
+	}
+	return scrubbed
+}
+
+// The url with its password and the values of its scrubbed params replaced, and its host if hosts are. Urls which
+// can't be parsed are left, but for their query.
+func (anonymizer *anonymizer) url(rawUrl string) string {
+	if rawUrl == "" {
+		return rawUrl
+	}
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		if i := strings.Index(rawUrl, "?"); i >= 0 {
+			return rawUrl[:i + 1] + anonymizer.query(rawUrl[i + 1:])
+		}
+		return rawUrl
+	}
+	parsed.RawQuery = anonymizer.query(parsed.RawQuery)
+	if _, ok := parsed.User.Password(); ok {
+		parsed.User = url.UserPassword(parsed.User.Username(), anonymizer.policy.Replacement)
+	}
+	if anonymizer.policy.Hosts && parsed.Host != "" {
+		parsed.Host = anonymizer.hostPort(parsed.Host)
+	}
+	return parsed.String()
+}
+
+// The urlencoded query, in the same order, with the values of its scrubbed params replaced
+func (anonymizer *anonymizer) query(query string) string {
+	if query == "" || len(anonymizer.params) == 0 {
+		return query
+	}
+	pairs := strings.Split(query, "&")
+	for i, pair := range pairs {
+		nameValue := strings.SplitN(pair, "=", 2)
+		name, err := url.QueryUnescape(nameValue[0])
+		if err != nil {
+			name = nameValue[0]
+		}
+		if anonymizer.params[strings.ToLower(name)] {
+			pairs[i] = nameValue[0] + "=" + url.QueryEscape(anonymizer.policy.Replacement)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// The pseudonym of a host with an optional port, keeping the port
+func (anonymizer *anonymizer) hostPort(hostPort string) string {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return anonymizer.host(hostPort)
+	}
+	return net.JoinHostPort(anonymizer.host(host), port)
+}
+
+// The pseudonym of a host, host-1.example for the first one
+func (anonymizer *anonymizer) host(host string) string {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	pseudonym, ok := anonymizer.hosts[host]
+	if !ok {
+		pseudonym = fmt.Sprintf("host-%d.example", len(anonymizer.hosts) + 1)
+		anonymizer.hosts[host] = pseudonym
+	}
+	return pseudonym
+}
@@ -0,0 +1,193 @@
+package goharproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// A server of the management API on another protocol, run by a ProxyServer alongside its REST API, e.g. the
+// gRPC server of the grpcserver package. It manages the proxies with the exported ProxyServer calls.
+type APIServer interface {
+	// Serves the API on l until stopped
+	Serve(l net.Listener) error
+	// Stops serving, the calls still running once ctx is done are cancelled
+	Stop(ctx context.Context)
+}
+
+// An APIServer and the port the ProxyServer serves it on
+type addedAPIServer struct {
+	server 		APIServer
+	port 		int
+	// Set once started, guarded by the stateLock of the ProxyServer
+	listener 	net.Listener
+}
+
+// The error of a management call, with the status the REST API answers it with
+type APIError struct {
+	Status 	int
+	Message string
+}
+
+func (err *APIError) Error() string {
+	return err.Message
+}
+
+func apiErrorf(status int, format string, args ...interface{}) *APIError {
+	return &APIError{Status : status, Message : fmt.Sprintf(format, args...)}
+}
+
+// AddAPIServer serves server on port, 0 picks a free one, from Start until Shutdown. Start fails if the port
+// can't be listened on. Must be called before Start.
+func (proxyServer *ProxyServer) AddAPIServer(port int, server APIServer) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port [%v]", port)
+	}
+	proxyServer.stateLock.Lock()
+	defer proxyServer.stateLock.Unlock()
+	if proxyServer.started || proxyServer.stopped {
+		return ErrAlreadyStarted
+	}
+	proxyServer.apiServers = append(proxyServer.apiServers, &addedAPIServer{server : server, port : port})
+	return nil
+}
+
+// APIServerAddr returns the address server listens on, or nil before Start or if it wasn't added
+func (proxyServer *ProxyServer) APIServerAddr(server APIServer) net.Addr {
+	proxyServer.stateLock.Lock()
+	defer proxyServer.stateLock.Unlock()
+	for _, added := range proxyServer.apiServers {
+		if added.server == server && added.listener != nil {
+			return added.listener.Addr()
+		}
+	}
+	return nil
+}
+
+// Listens on the ports of the added servers, closing the listeners again if one fails
+func (proxyServer *ProxyServer) listenAPIServers() error {
+	for i, added := range proxyServer.apiServers {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%v", added.port))
+		if err != nil {
+			for _, listening := range proxyServer.apiServers[:i] {
+				listening.listener.Close()
+				listening.listener = nil
+			}
+			return err
+		}
+		added.listener = l
+	}
+	return nil
+}
+
+func (proxyServer *ProxyServer) serveAPIServers() {
+	for _, added := range proxyServer.apiServers {
+		added := added
+		go func() {
+			if err := added.server.Serve(added.listener); err != nil {
+				proxyServer.logger.Errorf("Serving API on %v failed : %v", added.listener.Addr(), err)
+			}
+		}()
+		proxyServer.logger.Infof("Serving the API on %v too", added.listener.Addr())
+	}
+}
+
+// TLSConfig returns the TLS configuration the API is served with, nil when it is served over plain HTTP.
+// Added servers serve over TLS with it, with the same client certificates, when it is set.
+func (proxyServer *ProxyServer) TLSConfig() *tls.Config {
+	return proxyServer.tlsConfig
+}
+
+// CreateProxy creates, starts and registers a proxy like POST /proxy, owned by the caller ctx was authenticated as
+func (proxyServer *ProxyServer) CreateProxy(ctx context.Context, proxyCreate ProxyServerCreate) (ProxyServerPort, error) {
+	if proxyCreate.Config != nil {
+		if err := proxyCreate.Config.validate(); err != nil {
+			return ProxyServerPort{}, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+	}
+	if proxyCreate.Name != "" && !validProxyName(proxyCreate.Name) {
+		return ProxyServerPort{}, apiErrorf(http.StatusBadRequest, "Invalid proxy name [%v], names can't be blank or contain /", proxyCreate.Name)
+	}
+	if proxyCreate.Name != "" && proxyServer.proxies.getByName(proxyCreate.Name) != nil {
+		return ProxyServerPort{}, apiErrorf(http.StatusConflict, "Proxy named [%v] already exists", proxyCreate.Name)
+	}
+
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions {
+		Port 			: proxyCreate.Port,
+		BindAddr 		: proxyCreate.BindAddress,
+		CaptureSettings : CaptureSettings{CaptureContent : captureContent},
+		Logger 			: proxyServer.logger,
+		Clock 			: proxyServer.opts.Clock,
+		EntryBuffer 	: proxyCreate.EntryBuffer,
+		EntryOverflow 	: proxyCreate.EntryOverflow,
+		EntryWorkers 	: proxyCreate.EntryWorkers,
+		CaptureBudget 	: proxyCreate.CaptureBudget,
+		CaptureBudgetPolicy : proxyCreate.CaptureBudgetPolicy,
+		UpstreamPool 	: proxyCreate.UpstreamPool,
+		Seed 			: proxyCreate.Seed,
+		Sink 			: proxyCreate.Sink,
+		Statsd 			: proxyCreate.Statsd,
+		Tracing 		: proxyCreate.Tracing,
+		AccessLog 		: proxyServer.opts.AccessLog,
+	})
+	if err != nil {
+		return ProxyServerPort{}, apiErrorf(http.StatusBadRequest, "%v", err)
+	}
+	harProxy.Name = proxyCreate.Name
+	if proxyCreate.Config != nil {
+		// The sink, statsd and tracing of the body apply unless the config has its own
+		config := *proxyCreate.Config
+		if config.Sink == nil {
+			config.Sink = proxyCreate.Sink
+		}
+		if config.Statsd == nil {
+			config.Statsd = proxyCreate.Statsd
+		}
+		if config.Tracing == nil {
+			config.Tracing = proxyCreate.Tracing
+		}
+		harProxy.ApplyConfig(config)
+	}
+	if proxyServer.opts.BrowserMobCompat {
+		newBrowserMobProxy(harProxy)
+	}
+	if status, err := proxyServer.startAndRegister(harProxy, callerFrom(ctx).owner); err != nil {
+		return ProxyServerPort{}, &APIError{Status : status, Message : err.Error()}
+	}
+	return proxyServer.proxyServerPort(harProxy), nil
+}
+
+// Proxy returns the proxy on port, a 404 APIError if there is none and a 403 one if the caller
+// ctx was authenticated as doesn't own it
+func (proxyServer *ProxyServer) Proxy(ctx context.Context, port int) (*HarProxy, error) {
+	harProxy := proxyServer.proxies.get(port)
+	if harProxy == nil {
+		return nil, apiErrorf(http.StatusNotFound, "No proxy for port [%v]", port)
+	}
+	if !proxyServer.owns(callerFrom(ctx), harProxy) {
+		return nil, apiErrorf(http.StatusForbidden, "Proxy for port [%v] belongs to another API key", port)
+	}
+	return harProxy, nil
+}
+
+// DeleteProxy stops and unregisters the proxy on port like DELETE /proxy/[port]
+func (proxyServer *ProxyServer) DeleteProxy(ctx context.Context, port int) error {
+	harProxy, err := proxyServer.Proxy(ctx, port)
+	if err != nil {
+		return err
+	}
+	proxyServer.removeHarProxy(harProxy)
+	return nil
+}
+
+// Proxies lists the proxies the caller ctx was authenticated as owns, ordered by port, like GET /proxy
+func (proxyServer *ProxyServer) Proxies(ctx context.Context) []ProxyServerPort {
+	harProxies := proxyServer.proxiesOwnedBy(callerFrom(ctx))
+	proxyServerPorts := make([]ProxyServerPort, 0, len(harProxies))
+	for _, harProxy := range harProxies {
+		proxyServerPorts = append(proxyServerPorts, proxyServer.proxyServerPort(harProxy))
+	}
+	return proxyServerPorts
+}
@@ -0,0 +1,246 @@
+package goharproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The header API keys are sent in, see ProxyServerOptions.APIKeys. They may be sent as a bearer token instead.
+const APIKeyHeader = "X-Api-Key"
+
+// The query parameter of GET /proxy/[port]/har/stream sending a token of POST /proxy/[port]/har/streamToken,
+// for clients which can't set headers, e.g. the UI's EventSource. API keys are never accepted in urls.
+const StreamTokenParam = "streamToken"
+
+// How long a stream token may be used, once
+const streamTokenTTL = 30 * time.Second
+
+// Who called the management API, from the key the call was authenticated with
+type apiCaller struct {
+	// The owner of the key, empty when the server has no keys
+	owner string
+	// Sees and manages every proxy, as everyone does when the server has no keys
+	admin bool
+}
+
+type apiCallerKey struct{}
+
+// The port of the proxy whose stream a request was authenticated for with a stream token
+type streamTokenPortKey struct{}
+
+// The unused stream tokens, each lets its caller open one stream of a proxy
+type streamTokens struct {
+	lock 	sync.Mutex
+	grants 	map[string]streamGrant
+}
+
+type streamGrant struct {
+	caller 	apiCaller
+	port 	int
+	expires time.Time
+}
+
+type StreamToken struct {
+	Token 		string 	`json:"token"`
+	ExpiresInMs int64 	`json:"expiresInMs"`
+}
+
+func newStreamTokens() *streamTokens {
+	return &streamTokens{grants : make(map[string]streamGrant)}
+}
+
+// Returns a new token for caller to stream the proxy on port until now + streamTokenTTL
+func (tokens *streamTokens) issue(caller apiCaller, port int, now time.Time) string {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	token := hex.EncodeToString(secret)
+	tokens.lock.Lock()
+	defer tokens.lock.Unlock()
+	for unused, grant := range tokens.grants {
+		if !now.Before(grant.expires) {
+			delete(tokens.grants, unused)
+		}
+	}
+	tokens.grants[token] = streamGrant{caller : caller, port : port, expires : now.Add(streamTokenTTL)}
+	return token
+}
+
+// Uses up token, false if it is unknown, used or expired
+func (tokens *streamTokens) redeem(token string, now time.Time) (streamGrant, bool) {
+	tokens.lock.Lock()
+	defer tokens.lock.Unlock()
+	grant, ok := tokens.grants[token]
+	delete(tokens.grants, token)
+	return grant, ok && now.Before(grant.expires)
+}
+
+func (opts ProxyServerOptions) validateAPIKeys() error {
+	owners := make(map[string]bool)
+	for key, owner := range opts.APIKeys {
+		if strings.TrimSpace(key) == "" {
+			return errors.New("empty API key")
+		}
+		if strings.TrimSpace(owner) == "" {
+			return errors.New("API key without owner")
+		}
+		owners[owner] = true
+	}
+	for _, admin := range opts.Admins {
+		if !owners[admin] {
+			return fmt.Errorf("admin [%v] has no API key", admin)
+		}
+	}
+	return nil
+}
+
+// Rejects the calls without a known API key with 401, when the server has keys, and passes
+// on the others with their caller. The UI's static files are served to anyone.
+func (proxyServer *ProxyServer) authHandler(next http.Handler) http.Handler {
+	if len(proxyServer.opts.APIKeys) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ui" || strings.HasPrefix(r.URL.Path, "/ui/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if token := r.URL.Query().Get(StreamTokenParam); token != "" && r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/har/stream") {
+			grant, ok := proxyServer.streamTokens.redeem(token, proxyServer.clock.Now())
+			if !ok {
+				proxyServer.writeErrorMessage(w, http.StatusUnauthorized, "Unknown, used or expired stream token")
+				return
+			}
+			ctx := context.WithValue(context.WithValue(r.Context(), apiCallerKey{}, grant.caller), streamTokenPortKey{}, grant.port)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		caller, ok := proxyServer.callerWithKey(requestKey(r))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			proxyServer.writeErrorMessage(w, http.StatusUnauthorized, "Missing or unknown API key")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiCallerKey{}, caller)))
+	})
+}
+
+// Returns the key r was sent with, empty if it has none
+func requestKey(r *http.Request) string {
+	return bearerKey(r.Header.Get(APIKeyHeader), r.Header.Get("Authorization"))
+}
+
+// Returns the key of the APIKeyHeader value, or else of the Authorization bearer token
+func bearerKey(key, authorization string) string {
+	if key == "" && len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		key = strings.TrimSpace(authorization[len("Bearer "):])
+	}
+	return key
+}
+
+// Returns the caller with key, false if the key is empty or unknown
+func (proxyServer *ProxyServer) callerWithKey(key string) (apiCaller, bool) {
+	if key == "" {
+		return apiCaller{}, false
+	}
+	// Compared with every known key in constant time, not to tell how much of one matched
+	owner, found := "", false
+	for known, knownOwner := range proxyServer.opts.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(known)) == 1 {
+			owner, found = knownOwner, true
+		}
+	}
+	if !found {
+		return apiCaller{}, false
+	}
+	caller := apiCaller{owner : owner}
+	for _, admin := range proxyServer.opts.Admins {
+		caller.admin = caller.admin || admin == owner
+	}
+	return caller, true
+}
+
+// Authenticate returns ctx carrying the caller apiKey, or else the bearer token of authorization, is the key of,
+// for the ProxyServer calls made with it. False if the server has keys and neither is one, ctx is kept without keys.
+func (proxyServer *ProxyServer) Authenticate(ctx context.Context, apiKey, authorization string) (context.Context, bool) {
+	if len(proxyServer.opts.APIKeys) == 0 {
+		return ctx, true
+	}
+	caller, ok := proxyServer.callerWithKey(bearerKey(apiKey, authorization))
+	if !ok {
+		return nil, false
+	}
+	return context.WithValue(ctx, apiCallerKey{}, caller), true
+}
+
+// The caller of r, an admin when the server has no keys
+func callerOf(r *http.Request) apiCaller {
+	return callerFrom(r.Context())
+}
+
+// The caller a call's ctx was authenticated as, an admin when the server has no keys
+func callerFrom(ctx context.Context) apiCaller {
+	if caller, ok := ctx.Value(apiCallerKey{}).(apiCaller); ok {
+		return caller
+	}
+	return apiCaller{admin : true}
+}
+
+// Whether caller may see and manage harProxy
+func (proxyServer *ProxyServer) owns(caller apiCaller, harProxy *HarProxy) bool {
+	return caller.admin || proxyServer.proxies.owner(harProxy) == caller.owner
+}
+
+// Writes 403 and returns false if the caller of r doesn't own harProxy
+func (proxyServer *ProxyServer) authorize(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) bool {
+	if proxyServer.owns(callerOf(r), harProxy) {
+		return true
+	}
+	proxyServer.writeErrorMessage(w, http.StatusForbidden, fmt.Sprintf("Proxy for port [%v] belongs to another API key", harProxy.Port))
+	return false
+}
+
+// Returns the registered proxies the caller of r owns, ordered by port
+func (proxyServer *ProxyServer) ownedProxies(r *http.Request) []*HarProxy {
+	return proxyServer.proxiesOwnedBy(callerOf(r))
+}
+
+// Returns the registered proxies caller owns, ordered by port
+func (proxyServer *ProxyServer) proxiesOwnedBy(caller apiCaller) []*HarProxy {
+	harProxies := proxyServer.proxies.list()
+	if caller.admin {
+		return harProxies
+	}
+	owned := harProxies[:0]
+	for _, harProxy := range harProxies {
+		if proxyServer.owns(caller, harProxy) {
+			owned = append(owned, harProxy)
+		}
+	}
+	return owned
+}
+
+// Answers a token the caller of r may open one stream of harProxy with, within streamTokenTTL
+func (proxyServer *ProxyServer) postStreamToken(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	token := proxyServer.streamTokens.issue(callerOf(r), harProxy.Port, proxyServer.clock.Now())
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(StreamToken{Token : token, ExpiresInMs : streamTokenTTL.Milliseconds()})
+}
+
+// Writes 403 and returns false if r was authenticated with a stream token of another proxy than harProxy
+func (proxyServer *ProxyServer) authorizeStream(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) bool {
+	if port, ok := r.Context().Value(streamTokenPortKey{}).(int); ok && port != harProxy.Port {
+		proxyServer.writeErrorMessage(w, http.StatusForbidden, fmt.Sprintf("Stream token isn't for the proxy on port [%v]", harProxy.Port))
+		return false
+	}
+	return true
+}
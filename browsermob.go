@@ -0,0 +1,319 @@
+package goharproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"github.com/quantum/goproxy"
+)
+
+// The name of the latency rule PUT /proxy/[port]/limit sets in BrowserMob compatibility mode
+const browserMobLatencyRule = "browserMobLimit"
+
+// What the BrowserMob compatible API keeps per proxy, see ProxyServerOptions.BrowserMobCompat.
+// Its blacklist, whitelist and headers are applied by a request middleware installed when the proxy is created.
+type browserMobState struct {
+	lock sync.RWMutex
+	blacklist []browserMobBlacklistEntry
+	// Requests to urls matching none of whitelist are answered with whitelistStatus, when it isn't 0
+	whitelist []*regexp.Regexp
+	whitelistStatus int
+	// Set on every request
+	headers map[string]string
+}
+
+type browserMobBlacklistEntry struct {
+	UrlPattern 	string 	`json:"urlPattern"`
+	StatusCode 	int 	`json:"statusCode"`
+	// Any method when empty
+	Method 		string 	`json:"method,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+type browserMobWhitelist struct {
+	UrlPatterns []string 	`json:"urlPatterns"`
+	StatusCode 	int 		`json:"statusCode"`
+}
+
+type browserMobLimit struct {
+	UpstreamKbps 	int64 	`json:"upstreamKbps"`
+	DownstreamKbps 	int64 	`json:"downstreamKbps"`
+	Latency 		int64 	`json:"latency"`
+}
+
+// Makes harProxy keep the state of the BrowserMob compatible API, and apply it to its requests
+func newBrowserMobProxy(harProxy *HarProxy) {
+	state := &browserMobState{}
+	harProxy.browserMob = state
+	harProxy.UseRequest(state.filter)
+}
+
+func (state *browserMobState) filter(req *http.Request) (*http.Request, *http.Response) {
+	state.lock.RLock()
+	defer state.lock.RUnlock()
+	for name, value := range state.headers {
+		req.Header.Set(name, value)
+	}
+	url := req.URL.String()
+	if state.whitelistStatus != 0 && !matchesAny(state.whitelist, url) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, state.whitelistStatus, "")
+	}
+	for _, entry := range state.blacklist {
+		if (entry.Method == "" || entry.Method == req.Method) && entry.pattern.MatchString(url) {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, entry.StatusCode, "")
+		}
+	}
+	return req, nil
+}
+
+// Whether r has a JSON body, BrowserMob clients send form parameters instead
+func isJsonRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// Reads the port and bindAddress parameters BrowserMob clients create proxies with
+func (proxyServer *ProxyServer) browserMobCreateParams(r *http.Request, w http.ResponseWriter, proxyCreate *ProxyServerCreate) bool {
+	if port := r.FormValue("port"); port != "" {
+		parsed, err := strconv.Atoi(port)
+		if err != nil {
+			proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid port [%v]", port))
+			return false
+		}
+		proxyCreate.Port = parsed
+	}
+	if bindAddress := r.FormValue("bindAddress"); bindAddress != "" {
+		proxyCreate.BindAddress = bindAddress
+	}
+	return true
+}
+
+// Serves the BrowserMob routes which differ from ours, returns false for the others
+func (proxyServer *ProxyServer) serveBrowserMob(harProxy *HarProxy, path string, r *http.Request, w http.ResponseWriter) bool {
+	state := harProxy.browserMob
+	if state == nil {
+		return false
+	}
+	method := r.Method
+	switch {
+	case strings.HasSuffix(path, "har/pageRef") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH BROWSERMOB NEW PAGE")
+		proxyServer.browserMobNewPage(harProxy, r, w)
+	case strings.HasSuffix(path, "har") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH BROWSERMOB NEW HAR")
+		proxyServer.browserMobNewHar(harProxy, r, w)
+	case strings.HasSuffix(path, "har") && method == "GET":
+		proxyServer.logger.Debugf("MATCH BROWSERMOB GET HAR")
+		w.Header().Add("Content-Type", "application/json")
+		harProxy.WriteHar(w)
+	case strings.HasSuffix(path, "blacklist") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH BROWSERMOB BLACKLIST")
+		proxyServer.browserMobBlacklist(state, r, w)
+	case strings.HasSuffix(path, "blacklist") && method == "GET":
+		state.lock.RLock()
+		blacklist := append([]browserMobBlacklistEntry{}, state.blacklist...)
+		state.lock.RUnlock()
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(blacklist)
+	case strings.HasSuffix(path, "blacklist") && method == "DELETE":
+		state.lock.Lock()
+		state.blacklist = nil
+		state.lock.Unlock()
+		writeMessage(w, "Cleared blacklist successfully")
+	case strings.HasSuffix(path, "whitelist") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH BROWSERMOB WHITELIST")
+		proxyServer.browserMobWhitelist(state, r, w)
+	case strings.HasSuffix(path, "whitelist") && method == "GET":
+		state.lock.RLock()
+		whitelist := browserMobWhitelist{UrlPatterns : make([]string, len(state.whitelist)), StatusCode : state.whitelistStatus}
+		for i, pattern := range state.whitelist {
+			whitelist.UrlPatterns[i] = pattern.String()
+		}
+		state.lock.RUnlock()
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(whitelist)
+	case strings.HasSuffix(path, "whitelist") && method == "DELETE":
+		state.lock.Lock()
+		state.whitelist, state.whitelistStatus = nil, 0
+		state.lock.Unlock()
+		writeMessage(w, "Cleared whitelist successfully")
+	case strings.HasSuffix(path, "headers") && method == "POST":
+		headers := map[string]string{}
+		if !proxyServer.decodeJsonBody(w, r, &headers, false) {
+			return true
+		}
+		state.lock.Lock()
+		state.headers = headers
+		state.lock.Unlock()
+		writeMessage(w, "Set headers successfully")
+	case strings.HasSuffix(path, "limit") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH BROWSERMOB LIMIT")
+		proxyServer.browserMobLimit(harProxy, r, w)
+	case strings.HasSuffix(path, "limit") && method == "GET":
+		limit := browserMobLimit{}
+		for _, rule := range harProxy.LatencyRules() {
+			if rule.Name == browserMobLatencyRule {
+				limit.Latency = rule.DelayMs
+			}
+		}
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(limit)
+	case strings.HasSuffix(path, "hosts") && method == "POST":
+		return proxyServer.browserMobHosts(harProxy, r, w)
+	default:
+		return false
+	}
+	return true
+}
+
+// Starts a new HAR with its initial page, answering with the previous one, or 204 if it was empty
+func (proxyServer *ProxyServer) browserMobNewHar(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	pageRef := r.FormValue("initialPageRef")
+	if pageRef == "" {
+		pageRef = "Page 0"
+	}
+	pageTitle := r.FormValue("initialPageTitle")
+	if pageTitle == "" {
+		pageTitle = pageRef
+	}
+	captureSettings := harProxy.CaptureSettings()
+	captureSettings.CaptureContent = r.FormValue("captureContent") == "true" || r.FormValue("captureBinaryContent") == "true"
+	harProxy.SetCaptureSettings(captureSettings)
+
+	harProxy.waitForEntries(context.Background(), WaitEntriesTimeout)
+	previous := harProxy.HarLog.drain()
+	harProxy.HarLog.clearPages()
+	harProxy.NewPage(pageRef, pageTitle)
+	if previous.Len() == 0 && len(previous.Pages) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	previous.WriteTo(w)
+}
+
+func (proxyServer *ProxyServer) browserMobNewPage(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	pageRef := r.FormValue("pageRef")
+	if pageRef == "" {
+		harProxy.HarLog.lock.RLock()
+		pageRef = "Page " + strconv.Itoa(len(harProxy.HarLog.Pages))
+		harProxy.HarLog.lock.RUnlock()
+	}
+	pageTitle := r.FormValue("pageTitle")
+	if pageTitle == "" {
+		pageTitle = pageRef
+	}
+	harProxy.NewPage(pageRef, pageTitle)
+	writeMessage(w, "Started page successfully")
+}
+
+// Adds a blacklist entry, regex and status are required
+func (proxyServer *ProxyServer) browserMobBlacklist(state *browserMobState, r *http.Request, w http.ResponseWriter) {
+	entry := browserMobBlacklistEntry{UrlPattern : r.FormValue("regex"), Method : r.FormValue("method")}
+	var err error
+	if entry.pattern, err = regexp.Compile(entry.UrlPattern); err != nil || entry.UrlPattern == "" {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid regex [%v]", entry.UrlPattern))
+		return
+	}
+	if entry.StatusCode, err = strconv.Atoi(r.FormValue("status")); err != nil || entry.StatusCode < 100 || entry.StatusCode > 999 {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid status [%v]", r.FormValue("status")))
+		return
+	}
+	state.lock.Lock()
+	state.blacklist = append(state.blacklist, entry)
+	state.lock.Unlock()
+	writeMessage(w, "Added blacklist entry successfully")
+}
+
+// Replaces the whitelist by the comma separated patterns of regex, answering other requests with status
+func (proxyServer *ProxyServer) browserMobWhitelist(state *browserMobState, r *http.Request, w http.ResponseWriter) {
+	var patterns []*regexp.Regexp
+	for _, expr := range strings.Split(r.FormValue("regex"), ",") {
+		if expr = strings.TrimSpace(expr); expr == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid regex [%v]", expr))
+			return
+		}
+		patterns = append(patterns, pattern)
+	}
+	status, err := strconv.Atoi(r.FormValue("status"))
+	if err != nil || status < 100 || status > 999 {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid status [%v]", r.FormValue("status")))
+		return
+	}
+	state.lock.Lock()
+	state.whitelist, state.whitelistStatus = patterns, status
+	state.lock.Unlock()
+	writeMessage(w, "Set whitelist successfully")
+}
+
+// Sets the latency of every request as a latency rule. Bandwidth limits aren't supported, they must be 0.
+func (proxyServer *ProxyServer) browserMobLimit(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	limit := browserMobLimit{}
+	for name, value := range map[string]*int64{"upstreamKbps" : &limit.UpstreamKbps, "downstreamKbps" : &limit.DownstreamKbps, "latency" : &limit.Latency} {
+		if param := r.FormValue(name); param != "" {
+			parsed, err := strconv.ParseInt(param, 10, 64)
+			if err != nil || parsed < 0 {
+				proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid %v [%v]", name, param))
+				return
+			}
+			*value = parsed
+		}
+	}
+	if limit.UpstreamKbps != 0 || limit.DownstreamKbps != 0 {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, "Bandwidth limits aren't supported, only latency")
+		return
+	}
+	if r.FormValue("latency") == "" {
+		writeMessage(w, "Set limit successfully")
+		return
+	}
+	rules := make([]LatencyRule, 0, 1)
+	for _, rule := range harProxy.LatencyRules() {
+		if rule.Name != browserMobLatencyRule {
+			rules = append(rules, rule)
+		}
+	}
+	if limit.Latency > 0 {
+		rules = append(rules, LatencyRule{Name : browserMobLatencyRule, DelayMs : limit.Latency})
+	}
+	harProxy.SetLatencyRules(rules)
+	writeMessage(w, "Set limit successfully")
+}
+
+// Remaps hosts given as a json object of host to address, like BrowserMob clients do.
+// Returns false for our json array of hosts entries, left to the regular route.
+func (proxyServer *ProxyServer) browserMobHosts(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) bool {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return true
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return false
+	}
+	hosts := map[string]string{}
+	if !proxyServer.decodeJsonBody(w, r, &hosts, false) {
+		return true
+	}
+	hostEntries := make([]ProxyHosts, 0, len(hosts))
+	for host, newHost := range hosts {
+		hostEntries = append(hostEntries, ProxyHosts{Host : host, NewHost : newHost})
+	}
+	harProxy.AddHostEntries(hostEntries)
+	writeMessage(w, "Remapped hosts successfully")
+	return true
+}
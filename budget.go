@@ -0,0 +1,104 @@
+package goharproxy
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// Entries recorded while the log's bodies don't leave room for theirs are recorded without them
+	BudgetSkip = "skip"
+
+	// The bodies of the oldest entries are dropped to make room for the new ones
+	BudgetEvict = "evict"
+)
+
+// Values of HarEntry.CaptureSkipped
+const (
+	captureSkippedBudget = "budget"
+	captureSkippedEvicted = "evicted"
+)
+
+// The bytes of captured bodies an entry holds
+func entryBodyBytes(entry *HarEntry) int64 {
+	var bytes int64
+	if entry.Request != nil && entry.Request.PostData != nil {
+		bytes += int64(len(entry.Request.PostData.Text))
+	}
+	if entry.Response != nil && entry.Response.Content != nil {
+		bytes += int64(len(entry.Response.Content.Text))
+	}
+	return bytes
+}
+
+// Returns entry without its captured bodies, with copies of the request and response it shares with snapshots
+func withoutBodies(entry HarEntry, reason string) HarEntry {
+	if entry.Request != nil && entry.Request.PostData != nil {
+		request := *entry.Request
+		postData := *request.PostData
+		postData.Text = ""
+		postData.Truncated = false
+		request.PostData = &postData
+		entry.Request = &request
+	}
+	if entry.Response != nil && entry.Response.Content != nil {
+		response := *entry.Response
+		content := *response.Content
+		content.Text = ""
+		content.Truncated = false
+		response.Content = &content
+		entry.Response = &response
+	}
+	entry.CaptureSkipped = reason
+	return entry
+}
+
+// CaptureBytes returns the bytes of captured bodies held by the log's entries
+func (harLog *HarLog) CaptureBytes() int64 {
+	return atomic.LoadInt64(&harLog.captureBytes)
+}
+
+// Adds entry like addEntryWithin, keeping the bodies of the log within budget bytes unless budget is 0.
+// Returns whether entry was added and how many entries lost their bodies to make room.
+func (harLog *HarLog) addEntryWithinBudget(maxEntries int, budget int64, evict bool, entry HarEntry) (bool, int) {
+	harLog.lock.Lock()
+	defer harLog.lock.Unlock()
+	if maxEntries > 0 && len(harLog.entries) >= maxEntries {
+		return false, 0
+	}
+	bodyBytes := entryBodyBytes(&entry)
+	if budget > 0 && !evict && bodyBytes > 0 && harLog.captureBytes + bodyBytes > budget {
+		entry = withoutBodies(entry, captureSkippedBudget)
+	}
+	harLog.appendEntries([]HarEntry{entry})
+	if budget > 0 && evict && harLog.captureBytes > budget {
+		return true, harLog.evictBodies(budget - budget / 4)
+	}
+	return true, 0
+}
+
+// Must be called with lock held. Drops the bodies of the oldest entries until the log's bodies fit in target,
+// below the budget so not every new entry copies the log. The entries are copied as snapshots share them.
+func (harLog *HarLog) evictBodies(target int64) int {
+	entries := make([]HarEntry, len(harLog.entries), cap(harLog.entries))
+	copy(entries, harLog.entries)
+	evicted := 0
+	for i := harLog.bodiesFrom; i < len(entries) && harLog.captureBytes > target; i++ {
+		if bodyBytes := entryBodyBytes(&entries[i]); bodyBytes > 0 {
+			entries[i] = withoutBodies(entries[i], captureSkippedEvicted)
+			atomic.AddInt64(&harLog.captureBytes, -bodyBytes)
+			evicted++
+		}
+		harLog.bodiesFrom = i + 1
+	}
+	harLog.entries = entries
+	return evicted
+}
+
+// The bytes of captured bodies held by entries
+func sumBodyBytes(entries []HarEntry) int64 {
+	var bytes int64
+	for i := range entries {
+		bytes += entryBodyBytes(&entries[i])
+	}
+	return bytes
+}
@@ -0,0 +1,179 @@
+package goharproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Capacities of the pooled capture buffers, bodies growing past the last one get a buffer which isn't pooled
+var captureSizeClasses = [...]int{4 << 10, 64 << 10, 1 << 20}
+
+// Pools of *[]byte with the capacity of their class
+var capturePools [len(captureSizeClasses)]sync.Pool
+
+// An empty slice of at least size bytes, from the pool of the smallest class fitting it
+func getCaptureBytes(size int) []byte {
+	for class, classSize := range captureSizeClasses {
+		if size <= classSize {
+			if pooled, ok := capturePools[class].Get().(*[]byte); ok {
+				return (*pooled)[:0]
+			}
+			return make([]byte, 0, classSize)
+		}
+	}
+	return make([]byte, 0, size)
+}
+
+func putCaptureBytes(buf []byte) {
+	for class, classSize := range captureSizeClasses {
+		if cap(buf) == classSize {
+			buf = buf[:0]
+			capturePools[class].Put(&buf)
+			return
+		}
+	}
+}
+
+// A captured body, kept until its entry is recorded and whoever reads the body it was copied from is done.
+// Parsing the entry copies it into a string, so the buffer goes back to its pool afterwards.
+type captureBuffer struct {
+	buf []byte
+
+	// The most bytes kept, 0 keeps everything
+	limit int64
+
+	// Whether bytes were left out because of limit
+	truncated bool
+
+	// The holders which didn't release the buffer yet
+	refs int32
+
+	// Where Read is, for parsers reading the buffer as the entry's body
+	offset int
+}
+
+// A buffer fitting length bytes, or limit if smaller, held by refs holders.
+// length is the Content-Length, negative when unknown.
+func newCaptureBuffer(length int64, limit int64, refs int32) *captureBuffer {
+	size := length
+	if limit > 0 && (size < 0 || size > limit) {
+		size = limit
+	}
+	if size < 0 {
+		size = 0
+	}
+	return &captureBuffer{buf : getCaptureBytes(int(size)), limit : limit, refs : refs}
+}
+
+// Keeps p up to the limit, never fails so it can be used as the copy of a tee.
+// Growing moves the bytes to a buffer of the next class fitting them.
+func (capture *captureBuffer) Write(p []byte) (int, error) {
+	keep := p
+	if capture.limit > 0 && int64(len(capture.buf) + len(p)) > capture.limit {
+		keep = p[:capture.limit - int64(len(capture.buf))]
+		capture.truncated = true
+	}
+	if needed := len(capture.buf) + len(keep); needed > cap(capture.buf) {
+		if doubled := 2 * cap(capture.buf); needed < doubled {
+			needed = doubled
+		}
+		grown := append(getCaptureBytes(needed), capture.buf...)
+		putCaptureBytes(capture.buf)
+		capture.buf = grown
+	}
+	capture.buf = append(capture.buf, keep...)
+	return len(p), nil
+}
+
+func (capture *captureBuffer) Read(p []byte) (int, error) {
+	if capture.offset >= len(capture.buf) {
+		return 0, io.EOF
+	}
+	n := copy(p, capture.buf[capture.offset:])
+	capture.offset += n
+	return n, nil
+}
+
+// Releasing is done with release, the entry's copy of the request or response may be closed by its parser
+func (capture *captureBuffer) Close() error {
+	return nil
+}
+
+func (capture *captureBuffer) String() string {
+	return string(capture.buf)
+}
+
+func (capture *captureBuffer) Len() int {
+	return len(capture.buf)
+}
+
+// Puts the buffer back in its pool once every holder released it, nil is ignored
+func (capture *captureBuffer) release() {
+	if capture == nil || atomic.AddInt32(&capture.refs, -1) != 0 {
+		return
+	}
+	putCaptureBytes(capture.buf)
+	capture.buf = nil
+}
+
+// The text of a captured body, body is read unless it is a capture buffer
+func bodyText(body io.Reader) (string, bool) {
+	if capture, ok := body.(*captureBuffer); ok {
+		return capture.String(), capture.truncated
+	}
+	text, _ := ioutil.ReadAll(body)
+	return string(text), false
+}
+
+// Reads up to the limit of body, whose length is known, into a capture buffer held by the entry and by the returned body.
+// The returned body replays the captured bytes before the rest of body, the buffer is released when it is closed.
+func captureReadCloser(body io.ReadCloser, length int64, limit int64) (io.ReadCloser, *captureBuffer) {
+	capture := newCaptureBuffer(length, limit, 2)
+	keep := length
+	if limit > 0 && keep > limit {
+		keep = limit
+		capture.truncated = true
+	}
+	io.CopyN(capture, body, keep)
+	return &replayBody{capture : capture, rest : body}, capture
+}
+
+// The captured bytes of a body followed by what wasn't captured, as the transport or the client read them
+type replayBody struct {
+	// Guards offset and closed, so the buffer isn't released while a read copies from it
+	lock sync.Mutex
+	capture *captureBuffer
+	offset int
+	closed bool
+
+	rest io.ReadCloser
+}
+
+func (body *replayBody) Read(p []byte) (int, error) {
+	body.lock.Lock()
+	if body.closed {
+		body.lock.Unlock()
+		return 0, http.ErrBodyReadAfterClose
+	}
+	if body.offset < body.capture.Len() {
+		n := copy(p, body.capture.buf[body.offset:])
+		body.offset += n
+		body.lock.Unlock()
+		return n, nil
+	}
+	body.lock.Unlock()
+	return body.rest.Read(p)
+}
+
+func (body *replayBody) Close() error {
+	body.lock.Lock()
+	if !body.closed {
+		body.closed = true
+		body.capture.release()
+	}
+	body.lock.Unlock()
+	return body.rest.Close()
+}
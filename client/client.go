@@ -0,0 +1,256 @@
+// Package client calls the management API of a goharproxy server, with the request and response
+// types of the goharproxy package.
+//
+//	c := client.New("http://localhost:8080", nil)
+//	proxy, err := c.CreateProxy(ctx, goharproxy.ProxyServerCreate{Name : "checkout"})
+//	...
+//	defer proxy.Delete(ctx)
+//	err = proxy.WaitForIdle(ctx)
+//	harLog, err := proxy.Har(ctx, true)
+//
+// Every call takes a context, which cancels it along with its retries. Calls are retried when the server
+// can't be reached or answers 502, 503 or 504, except that a request which may have reached the server
+// is only sent again if repeating it changes nothing, e.g. a clearing Har isn't.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hellspam/goharproxy"
+)
+
+// How often WaitForIdle polls the proxy's status
+var IdlePollInterval = 50 * time.Millisecond
+
+// Client calls the management API at a base url, e.g. http://localhost:8080
+type Client struct {
+	baseUrl string
+	httpClient *http.Client
+
+	// Retries of a failed call, 3 by default
+	MaxRetries int
+
+	// The wait before the first retry, doubled for each next one, 200ms by default
+	RetryBackoff time.Duration
+
+	// Sent with every call when set, see goharproxy.ProxyServerOptions.APIKeys
+	APIKey string
+}
+
+// New returns a client of the API at baseUrl, sending requests with httpClient or http.DefaultClient when nil
+func New(baseUrl string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client {
+		baseUrl 	 : strings.TrimSuffix(baseUrl, "/"),
+		httpClient 	 : httpClient,
+		MaxRetries 	 : 3,
+		RetryBackoff : 200 * time.Millisecond,
+	}
+}
+
+// Error is what the API answered a call with, when it failed
+type Error struct {
+	StatusCode int
+	Message string
+	// The invalid items of a list the call sent, e.g. hosts entries
+	Items []goharproxy.ProxyServerItemErr
+}
+
+func (err *Error) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("goharproxy: %v", http.StatusText(err.StatusCode))
+	}
+	return fmt.Sprintf("goharproxy: %v (%v)", err.Message, err.StatusCode)
+}
+
+// ProxyHandle is a proxy of the server, see Client.CreateProxy and Client.Proxy
+type ProxyHandle struct {
+	client *Client
+
+	Port int
+	Name string
+	// The address the proxy listens on, empty for handles from Client.Proxy
+	Address string
+}
+
+// CreateProxy creates a proxy, see POST /proxy. It isn't retried once the request may have reached the server.
+func (client *Client) CreateProxy(ctx context.Context, create goharproxy.ProxyServerCreate) (*ProxyHandle, error) {
+	proxyServerPort := goharproxy.ProxyServerPort{}
+	if err := client.do(ctx, "POST", "/proxy", &create, false, &proxyServerPort); err != nil {
+		return nil, err
+	}
+	return &ProxyHandle{client : client, Port : proxyServerPort.Port, Name : proxyServerPort.Name, Address : proxyServerPort.Address}, nil
+}
+
+// ListProxies returns the server's proxies
+func (client *Client) ListProxies(ctx context.Context) ([]goharproxy.ProxyServerPort, error) {
+	var proxyServerPorts []goharproxy.ProxyServerPort
+	err := client.do(ctx, "GET", "/proxy", nil, true, &proxyServerPorts)
+	return proxyServerPorts, err
+}
+
+// Proxy returns a handle of the proxy on port, without checking that it exists
+func (client *Client) Proxy(port int) *ProxyHandle {
+	return &ProxyHandle{client : client, Port : port}
+}
+
+func (proxy *ProxyHandle) path(suffix string) string {
+	return "/proxy/" + strconv.Itoa(proxy.Port) + suffix
+}
+
+// Har returns the proxy's HAR log once the requests in progress were recorded, clearing it if clear.
+// A clearing call isn't retried once the request may have reached the server, as the entries would be lost.
+func (proxy *ProxyHandle) Har(ctx context.Context, clear bool) (*goharproxy.HarLog, error) {
+	harLog := &goharproxy.HarLog{}
+	method := "GET"
+	if clear {
+		method = "PUT"
+	}
+	if err := proxy.client.do(ctx, method, proxy.path("/har"), nil, !clear, harLog); err != nil {
+		return nil, err
+	}
+	return harLog, nil
+}
+
+// ClearHar clears the proxy's HAR log
+func (proxy *ProxyHandle) ClearHar(ctx context.Context) error {
+	return proxy.client.do(ctx, "PUT", proxy.path("/har"), nil, true, nil)
+}
+
+// AddHosts adds hosts entries after the proxy's current ones, see POST /proxy/[port]/hosts.
+// Invalid entries fail the call with an *Error whose Items say why, none of them are added then.
+func (proxy *ProxyHandle) AddHosts(ctx context.Context, hosts ...goharproxy.ProxyHosts) error {
+	if hosts == nil {
+		hosts = []goharproxy.ProxyHosts{}
+	}
+	return proxy.client.do(ctx, "POST", proxy.path("/hosts"), hosts, false, nil)
+}
+
+// SetCaptureSettings replaces the proxy's capture settings
+func (proxy *ProxyHandle) SetCaptureSettings(ctx context.Context, captureSettings goharproxy.CaptureSettings) error {
+	return proxy.client.do(ctx, "PUT", proxy.path("/captureSettings"), &captureSettings, true, nil)
+}
+
+// Status returns the proxy's status
+func (proxy *ProxyHandle) Status(ctx context.Context) (*goharproxy.ProxyServerStatus, error) {
+	status := &goharproxy.ProxyServerStatus{}
+	if err := proxy.client.do(ctx, "GET", proxy.path("/status"), nil, true, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// WaitForIdle waits until the proxy has no request in progress and no entry waiting to be recorded,
+// or ctx is done
+func (proxy *ProxyHandle) WaitForIdle(ctx context.Context) error {
+	for {
+		status, err := proxy.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if status.InFlightRequests == 0 && status.PendingEntries == 0 {
+			return nil
+		}
+		timer := time.NewTimer(IdlePollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Delete stops the proxy and removes it from the server
+func (proxy *ProxyHandle) Delete(ctx context.Context) error {
+	return proxy.client.do(ctx, "DELETE", proxy.path(""), nil, true, nil)
+}
+
+// Sends a request with body as json, if not nil, and decodes the response into result, if not nil.
+// Retries when the server can't be reached or is unavailable, and after other network errors if idempotent.
+func (client *Client) do(ctx context.Context, method, path string, body interface{}, idempotent bool, result interface{}) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	backoff := client.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := client.doOnce(ctx, method, path, encoded, idempotent, result)
+		if err == nil || !retry || attempt >= client.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// Returns whether a failed call may be sent again, with its error
+func (client *Client) doOnce(ctx context.Context, method, path string, body []byte, idempotent bool, result interface{}) (bool, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, client.baseUrl + path, reader)
+	if err != nil {
+		return false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if client.APIKey != "" {
+		req.Header.Set(goharproxy.APIKeyHeader, client.APIKey)
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return idempotent || notSent(err), err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		apiErr := &Error{StatusCode : resp.StatusCode}
+		proxyServerErr := goharproxy.ProxyServerErr{}
+		if json.NewDecoder(resp.Body).Decode(&proxyServerErr) == nil {
+			apiErr.Message, apiErr.Items = proxyServerErr.Error, proxyServerErr.Items
+		}
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true, apiErr
+		}
+		return false, apiErr
+	}
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return false, fmt.Errorf("goharproxy: decoding the response of %v %v: %w", method, path, err)
+	}
+	return false, nil
+}
+
+// Whether err is from before the request was sent, connecting to the server
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
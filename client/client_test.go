@@ -0,0 +1,201 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hellspam/goharproxy"
+	"github.com/Hellspam/goharproxy/client"
+)
+
+func newTestApi(t *testing.T) *httptest.Server {
+	proxyServer, err := goharproxy.NewProxyServerWithOptions(goharproxy.ProxyServerOptions{Logger : goharproxy.NopLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(proxyServer)
+	t.Cleanup(api.Close)
+	return api
+}
+
+func newTestUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello " + r.URL.Path[1:])
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// Gets rawUrl through proxy, returning the body
+func getThrough(t *testing.T, proxy *client.ProxyHandle, rawUrl string) string {
+	t.Helper()
+	proxyUrl, _ := url.Parse("http://" + proxy.Address)
+	transport := &http.Transport{Proxy : http.ProxyURL(proxyUrl)}
+	defer transport.CloseIdleConnections()
+	resp, err := (&http.Client{Transport : transport}).Get(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	api := newTestApi(t)
+	upstream := newTestUpstream(t)
+	c := client.New(api.URL + "/", nil)
+
+	proxy, err := c.CreateProxy(ctx, goharproxy.ProxyServerCreate{Name : "checkout", BindAddress : "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Port == 0 || proxy.Name != "checkout" || proxy.Address == "" {
+		t.Fatalf("Expected the created proxy but got: %+v", proxy)
+	}
+	proxies, err := c.ListProxies(ctx)
+	if err != nil || len(proxies) != 1 || proxies[0].Port != proxy.Port || proxies[0].Name != "checkout" {
+		t.Fatalf("Expected the created proxy to be listed but got: %+v, %v", proxies, err)
+	}
+
+	upstreamUrl, _ := url.Parse(upstream.URL)
+	if err := proxy.AddHosts(ctx, goharproxy.ProxyHosts{Host : "shop.example.com", NewHost : upstreamUrl.Host}); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.SetCaptureSettings(ctx, goharproxy.CaptureSettings{CaptureContent : true}); err != nil {
+		t.Fatal(err)
+	}
+	if body := getThrough(t, proxy, "http://shop.example.com/cart"); body != "hello cart" {
+		t.Fatalf("Expected the upstream's response through the hosts entry but got: %q", body)
+	}
+	if err := proxy.WaitForIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	harLog, err := proxy.Har(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := harLog.Entries()
+	if len(entries) != 1 || entries[0].Request.Url != "http://shop.example.com/cart" || entries[0].Response.Content.Text != "hello cart" {
+		t.Fatalf("Expected the entry with its content but got: %+v", entries)
+	}
+	if harLog, err = proxy.Har(ctx, true); err != nil || harLog.Len() != 1 {
+		t.Fatalf("Expected the entry to be kept by Har without clear but got: %v, %v", harLog, err)
+	}
+	if harLog, err = proxy.Har(ctx, false); err != nil || harLog.Len() != 0 {
+		t.Fatalf("Expected Har with clear to clear the log but got: %v, %v", harLog, err)
+	}
+
+	getThrough(t, proxy, "http://shop.example.com/checkout")
+	if err := proxy.WaitForIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := proxy.Status(ctx); err != nil || status.Entries != 1 {
+		t.Fatalf("Expected a recorded entry but got: %+v, %v", status, err)
+	}
+	if err := proxy.ClearHar(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if harLog, err = proxy.Har(ctx, false); err != nil || harLog.Len() != 0 {
+		t.Fatalf("Expected ClearHar to clear the log but got: %v, %v", harLog, err)
+	}
+
+	if err := proxy.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var apiErr *client.Error
+	if err := proxy.Delete(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 deleting the proxy again but got: %v", err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+	c := client.New(newTestApi(t).URL, nil)
+	proxy, err := c.CreateProxy(ctx, goharproxy.ProxyServerCreate{BindAddress : "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Delete(ctx)
+
+	var apiErr *client.Error
+	err = proxy.AddHosts(ctx, goharproxy.ProxyHosts{Host : "a.example.com", NewHost : "b.example.com"}, goharproxy.ProxyHosts{Host : "c.example.com"})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity || len(apiErr.Items) != 1 || apiErr.Items[0].Index != 1 {
+		t.Fatalf("Expected 422 with the invalid hosts entry but got: %#v", err)
+	}
+	err = proxy.SetCaptureSettings(ctx, goharproxy.CaptureSettings{MaxCaptureBytes : -1})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || !strings.Contains(apiErr.Message, "max capture bytes") {
+		t.Fatalf("Expected 400 for invalid capture settings but got: %v", err)
+	}
+	if _, err := c.CreateProxy(ctx, goharproxy.ProxyServerCreate{Port : proxy.Port}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected 409 creating a proxy on a used port but got: %v", err)
+	}
+}
+
+// Calls answered 503 are retried, with a doubling backoff, until they succeed or run out of retries
+func TestClientRetries(t *testing.T) {
+	var calls, unavailable int32
+	atomic.StoreInt32(&unavailable, 2)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.AddInt32(&unavailable, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `{"error" : "restarting"}`)
+			return
+		}
+		io.WriteString(w, `[{"port" : 8081}]`)
+	}))
+	defer api.Close()
+	c := client.New(api.URL, nil)
+	c.RetryBackoff = time.Millisecond
+
+	proxies, err := c.ListProxies(context.Background())
+	if err != nil || len(proxies) != 1 || proxies[0].Port != 8081 || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("Expected the list after 2 retries but got: %+v, %v after %v calls", proxies, err, calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&unavailable, 10)
+	var apiErr *client.Error
+	if _, err := c.ListProxies(context.Background()); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || apiErr.Message != "restarting" {
+		t.Fatalf("Expected the 503 once out of retries but got: %v", err)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 4 {
+		t.Fatal("Expected a call and 3 retries but got: ", calls)
+	}
+
+	// Cancelling the context stops the retries
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&unavailable, 10)
+	c.RetryBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if _, err := c.ListProxies(ctx); !errors.Is(err, context.DeadlineExceeded) || atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("Expected the deadline to stop the retries but got: %v after %v calls", err, calls)
+	}
+}
+
+func TestClientWaitForIdleTimeout(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"port" : 8081, "inFlightRequests" : 1}`)
+	}))
+	defer api.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+	defer cancel()
+	if err := client.New(api.URL, nil).Proxy(8081).WaitForIdle(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("Expected the deadline to stop waiting for a busy proxy but got: ", err)
+	}
+}
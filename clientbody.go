@@ -0,0 +1,88 @@
+package goharproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// The body of a proxied response as goproxy copies it to the client. Closing it, once the copy
+// is done or failed, sends the entry, so its time includes the transfer to the client.
+type clientBody struct {
+	io.ReadCloser
+	proxy *HarProxy
+	reqAndResp *reqAndResp
+
+	// Keeps what the client reads for the entry, nil when the content isn't captured or was captured before
+	capture *captureBuffer
+
+	// Done when the client went away, which also cancels the upstream request for transports
+	// watching its context. Others stop once goproxy fails to write to the client and closes the body,
+	// goproxy's transport reads the rest of the body then.
+	clientCtx context.Context
+
+	// Cancels the upstream request's context
+	cancel context.CancelFunc
+
+	// Only used by the goroutine copying the body
+	transferred int64
+	eof bool
+	readErr error
+
+	// goproxy closes the body twice
+	closeOnce sync.Once
+}
+
+func newClientBody(proxy *HarProxy, upstream io.ReadCloser, reqAndResp *reqAndResp, capture *captureBuffer, clientCtx context.Context, cancel context.CancelFunc) *clientBody {
+	return &clientBody {
+		ReadCloser 	: upstream,
+		proxy 		: proxy,
+		reqAndResp 	: reqAndResp,
+		capture 	: capture,
+		clientCtx 	: clientCtx,
+		cancel 		: cancel,
+	}
+}
+
+func (body *clientBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.transferred += int64(n)
+	if body.capture != nil {
+		body.capture.Write(p[:n])
+	}
+	if err == io.EOF {
+		body.eof = true
+	} else if err != nil {
+		body.readErr = err
+	}
+	return n, err
+}
+
+func (body *clientBody) Close() error {
+	err := http.ErrBodyReadAfterClose
+	body.closeOnce.Do(func() {
+		// Sent first, so reading the rest of the body doesn't delay nor time the entry
+		body.proxy.clientBodyClosed(body)
+		body.cancel()
+		err = body.ReadCloser.Close()
+	})
+	return err
+}
+
+// Sends the entry of a response whose body was copied to the client. Closed before the end,
+// without an upstream read error, means goproxy failed to write to the client.
+func (proxy *HarProxy) clientBodyClosed(body *clientBody) {
+	defer proxy.sending.done()
+	reqAndResp := body.reqAndResp
+	reqAndResp.end = proxy.clock.Now()
+	if body.capture != nil {
+		proxy.metrics.captured(int64(body.capture.Len()))
+	}
+	if !body.eof && (body.readErr == nil || body.clientCtx.Err() != nil) {
+		proxy.logger.Infof("Client of %v went away after %v bytes of the response", reqAndResp.req.URL, body.transferred)
+		reqAndResp.clientAborted = true
+		reqAndResp.transferred = body.transferred
+	}
+	proxy.sendEntry(*reqAndResp)
+}
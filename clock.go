@@ -0,0 +1,72 @@
+package goharproxy
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells proxies the time, for entry timestamps and durations and for their timeouts.
+// Set one with HarProxyOptions.Clock or ProxyServerOptions.Clock, e.g. testutil.FakeClock in tests.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer of a Clock, as time.Timer. It is an alias of an unnamed interface,
+// so clocks can implement Clock without importing this package.
+type Timer = interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// The time package's clock, used when no Clock is given
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (timer realTimer) C() <-chan time.Time {
+	return timer.timer.C
+}
+
+func (timer realTimer) Stop() bool {
+	return timer.timer.Stop()
+}
+
+func orRealClock(clock Clock) Clock {
+	if clock == nil {
+		return RealClock
+	}
+	return clock
+}
+
+// As context.WithTimeout, with timeout measured on clock. The context's error is context.Canceled either way.
+func withClockTimeout(parent context.Context, clock Clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	timer := clock.NewTimer(timeout)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,273 @@
+package goharproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The _custom field listing what cookie rules changed, e.g. "set request cookie session"
+const cookieChangesField = "cookieChanges"
+
+// Changes the cookies of matching requests and responses, e.g. to inject a session cookie or to keep
+// the browser under test from storing any, see HarProxyConfig.CookieRules. Every matching rule applies, in order.
+// The entry lists the changes in its _custom cookieChanges field.
+type CookieRule struct {
+	// Regular expression matched against the url the client requested, empty matches every request
+	UrlPattern 		string 				`json:"urlPattern,omitempty"`
+
+	// Request cookies set to their value, replacing the ones of the same name
+	Set 			map[string]string 	`json:"set,omitempty"`
+
+	// Names of the request cookies removed, * matches any characters
+	Remove 			[]string 			`json:"remove,omitempty"`
+
+	// Names of the cookies whose Set-Cookie response headers are removed, * matches any characters
+	RemoveSetCookie []string 			`json:"removeSetCookie,omitempty"`
+
+	// Override the attributes of the Set-Cookie headers left, e.g. secure false for a local http environment
+	Secure 			*bool 				`json:"secure,omitempty"`
+	HttpOnly 		*bool 				`json:"httpOnly,omitempty"`
+
+	// lax, strict or none, empty keeps the SameSite attribute
+	SameSite 		string 				`json:"sameSite,omitempty"`
+}
+
+var sameSites = map[string]http.SameSite {
+	"lax" 		: http.SameSiteLaxMode,
+	"strict" 	: http.SameSiteStrictMode,
+	"none" 		: http.SameSiteNoneMode,
+}
+
+func (rule CookieRule) validate() error {
+	if _, err := regexp.Compile(rule.UrlPattern); err != nil {
+		return fmt.Errorf("invalid urlPattern [%v]: %v", rule.UrlPattern, err)
+	}
+	for name := range rule.Set {
+		if name == "" || strings.ContainsAny(name, "=; ") {
+			return fmt.Errorf("invalid cookie name [%v]", name)
+		}
+	}
+	for _, name := range append(append([]string{}, rule.Remove...), rule.RemoveSetCookie...) {
+		if name == "" {
+			return errors.New("can't remove a cookie without name")
+		}
+	}
+	if _, ok := sameSites[rule.SameSite]; rule.SameSite != "" && !ok {
+		return fmt.Errorf("unknown sameSite [%v], expected lax, strict or none", rule.SameSite)
+	}
+	return nil
+}
+
+// A cookie rule as a proxy holds it, with its patterns compiled once when it is set
+type cookieRule struct {
+	CookieRule
+
+	urlPattern *regexp.Regexp
+	remove []*regexp.Regexp
+	removeSetCookie []*regexp.Regexp
+	// The names of Set, sorted
+	setNames []string
+	// Why the rule is invalid, it never matches then
+	err error
+}
+
+func newCookieRules(rules []CookieRule) []cookieRule {
+	compiled := make([]cookieRule, len(rules))
+	for i, rule := range rules {
+		compiled[i].CookieRule = rule
+		if compiled[i].err = rule.validate(); compiled[i].err != nil {
+			continue
+		}
+		compiled[i].urlPattern = regexp.MustCompile(rule.UrlPattern)
+		compiled[i].remove = compileNames(rule.Remove)
+		compiled[i].removeSetCookie = compileNames(rule.RemoveSetCookie)
+		for name := range rule.Set {
+			compiled[i].setNames = append(compiled[i].setNames, name)
+		}
+		sort.Strings(compiled[i].setNames)
+	}
+	return compiled
+}
+
+func cookieRulesOf(rules []cookieRule) []CookieRule {
+	cookieRules := make([]CookieRule, len(rules))
+	for i, rule := range rules {
+		cookieRules[i] = rule.CookieRule
+	}
+	return cookieRules
+}
+
+func (rule cookieRule) overridesAttributes() bool {
+	return rule.Secure != nil || rule.HttpOnly != nil || rule.SameSite != ""
+}
+
+// SetCookieRules replaces the proxy's cookie rules, they apply from the next request
+func (proxy *HarProxy) SetCookieRules(rules []CookieRule) error {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	compiled := newCookieRules(rules)
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.cookieRules = compiled
+	return nil
+}
+
+// CookieRules returns a copy of the cookie rules, in the order they are applied
+func (proxy *HarProxy) CookieRules() []CookieRule {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	return cookieRulesOf(proxy.cookieRules)
+}
+
+// The changes the cookie rules made to a request and its response, carried in the request's context
+// from the request middleware chain to the response one
+type cookieChanges struct {
+	// The url the rules are matched against, the one the client requested
+	clientUrl string
+	changes []string
+}
+
+type cookieChangesKey struct{}
+
+// Returns req carrying the record of its cookie changes, to call before the request middlewares run
+func withCookieChanges(req *http.Request) (*http.Request, *cookieChanges) {
+	changes := &cookieChanges{clientUrl : req.URL.String()}
+	return req.WithContext(context.WithValue(req.Context(), cookieChangesKey{}, changes)), changes
+}
+
+func (changes *cookieChanges) add(format string, args ...interface{}) {
+	if changes != nil {
+		changes.changes = append(changes.changes, fmt.Sprintf(format, args...))
+	}
+}
+
+// The cookie rules matching req, by the url its client requested when known
+func (proxy *HarProxy) matchCookieRules(req *http.Request) ([]*cookieRule, *cookieChanges) {
+	changes, _ := req.Context().Value(cookieChangesKey{}).(*cookieChanges)
+	requested := req.URL.String()
+	if changes != nil {
+		requested = changes.clientUrl
+	}
+	proxy.settingsLock.RLock()
+	rules := proxy.cookieRules
+	proxy.settingsLock.RUnlock()
+	var matched []*cookieRule
+	for i := range rules {
+		rule := &rules[i]
+		if rule.err != nil {
+			proxy.logger.Errorf("Skipping cookie rule %v: %v", i, rule.err)
+			continue
+		}
+		if rule.urlPattern.MatchString(requested) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched, changes
+}
+
+// Sets and removes the request cookies of the cookie rules matching req.
+// Cookies left untouched are sent on as they came, in their order.
+func rewriteRequestCookies(req *http.Request, harProxy *HarProxy) {
+	rules, changes := harProxy.matchCookieRules(req)
+	if len(rules) == 0 {
+		return
+	}
+	var cookies []string
+	for _, header := range req.Header["Cookie"] {
+		for _, cookie := range strings.Split(header, ";") {
+			if cookie = strings.TrimSpace(cookie); cookie != "" {
+				cookies = append(cookies, cookie)
+			}
+		}
+	}
+	changed := false
+	for _, rule := range rules {
+		kept := make([]string, 0, len(cookies) + len(rule.Set))
+		for _, cookie := range cookies {
+			name := strings.TrimSpace(strings.SplitN(cookie, "=", 2)[0])
+			if _, set := rule.Set[name]; set {
+				continue
+			}
+			if matchesName(rule.remove, name) {
+				changes.add("removed request cookie %v", name)
+				changed = true
+				continue
+			}
+			kept = append(kept, cookie)
+		}
+		for _, name := range rule.setNames {
+			kept = append(kept, name + "=" + rule.Set[name])
+			changes.add("set request cookie %v", name)
+			changed = true
+		}
+		cookies = kept
+	}
+	if !changed {
+		return
+	}
+	if len(cookies) == 0 {
+		req.Header.Del("Cookie")
+	} else {
+		req.Header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+}
+
+// Removes the Set-Cookie headers and overrides the attributes the cookie rules matching req ask for
+func rewriteResponseCookies(req *http.Request, resp *http.Response, harProxy *HarProxy) {
+	setCookies := resp.Header["Set-Cookie"]
+	if len(setCookies) == 0 {
+		return
+	}
+	rules, changes := harProxy.matchCookieRules(req)
+	if len(rules) == 0 {
+		return
+	}
+	kept := make([]string, 0, len(setCookies))
+	for _, setCookie := range setCookies {
+		parsed := (&http.Response{Header : http.Header{"Set-Cookie" : {setCookie}}}).Cookies()
+		if len(parsed) == 0 {
+			kept = append(kept, setCookie)
+			continue
+		}
+		cookie := parsed[0]
+		removed, overridden := false, false
+		for _, rule := range rules {
+			if matchesName(rule.removeSetCookie, cookie.Name) {
+				removed = true
+				break
+			}
+			if rule.Secure != nil {
+				cookie.Secure = *rule.Secure
+			}
+			if rule.HttpOnly != nil {
+				cookie.HttpOnly = *rule.HttpOnly
+			}
+			if rule.SameSite != "" {
+				cookie.SameSite = sameSites[rule.SameSite]
+			}
+			overridden = overridden || rule.overridesAttributes()
+		}
+		switch {
+		case removed:
+			changes.add("removed Set-Cookie %v", cookie.Name)
+		case overridden:
+			kept = append(kept, cookie.String())
+			changes.add("changed Set-Cookie %v to %v", cookie.Name, cookie.String())
+		default:
+			kept = append(kept, setCookie)
+		}
+	}
+	if len(kept) == 0 {
+		resp.Header.Del("Set-Cookie")
+	} else {
+		resp.Header["Set-Cookie"] = kept
+	}
+}
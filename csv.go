@@ -0,0 +1,133 @@
+package goharproxy
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// DefaultCSVColumns are the columns HarLog.WriteCSV writes when none are given
+var DefaultCSVColumns = []string{"startedDateTime", "method", "url", "status", "mimeType", "size", "time", "dns", "connect", "wait", "receive"}
+
+// The CSV columns, by name. Cells are left empty when the entry doesn't have the value,
+// e.g. without response, or with timings the HAR spec marks as not applicable (-1).
+var csvColumns = map[string]func(entry *HarEntry) string {
+	"startedDateTime" 	: func(entry *HarEntry) string { return entry.StartedDateTime.Format(time.RFC3339Nano) },
+	"pageRef" 			: func(entry *HarEntry) string { return entry.PageRef },
+	"method" 			: func(entry *HarEntry) string { return requestField(entry, func(request *HarRequest) string { return request.Method }) },
+	"url" 				: func(entry *HarEntry) string { return requestField(entry, func(request *HarRequest) string { return request.Url }) },
+	"status" 			: func(entry *HarEntry) string { return responseField(entry, func(response *HarResponse) string { return strconv.Itoa(response.Status) }) },
+	"mimeType" 			: func(entry *HarEntry) string { return responseField(entry, func(response *HarResponse) string { return mimeType(response) }) },
+	"size" 				: func(entry *HarEntry) string { return responseField(entry, func(response *HarResponse) string { return optionalInt(response.BodySize) }) },
+	"time" 				: func(entry *HarEntry) string { return strconv.FormatInt(entry.Time, 10) },
+	"blocked" 			: func(entry *HarEntry) string { return timing(entry, entry.Timings.Blocked) },
+	"dns" 				: func(entry *HarEntry) string { return timing(entry, entry.Timings.Dns) },
+	"connect" 			: func(entry *HarEntry) string { return timing(entry, entry.Timings.Connect) },
+	"ssl" 				: func(entry *HarEntry) string { return timing(entry, entry.Timings.Ssl) },
+	"send" 				: func(entry *HarEntry) string { return timing(entry, entry.Timings.Send) },
+	"wait" 				: func(entry *HarEntry) string { return timing(entry, entry.Timings.Wait) },
+	"receive" 			: func(entry *HarEntry) string { return timing(entry, entry.Timings.Receive) },
+	"serverIpAddress" 	: func(entry *HarEntry) string { return entry.ServerIpAddress },
+}
+
+// The columns whose cells are numbers, see entrySummary
+var numericCSVColumns = map[string]bool {
+	"status" : true, "size" : true, "time" : true, "blocked" : true, "dns" : true, "connect" : true,
+	"ssl" : true, "send" : true, "wait" : true, "receive" : true,
+}
+
+// The columns of entry as a json object, numbers as numbers and empty cells as null
+func entrySummary(entry *HarEntry, columns []string) map[string]interface{} {
+	summary := make(map[string]interface{}, len(columns))
+	for _, column := range columns {
+		value := csvColumns[column](entry)
+		switch {
+		case value == "":
+			summary[column] = nil
+		case numericCSVColumns[column]:
+			summary[column] = json.Number(value)
+		default:
+			summary[column] = value
+		}
+	}
+	return summary
+}
+
+func validateCSVColumns(columns []string) error {
+	for _, column := range columns {
+		if _, ok := csvColumns[column]; !ok {
+			return fmt.Errorf("unknown CSV column [%v]", column)
+		}
+	}
+	return nil
+}
+
+// WriteCSV streams a summary of the entries to w as CSV, a header row with the column names and a row per entry.
+// columns are written in the given order, DefaultCSVColumns when empty. Besides those, pageRef, blocked, ssl, send
+// and serverIpAddress are known, other names are an error.
+// Like WriteTo, entries added while writing are not written.
+func (harLog *HarLog) WriteCSV(w io.Writer, columns []string) (int64, error) {
+	if len(columns) == 0 {
+		columns = DefaultCSVColumns
+	}
+	if err := validateCSVColumns(columns); err != nil {
+		return 0, err
+	}
+	_, entries := harLog.snapshot()
+	counter := &countingWriter{w : w}
+	writer := csv.NewWriter(counter)
+	if err := writer.Write(columns); err != nil {
+		return counter.n, err
+	}
+	row := make([]string, len(columns))
+	for i := range entries {
+		for j, column := range columns {
+			row[j] = csvColumns[column](&entries[i])
+		}
+		if err := writer.Write(row); err != nil {
+			return counter.n, err
+		}
+	}
+	writer.Flush()
+	return counter.n, writer.Error()
+}
+
+func requestField(entry *HarEntry, field func(*HarRequest) string) string {
+	if entry.Request == nil {
+		return ""
+	}
+	return field(entry.Request)
+}
+
+func responseField(entry *HarEntry, field func(*HarResponse) string) string {
+	if entry.Response == nil {
+		return ""
+	}
+	return field(entry.Response)
+}
+
+func mimeType(response *HarResponse) string {
+	if response.Content == nil {
+		return ""
+	}
+	return response.Content.MimeType
+}
+
+// Sizes and timings are -1 when unknown
+func optionalInt(value int64) string {
+	if value < 0 {
+		return ""
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+// Entries without any timings recorded have all of them empty, rather than zero
+func timing(entry *HarEntry, value int64) string {
+	if entry.Timings == (HarTimings{}) {
+		return ""
+	}
+	return optionalInt(value)
+}
@@ -0,0 +1,93 @@
+package goharproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Headers which only apply to the recorded connection, or which curl sets from the command itself
+var curlSkippedHeaders = map[string]bool {
+	"Host" 					: true,
+	"Content-Length" 		: true,
+	"Connection" 			: true,
+	"Proxy-Connection" 		: true,
+	"Proxy-Authorization" 	: true,
+	"Keep-Alive" 			: true,
+	"Transfer-Encoding" 	: true,
+	"Te" 					: true,
+	"Trailer" 				: true,
+	"Upgrade" 				: true,
+}
+
+// ToCurl returns a shell command re-issuing the entry's request with curl, on one line.
+// Hop by hop and HTTP/2 pseudo headers are left out. Binary and multi line bodies are piped in through base64 -d.
+func (entry HarEntry) ToCurl() string {
+	harRequest := entry.Request
+	if harRequest == nil {
+		return ""
+	}
+	body := requestBody(harRequest)
+	args := []string{"curl"}
+	if harRequest.Method != "" && harRequest.Method != "GET" && !(harRequest.Method == "POST" && body != "") {
+		args = append(args, "-X", shellQuote(harRequest.Method))
+	}
+	args = append(args, shellQuote(harRequest.Url))
+	for _, header := range harRequest.Headers {
+		if curlSkippedHeaders[http.CanonicalHeaderKey(header.Name)] || strings.HasPrefix(header.Name, ":") {
+			continue
+		}
+		args = append(args, "-H", shellQuote(header.Name + ": " + header.Value))
+	}
+	if body == "" {
+		return strings.Join(args, " ")
+	}
+	if !pastable(body) {
+		args = append(args, "--data-binary", "@-")
+		return "printf %s " + shellQuote(base64.StdEncoding.EncodeToString([]byte(body))) + " | base64 -d | " + strings.Join(args, " ")
+	}
+	args = append(args, "--data-raw", shellQuote(body))
+	return strings.Join(args, " ")
+}
+
+// The recorded body, form params are encoded again when the text wasn't kept
+func requestBody(harRequest *HarRequest) string {
+	postData := harRequest.PostData
+	if postData == nil {
+		return ""
+	}
+	if postData.Text != "" || len(postData.Params) == 0 {
+		return postData.Text
+	}
+	form := url.Values{}
+	for _, param := range postData.Params {
+		form.Add(param.Name, param.Value)
+	}
+	return form.Encode()
+}
+
+// Bodies which can be quoted on the command line as they are
+func pastable(body string) bool {
+	if !utf8.ValidString(body) {
+		return false
+	}
+	for _, r := range body {
+		if unicode.IsControl(r) && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// Quotes s for POSIX shells, leaving it bare when that is safe
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_./:=@%+,", r)))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
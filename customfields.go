@@ -0,0 +1,75 @@
+package goharproxy
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Copies a request header to the entry's _custom fields, see HarProxyConfig.CustomHeaders
+type CustomHeader struct {
+	Header 	string 	`json:"header"`
+
+	// The name of the field, defaults to Header
+	Field 	string 	`json:"field,omitempty"`
+
+	// Remove the header before the request goes upstream and is recorded
+	Strip 	bool 	`json:"strip,omitempty"`
+}
+
+func (customHeader CustomHeader) validate() error {
+	if customHeader.Header == "" {
+		return errors.New("custom header requires a header name")
+	}
+	return nil
+}
+
+func (customHeader CustomHeader) field() string {
+	if customHeader.Field == "" {
+		return customHeader.Header
+	}
+	return customHeader.Field
+}
+
+// SetEntryMetadata sets a function computing custom fields from every request reaching the proxy,
+// before host entries and middlewares run. They are recorded in the entry's _custom fields,
+// overriding fields of the same name taken from CustomHeaders.
+// Only one function is active at a time, nil removes it.
+func (proxy *HarProxy) SetEntryMetadata(metadata func(*http.Request) map[string]interface{}) {
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.entryMetadata = metadata
+}
+
+// Collects the custom fields of req, then strips the headers configured so. Returns nil if there are none.
+func (proxy *HarProxy) customFields(req *http.Request) map[string]interface{} {
+	proxy.settingsLock.RLock()
+	customHeaders := proxy.customHeaders
+	metadata := proxy.entryMetadata
+	proxy.settingsLock.RUnlock()
+
+	var computed map[string]interface{}
+	if metadata != nil {
+		computed = metadata(req)
+	}
+	var fields map[string]interface{}
+	for _, customHeader := range customHeaders {
+		value := req.Header.Get(customHeader.Header)
+		if customHeader.Strip {
+			req.Header.Del(customHeader.Header)
+		}
+		if value == "" {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]interface{}, len(customHeaders) + len(computed))
+		}
+		fields[customHeader.field()] = value
+	}
+	if fields == nil {
+		return computed
+	}
+	for name, value := range computed {
+		fields[name] = value
+	}
+	return fields
+}
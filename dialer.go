@@ -0,0 +1,79 @@
+package goharproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+	"github.com/quantum/goproxy/transport"
+)
+
+// Tunes the connections a proxy keeps to upstream servers, see HarProxyOptions.UpstreamPool.
+// Zero values keep net/http's defaults: unlimited connections, 2 idle ones per host kept forever.
+type UpstreamPool struct {
+	// The most idle connections kept across all hosts
+	MaxIdleConns int 			`json:"maxIdleConns"`
+
+	// The most idle connections kept per host
+	MaxIdleConnsPerHost int 	`json:"maxIdleConnsPerHost"`
+
+	// The most connections per host, dialing, in use and idle, requests over it wait for one
+	MaxConnsPerHost int 		`json:"maxConnsPerHost"`
+
+	// How long an idle connection is kept
+	IdleConnTimeoutMs int64 	`json:"idleConnTimeoutMs"`
+}
+
+func (pool UpstreamPool) validate() error {
+	if pool.MaxIdleConns < 0 || pool.MaxIdleConnsPerHost < 0 || pool.MaxConnsPerHost < 0 || pool.IdleConnTimeoutMs < 0 {
+		return fmt.Errorf("invalid upstream pool %+v", pool)
+	}
+	return nil
+}
+
+// Upstream transport used when a proxy is given a DialContext or an UpstreamPool.
+// Reports the remote address of the connection the dialer returned.
+type dialingTransport struct {
+	*http.Transport
+}
+
+// Dials with a plain net.Dialer when dialContext is nil, pool may be nil
+func newDialingTransport(dialContext func(ctx context.Context, network, addr string) (net.Conn, error), pool *UpstreamPool) *dialingTransport {
+	if dialContext == nil {
+		dialContext = (&net.Dialer{}).DialContext
+	}
+	tr := &http.Transport {
+		Proxy 				: http.ProxyFromEnvironment,
+		DialContext 		: dialContext,
+		// We pass responses to our clients as is
+		DisableCompression 	: true,
+	}
+	if pool != nil {
+		tr.MaxIdleConns = pool.MaxIdleConns
+		tr.MaxIdleConnsPerHost = pool.MaxIdleConnsPerHost
+		tr.MaxConnsPerHost = pool.MaxConnsPerHost
+		tr.IdleConnTimeout = time.Duration(pool.IdleConnTimeoutMs) * time.Millisecond
+	}
+	return &dialingTransport{Transport : tr}
+}
+
+func (tr *dialingTransport) DetailedRoundTrip(req *http.Request) (*transport.RoundTripDetails, *http.Response, error) {
+	var remoteAddr net.Addr
+	trace := &httptrace.ClientTrace {
+		GotConn : func(info httptrace.GotConnInfo) {
+			remoteAddr = info.Conn.RemoteAddr()
+		},
+	}
+	resp, err := tr.Transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+	details := &transport.RoundTripDetails {
+		Host  : req.URL.Host,
+		Error : err,
+	}
+	if tcpAddr, ok := remoteAddr.(*net.TCPAddr); ok {
+		details.TCPAddr = tcpAddr
+	}
+	return details, resp, err
+}
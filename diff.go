@@ -0,0 +1,116 @@
+package goharproxy
+
+import (
+	"net/url"
+)
+
+// DiffOptions controls how DiffHarLogs matches and compares entries
+type DiffOptions struct {
+	// Match URLs without their query string
+	IgnoreQuery 	bool 				`json:"ignoreQuery"`
+
+	// Report matched entries which got slower by more than this many milliseconds, 0 only reports status changes
+	SlowerByMs 		int64 				`json:"slowerByMs"`
+
+	// Applied to URLs before matching, after IgnoreQuery
+	NormalizeUrl 	func(string) string `json:"-"`
+}
+
+func (opts DiffOptions) normalize(rawUrl string) string {
+	if opts.IgnoreQuery {
+		if parsed, err := url.Parse(rawUrl); err == nil {
+			parsed.RawQuery = ""
+			parsed.ForceQuery = false
+			rawUrl = parsed.String()
+		}
+	}
+	if opts.NormalizeUrl != nil {
+		rawUrl = opts.NormalizeUrl(rawUrl)
+	}
+	return rawUrl
+}
+
+// HarDiff reports how a second recording differs from a first one
+type HarDiff struct {
+	// Entries only in the second log
+	Added 	[]HarEntry 			`json:"added"`
+
+	// Entries only in the first log
+	Removed []HarEntry 			`json:"removed"`
+
+	// Matched entries whose status changed, or which got slower than DiffOptions.SlowerByMs allows
+	Changed []HarEntryChange 	`json:"changed"`
+}
+
+// How a matched entry changed, the status of an entry without response is 0
+type HarEntryChange struct {
+	Method 		string 	`json:"method"`
+	Url 		string 	`json:"url"`
+	StatusA 	int 	`json:"statusA"`
+	StatusB 	int 	`json:"statusB"`
+	TimeA 		int64 	`json:"timeA"`
+	TimeB 		int64 	`json:"timeB"`
+}
+
+// DiffHarLogs compares the entries of b against a. Entries are matched by method and normalized URL,
+// repeated requests are matched in the order they were recorded.
+func DiffHarLogs(a, b *HarLog, opts DiffOptions) HarDiff {
+	diff := HarDiff {
+		Added 	: []HarEntry{},
+		Removed : []HarEntry{},
+		Changed : []HarEntryChange{},
+	}
+	entriesA := a.Entries()
+	matched := make([]bool, len(entriesA))
+	unmatched := make(map[string][]int)
+	for i, entry := range entriesA {
+		key := diffKey(entry, opts)
+		unmatched[key] = append(unmatched[key], i)
+	}
+
+	for _, entryB := range b.Entries() {
+		key := diffKey(entryB, opts)
+		candidates := unmatched[key]
+		if len(candidates) == 0 {
+			diff.Added = append(diff.Added, entryB)
+			continue
+		}
+		unmatched[key] = candidates[1:]
+		matched[candidates[0]] = true
+		entryA := entriesA[candidates[0]]
+		statusA, statusB := entryStatus(entryA), entryStatus(entryB)
+		slower := opts.SlowerByMs > 0 && entryB.Time - entryA.Time > opts.SlowerByMs
+		if statusA != statusB || slower {
+			change := HarEntryChange {
+				StatusA : statusA,
+				StatusB : statusB,
+				TimeA 	: entryA.Time,
+				TimeB 	: entryB.Time,
+			}
+			if entryB.Request != nil {
+				change.Method, change.Url = entryB.Request.Method, entryB.Request.Url
+			}
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+	for i, entry := range entriesA {
+		if !matched[i] {
+			diff.Removed = append(diff.Removed, entry)
+		}
+	}
+	return diff
+}
+
+func diffKey(entry HarEntry, opts DiffOptions) string {
+	if entry.Request == nil {
+		return ""
+	}
+	return entry.Request.Method + " " + opts.normalize(entry.Request.Url)
+}
+
+func entryStatus(entry HarEntry) int {
+	if entry.Response == nil {
+		return 0
+	}
+	return entry.Response.Status
+}
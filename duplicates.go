@@ -0,0 +1,111 @@
+package goharproxy
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DuplicateOptions controls how HarLog.Duplicates tells requests apart
+type DuplicateOptions struct {
+	// Only entries whose url matches are compared, all of them when nil
+	UrlPattern 		*regexp.Regexp
+
+	// Compare urls without their query string
+	IgnoreQuery 	bool
+
+	// Query params whose name matches one of these are left out of the urls, e.g. ^_$ for jQuery's cache busters
+	IgnoreParams 	[]*regexp.Regexp
+
+	// Entries are duplicates of the first of their group if they started at most this long after it, 0 for any time apart
+	Window 			time.Duration
+}
+
+// HarDuplicates is a group of entries of the same request, see HarLog.Duplicates
+type HarDuplicates struct {
+	Method 		string 		`json:"method"`
+	// The url as compared, without the query or the params DuplicateOptions leaves out
+	Url 		string 		`json:"url"`
+	Count 		int 		`json:"count"`
+	// The entries' _id in the order they started, 0 for entries which weren't recorded by a proxy
+	EntryIds 	[]int64 	`json:"entryIds"`
+	// When the first and the last of them started
+	First 		time.Time 	`json:"first"`
+	Last 		time.Time 	`json:"last"`
+}
+
+// The url of an entry as compared, the query params left sorted by name
+func (opts DuplicateOptions) normalize(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	parsed.Fragment, parsed.RawFragment = "", ""
+	parsed.Scheme, parsed.Host = strings.ToLower(parsed.Scheme), strings.ToLower(parsed.Host)
+	query := parsed.Query()
+	if opts.IgnoreQuery {
+		query = nil
+	}
+	for name := range query {
+		for _, pattern := range opts.IgnoreParams {
+			if pattern.MatchString(name) {
+				delete(query, name)
+				break
+			}
+		}
+	}
+	parsed.RawQuery, parsed.ForceQuery = query.Encode(), false
+	return parsed.String()
+}
+
+// Duplicates returns the groups of current entries with the same method and url, as DuplicateOptions compares
+// them, which started within its window, those with the most entries first and then the earliest. Entries
+// alone in their group aren't returned. Requests in progress have no entry yet and aren't counted.
+func (harLog *HarLog) Duplicates(opts DuplicateOptions) []HarDuplicates {
+	_, entries := harLog.snapshot()
+	byRequest := make(map[string][]*HarEntry)
+	var keys []string
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Request == nil || opts.UrlPattern != nil && !opts.UrlPattern.MatchString(entry.Request.Url) {
+			continue
+		}
+		key := strings.ToUpper(entry.Request.Method) + " " + opts.normalize(entry.Request.Url)
+		if byRequest[key] == nil {
+			keys = append(keys, key)
+		}
+		byRequest[key] = append(byRequest[key], entry)
+	}
+
+	duplicates := []HarDuplicates{}
+	for _, key := range keys {
+		requests := byRequest[key]
+		sort.SliceStable(requests, func(i, j int) bool {
+			return requests[i].StartedDateTime.Before(requests[j].StartedDateTime)
+		})
+		method, normalized := key[:strings.Index(key, " ")], key[strings.Index(key, " ") + 1:]
+		for start := 0; start < len(requests); {
+			end := start + 1
+			for end < len(requests) && (opts.Window <= 0 || requests[end].StartedDateTime.Sub(requests[start].StartedDateTime) <= opts.Window) {
+				end++
+			}
+			if end - start > 1 {
+				group := HarDuplicates{Method : method, Url : normalized, Count : end - start, First : requests[start].StartedDateTime, Last : requests[end - 1].StartedDateTime}
+				for _, entry := range requests[start:end] {
+					group.EntryIds = append(group.EntryIds, entry.Id)
+				}
+				duplicates = append(duplicates, group)
+			}
+			start = end
+		}
+	}
+	sort.SliceStable(duplicates, func(i, j int) bool {
+		if duplicates[i].Count != duplicates[j].Count {
+			return duplicates[i].Count > duplicates[j].Count
+		}
+		return duplicates[i].First.Before(duplicates[j].First)
+	})
+	return duplicates
+}
@@ -0,0 +1,139 @@
+package goharproxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Fans out completed entries to the callbacks registered with OnEntry and the Subscribe channels
+type entryListeners struct {
+	lock 			sync.RWMutex
+	nextId 			int
+	callbacks 		map[int]func(HarEntry)
+	subscriptions 	map[int]*subscription
+	logger 			Logger
+
+	// Set once the proxy stopped recording, new subscriptions are closed right away
+	closed 			bool
+
+	// Entries dropped because a subscriber's buffer was full
+	dropped 		int64
+}
+
+func newEntryListeners(logger Logger) *entryListeners {
+	return &entryListeners {
+		callbacks 	  : make(map[int]func(HarEntry)),
+		subscriptions : make(map[int]*subscription),
+		logger 		  : logger,
+	}
+}
+
+// Registers callback and returns a func removing it, safe to call more than once
+func (listeners *entryListeners) add(callback func(HarEntry)) func() {
+	listeners.lock.Lock()
+	defer listeners.lock.Unlock()
+	id := listeners.nextId
+	listeners.nextId++
+	listeners.callbacks[id] = callback
+	return func() {
+		listeners.lock.Lock()
+		defer listeners.lock.Unlock()
+		delete(listeners.callbacks, id)
+	}
+}
+
+// Registers a channel receiving entries, full buffers drop entries rather than block the pipeline
+func (listeners *entryListeners) subscribe(buffer int) (<-chan HarEntry, func()) {
+	sub := &subscription{entries : make(chan HarEntry, buffer)}
+	listeners.lock.Lock()
+	if listeners.closed {
+		listeners.lock.Unlock()
+		sub.close()
+		return sub.entries, func() {}
+	}
+	id := listeners.nextId
+	listeners.nextId++
+	listeners.subscriptions[id] = sub
+	listeners.callbacks[id] = func(entry HarEntry) {
+		if !sub.send(entry) {
+			atomic.AddInt64(&listeners.dropped, 1)
+		}
+	}
+	listeners.lock.Unlock()
+
+	return sub.entries, func() {
+		listeners.lock.Lock()
+		delete(listeners.callbacks, id)
+		delete(listeners.subscriptions, id)
+		listeners.lock.Unlock()
+		sub.close()
+	}
+}
+
+// Closes every subscription, called once the last entry was notified
+func (listeners *entryListeners) close() {
+	listeners.lock.Lock()
+	listeners.closed = true
+	subscriptions := listeners.subscriptions
+	listeners.subscriptions = make(map[int]*subscription)
+	for id := range subscriptions {
+		delete(listeners.callbacks, id)
+	}
+	listeners.lock.Unlock()
+
+	for _, sub := range subscriptions {
+		sub.close()
+	}
+}
+
+func (listeners *entryListeners) notify(entry HarEntry) {
+	listeners.lock.RLock()
+	callbacks := make([]func(HarEntry), 0, len(listeners.callbacks))
+	for _, callback := range listeners.callbacks {
+		callbacks = append(callbacks, callback)
+	}
+	listeners.lock.RUnlock()
+
+	for _, callback := range callbacks {
+		listeners.notifyListener(callback, entry)
+	}
+}
+
+func (listeners *entryListeners) notifyListener(callback func(HarEntry), entry HarEntry) {
+	defer func() {
+		if e := recover(); e != nil {
+			listeners.logger.Errorf("Entry callback for %v panicked: %v", entry.Request.Url, e)
+		}
+	}()
+	callback(entry)
+}
+
+type subscription struct {
+	lock 	sync.Mutex
+	entries chan HarEntry
+	closed 	bool
+}
+
+// Returns false when the entry was dropped because the buffer is full
+func (sub *subscription) send(entry HarEntry) bool {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if sub.closed {
+		return true
+	}
+	select {
+	case sub.entries <- entry:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sub *subscription) close() {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if !sub.closed {
+		sub.closed = true
+		close(sub.entries)
+	}
+}
@@ -0,0 +1,154 @@
+package goharproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Continuously appends recorded entries to HAR files, see HarProxyOptions.Export
+type ExportOptions struct {
+	// The directory files are written to, created if missing
+	Dir string
+
+	// Rotate to a new file once the current one reaches this size in bytes, 0 means unlimited
+	MaxFileSize int64
+
+	// Rotate to a new file once the current one holds this many entries, 0 means unlimited
+	MaxEntries int
+}
+
+func (opts ExportOptions) validate() error {
+	if opts.Dir == "" {
+		return errors.New("export requires a directory")
+	}
+	if opts.MaxFileSize < 0 || opts.MaxEntries < 0 {
+		return fmt.Errorf("invalid export rotation [%v bytes, %v entries]", opts.MaxFileSize, opts.MaxEntries)
+	}
+	return nil
+}
+
+// Writes entries to the current export file, each file is a standalone HAR document once finalized
+type exportSink struct {
+	opts ExportOptions
+	logger Logger
+	// Names the files by the time they are created
+	clock Clock
+
+	lock sync.Mutex
+	file *os.File
+	encoder *json.Encoder
+	size int64
+	entries int
+
+	// Tells apart files created within the same timestamp
+	fileCount int
+}
+
+func newExportSink(opts ExportOptions, logger Logger, clock Clock) (*exportSink, error) {
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return &exportSink{opts : opts, logger : logger, clock : clock}, nil
+}
+
+// Appends entry, rotating afterwards if the current file is full
+func (sink *exportSink) write(port int, entry *HarEntry) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if err := sink.writeEntry(port, entry); err != nil {
+		sink.logger.Errorf("Exporting entry %v : %v", entry.Request.Url, err)
+		return
+	}
+	if (sink.opts.MaxEntries > 0 && sink.entries >= sink.opts.MaxEntries) ||
+		(sink.opts.MaxFileSize > 0 && sink.size >= sink.opts.MaxFileSize) {
+		sink.finalize()
+	}
+}
+
+// Must be called with lock held
+func (sink *exportSink) writeEntry(port int, entry *HarEntry) error {
+	if sink.file == nil {
+		if err := sink.open(port); err != nil {
+			return err
+		}
+	}
+	if sink.entries > 0 {
+		if err := sink.writeBytes([]byte{','}); err != nil {
+			return err
+		}
+	}
+	if err := sink.encoder.Encode(entry); err != nil {
+		return err
+	}
+	sink.entries++
+	return nil
+}
+
+// Must be called with lock held
+func (sink *exportSink) open(port int) error {
+	sink.fileCount++
+	name := fmt.Sprintf("har-%v-%v-%v.har", port, sink.clock.Now().Format("20060102T150405.000000000"), sink.fileCount)
+	file, err := os.Create(filepath.Join(sink.opts.Dir, name))
+	if err != nil {
+		return err
+	}
+	harLog := newHarLog()
+	header, err := openHarLogJson(harLogJson {
+		Version : harLog.Version,
+		Creator : harLog.Creator,
+		Browser : harLog.Browser,
+		Pages 	: harLog.Pages,
+	})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sink.file = file
+	sink.size = 0
+	sink.entries = 0
+	sink.encoder = json.NewEncoder(sinkWriter{sink})
+	return sink.writeBytes(header)
+}
+
+// Must be called with lock held
+func (sink *exportSink) writeBytes(p []byte) error {
+	_, err := sinkWriter{sink}.Write(p)
+	return err
+}
+
+// Must be called with lock held, completes the current file as a valid HAR document
+func (sink *exportSink) finalize() {
+	if sink.file == nil {
+		return
+	}
+	if err := sink.writeBytes(closeHarLogJson); err != nil {
+		sink.logger.Errorf("Finalizing export file %v : %v", sink.file.Name(), err)
+	}
+	if err := sink.file.Close(); err != nil {
+		sink.logger.Errorf("Closing export file %v : %v", sink.file.Name(), err)
+	}
+	sink.file = nil
+	sink.encoder = nil
+}
+
+// Finalizes the current file, later entries start a new one
+func (sink *exportSink) close() {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.finalize()
+}
+
+// Writes to the current file, keeping track of its size
+type sinkWriter struct {
+	sink *exportSink
+}
+
+func (writer sinkWriter) Write(p []byte) (int, error) {
+	n, err := writer.sink.file.Write(p)
+	writer.sink.size += int64(n)
+	return n, err
+}
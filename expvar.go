@@ -0,0 +1,86 @@
+package goharproxy
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Counters summed over every proxy of the process, published by EnableExpvar
+var totals struct {
+	requests 		int64
+	entries 		int64
+	captureBytes 	int64
+	errors 			int64
+}
+
+// Proxies currently serving, keyed by port
+var liveProxies = struct {
+	sync.RWMutex
+	byPort map[int]*HarProxy
+}{byPort : make(map[int]*HarProxy)}
+
+var expvarOnce sync.Once
+
+// EnableExpvar publishes the core counters under the "goharproxy" expvar map, served by
+// the expvar handler on /debug/vars. Nothing is published until it is called, further calls do nothing.
+func EnableExpvar() {
+	expvarOnce.Do(func() {
+		vars := expvar.NewMap("goharproxy")
+		vars.Set("active_proxies", expvar.Func(func() interface{} {
+			liveProxies.RLock()
+			defer liveProxies.RUnlock()
+			return len(liveProxies.byPort)
+		}))
+		vars.Set("total_requests", loadFunc(&totals.requests))
+		vars.Set("total_entries", loadFunc(&totals.entries))
+		vars.Set("capture_bytes", loadFunc(&totals.captureBytes))
+		vars.Set("errors", loadFunc(&totals.errors))
+		vars.Set("proxies", expvar.Func(proxiesSnapshot))
+	})
+}
+
+func loadFunc(counter *int64) expvar.Func {
+	return func() interface{} {
+		return atomic.LoadInt64(counter)
+	}
+}
+
+// The counters of each live proxy, keyed by port
+func proxiesSnapshot() interface{} {
+	liveProxies.RLock()
+	defer liveProxies.RUnlock()
+	snapshot := make(map[string]map[string]int64, len(liveProxies.byPort))
+	for port, harProxy := range liveProxies.byPort {
+		metrics := harProxy.metrics
+		var requests int64
+		for class := range metrics.requests {
+			requests += atomic.LoadInt64(&metrics.requests[class])
+		}
+		snapshot[strconv.Itoa(port)] = map[string]int64 {
+			"requests" 			: requests,
+			"entries" 			: int64(harProxy.HarLog.Len()),
+			"capture_bytes" 	: atomic.LoadInt64(&metrics.captureBytes),
+			"errors" 			: atomic.LoadInt64(&metrics.requests[errorClass]),
+			"in_flight" 		: atomic.LoadInt64(&metrics.inFlight),
+			"pending_entries" 	: atomic.LoadInt64(&metrics.pendingEntries),
+			"dropped_entries" 	: atomic.LoadInt64(&metrics.droppedEntries),
+		}
+	}
+	return snapshot
+}
+
+func registerLiveProxy(harProxy *HarProxy) {
+	liveProxies.Lock()
+	defer liveProxies.Unlock()
+	liveProxies.byPort[harProxy.Port] = harProxy
+}
+
+func unregisterLiveProxy(harProxy *HarProxy) {
+	liveProxies.Lock()
+	defer liveProxies.Unlock()
+	if liveProxies.byPort[harProxy.Port] == harProxy {
+		delete(liveProxies.byPort, harProxy.Port)
+	}
+}
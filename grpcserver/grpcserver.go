@@ -0,0 +1,310 @@
+// Package grpcserver serves the management API of a goharproxy.ProxyServer as the gRPC service of
+// proto/goharproxy.proto. It is kept apart so that goharproxy doesn't depend on gRPC:
+//
+//	proxyServer.AddAPIServer(9090, grpcserver.New(proxyServer))
+package grpcserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Hellspam/goharproxy"
+	pb "github.com/Hellspam/goharproxy/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The buffer of the subscription of a StreamEntries call, entries past it are dropped for that call
+const streamBuffer = 256
+
+// Server is the goharproxy.APIServer serving the gRPC API
+type Server struct {
+	grpcServer *grpc.Server
+}
+
+// Serves the calls with the exported ProxyServer calls the REST routes are backed by too
+type proxyService struct {
+	pb.UnimplementedProxyServiceServer
+	proxyServer *goharproxy.ProxyServer
+}
+
+// New creates the gRPC server of proxyServer's API, over TLS when proxyServer serves TLS. Calls are authenticated
+// with the API keys of the REST API, sent as x-api-key or authorization bearer metadata.
+func New(proxyServer *goharproxy.ProxyServer) *Server {
+	service := &proxyService{proxyServer : proxyServer}
+	grpcOpts := []grpc.ServerOption {
+		grpc.UnaryInterceptor(service.unaryInterceptor),
+		grpc.StreamInterceptor(service.streamInterceptor),
+	}
+	if tlsConfig := proxyServer.TLSConfig(); tlsConfig != nil {
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(grpcOpts...)
+	pb.RegisterProxyServiceServer(grpcServer, service)
+	return &Server{grpcServer : grpcServer}
+}
+
+func (server *Server) Serve(l net.Listener) error {
+	return server.grpcServer.Serve(l)
+}
+
+// Stop stops serving gracefully, the calls still running once ctx is done, e.g. entry streams, are cancelled
+func (server *Server) Stop(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		server.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		server.grpcServer.Stop()
+		<-stopped
+	}
+}
+
+// Returns ctx with the caller its key authenticates, Unauthenticated if the server has keys and the call none known
+func (service *proxyService) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(name string) string {
+		if values := md.Get(name); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	ctx, ok := service.proxyServer.Authenticate(ctx, first(strings.ToLower(goharproxy.APIKeyHeader)), first("authorization"))
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Missing or unknown API key")
+	}
+	return ctx, nil
+}
+
+func (service *proxyService) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := service.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (service *proxyService) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := service.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream : stream, ctx : ctx})
+}
+
+// A stream whose context carries its caller
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *authenticatedStream) Context() context.Context {
+	return stream.ctx
+}
+
+// The status of an error of the ProxyServer calls, from the HTTP status of the REST API
+func statusOf(err error) error {
+	apiErr := &goharproxy.APIError{}
+	if !errors.As(err, &apiErr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	code := codes.Internal
+	switch apiErr.Status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	}
+	return status.Error(code, apiErr.Message)
+}
+
+// Returns the proxy on port, NotFound if there is none and PermissionDenied if the caller doesn't own it
+func (service *proxyService) lookupProxy(ctx context.Context, port int32) (*goharproxy.HarProxy, error) {
+	harProxy, err := service.proxyServer.Proxy(ctx, int(port))
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	return harProxy, nil
+}
+
+func (service *proxyService) CreateProxy(ctx context.Context, req *pb.CreateProxyRequest) (*pb.Proxy, error) {
+	proxyCreate := goharproxy.ProxyServerCreate{Port : int(req.Port), BindAddress : req.BindAddress, Name : req.Name}
+	if req.CaptureSettings != nil {
+		// The rest of a new proxy's config is empty
+		proxyCreate.Config = &goharproxy.HarProxyConfig{CaptureSettings : captureSettingsOf(req.CaptureSettings)}
+	}
+	proxyServerPort, err := service.proxyServer.CreateProxy(ctx, proxyCreate)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	return protoProxy(proxyServerPort), nil
+}
+
+func (service *proxyService) DeleteProxy(ctx context.Context, req *pb.ProxyRef) (*pb.DeleteProxyResponse, error) {
+	if err := service.proxyServer.DeleteProxy(ctx, int(req.Port)); err != nil {
+		return nil, statusOf(err)
+	}
+	return &pb.DeleteProxyResponse{}, nil
+}
+
+func (service *proxyService) ListProxies(ctx context.Context, req *pb.ListProxiesRequest) (*pb.ListProxiesResponse, error) {
+	resp := &pb.ListProxiesResponse{}
+	for _, proxyServerPort := range service.proxyServer.Proxies(ctx) {
+		resp.Proxies = append(resp.Proxies, protoProxy(proxyServerPort))
+	}
+	return resp, nil
+}
+
+// Streams the recorded entries and clears them, like PUT /proxy/[port]/har. The entries are restored if the stream fails.
+func (service *proxyService) GetHar(req *pb.ProxyRef, stream pb.ProxyService_GetHarServer) error {
+	harProxy, err := service.lookupProxy(stream.Context(), req.Port)
+	if err != nil {
+		return err
+	}
+	entries, restore := harProxy.TakeEntries(stream.Context())
+	for _, entry := range entries {
+		if err := sendEntry(stream, entry); err != nil {
+			restore()
+			return err
+		}
+	}
+	return nil
+}
+
+func (service *proxyService) SetHosts(ctx context.Context, req *pb.SetHostsRequest) (*pb.SetHostsResponse, error) {
+	harProxy, err := service.lookupProxy(ctx, req.Port)
+	if err != nil {
+		return nil, err
+	}
+	hostEntries := make([]goharproxy.ProxyHosts, 0, len(req.Hosts))
+	for i, host := range req.Hosts {
+		hostEntry := goharproxy.ProxyHosts {
+			Host 				: host.Host,
+			NewHost 			: host.NewHost,
+			MatchType 			: host.MatchType,
+			NewScheme 			: host.NewScheme,
+			PreserveHostHeader 	: host.PreserveHostHeader,
+			RewriteLocation 	: host.RewriteLocation,
+		}
+		if hostEntry.Host == "" || hostEntry.NewHost == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "hosts entry %v: Host and NewHost can't be empty", i)
+		}
+		if err := hostEntry.Validate(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "hosts entry %v: %v", i, err)
+		}
+		hostEntries = append(hostEntries, hostEntry)
+	}
+	harProxy.AddHostEntries(hostEntries)
+	return &pb.SetHostsResponse{}, nil
+}
+
+func (service *proxyService) SetCaptureSettings(ctx context.Context, req *pb.SetCaptureSettingsRequest) (*pb.CaptureSettings, error) {
+	harProxy, err := service.lookupProxy(ctx, req.Port)
+	if err != nil {
+		return nil, err
+	}
+	captureSettings := captureSettingsOf(req.CaptureSettings)
+	if captureSettings.MaxCaptureBytes < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max capture bytes [%v]", captureSettings.MaxCaptureBytes)
+	}
+	harProxy.SetCaptureSettings(captureSettings)
+	return protoCaptureSettings(harProxy.CaptureSettings()), nil
+}
+
+// Streams the entries recorded from now on, like GET /proxy/[port]/har/stream, until the call is
+// cancelled or the proxy stops recording
+func (service *proxyService) StreamEntries(req *pb.ProxyRef, stream pb.ProxyService_StreamEntriesServer) error {
+	harProxy, err := service.lookupProxy(stream.Context(), req.Port)
+	if err != nil {
+		return err
+	}
+	entries, cancel := harProxy.Subscribe(streamBuffer)
+	defer cancel()
+	// Sent right away, so clients know the stream is open before the first entry
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case entry, ok := <-entries:
+			if !ok {
+				return nil
+			}
+			if err := sendEntry(stream, entry); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (service *proxyService) GetEntry(ctx context.Context, req *pb.EntryRef) (*pb.Entry, error) {
+	harProxy, err := service.lookupProxy(ctx, req.Port)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := harProxy.Entry(req.Id)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "No entry with id [%v]", req.Id)
+	}
+	return protoEntry(entry)
+}
+
+func sendEntry(stream interface{ Send(*pb.Entry) error }, entry goharproxy.HarEntry) error {
+	message, err := protoEntry(entry)
+	if err != nil {
+		return err
+	}
+	return stream.Send(message)
+}
+
+func protoEntry(entry goharproxy.HarEntry) (*pb.Entry, error) {
+	encoded, err := json.Marshal(&entry)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Encoding entry %v : %v", entry.Request.Url, err))
+	}
+	return &pb.Entry{Sequence : entry.Sequence, HarEntryJson : encoded, Id : entry.Id}, nil
+}
+
+func protoProxy(proxyServerPort goharproxy.ProxyServerPort) *pb.Proxy {
+	return &pb.Proxy {
+		Port 	: int32(proxyServerPort.Port),
+		Name 	: proxyServerPort.Name,
+		Address : proxyServerPort.Address,
+		Owner 	: proxyServerPort.Owner,
+	}
+}
+
+func captureSettingsOf(captureSettings *pb.CaptureSettings) goharproxy.CaptureSettings {
+	return goharproxy.CaptureSettings {
+		CaptureContent 					: captureSettings.GetCaptureContent(),
+		CaptureBeforeResponseMiddleware : captureSettings.GetCaptureBeforeResponseMiddleware(),
+		MaxCaptureBytes 				: captureSettings.GetMaxCaptureBytes(),
+		DisableRecording 				: captureSettings.GetDisableRecording(),
+	}
+}
+
+func protoCaptureSettings(captureSettings goharproxy.CaptureSettings) *pb.CaptureSettings {
+	return &pb.CaptureSettings {
+		CaptureContent 					: captureSettings.CaptureContent,
+		CaptureBeforeResponseMiddleware : captureSettings.CaptureBeforeResponseMiddleware,
+		MaxCaptureBytes 				: captureSettings.MaxCaptureBytes,
+		DisableRecording 				: captureSettings.DisableRecording,
+	}
+}
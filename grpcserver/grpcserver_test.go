@@ -0,0 +1,206 @@
+package grpcserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hellspam/goharproxy"
+	"github.com/Hellspam/goharproxy/grpcserver"
+	pb "github.com/Hellspam/goharproxy/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newTestUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello " + r.URL.Path[1:])
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestServer(t *testing.T) {
+	upstream := newTestUpstream(t)
+	proxyServer, err := goharproxy.NewProxyServerWithOptions(goharproxy.ProxyServerOptions {
+		APIKeys : map[string]string{"key-a" : "team-a", "key-b" : "team-b"},
+		Logger 	: goharproxy.NopLogger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpcserver.New(proxyServer)
+	if err := proxyServer.AddAPIServer(70000, server); err == nil {
+		t.Fatal("Expected an invalid port to be rejected")
+	}
+	if err := proxyServer.AddAPIServer(0, server); err != nil {
+		t.Fatal(err)
+	}
+	if proxyServer.APIServerAddr(server) != nil {
+		t.Fatal("Expected no address before Start but got: ", proxyServer.APIServerAddr(server))
+	}
+	if err := proxyServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxyServer.Shutdown(context.Background())
+	if err := proxyServer.AddAPIServer(0, grpcserver.New(proxyServer)); err != goharproxy.ErrAlreadyStarted {
+		t.Fatal("Expected servers added once started to be rejected but got: ", err)
+	}
+	addr, ok := proxyServer.APIServerAddr(server).(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatal("Expected the gRPC API on its port but got: ", proxyServer.APIServerAddr(server))
+	}
+
+	conn, err := grpc.NewClient(fmt.Sprintf("127.0.0.1:%v", addr.Port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewProxyServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+	ctxA := metadata.AppendToOutgoingContext(ctx, "x-api-key", "key-a")
+	ctxB := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer key-b")
+	expectCode := func(err error, code codes.Code) {
+		t.Helper()
+		if status.Code(err) != code {
+			t.Fatalf("Expected %v but got: %v", code, err)
+		}
+	}
+	decode := func(entry *pb.Entry) goharproxy.HarEntry {
+		t.Helper()
+		harEntry := goharproxy.HarEntry{}
+		if err := json.Unmarshal(entry.HarEntryJson, &harEntry); err != nil || harEntry.Id != entry.Id || harEntry.Sequence != entry.Sequence {
+			t.Fatal("Expected the entry as json with its id and sequence but got: ", string(entry.HarEntryJson), err)
+		}
+		return harEntry
+	}
+
+	_, err = client.ListProxies(ctx, &pb.ListProxiesRequest{})
+	expectCode(err, codes.Unauthenticated)
+	proxy, err := client.CreateProxy(ctxA, &pb.CreateProxyRequest{Name : "grpc", CaptureSettings : &pb.CaptureSettings{}})
+	if err != nil || proxy.Port == 0 || proxy.Name != "grpc" || proxy.Owner != "team-a" || proxy.Address == "" {
+		t.Fatal("Expected the created proxy but got: ", proxy, err)
+	}
+	_, err = client.CreateProxy(ctxA, &pb.CreateProxyRequest{Name : "grpc"})
+	expectCode(err, codes.AlreadyExists)
+	_, err = client.CreateProxy(ctxA, &pb.CreateProxyRequest{CaptureSettings : &pb.CaptureSettings{MaxCaptureBytes : -1}})
+	expectCode(err, codes.InvalidArgument)
+	if list, err := client.ListProxies(ctxB, &pb.ListProxiesRequest{}); err != nil || len(list.Proxies) != 0 {
+		t.Fatal("Expected team-b to see no proxy but got: ", list, err)
+	}
+	if list, err := client.ListProxies(ctxA, &pb.ListProxiesRequest{}); err != nil || len(list.Proxies) != 1 || list.Proxies[0].Port != proxy.Port {
+		t.Fatal("Expected team-a to see its proxy but got: ", list, err)
+	}
+	ref := &pb.ProxyRef{Port : proxy.Port}
+	_, err = client.DeleteProxy(ctxB, ref)
+	expectCode(err, codes.PermissionDenied)
+
+	_, err = client.SetHosts(ctxA, &pb.SetHostsRequest{Port : proxy.Port, Hosts : []*pb.HostEntry{{Host : "grpc.example.com"}}})
+	expectCode(err, codes.InvalidArgument)
+	if _, err := client.SetHosts(ctxA, &pb.SetHostsRequest{Port : proxy.Port, Hosts : []*pb.HostEntry {
+		{Host : "grpc.example.com", NewHost : strings.TrimPrefix(upstream.URL, "http://")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.SetCaptureSettings(ctxA, &pb.SetCaptureSettingsRequest{Port : proxy.Port, CaptureSettings : &pb.CaptureSettings{MaxCaptureBytes : -1}})
+	expectCode(err, codes.InvalidArgument)
+	captureSettings, err := client.SetCaptureSettings(ctxA, &pb.SetCaptureSettingsRequest{Port : proxy.Port, CaptureSettings : &pb.CaptureSettings{CaptureContent : true}})
+	if err != nil || !captureSettings.CaptureContent {
+		t.Fatal("Expected the capture settings set but got: ", captureSettings, err)
+	}
+
+	stream, err := client.StreamEntries(ctxA, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stream is open once its headers arrive
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", proxy.Port))
+	transport := &http.Transport{Proxy : http.ProxyURL(proxyUrl)}
+	defer transport.CloseIdleConnections()
+	resp, err := (&http.Client{Transport : transport}).Get("http://grpc.example.com/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	streamed, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := decode(streamed); entry.Request.Url != "http://grpc.example.com/bobo" || entry.Response.Content.Text != "hello bobo" {
+		t.Fatal("Expected the proxied request with its content but got: ", string(streamed.HarEntryJson))
+	}
+	if entry, err := client.GetEntry(ctxA, &pb.EntryRef{Port : proxy.Port, Id : streamed.Id}); err != nil || decode(entry).Id != streamed.Id {
+		t.Fatal("Expected the streamed entry by its id but got: ", entry, err)
+	}
+
+	har, err := client.GetHar(ctxA, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var drained []*pb.Entry
+	for {
+		entry, err := har.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		drained = append(drained, entry)
+	}
+	if len(drained) != 1 || drained[0].Id != streamed.Id {
+		t.Fatal("Expected the recorded entry but got: ", drained)
+	}
+	_, err = client.GetEntry(ctxA, &pb.EntryRef{Port : proxy.Port, Id : streamed.Id})
+	expectCode(err, codes.NotFound)
+
+	if _, err := client.DeleteProxy(ctxA, ref); err != nil {
+		t.Fatal(err)
+	}
+	// Deleting the proxy ends its streams
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatal("Expected the stream to end with the proxy but got: ", err)
+	}
+	if list, err := client.ListProxies(ctxA, &pb.ListProxiesRequest{}); err != nil || len(list.Proxies) != 0 {
+		t.Fatal("Expected the proxy to be deleted but got: ", list, err)
+	}
+	_, err = client.DeleteProxy(ctxA, ref)
+	expectCode(err, codes.NotFound)
+}
+
+func TestServerPortInUse(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	proxyServer, err := goharproxy.NewProxyServerWithOptions(goharproxy.ProxyServerOptions{Logger : goharproxy.NopLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpcserver.New(proxyServer)
+	proxyServer.AddAPIServer(l.Addr().(*net.TCPAddr).Port, server)
+	if err := proxyServer.Start(); err == nil {
+		proxyServer.Shutdown(context.Background())
+		t.Fatal("Expected Start to fail when the gRPC port is taken")
+	}
+	if proxyServer.APIServerAddr(server) != nil || proxyServer.Addr() != nil {
+		t.Fatal("Expected nothing left listening but got: ", proxyServer.APIServerAddr(server), proxyServer.Addr())
+	}
+}
@@ -0,0 +1,162 @@
+package goharproxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Responses shorter than this are sent as is, compressing them saves little
+const gzipMinSize = 1024
+
+// HAR logs compress well even at the fastest level, which keeps large HAR fetches streaming
+var gzipWriters = sync.Pool{New : func() interface{} {
+	writer, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+	return writer
+}}
+
+// Compresses the responses of next for clients accepting gzip, while they are written.
+// Upgraded connections and event streams are left alone.
+func gzipHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r) || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		gzipped := &gzipResponseWriter{ResponseWriter : w, status : http.StatusOK}
+		next.ServeHTTP(gzipped, r)
+		// Not deferred, a panicking handler aborts the response, it must not end like a complete one
+		gzipped.close()
+	})
+}
+
+// Whether r accepts the gzip content coding, explicitly or with *
+func acceptsGzip(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+		if coding = strings.TrimSpace(coding); coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Holds back the status and the first gzipMinSize bytes, then either compresses everything from there on
+// or, for short responses and ones which can't be compressed, writes them as they are
+type gzipResponseWriter struct {
+	http.ResponseWriter
+
+	status int
+	headerWritten bool
+	buffered []byte
+
+	// Set once the header went out, gzip is nil unless the body is compressed
+	decided bool
+	gzip *gzip.Writer
+}
+
+func (gzipped *gzipResponseWriter) WriteHeader(status int) {
+	if gzipped.headerWritten {
+		return
+	}
+	gzipped.status = status
+	gzipped.headerWritten = true
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified || !gzipped.compressible() {
+		gzipped.decide(false)
+	}
+}
+
+func (gzipped *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !gzipped.headerWritten {
+		gzipped.WriteHeader(http.StatusOK)
+	}
+	if gzipped.decided {
+		if gzipped.gzip != nil {
+			return gzipped.gzip.Write(p)
+		}
+		return gzipped.ResponseWriter.Write(p)
+	}
+	gzipped.buffered = append(gzipped.buffered, p...)
+	if len(gzipped.buffered) >= gzipMinSize {
+		if err := gzipped.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flushing sends what was held back, compressed as the response is meant to be streamed
+func (gzipped *gzipResponseWriter) Flush() {
+	if !gzipped.decided {
+		gzipped.decide(true)
+	}
+	if gzipped.gzip != nil {
+		gzipped.gzip.Flush()
+	}
+	if flusher, ok := gzipped.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (gzipped *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := gzipped.ResponseWriter.(http.Hijacker); ok && !gzipped.decided {
+		gzipped.decided = true
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("goharproxy: response can't be hijacked")
+}
+
+// Event streams are read as they come, and the handler may have encoded the body already
+func (gzipped *gzipResponseWriter) compressible() bool {
+	header := gzipped.Header()
+	return !strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") && header.Get("Content-Encoding") == ""
+}
+
+// Writes the header and what was held back, compressing it and what follows if compress
+func (gzipped *gzipResponseWriter) decide(compress bool) error {
+	gzipped.decided = true
+	if compress && gzipped.compressible() {
+		header := gzipped.Header()
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		gzipped.gzip = gzipWriters.Get().(*gzip.Writer)
+		gzipped.gzip.Reset(gzipped.ResponseWriter)
+	}
+	gzipped.ResponseWriter.WriteHeader(gzipped.status)
+	buffered := gzipped.buffered
+	gzipped.buffered = nil
+	if len(buffered) == 0 {
+		return nil
+	}
+	if gzipped.gzip != nil {
+		_, err := gzipped.gzip.Write(buffered)
+		return err
+	}
+	_, err := gzipped.ResponseWriter.Write(buffered)
+	return err
+}
+
+// Ends a response whose handler returned
+func (gzipped *gzipResponseWriter) close() {
+	if !gzipped.decided {
+		// Handlers which didn't write anything still get their status
+		gzipped.decide(false)
+	}
+	if gzipped.gzip != nil {
+		gzipped.gzip.Close()
+		gzipWriters.Put(gzipped.gzip)
+		gzipped.gzip = nil
+	}
+}
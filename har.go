@@ -5,17 +5,48 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"log"
-	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"encoding/json"
+	"io"
+	"bytes"
+	"fmt"
 )
 
 var startingEntrySize int = 1000
 
 type Har struct {
-	HarLog HarLog	`json:"harLog"`
+	HarLog *HarLog	`json:"harLog"`
 }
 
+// HarLog is safe for concurrent use, read the recorded entries with Entries, Len or EntriesSince
 type HarLog struct {
+	Version string			`json:"version"`
+	Creator string			`json:"creator"`
+	Browser string			`json:"browser"`
+	// Guarded by lock once the log is shared, e.g. by a proxy, add pages with AddPage then
+	Pages   []HarPage		`json:"pages"`
+
+	// Guarded by lock, serialized as "entries"
+	entries []HarEntry
+
+	// Sequence number of the last entry added, entries are numbered from 1 and never reused
+	seq int64
+
+	// Incremented each time the entries are cleared, see Generation
+	generation int64
+
+	// The bytes of captured bodies held by entries, changed with lock held and read with atomics, see CaptureBytes
+	captureBytes int64
+
+	// The entries before this index have no bodies left, where evicting bodies resumes
+	bodiesFrom int
+
+	lock sync.RWMutex
+}
+
+// The serialized form of HarLog
+type harLogJson struct {
 	Version string			`json:"version"`
 	Creator string			`json:"creator"`
 	Browser string			`json:"browser"`
@@ -29,25 +60,325 @@ func newHarLog() *HarLog {
 		Creator : "GoHarProxy 0.1",
 		Browser : "",
 		Pages 	: make([]HarPage, 0, 10),
-		Entries : makeNewEntries(),
+		entries : makeNewEntries(),
 	}
 	return &harLog
 }
 
 func (harLog *HarLog) addEntry(entry ...HarEntry) {
-	entries := harLog.Entries
-	m := len(entries)
-	n := m + len(entry)
-	if n > cap(entries) { // if necessary, reallocate
-		// allocate double what's needed, for future growth.
-		newEntries := make([]HarEntry, (n+1)*2)
-		copy(newEntries, entries)
-		entries = newEntries
+	harLog.lock.Lock()
+	defer harLog.lock.Unlock()
+	harLog.appendEntries(entry)
+}
+
+// Must be called with lock held. Appending only writes past the length of harLog.entries,
+// so slices of the entries taken before, by drain and snapshot, are never changed.
+func (harLog *HarLog) appendEntries(entry []HarEntry) {
+	harLog.entries = append(harLog.entries, entry...)
+	harLog.seq += int64(len(entry))
+	atomic.AddInt64(&harLog.captureBytes, sumBodyBytes(entry))
+}
+
+// AddPage adds page to the log, entries refer to it by its id with their pageRef
+func (harLog *HarLog) AddPage(page HarPage) {
+	harLog.lock.Lock()
+	defer harLog.lock.Unlock()
+	harLog.Pages = append(harLog.Pages, page)
+}
+
+// Adds page unless the log has a page with its id, returns whether it was added
+func (harLog *HarLog) addPageOnce(page HarPage) bool {
+	harLog.lock.Lock()
+	defer harLog.lock.Unlock()
+	for _, existing := range harLog.Pages {
+		if existing.Id == page.Id {
+			return false
+		}
+	}
+	harLog.Pages = append(harLog.Pages, page)
+	return true
+}
+
+// Removes the pages, the entries recorded keep referring to them
+func (harLog *HarLog) clearPages() {
+	harLog.lock.Lock()
+	defer harLog.lock.Unlock()
+	harLog.Pages = make([]HarPage, 0, 10)
+}
+
+// Entries returns a copy of the recorded entries. Entries are never modified once recorded,
+// so the copy shares their requests, responses and captured content with the log.
+func (harLog *HarLog) Entries() []HarEntry {
+	harLog.lock.RLock()
+	defer harLog.lock.RUnlock()
+	return copyEntries(harLog.entries)
+}
+
+// Len returns the number of recorded entries
+func (harLog *HarLog) Len() int {
+	harLog.lock.RLock()
+	defer harLog.lock.RUnlock()
+	return len(harLog.entries)
+}
+
+// EntriesSince returns a copy of the entries recorded after sequence number seq, and the
+// sequence number of the last recorded entry to pass on the next call. Start with 0.
+// Entries cleared before the call are not returned.
+func (harLog *HarLog) EntriesSince(seq int64) ([]HarEntry, int64) {
+	harLog.lock.RLock()
+	defer harLog.lock.RUnlock()
+	firstSeq := harLog.seq - int64(len(harLog.entries)) + 1
+	start := seq + 1 - firstSeq
+	if start < 0 {
+		start = 0
+	}
+	if start >= int64(len(harLog.entries)) {
+		return []HarEntry{}, harLog.seq
 	}
-	entries = entries[0:n]
-	copy(entries[m:n], entry)
-	harLog.Entries = entries
-	log.Println("Added entry ", entry[0].Request.Url)
+	return copyEntries(harLog.entries[start:]), harLog.seq
+}
+
+// EntriesBetween returns a copy of the entries which started at or after from and before to. Only the start
+// time counts, an entry which started before to is returned even if it ended after it. A zero from or to leaves
+// that side of the window open.
+func (harLog *HarLog) EntriesBetween(from, to time.Time) []HarEntry {
+	harLog.lock.RLock()
+	defer harLog.lock.RUnlock()
+	entries := []HarEntry{}
+	for i := range harLog.entries {
+		if startedBetween(&harLog.entries[i], from, to) {
+			entries = append(entries, harLog.entries[i])
+		}
+	}
+	return entries
+}
+
+func startedBetween(entry *HarEntry, from, to time.Time) bool {
+	return (from.IsZero() || !entry.StartedDateTime.Before(from)) && (to.IsZero() || entry.StartedDateTime.Before(to))
+}
+
+// Returns a log with the pages of this one and the entries keep selects, skipping offset of them and keeping
+// at most limit unless it is 0, with the number of entries selected before paging
+func (harLog *HarLog) selected(keep func(*HarEntry) bool, offset, limit int) (*HarLog, int) {
+	header, entries := harLog.snapshot()
+	selected := &HarLog{Version : header.Version, Creator : header.Creator, Browser : header.Browser, Pages : header.Pages, entries : []HarEntry{}}
+	matched := 0
+	for i := range entries {
+		if !keep(&entries[i]) {
+			continue
+		}
+		if matched >= offset && (limit == 0 || len(selected.entries) < limit) {
+			selected.entries = append(selected.entries, entries[i])
+		}
+		matched++
+	}
+	return selected, matched
+}
+
+// Entry returns a copy of the entry with id, see HarEntry.Id, false if there is none
+func (harLog *HarLog) Entry(id int64) (HarEntry, bool) {
+	harLog.lock.RLock()
+	defer harLog.lock.RUnlock()
+	// Entries are recorded in about the order of their ids, recent ones are looked up most
+	for i := len(harLog.entries) - 1; i >= 0; i-- {
+		if harLog.entries[i].Id == id {
+			return harLog.entries[i], true
+		}
+	}
+	return HarEntry{}, false
+}
+
+// Generation returns the number of times the entries were cleared. Entries recorded after a clear,
+// even of requests which started before it, belong to the next generation.
+func (harLog *HarLog) Generation() int64 {
+	harLog.lock.RLock()
+	defer harLog.lock.RUnlock()
+	return harLog.generation
+}
+
+func (harLog *HarLog) clear() {
+	harLog.lock.Lock()
+	defer harLog.lock.Unlock()
+	harLog.entries = makeNewEntries()
+	harLog.generation++
+	atomic.StoreInt64(&harLog.captureBytes, 0)
+	harLog.bodiesFrom = 0
+}
+
+// Returns a log holding the recorded entries and clears them, in one step. The drained log keeps the
+// generation of its entries, the entries recorded from then on belong to the next one.
+func (harLog *HarLog) drain() *HarLog {
+	harLog.lock.Lock()
+	defer harLog.lock.Unlock()
+	drained := &HarLog {
+		Version 	: harLog.Version,
+		Creator 	: harLog.Creator,
+		Browser 	: harLog.Browser,
+		Pages 		: harLog.Pages[:len(harLog.Pages):len(harLog.Pages)],
+		entries 	: harLog.entries,
+		seq 		: harLog.seq,
+		generation 	: harLog.generation,
+		captureBytes : harLog.captureBytes,
+	}
+	harLog.entries = makeNewEntries()
+	harLog.generation++
+	atomic.StoreInt64(&harLog.captureBytes, 0)
+	harLog.bodiesFrom = 0
+	return drained
+}
+
+// Puts the entries of drained, drained from this log, back before the ones recorded since, e.g. when exporting
+// them failed. They join the current generation. Does nothing if the log was cleared since, the entries were
+// meant to be dropped then.
+func (harLog *HarLog) restore(drained *HarLog) {
+	harLog.lock.Lock()
+	defer harLog.lock.Unlock()
+	if harLog.generation != drained.generation + 1 {
+		return
+	}
+	restored := make([]HarEntry, 0, len(drained.entries) + len(harLog.entries) + startingEntrySize)
+	restored = append(restored, drained.entries...)
+	harLog.entries = append(restored, harLog.entries...)
+	atomic.AddInt64(&harLog.captureBytes, drained.captureBytes)
+	harLog.bodiesFrom = 0
+}
+
+func (harLog *HarLog) MarshalJSON() ([]byte, error) {
+	harLog.lock.RLock()
+	serialized := harLogJson {
+		Version : harLog.Version,
+		Creator : harLog.Creator,
+		Browser : harLog.Browser,
+		Pages 	: harLog.Pages,
+		Entries : harLog.entries,
+	}
+	harLog.lock.RUnlock()
+	return json.Marshal(&serialized)
+}
+
+func (harLog *HarLog) UnmarshalJSON(data []byte) error {
+	serialized := harLogJson{}
+	if err := json.Unmarshal(data, &serialized); err != nil {
+		return err
+	}
+	harLog.lock.Lock()
+	defer harLog.lock.Unlock()
+	harLog.Version = serialized.Version
+	harLog.Creator = serialized.Creator
+	harLog.Browser = serialized.Browser
+	harLog.Pages = serialized.Pages
+	harLog.entries = serialized.Entries
+	harLog.seq = int64(len(serialized.Entries))
+	atomic.StoreInt64(&harLog.captureBytes, sumBodyBytes(serialized.Entries))
+	return nil
+}
+
+// WriteTo streams the log as JSON to w, entry by entry, without building the whole document in memory.
+// The lock is only held to take the current entry list, entries added meanwhile are not written.
+func (harLog *HarLog) WriteTo(w io.Writer) (int64, error) {
+	header, entries := harLog.snapshot()
+	counter := &countingWriter{w : w}
+	headerJson, err := openHarLogJson(header)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := counter.Write(headerJson); err != nil {
+		return counter.n, err
+	}
+	encoder := json.NewEncoder(counter)
+	for i := range entries {
+		if i > 0 {
+			if _, err := counter.Write([]byte{','}); err != nil {
+				return counter.n, err
+			}
+		}
+		if err := encoder.Encode(&entries[i]); err != nil {
+			return counter.n, err
+		}
+	}
+	_, err = counter.Write(closeHarLogJson)
+	return counter.n, err
+}
+
+// WriteJSONL streams the log as JSON Lines to w: a first line with the log without its entries,
+// then one line per entry, so each line can be decoded on its own. Like WriteTo, entries added
+// while writing are not written.
+func (harLog *HarLog) WriteJSONL(w io.Writer) (int64, error) {
+	header, entries := harLog.snapshot()
+	counter := &countingWriter{w : w}
+	encoder := json.NewEncoder(counter)
+	err := encoder.Encode(&harLogJsonlHeader {
+		Version : header.Version,
+		Creator : header.Creator,
+		Browser : header.Browser,
+		Pages 	: header.Pages,
+	})
+	if err != nil {
+		return counter.n, err
+	}
+	for i := range entries {
+		if err := encoder.Encode(&entries[i]); err != nil {
+			return counter.n, err
+		}
+	}
+	return counter.n, nil
+}
+
+// The first line written by WriteJSONL
+type harLogJsonlHeader struct {
+	Version string			`json:"version"`
+	Creator string			`json:"creator"`
+	Browser string			`json:"browser"`
+	Pages   []HarPage		`json:"pages"`
+}
+
+// Takes the log header and the current entry list, without copying the entries
+func (harLog *HarLog) snapshot() (harLogJson, []HarEntry) {
+	harLog.lock.RLock()
+	defer harLog.lock.RUnlock()
+	// Entries are only appended past this length or replaced by a new slice, never changed in place
+	entries := harLog.entries[:len(harLog.entries):len(harLog.entries)]
+	header := harLogJson {
+		Version : harLog.Version,
+		Creator : harLog.Creator,
+		Browser : harLog.Browser,
+		Pages 	: harLog.Pages,
+	}
+	return header, entries
+}
+
+// Serializes header up to the opening of its entries array
+func openHarLogJson(header harLogJson) ([]byte, error) {
+	header.Entries = nil
+	headerJson, err := json.Marshal(&header)
+	if err != nil {
+		return nil, err
+	}
+	// Reopen the serialized header to append the entries, it ends with "entries":null}
+	if !bytes.HasSuffix(headerJson, []byte("null}")) {
+		return nil, fmt.Errorf("goharproxy: unexpected HAR log header %s", headerJson)
+	}
+	return append(headerJson[:len(headerJson) - len("null}")], '['), nil
+}
+
+// Closes what openHarLogJson opened
+var closeHarLogJson = []byte("]}\n")
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (counter *countingWriter) Write(p []byte) (int, error) {
+	n, err := counter.w.Write(p)
+	counter.n += int64(n)
+	return n, err
+}
+
+func copyEntries(entries []HarEntry) []HarEntry {
+	copied := make([]HarEntry, len(entries))
+	copy(copied, entries)
+	return copied
 }
 
 func makeNewEntries() []HarEntry {
@@ -71,6 +402,42 @@ type HarEntry struct {
 	Timings         HarTimings		`json:"timings"`
 	ServerIpAddress string			`json:"serverIpAddress"`
 	Connection      string			`json:"connection"`
+	Comment         string			`json:"comment,omitempty"`
+	// Fields from CustomHeaders and SetEntryMetadata
+	Custom 			map[string]interface{}	`json:"_custom,omitempty"`
+	// Why the upstream round trip failed, the entry has no response then
+	Error 			string					`json:"_error,omitempty"`
+	// The order in which the proxy's responses completed, numbered from 1 per proxy.
+	// Entries are recorded concurrently, so the log may hold them slightly out of this order.
+	Sequence 		int64 					`json:"_sequence,omitempty"`
+	// Identifies the entry among those of its proxy, numbered from 1 in the order they were recorded.
+	// Ids keep increasing when the entries are cleared, they are never reused, see HarProxy.Entry.
+	Id 				int64 					`json:"_id,omitempty"`
+	// Whether the client went away before the whole response was sent,
+	// the response's bodySize is what it got then and the time when it went away
+	ClientAborted 	bool 					`json:"_clientAborted,omitempty"`
+	// Why the captured bodies were left out: "budget" when the proxy's capture budget was used up,
+	// "evicted" when they were dropped to make room for newer entries
+	CaptureSkipped 	string 					`json:"_captureSkipped,omitempty"`
+	// The name of the latency rule which delayed the response, see LatencyRule
+	LatencyRule 	string 					`json:"_latencyRule,omitempty"`
+	// The upstream status when a status rewrite changed the one the client got, see StatusRewrite
+	OriginalStatus 	int 					`json:"_originalStatus,omitempty"`
+	// Whether the request was answered with 429 by the proxy's rate limit, see RateLimit
+	RateLimited 	bool 					`json:"_rateLimited,omitempty"`
+	// The Location header as upstream sent it and as the client got it, when a host entry rewrote it, see ProxyHosts.RewriteLocation
+	LocationRewrite *LocationRewrite 		`json:"_locationRewrite,omitempty"`
+	// Whether the response is a recorded one the proxy's stub served, see StubOptions
+	Stubbed 		bool 					`json:"_stubbed,omitempty"`
+	// Whether the request was sent on an upstream connection of earlier requests, which then share its Connection,
+	// and whether that connection was idle in the transport's pool
+	ConnectionReused 	bool 				`json:"_connectionReused,omitempty"`
+	ConnectionWasIdle 	bool 				`json:"_connectionWasIdle,omitempty"`
+}
+
+type LocationRewrite struct {
+	Original 	string 	`json:"original"`
+	Rewritten 	string 	`json:"rewritten"`
 }
 
 type HarRequest struct {
@@ -83,11 +450,17 @@ type HarRequest struct {
 	PostData       *HarPostData			`json:"postData"`
 	BodySize       int64				`json:"bodySize"`
 	HeadersSize    int64				`json:"headersSize"`
+	// The url the client asked for when the query sent upstream differs, e.g. because of a query rewrite.
+	// Url has the query sent upstream.
+	OriginalUrl    string				`json:"_originalUrl,omitempty"`
+	// The URL actually requested when a host entry or middleware changed more than its query, Url keeps the host the client asked for
+	RewrittenTo    string				`json:"_rewrittenTo,omitempty"`
 }
 
+// Default capture setting for newly created proxies
 var captureContent bool = false
 
-func parseRequest(req *http.Request) *HarRequest {
+func parseRequest(req *http.Request, captureContent bool, logger Logger) *HarRequest {
 	if req == nil {
 		return nil
 	}
@@ -103,7 +476,7 @@ func parseRequest(req *http.Request) *HarRequest {
 	}
 
 	if captureContent && (req.Method == "POST" || req.Method == "PUT") {
-		harRequest.PostData = parsePostData(req)
+		harRequest.PostData = parsePostData(req, logger)
 	}
 
 	return &harRequest
@@ -120,10 +493,10 @@ func calcHeaderSize(header http.Header) int64 {
 	return int64(headerSize)
 }
 
-func parsePostData(req *http.Request) *HarPostData {
+func parsePostData(req *http.Request, logger Logger) *HarPostData {
 	defer func() {
 		if e := recover(); e != nil {
-			log.Printf("Error parsing request to %v: %v\n", req.URL, e)
+			logger.Errorf("Error parsing request to %v: %v", req.URL, e)
 		}
 	}()
 
@@ -146,9 +519,8 @@ func parsePostData(req *http.Request) *HarPostData {
 			index++
 		}
 		harPostData.Params = params
-	} else {
-		str, _ := ioutil.ReadAll(req.Body)
-		harPostData.Text = string(str)
+	} else if req.Body != nil {
+		harPostData.Text, harPostData.Truncated = bodyText(req.Body)
 	}
 	return harPostData
 }
@@ -199,7 +571,7 @@ type HarResponse struct {
 	HeadersSize        int64				`json:"headersSize"`
 }
 
-func parseResponse(resp *http.Response) *HarResponse {
+func parseResponse(resp *http.Response, captureContent bool, logger Logger) *HarResponse {
 	if resp == nil {
 		return nil
 	}
@@ -214,18 +586,22 @@ func parseResponse(resp *http.Response) *HarResponse {
 		BodySize		: resp.ContentLength,
 		HeadersSize		: calcHeaderSize(resp.Header),
 	}
+	// The advertised Content-Length stays in the headers, but no body was sent
+	if bodilessResponse(resp) {
+		harResponse.BodySize = 0
+	}
 
 	if captureContent {
-		harResponse.Content = parseContent(resp)
+		harResponse.Content = parseContent(resp, logger)
 	}
 
 	return &harResponse
 }
 
-func parseContent(resp *http.Response) *HarContent{
+func parseContent(resp *http.Response, logger Logger) *HarContent{
 	defer func() {
 		if e := recover(); e != nil {
-			log.Printf("Error parsing response to %v: %v\n", resp.Request.URL, e)
+			logger.Errorf("Error parsing response to %v: %v", resp.Request.URL, e)
 		}
 	}()
 
@@ -235,16 +611,23 @@ func parseContent(resp *http.Response) *HarContent{
 		panic("Missing content type in response")
 	}
 	harContent.MimeType = contentType[0]
-	if (resp.ContentLength <= 0) {
-		log.Println("Empty content")
+	if (resp.Body == nil || resp.ContentLength == 0 || bodilessResponse(resp)) {
+		logger.Debugf("Empty content for %v", resp.Request.URL)
 		return nil
 	}
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	harContent.Text = string(body)
+	harContent.Text, harContent.Truncated = bodyText(resp.Body)
 	return harContent
 }
 
+// Whether resp has no body whatever its headers say, as answers to HEAD requests and 1xx, 204 and 304 responses
+func bodilessResponse(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == "HEAD" {
+		return true
+	}
+	return resp.StatusCode / 100 == 1 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified
+}
+
 type HarCookie struct {
 	Name     string			`json:"name"`
 	Value    string			`json:"value"`
@@ -264,6 +647,8 @@ type HarPostData struct {
 	MimeType string					`json:"mimeType"`
 	Params   []HarPostDataParam		`json:"params"`
 	Text     string					`json:"text"`
+	// Whether Text is cut at CaptureSettings.MaxCaptureBytes
+	Truncated bool 					`json:"_truncated,omitempty"`
 }
 
 type HarPostDataParam struct {
@@ -279,6 +664,8 @@ type HarContent struct {
 	MimeType    string		`json:"mimeType"`
 	Text        string		`json:"text"`
 	Encoding    string		`json:"encoding"`
+	// Whether Text is cut at CaptureSettings.MaxCaptureBytes
+	Truncated 	bool 		`json:"_truncated,omitempty"`
 }
 
 type HarPageTimings struct {
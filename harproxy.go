@@ -3,7 +3,9 @@ package goharproxy
 import (
 	"net"
 	"net/http"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"log"
 	"strconv"
 	"io"
@@ -12,8 +14,15 @@ import (
 	"fmt"
 	"encoding/json"
 	"bytes"
-	"io/ioutil"
+	"bufio"
 	"time"
+	"errors"
+	"syscall"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"compress/gzip"
+	"runtime"
 	"github.com/quantum/goproxy"
 	"github.com/quantum/goproxy/transport"
 )
@@ -29,6 +38,9 @@ type HarProxy struct {
 	// The port our proxy is listening on
 	Port int
 
+	// Optional unique label, lets the proxy be addressed as /proxy/name/[name]
+	Name string
+
 	// Our HAR log.
 	// Starting size of 1000 entries, enlarged if necessary
 	// Read the specification here: http://www.softwareishard.com/blog/har-12-spec/
@@ -37,11 +49,65 @@ type HarProxy struct {
 	// Stoppable listener - used to stop http proxy
 	StoppableListener *stoppableListener
 
-	// This channel is used to signal when the http.Serve function is done serving our proxy
+	// Serves the proxy, created on Start
+	server *http.Server
+
+	// This channel is closed when the http.Serve function is done serving our proxy
 	isDone chan bool
 
+	// This channel is closed when all entries were processed after the entry channel was closed
+	entriesDone chan bool
+
+	// Entry processing is started on first use
+	processingOnce sync.Once
+
+	// Where the proxy is in its lifecycle, guarded by stateLock
+	state proxyState
+	stateLock sync.Mutex
+
 	// Stores hosts we want to redirect to a different ip / host
-	hostEntries []ProxyHosts
+	hostEntries []hostEntry
+
+	// Delay the responses of matching requests, see LatencyRule
+	latencyRules []latencyRule
+
+	// Change the status of matching responses, see StatusRewrite
+	statusRewrites []statusRewrite
+
+	// Change the query parameters of matching requests, see QueryRewrite
+	queryRewrites []queryRewrite
+
+	// Change the cookies of matching requests and responses, see CookieRule
+	cookieRules []cookieRule
+
+	// Post to urls when recorded entries match, see WebhookRule
+	webhookRules []webhookRule
+	webhookCounters webhookCounters
+	// Holds a value per webhook post in flight
+	webhookSlots chan struct{}
+	// Cancelled once the proxy stopped, ending the retries of webhook posts
+	webhookCtx context.Context
+	cancelWebhooks context.CancelFunc
+
+	// The page of the HAR log new entries refer to, see NewPage
+	pageRef string
+	// The request header setting the page of its entry, see HarProxyConfig.PageHeader
+	pageHeader string
+
+	// The state of the BrowserMob compatible API, nil unless the management server has it enabled
+	browserMob *browserMobState
+
+	// Takes the random decisions of the rules, e.g. which responses a percentage applies to
+	random *lockedRand
+
+	// Limits the requests of each client, nil without a rate limit
+	rateLimiter *rateLimiter
+
+	// Caps the upstream requests in flight, nil without connection limits
+	connectionLimiter *connectionLimiter
+
+	// Redacts the captured bodies, nil without body redactions
+	bodyRedactor *bodyRedactor
 
 
 	// We use this channel to receive a request and response from the proxy.
@@ -49,10 +115,425 @@ type HarProxy struct {
 	// to arrive at the same time.
 	entryChannel chan reqAndResp
 
-	// This is the count of entries we are currently waiting to finish processing
-	entriesInProcess int
+	// The capacity of entryChannel, and whether sendEntry drops entries instead of waiting for room
+	entryBuffer int
+	dropOverflow bool
+
+	// The number of goroutines receiving from entryChannel
+	entryWorkers int
+
+	// The most bytes of captured bodies the HAR log holds, 0 means unlimited, and whether the
+	// oldest bodies make room for new ones instead of the new entries being recorded without theirs
+	captureBudget int64
+	evictBodies bool
+
+	// Sequence number of the last entry put in entryChannel, see HarEntry.Sequence
+	entrySeq int64
+	// Id of the last recorded entry, see HarEntry.Id
+	entryId int64
+
+	// Fills the server ip of entries without the connected address
+	resolver *ipResolver
+
+	// Senders hold a read lock so the channel is never closed under them
+	entryChannelClosed bool
+	entryChannelLock sync.RWMutex
+
+	// The requests whose entries we are waiting for, see WaitForEntries
+	pending *pendingEntries
+
+	// The requests whose response arrived, until their entry is in the entry channel.
+	// Stopping waits for them before closing the channel, requests still waiting for upstream are dropped.
+	sending *pendingEntries
+
+	// Callbacks registered with OnEntry
+	entryListeners *entryListeners
+
+	// What parts of the traffic we record, guarded by settingsLock
+	captureSettings CaptureSettings
+
+	// The maximum number of entries kept in the HAR log, 0 means unlimited.
+	// Entries arriving after the limit is reached are dropped.
+	maxEntries int
+
+	// The host / ip we bind to, empty means all interfaces
+	bindAddr string
+
+	// Final gate over built entries, see SetEntryFilter
+	entryFilter func(*HarEntry) bool
+
+	// Request headers recorded as custom entry fields, and the func computing more of them, see SetEntryMetadata
+	customHeaders []CustomHeader
+	entryMetadata func(*http.Request) map[string]interface{}
+
+	// Makes the upstream round trips
+	transport http.RoundTripper
+	// The Transport, DialContext and UpstreamPool options, for Clone. A Transport given is shared with the clones,
+	// one the proxy built isn't, each clone building its own connection pool.
+	givenTransport http.RoundTripper
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	upstreamPool *UpstreamPool
+
+	// Receives everything this proxy logs
+	logger Logger
+	// Whether proxied requests are logged, see HarProxyOptions.AccessLog
+	accessLog bool
+
+	// Times the entries and the waits for them
+	clock Clock
+
+	// Exposed by the management server's /metrics endpoint
+	metrics *proxyMetrics
+
+	// Posts recorded entries to a collector, nil without sink, see SetSink
+	sink *httpSink
+	sinkCounters sinkCounters
+
+	// Sends the metrics of recorded entries, nil unless set, see SetStatsd
+	statsd *statsdClient
+	statsdCounters statsdCounters
+
+	// Exports recorded entries as spans, nil unless set, see SetTracing
+	tracing *httpSink
+	tracingOptions *TracingOptions
+	tracingCounters sinkCounters
+
+	// Answers requests with recorded responses, nil unless set, see SetStub
+	stub *httpStub
+	stubCounters stubCounters
+
+	// Writes recorded entries to files, nil unless HarProxyOptions.Export is set
+	exportOptions *ExportOptions
+	export *exportSink
+
+	// Added with UseRequest, run after the built in host replacement
+	requestMiddlewares []RequestMiddleware
+
+	// Added with UseResponse
+	responseMiddlewares []ResponseMiddleware
+
+	// Guards the proxy configuration - host entries, capture settings and custom headers
+	settingsLock sync.RWMutex
+
+	// The error http.Serve returned, if serving stopped for any reason other than Stop
+	serveErr error
+	serveErrLock sync.Mutex
+}
+
+// HarProxyConfig describes every configurable aspect of a proxy.
+// It can be exported from a proxy and applied to another one.
+type HarProxyConfig struct {
+	Hosts 			[]ProxyHosts 		`json:"hosts"`
+	CaptureSettings CaptureSettings		`json:"captureSettings"`
+	MaxEntries 		int 				`json:"maxEntries"`
+	CustomHeaders 	[]CustomHeader 		`json:"customHeaders,omitempty"`
+	LatencyRules 	[]LatencyRule 		`json:"latencyRules,omitempty"`
+	StatusRewrites 	[]StatusRewrite 	`json:"statusRewrites,omitempty"`
+	RateLimit 		*RateLimit 			`json:"rateLimit,omitempty"`
+	Limits 			*ConnectionLimits 	`json:"limits,omitempty"`
+	BodyRedactions 	*BodyRedactions 	`json:"bodyRedactions,omitempty"`
+	QueryRewrites 	[]QueryRewrite 		`json:"queryRewrites,omitempty"`
+	CookieRules 	[]CookieRule 		`json:"cookieRules,omitempty"`
+	Webhooks 		[]WebhookRule 		`json:"webhooks,omitempty"`
+	Sink 			*SinkOptions 		`json:"sink,omitempty"`
+	Statsd 			*StatsdOptions 		`json:"statsd,omitempty"`
+	Tracing 		*TracingOptions 	`json:"tracing,omitempty"`
+	// The request header whose value is the page of the request's entry, DefaultPageHeader when empty, "-" for none
+	PageHeader 		string 				`json:"pageHeader,omitempty"`
+}
+
+func (config HarProxyConfig) validate() error {
+	if config.CaptureSettings.MaxCaptureBytes < 0 {
+		return fmt.Errorf("invalid max capture bytes [%v]", config.CaptureSettings.MaxCaptureBytes)
+	}
+	if strings.ContainsAny(config.PageHeader, " \t\r\n:") {
+		return fmt.Errorf("invalid page header [%v]", config.PageHeader)
+	}
+	for _, hostEntry := range config.Hosts {
+		if err := hostEntry.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, customHeader := range config.CustomHeaders {
+		if err := customHeader.validate(); err != nil {
+			return err
+		}
+	}
+	for _, latencyRule := range config.LatencyRules {
+		if err := latencyRule.validate(); err != nil {
+			return err
+		}
+	}
+	for _, statusRewrite := range config.StatusRewrites {
+		if err := statusRewrite.validate(); err != nil {
+			return err
+		}
+	}
+	for _, queryRewrite := range config.QueryRewrites {
+		if err := queryRewrite.validate(); err != nil {
+			return err
+		}
+	}
+	for _, cookieRule := range config.CookieRules {
+		if err := cookieRule.validate(); err != nil {
+			return err
+		}
+	}
+	for _, webhook := range config.Webhooks {
+		if err := webhook.validate(); err != nil {
+			return err
+		}
+	}
+	if config.RateLimit != nil {
+		if err := config.RateLimit.validate(); err != nil {
+			return err
+		}
+	}
+	if config.Limits != nil {
+		if err := config.Limits.validate(); err != nil {
+			return err
+		}
+	}
+	if config.BodyRedactions != nil {
+		if err := config.BodyRedactions.validate(); err != nil {
+			return err
+		}
+	}
+	if config.Sink != nil {
+		if err := config.Sink.validate(); err != nil {
+			return err
+		}
+	}
+	if config.Statsd != nil {
+		if err := config.Statsd.validate(); err != nil {
+			return err
+		}
+	}
+	if config.Tracing != nil {
+		if err := config.Tracing.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HarProxyOptions holds everything needed to construct a HarProxy.
+// The zero value is valid and creates a proxy listening on a random port on all interfaces.
+type HarProxyOptions struct {
+	// The port to listen on, 0 picks a free port on Start
+	Port int
+
+	// The host / ip to bind to, empty means all interfaces
+	BindAddr string
+
+	// What parts of the traffic are recorded
+	CaptureSettings CaptureSettings
+
+	// The maximum number of entries kept in the HAR log, 0 means unlimited
+	MaxEntries int
+
+	// Makes the upstream round trips, defaults to goproxy's transport using the environment's proxy settings.
+	// If it implements DetailedRoundTripper the connected address fills the entries' serverIpAddress,
+	// otherwise it is resolved from the request host.
+	Transport http.RoundTripper
+
+	// Makes the upstream connections of the default transport, can't be combined with Transport.
+	// Host entries are applied before dialing, so addr is the rewritten host.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Sizes the default transport's connection pool, can't be combined with Transport.
+	// The default transport without it keeps 2 idle connections per host.
+	UpstreamPool *UpstreamPool
+
+	// Receives everything the proxy logs, defaults to DefaultLogger
+	Logger Logger
+
+	// Times the entries and the proxy's timeouts, defaults to RealClock
+	Clock Clock
+
+	// When set, recorded entries are also appended to rotating HAR files.
+	// ClearEntries does not affect written files, Stop finalizes the current one.
+	Export *ExportOptions
+
+	// When set, recorded entries are also posted in batches to a collector, see HarProxy.SetSink.
+	// Stop posts the entries still buffered.
+	Sink *SinkOptions
+
+	// When set, the metrics of recorded entries are sent to a StatsD server, see HarProxy.SetStatsd
+	Statsd *StatsdOptions
+
+	// When set, recorded entries are also exported as OpenTelemetry spans, see HarProxy.SetTracing.
+	// Stop posts the spans still buffered.
+	Tracing *TracingOptions
+
+	// When set, requests are answered with the responses recorded in a HAR log instead of upstream's, see HarProxy.SetStub
+	Stub *StubOptions
+
+	// The number of completed requests queued for recording without waiting for the entry processing, 0 means unbuffered
+	EntryBuffer int
+
+	// What happens to a response when the entry queue is full, OverflowBlock (the default) or OverflowDrop
+	EntryOverflow string
+
+	// The number of goroutines recording entries off the queue, 0 means DefaultEntryWorkers
+	EntryWorkers int
+
+	// The most bytes of captured bodies kept in the HAR log, 0 means unlimited. The other proxy outputs,
+	// entry listeners and exports, still get the captured bodies.
+	CaptureBudget int64
+
+	// What happens to the bodies of entries for which the budget has no room, BudgetSkip (the default) or BudgetEvict
+	CaptureBudgetPolicy string
+
+	// Resolves the server ip of entries whose transport doesn't report the connected address, defaults to
+	// net.DefaultResolver. Lookups don't hold up recording, entries recorded before it answered have no ip.
+	LookupIP func(ctx context.Context, host string) ([]net.IP, error)
+
+	// Seeds the random decisions of the rules, such as status rewrite percentages and latency jitter, 0 picks
+	// a random seed. The same seed and sequence of requests take the same decisions, see HarProxy.Seed.
+	Seed int64
+
+	// Logs every proxied request, with its url, status and duration, apart from what the proxy logs otherwise.
+	// A JsonLogger writes them as structured fields, other loggers get them as Infof.
+	AccessLog bool
+}
+
+// The number of entry workers of a proxy without EntryWorkers, a small multiple of GOMAXPROCS
+// as recording mostly waits for DNS lookups
+func DefaultEntryWorkers() int {
+	return 4 * runtime.GOMAXPROCS(0)
+}
+
+const (
+	// Responses wait for room in the entry queue, no entry is lost
+	OverflowBlock = "block"
+
+	// Entries which don't fit in the entry queue are dropped and counted, see DroppedEntries.
+	// Without EntryBuffer an entry is dropped whenever the processing is busy.
+	OverflowDrop = "drop"
+)
+
+// RequestMiddleware may modify or replace a proxied request, it must return a non nil request.
+// Returning a non nil response sends it to the client without making the upstream round trip.
+type RequestMiddleware func(*http.Request) (*http.Request, *http.Response)
+
+// ResponseMiddleware may modify or replace the upstream response before it is sent to the client.
+// Returning nil keeps the response it was given.
+type ResponseMiddleware func(*http.Request, *http.Response) *http.Response
+
+// DetailedRoundTripper is implemented by upstream transports that report which server they connected to
+type DetailedRoundTripper interface {
+	DetailedRoundTrip(req *http.Request) (*transport.RoundTripDetails, *http.Response, error)
+}
+
+func (opts HarProxyOptions) validate() error {
+	if opts.Port < 0 || opts.Port > 65535 {
+		return fmt.Errorf("invalid port [%v]", opts.Port)
+	}
+	if opts.BindAddr != "" && net.ParseIP(opts.BindAddr) == nil && !validHostname(opts.BindAddr) {
+		return fmt.Errorf("invalid bind address [%v]", opts.BindAddr)
+	}
+	if opts.BindAddr != "" && !isLocalAddress(opts.BindAddr) {
+		return fmt.Errorf("bind address [%v] is not a local address", opts.BindAddr)
+	}
+	if opts.MaxEntries < 0 {
+		return fmt.Errorf("invalid max entries [%v]", opts.MaxEntries)
+	}
+	if opts.CaptureSettings.MaxCaptureBytes < 0 {
+		return fmt.Errorf("invalid max capture bytes [%v]", opts.CaptureSettings.MaxCaptureBytes)
+	}
+	if opts.Export != nil {
+		if err := opts.Export.validate(); err != nil {
+			return err
+		}
+	}
+	if opts.Sink != nil {
+		if err := opts.Sink.validate(); err != nil {
+			return err
+		}
+	}
+	if opts.Statsd != nil {
+		if err := opts.Statsd.validate(); err != nil {
+			return err
+		}
+	}
+	if opts.Tracing != nil {
+		if err := opts.Tracing.validate(); err != nil {
+			return err
+		}
+	}
+	if opts.Stub != nil {
+		if err := opts.Stub.validate(); err != nil {
+			return err
+		}
+	}
+	if opts.Transport != nil && opts.DialContext != nil {
+		return errors.New("DialContext can't be combined with a custom Transport")
+	}
+	if opts.UpstreamPool != nil {
+		if opts.Transport != nil {
+			return errors.New("UpstreamPool can't be combined with a custom Transport")
+		}
+		if err := opts.UpstreamPool.validate(); err != nil {
+			return err
+		}
+	}
+	if opts.EntryBuffer < 0 {
+		return fmt.Errorf("invalid entry buffer [%v]", opts.EntryBuffer)
+	}
+	if opts.EntryWorkers < 0 {
+		return fmt.Errorf("invalid entry workers [%v]", opts.EntryWorkers)
+	}
+	switch opts.EntryOverflow {
+	case "", OverflowBlock, OverflowDrop:
+	default:
+		return fmt.Errorf("invalid entry overflow [%v], expected %v or %v", opts.EntryOverflow, OverflowBlock, OverflowDrop)
+	}
+	if opts.CaptureBudget < 0 {
+		return fmt.Errorf("invalid capture budget [%v]", opts.CaptureBudget)
+	}
+	switch opts.CaptureBudgetPolicy {
+	case "", BudgetSkip, BudgetEvict:
+	default:
+		return fmt.Errorf("invalid capture budget policy [%v], expected %v or %v", opts.CaptureBudgetPolicy, BudgetSkip, BudgetEvict)
+	}
+	return nil
+}
+
+// Controls which parts of the traffic are recorded in the HAR
+type CaptureSettings struct {
+	// Record request post data and response content
+	CaptureContent bool		`json:"captureContent"`
+
+	// Record the upstream response instead of the one response middlewares sent to the client
+	CaptureBeforeResponseMiddleware bool	`json:"captureBeforeResponseMiddleware"`
+
+	// The most bytes of a body recorded, the rest still goes through and the content is marked _truncated.
+	// 0 records whole bodies.
+	MaxCaptureBytes int64	`json:"maxCaptureBytes"`
+
+	// Only run host entries and middlewares, requests aren't copied, queued nor recorded.
+	// Requests started while it is set are left out of the HAR log, entry listeners and exports.
+	DisableRecording bool	`json:"disableRecording"`
 }
 
+type proxyState int
+
+const (
+	proxyNew proxyState = iota
+	proxyStarted
+	proxyStopped
+)
+
+var (
+	ErrNotStarted 		= errors.New("goharproxy: proxy was not started")
+	ErrAlreadyStarted 	= errors.New("goharproxy: proxy was already started")
+	ErrAlreadyStopped 	= errors.New("goharproxy: proxy was already stopped")
+)
+
+// How long Stop waits for the recorded entries to be processed
+var stopTimeout = 10 * time.Second
+
 func orPanic(err error) {
 	if err != nil {
 		panic(err)
@@ -74,17 +555,95 @@ func NewHarProxy() *HarProxy {
 }
 
 func NewHarProxyWithPort(port int) *HarProxy {
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions {
+		Port 			: port,
+		CaptureSettings : CaptureSettings{CaptureContent : captureContent},
+	})
+	orPanic(err)
+	return harProxy
+}
+
+func NewHarProxyWithOptions(opts HarProxyOptions) (*HarProxy, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	upstream := opts.Transport
+	if opts.DialContext != nil || opts.UpstreamPool != nil {
+		upstream = newDialingTransport(opts.DialContext, opts.UpstreamPool)
+	} else if upstream == nil {
+		upstream = &transport.Transport{Proxy: transport.ProxyFromEnvironment}
+	}
+	logger := orDefaultLogger(opts.Logger)
+	clock := orRealClock(opts.Clock)
+	entryWorkers := opts.EntryWorkers
+	if entryWorkers == 0 {
+		entryWorkers = DefaultEntryWorkers()
+	}
+	var export *exportSink
+	if opts.Export != nil {
+		var err error
+		if export, err = newExportSink(*opts.Export, logger, clock); err != nil {
+			return nil, err
+		}
+	}
+	webhookCtx, cancelWebhooks := context.WithCancel(context.Background())
 	harProxy := HarProxy {
 		Proxy 			 : goproxy.NewProxyHttpServer(),
-		Port 			 : port,
+		Port 			 : opts.Port,
 		HarLog 			 : newHarLog(),
-		hostEntries 	 : make([]ProxyHosts, 0, 100),
+		hostEntries 	 : make([]hostEntry, 0, 100),
 		isDone 			 : make(chan bool),
-		entryChannel	 : make(chan reqAndResp),
-		entriesInProcess : 0,
+		entriesDone 	 : make(chan bool),
+		entryChannel	 : make(chan reqAndResp, opts.EntryBuffer),
+		entryBuffer 	 : opts.EntryBuffer,
+		dropOverflow 	 : opts.EntryOverflow == OverflowDrop,
+		entryWorkers 	 : entryWorkers,
+		captureBudget 	 : opts.CaptureBudget,
+		evictBodies 	 : opts.CaptureBudgetPolicy == BudgetEvict,
+		resolver 		 : newIpResolver(opts.LookupIP, clock),
+		pending 		 : newPendingEntries(),
+		sending 		 : newPendingEntries(),
+		entryListeners 	 : newEntryListeners(logger),
+		captureSettings  : opts.CaptureSettings,
+		maxEntries 		 : opts.MaxEntries,
+		bindAddr 		 : opts.BindAddr,
+		transport 		 : upstream,
+		givenTransport 	 : opts.Transport,
+		dialContext 	 : opts.DialContext,
+		upstreamPool 	 : opts.UpstreamPool,
+		logger 			 : logger,
+		clock 			 : clock,
+		metrics 		 : newProxyMetrics(),
+		random 			 : newSeededRand(opts.Seed),
+		webhookSlots 	 : make(chan struct{}, webhookConcurrency),
+		webhookCtx 		 : webhookCtx,
+		cancelWebhooks 	 : cancelWebhooks,
+		exportOptions 	 : opts.Export,
+		export 			 : export,
+	}
+	if jsonLogger, ok := logger.(*JsonLogger); ok {
+		harProxy.logger = jsonLogger.forProxy(&harProxy)
+	}
+	harProxy.accessLog = opts.AccessLog
+	harProxy.Proxy.Logger = printfLogger{harProxy.logger}
+	if opts.Sink != nil {
+		harProxy.SetSink(opts.Sink)
+	}
+	if opts.Tracing != nil {
+		harProxy.SetTracing(opts.Tracing)
+	}
+	if opts.Stub != nil {
+		harProxy.SetStub(opts.Stub)
+	}
+	if opts.Statsd != nil {
+		if err := harProxy.SetStatsd(opts.Statsd); err != nil {
+			harProxy.SetSink(nil)
+			harProxy.SetTracing(nil)
+			return nil, err
+		}
 	}
 	createProxy(&harProxy)
-	return &harProxy
+	return &harProxy, nil
 }
 
 type reqAndResp struct {
@@ -92,270 +651,2535 @@ type reqAndResp struct {
 	start 	 time.Time
 	resp 	*http.Response
 	end   	 time.Time
+	captureContent bool
+	// The address we connected to, if the transport reported it
+	serverIpAddress string
+	// The response came from a request middleware, not from upstream
+	synthetic bool
+	// The URL as requested by the client, before host entries and middlewares
+	clientUrl string
+	// The entry's _custom fields
+	custom map[string]interface{}
+	// The error of the upstream round trip
+	err error
+	// Whether the request was counted as done in the metrics
+	counted bool
+	// Assigned when the entry is queued, see HarEntry.Sequence
+	seq int64
+	// Whether the client went away before the whole response body was sent, after transferred bytes
+	clientAborted bool
+	transferred int64
+	// The captured bodies, released once the entry is parsed or dropped
+	reqCapture *captureBuffer
+	respCapture *captureBuffer
+	// The name of the latency rule which delayed the response
+	latencyRule string
+	// The upstream status when a status rewrite changed it
+	originalStatus int
+	// The response is the 429 of the rate limit
+	rateLimited bool
+	// How long the request waited for a slot of the connection limits
+	blocked time.Duration
+	// The upstream Location header when a host entry rewrote it
+	locationRewrite *LocationRewrite
+	// What the cookie rules changed
+	cookieChanges *cookieChanges
+	// The page current when the request reached the proxy
+	pageRef string
+	// The response was recorded, served by the stub, or the stub matched no recorded one
+	stubbed bool
+	stubUnmatched bool
+	// The request body as sent upstream, nil without body or when it isn't sent
+	reqBody *upstreamBody
+	// The round trip's trace, nil when the request wasn't sent upstream
+	upstream *upstreamTrace
+}
+
+func (reqAndResp reqAndResp) releaseCaptures() {
+	reqAndResp.reqCapture.release()
+	reqAndResp.respCapture.release()
 }
 
 func createProxy(proxy *HarProxy) {
-	tr := transport.Transport{Proxy: transport.ProxyFromEnvironment}
 	proxy.Proxy.Verbose = Verbosity
-	go processEntriesFunc(proxy)
 	proxy.Proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if proxy.CaptureSettings().DisableRecording {
+			return proxy.passThrough(req, ctx)
+		}
+		proxy.startProcessing()
+		proxy.pending.add()
+		proxy.metrics.requestStarted()
 		reqAndResp := new(reqAndResp)
-		reqAndResp.start = time.Now()
-		if captureContent && req.ContentLength > 0 {
-			req, reqAndResp.req = copyReq(req)
+		defer proxy.releaseOnPanic(req, reqAndResp)
+		reqAndResp.start = proxy.clock.Now()
+		reqAndResp.pageRef = proxy.requestPageRef(req)
+		reqAndResp.clientUrl = req.URL.String()
+		reqAndResp.custom = proxy.customFields(req)
+		req, reqAndResp.cookieChanges = withCookieChanges(req)
+		var resp *http.Response
+		if resp = proxy.limitRate(req); resp != nil {
+			reqAndResp.rateLimited = true
+		} else {
+			req, resp = handleRequest(req, proxy)
+		}
+		if _, detailed := proxy.transport.(DetailedRoundTripper); !detailed || resp != nil {
+			// Looked up while the request is served, there is no connected address to record
+			proxy.resolver.ip(req.URL.Host)
+		}
+		captureSettings := proxy.CaptureSettings()
+		reqAndResp.captureContent = captureSettings.CaptureContent
+		if reqAndResp.captureContent && req.ContentLength > 0 && resp != nil {
+			// Not sent upstream, reading the body first holds nothing back
+			req, reqAndResp.req, reqAndResp.reqCapture = copyReq(req, captureSettings.MaxCaptureBytes)
+			proxy.metrics.captured(int64(reqAndResp.reqCapture.Len()))
 		} else {
-			reqAndResp.req = req
+			reqAndResp.req = copyReqHeader(req)
+			if resp == nil && req.Body != nil && req.Body != http.NoBody {
+				// Captured as the transport sends it
+				var capture *captureBuffer
+				if reqAndResp.captureContent {
+					capture = newCaptureBuffer(req.ContentLength, captureSettings.MaxCaptureBytes, 2)
+					reqAndResp.req.Body, reqAndResp.reqCapture = capture, capture
+				}
+				reqAndResp.reqBody = newUpstreamBody(req, capture)
+			}
+		}
+		if resp != nil {
+			proxy.sending.add()
+			defer proxy.sending.done()
+			reqAndResp.end = proxy.clock.Now()
+			proxy.metrics.requestDone(req, resp, reqAndResp.end.Sub(reqAndResp.start))
+			reqAndResp.counted = true
+			reqAndResp.synthetic = !reqAndResp.rateLimited
+			if reqAndResp.captureContent && resp.ContentLength > 0 && !bodilessResponse(resp) {
+				resp, reqAndResp.resp, reqAndResp.respCapture = copyResp(resp, captureSettings.MaxCaptureBytes)
+				proxy.metrics.captured(int64(reqAndResp.respCapture.Len()))
+			} else {
+				reqAndResp.resp = copyRespHeader(resp)
+			}
+			proxy.sendEntry(*reqAndResp)
+			return req, resp
 		}
 		ctx.RoundTripper = goproxy.RoundTripperFunc(func (req *http.Request, ctx *goproxy.ProxyCtx) (resp *http.Response, err error) {
-			reqAndResp.end = time.Now()
-			ctx.UserData, resp, err = tr.DetailedRoundTrip(req)
-			if captureContent && resp.ContentLength > 0 {
-				resp, reqAndResp.resp = copyResp(resp)
+			defer proxy.releaseOnPanic(req, reqAndResp)
+			clientCtx := req.Context()
+			reqAndResp.latencyRule = proxy.delayRequest(req)
+			upstreamCtx, cancel := context.WithCancel(clientCtx)
+			var details *transport.RoundTripDetails
+			release := func() {}
+			answered, matched, resp, err := proxy.serveStub(reqAndResp.clientUrl, req)
+			reqAndResp.stubbed, reqAndResp.stubUnmatched = matched, answered && !matched
+			if !answered {
+				var blocked time.Duration
+				release, blocked, err = proxy.acquireConnection(req)
+				reqAndResp.blocked = blocked
+				if err == nil {
+					reqAndResp.upstream = new(upstreamTrace)
+					details, resp, err = proxy.roundTrip(traceUpstream(req.WithContext(upstreamCtx), reqAndResp.upstream, proxy.clock.Now))
+				}
+			} else if reqAndResp.reqBody != nil {
+				reqAndResp.reqBody.fill()
+			}
+			proxy.sending.add()
+			// Unless the body sends the entry once it was copied to the client
+			handedOff := false
+			defer func() {
+				if !handedOff {
+					cancel()
+					proxy.sending.done()
+				}
+			}()
+			// The entry's time includes the wait for the upstream response
+			reqAndResp.end = proxy.clock.Now()
+			proxy.metrics.requestDone(req, resp, reqAndResp.end.Sub(reqAndResp.start))
+			reqAndResp.counted = true
+			ctx.UserData = details
+			if details != nil && details.TCPAddr != nil {
+				reqAndResp.serverIpAddress = details.TCPAddr.IP.String()
+			}
+			if err != nil {
+				release()
+				// Recorded without response, the client gets a 502 instead of goproxy's 500
+				proxy.logger.Infof("Round trip to %v failed : %v", req.URL, err)
+				reqAndResp.err = err
+				proxy.sendEntry(*reqAndResp)
+				return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error()), nil
+			}
+			resp, reqAndResp.originalStatus = proxy.rewriteStatus(req, resp)
+			reqAndResp.locationRewrite = proxy.rewriteLocation(reqAndResp.clientUrl, req, resp)
+			captureSettings := proxy.CaptureSettings()
+			captureBefore := captureSettings.CaptureBeforeResponseMiddleware
+			if !captureBefore {
+				resp = handleResponse(req, resp, proxy)
+			}
+			// Captured as the client reads it, unless middlewares still get to change the body
+			var teeCapture *captureBuffer
+			capturing := reqAndResp.captureContent && resp.ContentLength != 0 && !bodilessResponse(resp)
+			if capturing && !captureBefore {
+				reqAndResp.resp = copyRespHeader(resp)
+				teeCapture = newCaptureBuffer(resp.ContentLength, captureSettings.MaxCaptureBytes, 1)
+				reqAndResp.resp.Body, reqAndResp.respCapture = teeCapture, teeCapture
+			} else if capturing && resp.ContentLength > 0 {
+				resp, reqAndResp.resp, reqAndResp.respCapture = copyResp(resp, captureSettings.MaxCaptureBytes)
+				proxy.metrics.captured(int64(reqAndResp.respCapture.Len()))
 			} else {
-				reqAndResp.resp = resp
+				reqAndResp.resp = copyRespHeader(resp)
+			}
+			if captureBefore {
+				resp = handleResponse(req, resp, proxy)
+			}
+			// goproxy hands a switched connection's body to the websocket copy as is
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				release()
+				proxy.sendEntry(*reqAndResp)
+				return resp, nil
 			}
-			proxy.entryChannel<- *reqAndResp
-			return resp, err
+			if reqAndResp.latencyRule == "" {
+				reqAndResp.latencyRule = proxy.delayResponse(clientCtx, req, resp)
+			}
+			resp.Body = newClientBody(proxy, resp.Body, reqAndResp, teeCapture, clientCtx, cancel)
+			// Held until goproxy closes the body, middlewares may have replaced the upstream one
+			releaseWithBody(resp, release)
+			handedOff = true
+			return resp, nil
 		})
-		return handleRequest(req, proxy)
+		return req, nil
+	})
+}
+
+// Serves a request while recording is disabled, only the metrics are counted
+func (proxy *HarProxy) passThrough(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	proxy.metrics.requestStarted()
+	start := proxy.clock.Now()
+	if resp := proxy.limitRate(req); resp != nil {
+		proxy.metrics.requestDone(req, resp, proxy.clock.Since(start))
+		return req, resp
+	}
+	clientUrl := req.URL.String()
+	proxy.stripPageHeader(req)
+	req, _ = withCookieChanges(req)
+	req, resp := handleRequest(req, proxy)
+	if resp != nil {
+		proxy.metrics.requestDone(req, resp, proxy.clock.Since(start))
+		return req, resp
+	}
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func (req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		delayed := proxy.delayRequest(req) != ""
+		release := func() {}
+		answered, _, resp, err := proxy.serveStub(clientUrl, req)
+		if !answered {
+			release, _, err = proxy.acquireConnection(req)
+			if err == nil {
+				_, resp, err = proxy.roundTrip(req)
+			}
+		}
+		proxy.metrics.requestDone(req, resp, proxy.clock.Since(start))
+		if err != nil {
+			release()
+			proxy.logger.Infof("Round trip to %v failed : %v", req.URL, err)
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error()), nil
+		}
+		resp, _ = proxy.rewriteStatus(req, resp)
+		proxy.rewriteLocation(clientUrl, req, resp)
+		resp = handleResponse(req, resp, proxy)
+		if !delayed && resp.StatusCode != http.StatusSwitchingProtocols {
+			proxy.delayResponse(req.Context(), req, resp)
+		}
+		releaseWithBody(resp, release)
+		return resp, nil
+	})
+	return req, nil
+}
+
+// Deferred while a request is handled until its entry is sent, so a panic, e.g. of the transport or
+// of the entry metadata func, doesn't leave the entry pending nor the request in flight forever.
+// The request is counted as failed unless it was counted already. The panic goes on.
+func (proxy *HarProxy) releaseOnPanic(req *http.Request, reqAndResp *reqAndResp) {
+	if e := recover(); e != nil {
+		proxy.pending.done()
+		if !reqAndResp.counted {
+			proxy.metrics.requestDone(req, nil, proxy.clock.Since(reqAndResp.start))
+			reqAndResp.counted = true
+		}
+		panic(e)
+	}
+}
+
+func (proxy *HarProxy) roundTrip(req *http.Request) (*transport.RoundTripDetails, *http.Response, error) {
+	if detailed, ok := proxy.transport.(DetailedRoundTripper); ok {
+		return detailed.DetailedRoundTrip(req)
+	}
+	resp, err := proxy.transport.RoundTrip(req)
+	return nil, resp, err
+}
+
+// Captures up to limit bytes of the body of req, whose length is known, for the copy
+func copyReq(req *http.Request, limit int64) (*http.Request, *http.Request, *captureBuffer) {
+	reqCopy := copyReqHeader(req)
+	var capture *captureBuffer
+	req.Body, capture = captureReadCloser(req.Body, req.ContentLength, limit)
+	reqCopy.Body = capture
+	return req, reqCopy, capture
+}
+
+// Copies req for the HAR with header, trailer and url of its own and without body,
+// the transport and middlewares may change the request's while the entry is built
+func copyReqHeader(req *http.Request) *http.Request {
+	reqCopy := new(http.Request)
+	*reqCopy = *req
+	reqCopy.Body = nil
+	reqCopy.Header = req.Header.Clone()
+	reqCopy.Trailer = req.Trailer.Clone()
+	if req.URL != nil {
+		urlCopy := *req.URL
+		reqCopy.URL = &urlCopy
+	}
+	return reqCopy
+}
+
+// Captures up to limit bytes of the body of resp, whose length is known, for the copy
+func copyResp(resp *http.Response, limit int64) (*http.Response, *http.Response, *captureBuffer) {
+	respCopy := copyRespHeader(resp)
+	var capture *captureBuffer
+	resp.Body, capture = captureReadCloser(resp.Body, resp.ContentLength, limit)
+	respCopy.Body = capture
+	return resp, respCopy, capture
+}
+
+// Copies resp without its body, with header and trailer maps of its own
+func copyRespHeader(resp *http.Response) *http.Response {
+	respCopy := new(http.Response)
+	*respCopy = *resp
+	respCopy.Body = nil
+	respCopy.Header = resp.Header.Clone()
+	respCopy.Trailer = resp.Trailer.Clone()
+	return respCopy
+}
+
+func (proxy *HarProxy) startProcessing() {
+	proxy.processingOnce.Do(func() {
+		go processEntriesFunc(proxy)
 	})
 }
 
-func copyReq(req *http.Request) (*http.Request, *http.Request) {
-	reqCopy := new(http.Request)
-	*reqCopy = *req
-	req.Body, reqCopy.Body = copyReadCloser(req.Body, req.ContentLength)
-	return req, reqCopy
+func (proxy *HarProxy) sendEntry(reqAndResp reqAndResp) {
+	proxy.entryChannelLock.RLock()
+	defer proxy.entryChannelLock.RUnlock()
+	if proxy.entryChannelClosed {
+		proxy.logger.Infof("Dropping entry for %v, proxy on port :%v is stopped", reqAndResp.req.URL, proxy.Port)
+		reqAndResp.releaseCaptures()
+		proxy.pending.done()
+		return
+	}
+	atomic.AddInt64(&proxy.metrics.pendingEntries, 1)
+	// Numbered before the workers pick it up, so their scheduling doesn't reorder the entries
+	reqAndResp.seq = atomic.AddInt64(&proxy.entrySeq, 1)
+	if !proxy.dropOverflow {
+		proxy.entryChannel<- reqAndResp
+		return
+	}
+	select {
+	case proxy.entryChannel<- reqAndResp:
+	default:
+		atomic.AddInt64(&proxy.metrics.pendingEntries, -1)
+		atomic.AddInt64(&proxy.metrics.droppedEntries, 1)
+		proxy.logger.Infof("Dropping entry for %v, entry queue of proxy on port :%v is full", reqAndResp.req.URL, proxy.Port)
+		reqAndResp.releaseCaptures()
+		proxy.pending.done()
+	}
+}
+
+func (proxy *HarProxy) closeEntryChannel() {
+	proxy.entryChannelLock.Lock()
+	defer proxy.entryChannelLock.Unlock()
+	if !proxy.entryChannelClosed {
+		proxy.entryChannelClosed = true
+		close(proxy.entryChannel)
+	}
+}
+
+// Records the queued entries with entryWorkers goroutines until the entry channel is closed and drained
+func processEntriesFunc(proxy *HarProxy) {
+	var workers sync.WaitGroup
+	for i := 0; i < proxy.entryWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for reqAndResp := range proxy.entryChannel {
+				proxy.recordEntry(reqAndResp)
+			}
+		}()
+	}
+	workers.Wait()
+	proxy.logger.Debugf("Entry channel of proxy on port :%v closed", proxy.Port)
+	if proxy.export != nil {
+		proxy.export.close()
+	}
+	proxy.closeSink()
+	proxy.closeStatsd()
+	proxy.closeTracing()
+	proxy.entryListeners.close()
+	close(proxy.entriesDone)
+	proxy.logger.Debugf("Done processing entries of proxy on port :%v", proxy.Port)
+}
+
+func (proxy *HarProxy) recordEntry(reqAndResp reqAndResp) {
+	defer proxy.pending.done()
+	defer atomic.AddInt64(&proxy.metrics.pendingEntries, -1)
+	harEntry := new(HarEntry)
+	harEntry.Sequence = reqAndResp.seq
+	harEntry.PageRef = reqAndResp.pageRef
+	// Sealed first, the transport may still be sending the body
+	var streamed int64
+	var whole bool
+	if reqAndResp.reqBody != nil {
+		streamed, whole = reqAndResp.reqBody.seal()
+		if reqAndResp.reqCapture != nil {
+			proxy.metrics.captured(int64(reqAndResp.reqCapture.Len()))
+		}
+	}
+	harEntry.Request = parseRequest(reqAndResp.req, reqAndResp.captureContent, proxy.logger)
+	if reqAndResp.reqBody != nil && (whole || reqAndResp.upstream != nil) {
+		// What was sent, which the Content-Length doesn't tell for chunked bodies
+		harEntry.Request.BodySize = streamed
+	}
+	harEntry.Request.Url, harEntry.Request.OriginalUrl, harEntry.Request.RewrittenTo = entryUrls(reqAndResp.clientUrl, harEntry.Request.Url)
+	harEntry.StartedDateTime = reqAndResp.start
+	harEntry.Custom = reqAndResp.custom
+	if changes := reqAndResp.cookieChanges; changes != nil && len(changes.changes) > 0 {
+		// Copied, the fields may come from the entry metadata func
+		harEntry.Custom = make(map[string]interface{}, len(reqAndResp.custom) + 1)
+		for name, value := range reqAndResp.custom {
+			harEntry.Custom[name] = value
+		}
+		harEntry.Custom[cookieChangesField] = changes.changes
+	}
+	if reqAndResp.err != nil {
+		harEntry.Error = reqAndResp.err.Error()
+	}
+	harEntry.Response = parseResponse(reqAndResp.resp, reqAndResp.captureContent, proxy.logger)
+	reqAndResp.releaseCaptures()
+	proxy.redactBodies(harEntry)
+	harEntry.Time = reqAndResp.end.Sub(reqAndResp.start).Nanoseconds() / 1e6
+	harEntry.Timings.Blocked = reqAndResp.blocked.Milliseconds()
+	if reqAndResp.clientAborted {
+		harEntry.ClientAborted = true
+		if harEntry.Response != nil {
+			harEntry.Response.BodySize = reqAndResp.transferred
+		}
+	}
+	if reqAndResp.synthetic {
+		harEntry.Comment = "Response from request middleware"
+	}
+	harEntry.RateLimited = reqAndResp.rateLimited
+	harEntry.Stubbed = reqAndResp.stubbed
+	if reqAndResp.stubUnmatched {
+		harEntry.Comment = "No recorded response matched"
+	}
+	harEntry.LocationRewrite = reqAndResp.locationRewrite
+	harEntry.LatencyRule = reqAndResp.latencyRule
+	if reqAndResp.originalStatus != 0 && harEntry.Response != nil && harEntry.Response.Status != reqAndResp.originalStatus {
+		harEntry.OriginalStatus = reqAndResp.originalStatus
+	}
+	if reqAndResp.upstream != nil {
+		reqAndResp.upstream.record(harEntry, reqAndResp.end)
+	}
+	if reqAndResp.serverIpAddress != "" {
+		harEntry.ServerIpAddress = reqAndResp.serverIpAddress
+	} else {
+		harEntry.ServerIpAddress = proxy.resolver.ip(reqAndResp.req.URL.Host)
+	}
+	if proxy.accessLog {
+		logAccess(proxy.logger, AccessLog{Event : "request", Method : harEntry.Request.Method, Url : harEntry.Request.Url, Status : entryStatus(*harEntry), DurationMs : harEntry.Time, Error : harEntry.Error})
+	}
+	if !proxy.filterEntry(harEntry) {
+		return
+	}
+	harEntry.Id = atomic.AddInt64(&proxy.entryId, 1)
+	if proxy.export != nil {
+		proxy.export.write(proxy.Port, harEntry)
+	}
+	proxy.sendToSink(harEntry)
+	proxy.sendToStatsd(harEntry)
+	proxy.sendToTracing(harEntry)
+	if added, evicted := proxy.HarLog.addEntryWithinBudget(proxy.Config().MaxEntries, proxy.captureBudget, proxy.evictBodies, *harEntry); !added {
+		proxy.logger.Infof("Dropping entry %v, HAR log is full", harEntry.Request.Url)
+	} else {
+		proxy.metrics.entryAdded()
+		proxy.logger.Debugf("Added entry %v", harEntry.Request.Url)
+		if evicted > 0 {
+			proxy.logger.Debugf("Dropped the bodies of %v entries of proxy on port :%v to stay within its capture budget", evicted, proxy.Port)
+		}
+	}
+	proxy.triggerWebhooks(harEntry)
+	proxy.entryListeners.notify(*harEntry)
+}
+
+// Runs the request middleware chain, stopping at the first middleware returning a response
+func handleRequest(req *http.Request, harProxy *HarProxy) (*http.Request, *http.Response) {
+	for _, middleware := range harProxy.requestChain() {
+		var resp *http.Response
+		if req, resp = harProxy.runRequestMiddleware(middleware, req); resp != nil {
+			return req, resp
+		}
+	}
+	return req, nil
+}
+
+// Runs middleware, a panicking middleware is skipped so the request still completes
+func (proxy *HarProxy) runRequestMiddleware(middleware RequestMiddleware, req *http.Request) (newReq *http.Request, resp *http.Response) {
+	defer func() {
+		if e := recover(); e != nil {
+			proxy.logger.Errorf("Request middleware for %v panicked: %v", req.URL, e)
+			newReq, resp = req, nil
+		}
+	}()
+	return middleware(req)
+}
+
+// The built in request middlewares followed by the ones added with UseRequest
+func (proxy *HarProxy) requestChain() []RequestMiddleware {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	chain := make([]RequestMiddleware, 0, len(proxy.requestMiddlewares) + 1)
+	chain = append(chain, func(req *http.Request) (*http.Request, *http.Response) {
+		rewriteQuery(req, proxy)
+		rewriteRequestCookies(req, proxy)
+		replaceHost(req, proxy)
+		return req, nil
+	})
+	return append(chain, proxy.requestMiddlewares...)
+}
+
+func replaceHost(req *http.Request, harProxy *HarProxy) {
+	harProxy.settingsLock.RLock()
+	defer harProxy.settingsLock.RUnlock()
+	for _, hostEntry := range harProxy.hostEntries {
+		newHost, matched, err := hostEntry.match(req.URL.Host, req.URL.Scheme)
+		if err != nil {
+			harProxy.logger.Errorf("Skipping hosts entry: %v", err)
+			continue
+		}
+		if matched {
+			harProxy.logger.Debugf("Replacing %v with %v", req.URL.Host, newHost)
+			if hostEntry.PreserveHostHeader {
+				if req.Host == "" {
+					req.Host = req.URL.Host
+				}
+			} else {
+				req.Host = newHost
+			}
+			req.URL.Host = newHost
+			if hostEntry.NewScheme != "" {
+				req.URL.Scheme = hostEntry.NewScheme
+			}
+			return
+		}
+	}
+}
+
+// Runs the response middleware chain, after the cookie rules, a panicking middleware is skipped
+func handleResponse(req *http.Request, resp *http.Response, harProxy *HarProxy) *http.Response {
+	rewriteResponseCookies(req, resp, harProxy)
+	harProxy.settingsLock.RLock()
+	chain := harProxy.responseMiddlewares
+	harProxy.settingsLock.RUnlock()
+	for _, middleware := range chain {
+		resp = harProxy.runResponseMiddleware(middleware, req, resp)
+	}
+	return resp
+}
+
+func (proxy *HarProxy) runResponseMiddleware(middleware ResponseMiddleware, req *http.Request, resp *http.Response) (newResp *http.Response) {
+	defer func() {
+		if e := recover(); e != nil {
+			proxy.logger.Errorf("Response middleware for %v panicked: %v", req.URL, e)
+			newResp = resp
+		}
+	}()
+	if newResp = middleware(req, resp); newResp == nil {
+		newResp = resp
+	}
+	return newResp
+}
+
+// Looks up the server ip synchronously, for replays which wait for their responses anyway
+func fillIpAddress(req *http.Request, harEntry *HarEntry) {
+	host, _, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		host = req.URL.Host
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		harEntry.ServerIpAddress = ip.String()
+		return
+	}
+
+	if ipaddr, err := net.LookupIP(host); err == nil  {
+		harEntry.ServerIpAddress = firstIpv4(ipaddr)
+	}
+}
+
+func (proxy *HarProxy) AddHostEntries(hostEntries []ProxyHosts) {
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.hostEntries = append(proxy.hostEntries, newHostEntries(hostEntries)...)
+}
+
+// RemoveHostEntry removes the host entries replacing host, returns false if there were none
+func (proxy *HarProxy) RemoveHostEntry(host string) bool {
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	entries := make([]hostEntry, 0, cap(proxy.hostEntries))
+	for _, hostEntry := range proxy.hostEntries {
+		if hostEntry.Host != host {
+			entries = append(entries, hostEntry)
+		}
+	}
+	removed := len(entries) != len(proxy.hostEntries)
+	proxy.hostEntries = entries
+	return removed
+}
+
+// ClearHostEntries removes every host entry
+func (proxy *HarProxy) ClearHostEntries() {
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.hostEntries = make([]hostEntry, 0, 100)
+}
+
+// HostEntries returns a copy of the host entries, in the order they are matched
+func (proxy *HarProxy) HostEntries() []ProxyHosts {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	return hostsOf(proxy.hostEntries)
+}
+
+func (proxy *HarProxy) CaptureSettings() CaptureSettings {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	return proxy.captureSettings
+}
+
+func (proxy *HarProxy) SetCaptureSettings(captureSettings CaptureSettings) {
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.captureSettings = captureSettings
+}
+
+// OnEntry registers callback to be called with every completed entry, including entries
+// dropped because the HAR log is full. Callbacks run on the entry processing goroutines,
+// concurrently with each other, and WaitForEntries waits for them.
+// The returned func unregisters callback.
+func (proxy *HarProxy) OnEntry(callback func(HarEntry)) func() {
+	return proxy.entryListeners.add(callback)
+}
+
+// Subscribe returns a channel receiving the entries OnEntry callbacks get, and a func cancelling the subscription.
+// Entries are dropped rather than blocking when the channel's buffer is full, see SubscriptionDrops.
+// The channel is closed on cancel and once the proxy stopped recording.
+func (proxy *HarProxy) Subscribe(buffer int) (<-chan HarEntry, func()) {
+	return proxy.entryListeners.subscribe(buffer)
+}
+
+// SubscriptionDrops returns how many entries were dropped because a subscriber's buffer was full
+func (proxy *HarProxy) SubscriptionDrops() int64 {
+	return atomic.LoadInt64(&proxy.entryListeners.dropped)
+}
+
+// UseRequest adds middlewares to the end of the request chain.
+// Responses returned by middlewares are recorded in the HAR with a comment saying so.
+func (proxy *HarProxy) UseRequest(middlewares ...RequestMiddleware) {
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.requestMiddlewares = append(proxy.requestMiddlewares, middlewares...)
+}
+
+// UseResponse adds middlewares to the end of the response chain. By default the HAR records
+// the response after the chain ran, see CaptureSettings.CaptureBeforeResponseMiddleware.
+// A panicking middleware is logged and skipped.
+func (proxy *HarProxy) UseResponse(middlewares ...ResponseMiddleware) {
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.responseMiddlewares = append(proxy.responseMiddlewares, middlewares...)
+}
+
+// SetEntryFilter sets a function called with every built entry before it is stored.
+// Returning false drops the entry, the filter may also modify it. Dropped entries don't
+// count towards MaxEntries and never reach OnEntry callbacks.
+// Only one filter is active at a time, nil removes it.
+func (proxy *HarProxy) SetEntryFilter(filter func(*HarEntry) bool) {
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.entryFilter = filter
+}
+
+func (proxy *HarProxy) filterEntry(harEntry *HarEntry) bool {
+	proxy.settingsLock.RLock()
+	filter := proxy.entryFilter
+	proxy.settingsLock.RUnlock()
+	return filter == nil || filter(harEntry)
+}
+
+// Config returns a copy of the proxy's current configuration
+func (proxy *HarProxy) Config() HarProxyConfig {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	hosts := hostsOf(proxy.hostEntries)
+	customHeaders := make([]CustomHeader, len(proxy.customHeaders))
+	copy(customHeaders, proxy.customHeaders)
+	var rateLimit *RateLimit
+	if proxy.rateLimiter != nil {
+		limit := proxy.rateLimiter.limit
+		rateLimit = &limit
+	}
+	var limits *ConnectionLimits
+	if proxy.connectionLimiter != nil {
+		connectionLimits := proxy.connectionLimiter.limits
+		limits = &connectionLimits
+	}
+	var bodyRedactions *BodyRedactions
+	if proxy.bodyRedactor != nil {
+		redactions := proxy.bodyRedactor.redactions.copy()
+		bodyRedactions = &redactions
+	}
+	var sink *SinkOptions
+	if proxy.sink != nil {
+		sinkOptions := proxy.sink.opts.copy()
+		sink = &sinkOptions
+	}
+	var statsd *StatsdOptions
+	if proxy.statsd != nil {
+		statsdOptions := proxy.statsd.opts
+		statsd = &statsdOptions
+	}
+	var tracing *TracingOptions
+	if proxy.tracingOptions != nil {
+		tracingOptions := proxy.tracingOptions.copy()
+		tracing = &tracingOptions
+	}
+	return HarProxyConfig {
+		Hosts 			: hosts,
+		CaptureSettings : proxy.captureSettings,
+		MaxEntries 		: proxy.maxEntries,
+		CustomHeaders 	: customHeaders,
+		LatencyRules 	: latencyRulesOf(proxy.latencyRules),
+		StatusRewrites 	: statusRewritesOf(proxy.statusRewrites),
+		RateLimit 		: rateLimit,
+		Limits 			: limits,
+		BodyRedactions 	: bodyRedactions,
+		QueryRewrites 	: queryRewritesOf(proxy.queryRewrites),
+		CookieRules 	: cookieRulesOf(proxy.cookieRules),
+		Webhooks 		: webhookRulesOf(proxy.webhookRules),
+		Sink 			: sink,
+		Statsd 			: statsd,
+		Tracing 		: tracing,
+		PageHeader 		: proxy.pageHeader,
+	}
+}
+
+// ApplyConfig replaces the proxy's current configuration with config. The replaced sink and tracing exporter
+// still post what they hold. A StatsD server which can't be reached is logged and left out.
+func (proxy *HarProxy) ApplyConfig(config HarProxyConfig) {
+	hostEntries := newHostEntries(config.Hosts)
+	customHeaders := make([]CustomHeader, len(config.CustomHeaders))
+	copy(customHeaders, config.CustomHeaders)
+	now := proxy.clock.Now()
+	latencyRules := newLatencyRules(config.LatencyRules, now)
+	statusRewrites := newStatusRewrites(config.StatusRewrites, now)
+	queryRewrites := newQueryRewrites(config.QueryRewrites)
+	cookieRules := newCookieRules(config.CookieRules)
+	webhookRules := newWebhookRules(config.Webhooks)
+	var limiter *rateLimiter
+	if config.RateLimit != nil {
+		limiter = newRateLimiter(*config.RateLimit)
+	}
+	var connectionLimiter *connectionLimiter
+	if config.Limits != nil {
+		connectionLimiter = newConnectionLimiter(*config.Limits)
+	}
+	var redactor *bodyRedactor
+	if config.BodyRedactions != nil {
+		redactor = newBodyRedactor(*config.BodyRedactions)
+	}
+	var sink *httpSink
+	if config.Sink != nil {
+		sink = newHttpSink(config.Sink.copy(), proxy.logger, proxy.clock, &proxy.sinkCounters, nil)
+	}
+	var statsd *statsdClient
+	if config.Statsd != nil {
+		var err error
+		if statsd, err = newStatsdClient(*config.Statsd, proxy.logger, &proxy.statsdCounters); err != nil {
+			proxy.logger.Errorf("Not sending the metrics of proxy on port :%v to StatsD : %v", proxy.Port, err)
+		}
+	}
+	var tracing *httpSink
+	var tracingOptions *TracingOptions
+	if config.Tracing != nil {
+		tracing, tracingOptions = proxy.newTracingExporter(*config.Tracing)
+	}
+
+	proxy.settingsLock.Lock()
+	previousSink, previousStatsd, previousTracing := proxy.sink, proxy.statsd, proxy.tracing
+	proxy.sink, proxy.statsd = sink, statsd
+	proxy.tracing, proxy.tracingOptions = tracing, tracingOptions
+	proxy.hostEntries = hostEntries
+	proxy.captureSettings = config.CaptureSettings
+	proxy.maxEntries = config.MaxEntries
+	proxy.customHeaders = customHeaders
+	proxy.latencyRules = latencyRules
+	proxy.statusRewrites = statusRewrites
+	proxy.queryRewrites = queryRewrites
+	proxy.cookieRules = cookieRules
+	proxy.webhookRules = webhookRules
+	proxy.rateLimiter = limiter
+	proxy.connectionLimiter = connectionLimiter
+	proxy.bodyRedactor = redactor
+	proxy.pageHeader = config.PageHeader
+	proxy.settingsLock.Unlock()
+	if previousSink != nil {
+		go previousSink.close()
+	}
+	if previousStatsd != nil {
+		go previousStatsd.close()
+	}
+	if previousTracing != nil {
+		go previousTracing.close()
+	}
+}
+
+// Clone creates a new, not yet started, proxy with a copy of this proxy's configuration, entry filter,
+// entry metadata, middlewares and seed. The clone shares the Transport the proxy was given, if any,
+// otherwise it builds its own from the same DialContext and UpstreamPool, so their connections are apart.
+// Recorded entries, OnEntry callbacks and the name are not copied. Fails if the clone can't be created,
+// e.g. when its export directory can't be made anymore.
+func (proxy *HarProxy) Clone() (*HarProxy, error) {
+	clone, err := NewHarProxyWithOptions(HarProxyOptions {
+		BindAddr 	: proxy.bindAddr,
+		Transport 	: proxy.givenTransport,
+		DialContext : proxy.dialContext,
+		UpstreamPool : proxy.upstreamPool,
+		Logger 		: proxy.logger,
+		Clock 		: proxy.clock,
+		Export 		: proxy.exportOptions,
+		EntryBuffer 	: proxy.entryBuffer,
+		EntryOverflow 	: proxy.entryOverflow(),
+		EntryWorkers 	: proxy.entryWorkers,
+		CaptureBudget 	: proxy.captureBudget,
+		CaptureBudgetPolicy : proxy.captureBudgetPolicy(),
+		LookupIP 		: proxy.resolver.lookup,
+		Seed 			: proxy.Seed(),
+		Stub 			: proxy.Stub(),
+		AccessLog 		: proxy.accessLog,
+	})
+	if err != nil {
+		return nil, err
+	}
+	clone.ApplyConfig(proxy.Config())
+	proxy.settingsLock.RLock()
+	clone.entryFilter = proxy.entryFilter
+	clone.entryMetadata = proxy.entryMetadata
+	clone.requestMiddlewares = append(clone.requestMiddlewares, proxy.requestMiddlewares...)
+	clone.responseMiddlewares = append(clone.responseMiddlewares, proxy.responseMiddlewares...)
+	proxy.settingsLock.RUnlock()
+	return clone, nil
+}
+
+// Start listens on the configured port and serves the proxy in the background.
+// Listen errors are returned, errors while serving are available through Err.
+func (proxy *HarProxy) Start() error {
+	return proxy.StartContext(context.Background())
+}
+
+// StartContext is like Start, but the proxy is shut down gracefully when ctx is cancelled
+func (proxy *HarProxy) StartContext(ctx context.Context) error {
+	proxy.stateLock.Lock()
+	defer proxy.stateLock.Unlock()
+	switch proxy.state {
+	case proxyStarted:
+		return ErrAlreadyStarted
+	case proxyStopped:
+		return ErrAlreadyStopped
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(proxy.bindAddr, strconv.Itoa(proxy.Port)))
+	if err != nil {
+		proxy.logger.Errorf("Failed listening on port :%v : %v", proxy.Port, err)
+		return err
+	}
+	proxy.startServing(ctx, l)
+	return nil
+}
+
+// Serve serves the proxy on l instead of listening on Port, and blocks until it is stopped.
+// Port is updated from the listener address. Returns nil once stopped with Stop or Shutdown,
+// otherwise the error which made serving fail, e.g. from a closed listener.
+func (proxy *HarProxy) Serve(l net.Listener) error {
+	proxy.stateLock.Lock()
+	switch proxy.state {
+	case proxyStarted:
+		proxy.stateLock.Unlock()
+		return ErrAlreadyStarted
+	case proxyStopped:
+		proxy.stateLock.Unlock()
+		return ErrAlreadyStopped
+	}
+	proxy.startServing(context.Background(), l)
+	proxy.stateLock.Unlock()
+
+	<-proxy.isDone
+	return proxy.Err()
+}
+
+// Addr returns the address the proxy is bound to, ErrNotStarted before Start or Serve.
+// Unlike Port this is the actual address when listening on port 0.
+func (proxy *HarProxy) Addr() (net.Addr, error) {
+	proxy.stateLock.Lock()
+	defer proxy.stateLock.Unlock()
+	if proxy.StoppableListener == nil {
+		return nil, ErrNotStarted
+	}
+	return proxy.StoppableListener.Addr(), nil
+}
+
+// URL returns the proxy URL to configure clients with, e.g. "http://127.0.0.1:8080", or "" before Start.
+// A proxy bound to all interfaces is given with the loopback address.
+func (proxy *HarProxy) URL() string {
+	addr, err := proxy.Addr()
+	if err != nil {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// Must be called with stateLock held, on a proxy which was not started yet
+func (proxy *HarProxy) startServing(ctx context.Context, l net.Listener) {
+	proxy.state = proxyStarted
+	proxy.startProcessing()
+	proxy.StoppableListener = newStoppableListener(l)
+	proxy.Port = GetPort(l)
+	registerLiveProxy(proxy)
+	proxy.server = &http.Server{Handler : proxy.Proxy, ErrorLog : log.New(printfLogger{proxy.logger}, "", 0)}
+	proxy.logger.Infof("Starting harproxy server on port :%v", proxy.Port)
+	go func() {
+		err := proxy.server.Serve(proxy.StoppableListener)
+		if err != nil && err != http.ErrServerClosed {
+			proxy.logger.Errorf("Serving proxy on port :%v failed : %v", proxy.Port, err)
+			proxy.serveErrLock.Lock()
+			proxy.serveErr = err
+			proxy.serveErrLock.Unlock()
+		}
+		proxy.logger.Infof("Done serving proxy on port: %v", proxy.Port)
+		close(proxy.isDone)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+			defer cancel()
+			proxy.Shutdown(shutdownCtx)
+		case <-proxy.entriesDone:
+		}
+	}()
+	proxy.logger.Infof("Started harproxy server on port :%v", proxy.Port)
+}
+
+// Handler returns the recording proxy as an http.Handler, usable with any server instead of Start.
+// Call Close once the server is done with it to store the remaining entries.
+func (proxy *HarProxy) Handler() http.Handler {
+	proxy.startProcessing()
+	return proxy.Proxy
+}
+
+// Close stops recording for a proxy used through Handler and waits for the remaining entries to be stored.
+// Requests still reaching the handler are proxied without being recorded. Proxies started
+// with Start are stopped with Stop or Shutdown instead.
+func (proxy *HarProxy) Close() error {
+	proxy.stateLock.Lock()
+	switch proxy.state {
+	case proxyStarted:
+		proxy.stateLock.Unlock()
+		return ErrAlreadyStarted
+	case proxyStopped:
+		proxy.stateLock.Unlock()
+		return ErrAlreadyStopped
+	}
+	proxy.state = proxyStopped
+	proxy.stateLock.Unlock()
+
+	proxy.startProcessing()
+	// One deadline for both waits, a timer tick received by the first would never reach the second
+	ctx, cancel := withClockTimeout(context.Background(), proxy.clock, stopTimeout)
+	defer cancel()
+	proxy.sending.wait(ctx, nil)
+	proxy.closeEntryChannel()
+	select {
+	case <-proxy.entriesDone:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("goharproxy: timed out after %v waiting for entries to be stored", stopTimeout)
+	}
+}
+
+// Err returns the error that made the proxy stop serving, or nil if it is serving or was stopped by Stop
+func (proxy *HarProxy) Err() error {
+	proxy.serveErrLock.Lock()
+	defer proxy.serveErrLock.Unlock()
+	return proxy.serveErr
+}
+
+// Stop closes the listener and all open connections, then waits for the recorded entries to be processed.
+// Requests whose upstream response already arrived are recorded, requests still waiting for it are not.
+// It returns ErrNotStarted before Start and ErrAlreadyStopped on any call after the first.
+func (proxy *HarProxy) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	return proxy.stop(ctx, false)
+}
+
+// Shutdown stops accepting new connections and waits for in-flight requests and their entries
+// until ctx is done, at which point the remaining connections are closed and ctx.Err() is returned.
+func (proxy *HarProxy) Shutdown(ctx context.Context) error {
+	return proxy.stop(ctx, true)
+}
+
+func (proxy *HarProxy) stop(ctx context.Context, graceful bool) error {
+	proxy.stateLock.Lock()
+	switch proxy.state {
+	case proxyNew:
+		proxy.stateLock.Unlock()
+		return ErrNotStarted
+	case proxyStopped:
+		proxy.stateLock.Unlock()
+		return ErrAlreadyStopped
+	}
+	proxy.state = proxyStopped
+	proxy.stateLock.Unlock()
+	unregisterLiveProxy(proxy)
+
+	proxy.logger.Infof("Stopping harproxy server on port :%v", proxy.Port)
+	var err error
+	if graceful {
+		if err = proxy.server.Shutdown(ctx); err != nil {
+			proxy.logger.Infof("Forcing harproxy server on port :%v to stop: %v", proxy.Port, err)
+			proxy.server.Close()
+		}
+	} else {
+		proxy.server.Close()
+	}
+
+	// Once serving is done no request starts anymore. Requests whose response arrived send their entry,
+	// then we stop the process entries routine and wait for it to store them
+	<-proxy.isDone
+	proxy.sending.wait(ctx, nil)
+	proxy.CloseIdleConnections()
+	proxy.closeEntryChannel()
+	select {
+	case <-proxy.entriesDone:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	proxy.cancelWebhooks()
+	if err != nil && err != context.DeadlineExceeded && err != context.Canceled {
+		err = fmt.Errorf("goharproxy: stopping proxy on port :%v : %v", proxy.Port, err)
+	}
+	return err
+}
+
+// Releases the exporters of a proxy which never started, e.g. because its port is taken, as stopping does
+func (proxy *HarProxy) discard() {
+	if proxy.export != nil {
+		proxy.export.close()
+	}
+	proxy.closeSink()
+	proxy.closeStatsd()
+	proxy.closeTracing()
+	proxy.cancelWebhooks()
+}
+
+// CloseIdleConnections closes the idle upstream connections, so the next requests connect afresh.
+// Does nothing if the transport doesn't pool connections.
+func (proxy *HarProxy) CloseIdleConnections() {
+	if closer, ok := proxy.transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+func (proxy *HarProxy) ClearEntries() {
+	proxy.logger.Debugf("Clearing HAR for harproxy server on port :%v", proxy.Port)
+	proxy.HarLog.clear()
+}
+
+// TakeEntries waits up to WaitEntriesTimeout for the entries still being recorded, then clears the recorded
+// entries and returns them with a func putting them back, e.g. when sending them failed
+func (proxy *HarProxy) TakeEntries(ctx context.Context) ([]HarEntry, func()) {
+	proxy.waitForEntries(ctx, WaitEntriesTimeout)
+	drained := proxy.HarLog.drain()
+	return drained.Entries(), func() {
+		proxy.HarLog.restore(drained)
+	}
+}
+
+// NewHarReader returns the HAR log as JSON, see WriteHar. Reading it fails if the log can't be serialized.
+func (proxy *HarProxy) NewHarReader() io.Reader {
+	buffer := new(bytes.Buffer)
+	if _, err := proxy.WriteHar(buffer); err != nil {
+		proxy.logger.Errorf("Serializing HAR of proxy on port :%v : %v", proxy.Port, err)
+		return errReader{err}
+	}
+	return buffer
+}
+
+type errReader struct {
+	err error
+}
+
+func (reader errReader) Read(p []byte) (int, error) {
+	return 0, reader.err
+}
+
+// How long WriteHar and the har route wait for pending entries before serving what was recorded
+var WaitEntriesTimeout = 10 * time.Second
+
+// WriteHar waits up to WaitEntriesTimeout for the pending entries to be recorded, then streams the HAR log as JSON to w
+func (proxy *HarProxy) WriteHar(w io.Writer) (int64, error) {
+	proxy.waitForEntries(context.Background(), WaitEntriesTimeout)
+	return proxy.HarLog.WriteTo(w)
+}
+
+// InFlightRequests returns the number of requests which reached the proxy and are waiting for their response
+func (proxy *HarProxy) InFlightRequests() int {
+	return int(atomic.LoadInt64(&proxy.metrics.inFlight))
+}
+
+// PendingEntries returns the number of entries of completed requests which are not recorded yet
+func (proxy *HarProxy) PendingEntries() int {
+	return int(atomic.LoadInt64(&proxy.metrics.pendingEntries))
+}
+
+// Entry returns a copy of the recorded entry with id, false once it was cleared or drained, see HarEntry.Id
+func (proxy *HarProxy) Entry(id int64) (HarEntry, bool) {
+	return proxy.HarLog.Entry(id)
+}
+
+// DroppedEntries returns the number of entries dropped because the entry queue was full, see OverflowDrop
+func (proxy *HarProxy) DroppedEntries() int {
+	return int(atomic.LoadInt64(&proxy.metrics.droppedEntries))
+}
+
+func (proxy *HarProxy) entryOverflow() string {
+	if proxy.dropOverflow {
+		return OverflowDrop
+	}
+	return OverflowBlock
+}
+
+func (proxy *HarProxy) captureBudgetPolicy() string {
+	if proxy.evictBodies {
+		return BudgetEvict
+	}
+	return BudgetSkip
+}
+
+// WaitForEntries blocks until the entries of every request which reached the proxy are recorded,
+// including requests still waiting for their response. Returns ctx.Err() if ctx is done first.
+func (proxy *HarProxy) WaitForEntries(ctx context.Context) error {
+	return proxy.waitForEntries(ctx, 0)
+}
+
+// WaitForEntries, giving up after timeout on the proxy's clock unless it is 0
+func (proxy *HarProxy) waitForEntries(ctx context.Context, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := proxy.clock.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C()
+	}
+	err := proxy.pending.wait(ctx, expired)
+	if err != nil {
+		proxy.logger.Infof("Giving up waiting for %v entries of proxy on port :%v : %v", proxy.pending.len(), proxy.Port, err)
+	}
+	return err
+}
+//
+
+// HarProxyServer
+
+// The management API, creating proxies and serving their HAR logs over REST
+type ProxyServer struct {
+	opts ProxyServerOptions
+
+	// Serves the API, and optionally redirects plain HTTP to it
+	server *http.Server
+	redirectServer *http.Server
+
+	// The TLS configuration of the API, nil when it is served over plain HTTP
+	tlsConfig *tls.Config
+
+	// Set once started, guarded by stateLock
+	listener net.Listener
+	started bool
+	stopped bool
+	stateLock sync.Mutex
+
+	// Served alongside the API, see AddAPIServer
+	apiServers []*addedAPIServer
+
+	// Closed once server stopped serving
+	isDone chan bool
+
+	serveErr error
+	serveErrLock sync.RWMutex
+
+	// The created proxies, by port and name
+	proxies *proxyRegistry
+
+	// Authenticate the streams of clients which can't send API keys
+	streamTokens *streamTokens
+
+	// Receives everything the server logs
+	logger Logger
+
+	// Times the waits for entries of several proxies
+	clock Clock
+}
+
+var portPathRegex *regexp.Regexp = regexp.MustCompile("^/([^/]*)(/.*)?$")
+
+// Ports in paths are 1 to 5 digits, checked to be in range after parsing
+var portRegex *regexp.Regexp = regexp.MustCompile("^\\d{1,5}$")
+
+var namePathRegex *regexp.Regexp = regexp.MustCompile("^/name/([^/]+)(/.*)?$")
+
+// Names which /name/[name] can reach, no slashes and not only whitespace
+func validProxyName(name string) bool {
+	return strings.TrimSpace(name) != "" && !strings.Contains(name, "/")
+}
+
+type ProxyServerPort struct {
+	Port 	int   		`json:"port"`
+	Name 	string		`json:"name,omitempty"`
+	Address string 		`json:"address,omitempty"`
+	// The owner of the key which created the proxy, see ProxyServerOptions.APIKeys
+	Owner 	string 		`json:"owner,omitempty"`
+}
+
+type ProxyServerCreate struct {
+	Port 	int 				`json:"port"`
+	BindAddress string 			`json:"bindAddress"`
+	Name 	string				`json:"name"`
+	Config 	*HarProxyConfig		`json:"config"`
+	EntryBuffer int 			`json:"entryBuffer"`
+	EntryOverflow string 		`json:"entryOverflow"`
+	EntryWorkers int 			`json:"entryWorkers"`
+	CaptureBudget int64 		`json:"captureBudget"`
+	CaptureBudgetPolicy string 	`json:"captureBudgetPolicy"`
+	UpstreamPool *UpstreamPool 	`json:"upstreamPool"`
+	Seed int64 					`json:"seed"`
+	Sink *SinkOptions 			`json:"sink"`
+	Statsd *StatsdOptions 		`json:"statsd"`
+	Tracing *TracingOptions 	`json:"tracing"`
+}
+
+// What GET /proxy/[port]/status returns about the proxy's traffic and entry queue
+type ProxyServerStatus struct {
+	Port 				int 	`json:"port"`
+	Name 				string 	`json:"name,omitempty"`
+	Owner 				string 	`json:"owner,omitempty"`
+	Entries 			int 	`json:"entries"`
+	InFlightRequests 	int 	`json:"inFlightRequests"`
+	PendingEntries 		int 	`json:"pendingEntries"`
+	DroppedEntries 		int 	`json:"droppedEntries"`
+	EntryBuffer 		int 	`json:"entryBuffer"`
+	EntryOverflow 		string 	`json:"entryOverflow"`
+	EntryWorkers 		int 	`json:"entryWorkers"`
+	CaptureBytes 		int64 	`json:"captureBytes"`
+	CaptureBudget 		int64 	`json:"captureBudget"`
+	CaptureBudgetPolicy string 	`json:"captureBudgetPolicy"`
+	Seed 				int64 	`json:"seed"`
+	SinkSent 			int64 	`json:"sinkSent"`
+	SinkFailures 		int64 	`json:"sinkFailures"`
+	SinkDropped 		int64 	`json:"sinkDropped"`
+	WebhooksSent 		int64 	`json:"webhooksSent"`
+	WebhookFailures 	int64 	`json:"webhookFailures"`
+	WebhooksSuppressed 	int64 	`json:"webhooksSuppressed"`
+	StatsdSent 			int64 	`json:"statsdSent"`
+	StatsdDropped 		int64 	`json:"statsdDropped"`
+	TracingSent 		int64 	`json:"tracingSent"`
+	TracingFailures 	int64 	`json:"tracingFailures"`
+	TracingDropped 		int64 	`json:"tracingDropped"`
+	StubServed 			int64 	`json:"stubServed"`
+	StubUnmatched 		int64 	`json:"stubUnmatched"`
+}
+
+// The proxies whose logs POST /har/merge combines, Clear clears them like PUT /proxy/[port]/har
+type ProxyServerMerge struct {
+	Ports 	[]int 	`json:"ports"`
+	Clear 	bool 	`json:"clear"`
+}
+
+// The logs POST /har/diff compares, either the logs of two proxies or two uploaded logs
+type ProxyServerDiff struct {
+	Ports 	[]int 			`json:"ports"`
+	Hars 	[]*HarLog 		`json:"hars"`
+	Options DiffOptions 	`json:"options"`
+}
+
+type ProxyServerErr struct {
+	Error string	`json:"error"`
+	// The invalid items of a request body holding a list, e.g. of hosts entries
+	Items []ProxyServerItemErr 	`json:"items,omitempty"`
+}
+
+// Why the item at Index of a request body is invalid
+type ProxyServerItemErr struct {
+	Index int 		`json:"index"`
+	Error string 	`json:"error"`
+}
+
+type ProxyServerMessage struct {
+	Message string 		`json:"message"`
+}
+
+// Redirects requests to Host to NewHost, the first matching entry wins in insertion order
+type ProxyHosts struct {
+	Host 		string 		`json:"host"`
+	NewHost 	string		`json:"NewHost"`
+
+	// MatchExact when empty, MatchWildcard or MatchRegex
+	MatchType 	string 		`json:"matchType,omitempty"`
+
+	// http or https, keeps the scheme of the request when empty
+	NewScheme 	string 		`json:"newScheme,omitempty"`
+
+	// Send the original Host header to NewHost instead of NewHost itself, for name based virtual hosts
+	PreserveHostHeader bool `json:"preserveHostHeader,omitempty"`
+
+	// Point Location headers redirecting to NewHost back at the requested host, so redirects keep going through the entry
+	RewriteLocation bool 	`json:"rewriteLocation,omitempty"`
+}
+
+func (proxyServer *ProxyServer) addHostEntries(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	hostEntries := make([]ProxyHosts, 0, 10)
+	if !proxyServer.decodeJsonBody(w, r, &hostEntries, false) {
+		return
+	}
+
+	var itemErrs []ProxyServerItemErr
+	for i, hostEntry := range hostEntries {
+		if hostEntry.Host == "" || hostEntry.NewHost == "" {
+			itemErrs = append(itemErrs, ProxyServerItemErr{Index : i, Error : "Host and NewHost can't be empty"})
+		} else if err := hostEntry.Validate(); err != nil {
+			itemErrs = append(itemErrs, ProxyServerItemErr{Index : i, Error : err.Error()})
+		}
+	}
+	if len(itemErrs) > 0 {
+		proxyServer.writeItemErrors(w, http.StatusUnprocessableEntity, fmt.Sprintf("%v of %v hosts entries are invalid", len(itemErrs), len(hostEntries)), itemErrs)
+		return
+	}
+
+	harProxy.AddHostEntries(hostEntries)
+	writeMessage(w, "Added hosts entries successfully")
+}
+
+func getHostEntries(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.HostEntries())
+}
+
+func clearHostEntries(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.ClearHostEntries()
+	writeMessage(w, "Cleared hosts entries successfully")
+}
+
+func (proxyServer *ProxyServer) removeHostEntry(harProxy *HarProxy, host string, w http.ResponseWriter) {
+	if !harProxy.RemoveHostEntry(host) {
+		proxyServer.writeErrorMessage(w, http.StatusNotFound, fmt.Sprintf("No hosts entry for [%v]", host))
+		return
+	}
+	writeMessage(w, fmt.Sprintf("Removed hosts entry for [%v] successfully", host))
+}
+
+func (proxyServer *ProxyServer) putCaptureSettings(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	captureSettings := CaptureSettings{}
+	if !proxyServer.decodeJsonBody(w, r, &captureSettings, false) {
+		return
+	}
+	if captureSettings.MaxCaptureBytes < 0 {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("invalid max capture bytes [%v]", captureSettings.MaxCaptureBytes))
+		return
+	}
+	harProxy.SetCaptureSettings(captureSettings)
+	writeMessage(w, "Set capture settings successfully")
+}
+
+func getCaptureSettings(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	captureSettings := harProxy.CaptureSettings()
+	json.NewEncoder(w).Encode(&captureSettings)
+}
+
+func (proxyServer *ProxyServer) putLatencyRules(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	latencyRules := make([]LatencyRule, 0, 10)
+	if !proxyServer.decodeJsonBody(w, r, &latencyRules, false) {
+		return
+	}
+
+	var itemErrs []ProxyServerItemErr
+	for i, latencyRule := range latencyRules {
+		if err := latencyRule.validate(); err != nil {
+			itemErrs = append(itemErrs, ProxyServerItemErr{Index : i, Error : err.Error()})
+		}
+	}
+	if len(itemErrs) > 0 {
+		proxyServer.writeItemErrors(w, http.StatusUnprocessableEntity, fmt.Sprintf("%v of %v latency rules are invalid", len(itemErrs), len(latencyRules)), itemErrs)
+		return
+	}
+
+	harProxy.SetLatencyRules(latencyRules)
+	writeMessage(w, "Set latency rules successfully")
+}
+
+func getLatencyRules(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.LatencyRules())
+}
+
+func clearLatencyRules(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetLatencyRules(nil)
+	writeMessage(w, "Cleared latency rules successfully")
+}
+
+func (proxyServer *ProxyServer) putStatusRewrites(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	statusRewrites := make([]StatusRewrite, 0, 10)
+	if !proxyServer.decodeJsonBody(w, r, &statusRewrites, false) {
+		return
+	}
+
+	var itemErrs []ProxyServerItemErr
+	for i, statusRewrite := range statusRewrites {
+		if err := statusRewrite.validate(); err != nil {
+			itemErrs = append(itemErrs, ProxyServerItemErr{Index : i, Error : err.Error()})
+		}
+	}
+	if len(itemErrs) > 0 {
+		proxyServer.writeItemErrors(w, http.StatusUnprocessableEntity, fmt.Sprintf("%v of %v status rewrites are invalid", len(itemErrs), len(statusRewrites)), itemErrs)
+		return
+	}
+
+	harProxy.SetStatusRewrites(statusRewrites)
+	writeMessage(w, "Set status rewrites successfully")
+}
+
+func getStatusRewrites(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.StatusRewrites())
+}
+
+func clearStatusRewrites(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetStatusRewrites(nil)
+	writeMessage(w, "Cleared status rewrites successfully")
+}
+
+func (proxyServer *ProxyServer) putQueryRewrites(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	queryRewrites := make([]QueryRewrite, 0, 10)
+	if !proxyServer.decodeJsonBody(w, r, &queryRewrites, false) {
+		return
+	}
+
+	var itemErrs []ProxyServerItemErr
+	for i, queryRewrite := range queryRewrites {
+		if err := queryRewrite.validate(); err != nil {
+			itemErrs = append(itemErrs, ProxyServerItemErr{Index : i, Error : err.Error()})
+		}
+	}
+	if len(itemErrs) > 0 {
+		proxyServer.writeItemErrors(w, http.StatusUnprocessableEntity, fmt.Sprintf("%v of %v query rewrites are invalid", len(itemErrs), len(queryRewrites)), itemErrs)
+		return
+	}
+
+	harProxy.SetQueryRewrites(queryRewrites)
+	writeMessage(w, "Set query rewrites successfully")
+}
+
+func getQueryRewrites(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.QueryRewrites())
+}
+
+func clearQueryRewrites(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetQueryRewrites(nil)
+	writeMessage(w, "Cleared query rewrites successfully")
+}
+
+func (proxyServer *ProxyServer) putCookieRules(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	cookieRules := make([]CookieRule, 0, 10)
+	if !proxyServer.decodeJsonBody(w, r, &cookieRules, false) {
+		return
+	}
+
+	var itemErrs []ProxyServerItemErr
+	for i, cookieRule := range cookieRules {
+		if err := cookieRule.validate(); err != nil {
+			itemErrs = append(itemErrs, ProxyServerItemErr{Index : i, Error : err.Error()})
+		}
+	}
+	if len(itemErrs) > 0 {
+		proxyServer.writeItemErrors(w, http.StatusUnprocessableEntity, fmt.Sprintf("%v of %v cookie rules are invalid", len(itemErrs), len(cookieRules)), itemErrs)
+		return
+	}
+
+	harProxy.SetCookieRules(cookieRules)
+	writeMessage(w, "Set cookie rules successfully")
+}
+
+func getCookieRules(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.CookieRules())
+}
+
+func clearCookieRules(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetCookieRules(nil)
+	writeMessage(w, "Cleared cookie rules successfully")
+}
+
+func (proxyServer *ProxyServer) addWebhookRules(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	webhookRules := make([]WebhookRule, 0, 10)
+	if !proxyServer.decodeJsonBody(w, r, &webhookRules, false) {
+		return
+	}
+
+	var itemErrs []ProxyServerItemErr
+	for i, webhookRule := range webhookRules {
+		if err := webhookRule.validate(); err != nil {
+			itemErrs = append(itemErrs, ProxyServerItemErr{Index : i, Error : err.Error()})
+		}
+	}
+	if len(itemErrs) > 0 {
+		proxyServer.writeItemErrors(w, http.StatusUnprocessableEntity, fmt.Sprintf("%v of %v webhook rules are invalid", len(itemErrs), len(webhookRules)), itemErrs)
+		return
+	}
+
+	harProxy.AddWebhookRules(webhookRules)
+	writeMessage(w, "Added webhook rules successfully")
+}
+
+func getWebhookRules(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.WebhookRules())
+}
+
+func clearWebhookRules(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetWebhookRules(nil)
+	writeMessage(w, "Cleared webhook rules successfully")
+}
+
+func (proxyServer *ProxyServer) putRateLimit(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	rateLimit := RateLimit{}
+	if !proxyServer.decodeJsonBody(w, r, &rateLimit, false) {
+		return
+	}
+	if err := harProxy.SetRateLimit(&rateLimit); err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeMessage(w, "Set rate limit successfully")
+}
+
+func getRateLimit(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.RateLimit())
+}
+
+func clearRateLimit(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetRateLimit(nil)
+	writeMessage(w, "Removed rate limit successfully")
+}
+
+func (proxyServer *ProxyServer) putBodyRedactions(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	redactions := BodyRedactions{}
+	if !proxyServer.decodeJsonBody(w, r, &redactions, false) {
+		return
+	}
+	if err := harProxy.SetBodyRedactions(&redactions); err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeMessage(w, "Set body redactions successfully")
+}
+
+func getBodyRedactions(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.BodyRedactions())
+}
+
+func clearBodyRedactions(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetBodyRedactions(nil)
+	writeMessage(w, "Removed body redactions successfully")
+}
+
+func (proxyServer *ProxyServer) putConnectionLimits(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	limits := ConnectionLimits{}
+	if !proxyServer.decodeJsonBody(w, r, &limits, false) {
+		return
+	}
+	if err := harProxy.SetConnectionLimits(&limits); err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeMessage(w, "Set connection limits successfully")
+}
+
+func getConnectionLimits(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	limits := harProxy.ConnectionLimits()
+	if limits == nil {
+		limits = &ConnectionLimits{}
+	}
+	json.NewEncoder(w).Encode(limits)
+}
+
+func clearConnectionLimits(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetConnectionLimits(nil)
+	writeMessage(w, "Removed connection limits successfully")
+}
+
+func (proxyServer *ProxyServer) putSink(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	sink := SinkOptions{}
+	if !proxyServer.decodeJsonBody(w, r, &sink, false) {
+		return
+	}
+	if err := harProxy.SetSink(&sink); err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeMessage(w, "Set sink successfully")
+}
+
+func getSink(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	sink := harProxy.Sink()
+	if sink == nil {
+		sink = &SinkOptions{}
+	}
+	json.NewEncoder(w).Encode(sink)
+}
+
+func removeSink(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetSink(nil)
+	writeMessage(w, "Removed sink successfully")
+}
+
+func (proxyServer *ProxyServer) putStatsd(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	statsd := StatsdOptions{}
+	if !proxyServer.decodeJsonBody(w, r, &statsd, false) {
+		return
+	}
+	if err := harProxy.SetStatsd(&statsd); err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeMessage(w, "Set statsd successfully")
+}
+
+func getStatsd(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	statsd := harProxy.Statsd()
+	if statsd == nil {
+		statsd = &StatsdOptions{}
+	}
+	json.NewEncoder(w).Encode(statsd)
+}
+
+func removeStatsd(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetStatsd(nil)
+	writeMessage(w, "Removed statsd successfully")
+}
+
+func (proxyServer *ProxyServer) putTracing(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	tracing := TracingOptions{}
+	if !proxyServer.decodeJsonBody(w, r, &tracing, false) {
+		return
+	}
+	if err := harProxy.SetTracing(&tracing); err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeMessage(w, "Set tracing successfully")
+}
+
+func getTracing(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	tracing := harProxy.Tracing()
+	if tracing == nil {
+		tracing = &TracingOptions{}
+	}
+	json.NewEncoder(w).Encode(tracing)
+}
+
+func removeTracing(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetTracing(nil)
+	writeMessage(w, "Removed tracing successfully")
+}
+
+// Answers the proxy's requests with the responses of the HAR document posted, with the stub options as query params:
+// unmatched, matchHeaders as a comma separated list, matchBody and refreshHeaders
+func (proxyServer *ProxyServer) postStub(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	query := r.URL.Query()
+	stub := StubOptions{Unmatched : query.Get("unmatched")}
+	if value := query.Get("matchHeaders"); value != "" {
+		for _, name := range strings.Split(value, ",") {
+			stub.MatchHeaders = append(stub.MatchHeaders, strings.TrimSpace(name))
+		}
+	}
+	for name, flag := range map[string]*bool{"matchBody" : &stub.MatchBody, "refreshHeaders" : &stub.RefreshHeaders} {
+		if value := query.Get(name); value != "" {
+			var err error
+			if *flag, err = strconv.ParseBool(value); err != nil {
+				proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid %v [%v]", name, value))
+				return
+			}
+		}
+	}
+	harLog, err := ParseHar(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		proxyServer.writeErrorMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body larger than %v bytes", tooLarge.Limit))
+		return
+	case err != nil:
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Reading the HAR document: %v", err))
+		return
+	}
+	stub.Har = harLog
+	if err := harProxy.SetStub(&stub); err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeMessage(w, "Set stub successfully")
+}
+
+func getStub(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	stub := harProxy.Stub()
+	if stub == nil {
+		stub = &StubOptions{}
+	}
+	json.NewEncoder(w).Encode(stub)
+}
+
+func removeStub(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.SetStub(nil)
+	writeMessage(w, "Removed stub successfully")
+}
+
+func (proxyServer *ProxyServer) deleteHarProxy(harProxy *HarProxy, w http.ResponseWriter) {
+	port := harProxy.Port
+	if !proxyServer.removeHarProxy(harProxy) {
+		writeMessage(w, fmt.Sprintf("Proxy for port [%v] was already deleted", port))
+		return
+	}
+	writeMessage(w, fmt.Sprintf("Deleted proxy for port [%v] succesfully", port))
+}
+
+// Unregisters and stops harProxy, false if it was already deleted
+func (proxyServer *ProxyServer) removeHarProxy(harProxy *HarProxy) bool {
+	proxyServer.logger.Infof("Deleting proxy on port :%v", harProxy.Port)
+	// Another request may have deleted it since it was looked up, that one stops it
+	if !proxyServer.proxies.delete(harProxy) {
+		return false
+	}
+	if err := harProxy.Stop(); err != nil {
+		proxyServer.logger.Errorf("Stopping proxy on port :%v : %v", harProxy.Port, err)
+	}
+	return true
+}
+
+// Serves the proxy's HAR log, clearing it if drain
+func (proxyServer *ProxyServer) getHarLog(harProxy *HarProxy, r *http.Request, w http.ResponseWriter, drain bool) {
+	var columns []string
+	if value := r.URL.Query().Get("columns"); value != "" {
+		columns = strings.Split(value, ",")
+	}
+	format := harLogFormat(r)
+	switch format {
+	case "jsonl":
+		w.Header().Add("Content-Type", "application/x-ndjson")
+	case "csv":
+		// Checked before draining, so a request with a bad column doesn't lose the entries
+		if err := validateCSVColumns(columns); err != nil {
+			proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Add("Content-Type", "text/csv")
+	case "json":
+		w.Header().Add("Content-Type", "application/json")
+	default:
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Unknown HAR format [%v]", format))
+		return
+	}
+	query, ok := proxyServer.harLogQueryParams(r, w)
+	if !ok {
+		return
+	}
+	if query != nil && drain {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, "from, to, urlPattern, offset and limit only apply to GET, entries aren't cleared by parts")
+		return
+	}
+	policy, ok := proxyServer.anonymizeParams(r, w)
+	if !ok {
+		return
+	}
+	if err := harProxy.waitForEntries(context.Background(), WaitEntriesTimeout); err != nil {
+		w.Header().Set("X-Pending-Entries", strconv.Itoa(harProxy.pending.len()))
+	}
+	harLog := harProxy.HarLog
+	if drain {
+		harLog = harProxy.HarLog.drain()
+	} else if query != nil {
+		var matched int
+		harLog, matched = harProxy.HarLog.selected(query.keep, query.offset, query.limit)
+		w.Header().Set("X-Total-Entries", strconv.Itoa(matched))
+	}
+	proxyServer.logger.Debugf("Serving %v entries of proxy on port :%v", harLog.Len(), harProxy.Port)
+	// The drained entries are restored as they were if serving them fails
+	served := harLog
+	if policy != nil {
+		served = harLog.Anonymized(*policy)
+	}
+	proxyServer.writeHarLog(w, func(w io.Writer) (int64, error) {
+		switch format {
+		case "jsonl":
+			return served.WriteJSONL(w)
+		case "csv":
+			return served.WriteCSV(w, columns)
+		}
+		return served.WriteTo(w)
+	}, func() {
+		// The entries are drained in one step, so that concurrent exports never serve the same ones
+		if drain {
+			harProxy.HarLog.restore(harLog)
+		}
+	})
+}
+
+// Reads the anonymize params, nil unless anonymize=true. anonymizeHosts=true replaces the hosts, anonymizeHeaders
+// and anonymizeParams are comma separated names scrubbed on top of those of DefaultAnonymizePolicy.
+func (proxyServer *ProxyServer) anonymizeParams(r *http.Request, w http.ResponseWriter) (*AnonymizePolicy, bool) {
+	params := r.URL.Query()
+	flags := map[string]bool{}
+	for _, name := range []string{"anonymize", "anonymizeHosts"} {
+		if value := params.Get(name); value != "" {
+			var err error
+			if flags[name], err = strconv.ParseBool(value); err != nil {
+				proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid %v [%v]", name, value))
+				return nil, false
+			}
+		}
+	}
+	if !flags["anonymize"] {
+		for _, name := range []string{"anonymizeHosts", "anonymizeHeaders", "anonymizeParams"} {
+			if params.Get(name) != "" {
+				proxyServer.writeErrorMessage(w, http.StatusBadRequest, name + " only applies with anonymize=true")
+				return nil, false
+			}
+		}
+		return nil, true
+	}
+	policy := DefaultAnonymizePolicy()
+	policy.Hosts = flags["anonymizeHosts"]
+	for _, header := range strings.Split(params.Get("anonymizeHeaders"), ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			policy.Headers = append(policy.Headers, header)
+		}
+	}
+	for _, param := range strings.Split(params.Get("anonymizeParams"), ",") {
+		if param = strings.TrimSpace(param); param != "" {
+			policy.Params = append(policy.Params, param)
+		}
+	}
+	return &policy, true
+}
+
+// The entries GET /proxy/[port]/har serves, when some of its params are given
+type harLogQuery struct {
+	from, to time.Time
+	urlPattern *regexp.Regexp
+	offset, limit int
+}
+
+func (query *harLogQuery) keep(entry *HarEntry) bool {
+	return startedBetween(entry, query.from, query.to) && (query.urlPattern == nil || entry.Request != nil && query.urlPattern.MatchString(entry.Request.Url))
+}
+
+// Reads the from, to, urlPattern, offset and limit params, nil without any of them
+func (proxyServer *ProxyServer) harLogQueryParams(r *http.Request, w http.ResponseWriter) (*harLogQuery, bool) {
+	params := r.URL.Query()
+	query := &harLogQuery{}
+	given := false
+	for name, value := range map[string]*time.Time{"from" : &query.from, "to" : &query.to} {
+		if params.Get(name) == "" {
+			continue
+		}
+		given = true
+		var err error
+		if *value, err = parseTimeParam(params.Get(name)); err != nil {
+			proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid %v [%v], expected RFC3339 or epoch millis", name, params.Get(name)))
+			return nil, false
+		}
+	}
+	for name, value := range map[string]*int{"offset" : &query.offset, "limit" : &query.limit} {
+		if params.Get(name) == "" {
+			continue
+		}
+		given = true
+		var err error
+		if *value, err = strconv.Atoi(params.Get(name)); err != nil || *value < 0 {
+			proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid %v [%v]", name, params.Get(name)))
+			return nil, false
+		}
+	}
+	urlPattern, ok := proxyServer.urlPatternParam(r, w)
+	if !ok {
+		return nil, false
+	}
+	if query.urlPattern = urlPattern; !given && urlPattern == nil {
+		return nil, true
+	}
+	return query, true
+}
+
+// A time as RFC3339, with or without fractional seconds, or as milliseconds since the epoch
+func parseTimeParam(value string) (time.Time, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, millis * int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// Size of the start of a HAR response held back, so that an error serializing it can still be answered with 500
+var harResponseBufferSize = 64 * 1024
+
+// Streams a HAR with write to w, calling failed if that fails. If nothing was sent yet the error is answered
+// with 500, otherwise the response is aborted so that the client doesn't take it for the whole HAR.
+func (proxyServer *ProxyServer) writeHarLog(w http.ResponseWriter, write func(io.Writer) (int64, error), failed func()) {
+	sent := &countingWriter{w : w}
+	buffered := bufio.NewWriterSize(sent, harResponseBufferSize)
+	_, err := write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		return
+	}
+	failed()
+	if sent.n > 0 {
+		proxyServer.logger.Errorf("Aborting HAR response after %v bytes : %v", sent.n, err)
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	proxyServer.writeErrorMessage(w, http.StatusInternalServerError, fmt.Sprintf("Serializing HAR failed: %v", err))
+}
+
+// The format is taken from ?format=, JSON Lines can also be asked for with an Accept: application/x-ndjson header
+func harLogFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			if strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]) == "application/x-ndjson" {
+				return "jsonl"
+			}
+		}
+	}
+	return "json"
+}
+
+// Returns the proxies on ports and their logs once their pending entries are recorded, drained if drain is set.
+// Writes 404 and returns false if there is no proxy for one of the ports, 403 if the caller of r doesn't own one.
+func (proxyServer *ProxyServer) harLogsForPorts(ports []int, drain bool, r *http.Request, w http.ResponseWriter) ([]*HarProxy, []*HarLog, bool) {
+	harProxies := make([]*HarProxy, 0, len(ports))
+	for _, port := range ports {
+		harProxy := proxyServer.proxies.get(port)
+		if harProxy == nil {
+			proxyServer.writeErrorMessage(w, http.StatusNotFound, fmt.Sprintf("No proxy for port [%v]", port))
+			return nil, nil, false
+		}
+		if !proxyServer.authorize(harProxy, r, w) {
+			return nil, nil, false
+		}
+		harProxies = append(harProxies, harProxy)
+	}
+
+	ctx, cancel := withClockTimeout(context.Background(), proxyServer.clock, WaitEntriesTimeout)
+	defer cancel()
+	harLogs := make([]*HarLog, 0, len(harProxies))
+	for _, harProxy := range harProxies {
+		harProxy.WaitForEntries(ctx)
+		if drain {
+			harLogs = append(harLogs, harProxy.HarLog.drain())
+		} else {
+			harLogs = append(harLogs, harProxy.HarLog)
+		}
+	}
+	return harProxies, harLogs, true
+}
+
+func (proxyServer *ProxyServer) replayHarLog(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	opts := ReplayOptions{}
+	if !proxyServer.decodeJsonBody(w, r, &opts, true) {
+		return
+	}
+	if err := opts.validate(); err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	harProxy.waitForEntries(r.Context(), WaitEntriesTimeout)
+	replayer := Replayer{Transport : harProxy.transport, Logger : proxyServer.logger}
+	replayed, err := replayer.Replay(r.Context(), harProxy.HarLog, opts)
+	if err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusInternalServerError, fmt.Sprintf("Replaying entries of proxy on port :%v failed: %v", harProxy.Port, err))
+		return
+	}
+	proxyServer.logger.Debugf("Replayed %v entries of proxy on port :%v", replayed.Len(), harProxy.Port)
+	w.Header().Add("Content-Type", "application/json")
+	if _, err := replayed.WriteTo(w); err != nil {
+		proxyServer.logger.Errorf("Writing replayed HAR of proxy on port :%v : %v", harProxy.Port, err)
+	}
+}
+
+// Writes a curl command per recorded entry whose url matches the urlPattern regular expression, if given
+func (proxyServer *ProxyServer) getCurlCommands(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	urlPattern, ok := proxyServer.urlPatternParam(r, w)
+	if !ok {
+		return
+	}
+	harProxy.waitForEntries(r.Context(), WaitEntriesTimeout)
+
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	for _, entry := range harProxy.HarLog.Entries() {
+		if entry.Request == nil || urlPattern != nil && !urlPattern.MatchString(entry.Request.Url) {
+			continue
+		}
+		io.WriteString(w, entry.ToCurl() + "\n")
+	}
+}
+
+// Writes the requests of the recorded entries whose url matches the urlPattern regular expression, if given,
+// as a Postman collection with a folder per host or page, picked by the groupBy parameter
+func (proxyServer *ProxyServer) getPostmanCollection(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	urlPattern, ok := proxyServer.urlPatternParam(r, w)
+	if !ok {
+		return
+	}
+	harProxy.waitForEntries(r.Context(), WaitEntriesTimeout)
+
+	name := harProxy.Name
+	if name == "" {
+		name = fmt.Sprintf("Proxy %v", harProxy.Port)
+	}
+	collection, err := ConvertHarToPostman(harProxy.HarLog, PostmanOptions{Name : name, UrlPattern : urlPattern, GroupBy : r.URL.Query().Get("groupBy")})
+	if err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&collection)
+}
+
+// Writes a JMeter test plan of the recorded entries whose url matches the urlPattern regular expression, if given.
+// thinkTime=true waits between the requests as the client did.
+func (proxyServer *ProxyServer) getJMeterPlan(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	urlPattern, ok := proxyServer.urlPatternParam(r, w)
+	if !ok {
+		return
+	}
+	thinkTime, ok := proxyServer.boolParam(r, w, "thinkTime")
+	if !ok {
+		return
+	}
+	harProxy.waitForEntries(r.Context(), WaitEntriesTimeout)
+
+	name := harProxy.Name
+	if name == "" {
+		name = fmt.Sprintf("Proxy %v", harProxy.Port)
+	}
+	jmx, err := ConvertHarToJMeter(harProxy.HarLog, JMeterOptions{Name : name, UrlPattern : urlPattern, ThinkTime : thinkTime})
+	if err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Add("Content-Type", "application/xml")
+	w.Write(jmx)
+}
+
+// Writes a draft OpenAPI document of the recorded entries whose url matches the urlPattern regular expression, if given.
+// Each paramPattern parameter is a regular expression of the path segments taken for parameters.
+func (proxyServer *ProxyServer) getOpenAPIDocument(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	urlPattern, ok := proxyServer.urlPatternParam(r, w)
+	if !ok {
+		return
+	}
+	harProxy.waitForEntries(r.Context(), WaitEntriesTimeout)
+
+	title := harProxy.Name
+	if title == "" {
+		title = fmt.Sprintf("Proxy %v", harProxy.Port)
+	}
+	document, err := InferOpenAPI(harProxy.HarLog, OpenAPIOptions{Title : title, UrlPattern : urlPattern, ParamPatterns : r.URL.Query()["paramPattern"]})
+	if err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&document)
+}
+
+// Writes the recorded entry with the id, 404 once it was cleared
+func (proxyServer *ProxyServer) getHarEntry(harProxy *HarProxy, id string, w http.ResponseWriter) {
+	entryId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || entryId <= 0 {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid entry id [%v]", id))
+		return
+	}
+	entry, ok := harProxy.Entry(entryId)
+	if !ok {
+		proxyServer.writeErrorMessage(w, http.StatusNotFound, fmt.Sprintf("No entry with id [%v]", entryId))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&entry)
 }
 
-func copyResp(resp *http.Response) (*http.Response, *http.Response) {
-	respCopy := new(http.Response)
-	*respCopy = *resp
-	resp.Body, respCopy.Body = copyReadCloser(resp.Body, resp.ContentLength)
-	return resp, respCopy
-}
+// Writes the aggregates of the recorded entries whose url matches the urlPattern regular expression, if given,
+// grouped by the groupBy parameter
+func (proxyServer *ProxyServer) getHarStats(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	urlPattern, ok := proxyServer.urlPatternParam(r, w)
+	if !ok {
+		return
+	}
+	harProxy.waitForEntries(r.Context(), WaitEntriesTimeout)
 
-func copyReadCloser(readCloser io.ReadCloser, len int64) (io.ReadCloser, io.ReadCloser) {
-	temp := bytes.NewBuffer(make([]byte, 0, len))
-	teeReader := io.TeeReader(readCloser, temp)
-	copy := bytes.NewBuffer(make([]byte, 0, len))
-	copy.ReadFrom(teeReader)
-	return ioutil.NopCloser(temp), ioutil.NopCloser(copy)
+	stats, err := harProxy.HarLog.Stats(StatsOptions{UrlPattern : urlPattern, GroupBy : r.URL.Query().Get("groupBy")})
+	if err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&stats)
 }
 
-func processEntriesFunc(proxy *HarProxy) {
-	for {
-		reqAndResp ,ok := <-proxy.entryChannel
-		if !ok {
-			log.Println("GOT DONE SIGNAL")
-			break
-		}
-		proxy.entriesInProcess += 1
-		go func() {
-			harEntry := new(HarEntry)
-			harEntry.Request = parseRequest(reqAndResp.req)
-			harEntry.StartedDateTime = reqAndResp.start
-			harEntry.Response = parseResponse(reqAndResp.resp)
-			harEntry.Time = reqAndResp.end.Sub(reqAndResp.start).Nanoseconds() / 1e6
-			fillIpAddress(reqAndResp.req, harEntry)
-			proxy.HarLog.addEntry(*harEntry)
-			proxy.entriesInProcess -= 1
-		}()
+// Writes the stats of the entries by request host, never clearing them
+func (proxyServer *ProxyServer) getHarHosts(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	if clear := r.URL.Query().Get("clear"); clear != "" && clear != "false" {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, "har/hosts never clears the entries, only clear=false is accepted")
+		return
 	}
-	log.Println("DONE PROCESSING ENTRIES")
-}
+	urlPattern, ok := proxyServer.urlPatternParam(r, w)
+	if !ok {
+		return
+	}
+	harProxy.waitForEntries(r.Context(), WaitEntriesTimeout)
 
-func handleRequest(req *http.Request, harProxy *HarProxy) (*http.Request, *http.Response) {
-	replaceHost(req, harProxy)
-	return req, nil
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.HarLog.HostStats(urlPattern))
 }
 
-func replaceHost(req *http.Request, harProxy *HarProxy) {
-	for _, hostEntry := range harProxy.hostEntries {
-		if req.URL.Host == hostEntry.Host {
-			log.Println("Replacing ", hostEntry.Host, hostEntry.NewHost)
-			req.URL.Host = hostEntry.NewHost
+// Writes the n slowest entries, 10 by default, whose url matches the urlPattern param, as entries or
+// with fields as a summary of these CSV columns
+func (proxyServer *ProxyServer) getSlowestEntries(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	n := 10
+	if value := r.URL.Query().Get("n"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 1 {
+			proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid n [%v]", value))
 			return
 		}
 	}
-}
+	var fields []string
+	if value := r.URL.Query().Get("fields"); value != "" {
+		fields = strings.Split(value, ",")
+		if err := validateCSVColumns(fields); err != nil {
+			proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	urlPattern, ok := proxyServer.urlPatternParam(r, w)
+	if !ok {
+		return
+	}
 
-func handleResponse(resp *http.Response, harEntry *HarEntry, harProxy *HarProxy) (newResp *http.Response, err error) {
-	return resp, nil
+	slowest := harProxy.HarLog.SlowestEntries(n, urlPattern)
+	w.Header().Add("Content-Type", "application/json")
+	if fields == nil {
+		json.NewEncoder(w).Encode(slowest)
+		return
+	}
+	summaries := make([]map[string]interface{}, len(slowest))
+	for i := range slowest {
+		summaries[i] = entrySummary(&slowest[i], fields)
+	}
+	json.NewEncoder(w).Encode(summaries)
 }
 
-func fillIpAddress(req *http.Request, harEntry *HarEntry) {
-	host, _, err := net.SplitHostPort(req.URL.Host)
-	if err != nil {
-		host = req.URL.Host
+// Writes the groups of duplicate entries, never clearing them. The ignoreParam params are patterns of the
+// query params left out of the urls, windowMs the most milliseconds between the first and last of a group.
+func (proxyServer *ProxyServer) getHarDuplicates(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	query := r.URL.Query()
+	urlPattern, ok := proxyServer.urlPatternParam(r, w)
+	if !ok {
+		return
 	}
-	if ip := net.ParseIP(host); ip != nil {
-		harEntry.ServerIpAddress = string(ip)
+	opts := DuplicateOptions{UrlPattern : urlPattern}
+	if opts.IgnoreQuery, ok = proxyServer.boolParam(r, w, "ignoreQuery"); !ok {
+		return
 	}
-
-	if ipaddr, err := net.LookupIP(host); err == nil  {
-		for _, ip := range ipaddr {
-			if ip.To4() != nil {
-				harEntry.ServerIpAddress = ip.String()
-				return
-			}
+	for _, pattern := range query["ignoreParam"] {
+		ignored, err := regexp.Compile(pattern)
+		if err != nil {
+			proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid ignoreParam [%v]: %v", pattern, err))
+			return
 		}
+		opts.IgnoreParams = append(opts.IgnoreParams, ignored)
 	}
-}
+	if value := query.Get("windowMs"); value != "" {
+		windowMs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || windowMs < 0 {
+			proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid windowMs [%v]", value))
+			return
+		}
+		opts.Window = time.Duration(windowMs) * time.Millisecond
+	}
+	harProxy.waitForEntries(r.Context(), WaitEntriesTimeout)
 
-func (proxy *HarProxy) AddHostEntries(hostEntries []ProxyHosts) {
-	entries := proxy.hostEntries
-	m := len(entries)
-	n := m + len(hostEntries)
-	if n > cap(entries) { // if necessary, reallocate
-		// allocate double what's needed, for future growth.
-		newEntries := make([]ProxyHosts, (n+1)*2)
-		copy(newEntries, entries)
-		entries = newEntries
-	}
-	entries = entries[0:n]
-	copy(entries[m:n], hostEntries)
-	proxy.hostEntries = entries
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.HarLog.Duplicates(opts))
 }
 
-func (proxy *HarProxy) Start() {
-	l, err := net.Listen("tcp", ":" + strconv.Itoa(proxy.Port))
+// Compiles the urlPattern parameter, nil if missing. Writes 400 and returns false if it is invalid.
+func (proxyServer *ProxyServer) urlPatternParam(r *http.Request, w http.ResponseWriter) (*regexp.Regexp, bool) {
+	pattern := r.URL.Query().Get("urlPattern")
+	if pattern == "" {
+		return nil, true
+	}
+	urlPattern, err := regexp.Compile(pattern)
 	if err != nil {
-		log.Fatal("listen:", err)
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid urlPattern [%v]: %v", pattern, err))
+		return nil, false
 	}
-	proxy.StoppableListener = newStoppableListener(l)
-	proxy.Port = GetPort(l)
-	log.Printf("Starting harproxy server on port :%v", proxy.Port)
-	go func() {
-		http.Serve(proxy.StoppableListener, proxy.Proxy)
-		log.Printf("Done serving proxy on port: %v", proxy.Port)
-
-		// We notify twice to close both the mutex and the process entries routine
-		close(proxy.entryChannel)
-		proxy.isDone <- true
-
-	}()
-	log.Printf("Stared harproxy server on port :%v", proxy.Port)
+	return urlPattern, true
 }
 
-func (proxy *HarProxy) Stop() {
-	log.Printf("Stopping harproxy server on port :%v", proxy.Port)
-	proxy.StoppableListener.Add(1)
-	proxy.StoppableListener.Close()
-	<-proxy.isDone
-	proxy.StoppableListener.Done()
-	proxy = nil
+// Parses the name boolean parameter, false if missing. Writes 400 and returns false if it is invalid.
+func (proxyServer *ProxyServer) boolParam(r *http.Request, w http.ResponseWriter, name string) (bool, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, true
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid %v [%v]", name, value))
+		return false, false
+	}
+	return parsed, true
 }
 
-func (proxy *HarProxy) ClearEntries() {
-	log.Printf("Clearing HAR for harproxy server on port :%v", proxy.Port)
-	proxy.HarLog.Entries = nil
-	proxy.HarLog.Entries = makeNewEntries()
-}
+func (proxyServer *ProxyServer) mergeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		proxyServer.errHandler(w, r)
+		return
+	}
+	merge := ProxyServerMerge{}
+	if !proxyServer.decodeJsonBody(w, r, &merge, false) {
+		return
+	}
 
-func (proxy *HarProxy) NewHarReader() io.Reader {
-	proxy.WaitForEntries()
-	str, _ := json.Marshal(proxy.HarLog)
-	return strings.NewReader(string(str))
+	harProxies, harLogs, ok := proxyServer.harLogsForPorts(merge.Ports, merge.Clear, r, w)
+	if !ok {
+		return
+	}
+	restore := func() {
+		if merge.Clear {
+			for i, harProxy := range harProxies {
+				harProxy.HarLog.restore(harLogs[i])
+			}
+		}
+	}
+	merged, err := MergeHarLogs(harLogs...)
+	if err != nil {
+		restore()
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	proxyServer.logger.Debugf("Serving %v merged entries of proxies on ports %v", merged.Len(), merge.Ports)
+	w.Header().Add("Content-Type", "application/json")
+	proxyServer.writeHarLog(w, merged.WriteTo, restore)
 }
 
-func (proxy *HarProxy) WaitForEntries() {
-	secs := 0
-	for len(proxy.entryChannel) > 0 || proxy.entriesInProcess > 0 {
-		log.Println("WAITING FOR ENTRIES")
-		time.Sleep(1 * time.Second)
-		secs++
-		if secs > 10 {
-			log.Printf("GIVING UP WAITING FOR ENTRIES AFTER %v SECONDS", secs)
+func (proxyServer *ProxyServer) diffHandler(w http.ResponseWriter, r *http.Request) {
+	proxyDiff := ProxyServerDiff{}
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		for _, name := range []string{"a", "b"} {
+			port, err := strconv.Atoi(query.Get(name))
+			if err != nil {
+				proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid port [%v] for %v", query.Get(name), name))
+				return
+			}
+			proxyDiff.Ports = append(proxyDiff.Ports, port)
+		}
+		var ok bool
+		if proxyDiff.Options.IgnoreQuery, ok = proxyServer.boolParam(r, w, "ignoreQuery"); !ok {
+			return
+		}
+		if slowerBy := query.Get("slowerByMs"); slowerBy != "" {
+			var err error
+			if proxyDiff.Options.SlowerByMs, err = strconv.ParseInt(slowerBy, 10, 64); err != nil {
+				proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid slowerByMs [%v]", slowerBy))
+				return
+			}
+		}
+	case "POST":
+		if !proxyServer.decodeJsonBody(w, r, &proxyDiff, false) {
+			return
 		}
+	default:
+		proxyServer.errHandler(w, r)
+		return
 	}
-}
-//
 
-// HarProxyServer
+	harLogs := proxyDiff.Hars
+	if len(proxyDiff.Ports) > 0 && len(proxyDiff.Hars) == 0 {
+		var ok bool
+		if _, harLogs, ok = proxyServer.harLogsForPorts(proxyDiff.Ports, false, r, w); !ok {
+			return
+		}
+	}
+	if len(harLogs) != 2 || harLogs[0] == nil || harLogs[1] == nil || len(proxyDiff.Hars) > 0 && len(proxyDiff.Ports) > 0 {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, "Expected either two ports or two HAR logs")
+		return
+	}
 
-var portAndProxy map[int]*HarProxy = make(map[int]*HarProxy, 5000)
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DiffHarLogs(harLogs[0], harLogs[1], proxyDiff.Options))
+}
 
-var portPathRegex *regexp.Regexp = regexp.MustCompile("/(\\d*)(/.*)?")
+// Validates an uploaded HAR document, gzipped when its Content-Encoding is gzip or it starts like a gzip stream
+func (proxyServer *ProxyServer) validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		proxyServer.errHandler(w, r)
+		return
+	}
+	body := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	var document io.Reader = body
+	if magic, _ := body.Peek(2); r.Header.Get("Content-Encoding") == "gzip" || bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gunzipped, err := gzip.NewReader(body)
+		if err != nil {
+			proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid gzip body: %v", err))
+			return
+		}
+		defer gunzipped.Close()
+		document = maxBytesReader(gunzipped, maxRequestBodySize)
+	}
 
-type ProxyServerPort struct {
-	Port int   `json:"port"`
+	report, err := ValidateHarLog(document)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		proxyServer.writeErrorMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body larger than %v bytes", tooLarge.Limit))
+		return
+	case err != nil:
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Reading the HAR document: %v", err))
+		return
+	}
+	proxyServer.logger.Debugf("Validated HAR document of %v entries, %v errors and %v warnings", report.Entries, report.Errors, report.Warnings)
+	w.Header().Add("Content-Type", "application/json")
+	if !report.Valid {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(report)
 }
 
-type ProxyServerErr struct {
-	Error string	`json:"error"`
+func (proxyServer *ProxyServer) createNewHarProxy(r *http.Request, w http.ResponseWriter) {
+	proxyServer.logger.Infof("Got request to start new proxy")
+	proxyCreate := ProxyServerCreate{}
+	if proxyServer.opts.BrowserMobCompat && !isJsonRequest(r) {
+		if !proxyServer.browserMobCreateParams(r, w, &proxyCreate) {
+			return
+		}
+	} else if !proxyServer.decodeJsonBody(w, r, &proxyCreate, true) {
+		return
+	}
+	proxyServerPort, err := proxyServer.CreateProxy(r.Context(), proxyCreate)
+	if err != nil {
+		apiErr := err.(*APIError)
+		proxyServer.writeErrorMessage(w, apiErr.Status, apiErr.Message)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&proxyServerPort)
 }
 
-type ProxyServerMessage struct {
-	Message string 		`json:"message"`
+func (proxyServer *ProxyServer) getHarProxyStatus(harProxy *HarProxy, w http.ResponseWriter) {
+	sinkSent, sinkFailures, sinkDropped := harProxy.SinkStats()
+	webhooksSent, webhookFailures, webhooksSuppressed := harProxy.WebhookStats()
+	statsdSent, statsdDropped := harProxy.StatsdStats()
+	tracingSent, tracingFailures, tracingDropped := harProxy.TracingStats()
+	stubServed, stubUnmatched := harProxy.StubStats()
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ProxyServerStatus {
+		Port 				: harProxy.Port,
+		Name 				: harProxy.Name,
+		Owner 				: proxyServer.proxies.owner(harProxy),
+		Entries 			: harProxy.HarLog.Len(),
+		InFlightRequests 	: harProxy.InFlightRequests(),
+		PendingEntries 		: harProxy.PendingEntries(),
+		DroppedEntries 		: harProxy.DroppedEntries(),
+		EntryBuffer 		: harProxy.entryBuffer,
+		EntryOverflow 		: harProxy.entryOverflow(),
+		EntryWorkers 		: harProxy.entryWorkers,
+		CaptureBytes 		: harProxy.HarLog.CaptureBytes(),
+		CaptureBudget 		: harProxy.captureBudget,
+		CaptureBudgetPolicy : harProxy.captureBudgetPolicy(),
+		Seed 				: harProxy.Seed(),
+		SinkSent 			: sinkSent,
+		SinkFailures 		: sinkFailures,
+		SinkDropped 		: sinkDropped,
+		WebhooksSent 		: webhooksSent,
+		WebhookFailures 	: webhookFailures,
+		WebhooksSuppressed 	: webhooksSuppressed,
+		StatsdSent 			: statsdSent,
+		StatsdDropped 		: statsdDropped,
+		TracingSent 		: tracingSent,
+		TracingFailures 	: tracingFailures,
+		TracingDropped 		: tracingDropped,
+		StubServed 			: stubServed,
+		StubUnmatched 		: stubUnmatched,
+	})
 }
 
-type ProxyHosts struct {
-	Host 	string 		`json:"host"`
-	NewHost string		`json:"NewHost"`
+func getHarProxyConfig(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	config := harProxy.Config()
+	json.NewEncoder(w).Encode(&config)
 }
 
-func addHostEntries(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
-	hostEntries := make([]ProxyHosts, 0, 10)
-	err := json.NewDecoder(r.Body).Decode(&hostEntries)
-	if err != nil {
-		writeErrorMessage(w, http.StatusInternalServerError,  err.Error())
+func (proxyServer *ProxyServer) putHarProxyConfig(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	config := HarProxyConfig{}
+	if !proxyServer.decodeJsonBody(w, r, &config, false) {
+		return
+	}
+	if err := config.validate(); err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	harProxy.AddHostEntries(hostEntries)
-	writeMessage(w, "Added hosts entries successfully")
+	harProxy.ApplyConfig(config)
+	writeMessage(w, "Applied config successfully")
 }
 
-func deleteHarProxy(port int, w http.ResponseWriter) {
-	log.Printf("Deleting proxy on port :%v\n", port)
-	harProxy := portAndProxy[port]
-	harProxy.Stop()
-	delete(portAndProxy, port)
-	harProxy = nil
-	writeMessage(w, fmt.Sprintf("Deleted proxy for port [%v] succesfully", port))
+func closeIdleConnections(harProxy *HarProxy, w http.ResponseWriter) {
+	harProxy.CloseIdleConnections()
+	writeMessage(w, "Closed idle upstream connections successfully")
 }
 
-func getHarLog(harProxy *HarProxy, w http.ResponseWriter) {
-	w.Header().Add("Content-Type", "application/json")
-	harProxy.WaitForEntries()
-	str, _ := json.Marshal(harProxy.HarLog)
-	log.Println("Entry:", string(str))
-	json.NewEncoder(w).Encode(harProxy.HarLog)
-	harProxy.ClearEntries()
+// Clones harProxy, the clone being owned by the caller of r
+func (proxyServer *ProxyServer) cloneHarProxy(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	proxyServer.logger.Infof("Cloning proxy on port :%v", harProxy.Port)
+	clone, err := harProxy.Clone()
+	if err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusInternalServerError, fmt.Sprintf("Failed cloning proxy: %v", err))
+		return
+	}
+	proxyServer.startAndRegisterHarProxy(clone, callerOf(r).owner, w)
+}
 
+// Starts harProxy and registers it as owned by owner, unless one with the same name was registered while it started
+func (proxyServer *ProxyServer) startAndRegisterHarProxy(harProxy *HarProxy, owner string, w http.ResponseWriter) {
+	if status, err := proxyServer.startAndRegister(harProxy, owner); err != nil {
+		proxyServer.writeErrorMessage(w, status, err.Error())
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	proxyServerPort := proxyServer.proxyServerPort(harProxy)
+	json.NewEncoder(w).Encode(&proxyServerPort)
 }
 
-func createNewHarProxy(w http.ResponseWriter) {
-	log.Printf("Got request to start new proxy\n")
-	harProxy := NewHarProxy()
-	harProxy.Start()
-	port := GetPort(harProxy.StoppableListener.Listener)
-	harProxy.Port = port
+// Starts harProxy and registers it for owner, returns the status to answer with if either fails
+func (proxyServer *ProxyServer) startAndRegister(harProxy *HarProxy, owner string) (int, error) {
+	if err := harProxy.Start(); err != nil {
+		harProxy.discard()
+		status := http.StatusInternalServerError
+		if errors.Is(err, syscall.EADDRINUSE) {
+			status = http.StatusConflict
+		}
+		return status, fmt.Errorf("Failed starting proxy: %v", err)
+	}
+	if err := proxyServer.proxies.put(harProxy, owner); err != nil {
+		harProxy.Stop()
+		return http.StatusConflict, err
+	}
+	return http.StatusOK, nil
+}
 
-	portAndProxy[port] = harProxy
+// Describes a registered proxy as it is listed
+func (proxyServer *ProxyServer) proxyServerPort(harProxy *HarProxy) ProxyServerPort {
+	proxyServerPort := ProxyServerPort{Port : harProxy.Port, Name : harProxy.Name, Owner : proxyServer.proxies.owner(harProxy)}
+	if addr, err := harProxy.Addr(); err == nil {
+		proxyServerPort.Address = addr.String()
+	}
+	return proxyServerPort
+}
 
+// Lists the proxies the caller of r owns
+func (proxyServer *ProxyServer) listHarProxies(r *http.Request, w http.ResponseWriter) {
 	w.Header().Add("Content-Type", "application/json")
-	proxyServerPort := ProxyServerPort {
-		Port : port,
-	}
-	json.NewEncoder(w).Encode(&proxyServerPort)
+	json.NewEncoder(w).Encode(proxyServer.Proxies(r.Context()))
 }
 
-func getProxyForPath(path string, w http.ResponseWriter) (*HarProxy, string) {
-	if portPathRegex.MatchString(path) {
-		portStr := portPathRegex.FindStringSubmatch(path)[1]
-		port, _ := strconv.Atoi(portStr)
-		if portAndProxy[port] == nil {
-			writeErrorMessage(w, http.StatusNotFound, fmt.Sprintf("No proxy for port [%v]", port))
+func (proxyServer *ProxyServer) getProxyForPath(path string, w http.ResponseWriter) (*HarProxy, string) {
+	if namePathRegex.MatchString(path) {
+		matches := namePathRegex.FindStringSubmatch(path)
+		name := matches[1]
+		harProxy := proxyServer.proxies.getByName(name)
+		if harProxy == nil {
+			proxyServer.writeErrorMessage(w, http.StatusNotFound, fmt.Sprintf("No proxy named [%v]", name))
 			return nil, path
 		}
 
-		log.Printf("PORT:[%v]\n", port)
-		return portAndProxy[port],  path[len("/" + portStr):]
+		proxyServer.logger.Debugf("NAME:[%v] PORT:[%v]", name, harProxy.Port)
+		return harProxy, matches[2]
+	}
+
+	if !portPathRegex.MatchString(path) {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid proxy path [/proxy%v]", path))
+		return nil, path
+	}
+	portStr := portPathRegex.FindStringSubmatch(path)[1]
+	port, err := strconv.Atoi(portStr)
+	if !portRegex.MatchString(portStr) || err != nil || port < 1 || port > 65535 {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid proxy port [%v] in path [/proxy%v], expected a port from 1 to 65535", portStr, path))
+		return nil, path
+	}
+	harProxy := proxyServer.proxies.get(port)
+	if harProxy == nil {
+		proxyServer.writeErrorMessage(w, http.StatusNotFound, fmt.Sprintf("No proxy for port [%v]", port))
+		return nil, path
 	}
 
-	return nil,path
+	proxyServer.logger.Debugf("PORT:[%v]", port)
+	return harProxy,  path[len("/" + portStr):]
 }
 
 func writeMessage(w http.ResponseWriter, msg string) {
@@ -366,8 +3190,8 @@ func writeMessage(w http.ResponseWriter, msg string) {
 	json.NewEncoder(w).Encode(&proxyMessage)
 }
 
-func writeErrorMessage(w http.ResponseWriter, httpStatus int,  msg string) {
-	log.Printf("ERROR :[%v]", msg)
+func (proxyServer *ProxyServer) writeErrorMessage(w http.ResponseWriter, httpStatus int,  msg string) {
+	proxyServer.logger.Errorf("[%v]", msg)
 	w.WriteHeader(httpStatus)
 	errorMessage := ProxyServerErr {
 		Error : msg,
@@ -375,53 +3199,521 @@ func writeErrorMessage(w http.ResponseWriter, httpStatus int,  msg string) {
 	json.NewEncoder(w).Encode(&errorMessage)
 }
 
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
+func (proxyServer *ProxyServer) writeItemErrors(w http.ResponseWriter, httpStatus int, msg string, items []ProxyServerItemErr) {
+	proxyServer.logger.Errorf("[%v] %v", msg, items)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(&ProxyServerErr{Error : msg, Items : items})
+}
+
+func (proxyServer *ProxyServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 	if !strings.Contains(r.URL.Path, "/proxy") {
-		errHandler(w, r)
+		proxyServer.errHandler(w, r)
 		return
 	}
 	path := r.URL.Path[len("/proxy"):]
 	method := r.Method
 
-	log.Printf("PATH:[%v]\n", r.URL.Path)
-	log.Printf("FILTERED:[%v]\n", path)
-	log.Printf("METHOD:[%v]\n", method)
+	proxyServer.logger.Debugf("PATH:[%v]", r.URL.Path)
+	proxyServer.logger.Debugf("FILTERED:[%v]", path)
+	proxyServer.logger.Debugf("METHOD:[%v]", method)
 	if path == "" && method == "POST" {
-		log.Println("MATCH CREATE")
-		createNewHarProxy(w)
+		proxyServer.logger.Debugf("MATCH CREATE")
+		proxyServer.createNewHarProxy(r, w)
+		return
+	}
+	if path == "" && method == "GET" {
+		proxyServer.logger.Debugf("MATCH LIST")
+		proxyServer.listHarProxies(r, w)
 		return
 	}
 
-	harProxy, path := getProxyForPath(path, w)
+	harProxy, path := proxyServer.getProxyForPath(path, w)
+	if harProxy != nil && (!proxyServer.authorize(harProxy, r, w) || proxyServer.serveBrowserMob(harProxy, path, r, w)) {
+		return
+	}
 	switch {
 	case harProxy == nil:
 		return
+	case strings.HasSuffix(path, "har/curl") && method == "GET":
+		proxyServer.logger.Debugf("MATCH CURL")
+		proxyServer.getCurlCommands(harProxy, r, w)
+	case strings.HasSuffix(path, "har/postman") && method == "GET":
+		proxyServer.logger.Debugf("MATCH POSTMAN")
+		proxyServer.getPostmanCollection(harProxy, r, w)
+	case strings.HasSuffix(path, "har/jmeter") && method == "GET":
+		proxyServer.logger.Debugf("MATCH JMETER")
+		proxyServer.getJMeterPlan(harProxy, r, w)
+	case strings.HasSuffix(path, "har/openapi") && method == "GET":
+		proxyServer.logger.Debugf("MATCH OPENAPI")
+		proxyServer.getOpenAPIDocument(harProxy, r, w)
+	case strings.HasSuffix(path, "har/streamToken") && method == "POST":
+		proxyServer.logger.Debugf("MATCH STREAM TOKEN")
+		proxyServer.postStreamToken(harProxy, r, w)
+	case strings.HasSuffix(path, "har/stream") && method == "GET":
+		proxyServer.logger.Debugf("MATCH STREAM")
+		proxyServer.streamHarEntries(harProxy, r, w)
+	case strings.HasSuffix(path, "har/stats") && method == "GET":
+		proxyServer.logger.Debugf("MATCH STATS")
+		proxyServer.getHarStats(harProxy, r, w)
+	case strings.HasSuffix(path, "har/slowest") && method == "GET":
+		proxyServer.logger.Debugf("MATCH SLOWEST")
+		proxyServer.getSlowestEntries(harProxy, r, w)
+	case strings.HasSuffix(path, "har/hosts") && method == "GET":
+		proxyServer.logger.Debugf("MATCH HOSTS STATS")
+		proxyServer.getHarHosts(harProxy, r, w)
+	case strings.HasSuffix(path, "har/duplicates") && method == "GET":
+		proxyServer.logger.Debugf("MATCH DUPLICATES")
+		proxyServer.getHarDuplicates(harProxy, r, w)
+	case strings.HasPrefix(path, "/har/entry/") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET ENTRY")
+		proxyServer.getHarEntry(harProxy, path[len("/har/entry/"):], w)
 	case strings.HasSuffix(path, "har") && method == "PUT":
-		log.Println("MATCH PRINT")
-		getHarLog(harProxy, w)
+		proxyServer.logger.Debugf("MATCH PRINT")
+		proxyServer.getHarLog(harProxy, r, w, true)
+	case strings.HasSuffix(path, "har") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET HAR")
+		proxyServer.getHarLog(harProxy, r, w, false)
 	case path == "" && method == "DELETE":
-		log.Println("MATCH DELETE")
-		deleteHarProxy(harProxy.Port, w)
+		proxyServer.logger.Debugf("MATCH DELETE")
+		proxyServer.deleteHarProxy(harProxy, w)
+	case strings.HasPrefix(path, "/hosts/") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH DELETE HOST")
+		proxyServer.removeHostEntry(harProxy, path[len("/hosts/"):], w)
 	case strings.HasSuffix(path, "hosts") && method == "POST":
-		log.Println("MATCH HOSTS")
-		addHostEntries(harProxy, r, w)
+		proxyServer.logger.Debugf("MATCH HOSTS")
+		proxyServer.addHostEntries(harProxy, r, w)
+	case strings.HasSuffix(path, "hosts") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET HOSTS")
+		getHostEntries(harProxy, w)
+	case strings.HasSuffix(path, "hosts") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH CLEAR HOSTS")
+		clearHostEntries(harProxy, w)
+	case strings.HasSuffix(path, "captureSettings") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT CAPTURE SETTINGS")
+		proxyServer.putCaptureSettings(harProxy, r, w)
+	case strings.HasSuffix(path, "captureSettings") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET CAPTURE SETTINGS")
+		getCaptureSettings(harProxy, w)
+	case strings.HasSuffix(path, "latency") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT LATENCY")
+		proxyServer.putLatencyRules(harProxy, r, w)
+	case strings.HasSuffix(path, "latency") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET LATENCY")
+		getLatencyRules(harProxy, w)
+	case strings.HasSuffix(path, "latency") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH CLEAR LATENCY")
+		clearLatencyRules(harProxy, w)
+	case strings.HasSuffix(path, "statusRewrites") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT STATUS REWRITES")
+		proxyServer.putStatusRewrites(harProxy, r, w)
+	case strings.HasSuffix(path, "statusRewrites") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET STATUS REWRITES")
+		getStatusRewrites(harProxy, w)
+	case strings.HasSuffix(path, "statusRewrites") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH CLEAR STATUS REWRITES")
+		clearStatusRewrites(harProxy, w)
+	case strings.HasSuffix(path, "queryRewrites") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT QUERY REWRITES")
+		proxyServer.putQueryRewrites(harProxy, r, w)
+	case strings.HasSuffix(path, "queryRewrites") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET QUERY REWRITES")
+		getQueryRewrites(harProxy, w)
+	case strings.HasSuffix(path, "queryRewrites") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH CLEAR QUERY REWRITES")
+		clearQueryRewrites(harProxy, w)
+	case strings.HasSuffix(path, "cookies") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT COOKIES")
+		proxyServer.putCookieRules(harProxy, r, w)
+	case strings.HasSuffix(path, "cookies") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET COOKIES")
+		getCookieRules(harProxy, w)
+	case strings.HasSuffix(path, "cookies") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH CLEAR COOKIES")
+		clearCookieRules(harProxy, w)
+	case strings.HasSuffix(path, "rateLimit") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT RATE LIMIT")
+		proxyServer.putRateLimit(harProxy, r, w)
+	case strings.HasSuffix(path, "rateLimit") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET RATE LIMIT")
+		getRateLimit(harProxy, w)
+	case strings.HasSuffix(path, "rateLimit") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH REMOVE RATE LIMIT")
+		clearRateLimit(harProxy, w)
+	case strings.HasSuffix(path, "redactions/body") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT BODY REDACTIONS")
+		proxyServer.putBodyRedactions(harProxy, r, w)
+	case strings.HasSuffix(path, "redactions/body") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET BODY REDACTIONS")
+		getBodyRedactions(harProxy, w)
+	case strings.HasSuffix(path, "redactions/body") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH REMOVE BODY REDACTIONS")
+		clearBodyRedactions(harProxy, w)
+	case strings.HasSuffix(path, "webhooks") && method == "POST":
+		proxyServer.logger.Debugf("MATCH ADD WEBHOOKS")
+		proxyServer.addWebhookRules(harProxy, r, w)
+	case strings.HasSuffix(path, "webhooks") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET WEBHOOKS")
+		getWebhookRules(harProxy, w)
+	case strings.HasSuffix(path, "webhooks") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH CLEAR WEBHOOKS")
+		clearWebhookRules(harProxy, w)
+	case strings.HasSuffix(path, "sink") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT SINK")
+		proxyServer.putSink(harProxy, r, w)
+	case strings.HasSuffix(path, "sink") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET SINK")
+		getSink(harProxy, w)
+	case strings.HasSuffix(path, "sink") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH REMOVE SINK")
+		removeSink(harProxy, w)
+	case strings.HasSuffix(path, "statsd") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT STATSD")
+		proxyServer.putStatsd(harProxy, r, w)
+	case strings.HasSuffix(path, "statsd") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET STATSD")
+		getStatsd(harProxy, w)
+	case strings.HasSuffix(path, "statsd") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH REMOVE STATSD")
+		removeStatsd(harProxy, w)
+	case strings.HasSuffix(path, "tracing") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT TRACING")
+		proxyServer.putTracing(harProxy, r, w)
+	case strings.HasSuffix(path, "tracing") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET TRACING")
+		getTracing(harProxy, w)
+	case strings.HasSuffix(path, "tracing") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH REMOVE TRACING")
+		removeTracing(harProxy, w)
+	case strings.HasSuffix(path, "stub") && method == "POST":
+		proxyServer.logger.Debugf("MATCH POST STUB")
+		proxyServer.postStub(harProxy, r, w)
+	case strings.HasSuffix(path, "stub") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET STUB")
+		getStub(harProxy, w)
+	case strings.HasSuffix(path, "stub") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH REMOVE STUB")
+		removeStub(harProxy, w)
+	case strings.HasSuffix(path, "limits") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT LIMITS")
+		proxyServer.putConnectionLimits(harProxy, r, w)
+	case strings.HasSuffix(path, "limits") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET LIMITS")
+		getConnectionLimits(harProxy, w)
+	case strings.HasSuffix(path, "limits") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH REMOVE LIMITS")
+		clearConnectionLimits(harProxy, w)
+	case strings.HasSuffix(path, "replay") && method == "POST":
+		proxyServer.logger.Debugf("MATCH REPLAY")
+		proxyServer.replayHarLog(harProxy, r, w)
+	case strings.HasSuffix(path, "seleniumProxy") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET SELENIUM PROXY")
+		proxyServer.getSeleniumProxy(harProxy, r, w)
+	case strings.HasSuffix(path, "status") && method == "GET":
+		proxyServer.logger.Debugf("MATCH STATUS")
+		proxyServer.getHarProxyStatus(harProxy, w)
+	case strings.HasSuffix(path, "config") && method == "GET":
+		proxyServer.logger.Debugf("MATCH GET CONFIG")
+		getHarProxyConfig(harProxy, w)
+	case strings.HasSuffix(path, "config") && method == "PUT":
+		proxyServer.logger.Debugf("MATCH PUT CONFIG")
+		proxyServer.putHarProxyConfig(harProxy, r, w)
+	case strings.HasSuffix(path, "connections") && method == "DELETE":
+		proxyServer.logger.Debugf("MATCH CLOSE CONNECTIONS")
+		closeIdleConnections(harProxy, w)
+	case strings.HasSuffix(path, "selftest") && method == "POST":
+		proxyServer.logger.Debugf("MATCH SELFTEST")
+		proxyServer.selfTestHarProxy(harProxy, r, w)
+	case strings.HasSuffix(path, "clone") && method == "POST":
+		proxyServer.logger.Debugf("MATCH CLONE")
+		proxyServer.cloneHarProxy(harProxy, r, w)
 	default:
-		log.Printf("No such path: [%v]", path)
-		writeErrorMessage(w, http.StatusNotFound, fmt.Sprintf("No such path [%s] with method %v" , path, method))
+		proxyServer.logger.Debugf("No such path: [%v]", path)
+		proxyServer.writeErrorMessage(w, http.StatusNotFound, fmt.Sprintf("No such path [%s] with method %v" , path, method))
 	}
 }
 
-func errHandler(w http.ResponseWriter, r *http.Request) {
-	msg := fmt.Sprintf("No such path: [%v]", r.URL.Path)
-	log.Println(msg)
-	writeErrorMessage(w, http.StatusNotFound, msg)
+func (proxyServer *ProxyServer) errHandler(w http.ResponseWriter, r *http.Request) {
+	proxyServer.writeErrorMessage(w, http.StatusNotFound, fmt.Sprintf("No such path: [%v]", r.URL.Path))
 }
 
+// Deprecated: Use NewProxyServerWithOptions, which neither uses http.DefaultServeMux nor exits on failure.
 func NewProxyServer(port int) {
-	http.HandleFunc("/", errHandler)
-	http.HandleFunc("/proxy", proxyHandler)
-	http.HandleFunc("/proxy/", proxyHandler)
+	proxyServer, err := NewProxyServerWithOptions(ProxyServerOptions{Port : port})
+	if err == nil {
+		err = proxyServer.ListenAndServe()
+	}
+	log.Fatal(err)
+}
+
+type ProxyServerOptions struct {
+	// The port the management API listens on
+	Port int
+
+	// PEM encoded certificate and key files, serve the API over TLS when set
+	CertFile string
+	KeyFile string
+
+	// TLS configuration to serve the API with, may be combined with CertFile and KeyFile
+	TLSConfig *tls.Config
+
+	// When set, clients must present a certificate signed by one of these CAs (mutual TLS)
+	ClientCAs *x509.CertPool
+
+	// When set, plain HTTP requests on this port are redirected to the TLS port.
+	// Otherwise plain HTTP requests are only rejected, with 400, by the TLS port itself.
+	RedirectHTTPPort int
+
+	// Receives everything the server logs, also used by the proxies it creates. Defaults to DefaultLogger.
+	Logger Logger
+
+	// Used by the proxies it creates, and to time the waits for their entries. Defaults to RealClock.
+	Clock Clock
+
+	// Serves the metrics of the created proxies on /metrics, in the Prometheus text format
+	EnableMetrics bool
+
+	// The host clients reach the proxies at, e.g. in GET /proxy/[port]/seleniumProxy,
+	// when it isn't the one they reach the API at
+	ExternalHost string
+
+	// Serves the routes of the BrowserMob Proxy REST API where they differ from ours, so its clients work unmodified.
+	// E.g. PUT /proxy/[port]/har starts a new HAR and GET /proxy/[port]/har returns it without clearing.
+	BrowserMobCompat bool
+
+	// Logs every request to the management API, and turns on HarProxyOptions.AccessLog for the proxies it creates
+	AccessLog bool
+
+	// When set, calls must send one of these keys, in the X-Api-Key header or as a bearer token, or get 401.
+	// The keys map to their owners, who only see and manage the proxies created with one of their keys.
+	APIKeys map[string]string
+
+	// Owners of APIKeys whose keys see and manage every proxy
+	Admins []string
+}
+
+func (opts ProxyServerOptions) validate() error {
+	if opts.Port < 0 || opts.Port > 65535 {
+		return fmt.Errorf("invalid port [%v]", opts.Port)
+	}
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return errors.New("CertFile and KeyFile must be set together")
+	}
+	if !opts.useTLS() && (opts.ClientCAs != nil || opts.RedirectHTTPPort != 0) {
+		return errors.New("ClientCAs and RedirectHTTPPort require a certificate")
+	}
+	if opts.RedirectHTTPPort < 0 || opts.RedirectHTTPPort > 65535 {
+		return fmt.Errorf("invalid redirect port [%v]", opts.RedirectHTTPPort)
+	}
+	return opts.validateAPIKeys()
+}
+
+func (opts ProxyServerOptions) useTLS() bool {
+	return opts.CertFile != "" ||
+		(opts.TLSConfig != nil && (len(opts.TLSConfig.Certificates) > 0 || opts.TLSConfig.GetCertificate != nil))
+}
+
+// NewProxyServerWithOptions creates the management API described by opts, served over TLS
+// when a certificate is given. Start it with Start or ListenAndServe.
+func NewProxyServerWithOptions(opts ProxyServerOptions) (*ProxyServer, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	proxyServer := &ProxyServer {
+		opts 		 : opts,
+		logger 		 : orDefaultLogger(opts.Logger),
+		clock 		 : orRealClock(opts.Clock),
+		isDone 		 : make(chan bool),
+		proxies 	 : newProxyRegistry(),
+		streamTokens : newStreamTokens(),
+	}
+	proxyServer.server = &http.Server {
+		Addr 	: ":" + strconv.Itoa(opts.Port),
+		Handler : gzipHandler(proxyServer.authHandler(proxyServer.newMux())),
+	}
+	if opts.AccessLog {
+		proxyServer.server.Handler = accessLogHandler(proxyServer.logger, proxyServer.server.Handler)
+	}
+	if !opts.useTLS() {
+		return proxyServer, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion : tls.VersionTLS12}
+	if opts.TLSConfig != nil {
+		tlsConfig = opts.TLSConfig.Clone()
+	}
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	if opts.ClientCAs != nil {
+		tlsConfig.ClientCAs = opts.ClientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	proxyServer.server.TLSConfig = tlsConfig
+	// Kept apart, the server sets up its copy when it starts serving
+	proxyServer.tlsConfig = tlsConfig.Clone()
+	return proxyServer, nil
+}
+
+func (proxyServer *ProxyServer) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", proxyServer.errHandler)
+	mux.HandleFunc("/proxy", proxyServer.proxyHandler)
+	mux.HandleFunc("/proxy/", proxyServer.proxyHandler)
+	mux.HandleFunc("/har/merge", proxyServer.mergeHandler)
+	mux.HandleFunc("/har/diff", proxyServer.diffHandler)
+	mux.HandleFunc("/har/validate", proxyServer.validateHandler)
+	ui := uiHandler()
+	mux.Handle("/ui", ui)
+	mux.Handle("/ui/", ui)
+	if proxyServer.opts.EnableMetrics {
+		mux.HandleFunc("/metrics", proxyServer.metricsHandler)
+	}
+	return mux
+}
+
+func (proxyServer *ProxyServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, proxyServer.ownedProxies(r))
+}
+
+// ServeHTTP serves the management API, for use with a server other than the one Start runs
+func (proxyServer *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	proxyServer.server.Handler.ServeHTTP(w, r)
+}
+
+// Start listens on the configured port, 0 picks a free one, and serves the API in the background.
+func (proxyServer *ProxyServer) Start() error {
+	proxyServer.stateLock.Lock()
+	defer proxyServer.stateLock.Unlock()
+	if proxyServer.stopped {
+		return ErrAlreadyStopped
+	}
+	if proxyServer.started {
+		return ErrAlreadyStarted
+	}
+
+	l, err := net.Listen("tcp", proxyServer.server.Addr)
+	if err != nil {
+		return err
+	}
+	if proxyServer.opts.RedirectHTTPPort != 0 {
+		redirectListener, err := net.Listen("tcp", ":" + strconv.Itoa(proxyServer.opts.RedirectHTTPPort))
+		if err != nil {
+			l.Close()
+			return err
+		}
+		proxyServer.redirectServer = &http.Server{Handler : httpsRedirectHandler(GetPort(l))}
+		go proxyServer.redirectServer.Serve(redirectListener)
+		proxyServer.logger.Infof("Redirecting plain HTTP on port :%v to port :%v", GetPort(redirectListener), GetPort(l))
+	}
+	if err := proxyServer.listenAPIServers(); err != nil {
+		l.Close()
+		if proxyServer.redirectServer != nil {
+			proxyServer.redirectServer.Close()
+		}
+		return err
+	}
+	proxyServer.serveAPIServers()
+	proxyServer.listener = l
+	proxyServer.started = true
+
+	go func() {
+		var err error
+		if proxyServer.server.TLSConfig != nil {
+			err = proxyServer.server.ServeTLS(l, "", "")
+		} else {
+			err = proxyServer.server.Serve(l)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			proxyServer.logger.Errorf("Serving HAR Proxy server failed : %v", err)
+			proxyServer.serveErrLock.Lock()
+			proxyServer.serveErr = err
+			proxyServer.serveErrLock.Unlock()
+		}
+		close(proxyServer.isDone)
+	}()
+	proxyServer.logger.Infof("Started HAR Proxy server on %v, Waiting for proxy start request", l.Addr())
+	return nil
+}
+
+// ListenAndServe starts the server and blocks until it stops serving.
+// Returns nil once stopped with Shutdown, otherwise the error which made serving fail.
+func (proxyServer *ProxyServer) ListenAndServe() error {
+	if err := proxyServer.Start(); err != nil {
+		return err
+	}
+	<-proxyServer.isDone
+	proxyServer.serveErrLock.RLock()
+	defer proxyServer.serveErrLock.RUnlock()
+	return proxyServer.serveErr
+}
+
+// Addr returns the address the server listens on, or nil before Start
+func (proxyServer *ProxyServer) Addr() net.Addr {
+	proxyServer.stateLock.Lock()
+	defer proxyServer.stateLock.Unlock()
+	if proxyServer.listener == nil {
+		return nil
+	}
+	return proxyServer.listener.Addr()
+}
 
-	log.Printf("Started HAR Proxy server on port :%v, Waiting for proxy start request\n", port)
-	log.Fatal(http.ListenAndServe(":" + strconv.Itoa(port), nil))
+// Shutdown gracefully stops serving the API, then shuts down every proxy it created.
+// Connections still open when ctx is done are closed.
+func (proxyServer *ProxyServer) Shutdown(ctx context.Context) error {
+	proxyServer.stateLock.Lock()
+	if proxyServer.stopped {
+		proxyServer.stateLock.Unlock()
+		return ErrAlreadyStopped
+	}
+	if !proxyServer.started {
+		proxyServer.stateLock.Unlock()
+		return ErrNotStarted
+	}
+	proxyServer.stopped = true
+	proxyServer.stateLock.Unlock()
+
+	err := proxyServer.server.Shutdown(ctx)
+	if err != nil {
+		proxyServer.server.Close()
+	}
+	if proxyServer.redirectServer != nil {
+		proxyServer.redirectServer.Close()
+	}
+	for _, added := range proxyServer.apiServers {
+		added.server.Stop(ctx)
+	}
+	<-proxyServer.isDone
+
+	for _, harProxy := range proxyServer.proxies.clear() {
+		if proxyErr := harProxy.Shutdown(ctx); proxyErr != nil {
+			proxyServer.logger.Errorf("Stopping proxy on port :%v : %v", harProxy.Port, proxyErr)
+			if err == nil {
+				err = proxyErr
+			}
+		}
+	}
+	return err
+}
+
+// Redirects plain HTTP requests to the same path on the TLS port
+func httpsRedirectHandler(tlsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := url.URL {
+			Scheme 	 : "https",
+			Host 	 : net.JoinHostPort(host, strconv.Itoa(tlsPort)),
+			Path 	 : r.URL.Path,
+			RawQuery : r.URL.RawQuery,
+		}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
 }
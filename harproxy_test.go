@@ -6,15 +6,41 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"math/big"
+	mathrand "math/rand"
+	"path/filepath"
+	"sort"
 	"io"
+	"bufio"
+	"compress/gzip"
 	"log"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"net"
+	"net/http/httptrace"
 	"strconv"
 	"bytes"
 	"io/ioutil"
 	"strings"
+	"reflect"
+	"time"
+	"context"
+	"sync"
+	"sync/atomic"
+	"runtime"
+	"expvar"
+	"os"
+	"github.com/quantum/goproxy"
+	"github.com/quantum/goproxy/transport"
+	"github.com/Hellspam/goharproxy/testutil"
 )
 
 var acceptAllCerts = &tls.Config{InsecureSkipVerify: true}
@@ -53,8 +79,8 @@ func TestHttpHarProxyGetIpEntries(t *testing.T) {
 	}
 	harLog := testLog(t, harProxy.NewHarReader())
 	host, _, _ := net.SplitHostPort(testUrl.Host)
-	if harLog.Entries[0].ServerIpAddress != host {
-		t.Fatal("Expected to get host: ", host, " but got: ", harLog.Entries[0].ServerIpAddress)
+	if harLog.Entries()[0].ServerIpAddress != host {
+		t.Fatal("Expected to get host: ", host, " but got: ", harLog.Entries()[0].ServerIpAddress)
 	}
 }
 
@@ -74,207 +100,7257 @@ func TestHttpHarProxyGetHostEntries(t *testing.T) {
 		t.Fatal("Didn't get ip for www.google.com")
 	}
 	harLog := testLog(t, harProxy.NewHarReader())
-	if ip := net.ParseIP(harLog.Entries[0].ServerIpAddress); ip == nil {
+	if ip := net.ParseIP(harLog.Entries()[0].ServerIpAddress); ip == nil {
 		t.Fatal("Expected to get valid ip address in har ServerIpAddress")
 	}
 }
 
+func TestHarProxyCloneIsolation(t *testing.T) {
+	harProxy := NewHarProxy()
+	harProxy.SetCaptureSettings(CaptureSettings{CaptureContent : true})
+	harProxy.AddHostEntries([]ProxyHosts{{Host : "www.google.com", NewHost : "localhost:8080"}})
+
+	clone, err := harProxy.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clone.CaptureSettings().CaptureContent {
+		t.Fatal("Expected clone to copy capture settings")
+	}
+	if len(clone.hostEntries) != 1 || clone.hostEntries[0].ProxyHosts != harProxy.hostEntries[0].ProxyHosts {
+		t.Fatal("Expected clone to copy host entries but got: ", clone.hostEntries)
+	}
+
+	clone.hostEntries[0].NewHost = "localhost:9090"
+	clone.AddHostEntries([]ProxyHosts{{Host : "www.yahoo.com", NewHost : "localhost:8080"}})
+	clone.SetCaptureSettings(CaptureSettings{CaptureContent : false})
+	if len(harProxy.hostEntries) != 1 || harProxy.hostEntries[0].NewHost != "localhost:8080" {
+		t.Fatal("Mutating clone host entries changed the original: ", harProxy.hostEntries)
+	}
+	if !harProxy.CaptureSettings().CaptureContent {
+		t.Fatal("Mutating clone capture settings changed the original")
+	}
+
+	sink := SinkOptions{Url : "http://collector.example.com/har", Headers : map[string]string{"Authorization" : "Bearer t"}}
+	harProxy.SetSink(&sink)
+	harProxy.SetStatsd(&StatsdOptions{Address : "127.0.0.1:8125"})
+	harProxy.SetTracing(&TracingOptions{Endpoint : "http://collector.example.com/v1/traces"})
+	clone, _ = harProxy.Clone()
+	if !reflect.DeepEqual(clone.Sink(), harProxy.Sink()) || !reflect.DeepEqual(clone.Statsd(), harProxy.Statsd()) || !reflect.DeepEqual(clone.Tracing(), harProxy.Tracing()) {
+		t.Fatalf("Expected clone to copy the sink, statsd and tracing but got: %+v %+v %+v", clone.Sink(), clone.Statsd(), clone.Tracing())
+	}
+	if clone.sink == harProxy.sink || clone.statsd == harProxy.statsd || clone.tracing == harProxy.tracing {
+		t.Fatal("Expected clone to post with its own sink, statsd client and tracing exporter")
+	}
+	sink.Headers["Authorization"] = "Bearer u"
+	clone.Sink().Headers["Authorization"] = "Bearer u"
+	if harProxy.Sink().Headers["Authorization"] != "Bearer t" || clone.Sink().Headers["Authorization"] != "Bearer t" {
+		t.Fatal("Expected the sink headers to be copied")
+	}
+
+	accessLogged, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger, AccessLog : true})
+	if clone, _ := accessLogged.Clone(); !clone.accessLog {
+		t.Fatal("Expected the clone of an access logging proxy to log its requests")
+	}
+
+	// The clone answers from the same recorded responses, in a sequence of its own
+	recorded := &HarLog{}
+	recorded.addEntry(HarEntry{Request : &HarRequest{Method : "GET", Url : "http://stubbed.example.com/"}, Response : &HarResponse{Status : 200}})
+	if err := harProxy.SetStub(&StubOptions{Har : recorded, MatchHeaders : []string{"Authorization"}}); err != nil {
+		t.Fatal(err)
+	}
+	clone, _ = harProxy.Clone()
+	if !reflect.DeepEqual(clone.Stub(), harProxy.Stub()) || clone.stub == harProxy.stub {
+		t.Fatalf("Expected the clone to copy the stub but got: %+v", clone.Stub())
+	}
+	harProxy.SetStub(nil)
+
+	// Transports the proxies build aren't shared, so closing the connections of one leaves the other's
+	if clone.transport == harProxy.transport {
+		t.Fatal("Expected the clone to build its own transport")
+	}
+	pooled, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger, UpstreamPool : &UpstreamPool{MaxIdleConnsPerHost : 8}})
+	if clone, _ := pooled.Clone(); clone.transport == pooled.transport || clone.upstreamPool != pooled.upstreamPool {
+		t.Fatal("Expected the clone to build its own transport with the same pool settings")
+	}
+	given := &http.Transport{}
+	withTransport, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger, Transport : given})
+	if clone, _ := withTransport.Clone(); clone.transport != given {
+		t.Fatal("Expected the clone to share the given transport")
+	}
+
+	exportDir := filepath.Join(t.TempDir(), "export")
+	exporting, err := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger, Export : &ExportOptions{Dir : exportDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(exportDir)
+	ioutil.WriteFile(exportDir, nil, 0644)
+	if clone, err := exporting.Clone(); err == nil || clone != nil {
+		t.Fatal("Expected cloning to fail once the export directory can't be made")
+	}
+}
+
+func TestNewHarProxyWithOptionsInvalid(t *testing.T) {
+	invalidOptions := []HarProxyOptions {
+		{Port : -1},
+		{Port : 65536},
+		{BindAddr : "not an address"},
+		{MaxEntries : -1},
+		{EntryBuffer : -1},
+		{EntryOverflow : "spill"},
+		{EntryWorkers : -1},
+		{CaptureSettings : CaptureSettings{MaxCaptureBytes : -1}},
+		{CaptureBudget : -1},
+		{CaptureBudgetPolicy : "spill"},
+	}
+	for _, opts := range invalidOptions {
+		if harProxy, err := NewHarProxyWithOptions(opts); err == nil || harProxy != nil {
+			t.Fatalf("Expected error for options %+v", opts)
+		}
+	}
+}
+
+func TestNewHarProxyWithOptionsDefaults(t *testing.T) {
+	harProxy := NewHarProxyWithPort(0)
+	optionsProxy, err := NewHarProxyWithOptions(HarProxyOptions{CaptureSettings : CaptureSettings{CaptureContent : captureContent}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(harProxy.Config(), optionsProxy.Config()) || harProxy.Port != optionsProxy.Port {
+		t.Fatalf("Expected default options to match NewHarProxy: %+v %+v", harProxy.Config(), optionsProxy.Config())
+	}
+	if optionsProxy.bindAddr != "" || optionsProxy.Config().MaxEntries != 0 {
+		t.Fatal("Expected default options to bind all interfaces without entry limit")
+	}
+}
+
+func TestHarProxyMaxEntries(t *testing.T) {
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{MaxEntries : 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Get(srv.URL + "/bobo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if harLog := testLog(t, harProxy.NewHarReader()); len(harLog.Entries()) != 1 {
+		t.Fatal("Expected 1 entry but got: ", len(harLog.Entries()))
+	}
+}
+
+func TestHarProxyStartPortInUse(t *testing.T) {
+	harProxy := NewHarProxy()
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer harProxy.Stop()
+
+	secondProxy := NewHarProxyWithPort(harProxy.Port)
+	if err := secondProxy.Start(); err == nil {
+		t.Fatal("Expected error starting a second proxy on port ", harProxy.Port)
+	}
+
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	resp, err := newProxyHttpTestClient(proxyUrl).Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	if harProxy.Err() != nil {
+		t.Fatal("Expected first proxy to keep serving but got: ", harProxy.Err())
+	}
+}
+
+func TestHarProxyStopBeforeStart(t *testing.T) {
+	harProxy := NewHarProxy()
+	if err := harProxy.Stop(); err != ErrNotStarted {
+		t.Fatal("Expected ErrNotStarted but got: ", err)
+	}
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHarProxyDoubleStop(t *testing.T) {
+	harProxy := NewHarProxy()
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.Stop(); err != ErrAlreadyStopped {
+		t.Fatal("Expected ErrAlreadyStopped but got: ", err)
+	}
+	if err := harProxy.Start(); err != ErrAlreadyStopped {
+		t.Fatal("Expected restarting a stopped proxy to fail but got: ", err)
+	}
+}
+
+func TestHarProxyStopWithInFlightRequests(t *testing.T) {
+	release := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "slow")
+	}))
+	defer slow.Close()
+
+	harProxy := NewHarProxy()
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+
+	done := make(chan bool)
+	for i := 0; i < 5; i++ {
+		go func() {
+			client.Get(slow.URL)
+			done <- true
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan error)
+	go func() { stopped <- harProxy.Stop() }()
+	stopErr := <-stopped
+	close(release)
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+	if stopErr != nil {
+		t.Fatal(stopErr)
+	}
+}
+
+func TestHarProxyShutdownDrainsInFlightRequests(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "slow")
+	}))
+	defer slow.Close()
+
+	harProxy := NewHarProxy()
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+
+	respErr := make(chan error)
+	go func() {
+		resp, err := client.Get(slow.URL)
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+		}
+		respErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+	defer cancel()
+	if err := harProxy.Shutdown(ctx); err != nil {
+		t.Fatal("Expected drain to succeed but got: ", err)
+	}
+	if err := <-respErr; err != nil {
+		t.Fatal("Expected in-flight request to complete but got: ", err)
+	}
+	if len(harProxy.HarLog.Entries()) != 1 {
+		t.Fatal("Expected drained request in HAR but got entries: ", len(harProxy.HarLog.Entries()))
+	}
+}
+
+func TestHarProxyStopAfterListenerFailure(t *testing.T) {
+	// Answers at once, then takes its time sending the body
+	bodySent := make(chan struct{}, 3)
+	slowBody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "4")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "slow")
+		bodySent <- struct{}{}
+	}))
+	defer slowBody.Close()
+
+	harProxy := NewHarProxy()
+	harProxy.SetCaptureSettings(CaptureSettings{CaptureContent : true})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() { served <- harProxy.Serve(l) }()
+	proxyUrl, _ := url.Parse("http://" + l.Addr().String())
+	client := newProxyHttpTestClient(proxyUrl)
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	resp.Body.Close()
+	for i := 0; i < 3; i++ {
+		go func() {
+			if resp, err := client.Get(slowBody.URL); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	for harProxy.sending.len() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The listener fails while the requests are in flight, then the proxy is stopped
+	l.Close()
+	if err := <-served; err == nil {
+		t.Fatal("Expected Serve to report the listener failure")
+	}
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if harProxy.HarLog.Len() != 4 {
+		t.Fatal("Expected every request whose response arrived to be recorded but got: ", harProxy.HarLog.Len())
+	}
+	for i := 0; i < 3; i++ {
+		<-bodySent
+	}
+}
+
+func TestHarProxyShutdownDeadlineForcesClose(t *testing.T) {
+	release := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	harProxy := NewHarProxy()
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+
+	respErr := make(chan error)
+	go func() {
+		_, err := client.Get(slow.URL)
+		respErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	if err := harProxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected deadline exceeded but got: ", err)
+	}
+	if err := <-respErr; err == nil {
+		t.Fatal("Expected forced close to abort the in-flight request")
+	}
+}
+
+func TestHarProxyStartContextCancel(t *testing.T) {
+	harProxy := NewHarProxy()
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := harProxy.StartContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case <-harProxy.entriesDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected cancelled context to stop the proxy")
+	}
+	if err := harProxy.Stop(); err != ErrAlreadyStopped {
+		t.Fatal("Expected ErrAlreadyStopped but got: ", err)
+	}
+}
+
+func TestHarProxyAddr(t *testing.T) {
+	harProxy := NewHarProxyWithPort(0)
+	if _, err := harProxy.Addr(); err != ErrNotStarted {
+		t.Fatal("Expected ErrNotStarted before Start but got: ", err)
+	}
+	if harProxy.URL() != "" {
+		t.Fatal("Expected no URL before Start but got: ", harProxy.URL())
+	}
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer harProxy.Stop()
+
+	addr, err := harProxy.Addr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpAddr := addr.(*net.TCPAddr)
+	if tcpAddr.Port == 0 || tcpAddr.Port != harProxy.Port {
+		t.Fatalf("Expected the assigned port %v but got: %v", harProxy.Port, tcpAddr.Port)
+	}
+	if expected := fmt.Sprintf("http://127.0.0.1:%v", tcpAddr.Port); harProxy.URL() != expected {
+		t.Fatalf("Expected URL [%v] but got [%v]", expected, harProxy.URL())
+	}
+
+	proxyUrl, _ := url.Parse(harProxy.URL())
+	resp, err := newProxyHttpTestClient(proxyUrl).Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+}
+
+func TestHarProxyServeListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	harProxy := NewHarProxy()
+	served := make(chan error, 1)
+	go func() {
+		served <- harProxy.Serve(l)
+	}()
+
+	proxyUrl, _ := url.Parse("http://" + l.Addr().String())
+	client := newProxyHttpTestClient(proxyUrl)
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	if harProxy.Port != GetPort(l) {
+		t.Fatalf("Expected port %v but got: %v", GetPort(l), harProxy.Port)
+	}
+
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal("Expected Serve to return nil after Stop but got: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Serve to return after Stop")
+	}
+	if len(harProxy.HarLog.Entries()) != 1 {
+		t.Fatal("Expected 1 entry but got: ", len(harProxy.HarLog.Entries()))
+	}
+}
+
+func TestHarProxyServeClosedListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	harProxy := NewHarProxy()
+	served := make(chan error, 1)
+	go func() {
+		served <- harProxy.Serve(l)
+	}()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Fatal("Expected an error serving on a closed listener")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Serve to return on a closed listener")
+	}
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHarProxyExpvar(t *testing.T) {
+	EnableExpvar()
+	EnableExpvar()
+	vars := expvar.Get("goharproxy").(*expvar.Map)
+	intVar := func(name string) int64 {
+		value, _ := strconv.ParseInt(vars.Get(name).String(), 10, 64)
+		return value
+	}
+	requests, entries, captureBytes, errors := intVar("total_requests"), intVar("total_entries"), intVar("capture_bytes"), intVar("errors")
+	activeProxies := intVar("active_proxies")
+
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{CaptureSettings : CaptureSettings{CaptureContent : true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if intVar("active_proxies") != activeProxies + 1 {
+		t.Fatal("Expected started proxy to be active but got: ", vars.Get("active_proxies"))
+	}
+	closed := httptest.NewServer(nil)
+	closed.Close()
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+	for _, target := range []string{srv.URL + "/bobo", srv.URL + "/bobo", closed.URL} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	harProxy.WaitForEntries(context.Background())
+
+	if delta := intVar("total_requests") - requests; delta != 3 {
+		t.Error("Expected 3 more requests but got: ", delta)
+	}
+	if delta := intVar("total_entries") - entries; delta != 3 {
+		t.Error("Expected 3 more entries but got: ", delta)
+	}
+	if delta := intVar("capture_bytes") - captureBytes; delta != 2 * int64(len("bobo")) {
+		t.Error("Expected the captured response bodies but got: ", delta)
+	}
+	if delta := intVar("errors") - errors; delta != 1 {
+		t.Error("Expected 1 more error but got: ", delta)
+	}
+
+	proxies := make(map[string]map[string]int64)
+	json.Unmarshal([]byte(vars.Get("proxies").String()), &proxies)
+	expected := map[string]int64{"requests" : 3, "entries" : 3, "capture_bytes" : 8, "errors" : 1, "in_flight" : 0, "pending_entries" : 0, "dropped_entries" : 0}
+	if !reflect.DeepEqual(proxies[strconv.Itoa(harProxy.Port)], expected) {
+		t.Errorf("Expected proxy counters %v but got: %v", expected, proxies[strconv.Itoa(harProxy.Port)])
+	}
+
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	proxies = make(map[string]map[string]int64)
+	json.Unmarshal([]byte(vars.Get("proxies").String()), &proxies)
+	if _, exists := proxies[strconv.Itoa(harProxy.Port)]; exists {
+		t.Fatal("Expected stopped proxy to be removed but got: ", proxies)
+	}
+	if intVar("active_proxies") != activeProxies {
+		t.Fatal("Expected stopped proxy to be inactive but got: ", vars.Get("active_proxies"))
+	}
+}
+
+func TestHarProxyWriteHar(t *testing.T) {
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+
+	var buffer bytes.Buffer
+	if _, err := harProxy.WriteHar(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	harLog := testLog(t, &buffer)
+	if len(harLog.Entries()) != 1 || harLog.Entries()[0].Request.Url != srv.URL + "/bobo" {
+		t.Fatal("Expected the recorded entry but got: ", harLog.Entries())
+	}
+}
+
+func TestHarProxyWaitForEntries(t *testing.T) {
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stuck.Close()
+
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	if err := harProxy.WaitForEntries(context.Background()); err != nil || harProxy.HarLog.Len() != 1 {
+		t.Fatal("Expected the entry to be recorded but got: ", err, harProxy.HarLog.Len())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := client.Get(stuck.URL); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	for harProxy.pending.len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if err := harProxy.WaitForEntries(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected the stuck entry to time out but got: ", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := harProxy.WaitForEntries(ctx); err != context.Canceled {
+		t.Fatal("Expected cancellation but got: ", err)
+	}
+
+	close(release)
+	<-done
+	if err := harProxy.WaitForEntries(context.Background()); err != nil || harProxy.HarLog.Len() != 2 {
+		t.Fatal("Expected the released entry to be recorded but got: ", err, harProxy.HarLog.Len())
+	}
+}
+
+func TestHarProxyInFlightAndPendingEntries(t *testing.T) {
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stuck.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	harProxy.UseRequest(func(req *http.Request) (*http.Request, *http.Response) {
+		if req.URL.Path == "/panic" {
+			panic("middleware")
+		}
+		return req, nil
+	})
+	waitFor := func(condition func() bool) {
+		for start := time.Now(); !condition(); time.Sleep(time.Millisecond) {
+			if time.Since(start) > 5 * time.Second {
+				t.Fatalf("Timed out with %v in flight and %v pending", harProxy.InFlightRequests(), harProxy.PendingEntries())
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := client.Get(stuck.URL); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitFor(func() bool { return harProxy.InFlightRequests() == 1 })
+	if harProxy.PendingEntries() != 0 {
+		t.Fatal("Expected no pending entry while waiting for the response but got: ", harProxy.PendingEntries())
+	}
+
+	unblock := make(chan struct{})
+	harProxy.OnEntry(func(HarEntry) { <-unblock })
+	close(release)
+	<-done
+	waitFor(func() bool { return harProxy.InFlightRequests() == 0 && harProxy.PendingEntries() == 1 })
+	close(unblock)
+
+	if resp, err := client.Get(closed.URL); err == nil {
+		resp.Body.Close()
+	}
+	resp, err := client.Get(srv.URL + "/panic")
+	testResp(t, resp, err)
+	if err := harProxy.WaitForEntries(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if harProxy.InFlightRequests() != 0 || harProxy.PendingEntries() != 0 || harProxy.HarLog.Len() != 3 {
+		t.Fatalf("Expected quiescence with 3 entries but got %v in flight, %v pending and %v entries",
+			harProxy.InFlightRequests(), harProxy.PendingEntries(), harProxy.HarLog.Len())
+	}
+
+	// A request whose handling panics is neither in flight nor pending afterwards, and counts as failed
+	harProxy.SetEntryMetadata(func(req *http.Request) map[string]interface{} {
+		panic("metadata")
+	})
+	harProxy.Proxy.Logger = log.New(ioutil.Discard, "", 0)
+	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	failed := atomic.LoadInt64(&harProxy.metrics.requests[errorClass])
+	if resp, err := client.Get(srv.URL + "/bobo"); err == nil {
+		resp.Body.Close()
+	}
+	waitFor(func() bool { return harProxy.InFlightRequests() == 0 && harProxy.PendingEntries() == 0 })
+	// The client may retry the request once the connection is dropped
+	if atomic.LoadInt64(&harProxy.metrics.requests[errorClass]) <= failed || harProxy.HarLog.Len() != 3 {
+		t.Fatal("Expected the panicking request to count as failed without entry but got: ", harProxy.HarLog.Len())
+	}
+}
+
+func TestHarProxyServerMerge(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	var ports []int
+	for i := 0; i < 2; i++ {
+		proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+		defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+		ports = append(ports, proxyServerPort.Port)
+		resp, err := proxiedClient.Get(fmt.Sprintf("%v/query?result=%v", srv.URL, i))
+		testResp(t, resp, err)
+	}
+
+	merge := func(body string) *http.Response {
+		resp, err := testClient.Post(harProxyServer.URL + "/har/merge", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	body := fmt.Sprintf(`{"ports" : [%v, %v], "clear" : true}`, ports[0], ports[1])
+	resp := merge(body)
+	testResp(t, resp, nil)
+	harLog := testLog(t, resp.Body)
+	if harLog.Len() != 2 || !harLog.Entries()[0].StartedDateTime.Before(harLog.Entries()[1].StartedDateTime) {
+		t.Fatal("Expected both entries in time order but got: ", harLog.Entries())
+	}
+	resp = merge(body)
+	testResp(t, resp, nil)
+	cleared := new(HarLog)
+	if err := json.NewDecoder(resp.Body).Decode(cleared); err != nil || cleared.Len() != 0 {
+		t.Fatal("Expected the merged logs to be cleared but got: ", err, cleared.Len())
+	}
+
+	if resp := merge(`{"ports" : [1]}`); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Expected 404 for an unknown port but got: ", resp.Status)
+	}
+	if resp := merge(`{"ports" : "all"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an invalid body but got: ", resp.Status)
+	}
+}
+
+func TestHarProxyServerDiff(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	var ports []int
+	for _, path := range []string{"/bobo", "/query?result=a"} {
+		proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+		defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+		ports = append(ports, proxyServerPort.Port)
+		resp, err := proxiedClient.Get(srv.URL + path)
+		testResp(t, resp, err)
+	}
+
+	decodeDiff := func(resp *http.Response, err error) HarDiff {
+		testResp(t, resp, err)
+		diff := HarDiff{}
+		if err := json.NewDecoder(resp.Body).Decode(&diff); err != nil {
+			t.Fatal(err)
+		}
+		return diff
+	}
+	diff := decodeDiff(testClient.Get(fmt.Sprintf("%v/har/diff?a=%v&b=%v", harProxyServer.URL, ports[0], ports[1])))
+	if len(diff.Removed) != 1 || diff.Removed[0].Request.Url != srv.URL + "/bobo" ||
+		len(diff.Added) != 1 || diff.Added[0].Request.Url != srv.URL + "/query?result=a" {
+		t.Fatalf("Expected the differing entries but got: %+v", diff)
+	}
+
+	harLog := newHarLog()
+	harLog.addEntry(HarEntry{Request : &HarRequest{Method : "GET", Url : "http://a.com/?v=1"}})
+	uploaded, _ := json.Marshal(harLog)
+	body := fmt.Sprintf(`{"hars" : [%s, %s], "options" : {"ignoreQuery" : true}}`,
+		uploaded, strings.Replace(string(uploaded), "v=1", "v=2", 1))
+	diff = decodeDiff(testClient.Post(harProxyServer.URL + "/har/diff", "application/json", strings.NewReader(body)))
+	if len(diff.Added) != 0 || len(diff.Removed) != 0 || len(diff.Changed) != 0 {
+		t.Fatalf("Expected no differences ignoring the query but got: %+v", diff)
+	}
+
+	diff = decodeDiff(testClient.Get(fmt.Sprintf("%v/har/diff?a=%v&b=%v&ignoreQuery=1", harProxyServer.URL, ports[0], ports[1])))
+	if len(diff.Removed) != 1 || len(diff.Added) != 1 {
+		t.Fatalf("Expected the differing entries ignoring the query but got: %+v", diff)
+	}
+	resp, err := testClient.Get(fmt.Sprintf("%v/har/diff?a=%v&b=%v&ignoreQuery=ture", harProxyServer.URL, ports[0], ports[1]))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an invalid ignoreQuery but got: ", resp.Status)
+	}
+	resp, err = testClient.Get(fmt.Sprintf("%v/har/diff?a=%v", harProxyServer.URL, ports[0]))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 without a second port but got: ", resp.Status)
+	}
+	resp, err = testClient.Post(harProxyServer.URL + "/har/diff", "application/json", strings.NewReader(`{"ports" : [1, 2]}`))
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Expected 404 for unknown ports but got: ", resp.Status)
+	}
+}
+
+func TestHarProxyServerValidate(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	validateUrl := harProxyServer.URL + "/har/validate"
+
+	validate := func(body io.Reader, status int) HarValidationReport {
+		resp, err := testClient.Post(validateUrl, "application/json", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("Expected %v but got: %v", status, resp.Status)
+		}
+		report := HarValidationReport{}
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	chrome, _ := ioutil.ReadFile("testdata/chrome.har")
+	if report := validate(bytes.NewReader(chrome), http.StatusOK); !report.Valid || report.Entries != 2 {
+		t.Fatalf("Expected the browser export to be valid but got: %+v", report)
+	}
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Write(chrome)
+	gzipWriter.Close()
+	if report := validate(&gzipped, http.StatusOK); !report.Valid || report.Entries != 2 {
+		t.Fatalf("Expected the gzipped browser export to be valid but got: %+v", report)
+	}
+
+	corrupted, _ := ioutil.ReadFile("testdata/validate/corrupted.har")
+	report := validate(bytes.NewReader(corrupted), http.StatusUnprocessableEntity)
+	if report.Valid || report.Errors == 0 || report.Violations[0].Field != "version" {
+		t.Fatalf("Expected the violations of the corrupted document but got: %+v", report)
+	}
+	if report := validate(strings.NewReader("not json"), http.StatusUnprocessableEntity); report.Valid || len(report.Violations) != 1 {
+		t.Fatalf("Expected a violation for a document which isn't json but got: %+v", report)
+	}
+
+	req, _ := http.NewRequest("POST", validateUrl, bytes.NewReader(chrome))
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := testClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for a body which isn't gzipped but got: ", resp.Status)
+	}
+	// The limit applies to the decompressed document too, which a small gzip body may inflate past
+	var bomb bytes.Buffer
+	gzipWriter = gzip.NewWriter(&bomb)
+	io.WriteString(gzipWriter, `{"log" : {"comment" : "`)
+	gzipWriter.Write(bytes.Repeat([]byte("a"), maxRequestBodySize))
+	io.WriteString(gzipWriter, `"}}`)
+	gzipWriter.Close()
+	if bomb.Len() > maxRequestBodySize / 100 {
+		t.Fatal("Expected a small gzip body but got: ", bomb.Len())
+	}
+	resp, err = testClient.Post(validateUrl, "application/json", &bomb)
+	if err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatal("Expected 413 for a body inflating past the limit but got: ", resp.Status)
+	}
+	resp, err = testClient.Get(validateUrl)
+	if err != nil || resp.StatusCode == http.StatusOK {
+		t.Fatal("Expected GET to be rejected but got: ", resp.Status)
+	}
+}
+
+func TestReplayer(t *testing.T) {
+	var lock sync.Mutex
+	var received []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		received = append(received, r.Method + " " + r.Host + r.URL.RequestURI() + " " + string(body))
+		lock.Unlock()
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "replayed")
+	}))
+	defer target.Close()
+	targetUrl, _ := url.Parse(target.URL)
+
+	start := time.Now()
+	entry := func(method, path string, offset time.Duration) HarEntry {
+		harEntry := HarEntry {
+			StartedDateTime : start.Add(offset),
+			Request 		: &HarRequest {
+				Method 	: method,
+				Url 	: "http://recorded.invalid" + path,
+				Headers : []HarNameValuePair{{Name : "Host", Value : "recorded.invalid"}, {Name : "X-Trace", Value : path}},
+			},
+		}
+		if method == "POST" {
+			harEntry.Request.PostData = &HarPostData{MimeType : "text/plain", Text : "data"}
+		}
+		return harEntry
+	}
+	recorded := newHarLog()
+	recorded.addEntry(
+		entry("GET", "/a", 0),
+		entry("POST", "/post", 10 * time.Millisecond),
+		entry("GET", "/c?q=1", 60 * time.Millisecond),
+		entry("GET", "/b", 30 * time.Millisecond),
+	)
+
+	replayer := Replayer{Logger : NopLogger}
+	began := time.Now()
+	replayed, err := replayer.Replay(context.Background(), recorded, ReplayOptions{Target : target.URL, Paced : true, Concurrency : 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(began); elapsed < 60 * time.Millisecond {
+		t.Fatal("Expected the recorded pacing to be kept but replaying took: ", elapsed)
+	}
+	expected := []string {
+		"GET " + targetUrl.Host + "/a ",
+		"GET " + targetUrl.Host + "/b ",
+		"GET " + targetUrl.Host + "/c?q=1 ",
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("Expected paced GET requests to the target %v but got: %v", expected, received)
+	}
+	if replayed.Len() != 3 {
+		t.Fatal("Expected an entry per replayed request but got: ", replayed.Len())
+	}
+	for i, replayedEntry := range replayed.Entries() {
+		if replayedEntry.Response == nil || replayedEntry.Response.Status != http.StatusOK ||
+			replayedEntry.Response.Content.Text != "replayed" || !strings.HasPrefix(replayedEntry.Request.Url, target.URL) {
+			t.Fatalf("Unexpected replayed entry %v: %+v", i, replayedEntry)
+		}
+	}
+
+	received = nil
+	replayed, err = replayer.Replay(context.Background(), recorded, ReplayOptions{Target : target.URL, Methods : []string{"GET", "post"}})
+	if err != nil || replayed.Len() != 4 || received[1] != "POST " + targetUrl.Host + "/post data" {
+		t.Fatal("Expected POST requests to be replayed with their body but got: ", err, received)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := replayer.Replay(ctx, recorded, ReplayOptions{Target : target.URL, Paced : true}); err != context.Canceled {
+		t.Fatal("Expected cancellation but got: ", err)
+	}
+	if _, err := replayer.Replay(context.Background(), recorded, ReplayOptions{Target : "localhost:8080"}); err == nil {
+		t.Fatal("Expected error for a target without scheme")
+	}
+}
+
+func TestHarProxyServerReplay(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	resp, err := proxiedClient.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+
+	replayUrl := fmt.Sprintf("%v/proxy/%v/replay", harProxyServer.URL, proxyServerPort.Port)
+	resp, err = testClient.Post(replayUrl, "application/json", strings.NewReader(`{"concurrency" : 2}`))
+	testResp(t, resp, err)
+	harLog := testLog(t, resp.Body)
+	entry := harLog.Entries()[0]
+	if harLog.Len() != 1 || entry.Request.Url != srv.URL + "/bobo" || entry.Response.Content.Text != "bobo" {
+		t.Fatal("Expected the recorded request to be replayed but got: ", harLog.Entries())
+	}
+
+	resp, err = testClient.Post(replayUrl, "application/json", strings.NewReader(`{"target" : "nowhere"}`))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an invalid target but got: ", resp.Status)
+	}
+}
+
+func TestHarProxyServerCurl(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	for _, path := range []string{"/bobo", "/query?result=a"} {
+		resp, err := proxiedClient.Get(srv.URL + path)
+		testResp(t, resp, err)
+	}
+
+	curlUrl := fmt.Sprintf("%v/proxy/%v/har/curl", harProxyServer.URL, proxyServerPort.Port)
+	resp, err := testClient.Get(curlUrl + "?urlPattern=" + url.QueryEscape("bobo$"))
+	testResp(t, resp, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.HasPrefix(string(body), "curl " + srv.URL + "/bobo -H ") || strings.Count(string(body), "\n") != 1 ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("Expected the curl command of the matching entry but got: %s", body)
+	}
+	resp, err = testClient.Get(curlUrl)
+	testResp(t, resp, err)
+	if body, _ := ioutil.ReadAll(resp.Body); strings.Count(string(body), "\n") != 2 {
+		t.Fatalf("Expected a command per entry but got: %s", body)
+	}
+	resp, err = testClient.Get(curlUrl + "?urlPattern=" + url.QueryEscape("("))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an invalid pattern but got: ", resp.Status)
+	}
+}
+
+func TestHarProxyServerPostman(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	for _, path := range []string{"/bobo", "/query?result=a"} {
+		resp, err := proxiedClient.Get(srv.URL + path)
+		testResp(t, resp, err)
+	}
+
+	postmanUrl := fmt.Sprintf("%v/proxy/%v/har/postman", harProxyServer.URL, proxyServerPort.Port)
+	resp, err := testClient.Get(postmanUrl + "?urlPattern=" + url.QueryEscape("query"))
+	testResp(t, resp, err)
+	collection := PostmanCollection{}
+	json.NewDecoder(resp.Body).Decode(&collection)
+	resp.Body.Close()
+	srvUrl, _ := url.Parse(srv.URL)
+	if collection.Info.Name != fmt.Sprintf("Proxy %v", proxyServerPort.Port) || len(collection.Item) != 1 ||
+		collection.Item[0].Name != srvUrl.Host || len(collection.Item[0].Item) != 1 {
+		t.Fatalf("Expected a folder with the matching request but got: %+v", collection)
+	}
+	if request := collection.Item[0].Item[0].Request; request.Method != "GET" || request.Url.Raw != srv.URL + "/query?result=a" ||
+		!reflect.DeepEqual(request.Url.Query, []PostmanKeyValue{{Key : "result", Value : "a"}}) {
+		t.Fatalf("Expected the recorded request but got: %+v", request)
+	}
+	resp, err = testClient.Get(postmanUrl + "?groupBy=status")
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an invalid groupBy but got: ", resp.Status)
+	}
+}
+
+func TestHarProxyServerJMeter(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	for _, path := range []string{"/bobo", "/query?result=a"} {
+		resp, err := proxiedClient.Get(srv.URL + path)
+		testResp(t, resp, err)
+	}
+
+	jmeterUrl := fmt.Sprintf("%v/proxy/%v/har/jmeter", harProxyServer.URL, proxyServerPort.Port)
+	resp, err := testClient.Get(jmeterUrl + "?thinkTime=true&urlPattern=" + url.QueryEscape("query"))
+	testResp(t, resp, err)
+	plan := struct {
+		HashTree struct {
+			TestPlan struct{ Name string `xml:"testname,attr"` }
+			HashTree struct {
+				HashTree struct {
+					Samplers []struct{ Name string `xml:"testname,attr"` } `xml:"HTTPSamplerProxy"`
+				} `xml:"hashTree"`
+			} `xml:"hashTree"`
+		} `xml:"hashTree"`
+	}{}
+	if err := xml.NewDecoder(resp.Body).Decode(&plan); err != nil || resp.Header.Get("Content-Type") != "application/xml" {
+		t.Fatal("Expected a JMeter test plan but got: ", err)
+	}
+	if samplers := plan.HashTree.HashTree.HashTree.Samplers; plan.HashTree.TestPlan.Name != fmt.Sprintf("Proxy %v", proxyServerPort.Port) || len(samplers) != 1 || samplers[0].Name != "GET /query" {
+		t.Fatalf("Expected a sampler of the matching request but got: %+v", plan)
+	}
+	resp, err = testClient.Get(jmeterUrl + "?thinkTime=sometimes")
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an invalid thinkTime but got: ", resp.Status)
+	}
+}
+
+func TestHarProxyServerOpenAPI(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	for _, path := range []string{"/bobo", "/query?result=1", "/query/1"} {
+		resp, err := proxiedClient.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	openAPIUrl := fmt.Sprintf("%v/proxy/%v/har/openapi", harProxyServer.URL, proxyServerPort.Port)
+	resp, err := testClient.Get(openAPIUrl + "?urlPattern=" + url.QueryEscape("query"))
+	testResp(t, resp, err)
+	document := OpenAPIDocument{}
+	json.NewDecoder(resp.Body).Decode(&document)
+	resp.Body.Close()
+	if document.OpenAPI != "3.0.3" || len(document.Paths) != 2 || document.Paths["/query/{id}"] == nil || document.Paths["/query"].Get == nil {
+		t.Fatalf("Expected the paths of the matching entries but got: %+v", document)
+	}
+	resp, err = testClient.Get(openAPIUrl + "?paramPattern=" + url.QueryEscape("("))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an invalid parameter pattern but got: ", resp.Status)
+	}
+}
+
+func TestHarProxyServerJSONL(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	harUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
+
+	for _, jsonl := range []func(*http.Request){
+		func(req *http.Request) { req.URL.RawQuery = "format=jsonl" },
+		func(req *http.Request) { req.Header.Set("Accept", "application/json;q=0.5, application/x-ndjson") },
+	} {
+		for _, path := range []string{"/bobo", "/query?result=a"} {
+			resp, err := proxiedClient.Get(srv.URL + path)
+			testResp(t, resp, err)
+		}
+		req, _ := http.NewRequest("PUT", harUrl, nil)
+		jsonl(req)
+		resp, err := testClient.Do(req)
+		testResp(t, resp, err)
+		if contentType := resp.Header.Get("Content-Type"); contentType != "application/x-ndjson" {
+			t.Fatal("Expected JSON Lines but got: ", contentType)
+		}
+		decoder := json.NewDecoder(resp.Body)
+		header := harLogJsonlHeader{}
+		if err := decoder.Decode(&header); err != nil || header.Version != "1.2" {
+			t.Fatal("Expected the log metadata on the first line but got: ", header, err)
+		}
+		var urls []string
+		for decoder.More() {
+			var entry HarEntry
+			if err := decoder.Decode(&entry); err != nil {
+				t.Fatal(err)
+			}
+			urls = append(urls, entry.Request.Url)
+		}
+		resp.Body.Close()
+		if !reflect.DeepEqual(urls, []string{srv.URL + "/bobo", srv.URL + "/query?result=a"}) {
+			t.Fatal("Expected an entry per line but got: ", urls)
+		}
+	}
+}
+
+func TestHarProxyServerHarSerializationError(t *testing.T) {
+	proxyServer, _ := NewProxyServerWithOptions(ProxyServerOptions{})
+	harProxyServer := httptest.NewServer(proxyServer)
+	defer harProxyServer.Close()
+	testClient := &http.Client{}
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	harUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
+	harProxy := proxyServer.proxies.get(proxyServerPort.Port)
+
+	resp, err := proxiedClient.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	// JSON can't hold times past year 9999
+	unserializable := HarEntry{StartedDateTime : time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC), Request : &HarRequest{Method : "GET", Url : "http://unserializable"}}
+	harProxy.HarLog.addEntry(unserializable)
+
+	req, _ := http.NewRequest("PUT", harUrl, nil)
+	resp, err = testClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorMessage := ProxyServerErr{}
+	json.NewDecoder(resp.Body).Decode(&errorMessage)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(errorMessage.Error, "year outside of range") {
+		t.Fatal("Expected the serialization error with 500 but got: ", resp.StatusCode, errorMessage)
+	}
+	if harProxy.HarLog.Len() != 2 {
+		t.Fatal("Expected the entries to be kept after the failed export but got: ", harProxy.HarLog.Len())
+	}
+	if _, err := ioutil.ReadAll(harProxy.NewHarReader()); err == nil {
+		t.Fatal("Expected reading the HAR to fail")
+	}
+
+	// Past the start the response was already sent before failing, it is aborted
+	harProxy.ClearEntries()
+	for harProxy.HarLog.Len() < 1000 {
+		harProxy.HarLog.addEntry(HarEntry{StartedDateTime : time.Now(), Request : &HarRequest{Method : "GET", Url : srv.URL + "/bobo"}})
+	}
+	harProxy.HarLog.addEntry(unserializable)
+	resp, err = testClient.Do(req)
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Fatal("Expected the response to be aborted")
+	}
+	if harProxy.HarLog.Len() != 1001 {
+		t.Fatal("Expected the entries to be kept after the aborted export but got: ", harProxy.HarLog.Len())
+	}
+
+	// Restored entries go back before the ones recorded since, with their sequence numbers
+	harProxy.ClearEntries()
+	resp, err = proxiedClient.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	harProxy.WaitForEntries(context.Background())
+	drained := harProxy.HarLog.drain()
+	resp, err = proxiedClient.Get(srv.URL + "/query?result=after")
+	testResp(t, resp, err)
+	harProxy.WaitForEntries(context.Background())
+	harProxy.HarLog.restore(drained)
+	if entries, _ := harProxy.HarLog.EntriesSince(drained.seq - 1); len(entries) != 2 || entries[0].Request.Url != srv.URL + "/bobo" {
+		t.Fatal("Expected the restored entry first, then the one recorded since but got: ", entries)
+	}
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	harLog := new(HarLog)
+	if err := json.NewDecoder(resp.Body).Decode(harLog); err != nil || harLog.Len() != 2 || harProxy.HarLog.Len() != 0 {
+		t.Fatal("Expected the served entry to be cleared but got: ", err, harProxy.HarLog.Len())
+	}
+}
+
+func TestHarProxyServerConcurrentHarExports(t *testing.T) {
+	const exports, entries = 8, 200
+	proxyServer, _ := NewProxyServerWithOptions(ProxyServerOptions{})
+	harProxyServer := httptest.NewServer(proxyServer)
+	defer harProxyServer.Close()
+	testClient := &http.Client{}
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	harUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
+	harProxy := proxyServer.proxies.get(proxyServerPort.Port)
+
+	recording := make(chan struct{})
+	go func() {
+		defer close(recording)
+		for i := 0; i < entries; i++ {
+			harProxy.HarLog.addEntry(HarEntry{StartedDateTime : time.Now(), Request : &HarRequest{Method : "GET", Url : fmt.Sprintf("http://entry/%v", i)}})
+		}
+	}()
+	exported := make(chan []HarEntry)
+	for i := 0; i < exports; i++ {
+		go func() {
+			var all []HarEntry
+			defer func() { exported <- all }()
+			for j := 0; j < 5; j++ {
+				req, _ := http.NewRequest("PUT", harUrl, nil)
+				resp, err := testClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				harLog := new(HarLog)
+				err = json.NewDecoder(resp.Body).Decode(harLog)
+				resp.Body.Close()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				all = append(all, harLog.Entries()...)
+			}
+		}()
+	}
+	counts := make(map[string]int)
+	for i := 0; i < exports; i++ {
+		for _, entry := range <-exported {
+			counts[entry.Request.Url]++
+		}
+	}
+	<-recording
+	for _, entry := range harProxy.HarLog.Entries() {
+		counts[entry.Request.Url]++
+	}
+	for url, count := range counts {
+		if count != 1 {
+			t.Fatalf("Expected %v to be exported once but got: %v", url, count)
+		}
+	}
+	if len(counts) != entries {
+		t.Fatalf("Expected %v entries exported or left but got: %v", entries, len(counts))
+	}
+}
+
+func TestHarProxyServerCSV(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	resp, err := proxiedClient.Get(srv.URL + "/query?result=a,b")
+	testResp(t, resp, err)
+	harUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
+
+	req, _ := http.NewRequest("PUT", harUrl + "?format=csv&columns=nope", nil)
+	resp, err = testClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an unknown column but got: ", resp.Status)
+	}
+	req, _ = http.NewRequest("PUT", harUrl + "?format=csv&columns=method,url,status", nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/csv" {
+		t.Fatal("Expected CSV but got: ", contentType)
+	}
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	expected := [][]string{{"method", "url", "status"}, {"GET", srv.URL + "/query?result=a,b", "200"}}
+	if err != nil || !reflect.DeepEqual(records, expected) {
+		t.Fatalf("Expected the entry kept by the rejected request but got: %q %v", records, err)
+	}
+	req, _ = http.NewRequest("PUT", harUrl + "?format=xml", nil)
+	resp, err = testClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an unknown format but got: ", resp.Status)
+	}
+}
+
+func TestHarProxyServerStats(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	for _, path := range []string{"/bobo", "/query?result=a", "/query?result=b"} {
+		resp, err := proxiedClient.Get(srv.URL + path)
+		testResp(t, resp, err)
+	}
+
+	statsUrl := fmt.Sprintf("%v/proxy/%v/har/stats", harProxyServer.URL, proxyServerPort.Port)
+	resp, err := testClient.Get(statsUrl + "?groupBy=status&urlPattern=" + url.QueryEscape("query"))
+	testResp(t, resp, err)
+	stats := HarStats{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.GroupBy != "status" || stats.Overall.Count != 2 || stats.Groups["200"].Count != 2 {
+		t.Fatalf("Expected the query entries by status but got: %+v", stats)
+	}
+	resp, err = testClient.Get(statsUrl)
+	testResp(t, resp, err)
+	stats = HarStats{}
+	json.NewDecoder(resp.Body).Decode(&stats)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	if stats.Overall.Count != 3 || len(stats.Groups) != 1 || stats.Groups[host].Count != 3 {
+		t.Fatalf("Expected all entries by host but got: %+v", stats)
+	}
+	for _, query := range []string{"?groupBy=bogus", "?urlPattern=" + url.QueryEscape("(")} {
+		resp, err = testClient.Get(statsUrl + query)
+		if err != nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatal("Expected 400 but got: ", resp.Status)
+		}
+	}
+}
+
+func TestHarProxyServerHarHosts(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusInternalServerError
+		if r.URL.Path == "/missing" {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, "failed")
+	}))
+	defer failing.Close()
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	for _, rawUrl := range []string{srv.URL + "/bobo", failing.URL + "/a", failing.URL + "/b", failing.URL + "/missing", srv.URL + "/query?result=ok", "http://127.0.0.1:1/closed"} {
+		resp, err := proxiedClient.Get(rawUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	hostsUrl := fmt.Sprintf("%v/proxy/%v/har/hosts", harProxyServer.URL, proxyServerPort.Port)
+	resp, err := testClient.Get(hostsUrl + "?clear=false")
+	testResp(t, resp, err)
+	var hosts []HarHostStats
+	if err := json.NewDecoder(resp.Body).Decode(&hosts); err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 3 {
+		t.Fatalf("Expected a line per host but got: %+v", hosts)
+	}
+	failingHost, srvHost := strings.TrimPrefix(failing.URL, "http://"), strings.TrimPrefix(srv.URL, "http://")
+	if failed := hosts[0]; failed.Host != failingHost || failed.Count != 3 || failed.Errors != 3 || failed.Statuses["5xx"] != 2 || failed.Statuses["4xx"] != 1 || failed.Bytes != 18 {
+		t.Fatalf("Expected the failing host first with its errors by class but got: %+v", failed)
+	}
+	if ok := hosts[1]; ok.Host != srvHost || ok.Count != 2 || ok.Errors != 0 || ok.Statuses["2xx"] != 2 || ok.MaxTime < int64(ok.MeanTime) {
+		t.Fatalf("Expected the working host without errors but got: %+v", ok)
+	}
+	if closed := hosts[2]; closed.Host != "127.0.0.1:1" || closed.Count != 1 || closed.Errors != 1 || closed.Statuses["error"] != 1 {
+		t.Fatalf("Expected the unreachable host's entry without response but got: %+v", closed)
+	}
+
+	resp, err = testClient.Get(hostsUrl + "?urlPattern=" + url.QueryEscape("/missing|/query"))
+	testResp(t, resp, err)
+	hosts = nil
+	json.NewDecoder(resp.Body).Decode(&hosts)
+	if len(hosts) != 2 || hosts[0].Count != 1 || hosts[1].Count != 1 || hosts[0].Host >= hosts[1].Host || hosts[0].Host != failingHost && hosts[1].Host != failingHost {
+		t.Fatalf("Expected the matching entries by host, tied hosts by name, but got: %+v", hosts)
+	}
+	for _, query := range []string{"?clear=true", "?urlPattern=" + url.QueryEscape("(")} {
+		resp, err = testClient.Get(hostsUrl + query)
+		if err != nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatal("Expected 400 but got: ", resp.Status)
+		}
+	}
+	resp, err = testClient.Get(fmt.Sprintf("%v/proxy/%v/status", harProxyServer.URL, proxyServerPort.Port))
+	testResp(t, resp, err)
+	status := ProxyServerStatus{}
+	json.NewDecoder(resp.Body).Decode(&status)
+	if status.Entries != 6 {
+		t.Fatal("Expected the entries to be kept but got: ", status.Entries)
+	}
+}
+
+// Entries take as long as the slow handler's ms param, on the proxy's fake clock
+func TestHarProxyServerSlowest(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Now())
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms, _ := strconv.Atoi(r.URL.Query().Get("ms"))
+		clock.Advance(time.Duration(ms) * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+	defer slow.Close()
+	testClient, harProxyServer := newProxyTestServerWithOptions(ProxyServerOptions{Clock : clock})
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	for _, path := range []string{"/api?ms=30", "/static?ms=500", "/api?ms=120", "/api?ms=5", "/static?ms=120"} {
+		resp, err := proxiedClient.Get(slow.URL + path)
+		testResp(t, resp, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	// Waits for the entries to be recorded, the slowest entries are taken right away
+	resp, err := testClient.Get(fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port))
+	testResp(t, resp, err)
+	slowestUrl := fmt.Sprintf("%v/proxy/%v/har/slowest", harProxyServer.URL, proxyServerPort.Port)
+
+	resp, err = testClient.Get(slowestUrl + "?n=3")
+	testResp(t, resp, err)
+	var entries []HarEntry
+	json.NewDecoder(resp.Body).Decode(&entries)
+	if len(entries) != 3 || entries[0].Time != 500 || entries[1].Request.Url != slow.URL + "/api?ms=120" || entries[2].Request.Url != slow.URL + "/static?ms=120" {
+		t.Fatalf("Expected the 3 slowest entries, ties in the order they started, but got: %+v", entries)
+	}
+
+	resp, err = testClient.Get(slowestUrl + "?n=50&fields=url,time,status&urlPattern=api")
+	testResp(t, resp, err)
+	var summaries []map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&summaries)
+	if len(summaries) != 3 || len(summaries[0]) != 3 || summaries[0]["url"] != slow.URL + "/api?ms=120" || summaries[0]["time"] != float64(120) ||
+			summaries[0]["status"] != float64(200) || summaries[2]["time"] != float64(5) {
+		t.Fatalf("Expected the summaries of all api entries but got: %+v", summaries)
+	}
+	if resp, err = testClient.Get(slowestUrl); err != nil {
+		t.Fatal(err)
+	}
+	entries = nil
+	json.NewDecoder(resp.Body).Decode(&entries)
+	if len(entries) != 5 {
+		t.Fatal("Expected every entry when there are fewer than 10 but got: ", len(entries))
+	}
+	for _, query := range []string{"?n=0", "?n=x", "?fields=url,bogus", "?urlPattern=" + url.QueryEscape("(")} {
+		resp, err = testClient.Get(slowestUrl + query)
+		if err != nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v but got: %v", query, resp.Status)
+		}
+	}
+}
+
+func TestHarProxyServerDuplicates(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	for _, path := range []string{"/query?result=a&_=1", "/query?result=a&_=2", "/query?result=b", "/bobo", "/query?_=3&result=a"} {
+		resp, err := proxiedClient.Get(srv.URL + path)
+		testResp(t, resp, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	duplicatesUrl := fmt.Sprintf("%v/proxy/%v/har/duplicates", harProxyServer.URL, proxyServerPort.Port)
+	getDuplicates := func(query string) []HarDuplicates {
+		resp, err := testClient.Get(duplicatesUrl + query)
+		testResp(t, resp, err)
+		defer resp.Body.Close()
+		var duplicates []HarDuplicates
+		json.NewDecoder(resp.Body).Decode(&duplicates)
+		return duplicates
+	}
+
+	if duplicates := getDuplicates(""); duplicates == nil || len(duplicates) != 0 {
+		t.Fatalf("Expected no duplicates with the cache busters but got: %+v", duplicates)
+	}
+	duplicates := getDuplicates("?ignoreParam=" + url.QueryEscape("^_$"))
+	if len(duplicates) != 1 || duplicates[0].Url != srv.URL + "/query?result=a" || duplicates[0].Count != 3 || len(duplicates[0].EntryIds) != 3 {
+		t.Fatalf("Expected the requests of result a but got: %+v", duplicates)
+	}
+	resp, err := testClient.Get(fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port))
+	testResp(t, resp, err)
+	harLog, err := ParseHar(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range duplicates[0].EntryIds {
+		if entry, ok := harLog.Entry(id); !ok || !strings.Contains(entry.Request.Url, "result=a") {
+			t.Fatalf("Expected entry %v to be a request of result a but got: %+v", id, entry)
+		}
+	}
+	if duplicates = getDuplicates("?ignoreQuery=true&urlPattern=query&windowMs=60000"); len(duplicates) != 1 || duplicates[0].Count != 4 {
+		t.Fatalf("Expected the query requests without their query but got: %+v", duplicates)
+	}
+	for _, query := range []string{"?ignoreQuery=maybe", "?windowMs=-1", "?ignoreParam=" + url.QueryEscape("("), "?urlPattern=" + url.QueryEscape("(")} {
+		resp, err := testClient.Get(duplicatesUrl + query)
+		if err != nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v but got: %v", query, resp.Status)
+		}
+	}
+}
+
+func TestHarProxyServerHarAnonymized(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	for _, path := range []string{"/query?result=a&token=url-secret", "/bobo?session=session-secret&id=1"} {
+		req, _ := http.NewRequest("GET", srv.URL + path, nil)
+		req.Header.Set("Authorization", "Bearer header-secret")
+		req.Header.Set("X-Api-Key", "api-secret")
+		resp, err := proxiedClient.Do(req)
+		testResp(t, resp, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	harUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
+	get := func(query string) []byte {
+		resp, err := testClient.Get(harUrl + query)
+		testResp(t, resp, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return body
+	}
+
+	anonymized := get("?anonymize=true&anonymizeHosts=true&anonymizeHeaders=X-Api-Key")
+	srvUrl, _ := url.Parse(srv.URL)
+	for _, secret := range []string{"url-secret", "session-secret", "header-secret", "api-secret", srvUrl.Host} {
+		if bytes.Contains(anonymized, []byte(secret)) {
+			t.Errorf("Expected %v to be scrubbed but got: %s", secret, anonymized)
+		}
+	}
+	harLog, err := ParseHar(bytes.NewReader(anonymized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := harLog.Entries()
+	if len(entries) != 2 || !strings.HasPrefix(entries[0].Request.Url, "http://host-1.example:") || !strings.HasPrefix(entries[1].Request.Url, "http://host-1.example:") {
+		t.Fatalf("Expected both entries on the same pseudonym but got: %+v", entries)
+	}
+	if csv := get("?format=csv&columns=url&anonymize=true"); bytes.Contains(csv, []byte("url-secret")) || !bytes.Contains(csv, []byte(srvUrl.Host)) {
+		t.Fatalf("Expected the CSV urls to be scrubbed, with their hosts, but got: %s", csv)
+	}
+	if recorded := get(""); !bytes.Contains(recorded, []byte("url-secret")) || !bytes.Contains(recorded, []byte("header-secret")) {
+		t.Fatalf("Expected the recorded entries to be left as they were but got: %s", recorded)
+	}
+	for _, query := range []string{"?anonymize=maybe", "?anonymizeHosts=true"} {
+		resp, err := testClient.Get(harUrl + query)
+		if err != nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v but got: %v", query, resp.Status)
+		}
+	}
+}
+
+func TestHarProxyStatsOfDelayedUpstream(t *testing.T) {
+	delayed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "delayed")
+	}))
+	defer delayed.Close()
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(delayed.URL)
+		testResp(t, resp, err)
+		resp.Body.Close()
+	}
+	harProxy.WaitForEntries(context.Background())
+
+	// The recorded times include the wait for the upstream
+	stats, err := harProxy.HarLog.Stats(StatsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Overall.Count != 3 || stats.Overall.P50 < 100 || stats.Overall.P99 < 100 {
+		t.Fatalf("Expected percentiles of at least 100ms but got: %+v", stats.Overall)
+	}
+}
+
+func TestDiffOfRecordedHars(t *testing.T) {
+	var delay int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(atomic.LoadInt64(&delay)))
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+	record := func(latency time.Duration) *HarLog {
+		atomic.StoreInt64(&delay, int64(latency))
+		client, harProxy, s := oneShotProxy()
+		defer s.Close()
+		for _, path := range []string{"/a", "/b"} {
+			resp, err := client.Get(upstream.URL + path)
+			testResp(t, resp, err)
+			resp.Body.Close()
+		}
+		harProxy.WaitForEntries(context.Background())
+		return harProxy.HarLog
+	}
+
+	fast, slow := record(0), record(200 * time.Millisecond)
+	diff := DiffHarLogs(fast, slow, DiffOptions{SlowerByMs : 100})
+	if len(diff.Changed) != 2 || diff.Changed[0].TimeB < 200 || len(diff.Added) != 0 || len(diff.Removed) != 0 {
+		t.Fatalf("Expected both entries to be reported slower but got: %+v", diff)
+	}
+	if diff := DiffHarLogs(slow, fast, DiffOptions{SlowerByMs : 100}); len(diff.Changed) != 0 {
+		t.Fatalf("Expected no entry to be reported slower but got: %+v", diff)
+	}
+}
+
+func TestHarProxyClock(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := testutil.NewFakeClock(start)
+	// The upstream takes 250ms to answer
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Clock : clock, Transport : delayedTransport{clock, 250 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	harProxy.WaitForEntries(context.Background())
+	entries := harProxy.HarLog.Entries()
+	if len(entries) != 1 || !entries[0].StartedDateTime.Equal(start) || entries[0].Time != 250 {
+		t.Fatal("Expected the entry to be timed by the clock but got: ", entries)
+	}
+	if clone, _ := harProxy.Clone(); clone.clock != clock {
+		t.Fatal("Expected clones to share the clock")
+	}
+}
+
+func TestHarProxyCloseDeadline(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Now())
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Clock : clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtering := make(chan struct{})
+	release := make(chan struct{})
+	harProxy.SetEntryFilter(func(*HarEntry) bool {
+		close(filtering)
+		<-release
+		return true
+	})
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	<-filtering
+
+	// Both the entry being sent and the one being processed are stuck, Close waits for them within one deadline
+	harProxy.sending.add()
+	closed := make(chan error)
+	go func() { closed <- harProxy.Close() }()
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(stopTimeout)
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Fatal("Expected Close to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Close to return at the deadline")
+	}
+	harProxy.sending.done()
+	close(release)
+}
+
+func TestHarProxyConcurrentEntries(t *testing.T) {
+	const requests = 300
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	client.Transport.(*http.Transport).MaxIdleConnsPerHost = 50
+
+	var sending sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		sending.Add(1)
+		go func(i int) {
+			defer sending.Done()
+			resp, err := client.Get(fmt.Sprintf("%v/query?result=%v", srv.URL, i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}(i)
+		// Waiting while requests are still coming in must not return before they are recorded
+		if i % 50 == 0 {
+			go harProxy.WaitForEntries(context.Background())
+		}
+	}
+	sending.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+	if err := harProxy.WaitForEntries(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if harProxy.HarLog.Len() != requests || harProxy.pending.len() != 0 || harProxy.PendingEntries() != 0 {
+		t.Fatalf("Expected %v entries and none pending but got: %v, %v", requests, harProxy.HarLog.Len(), harProxy.pending.len())
+	}
+}
+
+func TestHarProxyClearWithInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "slow")
+	}))
+	defer slow.Close()
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := client.Get(slow.URL + "/started-before-clear"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	// Waiting for the entries would wait for the held request too
+	for harProxy.InFlightRequests() < 1 || harProxy.HarLog.Len() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	harProxy.ClearEntries()
+	close(release)
+	<-done
+
+	// The request finished after the clear, its entry belongs to the new generation
+	harProxy.WaitForEntries(context.Background())
+	entries := harProxy.HarLog.Entries()
+	if harProxy.HarLog.Generation() != 1 || len(entries) != 1 || entries[0].Request.Url != slow.URL + "/started-before-clear" {
+		t.Fatal("Expected only the request finishing after the clear in generation 1 but got: ", harProxy.HarLog.Generation(), entries)
+	}
+}
+
+func TestHarProxyRepeatedClearsUnderTraffic(t *testing.T) {
+	const clients, requests = 8, 40
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+
+	var sending sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		sending.Add(1)
+		go func(i int) {
+			defer sending.Done()
+			for j := 0; j < requests; j++ {
+				resp, err := client.Get(fmt.Sprintf("%v/query?result=%v-%v", srv.URL, i, j))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+		}(i)
+	}
+	recorded := make(chan struct{})
+	go func() {
+		sending.Wait()
+		harProxy.WaitForEntries(context.Background())
+		close(recorded)
+	}()
+
+	// Every other drain fails to export and restores its entries, each entry must end up in exactly one generation
+	generations := make(map[string]int64)
+	for i := int64(0); ; i++ {
+		finished := false
+		select {
+		case <-recorded:
+			finished = true
+		default:
+		}
+		if harProxy.HarLog.Generation() != i {
+			t.Fatalf("Expected generation %v but got: %v", i, harProxy.HarLog.Generation())
+		}
+		drained := harProxy.HarLog.drain()
+		if i % 2 == 1 && !finished {
+			harProxy.HarLog.restore(drained)
+		} else {
+			for _, entry := range drained.Entries() {
+				if generation, ok := generations[entry.Request.Url]; ok {
+					t.Fatalf("Entry %v exported in generations %v and %v", entry.Request.Url, generation, drained.generation)
+				}
+				generations[entry.Request.Url] = drained.generation
+			}
+		}
+		if finished {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(generations) != clients * requests || harProxy.HarLog.Len() != 0 {
+		t.Fatalf("Expected %v entries exported but got: %v, %v left", clients * requests, len(generations), harProxy.HarLog.Len())
+	}
+}
+
+func TestHarProxyConcurrentClearAndExport(t *testing.T) {
+	const clients, requests = 8, 40
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+
+	var sending, exporting sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		sending.Add(1)
+		go func(i int) {
+			defer sending.Done()
+			for j := 0; j < requests; j++ {
+				resp, err := client.Get(fmt.Sprintf("%v/query?result=%v-%v", srv.URL, i, j))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+		}(i)
+	}
+	// Entries drained while requests are recorded must each be drained once, none lost
+	drained := make(chan int)
+	stop := make(chan struct{})
+	exporting.Add(1)
+	go func() {
+		defer exporting.Done()
+		count := 0
+		defer func() { drained <- count }()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			harLog := harProxy.HarLog.drain()
+			count += harLog.Len()
+			harLog.WriteTo(ioutil.Discard)
+			if i % 10 == 0 {
+				harProxy.HarLog.AddPage(HarPage{Id : fmt.Sprintf("page_%v", i)})
+			}
+			harProxy.HarLog.WriteJSONL(ioutil.Discard)
+			harProxy.HarLog.WriteCSV(ioutil.Discard, nil)
+			json.Marshal(harProxy.HarLog)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	sending.Wait()
+	harProxy.WaitForEntries(context.Background())
+	close(stop)
+	count := <-drained
+	exporting.Wait()
+	if total := count + harProxy.HarLog.Len(); total != clients * requests {
+		t.Fatalf("Expected %v entries drained or left but got: %v", clients * requests, total)
+	}
+
+	// Entries recorded while clearing end up in the cleared log
+	clearing := make(chan struct{})
+	go func() {
+		defer close(clearing)
+		for i := 0; i < 20; i++ {
+			harProxy.ClearEntries()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for j := 0; j < requests; j++ {
+		resp, err := client.Get(srv.URL + "/bobo")
+		testResp(t, resp, err)
+		resp.Body.Close()
+	}
+	<-clearing
+	harProxy.WaitForEntries(context.Background())
+	harProxy.ClearEntries()
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	harProxy.WaitForEntries(context.Background())
+	if harProxy.HarLog.Len() != 1 {
+		t.Fatal("Expected only the entry recorded after the last clear but got: ", harProxy.HarLog.Len())
+	}
+}
+
+func TestHarProxyFailedRoundTrip(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	refused := "http://" + listener.Addr().String() + "/refused"
+	listener.Close()
+	untrusted := httptest.NewTLSServer(ConstantHanlder("secret"))
+	defer untrusted.Close()
+	untrustedUrl, _ := url.Parse(untrusted.URL)
+
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	harProxy.SetCaptureSettings(CaptureSettings{CaptureContent : true})
+	harProxy.AddHostEntries([]ProxyHosts{{Host : "untrusted.invalid", NewHost : untrustedUrl.Host, NewScheme : "https"}})
+
+	for _, requestUrl := range []string{refused, "http://untrusted.invalid/secret"} {
+		resp, err := client.Get(requestUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway || len(body) == 0 {
+			t.Fatalf("Expected a 502 with the error for %v but got: %v %s", requestUrl, resp.Status, body)
+		}
+	}
+	harProxy.WaitForEntries(context.Background())
+	entries := harProxy.HarLog.Entries()
+	if len(entries) != 2 {
+		t.Fatal("Expected an entry per failed request but got: ", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Response != nil || entry.Error == "" {
+			t.Fatalf("Expected a failed entry without response but got: %+v", entry)
+		}
+	}
+	if !strings.Contains(entries[0].Error, "refused") || entries[1].Request.RewrittenTo != "https://" + untrustedUrl.Host + "/secret" {
+		t.Fatalf("Expected the errors of the round trips but got: %v, %v", entries[0].Error, entries[1].Error)
+	}
+}
+
+func TestHarProxyBodilessResponses(t *testing.T) {
+	modified := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/head":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", "100")
+		case "/conditional":
+			http.ServeContent(w, r, "bobo.txt", modified, strings.NewReader("bobo"))
+		}
+	}))
+	defer upstream.Close()
+	// Answers 204 with body bytes it shouldn't send
+	noContent, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer noContent.Close()
+	go func() {
+		for {
+			conn, err := noContent.Accept()
+			if err != nil {
+				return
+			}
+			http.ReadRequest(bufio.NewReader(conn))
+			io.WriteString(conn, "HTTP/1.1 204 No Content\r\nContent-Type: text/plain\r\nContent-Length: 4\r\nConnection: close\r\n\r\nbobo")
+			conn.Close()
+		}
+	}()
+
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	harProxy.SetCaptureSettings(CaptureSettings{CaptureContent : true})
+	client.Timeout = 5 * time.Second
+
+	resp, err := client.Head(upstream.URL + "/head")
+	testResp(t, resp, err)
+	req, _ := http.NewRequest("GET", upstream.URL + "/conditional", nil)
+	req.Header.Set("If-Modified-Since", modified.Format(http.TimeFormat))
+	if resp, err = client.Do(req); err != nil || resp.StatusCode != http.StatusNotModified {
+		t.Fatal("Expected 304 but got: ", resp, err)
+	}
+	resp.Body.Close()
+	if resp, err = client.Get("http://" + noContent.Addr().String() + "/"); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatal("Expected 204 but got: ", resp, err)
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := harProxy.WaitForEntries(ctx); err != nil {
+		t.Fatal(err)
+	}
+	entries := harProxy.HarLog.Entries()
+	if len(entries) != 3 {
+		t.Fatal("Expected an entry per request but got: ", len(entries))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Sequence < entries[j].Sequence })
+	for i, status := range []int{http.StatusOK, http.StatusNotModified, http.StatusNoContent} {
+		response := entries[i].Response
+		if response.Status != status || response.BodySize != 0 || response.Content != nil {
+			t.Fatalf("Expected a %v response without body but got: %v %v %+v", status, response.Status, response.BodySize, response.Content)
+		}
+	}
+	// The advertised length is still part of the headers
+	headers := entries[0].Response.Headers
+	contentLength := ""
+	for _, header := range headers {
+		if header.Name == "Content-Length" {
+			contentLength = header.Value
+		}
+	}
+	if contentLength != "100" || entries[0].Response.HeadersSize < int64(len("Content-Length") + 2 + len("100")) {
+		t.Fatalf("Expected the HEAD response to keep its Content-Length header but got: %v %v", headers, entries[0].Response.HeadersSize)
+	}
+}
+
+func TestHarProxyClientAbort(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	const total = 64 << 20
+	stopped := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(stopped)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(total))
+		chunk := make([]byte, 32 << 10)
+		for written := 0; written < total; written += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}))
+	// Reads of the net/http transport stop with the client's context
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{DialContext : (&net.Dialer{}).DialContext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(harProxy.Proxy)
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET %v/download HTTP/1.1\r\nHost: %v\r\n\r\n", upstream.URL, upstream.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	testResp(t, resp, err)
+	if _, err := io.ReadFull(resp.Body, make([]byte, 256 << 10)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the upstream download to stop once the client went away")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := harProxy.WaitForEntries(ctx); err != nil {
+		t.Fatal(err)
+	}
+	entries := harProxy.HarLog.Entries()
+	if len(entries) != 1 || !entries[0].ClientAborted {
+		t.Fatal("Expected the aborted download to be recorded but got: ", entries)
+	}
+	if bodySize := entries[0].Response.BodySize; bodySize < 256 << 10 || bodySize >= total {
+		t.Fatal("Expected the bytes sent before the client went away but got: ", bodySize)
+	}
+
+	s.Close()
+	upstream.Close()
+	harProxy.closeEntryChannel()
+	<-harProxy.entriesDone
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > goroutines; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no goroutine to be left but got %v instead of %v", runtime.NumGoroutine(), goroutines)
+		}
+	}
+}
+
+func TestHarProxyPanickingTransport(t *testing.T) {
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Transport : panickingTransport{}, Logger : NopLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	harProxy.Proxy.Logger = log.New(ioutil.Discard, "", 0)
+	client, s := newProxyHttpTestServer(harProxy)
+	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	defer s.Close()
+	if resp, err := client.Get(srv.URL + "/bobo"); err == nil {
+		resp.Body.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := harProxy.WaitForEntries(ctx); err != nil {
+		t.Fatal("Expected the request of the panicking round trip not to stay pending but got: ", err)
+	}
+	if harProxy.InFlightRequests() != 0 {
+		t.Fatal("Expected the request of the panicking round trip not to stay in flight but got: ", harProxy.InFlightRequests())
+	}
+}
+
+type panickingTransport struct{}
+
+func (panickingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	panic("transport failure")
+}
+
+func TestHarProxyServerConcurrentCreateDelete(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	request := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, harProxyServer.URL + path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		defer resp.Body.Close()
+		if method == "POST" && resp.StatusCode == http.StatusOK {
+			proxyServerPort := ProxyServerPort{}
+			json.NewDecoder(resp.Body).Decode(&proxyServerPort)
+			return proxyServerPort.Port
+		}
+		return resp.StatusCode
+	}
+
+	var wg sync.WaitGroup
+	var deleted int64
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := ""
+			if i % 2 == 0 {
+				body = fmt.Sprintf(`{"name" : "proxy-%v"}`, i)
+			}
+			port := request("POST", "/proxy", body)
+			if port <= 0 {
+				t.Error("Expected the proxy to be created")
+				return
+			}
+			request("GET", "/proxy", "")
+			request("PUT", fmt.Sprintf("/proxy/%v/har", port), "")
+			// Deleting twice at once succeeds, unless the second request finds no proxy anymore
+			statuses := make(chan int, 2)
+			for j := 0; j < 2; j++ {
+				go func() { statuses <- request("DELETE", fmt.Sprintf("/proxy/%v", port), "") }()
+			}
+			first, second := <-statuses, <-statuses
+			if first + second != 2 * http.StatusOK && first + second != http.StatusOK + http.StatusNotFound {
+				t.Errorf("Expected the deletes to succeed or find no proxy but got: %v, %v", first, second)
+			}
+			atomic.AddInt64(&deleted, 1)
+		}(i)
+	}
+	// Only one of the proxies created at once with the same name is kept
+	statuses := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		go func() { statuses <- request("POST", "/proxy", `{"name" : "shared"}`) }()
+	}
+	created := 0
+	for i := 0; i < 5; i++ {
+		if status := <-statuses; status != http.StatusConflict {
+			created++
+		}
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Fatal("Expected one proxy named shared but got: ", created)
+	}
+	deleteProxyPath(t, harProxyServer, testClient, "/name/shared")
+
+	resp, err := testClient.Get(harProxyServer.URL + "/proxy")
+	testResp(t, resp, err)
+	var proxyServerPorts []ProxyServerPort
+	json.NewDecoder(resp.Body).Decode(&proxyServerPorts)
+	if len(proxyServerPorts) != 0 || deleted != 30 {
+		t.Fatal("Expected every proxy to be deleted but got: ", proxyServerPorts)
+	}
+}
+
+func TestHarProxyServerParallelDeletes(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	deleteMessages := func(port int) map[string]int {
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		messages := make(map[string]int)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest("DELETE", fmt.Sprintf("%v/proxy/%v", harProxyServer.URL, port), nil)
+				resp, err := testClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := ioutil.ReadAll(resp.Body)
+				lock.Lock()
+				messages[fmt.Sprintf("%v %s", resp.StatusCode, bytes.TrimSpace(body))]++
+				lock.Unlock()
+			}()
+		}
+		wg.Wait()
+		return messages
+	}
+
+	deleted := fmt.Sprintf(`200 {"message":"Deleted proxy for port [%v] succesfully"}`, proxyServerPort.Port)
+	alreadyDeleted := fmt.Sprintf(`200 {"message":"Proxy for port [%v] was already deleted"}`, proxyServerPort.Port)
+	notFound := fmt.Sprintf(`404 {"error":"No proxy for port [%v]"}`, proxyServerPort.Port)
+	messages := deleteMessages(proxyServerPort.Port)
+	if messages[deleted] != 1 || messages[deleted] + messages[alreadyDeleted] + messages[notFound] != 10 {
+		t.Fatal("Expected one delete to stop the proxy and the others to find it deleted but got: ", messages)
+	}
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	unknownPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	expected := map[string]int{fmt.Sprintf(`404 {"error":"No proxy for port [%v]"}`, unknownPort) : 10}
+	if messages := deleteMessages(unknownPort); !reflect.DeepEqual(messages, expected) {
+		t.Fatal("Expected every delete of an unknown port to find no proxy but got: ", messages)
+	}
+}
+
+func TestHarProxyServerDeleteDeletedProxy(t *testing.T) {
+	proxyServer, _ := NewProxyServerWithOptions(ProxyServerOptions{})
+	harProxy := NewHarProxy()
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxyServer.proxies.put(harProxy, "")
+	for _, expected := range []string{"Deleted proxy for port [%v] succesfully", "Proxy for port [%v] was already deleted"} {
+		recorder := httptest.NewRecorder()
+		proxyServer.deleteHarProxy(harProxy, recorder)
+		message := ProxyServerMessage{}
+		json.NewDecoder(recorder.Body).Decode(&message)
+		if recorder.Code != http.StatusOK || message.Message != fmt.Sprintf(expected, harProxy.Port) {
+			t.Fatalf("Expected %q but got: %v %v", expected, recorder.Code, message.Message)
+		}
+	}
+}
+
+func TestHarProxyServerPendingEntries(t *testing.T) {
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stuck.Close()
+	clock := testutil.NewFakeClock(time.Now())
+
+	testClient, harProxyServer := newProxyTestServerWithOptions(ProxyServerOptions{Clock : clock})
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	resp, err := proxiedClient.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := proxiedClient.Get(stuck.URL); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	defer func() {
+		close(release)
+		<-done
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port), nil)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		resp, err = testClient.Do(req)
+	}()
+	// Let the wait for the stuck entry time out once it started
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(WaitEntriesTimeout)
+	<-served
+	testResp(t, resp, err)
+	if resp.Header.Get("X-Pending-Entries") != "1" {
+		t.Fatal("Expected one pending entry to be reported but got: ", resp.Header.Get("X-Pending-Entries"))
+	}
+	if harLog := testLog(t, resp.Body); harLog.Len() != 1 {
+		t.Fatal("Expected the recorded entry to be served but got: ", harLog.Len())
+	}
+}
+
+func TestHarProxyEntryOverflowDrop(t *testing.T) {
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Transport : stubTransport{}, EntryBuffer : 1, EntryOverflow : OverflowDrop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without processing nothing takes entries off the queue, the second one doesn't fit
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", fmt.Sprintf("http://127.0.0.1/%v", i), nil)
+		resp, _ := stubTransport{}.RoundTrip(req)
+		harProxy.pending.add()
+		harProxy.sendEntry(reqAndResp{req : req, resp : resp, clientUrl : req.URL.String(), serverIpAddress : "127.0.0.1"})
+	}
+	if harProxy.DroppedEntries() != 1 || harProxy.PendingEntries() != 1 {
+		t.Fatalf("Expected one dropped and one pending entry but got: %v %v", harProxy.DroppedEntries(), harProxy.PendingEntries())
+	}
+	if clone, _ := harProxy.Clone(); clone.entryBuffer != 1 || clone.entryOverflow() != OverflowDrop {
+		t.Fatal("Expected the clone to keep the entry queue settings but got: ", clone.entryBuffer, clone.entryOverflow())
+	}
+
+	harProxy.startProcessing()
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := harProxy.WaitForEntries(ctx); err != nil {
+		t.Fatal("Expected the dropped entry not to be waited for but got: ", err)
+	}
+	if entries := harProxy.HarLog.Entries(); len(entries) != 1 || entries[0].Request.Url != "http://127.0.0.1/0" {
+		t.Fatal("Expected only the queued entry to be recorded but got: ", entries)
+	}
+}
+
+func TestHarProxyBufferedEntriesBlock(t *testing.T) {
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Transport : stubTransport{}, EntryBuffer : 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	for i := 0; i < 20; i++ {
+		resp, err := client.Get(fmt.Sprintf("http://127.0.0.1/%v", i))
+		testResp(t, resp, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := harProxy.WaitForEntries(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if harProxy.HarLog.Len() != 20 || harProxy.DroppedEntries() != 0 {
+		t.Fatalf("Expected every entry to be recorded but got: %v, %v dropped", harProxy.HarLog.Len(), harProxy.DroppedEntries())
+	}
+}
+
+func TestHarProxyEntryWorkers(t *testing.T) {
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Transport : stubTransport{}, EntryBuffer : 4, EntryWorkers : 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var filtering int32
+	release := make(chan struct{})
+	harProxy.SetEntryFilter(func(entry *HarEntry) bool {
+		atomic.AddInt32(&filtering, 1)
+		<-release
+		return true
+	})
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	// The buffer takes the entries which find both workers busy
+	for i := 1; i <= 4; i++ {
+		resp, err := client.Get(fmt.Sprintf("http://127.0.0.1/%v", i))
+		testResp(t, resp, err)
+	}
+	for atomic.LoadInt32(&filtering) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if filtering := atomic.LoadInt32(&filtering); filtering != 2 {
+		t.Fatal("Expected only the 2 workers to record entries but got: ", filtering)
+	}
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := harProxy.WaitForEntries(ctx); err != nil {
+		t.Fatal(err)
+	}
+	entries := harProxy.HarLog.Entries()
+	if len(entries) != 4 {
+		t.Fatal("Expected 4 entries but got: ", len(entries))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Sequence < entries[j].Sequence })
+	for i, entry := range entries {
+		if entry.Sequence != int64(i + 1) || entry.Request.Url != fmt.Sprintf("http://127.0.0.1/%v", i + 1) {
+			t.Fatalf("Expected entry %v to be numbered in request order but got: %v %v", i + 1, entry.Sequence, entry.Request.Url)
+		}
+	}
+}
+
+func TestHarProxyServerStatus(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	body, _ := json.Marshal(&ProxyServerCreate{EntryOverflow : "spill"})
+	resp, err := testClient.Post(harProxyServer.URL + "/proxy", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected an invalid overflow policy to be rejected but got: ", resp.StatusCode)
+	}
+
+	body, _ = json.Marshal(&ProxyServerCreate{Name : "queued", EntryBuffer : 8, EntryOverflow : OverflowDrop, CaptureBudget : 1 << 20, CaptureBudgetPolicy : BudgetEvict})
+	resp, err = testClient.Post(harProxyServer.URL + "/proxy", "application/json", bytes.NewBuffer(body))
+	testResp(t, resp, err)
+	proxyServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(proxyServerPort)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	proxiedClient := newPortHttpTestClient(harProxyServer, proxyServerPort.Port)
+	resp, err = proxiedClient.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+
+	resp, err = testClient.Get(harProxyServer.URL + "/proxy/name/queued/status")
+	testResp(t, resp, err)
+	status := ProxyServerStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Port != proxyServerPort.Port || status.Name != "queued" || status.EntryBuffer != 8 || status.EntryOverflow != OverflowDrop {
+		t.Fatal("Expected the proxy's entry queue settings but got: ", status)
+	}
+	if status.CaptureBudget != 1 << 20 || status.CaptureBudgetPolicy != BudgetEvict || status.CaptureBytes != int64(len("bobo") * status.Entries) {
+		t.Fatal("Expected the proxy's capture budget holding the recorded body but got: ", status)
+	}
+	// The entry may still be on its way to the log
+	if status.Entries + status.PendingEntries != 1 || status.InFlightRequests != 0 || status.DroppedEntries != 0 {
+		t.Fatal("Expected one entry and nothing dropped but got: ", status)
+	}
+}
+
+func TestHarProxyServerUpstreamPool(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	body, _ := json.Marshal(&ProxyServerCreate{UpstreamPool : &UpstreamPool{MaxConnsPerHost : -1}})
+	resp, err := testClient.Post(harProxyServer.URL + "/proxy", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected an invalid upstream pool to be rejected but got: ", resp.StatusCode)
+	}
+
+	body, _ = json.Marshal(&ProxyServerCreate{UpstreamPool : &UpstreamPool{MaxIdleConnsPerHost : 64, IdleConnTimeoutMs : 1000}})
+	resp, err = testClient.Post(harProxyServer.URL + "/proxy", "application/json", bytes.NewBuffer(body))
+	testResp(t, resp, err)
+	proxyServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(proxyServerPort)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	resp, err = newPortHttpTestClient(harProxyServer, proxyServerPort.Port).Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("%v/proxy/%v/connections", harProxyServer.URL, proxyServerPort.Port), nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+}
+
+func TestHarProxyServerSelfTest(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	// The pool's http.Transport serves the concurrent requests, the default transport isn't race free with them
+	body, _ := json.Marshal(&ProxyServerCreate{UpstreamPool : &UpstreamPool{MaxIdleConnsPerHost : 4}})
+	resp, err := testClient.Post(harProxyServer.URL + "/proxy", "application/json", bytes.NewBuffer(body))
+	testResp(t, resp, err)
+	proxyServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(proxyServerPort)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	resp, err = newPortHttpTestClient(harProxyServer, proxyServerPort.Port).Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+
+	selfTestUrl := fmt.Sprintf("%v/proxy/%v/selftest", harProxyServer.URL, proxyServerPort.Port)
+	resp, err = testClient.Post(selfTestUrl, "application/json", strings.NewReader(`{ "requests" : -1 }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected a negative number of requests to be rejected but got: ", resp.StatusCode)
+	}
+
+	resp, err = testClient.Post(selfTestUrl, "application/json", strings.NewReader(`{ "requests" : 40, "concurrency" : 4, "bodySize" : 2048 }`))
+	testResp(t, resp, err)
+	var report SelfTestReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests != 40 || report.Concurrency != 4 || report.Errors != 0 || report.RequestsPerSecond <= 0 {
+		t.Fatalf("Expected 40 successful requests, 4 at once, but got: %+v", report)
+	}
+	latency := report.Latency
+	if latency.P50 <= 0 || latency.P50 > latency.P90 || latency.P90 > latency.P99 || latency.P99 > latency.Max {
+		t.Fatalf("Expected ordered latency percentiles but got: %+v", latency)
+	}
+	if report.Recorded.Count != 40 || report.Recorded.Errors != 0 || report.Recorded.Bytes != 40 * 2048 {
+		t.Fatalf("Expected the clone to record the 40 echoed bodies but got: %+v", report.Recorded)
+	}
+
+	resp, err = testClient.Get(fmt.Sprintf("%v/proxy/%v/status", harProxyServer.URL, proxyServerPort.Port))
+	testResp(t, resp, err)
+	var status ProxyServerStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	if status.Entries != 1 {
+		t.Fatal("Expected the self test to leave the proxy's log alone but got entries: ", status.Entries)
+	}
+}
+
+func TestHarProxyServerGzip(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	for i := 0; i < 50; i++ {
+		resp, err := proxiedClient.Get(fmt.Sprintf("%v/bobo?request=%v", srv.URL, i))
+		testResp(t, resp, err)
+	}
+
+	// Returns the Content-Encoding and the body, gunzipped if it was compressed
+	get := func(path string, acceptEncoding string) (string, string) {
+		req, _ := http.NewRequest("GET", harProxyServer.URL + path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := testClient.Do(req)
+		testResp(t, resp, err)
+		defer resp.Body.Close()
+		var body io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			gunzipped, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gunzipped
+		}
+		read, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Header.Get("Content-Encoding"), string(read)
+	}
+	curlPath := fmt.Sprintf("/proxy/%v/har/curl", proxyServerPort.Port)
+	_, plain := get(curlPath, "identity")
+	for _, acceptEncoding := range []string{"gzip", "deflate, gzip;q=0.5", "*"} {
+		if encoding, body := get(curlPath, acceptEncoding); encoding != "gzip" || body != plain {
+			t.Fatalf("Expected the gzipped commands for %v but got %v: %v", acceptEncoding, encoding, body)
+		}
+	}
+	if encoding, _ := get(curlPath, "gzip;q=0"); encoding != "" {
+		t.Fatal("Expected no compression when gzip is refused but got: ", encoding)
+	}
+	if encoding, body := get("/proxy", "gzip"); encoding != "" || !strings.Contains(body, strconv.Itoa(proxyServerPort.Port)) {
+		t.Fatal("Expected the short proxy listing uncompressed but got: ", encoding, body)
+	}
+
+	events := gzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(strings.Repeat("data: event\n\n", 200)))
+	}))
+	recorder := httptest.NewRecorder()
+	events.ServeHTTP(recorder, httptest.NewRequest("GET", "/events", nil))
+	req := httptest.NewRequest("GET", "/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	gzipRecorder := httptest.NewRecorder()
+	events.ServeHTTP(gzipRecorder, req)
+	if gzipRecorder.Header().Get("Content-Encoding") != "" || gzipRecorder.Body.String() != recorder.Body.String() {
+		t.Fatal("Expected event streams to be left uncompressed")
+	}
+}
+
+func TestHarProxyExport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "export")
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Export : &ExportOptions{Dir : dir, MaxEntries : 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(fmt.Sprintf("%v/query?result=%v", srv.URL, i))
+		testResp(t, resp, err)
+		harProxy.WaitForEntries(context.Background())
+		harProxy.ClearEntries()
+	}
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("har-%v-*.har", harProxy.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if len(files) != 3 {
+		t.Fatal("Expected 3 export files but got: ", files)
+	}
+	results := make([]string, 0, 5)
+	for i, expectedEntries := range []int{2, 2, 1} {
+		data, err := ioutil.ReadFile(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		harLog := new(HarLog)
+		if err := json.Unmarshal(data, harLog); err != nil {
+			t.Fatalf("Expected %v to be a valid HAR log but got: %v\n%s", files[i], err, data)
+		}
+		if harLog.Len() != expectedEntries || harLog.Version != "1.2" {
+			t.Fatalf("Expected %v entries in %v but got: %v", expectedEntries, files[i], harLog.Len())
+		}
+		for _, entry := range harLog.Entries() {
+			results = append(results, entry.Request.QueryString[0].Value)
+		}
+	}
+	if !reflect.DeepEqual(results, []string{"0", "1", "2", "3", "4"}) {
+		t.Fatal("Expected every request exported once in order but got: ", results)
+	}
+}
+
+func TestHarProxyExportClock(t *testing.T) {
+	dir := t.TempDir()
+	clock := testutil.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Clock : clock, Export : &ExportOptions{Dir : dir, MaxEntries : 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL + "/bobo")
+		testResp(t, resp, err)
+		harProxy.WaitForEntries(context.Background())
+		clock.Advance(1500 * time.Millisecond)
+	}
+	if err := harProxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files are named by the proxy's clock when they are created
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	sort.Strings(files)
+	expected := []string{"har-0-20260101T000000.000000000-1.har", "har-0-20260101T000001.500000000-2.har"}
+	if len(files) != 2 || filepath.Base(files[0]) != expected[0] || filepath.Base(files[1]) != expected[1] {
+		t.Fatal("Expected the export files to be named by the clock but got: ", files)
+	}
+}
+
+// A collector recording the batches it is posted, failing the first failures posts with 500
+type testCollector struct {
+	lock sync.Mutex
+	failures int
+	batches []*http.Request
+	bodies [][]byte
+}
+
+func (collector *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	if collector.failures > 0 {
+		collector.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	collector.batches = append(collector.batches, r)
+	collector.bodies = append(collector.bodies, body)
+}
+
+func (collector *testCollector) received() ([]*http.Request, [][]byte) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	return append([]*http.Request{}, collector.batches...), append([][]byte{}, collector.bodies...)
+}
+
+func TestHarProxySink(t *testing.T) {
+	collector := &testCollector{failures : 1}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions {
+		Logger 	: NopLogger,
+		Sink 	: &SinkOptions {
+			Url 			: collectorServer.URL,
+			Headers 		: map[string]string{"Authorization" : "Bearer token"},
+			BatchSize 		: 2,
+			FlushIntervalMs : 60000,
+			RetryBackoffMs 	: 10,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(fmt.Sprintf("%v/query?result=%v", srv.URL, i))
+		testResp(t, resp, err)
+		resp.Body.Close()
+	}
+	harProxy.WaitForEntries(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for batches, _ := collector.received(); len(batches) < 2 && time.Now().Before(deadline); batches, _ = collector.received() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if batches, _ := collector.received(); len(batches) != 2 {
+		t.Fatal("Expected two full batches, the first one retried, but got: ", len(batches))
+	}
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	batches, bodies := collector.received()
+	if len(batches) != 3 {
+		t.Fatal("Expected the last entry to be posted on Stop but got batches: ", len(batches))
+	}
+	results := []string{}
+	for i, body := range bodies {
+		if batches[i].Header.Get("Authorization") != "Bearer token" || batches[i].Header.Get("Content-Type") != "application/json" {
+			t.Fatal("Expected the sink headers but got: ", batches[i].Header)
+		}
+		harLog := new(HarLog)
+		if err := json.Unmarshal(body, harLog); err != nil {
+			t.Fatalf("Expected a HAR log but got: %v\n%s", err, body)
+		}
+		for _, entry := range harLog.Entries() {
+			results = append(results, entry.Request.QueryString[0].Value)
+		}
+	}
+	sort.Strings(results)
+	if !reflect.DeepEqual(results, []string{"0", "1", "2", "3", "4"}) {
+		t.Fatal("Expected every entry posted once but got: ", results)
+	}
+	if sent, failures, dropped := harProxy.SinkStats(); sent != 5 || failures != 1 || dropped != 0 {
+		t.Fatalf("Expected 5 entries sent after 1 failure but got %v sent, %v failures, %v dropped", sent, failures, dropped)
+	}
+}
+
+func TestHarProxySinkGivesUp(t *testing.T) {
+	collector := &testCollector{failures : 100}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+	harProxy, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger})
+	harProxy.SetSink(&SinkOptions{Url : collectorServer.URL, Format : SinkFormatJsonl, BatchSize : 1, MaxRetries : 2, RetryBackoffMs : 1})
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "bobo" {
+		t.Fatalf("Expected the failing sink not to affect the response but got: %s", body)
+	}
+	if err := harProxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sent, failures, dropped := harProxy.SinkStats(); sent != 0 || failures != 3 || dropped != 1 {
+		t.Fatalf("Expected the entry dropped after 2 retries but got %v sent, %v failures, %v dropped", sent, failures, dropped)
+	}
+	if err := harProxy.SetSink(&SinkOptions{Url : "ftp://collector"}); err == nil {
+		t.Fatal("Expected an error for a sink url which isn't http")
+	}
+}
+
+func TestHarProxyServerSink(t *testing.T) {
+	collector := &testCollector{}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	sinkUrl := fmt.Sprintf("%v/proxy/%v/sink", harProxyServer.URL, proxyServerPort.Port)
+
+	req, _ := http.NewRequest("PUT", sinkUrl, strings.NewReader(`{"url" : "` + collectorServer.URL + `", "format" : "jsonl", "batchSize" : 1}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = testClient.Get(sinkUrl)
+	testResp(t, resp, err)
+	sink := SinkOptions{}
+	json.NewDecoder(resp.Body).Decode(&sink)
+	if sink.Url != collectorServer.URL || sink.Format != SinkFormatJsonl || sink.BatchSize != 1 || sink.MaxRetries != 3 {
+		t.Fatalf("Expected the sink with its defaults but got: %+v", sink)
+	}
+	resp, err = proxiedClient.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+
+	deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	batches, bodies := collector.received()
+	if len(batches) != 1 || batches[0].Header.Get("Content-Type") != "application/x-ndjson" || strings.Count(string(bodies[0]), "\n") != 1 {
+		t.Fatalf("Expected a JSON Lines batch of the entry but got: %s", bodies)
+	}
+
+	resp, err = testClient.Post(harProxyServer.URL + "/proxy", "application/json", strings.NewReader(`{"sink" : {"url" : "nowhere"}}`))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an invalid sink but got: ", resp.Status)
+	}
+}
+
+func TestHarProxyStatsd(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger, Statsd : &StatsdOptions{Address : listener.LocalAddr().String(), Prefix : "test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	resp, err := client.Post(srv.URL + "/bobo", "text/plain", strings.NewReader("hello"))
+	testResp(t, resp, err)
+	resp.Body.Close()
+	harProxy.WaitForEntries(context.Background())
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	datagram := make([]byte, 1024)
+	n, _, err := listener.ReadFrom(datagram)
+	if err != nil {
+		t.Fatal("Expected the metrics of the entry: ", err)
+	}
+	bucket := strings.NewReplacer(".", "_", ":", "_").Replace(strings.TrimPrefix(srv.URL, "http://")) + ".2xx"
+	expected := fmt.Sprintf("test.request.time.%v:%v|ms\ntest.request.count.%v:1|c\ntest.request.bytes_sent.%v:5|c\ntest.request.bytes_received.%v:4|c",
+		bucket, harProxy.HarLog.Entries()[0].Time, bucket, bucket, bucket)
+	if string(datagram[:n]) != expected {
+		t.Fatalf("Expected metrics\n%v\nbut got\n%s", expected, datagram[:n])
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sent, _ := harProxy.StatsdStats(); sent == 0 && time.Now().Before(deadline); sent, _ = harProxy.StatsdStats() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sent, dropped := harProxy.StatsdStats(); sent != 1 || dropped != 0 {
+		t.Fatalf("Expected one datagram sent but got %v sent, %v dropped", sent, dropped)
+	}
+
+	statsd, _ := newStatsdClient(StatsdOptions{Address : listener.LocalAddr().String(), SampleRate : 0.25, Tags : true}, NopLogger, &statsdCounters{})
+	defer statsd.close()
+	failed := HarEntry{Request : &HarRequest{Method : "GET", Url : "http://example.com:8080/a"}, Time : 12}
+	if metrics := string(statsd.format(&failed)); metrics != "goharproxy.request.time:12|ms|@0.25|#host:example.com:8080,status:error\n" +
+			"goharproxy.request.count:1|c|@0.25|#host:example.com:8080,status:error\n" +
+			"goharproxy.request.errors:1|c|@0.25|#host:example.com:8080,status:error\n" +
+			"goharproxy.request.bytes_sent:0|c|@0.25|#host:example.com:8080,status:error\n" +
+			"goharproxy.request.bytes_received:0|c|@0.25|#host:example.com:8080,status:error" {
+		t.Fatal("Expected sampled and tagged metrics with an error but got: ", metrics)
+	}
+	for _, invalid := range []StatsdOptions{{}, {Address : "localhost"}, {Address : "localhost:8125", SampleRate : 2}, {Address : "localhost:8125", Prefix : "a:b"}} {
+		if err := harProxy.SetStatsd(&invalid); err == nil {
+			t.Fatalf("Expected an error for %+v", invalid)
+		}
+	}
+}
+
+func TestHarProxyServerStatsd(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	statsdUrl := fmt.Sprintf("%v/proxy/%v/statsd", harProxyServer.URL, proxyServerPort.Port)
+
+	req, _ := http.NewRequest("PUT", statsdUrl, strings.NewReader(`{"address" : "127.0.0.1:8125", "tags" : true}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = testClient.Get(statsdUrl)
+	testResp(t, resp, err)
+	statsd := StatsdOptions{}
+	json.NewDecoder(resp.Body).Decode(&statsd)
+	if statsd.Address != "127.0.0.1:8125" || statsd.Prefix != "goharproxy" || statsd.SampleRate != 1 || !statsd.Tags {
+		t.Fatalf("Expected the statsd options with their defaults but got: %+v", statsd)
+	}
+
+	req, _ = http.NewRequest("PUT", statsdUrl, strings.NewReader(`{"address" : "127.0.0.1:8125", "sampleRate" : -1}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = testClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an invalid sample rate but got: ", resp.Status)
+	}
+	deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v/statsd", proxyServerPort.Port))
+	resp, err = testClient.Get(statsdUrl)
+	testResp(t, resp, err)
+	statsd = StatsdOptions{}
+	json.NewDecoder(resp.Body).Decode(&statsd)
+	if statsd.Address != "" {
+		t.Fatalf("Expected no statsd once removed but got: %+v", statsd)
+	}
+}
+
+// The fields of an exported span the tests look at
+type testSpan struct {
+	TraceId 		string
+	SpanId 			string
+	ParentSpanId 	string
+	Name 			string
+	Kind 			int
+	Attributes 		[]otlpAttribute
+	Events 			[]otlpEvent
+	Status 			otlpStatus
+}
+
+func (span testSpan) attribute(key string) string {
+	for _, attribute := range span.Attributes {
+		if attribute.Key != key {
+			continue
+		}
+		if attribute.Value.StringValue != nil {
+			return *attribute.Value.StringValue
+		}
+		return *attribute.Value.IntValue
+	}
+	return ""
+}
+
+func TestHarProxyTracing(t *testing.T) {
+	collector := &testCollector{}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions {
+		Logger 	: NopLogger,
+		Tracing : &TracingOptions{Endpoint : collectorServer.URL + "/v1/traces", Headers : map[string]string{"Api-Key" : "key"}, ServiceName : "checkout"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+	req, _ := http.NewRequest("GET", srv.URL + "/bobo?a=1", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := client.Do(req)
+	testResp(t, resp, err)
+	resp.Body.Close()
+	resp, err = client.Post(srv.URL + "/query?result=hi", "text/plain", strings.NewReader("body"))
+	testResp(t, resp, err)
+	resp.Body.Close()
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	batches, bodies := collector.received()
+	if len(batches) != 1 || batches[0].URL.Path != "/v1/traces" || batches[0].Header.Get("Api-Key") != "key" || batches[0].Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected one OTLP post of the spans but got: %s", bodies)
+	}
+	exported := struct {
+		ResourceSpans []struct {
+			Resource struct{ Attributes []otlpAttribute }
+			ScopeSpans []struct{ Spans []testSpan }
+		}
+	}{}
+	if err := json.Unmarshal(bodies[0], &exported); err != nil || len(exported.ResourceSpans) != 1 || len(exported.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Expected an OTLP export request but got: %s", bodies[0])
+	}
+	if resource := (testSpan{Attributes : exported.ResourceSpans[0].Resource.Attributes}); resource.attribute("service.name") != "checkout" {
+		t.Fatal("Expected the service name as resource attribute but got: ", resource.Attributes)
+	}
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Name < spans[j].Name
+	})
+	host := strings.TrimPrefix(srv.URL, "http://")
+	if len(spans) != 2 || spans[0].Name != "GET " + host + "/bobo" || spans[1].Name != "POST " + host + "/query" {
+		t.Fatalf("Expected a span per entry but got: %+v", spans)
+	}
+	if spans[0].TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || spans[0].ParentSpanId != "00f067aa0ba902b7" || len(spans[0].SpanId) != 16 ||
+			spans[0].attribute("http.response.status_code") != "200" || spans[0].attribute("url.full") != srv.URL + "/bobo?a=1" || spans[0].Kind != otlpSpanKindClient {
+		t.Fatalf("Expected the span to join the incoming trace but got: %+v", spans[0])
+	}
+	if len(spans[1].TraceId) != 32 || spans[1].TraceId == spans[0].TraceId || spans[1].ParentSpanId != "" ||
+			spans[1].attribute("http.request.body.size") != "4" || spans[1].attribute("http.response.body.size") != "2" || spans[1].attribute("network.peer.address") == "" {
+		t.Fatalf("Expected a root span with the sizes but got: %+v", spans[1])
+	}
+	if sent, failures, dropped := harProxy.TracingStats(); sent != 2 || failures != 0 || dropped != 0 {
+		t.Fatalf("Expected 2 spans sent but got %v, %v, %v", sent, failures, dropped)
+	}
+}
+
+func TestOtlpSpanOf(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entry := HarEntry {
+		StartedDateTime : start,
+		Time 			: 100,
+		Request 		: &HarRequest{Method : "GET", Url : "https://example.com/a", Headers : []HarNameValuePair{{Name : "traceparent", Value : "00-00000000000000000000000000000000-00f067aa0ba902b7-01"}}},
+		Timings 		: HarTimings{Blocked : -1, Dns : 5, Connect : 30, Ssl : 20, Send : 1, Wait : 60, Receive : 4},
+		Error 			: "connection reset",
+	}
+	span := otlpSpanOf(&entry)
+	if span.ParentSpanId != "" || span.Status.Code != 2 || span.Status.Message != "connection reset" || span.EndTimeUnixNano != strconv.FormatInt(start.Add(100 * time.Millisecond).UnixNano(), 10) {
+		t.Fatalf("Expected an error root span, the traceparent being invalid, but got: %+v", span)
+	}
+	events := []string{}
+	for _, event := range span.Events {
+		offset, _ := strconv.ParseInt(event.TimeUnixNano, 10, 64)
+		events = append(events, fmt.Sprintf("%v@%v=%v", event.Name, (offset - start.UnixNano()) / 1e6, *event.Attributes[0].Value.IntValue))
+	}
+	if strings.Join(events, " ") != "dns@0=5 connect@5=30 ssl@15=20 send@35=1 wait@36=60 receive@96=4" {
+		t.Fatal("Expected an event per timing but got: ", events)
+	}
+}
+
+func TestHarProxyServerTracing(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	tracingUrl := fmt.Sprintf("%v/proxy/%v/tracing", harProxyServer.URL, proxyServerPort.Port)
+
+	req, _ := http.NewRequest("PUT", tracingUrl, strings.NewReader(`{"endpoint" : "http://localhost:4318/v1/traces"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = testClient.Get(tracingUrl)
+	testResp(t, resp, err)
+	tracing := TracingOptions{}
+	json.NewDecoder(resp.Body).Decode(&tracing)
+	if tracing.Endpoint != "http://localhost:4318/v1/traces" || tracing.ServiceName != "goharproxy" || tracing.BatchSize != 100 {
+		t.Fatalf("Expected the tracing options with their defaults but got: %+v", tracing)
+	}
+
+	req, _ = http.NewRequest("PUT", tracingUrl, strings.NewReader(`{"endpoint" : "localhost:4318"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = testClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for an invalid endpoint but got: ", resp.Status)
+	}
+	deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v/tracing", proxyServerPort.Port))
+	resp, err = testClient.Get(tracingUrl)
+	testResp(t, resp, err)
+	tracing = TracingOptions{}
+	json.NewDecoder(resp.Body).Decode(&tracing)
+	if tracing.Endpoint != "" {
+		t.Fatalf("Expected no tracing once removed but got: %+v", tracing)
+	}
+}
+
+// Records a suite against a backend, then runs it again against the stub of the recorded log once the backend is gone
+func TestHarProxyStub(t *testing.T) {
+	visits := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cart":
+			visits++
+			http.SetCookie(w, &http.Cookie{Name : "session", Value : strconv.Itoa(visits), Expires : time.Now().Add(time.Hour)})
+			fmt.Fprintf(w, "visit %v", visits)
+		case "/echo":
+			body, _ := ioutil.ReadAll(r.Body)
+			fmt.Fprintf(w, "echo %s", body)
+		}
+	}))
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger, CaptureSettings : CaptureSettings{CaptureContent : true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer harProxy.Stop()
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+	get := func(req *http.Request) (*http.Response, string) {
+		t.Helper()
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	suite := func() {
+		t.Helper()
+		for _, expected := range []string{"visit 1", "visit 2"} {
+			req, _ := http.NewRequest("GET", backend.URL + "/cart", nil)
+			if resp, body := get(req); body != expected || resp.StatusCode != http.StatusOK || len(resp.Cookies()) != 1 || resp.Cookies()[0].Value != expected[6:] {
+				t.Fatalf("Expected %q with its cookie but got: %v %q %v", expected, resp.Status, body, resp.Header)
+			}
+		}
+		for _, sent := range []string{"a", "b"} {
+			req, _ := http.NewRequest("POST", backend.URL + "/echo", strings.NewReader(sent))
+			req.Header.Set("Content-Type", "text/plain")
+			if _, body := get(req); body != "echo " + sent {
+				t.Fatalf("Expected the echo of %q but got: %q", sent, body)
+			}
+		}
+	}
+	suite()
+	harProxy.WaitForEntries(context.Background())
+	backend.Close()
+	document, _ := json.Marshal(harProxy.HarLog)
+	recorded, err := ParseHar(bytes.NewReader(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+	harProxy.ClearEntries()
+
+	if err := harProxy.SetStub(&StubOptions{Har : recorded, MatchBody : true}); err != nil {
+		t.Fatal(err)
+	}
+	suite()
+	req, _ := http.NewRequest("GET", backend.URL + "/cart", nil)
+	if _, body := get(req); body != "visit 2" {
+		t.Fatal("Expected the last recorded response to repeat but got: ", body)
+	}
+	req, _ = http.NewRequest("POST", backend.URL + "/echo", strings.NewReader("c"))
+	req.Header.Set("Content-Type", "text/plain")
+	if resp, _ := get(req); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Expected 404 for a body matching no entry but got: ", resp.Status)
+	}
+	harProxy.WaitForEntries(context.Background())
+	stubbed := 0
+	for _, entry := range harProxy.HarLog.Entries() {
+		if entry.Stubbed {
+			stubbed++
+		} else if entry.Response == nil || entry.Response.Status != http.StatusNotFound || entry.Comment != "No recorded response matched" {
+			t.Fatalf("Expected the unmatched entry to be the 404 but got: %+v", entry)
+		}
+	}
+	if served, unmatched := harProxy.StubStats(); stubbed != 5 || served != 5 || unmatched != 1 {
+		t.Fatalf("Expected 5 served entries and an unmatched one but got %v entries, %v served, %v unmatched", stubbed, served, unmatched)
+	}
+
+	// Requests must carry the recorded values of the match headers, none for these entries
+	harProxy.SetStub(&StubOptions{Har : recorded, MatchHeaders : []string{"X-User"}})
+	req, _ = http.NewRequest("GET", backend.URL + "/cart", nil)
+	req.Header.Set("X-User", "bob")
+	if resp, _ := get(req); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Expected 404 for a header matching no entry but got: ", resp.Status)
+	}
+	req.Header.Del("X-User")
+	if _, body := get(req); body != "visit 1" {
+		t.Fatal("Expected the recorded response without the header but got: ", body)
+	}
+
+	harProxy.SetStub(&StubOptions{Har : recorded, Unmatched : StubUnmatchedFail})
+	req, _ = http.NewRequest("GET", srv.URL + "/bobo", nil)
+	if resp, _ := get(req); resp.StatusCode != http.StatusBadGateway {
+		t.Fatal("Expected 502 for an unmatched request failing but got: ", resp.Status)
+	}
+	harProxy.SetStub(&StubOptions{Har : recorded, Unmatched : StubUnmatchedPassThrough})
+	if resp, _ := get(req); resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected an unmatched request to go upstream but got: ", resp.Status)
+	}
+	if stub := harProxy.Stub(); stub == nil || stub.Unmatched != StubUnmatchedPassThrough {
+		t.Fatalf("Expected the stub options but got: %+v", stub)
+	}
+	harProxy.SetStub(nil)
+	req, _ = http.NewRequest("GET", backend.URL + "/cart", nil)
+	if resp, err := client.Do(req); err == nil && resp.StatusCode == http.StatusOK {
+		t.Fatal("Expected the request to go to the closed backend without stub")
+	}
+	if err := harProxy.SetStub(&StubOptions{}); err == nil {
+		t.Fatal("Expected an error for a stub without HAR log")
+	}
+	if err := harProxy.SetStub(&StubOptions{Har : recorded, Unmatched : "ignore"}); err == nil {
+		t.Fatal("Expected an error for an invalid unmatched policy")
+	}
+}
+
+func TestStubRefreshHeaders(t *testing.T) {
+	recorded := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := recorded.Add(24 * time.Hour)
+	response := stubResponse {
+		recorded : recorded,
+		response : &HarResponse {
+			Status 	: 200,
+			Headers : []HarNameValuePair{{Name : "Date", Value : recorded.Format(http.TimeFormat)}, {Name : "Set-Cookie", Value : "a=1,b=2"}, {Name : "Content-Encoding", Value : "gzip"}},
+			Cookies : []HarCookie{{Name : "a", Value : "1", Expires : recorded.Add(time.Hour)}, {Name : "b", Value : "2"}},
+			Content : &HarContent{Text : "hi"},
+		},
+	}
+	resp := (&httpStub{opts : StubOptions{RefreshHeaders : true}}).response(&response, nil, now)
+	cookies := resp.Cookies()
+	if resp.Status != "200 OK" || resp.Header.Get("Date") != now.Format(http.TimeFormat) || resp.Header.Get("Content-Encoding") != "" ||
+			len(cookies) != 2 || !cookies[0].Expires.Equal(now.Add(time.Hour)) || !cookies[1].Expires.IsZero() {
+		t.Fatalf("Expected the refreshed headers but got: %v %v", resp.Status, resp.Header)
+	}
+	resp = (&httpStub{}).response(&response, nil, now)
+	if resp.Header.Get("Date") != recorded.Format(http.TimeFormat) || !resp.Cookies()[0].Expires.Equal(recorded.Add(time.Hour)) {
+		t.Fatal("Expected the recorded headers but got: ", resp.Header)
+	}
+}
+
+func TestHarProxyServerStub(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, client := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	stubUrl := fmt.Sprintf("%v/proxy/%v/stub", harProxyServer.URL, proxyServerPort.Port)
+
+	document := `{"log" : {"version" : "1.2", "creator" : {"name" : "test", "version" : "1"}, "entries" : [{
+		"startedDateTime" : "2026-01-01T00:00:00Z", "time" : 1, "timings" : {"send" : 0, "wait" : 1, "receive" : 0},
+		"request" : {"method" : "GET", "url" : "http://stub.example.com/a", "httpVersion" : "HTTP/1.1", "headers" : [], "queryString" : [], "cookies" : [], "headersSize" : -1, "bodySize" : 0},
+		"response" : {"status" : 201, "statusText" : "Created", "httpVersion" : "HTTP/1.1", "headers" : [{"name" : "Content-Type", "value" : "text/plain"}], "cookies" : [],
+			"content" : {"size" : 7, "mimeType" : "text/plain", "text" : "stubbed"}, "redirectURL" : "", "headersSize" : -1, "bodySize" : 7}}]}}`
+	resp, err := testClient.Post(stubUrl + "?unmatched=fail&matchHeaders=X-User,%20X-Team&refreshHeaders=true", "application/json", strings.NewReader(document))
+	testResp(t, resp, err)
+	resp, err = testClient.Get(stubUrl)
+	testResp(t, resp, err)
+	stub := StubOptions{}
+	json.NewDecoder(resp.Body).Decode(&stub)
+	if stub.Unmatched != StubUnmatchedFail || strings.Join(stub.MatchHeaders, " ") != "X-User X-Team" || stub.MatchBody || !stub.RefreshHeaders {
+		t.Fatalf("Expected the stub options but got: %+v", stub)
+	}
+	resp, err = testClient.Post(stubUrl, "application/json", strings.NewReader(document))
+	testResp(t, resp, err)
+
+	resp, err = client.Get("http://stub.example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(body) != "stubbed" {
+		t.Fatalf("Expected the recorded response but got: %v %q", resp.Status, body)
+	}
+	resp, err = testClient.Get(fmt.Sprintf("%v/proxy/%v/status", harProxyServer.URL, proxyServerPort.Port))
+	testResp(t, resp, err)
+	status := ProxyServerStatus{}
+	json.NewDecoder(resp.Body).Decode(&status)
+	if status.StubServed != 1 || status.StubUnmatched != 0 {
+		t.Fatalf("Expected a served request in the status but got: %+v", status)
+	}
+
+	for _, invalid := range []struct{ query, document string } {
+		{"?unmatched=ignore", document},
+		{"?matchBody=maybe", document},
+		{"", "not a HAR"},
+	} {
+		resp, err = testClient.Post(stubUrl + invalid.query, "application/json", strings.NewReader(invalid.document))
+		if err != nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %q but got: %v", invalid.query, resp.Status)
+		}
+	}
+	deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v/stub", proxyServerPort.Port))
+	resp, err = testClient.Get(stubUrl)
+	testResp(t, resp, err)
+	stub = StubOptions{}
+	json.NewDecoder(resp.Body).Decode(&stub)
+	if stub.Unmatched != "" {
+		t.Fatalf("Expected no stub once removed but got: %+v", stub)
+	}
+}
+
+// Parallel test cases label their requests with the page header, their entries are grouped by page
+func TestHarProxyPageHeader(t *testing.T) {
+	var leaked int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Har-Page") != "" || r.Header.Get("X-Test-Case") != "" {
+			atomic.AddInt32(&leaked, 1)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer harProxy.Stop()
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+	get := func(path, header, page string) {
+		req, _ := http.NewRequest("GET", backend.URL + path, nil)
+		if page != "" {
+			req.Header.Set(header, page)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	harProxy.NewPage("setup", "Setup")
+	var wg sync.WaitGroup
+	for _, page := range []string{"checkout", "search"} {
+		wg.Add(1)
+		go func(page string) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				get(fmt.Sprintf("/%v/%v", page, i), "X-Har-Page", page)
+			}
+		}(page)
+	}
+	wg.Wait()
+	get("/unlabelled", "", "")
+	harProxy.WaitForEntries(context.Background())
+
+	document, _ := json.Marshal(harProxy.HarLog)
+	exported, err := ParseHar(bytes.NewReader(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := map[string]string{}
+	for _, page := range exported.Pages {
+		titles[page.Id] = page.Title
+	}
+	if len(exported.Pages) != 3 || titles["setup"] != "Setup" || titles["checkout"] != "checkout" || titles["search"] != "search" {
+		t.Fatalf("Expected the current page and a page per header value but got: %+v", exported.Pages)
+	}
+	byPage := map[string]int{}
+	for _, entry := range exported.Entries() {
+		requestUrl, _ := url.Parse(entry.Request.Url)
+		if page := strings.Split(requestUrl.Path, "/")[1]; page != entry.PageRef && !(page == "unlabelled" && entry.PageRef == "setup") {
+			t.Errorf("Expected %v to refer to its page but got: %v", entry.Request.Url, entry.PageRef)
+		}
+		for _, header := range entry.Request.Headers {
+			if strings.EqualFold(header.Name, "X-Har-Page") {
+				t.Errorf("Expected the page header to be stripped from %v", entry.Request.Url)
+			}
+		}
+		byPage[entry.PageRef]++
+	}
+	if byPage["checkout"] != 5 || byPage["search"] != 5 || byPage["setup"] != 1 {
+		t.Fatal("Expected the entries grouped by page but got: ", byPage)
+	}
+
+	// Another header name, the default one going upstream as any header
+	harProxy.ClearEntries()
+	config := harProxy.Config()
+	config.PageHeader = "X-Test-Case"
+	harProxy.ApplyConfig(config)
+	get("/login", "X-Test-Case", "login")
+	get("/logout", "X-Har-Page", "logout")
+	harProxy.WaitForEntries(context.Background())
+	entries := harProxy.HarLog.Entries()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Id < entries[j].Id
+	})
+	if len(entries) != 2 || entries[0].PageRef != "login" || entries[1].PageRef != "setup" || atomic.LoadInt32(&leaked) != 1 {
+		t.Fatalf("Expected only the configured header to set the page but got: %+v, %v leaked", entries, leaked)
+	}
+	config.PageHeader = "X-Har Page"
+	if err := config.validate(); err == nil {
+		t.Fatal("Expected an error for an invalid page header")
+	}
+}
+
+func TestHarProxyConnectionReuse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer harProxy.Stop()
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+	get := func(path string, close bool) HarEntry {
+		t.Helper()
+		req, _ := http.NewRequest("GET", backend.URL + path, nil)
+		req.Close = close
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		harProxy.WaitForEntries(context.Background())
+		entries := harProxy.HarLog.Entries()
+		return entries[len(entries) - 1]
+	}
+
+	first, second := get("/first", false), get("/second", false)
+	if first.Connection == "" || first.ConnectionReused {
+		t.Fatalf("Expected the first request on a new connection but got: %q reused %v", first.Connection, first.ConnectionReused)
+	}
+	if second.Connection != first.Connection || !second.ConnectionReused || !second.ConnectionWasIdle {
+		t.Fatalf("Expected the second request to reuse the idle connection %q but got: %q reused %v idle %v", first.Connection, second.Connection, second.ConnectionReused, second.ConnectionWasIdle)
+	}
+
+	closing, closingAgain := get("/close", true), get("/closeAgain", true)
+	if closingAgain.Connection == "" || closingAgain.Connection == closing.Connection || closingAgain.ConnectionReused {
+		t.Fatalf("Expected Connection: close to get a new connection but got: %q then %q reused %v", closing.Connection, closingAgain.Connection, closingAgain.ConnectionReused)
+	}
+
+	document, _ := json.Marshal(second)
+	if !bytes.Contains(document, []byte(`"connection":"` + second.Connection + `"`)) || !bytes.Contains(document, []byte(`"_connectionReused":true`)) {
+		t.Fatal("Expected the connection in the entry's json but got: ", string(document))
+	}
+}
+
+// A throttled upload is streamed upstream as the client sends it, its time being the entry's send timing
+func TestHarProxyUploadTimings(t *testing.T) {
+	const chunk, chunks = 256 << 10, 16
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, n)
+	}))
+	defer backend.Close()
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	harProxy.SetCaptureSettings(CaptureSettings{CaptureContent : true})
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer harProxy.Stop()
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+
+	upload, uploading := io.Pipe()
+	go func() {
+		for i := 0; i < chunks; i++ {
+			time.Sleep(20 * time.Millisecond)
+			uploading.Write(bytes.Repeat([]byte{'a' + byte(i)}, chunk))
+		}
+		uploading.Close()
+	}()
+	req, _ := http.NewRequest("POST", backend.URL + "/upload", upload)
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := newProxyHttpTestClient(proxyUrl).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != strconv.Itoa(chunk * chunks) {
+		t.Fatal("Expected the whole body upstream but got: ", string(body))
+	}
+
+	harProxy.WaitForEntries(context.Background())
+	entry := harProxy.HarLog.Entries()[0]
+	if entry.Request.BodySize != chunk * chunks {
+		t.Fatalf("Expected the streamed bytes as bodySize of the chunked request but got: %v", entry.Request.BodySize)
+	}
+	if postData := entry.Request.PostData; postData == nil || len(postData.Text) != chunk * chunks || postData.Truncated || postData.Text[chunk * chunks - 1] != 'a' + chunks - 1 {
+		t.Fatalf("Expected the whole body captured as it was streamed but got: %+v", postData)
+	}
+	timings := entry.Timings
+	if timings.Send < 200 || timings.Send < 10 * timings.Wait || timings.Send > entry.Time {
+		t.Fatalf("Expected the upload to dominate the timings of %vms but got: %+v", entry.Time, timings)
+	}
+}
+
+func TestHarProxyExportInvalid(t *testing.T) {
+	for _, export := range []*ExportOptions {
+		{},
+		{Dir : t.TempDir(), MaxEntries : -1},
+		{Dir : t.TempDir(), MaxFileSize : -1},
+	} {
+		if _, err := NewHarProxyWithOptions(HarProxyOptions{Export : export}); err == nil {
+			t.Errorf("Expected error for export options %+v", export)
+		}
+	}
+}
+
+func TestHarProxySubscribe(t *testing.T) {
+	harProxy := NewHarProxy()
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+
+	fast, _ := harProxy.Subscribe(10)
+	slow, _ := harProxy.Subscribe(1)
+	cancelled, cancel := harProxy.Subscribe(10)
+	cancel()
+	cancel()
+	if _, open := <-cancelled; open {
+		t.Fatal("Expected cancelled subscription to be closed")
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL + "/bobo")
+		testResp(t, resp, err)
+		harProxy.WaitForEntries(context.Background())
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case entry := <-fast:
+			if entry.Request.Url != srv.URL + "/bobo" {
+				t.Fatal("Unexpected entry: ", entry.Request.Url)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the fast subscriber to receive every entry")
+		}
+	}
+	if drops := harProxy.SubscriptionDrops(); drops != 2 {
+		t.Fatal("Expected the slow subscriber to drop 2 entries but got: ", drops)
+	}
+
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, open := <-slow; !open {
+		t.Fatal("Expected the slow subscriber to keep its buffered entry")
+	}
+	for _, entries := range []<-chan HarEntry{fast, slow} {
+		select {
+		case _, open := <-entries:
+			if open {
+				t.Fatal("Expected no more entries after Stop")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected Stop to close subscriptions")
+		}
+	}
+	if _, open := <-mustSubscribe(harProxy); open {
+		t.Fatal("Expected subscriptions after Stop to be closed")
+	}
+}
+
+func mustSubscribe(harProxy *HarProxy) <-chan HarEntry {
+	entries, _ := harProxy.Subscribe(1)
+	return entries
+}
+
+func TestHarProxyOnEntry(t *testing.T) {
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+
+	var lock sync.Mutex
+	seen := make([]map[string]int, 2)
+	unsubscribes := make([]func(), 2)
+	for i := range seen {
+		listener := make(map[string]int)
+		seen[i] = listener
+		unsubscribes[i] = harProxy.OnEntry(func(entry HarEntry) {
+			lock.Lock()
+			defer lock.Unlock()
+			listener[entry.Request.Url]++
+		})
+	}
+	harProxy.OnEntry(func(entry HarEntry) {
+		panic("callback failure")
+	})
+
+	for i := 0; i < 5; i++ {
+		if _, err := client.Get(fmt.Sprintf("%v/query?result=%v", srv.URL, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	harProxy.WaitForEntries(context.Background())
+	unsubscribes[1]()
+	if _, err := client.Get(srv.URL + "/bobo"); err != nil {
+		t.Fatal(err)
+	}
+	harProxy.WaitForEntries(context.Background())
+
+	lock.Lock()
+	defer lock.Unlock()
+	for i := 0; i < 5; i++ {
+		entryUrl := fmt.Sprintf("%v/query?result=%v", srv.URL, i)
+		if seen[0][entryUrl] != 1 || seen[1][entryUrl] != 1 {
+			t.Fatal("Expected both callbacks to see entry exactly once: ", entryUrl, seen)
+		}
+	}
+	if seen[0][srv.URL + "/bobo"] != 1 || seen[1][srv.URL + "/bobo"] != 0 {
+		t.Fatal("Expected only the subscribed callback to see entry after unsubscribe: ", seen)
+	}
+}
+
+func TestHarProxyEntryFilter(t *testing.T) {
+	statusServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(status)
+	}))
+	defer statusServer.Close()
+
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{MaxEntries : 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+
+	harProxy.SetEntryFilter(func(harEntry *HarEntry) bool {
+		if harEntry.Response.Status == http.StatusNotFound {
+			return false
+		}
+		harEntry.Request.Url = strings.Replace(harEntry.Request.Url, "secret", "scrubbed", 1)
+		return true
+	})
+	notified := 0
+	var lock sync.Mutex
+	harProxy.OnEntry(func(entry HarEntry) {
+		lock.Lock()
+		defer lock.Unlock()
+		notified++
+	})
+
+	for _, status := range []int{404, 200, 404, 500} {
+		if _, err := client.Get(fmt.Sprintf("%v/?status=%v&token=secret", statusServer.URL, status)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	harLog := testLog(t, harProxy.NewHarReader())
+	if len(harLog.Entries()) != 2 {
+		t.Fatal("Expected 404 entries to be dropped before the entry limit but got: ", len(harLog.Entries()))
+	}
+	for _, entry := range harLog.Entries() {
+		if entry.Response.Status == http.StatusNotFound || strings.Contains(entry.Request.Url, "secret") {
+			t.Fatal("Expected filter to drop and rewrite entries but got: ", entry.Request.Url, entry.Response.Status)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if notified != 2 {
+		t.Fatal("Expected filtered entries to never reach OnEntry but got notifications: ", notified)
+	}
+}
+
+type stubTransport struct {
+	serverIp net.IP
+}
+
+func (stub stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response {
+		Status 		  : "200 OK",
+		StatusCode 	  : http.StatusOK,
+		Proto 		  : "HTTP/1.1",
+		ProtoMajor 	  : 1,
+		ProtoMinor 	  : 1,
+		Header 		  : http.Header{"Content-Type" : {"text/plain"}},
+		Body 		  : ioutil.NopCloser(strings.NewReader("stub")),
+		ContentLength : 4,
+		Request 	  : req,
+	}, nil
+}
+
+// Answers like stubTransport once the fake clock advanced by delay
+type delayedTransport struct {
+	clock *testutil.FakeClock
+	delay time.Duration
+}
+
+func (delayed delayedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delayed.clock.Advance(delayed.delay)
+	return stubTransport{}.RoundTrip(req)
+}
+
+type detailedStubTransport struct {
+	stubTransport
+}
+
+func (stub detailedStubTransport) DetailedRoundTrip(req *http.Request) (*transport.RoundTripDetails, *http.Response, error) {
+	resp, err := stub.RoundTrip(req)
+	return &transport.RoundTripDetails{Host : req.URL.Host, TCPAddr : &net.TCPAddr{IP : stub.serverIp, Port : 80}}, resp, err
+}
+
+func TestHarProxyCustomTransport(t *testing.T) {
+	transports := map[string]http.RoundTripper {
+		"" 			: stubTransport{},
+		"10.1.2.3" 	: detailedStubTransport{stubTransport{net.ParseIP("10.1.2.3")}},
+	}
+	for expectedIp, upstream := range transports {
+		harProxy, err := NewHarProxyWithOptions(HarProxyOptions {
+			Transport 		: upstream,
+			CaptureSettings : CaptureSettings{CaptureContent : true},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, s := newProxyHttpTestServer(harProxy)
+
+		resp, err := client.Get("http://stub.invalid/canned")
+		testResp(t, resp, err)
+		harLog := testLog(t, harProxy.NewHarReader())
+		s.Close()
+
+		entry := harLog.Entries()[0]
+		if entry.Request.Url != "http://stub.invalid/canned" || entry.Response.Status != http.StatusOK {
+			t.Fatal("Expected entry built from the stub response but got: ", entry.Request.Url, entry.Response.Status)
+		}
+		if entry.Response.Content == nil || entry.Response.Content.Text != "stub" {
+			t.Fatal("Expected stub content in entry")
+		}
+		if entry.ServerIpAddress != expectedIp {
+			t.Fatalf("Expected server ip [%v] but got [%v]", expectedIp, entry.ServerIpAddress)
+		}
+	}
+}
+
+func TestHarProxySlowLookup(t *testing.T) {
+	release := make(chan struct{})
+	var lookups int32
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions {
+		Transport 	: stubTransport{},
+		LookupIP 	: func(ctx context.Context, host string) ([]net.IP, error) {
+			atomic.AddInt32(&lookups, 1)
+			select {
+			case <-release:
+				return []net.IP{net.ParseIP("::1"), net.ParseIP("10.9.8.7")}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+
+	resp, err := client.Get("http://slow.invalid/first")
+	testResp(t, resp, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := harProxy.WaitForEntries(ctx); err != nil {
+		t.Fatal("Expected the entry to be recorded without waiting for the lookup but got: ", err)
+	}
+	if ip := harProxy.HarLog.Entries()[0].ServerIpAddress; ip != "" {
+		t.Fatal("Expected no server ip before the lookup answered but got: ", ip)
+	}
+
+	close(release)
+	for harProxy.resolver.ip("slow.invalid") == "" {
+		time.Sleep(time.Millisecond)
+	}
+	resp, err = client.Get("http://slow.invalid:8080/second")
+	testResp(t, resp, err)
+	harProxy.WaitForEntries(ctx)
+	if entries := harProxy.HarLog.Entries(); len(entries) != 2 || entries[1].ServerIpAddress != "10.9.8.7" {
+		t.Fatal("Expected the resolved IPv4 address for the second entry but got: ", entries)
+	}
+	if lookups := atomic.LoadInt32(&lookups); lookups != 1 {
+		t.Fatal("Expected the host to be looked up once but got: ", lookups)
+	}
+}
+
+// Changes the request's headers like a transport, in the round trip and while the entry is built
+type headerChangingTransport struct {
+	changing *sync.WaitGroup
+}
+
+func (changing headerChangingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Del("X-Client")
+	req.Header.Set("X-Transport", "added")
+	changing.changing.Add(1)
+	go func() {
+		defer changing.changing.Done()
+		for i := 0; i < 100; i++ {
+			req.Header.Set(fmt.Sprintf("X-Later-%v", i), "added")
+		}
+	}()
+	return stubTransport{}.RoundTrip(req)
+}
+
+func TestHarProxyRecordsClientHeaders(t *testing.T) {
+	var changing sync.WaitGroup
+	defer changing.Wait()
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Transport : headerChangingTransport{&changing}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	for _, captureContent := range []bool{false, true} {
+		harProxy.SetCaptureSettings(CaptureSettings{CaptureContent : captureContent})
+		req, _ := http.NewRequest("POST", "http://stub.invalid/headers", strings.NewReader("bobo"))
+		req.Header.Set("X-Client", "sent")
+		resp, err := client.Do(req)
+		testResp(t, resp, err)
+	}
+	harProxy.WaitForEntries(context.Background())
+
+	for _, entry := range harProxy.HarLog.Entries() {
+		headers := make(map[string]string)
+		for _, header := range entry.Request.Headers {
+			headers[header.Name] = header.Value
+		}
+		if headers["X-Client"] != "sent" || headers["X-Transport"] != "" || len(headers) != len(entry.Request.Headers) {
+			t.Fatal("Expected the headers the client sent but got: ", entry.Request.Headers)
+		}
+		for name := range headers {
+			if strings.HasPrefix(name, "X-Later") {
+				t.Fatal("Expected the headers the client sent but got: ", entry.Request.Headers)
+			}
+		}
+	}
+}
+
+func TestHarProxyDisableRecording(t *testing.T) {
+	srvUrl, _ := url.Parse(srv.URL)
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	harProxy.AddHostEntries([]ProxyHosts{{Host : "rewritten.invalid", NewHost : srvUrl.Host}})
+	var notified int64
+	harProxy.OnEntry(func(HarEntry) { atomic.AddInt64(&notified, 1) })
+
+	get := func() {
+		resp, err := client.Get("http://rewritten.invalid/bobo")
+		testResp(t, resp, err)
+		if body, _ := ioutil.ReadAll(resp.Body); string(body) != "bobo" {
+			t.Fatal("Expected the rewritten host to answer but got: ", string(body))
+		}
+		resp.Body.Close()
+	}
+	harProxy.SetCaptureSettings(CaptureSettings{CaptureContent : true, DisableRecording : true})
+	get()
+	get()
+	harProxy.WaitForEntries(context.Background())
+	if entries := harProxy.HarLog.Entries(); len(entries) != 0 || atomic.LoadInt64(&notified) != 0 {
+		t.Fatal("Expected no entries while recording is disabled but got: ", entries)
+	}
+	if requests := atomic.LoadInt64(&harProxy.metrics.requests[1]); requests != 2 || harProxy.InFlightRequests() != 0 {
+		t.Fatal("Expected the requests to be counted but got: ", requests, harProxy.InFlightRequests())
+	}
+
+	harProxy.SetCaptureSettings(CaptureSettings{CaptureContent : true})
+	get()
+	harProxy.WaitForEntries(context.Background())
+	entries := harProxy.HarLog.Entries()
+	if len(entries) != 1 || entries[0].Response.Content.Text != "bobo" || atomic.LoadInt64(&notified) != 1 {
+		t.Fatal("Expected the request to be recorded once recording is enabled but got: ", entries)
+	}
+}
+
+func TestHarProxyMaxCaptureBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/chunked" {
+			w.Write(body[:len(body) / 2])
+			w.(http.Flusher).Flush()
+			w.Write(body[len(body) / 2:])
+			return
+		}
+		w.Write(body)
+	}))
+	defer upstream.Close()
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+
+	sent := strings.Repeat("0123456789", 1000)
+	for _, maxCaptureBytes := range []int64{0, 1000} {
+		harProxy.SetCaptureSettings(CaptureSettings{CaptureContent : true, MaxCaptureBytes : maxCaptureBytes})
+		for _, path := range []string{"/echo", "/chunked"} {
+			harProxy.ClearEntries()
+			resp, err := client.Post(upstream.URL + path, "text/plain", strings.NewReader(sent))
+			testResp(t, resp, err)
+			if body, _ := ioutil.ReadAll(resp.Body); string(body) != sent {
+				t.Fatal("Expected the whole body to go through but got bytes: ", len(body))
+			}
+			resp.Body.Close()
+			harProxy.WaitForEntries(context.Background())
+
+			entry := harProxy.HarLog.Entries()[0]
+			expected, truncated := sent, false
+			if maxCaptureBytes > 0 {
+				expected, truncated = sent[:maxCaptureBytes], true
+			}
+			if postData := entry.Request.PostData; postData.Text != expected || postData.Truncated != truncated {
+				t.Fatal("Expected the post data up to the limit but got: ", len(postData.Text), postData.Truncated)
+			}
+			if content := entry.Response.Content; content == nil || content.Text != expected || content.Truncated != truncated {
+				t.Fatal("Expected the content up to the limit but got: ", content)
+			}
+		}
+	}
+}
+
+func TestHarProxyCaptureBudget(t *testing.T) {
+	for _, policy := range []string{BudgetSkip, BudgetEvict} {
+		harProxy, err := NewHarProxyWithOptions(HarProxyOptions {
+			Transport 			: bodyTransport{body : bytes.Repeat([]byte("a"), 1000)},
+			CaptureSettings 	: CaptureSettings{CaptureContent : true},
+			CaptureBudget 		: 5000,
+			CaptureBudgetPolicy : policy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, s := newProxyHttpTestServer(harProxy)
+		for i := 0; i < 10; i++ {
+			resp, err := client.Get(fmt.Sprintf("http://stub.invalid/%v", i))
+			testResp(t, resp, err)
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			harProxy.WaitForEntries(context.Background())
+			entries := harProxy.HarLog.Entries()
+			if retained := harProxy.HarLog.CaptureBytes(); retained != sumBodyBytes(entries) || retained > 5000 {
+				t.Fatalf("Expected the %v budget to count the kept bodies but got %v for %v", policy, retained, sumBodyBytes(entries))
+			}
+		}
+
+		// Skipping keeps the first five bodies, evicting keeps the last four after going down to 3750 bytes
+		kept, reason := func(i int) bool { return i < 5 }, "budget"
+		if policy == BudgetEvict {
+			kept, reason = func(i int) bool { return i >= 6 }, "evicted"
+		}
+		for i, entry := range harProxy.HarLog.Entries() {
+			if kept(i) != (entry.Response.Content.Text != "") || kept(i) != (entry.CaptureSkipped == "") {
+				t.Fatalf("Unexpected body of entry %v with %v policy: %v bytes, skipped %v", i, policy, len(entry.Response.Content.Text), entry.CaptureSkipped)
+			}
+			if !kept(i) && entry.CaptureSkipped != reason {
+				t.Fatalf("Expected entry %v to be marked %v but got: %v", i, reason, entry.CaptureSkipped)
+			}
+		}
+
+		harProxy.ClearEntries()
+		if retained := harProxy.HarLog.CaptureBytes(); retained != 0 {
+			t.Fatal("Expected clearing to empty the budget but got: ", retained)
+		}
+		s.Close()
+	}
+}
+
+func TestHarProxyUpstreamPool(t *testing.T) {
+	const parallel = 16
+	var opened int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("pooled"))
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&opened, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	// Rounds of parallel requests through a proxy with pool, returns how many reused an upstream connection
+	// and how many connections the upstream server accepted
+	run := func(harProxy *HarProxy, rounds int) (int64, int64) {
+		var reused int64
+		harProxy.UseRequest(func(req *http.Request) (*http.Request, *http.Response) {
+			trace := &httptrace.ClientTrace {
+				GotConn : func(info httptrace.GotConnInfo) {
+					if info.Reused {
+						atomic.AddInt64(&reused, 1)
+					}
+				},
+			}
+			return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), nil
+		})
+		client, s := newProxyHttpTestServer(harProxy)
+		defer s.Close()
+		client.Transport.(*http.Transport).MaxIdleConnsPerHost = parallel
+		atomic.StoreInt64(&opened, 0)
+		for round := 0; round < rounds; round++ {
+			var requests sync.WaitGroup
+			for i := 0; i < parallel; i++ {
+				requests.Add(1)
+				go func() {
+					defer requests.Done()
+					resp, err := client.Get(upstream.URL)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+				}()
+			}
+			requests.Wait()
+		}
+		return atomic.LoadInt64(&reused), atomic.LoadInt64(&opened)
+	}
+	newPooledProxy := func(pool UpstreamPool) *HarProxy {
+		harProxy, err := NewHarProxyWithOptions(HarProxyOptions{UpstreamPool : &pool, Logger : NopLogger})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return harProxy
+	}
+
+	if reused, opened := run(newPooledProxy(UpstreamPool{}), 4); reused > 3 * 2 || opened < 3 * (parallel - 2) {
+		t.Fatal("Expected only 2 idle connections to be kept by default but got reused / opened: ", reused, opened)
+	}
+	tuned := newPooledProxy(UpstreamPool{MaxIdleConnsPerHost : parallel})
+	if reused, opened := run(tuned, 4); reused < 3 * parallel - 2 || opened > parallel + 2 {
+		t.Fatal("Expected the idle connections to be reused but got reused / opened: ", reused, opened)
+	}
+	tuned.CloseIdleConnections()
+	if reused, opened := run(tuned, 1); reused != 0 || opened != parallel {
+		t.Fatal("Expected new connections once the idle ones were closed but got reused / opened: ", reused, opened)
+	}
+	if _, opened := run(newPooledProxy(UpstreamPool{MaxConnsPerHost : 4, MaxIdleConnsPerHost : 4}), 2); opened > 4 {
+		t.Fatal("Expected at most 4 upstream connections but got: ", opened)
+	}
+
+	if _, err := NewHarProxyWithOptions(HarProxyOptions{UpstreamPool : &UpstreamPool{MaxIdleConns : -1}}); err == nil {
+		t.Fatal("Expected a negative pool size to be rejected")
+	}
+	if _, err := NewHarProxyWithOptions(HarProxyOptions{UpstreamPool : &UpstreamPool{}, Transport : stubTransport{}}); err == nil {
+		t.Fatal("Expected an upstream pool with a custom transport to be rejected")
+	}
+}
+
+func TestHarProxyLatencyContentType(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".html") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/css")
+		}
+		io.WriteString(w, "asset")
+	}))
+	defer upstream.Close()
+	delay := 300 * time.Millisecond
+	harProxy := NewHarProxy()
+	if err := harProxy.SetLatencyRules([]LatencyRule{{Name : "slow-html", ContentType : "^text/html", DelayMs : delay.Milliseconds(), Phase : PhaseFirstByte}}); err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+
+	timed := func(path string) time.Duration {
+		start := time.Now()
+		resp, err := client.Get(upstream.URL + path)
+		testResp(t, resp, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return time.Since(start)
+	}
+	if elapsed := timed("/page.html"); elapsed < delay {
+		t.Fatal("Expected the html response to be delayed but it took: ", elapsed)
+	}
+	if elapsed := timed("/style.css"); elapsed >= delay {
+		t.Fatal("Expected the css response not to be delayed but it took: ", elapsed)
+	}
+
+	harProxy.WaitForEntries(context.Background())
+	for _, entry := range harProxy.HarLog.Entries() {
+		expected := ""
+		if strings.HasSuffix(entry.Request.Url, ".html") {
+			expected = "slow-html"
+		}
+		if entry.LatencyRule != expected {
+			t.Fatal("Expected latency rule [", expected, "] for ", entry.Request.Url, " but got: ", entry.LatencyRule)
+		}
+	}
+}
+
+func TestHarProxyLatencyPhases(t *testing.T) {
+	body := bytes.Repeat([]byte("paced"), 64 << 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer upstream.Close()
+	delay := 400 * time.Millisecond
+
+	for _, phase := range []string{PhaseRequest, PhaseFirstByte, PhaseBody} {
+		harProxy := NewHarProxy()
+		harProxy.SetLatencyRules([]LatencyRule{{DelayMs : delay.Milliseconds(), Phase : phase}})
+		client, s := newProxyHttpTestServer(harProxy)
+		start := time.Now()
+		resp, err := client.Get(upstream.URL)
+		testResp(t, resp, err)
+		firstByte := time.Since(start)
+		received, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		total := time.Since(start)
+		s.Close()
+
+		if !bytes.Equal(received, body) {
+			t.Fatal("Expected the whole body with phase ", phase, " but got bytes: ", len(received))
+		}
+		if total < delay - 10 * time.Millisecond {
+			t.Fatal("Expected the response to take the delay with phase ", phase, " but it took: ", total)
+		}
+		if phase == PhaseBody && firstByte >= delay / 2 {
+			t.Fatal("Expected the first byte before the body was paced but got it after: ", firstByte)
+		}
+		if phase != PhaseBody && firstByte < delay {
+			t.Fatal("Expected the first byte after the delay with phase ", phase, " but got it after: ", firstByte)
+		}
+		harProxy.WaitForEntries(context.Background())
+		if entry := harProxy.HarLog.Entries()[0]; entry.LatencyRule != "latency[0]" || entry.Time < delay.Milliseconds() - 10 {
+			t.Fatal("Expected the entry to record the rule and the delay with phase ", phase, " but got: ", entry.LatencyRule, entry.Time)
+		}
+	}
+
+	if err := NewHarProxy().SetLatencyRules([]LatencyRule{{ContentType : "text/html", DelayMs : 10}}); err == nil {
+		t.Fatal("Expected a content type with the request phase to be rejected")
+	}
+}
+
+func TestHarProxyServerLatency(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	latencyUrl := fmt.Sprintf("%v/proxy/%v/latency", harProxyServer.URL, proxyServerPort.Port)
+	put := func(rules []LatencyRule) *http.Response {
+		body, _ := json.Marshal(rules)
+		req, _ := http.NewRequest("PUT", latencyUrl, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := put([]LatencyRule{{DelayMs : 10}, {DelayMs : 10, Phase : "later"}, {UrlPattern : "(", DelayMs : 10}})
+	proxyErr := ProxyServerErr{}
+	json.NewDecoder(resp.Body).Decode(&proxyErr)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity || len(proxyErr.Items) != 2 || proxyErr.Items[0].Index != 1 {
+		t.Fatal("Expected the invalid latency rules to be listed but got: ", resp.StatusCode, proxyErr)
+	}
+
+	rules := []LatencyRule{{Name : "slow-js", UrlPattern : "\\.js$", ContentType : "javascript", DelayMs : 200, Phase : PhaseBody}}
+	resp = put(rules)
+	testResp(t, resp, nil)
+	resp, err := testClient.Get(latencyUrl)
+	testResp(t, resp, err)
+	got := []LatencyRule{}
+	json.NewDecoder(resp.Body).Decode(&got)
+	if !reflect.DeepEqual(got, rules) {
+		t.Fatal("Expected the latency rules which were set but got: ", got)
+	}
+
+	req, _ := http.NewRequest("DELETE", latencyUrl, nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = testClient.Get(latencyUrl)
+	testResp(t, resp, err)
+	got = nil
+	json.NewDecoder(resp.Body).Decode(&got)
+	if len(got) != 0 {
+		t.Fatal("Expected no latency rules once cleared but got: ", got)
+	}
+}
+
+func TestHarProxyStatusRewrites(t *testing.T) {
+	const seed, requests = 42, 200
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Seed : seed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := ""
+	err = harProxy.SetStatusRewrites([]StatusRewrite {
+		{UrlPattern : "/missing$", FromStatus : http.StatusNotFound, ToStatus : http.StatusOK, Body : &empty},
+		{UrlPattern : "/bobo$", ToStatus : http.StatusServiceUnavailable, Percentage : 30},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+
+	// The rewrites drawn by the same sequence of random numbers
+	expected := mathrand.New(mathrand.NewSource(seed))
+	for i := 0; i < requests; i++ {
+		resp, err := client.Get(srv.URL + "/bobo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		expectedStatus := http.StatusOK
+		if expected.Float64() * 100 < 30 {
+			expectedStatus = http.StatusServiceUnavailable
+		}
+		if resp.StatusCode != expectedStatus || string(body) != "bobo" {
+			t.Fatal("Expected request ", i, " to get ", expectedStatus, " but got: ", resp.StatusCode, string(body))
+		}
+	}
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	resp, err := client.Get(missing.URL + "/missing")
+	testResp(t, resp, err)
+	if body, _ := ioutil.ReadAll(resp.Body); len(body) != 0 {
+		t.Fatal("Expected the replacement body to be empty but got: ", string(body))
+	}
+	resp.Body.Close()
+
+	harProxy.WaitForEntries(context.Background())
+	rewritten := 0
+	for _, entry := range harProxy.HarLog.Entries() {
+		switch {
+		case entry.Response.Status == http.StatusServiceUnavailable && entry.OriginalStatus == http.StatusOK:
+			rewritten++
+		case strings.HasSuffix(entry.Request.Url, "/missing"):
+			if entry.Response.Status != http.StatusOK || entry.OriginalStatus != http.StatusNotFound {
+				t.Fatal("Expected the 404 to be recorded as a rewritten 200 but got: ", entry.Response.Status, entry.OriginalStatus)
+			}
+		case entry.Response.Status != http.StatusOK || entry.OriginalStatus != 0:
+			t.Fatal("Expected an untouched entry but got: ", entry.Response.Status, entry.OriginalStatus)
+		}
+	}
+	if rewritten < requests / 5 || rewritten > requests * 2 / 5 {
+		t.Fatal("Expected about 30% of the responses to be rewritten but got: ", rewritten)
+	}
+
+	if err := harProxy.SetStatusRewrites([]StatusRewrite{{ToStatus : 200, Percentage : 120}}); err == nil {
+		t.Fatal("Expected a percentage over 100 to be rejected")
+	}
+}
+
+func TestHarProxySeed(t *testing.T) {
+	// The statuses of 16 requests through a proxy seeded with 7 rewriting half of them, . for 200 and x for 503.
+	// Each request draws its latency jitter, then whether it is rewritten.
+	golden := "x.xx.x.x.xxx..xx"
+	decisions := func(seed int64) (string, int64) {
+		harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Seed : seed, Logger : NopLogger})
+		if err != nil {
+			t.Fatal(err)
+		}
+		harProxy.SetStatusRewrites([]StatusRewrite{{ToStatus : http.StatusServiceUnavailable, Percentage : 50}})
+		harProxy.SetLatencyRules([]LatencyRule{{DelayMs : 1, JitterMs : 5}})
+		client, s := newProxyHttpTestServer(harProxy)
+		defer s.Close()
+		statuses := ""
+		for i := 0; i < 16; i++ {
+			resp, err := client.Get(srv.URL + "/bobo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				statuses += "."
+			} else {
+				statuses += "x"
+			}
+		}
+		return statuses, harProxy.Seed()
+	}
+
+	if statuses, seed := decisions(7); statuses != golden || seed != 7 {
+		t.Fatal("Expected the decisions of seed 7 to be ", golden, " but got: ", statuses, seed)
+	}
+	first, seed := decisions(0)
+	if seed == 0 {
+		t.Fatal("Expected a random seed to be picked")
+	}
+	if again, _ := decisions(seed); again != first {
+		t.Fatal("Expected the picked seed to reproduce ", first, " but got: ", again)
+	}
+	original := NewHarProxyWithPort(0)
+	if clone, _ := original.Clone(); clone.Seed() != original.Seed() {
+		t.Fatal("Expected a clone to keep the seed")
+	}
+}
+
+func TestHarProxyServerStatusRewrites(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, client := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	rewritesUrl := fmt.Sprintf("%v/proxy/%v/statusRewrites", harProxyServer.URL, proxyServerPort.Port)
+	put := func(body string) *http.Response {
+		req, _ := http.NewRequest("PUT", rewritesUrl, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := put(`[{"toStatus" : 503}, {"toStatus" : 42}]`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatal("Expected an invalid status to be rejected but got: ", resp.StatusCode)
+	}
+	resp = put(`[{"urlPattern" : "bobo", "toStatus" : 503, "body" : "unavailable"}]`)
+	testResp(t, resp, nil)
+	resp, err := testClient.Get(rewritesUrl)
+	testResp(t, resp, err)
+	rewrites := []StatusRewrite{}
+	json.NewDecoder(resp.Body).Decode(&rewrites)
+	if len(rewrites) != 1 || rewrites[0].ToStatus != 503 || rewrites[0].Body == nil || *rewrites[0].Body != "unavailable" {
+		t.Fatal("Expected the status rewrite which was set but got: ", rewrites)
+	}
+
+	resp, err = client.Get(srv.URL + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "unavailable" {
+		t.Fatal("Expected the rewritten response but got: ", resp.StatusCode, string(body))
+	}
+
+	req, _ := http.NewRequest("DELETE", rewritesUrl, nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+}
+
+func TestHarProxyActivationWindows(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Now())
+	harProxy, _ := NewHarProxyWithOptions(HarProxyOptions{Clock : clock, Logger : NopLogger})
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	status := func() int {
+		resp, err := client.Get(srv.URL + "/bobo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if err := harProxy.SetStatusRewrites([]StatusRewrite{{ToStatus : 503, ActivationWindow : ActivationWindow{DurationSeconds : -1}}}); err == nil {
+		t.Fatal("Expected a negative duration to be rejected")
+	}
+	end := clock.Now().Add(time.Minute)
+	if err := harProxy.SetStatusRewrites([]StatusRewrite{{ToStatus : 503, ActivationWindow : ActivationWindow{DurationSeconds : 1, End : &end}}}); err == nil {
+		t.Fatal("Expected a duration and an end to be rejected")
+	}
+	rewrites := []StatusRewrite{}
+	json.Unmarshal([]byte(`[{"urlPattern" : "bobo", "toStatus" : 503, "durationSeconds" : 30}]`), &rewrites)
+	start := clock.Now().Add(10 * time.Second)
+	rewrites = append(rewrites, StatusRewrite{ToStatus : 404, ActivationWindow : ActivationWindow{Start : &start}})
+	if err := harProxy.SetStatusRewrites(rewrites); err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.SetLatencyRules([]LatencyRule{{Name : "spike", ActivationWindow : ActivationWindow{DurationSeconds : 5}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := status(); code != http.StatusServiceUnavailable {
+		t.Fatal("Expected the rewrite to be active right away but got: ", code)
+	}
+	clock.Advance(29 * time.Second)
+	listed := harProxy.StatusRewrites()
+	if len(listed) != 2 || listed[0].RemainingSeconds == nil || *listed[0].RemainingSeconds != 1 || listed[0].DurationSeconds != 0 {
+		t.Fatal("Expected the rewrite to be listed with a second left but got: ", listed)
+	}
+	if !listed[0].End.Equal(start.Add(20 * time.Second)) || listed[1].RemainingSeconds != nil {
+		t.Fatal("Expected the duration to be listed as end, and no remaining time without end, but got: ", listed)
+	}
+	if latencyRules := harProxy.LatencyRules(); len(latencyRules) != 0 {
+		t.Fatal("Expected the expired latency rule to be removed but got: ", latencyRules)
+	}
+
+	clock.Advance(time.Second)
+	if code := status(); code != http.StatusNotFound {
+		t.Fatal("Expected the expired rewrite to stop matching, and the started one to apply, but got: ", code)
+	}
+	harProxy.settingsLock.RLock()
+	remaining := len(harProxy.statusRewrites)
+	harProxy.settingsLock.RUnlock()
+	if remaining != 1 {
+		t.Fatal("Expected the expired rewrite to be removed once seen but got rewrites: ", remaining)
+	}
+
+	harProxy.WaitForEntries(context.Background())
+	entries := harProxy.HarLog.Entries()
+	if len(entries) != 2 || entries[0].LatencyRule != "spike" || entries[1].LatencyRule != "" {
+		t.Fatal("Expected the latency rule to fire only within its window but got: ", entries)
+	}
+}
+
+func TestHarProxyRateLimit(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Now())
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Clock : clock, Logger : NopLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.SetRateLimit(&RateLimit{RequestsPerSecond : 1, Burst : 3}); err != nil {
+		t.Fatal(err)
+	}
+	quiet, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	noisy, _ := newProxyHttpTestServer(harProxy)
+	// The noisy client connects from another loopback address
+	noisy.Transport.(*http.Transport).DialContext = (&net.Dialer{LocalAddr : &net.TCPAddr{IP : net.ParseIP("127.0.0.2")}}).DialContext
+
+	send := func(client *http.Client, n int) (ok int, limited int) {
+		for i := 0; i < n; i++ {
+			resp, err := client.Get(srv.URL + "/bobo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			switch resp.StatusCode {
+			case http.StatusOK:
+				ok++
+			case http.StatusTooManyRequests:
+				if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "1" {
+					t.Fatal("Expected to be told to retry after 1 second but got: ", retryAfter)
+				}
+				limited++
+			default:
+				t.Fatal("Unexpected status: ", resp.StatusCode)
+			}
+		}
+		return
+	}
+	if ok, limited := send(noisy, 10); ok != 3 || limited != 7 {
+		t.Fatal("Expected the noisy client to be limited after its burst but got ok / limited: ", ok, limited)
+	}
+	if ok, limited := send(quiet, 3); ok != 3 || limited != 0 {
+		t.Fatal("Expected the quiet client not to be limited but got ok / limited: ", ok, limited)
+	}
+	clock.Advance(time.Second)
+	if ok, limited := send(noisy, 2); ok != 1 || limited != 1 {
+		t.Fatal("Expected the noisy client to get one more request a second later but got ok / limited: ", ok, limited)
+	}
+
+	harProxy.WaitForEntries(context.Background())
+	rateLimited := 0
+	for _, entry := range harProxy.HarLog.Entries() {
+		if entry.RateLimited {
+			rateLimited++
+			if entry.Response.Status != http.StatusTooManyRequests || entry.Comment != "" {
+				t.Fatal("Expected a rate limited entry to record the 429 but got: ", entry.Response.Status, entry.Comment)
+			}
+		}
+	}
+	if rateLimited != 8 {
+		t.Fatal("Expected 8 rate limited entries but got: ", rateLimited)
+	}
+
+	if err := harProxy.SetRateLimit(&RateLimit{RequestsPerSecond : 1}); err == nil {
+		t.Fatal("Expected a rate limit without burst to be rejected")
+	}
+}
+
+func TestRateLimiterBounded(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{RequestsPerSecond : 1, Burst : 1, MaxClients : 2})
+	now := time.Now()
+	for _, client := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3"} {
+		limiter.allow(client, now)
+	}
+	if limiter.len() != 2 {
+		t.Fatal("Expected 2 clients to be tracked but got: ", limiter.len())
+	}
+	// 10.0.0.2 was the least recently seen, it was forgotten for 10.0.0.3
+	if allowed, _ := limiter.allow("10.0.0.2", now); !allowed {
+		t.Fatal("Expected the forgotten client to get a new bucket")
+	}
+	if allowed, retryAfter := limiter.allow("10.0.0.3", now); allowed || retryAfter != time.Second {
+		t.Fatal("Expected the recent client to wait a second but got: ", allowed, retryAfter)
+	}
+}
+
+func TestHarProxyServerRateLimit(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, client := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	rateLimitUrl := fmt.Sprintf("%v/proxy/%v/rateLimit", harProxyServer.URL, proxyServerPort.Port)
+	put := func(body string) *http.Response {
+		req, _ := http.NewRequest("PUT", rateLimitUrl, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := put(`{"requestsPerSecond" : 0, "burst" : 1}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected an invalid rate limit to be rejected but got: ", resp.StatusCode)
+	}
+	resp = put(`{"requestsPerSecond" : 0.001, "burst" : 1}`)
+	testResp(t, resp, nil)
+	resp, err := testClient.Get(rateLimitUrl)
+	testResp(t, resp, err)
+	rateLimit := RateLimit{}
+	json.NewDecoder(resp.Body).Decode(&rateLimit)
+	if rateLimit.RequestsPerSecond != 0.001 || rateLimit.Burst != 1 {
+		t.Fatal("Expected the rate limit which was set but got: ", rateLimit)
+	}
+	for _, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		resp, err = client.Get(srv.URL + "/bobo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatal("Expected ", expected, " but got: ", resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest("DELETE", rateLimitUrl, nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+}
+
+func TestBodyRedactor(t *testing.T) {
+	card := "${1}removed"
+	redactor := newBodyRedactor(BodyRedactions {
+		JsonPaths 	: []string{"user.password", "*.creditCard.number", "items.sku", "tokens.1"},
+		Patterns 	: []BodyPattern{{Pattern : `password=[^&]*`, Replacement : nil}, {Pattern : `(card=)\d+`, Replacement : &card}},
+	})
+	for _, test := range []struct{ mimeType, body, expected string } {
+		{"application/json", `{"user" : {"name" : "ann", "password" : {"old" : "a", "new" : "b"}}, "password" : "top"}`,
+			`{"user":{"name":"ann","password":"[REDACTED]"},"password":"top"}`},
+		{"application/json; charset=utf-8", `{"order" : {"creditCard" : {"number" : 4111111111111111, "expiry" : "12/30"}}, "creditCard" : {"number" : 1}}`,
+			`{"order":{"creditCard":{"number":"[REDACTED]","expiry":"12/30"}},"creditCard":{"number":1}}`},
+		{"application/vnd.api+json", `{"items" : [{"sku" : "a", "qty" : 1.50}, {"sku" : ["b"]}, 3], "tokens" : ["x", "y", "z"]}`,
+			`{"items":[{"sku":"[REDACTED]","qty":1.50},{"sku":"[REDACTED]"},3],"tokens":["x","[REDACTED]","z"]}`},
+		{"application/json", `[{"user" : {"password" : "p", "note" : "<b>&</b>"}}]`, `[{"user":{"password":"[REDACTED]","note":"<b>&</b>"}}]`},
+		{"application/json", `{"user" : {"password" : "p"`, `{"user" : {"password" : "p"`},
+		{"application/json", `password=p&card=4111`, `[REDACTED]&card=removed`},
+		{"application/json", `{"user" : {"password" : "p"}} {}`, `{"user" : {"password" : "p"}} {}`},
+		{"text/plain", `login password=p&card=4111 {"user" : {"password" : "p"}}`, `login [REDACTED]&card=removed {"user" : {"password" : "p"}}`},
+	} {
+		if redacted := redactor.redact(test.body, test.mimeType); redacted != test.expected {
+			t.Errorf("Expected %v redacted as %v but got: %v", test.body, test.expected, redacted)
+		}
+	}
+	if err := (BodyRedactions{JsonPaths : []string{"user..password"}}).validate(); err == nil {
+		t.Error("Expected a path with an empty segment to be invalid")
+	}
+	if err := (BodyRedactions{Patterns : []BodyPattern{{Pattern : "("}}}).validate(); err == nil {
+		t.Error("Expected an invalid pattern to be invalid")
+	}
+}
+
+func TestHarProxyServerBodyRedactions(t *testing.T) {
+	var upstreamBody atomic.Value
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		upstreamBody.Store(string(body))
+		w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+		w.Write(body)
+	}))
+	defer echo.Close()
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, client := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	proxyUrl := fmt.Sprintf("%v/proxy/%v", harProxyServer.URL, proxyServerPort.Port)
+	put := func(path, body string) *http.Response {
+		req, _ := http.NewRequest("PUT", proxyUrl + path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	testResp(t, put("/captureSettings", `{"captureContent" : true}`), nil)
+	if resp := put("/redactions/body", `{"patterns" : [{"pattern" : "("}]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected invalid body redactions to be rejected but got: ", resp.StatusCode)
+	}
+	testResp(t, put("/redactions/body", `{"jsonPaths" : ["user.password"], "patterns" : [{"pattern" : "secret=\\w+"}]}`), nil)
+	resp, err := testClient.Get(proxyUrl + "/redactions/body")
+	testResp(t, resp, err)
+	redactions := BodyRedactions{}
+	json.NewDecoder(resp.Body).Decode(&redactions)
+	if len(redactions.JsonPaths) != 1 || len(redactions.Patterns) != 1 || redactions.Patterns[0].Replacement != nil {
+		t.Fatalf("Expected the body redactions which were set but got: %+v", redactions)
+	}
+
+	for _, body := range []struct{ mimeType, text string } {
+		{"application/json", `{"user" : {"name" : "ann", "password" : "hunter2"}}`},
+		{"text/plain", "secret=hunter2"},
+	} {
+		resp, err := client.Post(echo.URL + "/login", body.mimeType, strings.NewReader(body.text))
+		testResp(t, resp, err)
+		echoed, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(echoed) != body.text || upstreamBody.Load() != body.text {
+			t.Fatalf("Expected the bodies sent as they were but got: %v upstream, %s back", upstreamBody.Load(), echoed)
+		}
+	}
+	resp, err = testClient.Get(proxyUrl + "/har")
+	testResp(t, resp, err)
+	harLog, err := ParseHar(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := harLog.Entries()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Request.PostData.MimeType < entries[j].Request.PostData.MimeType })
+	if len(entries) != 2 || entries[0].Request.PostData.Text != `{"user":{"name":"ann","password":"[REDACTED]"}}` || entries[0].Response.Content.Text != entries[0].Request.PostData.Text ||
+			entries[1].Request.PostData.Text != "[REDACTED]" || entries[1].Response.Content.Text != "[REDACTED]" {
+		t.Fatalf("Expected the recorded bodies to be redacted but got: %+v", entries)
+	}
+
+	req, _ := http.NewRequest("DELETE", proxyUrl + "/redactions/body", nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = testClient.Get(proxyUrl + "/redactions/body")
+	testResp(t, resp, err)
+	if body, _ := ioutil.ReadAll(resp.Body); strings.TrimSpace(string(body)) != "null" {
+		t.Fatal("Expected no body redactions once removed but got: ", string(body))
+	}
+}
+
+func TestHarProxyServerAPIKeys(t *testing.T) {
+	if _, err := NewProxyServerWithOptions(ProxyServerOptions{APIKeys : map[string]string{"key-a" : "team-a"}, Admins : []string{"ops"}}); err == nil {
+		t.Fatal("Expected an admin without key to be rejected")
+	}
+	testClient, harProxyServer := newProxyTestServerWithOptions(ProxyServerOptions {
+		APIKeys : map[string]string{"key-a" : "team-a", "key-b" : "team-b", "key-ops" : "ops"},
+		Admins 	: []string{"ops"},
+	})
+	defer harProxyServer.Close()
+	call := func(method, path, key, body string) *http.Response {
+		req, _ := http.NewRequest(method, harProxyServer.URL + path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expectStatus := func(resp *http.Response, status int) {
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("Expected %v for %v %v but got: %v", status, resp.Request.Method, resp.Request.URL.Path, resp.StatusCode)
+		}
+	}
+	create := func(key string) ProxyServerPort {
+		resp := call("POST", "/proxy", key, "")
+		testResp(t, resp, nil)
+		proxyServerPort := ProxyServerPort{}
+		json.NewDecoder(resp.Body).Decode(&proxyServerPort)
+		resp.Body.Close()
+		return proxyServerPort
+	}
+	list := func(key string) []ProxyServerPort {
+		resp := call("GET", "/proxy", key, "")
+		testResp(t, resp, nil)
+		proxyServerPorts := []ProxyServerPort{}
+		json.NewDecoder(resp.Body).Decode(&proxyServerPorts)
+		resp.Body.Close()
+		return proxyServerPorts
+	}
+
+	expectStatus(call("GET", "/proxy", "", ""), http.StatusUnauthorized)
+	expectStatus(call("GET", "/proxy", "key-c", ""), http.StatusUnauthorized)
+	expectStatus(call("GET", "/ui", "", ""), http.StatusOK)
+
+	proxyA := create("key-a")
+	// Keys may be sent as bearer tokens too
+	req, _ := http.NewRequest("POST", harProxyServer.URL + "/proxy", nil)
+	req.Header.Set("Authorization", "Bearer key-b")
+	resp, err := testClient.Do(req)
+	testResp(t, resp, err)
+	proxyB := ProxyServerPort{}
+	json.NewDecoder(resp.Body).Decode(&proxyB)
+	resp.Body.Close()
+	if proxyA.Owner != "team-a" || proxyB.Owner != "team-b" {
+		t.Fatalf("Expected the proxies to be owned by the keys' owners but got: %+v, %+v", proxyA, proxyB)
+	}
+
+	if proxies := list("key-a"); len(proxies) != 1 || proxies[0].Port != proxyA.Port || proxies[0].Owner != "team-a" {
+		t.Fatal("Expected team-a to only see its proxy but got: ", proxies)
+	}
+	if proxies := list("key-b"); len(proxies) != 1 || proxies[0].Port != proxyB.Port {
+		t.Fatal("Expected team-b to only see its proxy but got: ", proxies)
+	}
+	if proxies := list("key-ops"); len(proxies) != 2 {
+		t.Fatal("Expected the admin to see every proxy but got: ", proxies)
+	}
+
+	pathA := fmt.Sprintf("/proxy/%v", proxyA.Port)
+	expectStatus(call("GET", pathA + "/har", "key-b", ""), http.StatusForbidden)
+	expectStatus(call("PUT", pathA + "/config", "key-b", "{}"), http.StatusForbidden)
+	expectStatus(call("GET", pathA + "/status", "key-b", ""), http.StatusForbidden)
+	expectStatus(call("DELETE", pathA, "key-b", ""), http.StatusForbidden)
+	expectStatus(call("POST", "/har/merge", "key-b", fmt.Sprintf(`{"ports" : [%v, %v]}`, proxyA.Port, proxyB.Port)), http.StatusForbidden)
+	expectStatus(call("GET", pathA + "/har", "key-a", ""), http.StatusOK)
+
+	resp = call("GET", pathA + "/status", "key-a", "")
+	testResp(t, resp, nil)
+	status := ProxyServerStatus{}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.Owner != "team-a" {
+		t.Fatal("Expected the status to show the owner but got: ", status.Owner)
+	}
+
+	expectStatus(call("GET", pathA + "/har", "key-ops", ""), http.StatusOK)
+	expectStatus(call("DELETE", fmt.Sprintf("/proxy/%v", proxyB.Port), "key-ops", ""), http.StatusOK)
+	expectStatus(call("DELETE", pathA, "key-a", ""), http.StatusOK)
+	if proxies := list("key-ops"); len(proxies) != 0 {
+		t.Fatal("Expected every proxy to be deleted but got: ", proxies)
+	}
+}
+
+func TestHarProxyServerUIWithAPIKeys(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Now())
+	testClient, harProxyServer := newProxyTestServerWithOptions(ProxyServerOptions {
+		APIKeys : map[string]string{"key-a" : "team-a", "key-b" : "team-b"},
+		Clock 	: clock,
+	})
+	defer harProxyServer.Close()
+	// The calls of ui/app.js, the key in the header but for the stream which sends a stream token instead
+	call := func(method, path, key string) *http.Response {
+		req, _ := http.NewRequest(method, harProxyServer.URL + path, nil)
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := call("GET", "/ui/app.js", "")
+	testResp(t, resp, nil)
+	resp.Body.Close()
+	resp = call("POST", "/proxy", "key-a")
+	testResp(t, resp, nil)
+	proxyServerPort := ProxyServerPort{}
+	json.NewDecoder(resp.Body).Decode(&proxyServerPort)
+	resp.Body.Close()
+	proxyPath := fmt.Sprintf("/proxy/%v", proxyServerPort.Port)
+	defer func() {
+		call("DELETE", proxyPath, "key-a").Body.Close()
+	}()
+
+	if resp = call("GET", "/proxy", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("Expected the UI's first listing without key to get 401 but got: ", resp.StatusCode)
+	}
+	resp.Body.Close()
+	resp = call("GET", "/proxy", "key-a")
+	testResp(t, resp, nil)
+	proxyServerPorts := []ProxyServerPort{}
+	json.NewDecoder(resp.Body).Decode(&proxyServerPorts)
+	resp.Body.Close()
+	if len(proxyServerPorts) != 1 || proxyServerPorts[0].Port != proxyServerPort.Port {
+		t.Fatal("Expected the UI to list the key's proxy but got: ", proxyServerPorts)
+	}
+
+	streamToken := func(path, key string) string {
+		resp := call("POST", path + "/har/streamToken", key)
+		defer resp.Body.Close()
+		testResp(t, resp, nil)
+		token := StreamToken{}
+		json.NewDecoder(resp.Body).Decode(&token)
+		if token.Token == "" || token.ExpiresInMs != streamTokenTTL.Milliseconds() {
+			t.Fatal("Expected a stream token but got: ", token)
+		}
+		return token.Token
+	}
+	if resp = call("POST", proxyPath + "/har/streamToken", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("Expected a stream token without key to get 401 but got: ", resp.StatusCode)
+	}
+	resp.Body.Close()
+	if resp = call("POST", proxyPath + "/har/streamToken", "key-b"); resp.StatusCode != http.StatusForbidden {
+		t.Fatal("Expected a stream token of another team's proxy to get 403 but got: ", resp.StatusCode)
+	}
+	resp.Body.Close()
+	resp = call("POST", "/proxy", "key-a")
+	otherPort := ProxyServerPort{}
+	json.NewDecoder(resp.Body).Decode(&otherPort)
+	resp.Body.Close()
+	otherPath := fmt.Sprintf("/proxy/%v", otherPort.Port)
+	defer func() {
+		call("DELETE", otherPath, "key-a").Body.Close()
+	}()
+	used := streamToken(proxyPath, "key-a")
+	resp = call("GET", proxyPath + "/har/stream?streamToken=" + used, "")
+	testResp(t, resp, nil)
+	resp.Body.Close()
+	expired := streamToken(proxyPath, "key-a")
+	clock.Advance(streamTokenTTL)
+	for name, query := range map[string]string {
+		"the key" 			: "apiKey=key-a",
+		"no token" 			: "streamToken=",
+		"an unknown token" 	: "streamToken=bobo",
+		"a used token" 		: "streamToken=" + used,
+		"an expired token" 	: "streamToken=" + expired,
+	} {
+		resp = call("GET", proxyPath + "/har/stream?" + query, "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected the stream with %v to get 401 but got: %v", name, resp.StatusCode)
+		}
+	}
+	if resp = call("GET", otherPath + "/har/stream?streamToken=" + streamToken(proxyPath, "key-a"), ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatal("Expected the stream of another proxy than the token's to get 403 but got: ", resp.StatusCode)
+	}
+	resp.Body.Close()
+	token := streamToken(proxyPath, "key-a")
+	logged := loggedRequestURI(httptest.NewRequest("GET", proxyPath + "/har/stream?streamToken=" + token, nil))
+	if logged != proxyPath + "/har/stream" {
+		t.Fatal("Expected the access log to leave the stream token out but got: ", logged)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", harProxyServer.URL + proxyPath + "/har/stream?streamToken=" + token, nil)
+	resp, err := testClient.Do(req)
+	testResp(t, resp, err)
+	events := bufio.NewReader(resp.Body)
+	if line, err := events.ReadString('\n'); err != nil || !strings.HasPrefix(line, ":") {
+		t.Fatal("Expected the opening comment but got: ", line, err)
+	}
+	proxiedResp, err := newPortHttpTestClient(harProxyServer, proxyServerPort.Port).Get(srv.URL + "/bobo")
+	testResp(t, proxiedResp, err)
+	proxiedResp.Body.Close()
+	for {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			break
+		}
+	}
+
+	if resp = call("PUT", proxyPath + "/har", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("Expected clearing without key to get 401 but got: ", resp.StatusCode)
+	}
+	resp.Body.Close()
+	resp = call("PUT", proxyPath + "/har", "key-a")
+	testResp(t, resp, nil)
+	if harLog := testLog(t, resp.Body); harLog.Len() != 1 {
+		t.Fatal("Expected the UI to clear the streamed entry but got: ", harLog.Len())
+	}
+	resp.Body.Close()
+}
+
+func TestHarProxyConnectionLimits(t *testing.T) {
+	var inFlight, maxInFlight int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	harProxy, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger})
+	if err := harProxy.SetConnectionLimits(&ConnectionLimits{MaxConcurrent : -1}); err == nil {
+		t.Fatal("Expected negative limits to be rejected")
+	}
+	if err := harProxy.SetConnectionLimits(&ConnectionLimits{MaxConcurrent : 2}); err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(slow.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if max := atomic.LoadInt32(&maxInFlight); max != 2 {
+		t.Fatal("Expected at most 2 requests at once upstream but got: ", max)
+	}
+	harProxy.WaitForEntries(context.Background())
+	entries := harProxy.HarLog.Entries()
+	if len(entries) != 20 {
+		t.Fatal("Expected 20 entries but got: ", len(entries))
+	}
+	blocked := 0
+	for _, entry := range entries {
+		if entry.Timings.Blocked > 0 {
+			blocked++
+		}
+	}
+	if blocked < 18 {
+		t.Fatal("Expected the requests waiting for a slot to record it as blocked but got: ", blocked)
+	}
+}
+
+func TestHarProxyConnectionLimitsPerHost(t *testing.T) {
+	var lock sync.Mutex
+	inFlight, maxInFlight := map[string]int{}, map[string]int{}
+	slow := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			inFlight[name]++
+			if inFlight[name] > maxInFlight[name] {
+				maxInFlight[name] = inFlight[name]
+			}
+			lock.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			lock.Lock()
+			inFlight[name]--
+			lock.Unlock()
+		}))
+	}
+	first, second := slow("first"), slow("second")
+	defer first.Close()
+	defer second.Close()
+	harProxy, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger})
+	harProxy.SetConnectionLimits(&ConnectionLimits{MaxConcurrentPerHost : 1})
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		for _, target := range []string{first.URL, second.URL} {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				resp, err := client.Get(target)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}(target)
+		}
+	}
+	wg.Wait()
+	lock.Lock()
+	defer lock.Unlock()
+	if maxInFlight["first"] != 1 || maxInFlight["second"] != 1 {
+		t.Fatal("Expected one request at once per host but got: ", maxInFlight)
+	}
+	if hosts := len(harProxy.connectionLimiter.hosts); hosts != 0 {
+		t.Fatal("Expected the hosts to be forgotten once idle but got: ", hosts)
+	}
+}
+
+func TestHarProxyServerConnectionLimits(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, client := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	limitsUrl := fmt.Sprintf("%v/proxy/%v/limits", harProxyServer.URL, proxyServerPort.Port)
+	put := func(body string) *http.Response {
+		req, _ := http.NewRequest("PUT", limitsUrl, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := put(`{"maxConcurrent" : -1}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected invalid limits to be rejected but got: ", resp.StatusCode)
+	}
+	resp = put(`{"maxConcurrent" : 4, "maxConcurrentPerHost" : 1}`)
+	testResp(t, resp, nil)
+	resp, err := testClient.Get(limitsUrl)
+	testResp(t, resp, err)
+	limits := ConnectionLimits{}
+	json.NewDecoder(resp.Body).Decode(&limits)
+	if limits.MaxConcurrent != 4 || limits.MaxConcurrentPerHost != 1 {
+		t.Fatal("Expected the limits which were set but got: ", limits)
+	}
+	resp, err = client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+
+	req, _ := http.NewRequest("DELETE", limitsUrl, nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = testClient.Get(limitsUrl)
+	testResp(t, resp, err)
+	limits = ConnectionLimits{}
+	json.NewDecoder(resp.Body).Decode(&limits)
+	if limits.MaxConcurrent != 0 || limits.MaxConcurrentPerHost != 0 {
+		t.Fatal("Expected the limits to be removed but got: ", limits)
+	}
+}
+
+func TestHarProxyQueryRewrites(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RawQuery)
+	}))
+	defer echo.Close()
+	harProxy, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger})
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	if err := harProxy.SetQueryRewrites([]QueryRewrite{{Remove : []string{""}}}); err == nil {
+		t.Fatal("Expected a rewrite removing a parameter without name to be rejected")
+	}
+	err := harProxy.SetQueryRewrites([]QueryRewrite {
+		{Remove : []string{"utm_*", "fbclid"}},
+		{UrlPattern : "/debug", Set : map[string]string{"debug" : "true", "note" : "a b&c=d/é"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string {
+		"/?b=2&utm_source=x&a=1&utm_medium=y&fbclid=z&c=%2F" 	: "b=2&a=1&c=%2F",
+		"/?utm_source=x" 										: "",
+		"/debug" 												: "debug=true&note=a+b%26c%3Dd%2F%C3%A9",
+		"/debug?z=1&debug=false&utm_id=3&debug=no&a=2" 			: "z=1&debug=true&a=2&note=a+b%26c%3Dd%2F%C3%A9",
+		"/untouched?utm=1&b&a=%20" 								: "utm=1&b&a=%20",
+	}
+	for path, query := range expected {
+		resp, err := client.Get(echo.URL + path)
+		testResp(t, resp, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != query {
+			t.Fatalf("Expected upstream query [%v] for %v but got [%v]", query, path, string(body))
+		}
+	}
+
+	harProxy.WaitForEntries(context.Background())
+	for _, entry := range harProxy.HarLog.Entries() {
+		requested := entry.Request.OriginalUrl
+		if requested == "" {
+			requested = entry.Request.Url
+		}
+		path := strings.TrimPrefix(requested, echo.URL)
+		query, ok := expected[path]
+		if !ok {
+			t.Fatal("Expected the entry to keep the url requested but got: ", requested)
+		}
+		sent := strings.SplitN(echo.URL + path, "?", 2)[0]
+		if query != "" {
+			sent += "?" + query
+		}
+		if entry.Request.Url != sent || entry.Request.RewrittenTo != "" {
+			t.Fatalf("Expected %v to be recorded with the url sent [%v] but got [%v] rewritten to [%v]", path, sent, entry.Request.Url, entry.Request.RewrittenTo)
+		}
+		if (path == "/untouched?utm=1&b&a=%20") != (entry.Request.OriginalUrl == "") {
+			t.Fatalf("Expected only the rewritten urls to have an _originalUrl but got [%v] for %v", entry.Request.OriginalUrl, path)
+		}
+	}
+
+	// Host entries still record their changes as _rewrittenTo
+	harProxy.AddHostEntries([]ProxyHosts{{Host : "rewritten.example.com", NewHost : strings.TrimPrefix(echo.URL, "http://")}})
+	harProxy.HarLog.clear()
+	resp, err := client.Get("http://rewritten.example.com/?a=1&utm_source=x")
+	testResp(t, resp, err)
+	resp.Body.Close()
+	harProxy.WaitForEntries(context.Background())
+	if entries := harProxy.HarLog.Entries(); len(entries) != 1 || entries[0].Request.Url != "http://rewritten.example.com/?a=1" ||
+			entries[0].Request.OriginalUrl != "http://rewritten.example.com/?a=1&utm_source=x" || entries[0].Request.RewrittenTo != echo.URL + "/?a=1" {
+		t.Fatalf("Expected the urls requested, with the query sent and sent upstream but got: %+v", entries)
+	}
+}
+
+func TestHarProxyServerQueryRewrites(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	queryRewritesUrl := fmt.Sprintf("%v/proxy/%v/queryRewrites", harProxyServer.URL, proxyServerPort.Port)
+	put := func(body string) *http.Response {
+		req, _ := http.NewRequest("PUT", queryRewritesUrl, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := put(`[{"remove" : ["utm_*"]}, {"urlPattern" : "(", "set" : {"debug" : "true"}}]`)
+	itemErrs := ProxyServerErr{}
+	json.NewDecoder(resp.Body).Decode(&itemErrs)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity || len(itemErrs.Items) != 1 || itemErrs.Items[0].Index != 1 {
+		t.Fatal("Expected the invalid rewrite to be rejected but got: ", resp.StatusCode, itemErrs)
+	}
+	resp = put(`[{"remove" : ["utm_*"]}, {"urlPattern" : "/debug", "set" : {"debug" : "true"}}]`)
+	testResp(t, resp, nil)
+	resp, err := testClient.Get(queryRewritesUrl)
+	testResp(t, resp, err)
+	queryRewrites := []QueryRewrite{}
+	json.NewDecoder(resp.Body).Decode(&queryRewrites)
+	expected := []QueryRewrite{{Remove : []string{"utm_*"}}, {UrlPattern : "/debug", Set : map[string]string{"debug" : "true"}}}
+	if !reflect.DeepEqual(queryRewrites, expected) {
+		t.Fatal("Expected the query rewrites which were set but got: ", queryRewrites)
+	}
+
+	req, _ := http.NewRequest("DELETE", queryRewritesUrl, nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = testClient.Get(queryRewritesUrl)
+	testResp(t, resp, err)
+	queryRewrites = nil
+	json.NewDecoder(resp.Body).Decode(&queryRewrites)
+	if len(queryRewrites) != 0 {
+		t.Fatal("Expected the query rewrites to be cleared but got: ", queryRewrites)
+	}
+}
+
+func TestHarProxyCookieRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=upstream; Path=/; Secure")
+		w.Header().Add("Set-Cookie", "tracker=1")
+		w.Header().Add("Set-Cookie", "tracker_id=2")
+		io.WriteString(w, r.Header.Get("Cookie"))
+	}))
+	defer backend.Close()
+	harProxy, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger})
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	if err := harProxy.SetCookieRules([]CookieRule{{SameSite : "sometimes"}}); err == nil {
+		t.Fatal("Expected an unknown sameSite to be rejected")
+	}
+	secure := false
+	err := harProxy.SetCookieRules([]CookieRule {
+		{UrlPattern : "/app", Set : map[string]string{"session" : "injected"}, Remove : []string{"debug_*"}},
+		{RemoveSetCookie : []string{"tracker*"}, Secure : &secure},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", backend.URL + "/app", nil)
+	req.Header.Set("Cookie", "a=1; debug_x=2; session=old; b=3")
+	resp, err := client.Do(req)
+	testResp(t, resp, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "a=1; b=3; session=injected" {
+		t.Fatal("Expected upstream to see the injected cookie but got: ", string(body))
+	}
+	if setCookies := resp.Header["Set-Cookie"]; !reflect.DeepEqual(setCookies, []string{"session=upstream; Path=/"}) {
+		t.Fatal("Expected the client to get only the session cookie, not secure, but got: ", setCookies)
+	}
+
+	// Only the second rule matches
+	resp, err = client.Get(backend.URL + "/other")
+	testResp(t, resp, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "" || len(resp.Header["Set-Cookie"]) != 1 {
+		t.Fatal("Expected no cookie upstream and the trackers stripped but got: ", string(body), resp.Header["Set-Cookie"])
+	}
+
+	harProxy.WaitForEntries(context.Background())
+	expected := map[string][]string {
+		backend.URL + "/app" 	: {"removed request cookie debug_x", "set request cookie session", "changed Set-Cookie session to session=upstream; Path=/",
+			"removed Set-Cookie tracker", "removed Set-Cookie tracker_id"},
+		backend.URL + "/other" 	: {"changed Set-Cookie session to session=upstream; Path=/", "removed Set-Cookie tracker", "removed Set-Cookie tracker_id"},
+	}
+	for _, entry := range harProxy.HarLog.Entries() {
+		if changes := entry.Custom[cookieChangesField]; !reflect.DeepEqual(changes, expected[entry.Request.Url]) {
+			t.Fatalf("Expected the cookie changes of %v to be recorded but got: %v", entry.Request.Url, changes)
+		}
+	}
+}
+
+func TestHarProxyWebhooks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+	received := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received <- r.URL.Path + " " + string(body)
+	}))
+	defer receiver.Close()
+
+	clock := testutil.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	harProxy, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger, Clock : clock})
+	err := harProxy.SetWebhookRules([]WebhookRule {
+		{StatusMin : 500, StatusMax : 599, TargetUrl : receiver.URL + "/alerts", CooldownMs : 60000,
+			PayloadTemplate : `{"text" : {{json .Url}}, "status" : {{.Status}}}`},
+		{UrlPattern : "/slow$", TargetUrl : receiver.URL + "/slow"},
+		{UrlPattern : "/slow$", TargetUrl : receiver.URL + "/broken"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	request := func(path string) {
+		resp, err := client.Get(upstream.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		harProxy.WaitForEntries(context.Background())
+	}
+	nextPost := func() string {
+		select {
+		case post := <-received:
+			return post
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a webhook post")
+			return ""
+		}
+	}
+
+	request("/ok")
+	request("/fail")
+	if post := nextPost(); post != fmt.Sprintf(`/alerts {"text" : "%v/fail", "status" : 503}`, upstream.URL) {
+		t.Fatal("Expected the templated payload of the failed request but got: ", post)
+	}
+	request("/fail")
+	clock.Advance(61 * time.Second)
+	request("/fail")
+	nextPost()
+
+	request("/slow")
+	payload := WebhookPayload{}
+	post := nextPost()
+	if !strings.HasPrefix(post, "/slow ") || json.Unmarshal([]byte(post[len("/slow "):]), &payload) != nil ||
+		payload.Url != upstream.URL + "/slow" || payload.Status != 200 || payload.Method != "GET" {
+		t.Fatal("Expected the default payload of the matching entry but got: ", post)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, failures, _ := harProxy.WebhookStats(); failures == 0 && time.Now().Before(deadline); _, failures, _ = harProxy.WebhookStats() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case post := <-received:
+		t.Fatal("Expected no other post but got: ", post)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if sent, failures, suppressed := harProxy.WebhookStats(); sent != 3 || failures != 1 || suppressed != 1 {
+		t.Fatalf("Expected 3 posts sent, 1 failed and 1 suppressed by the cooldown but got %v, %v, %v", sent, failures, suppressed)
+	}
+}
+
+func TestHarProxyWebhookRetriesEndOnStop(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	var posts int64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&posts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	clock := testutil.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	harProxy, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger, Clock : clock})
+	harProxy.SetWebhookRules([]WebhookRule{{TargetUrl : receiver.URL, MaxRetries : 10}})
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := harProxy.Addr()
+	client := newProxyHttpTestClient(&url.URL{Scheme : "http", Host : addr.String()})
+	resp, err := client.Get(upstream.URL + "/ok")
+	testResp(t, resp, err)
+	resp.Body.Close()
+	harProxy.WaitForEntries(context.Background())
+
+	waitFor := func(what string, done func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for ", what)
+			}
+		}
+	}
+	// The first post failed and its retry waits for the backoff
+	waitFor("the retry backoff", func() bool { return clock.Timers() == 1 })
+	harProxy.Stop()
+	waitFor("the retry to end", func() bool { return len(harProxy.webhookSlots) == 0 })
+	if timers := clock.Timers(); timers != 0 {
+		t.Fatal("Expected the backoff timer to be stopped but got: ", timers)
+	}
+	clock.Advance(time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	if _, failures, _ := harProxy.WebhookStats(); failures != 1 || atomic.LoadInt64(&posts) != 1 {
+		t.Fatalf("Expected no retry once stopped but got %v failures, %v posts", failures, atomic.LoadInt64(&posts))
+	}
+}
+
+func TestHarProxyServerWebhooks(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	webhooksUrl := fmt.Sprintf("%v/proxy/%v/webhooks", harProxyServer.URL, proxyServerPort.Port)
+
+	for _, rules := range []string{`[{"statusMin" : 500, "targetUrl" : "http://hooks.example.com/a"}]`, `[{"targetUrl" : "http://hooks.example.com/b", "cooldownMs" : 1000}]`} {
+		resp, err := testClient.Post(webhooksUrl, "application/json", strings.NewReader(rules))
+		testResp(t, resp, err)
+	}
+	resp, err := testClient.Get(webhooksUrl)
+	testResp(t, resp, err)
+	rules := []WebhookRule{}
+	json.NewDecoder(resp.Body).Decode(&rules)
+	if len(rules) != 2 || rules[0].StatusMin != 500 || rules[1].CooldownMs != 1000 {
+		t.Fatal("Expected the added webhook rules but got: ", rules)
+	}
+
+	resp, err = testClient.Post(webhooksUrl, "application/json", strings.NewReader(`[{"targetUrl" : "nowhere"}, {"targetUrl" : "http://a", "payloadTemplate" : "{{"}]`))
+	if err != nil || resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatal("Expected 422 for invalid rules but got: ", resp.Status)
+	}
+	proxyServerErr := ProxyServerErr{}
+	json.NewDecoder(resp.Body).Decode(&proxyServerErr)
+	if len(proxyServerErr.Items) != 2 {
+		t.Fatal("Expected an error per invalid rule but got: ", proxyServerErr)
+	}
+	deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v/webhooks", proxyServerPort.Port))
+	resp, err = testClient.Get(webhooksUrl)
+	testResp(t, resp, err)
+	json.NewDecoder(resp.Body).Decode(&rules)
+	if len(rules) != 0 {
+		t.Fatal("Expected no webhook rules once cleared but got: ", rules)
+	}
+}
+
+func TestHarProxyServerCookieRules(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	cookiesUrl := fmt.Sprintf("%v/proxy/%v/cookies", harProxyServer.URL, proxyServerPort.Port)
+	put := func(body string) *http.Response {
+		req, _ := http.NewRequest("PUT", cookiesUrl, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := put(`[{"set" : {"session" : "1"}}, {"remove" : [""]}]`)
+	itemErrs := ProxyServerErr{}
+	json.NewDecoder(resp.Body).Decode(&itemErrs)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity || len(itemErrs.Items) != 1 || itemErrs.Items[0].Index != 1 {
+		t.Fatal("Expected the invalid rule to be rejected but got: ", resp.StatusCode, itemErrs)
+	}
+	resp = put(`[{"set" : {"session" : "1"}}, {"removeSetCookie" : ["*"], "httpOnly" : true}]`)
+	testResp(t, resp, nil)
+	resp, err := testClient.Get(cookiesUrl)
+	testResp(t, resp, err)
+	cookieRules := []CookieRule{}
+	json.NewDecoder(resp.Body).Decode(&cookieRules)
+	httpOnly := true
+	expected := []CookieRule{{Set : map[string]string{"session" : "1"}}, {RemoveSetCookie : []string{"*"}, HttpOnly : &httpOnly}}
+	if !reflect.DeepEqual(cookieRules, expected) {
+		t.Fatal("Expected the cookie rules which were set but got: ", cookieRules)
+	}
+
+	req, _ := http.NewRequest("DELETE", cookiesUrl, nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = testClient.Get(cookiesUrl)
+	testResp(t, resp, err)
+	cookieRules = nil
+	json.NewDecoder(resp.Body).Decode(&cookieRules)
+	if len(cookieRules) != 0 {
+		t.Fatal("Expected the cookie rules to be cleared but got: ", cookieRules)
+	}
+}
+
+func TestHarProxySeleniumProxy(t *testing.T) {
+	harProxy, _ := NewHarProxyWithOptions(HarProxyOptions{Port : 9091, BindAddr : "127.0.0.1"})
+	expected := SeleniumProxy{ProxyType : "manual", HttpProxy : "proxy.example.com:9091", SslProxy : "proxy.example.com:9091"}
+	if seleniumProxy := harProxy.SeleniumProxy("proxy.example.com"); seleniumProxy != expected {
+		t.Fatal("Expected the capability for the external host but got: ", seleniumProxy)
+	}
+	if seleniumProxy := harProxy.SeleniumProxy(""); seleniumProxy.HttpProxy != "127.0.0.1:9091" {
+		t.Fatal("Expected the bind address without external host but got: ", seleniumProxy)
+	}
+	if seleniumProxy := harProxy.SeleniumProxy("::1"); seleniumProxy.SslProxy != "[::1]:9091" {
+		t.Fatal("Expected an ipv6 host in brackets but got: ", seleniumProxy)
+	}
+
+	for _, externalHost := range []string{"", "grid.example.com"} {
+		testClient, harProxyServer := newProxyTestServerWithOptions(ProxyServerOptions{ExternalHost : externalHost})
+		proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+		resp, err := testClient.Get(fmt.Sprintf("%v/proxy/%v/seleniumProxy", harProxyServer.URL, proxyServerPort.Port))
+		testResp(t, resp, err)
+		capability := map[string]string{}
+		json.NewDecoder(resp.Body).Decode(&capability)
+		resp.Body.Close()
+		host := externalHost
+		if host == "" {
+			serverUrl, _ := url.Parse(harProxyServer.URL)
+			host = serverUrl.Hostname()
+		}
+		address := net.JoinHostPort(host, strconv.Itoa(proxyServerPort.Port))
+		expected := map[string]string{"proxyType" : "manual", "httpProxy" : address, "sslProxy" : address}
+		if !reflect.DeepEqual(capability, expected) {
+			t.Fatal("Expected the WebDriver proxy capability but got: ", capability)
+		}
+		deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+		harProxyServer.Close()
+	}
+}
+
+// Walks through what the browsermob-proxy clients do, e.g. the README example of the python one
+func TestHarProxyBrowserMobCompat(t *testing.T) {
+	headers := make(chan http.Header, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	testClient, harProxyServer := newProxyTestServerWithOptions(ProxyServerOptions{BrowserMobCompat : true})
+	defer harProxyServer.Close()
+
+	resp, err := testClient.Post(harProxyServer.URL + "/proxy?port=0", "", nil)
+	testResp(t, resp, err)
+	proxyServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(proxyServerPort)
+	resp.Body.Close()
+	client := newPortHttpTestClient(harProxyServer, proxyServerPort.Port)
+	proxyUrl := fmt.Sprintf("%v/proxy/%v", harProxyServer.URL, proxyServerPort.Port)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+
+	form := func(method, path string, values url.Values) *http.Response {
+		req, _ := http.NewRequest(method, proxyUrl + path, strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	getHar := func() *HarLog {
+		resp, err := testClient.Get(proxyUrl + "/har")
+		testResp(t, resp, err)
+		defer resp.Body.Close()
+		harLog := new(HarLog)
+		json.NewDecoder(resp.Body).Decode(harLog)
+		return harLog
+	}
+	proxied := func(url string) int {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if resp := form("PUT", "/har", url.Values{"initialPageRef" : {"home"}}); resp.StatusCode != http.StatusNoContent {
+		t.Fatal("Expected 204 for the first HAR but got: ", resp.Status)
+	}
+	proxied(upstream.URL + "/first")
+	<-headers
+	harLog := getHar()
+	if len(harLog.Pages) != 1 || harLog.Pages[0].Id != "home" || harLog.Len() != 1 || harLog.Entries()[0].PageRef != "home" {
+		t.Fatalf("Expected the entry of page home but got %+v, %+v", harLog.Pages, harLog.Entries())
+	}
+	if getHar().Len() != 1 {
+		t.Fatal("Expected GET har to keep the entries")
+	}
+
+	resp = form("PUT", "/har/pageRef", url.Values{"pageRef" : {"checkout"}})
+	testResp(t, resp, nil)
+	proxied(upstream.URL + "/second")
+	<-headers
+	resp = form("PUT", "/har", url.Values{})
+	testResp(t, resp, nil)
+	harLog = testLog(t, resp.Body)
+	resp.Body.Close()
+	if len(harLog.Pages) != 2 || harLog.Len() != 2 || harLog.Entries()[1].PageRef != "checkout" {
+		t.Fatalf("Expected the previous HAR with both pages but got %+v, %+v", harLog.Pages, harLog.Entries())
+	}
+	if harLog = getHar(); len(harLog.Pages) != 1 || harLog.Pages[0].Id != "Page 0" || harLog.Len() != 0 {
+		t.Fatalf("Expected a new HAR with the default page but got %+v", harLog.Pages)
+	}
+
+	testResp(t, form("PUT", "/blacklist", url.Values{"regex" : {".*/ads/.*"}, "status" : {"404"}}), nil)
+	if status := proxied(upstream.URL + "/ads/banner"); status != http.StatusNotFound {
+		t.Fatal("Expected the blacklisted request to get 404 but got: ", status)
+	}
+	testResp(t, form("PUT", "/whitelist", url.Values{"regex" : {".*/allowed.*, .*/ads/.*"}, "status" : {"403"}}), nil)
+	if status := proxied(upstream.URL + "/other"); status != http.StatusForbidden {
+		t.Fatal("Expected the request out of the whitelist to get 403 but got: ", status)
+	}
+	deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v/whitelist", proxyServerPort.Port))
+	deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v/blacklist", proxyServerPort.Port))
+
+	resp, err = testClient.Post(proxyUrl + "/headers", "application/json", strings.NewReader(`{"User-Agent" : "BrowserMob-Agent"}`))
+	testResp(t, resp, err)
+	proxied(upstream.URL + "/allowed")
+	if header := <-headers; header.Get("User-Agent") != "BrowserMob-Agent" {
+		t.Fatal("Expected the header set on the request but got: ", header)
+	}
+
+	testResp(t, form("PUT", "/limit", url.Values{"latency" : {"50"}}), nil)
+	resp, err = testClient.Get(proxyUrl + "/limit")
+	testResp(t, resp, err)
+	limit := map[string]int64{}
+	json.NewDecoder(resp.Body).Decode(&limit)
+	resp.Body.Close()
+	if limit["latency"] != 50 {
+		t.Fatal("Expected a latency of 50ms but got: ", limit)
+	}
+	if resp := form("PUT", "/limit", url.Values{"downstreamKbps" : {"100"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected bandwidth limits to be rejected but got: ", resp.Status)
+	}
+
+	resp, err = testClient.Post(proxyUrl + "/hosts", "application/json", strings.NewReader(`{"example.invalid" : "127.0.0.1"}`))
+	testResp(t, resp, err)
+	resp, err = testClient.Get(proxyUrl + "/config")
+	testResp(t, resp, err)
+	config := HarProxyConfig{}
+	json.NewDecoder(resp.Body).Decode(&config)
+	resp.Body.Close()
+	if len(config.Hosts) != 1 || config.Hosts[0].Host != "example.invalid" || config.Hosts[0].NewHost != "127.0.0.1" {
+		t.Fatal("Expected the host remapped but got: ", config.Hosts)
+	}
+}
+
+func TestHarProxyDialContext(t *testing.T) {
+	srvUrl, _ := url.Parse(srv.URL)
+	dialed := make(chan string, 10)
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions {
+		DialContext : func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			return (&net.Dialer{}).DialContext(ctx, network, srvUrl.Host)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	harProxy.AddHostEntries([]ProxyHosts{{Host : "rewritten.invalid", NewHost : "dialed.invalid:81"}})
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+
+	resp, err := client.Get("http://rewritten.invalid/bobo")
+	testResp(t, resp, err)
+	str, _ := ioutil.ReadAll(resp.Body)
+	if string(str) != "bobo" {
+		t.Fatal("Expected dialer to redirect request to test server but got: ", string(str))
+	}
+	if addr := <-dialed; addr != "dialed.invalid:81" {
+		t.Fatal("Expected dialer to get the host entry address but got: ", addr)
+	}
+
+	harLog := testLog(t, harProxy.NewHarReader())
+	if harLog.Entries()[0].ServerIpAddress != srvUrl.Hostname() {
+		t.Fatal("Expected server ip from the dialed connection but got: ", harLog.Entries()[0].ServerIpAddress)
+	}
+
+	if _, err := NewHarProxyWithOptions(HarProxyOptions{DialContext : (&net.Dialer{}).DialContext, Transport : stubTransport{}}); err == nil {
+		t.Fatal("Expected error combining DialContext and Transport")
+	}
+}
+
+func TestHarProxyHostEntriesRewrite(t *testing.T) {
+	vhosts := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}
+	plain := httptest.NewServer(http.HandlerFunc(vhosts))
+	defer plain.Close()
+	plainUrl, _ := url.Parse(plain.URL)
+	secure := httptest.NewTLSServer(http.HandlerFunc(vhosts))
+	defer secure.Close()
+	secureUrl, _ := url.Parse(secure.URL)
+
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Transport : &http.Transport{TLSClientConfig : acceptAllCerts}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	harProxy.AddHostEntries([]ProxyHosts {
+		{Host : "vhost.example.com", NewHost : plainUrl.Host, PreserveHostHeader : true},
+		{Host : "plain.example.com", NewHost : plainUrl.Host},
+		{Host : "secure.example.com", NewHost : secureUrl.Host, NewScheme : "https", PreserveHostHeader : true},
+	})
+
+	expected := map[string]string {
+		"http://vhost.example.com/a" 	: "vhost.example.com",
+		"http://plain.example.com/b" 	: plainUrl.Host,
+		"http://secure.example.com/c" 	: "secure.example.com",
+	}
+	for requested, host := range expected {
+		resp, err := client.Get(requested)
+		testResp(t, resp, err)
+		if body, _ := ioutil.ReadAll(resp.Body); string(body) != host {
+			t.Fatalf("Expected target to receive Host [%v] for %v but got [%v]", host, requested, string(body))
+		}
+	}
+
+	rewrittenTo := map[string]string {
+		"http://vhost.example.com/a" 	: plain.URL + "/a",
+		"http://plain.example.com/b" 	: plain.URL + "/b",
+		"http://secure.example.com/c" 	: secure.URL + "/c",
+	}
+	harLog := testLog(t, harProxy.NewHarReader())
+	for _, entry := range harLog.Entries() {
+		if target, ok := rewrittenTo[entry.Request.Url]; !ok || entry.Request.RewrittenTo != target {
+			t.Fatalf("Expected client url with its target [%v] but got [%v] rewritten to [%v]",
+				target, entry.Request.Url, entry.Request.RewrittenTo)
+		}
+	}
+	if len(harLog.Entries()) != len(rewrittenTo) {
+		t.Fatal("Expected an entry per request but got: ", len(harLog.Entries()))
+	}
+}
+
+func TestHarProxyRewriteLocation(t *testing.T) {
+	var stub *httptest.Server
+	stub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, stub.URL + "/b?step=2", http.StatusFound)
+		case "/b":
+			// Protocol relative
+			http.Redirect(w, r, "//" + r.Host + "/c", http.StatusFound)
+		case "/c":
+			http.Redirect(w, r, "/done", http.StatusFound)
+		default:
+			io.WriteString(w, "done")
+		}
+	}))
+	defer stub.Close()
+	stubUrl, _ := url.Parse(stub.URL)
+
+	harProxy, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger})
+	client, s := newProxyHttpTestServer(harProxy)
+	defer s.Close()
+	harProxy.AddHostEntries([]ProxyHosts {
+		{Host : "api.example.invalid", NewHost : stubUrl.Host, RewriteLocation : true},
+		{Host : "plain.example.invalid", NewHost : stubUrl.Host},
+	})
+	var followed []string
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		followed = append(followed, req.URL.String())
+		return nil
+	}
+
+	resp, err := client.Get("http://api.example.invalid/a")
+	testResp(t, resp, err)
+	resp.Body.Close()
+	expected := []string{"http://api.example.invalid/b?step=2", "http://api.example.invalid/c", "http://api.example.invalid/done"}
+	if !reflect.DeepEqual(followed, expected) {
+		t.Fatal("Expected the redirects to stay on the mapped host but got: ", followed)
+	}
+	harProxy.WaitForEntries(context.Background())
+	var rewrites []LocationRewrite
+	for _, entry := range harProxy.HarLog.Entries() {
+		if entry.LocationRewrite != nil {
+			rewrites = append(rewrites, *entry.LocationRewrite)
+		}
+	}
+	expectedRewrites := []LocationRewrite {
+		{Original : stub.URL + "/b?step=2", Rewritten : "http://api.example.invalid/b?step=2"},
+		{Original : "//" + stubUrl.Host + "/c", Rewritten : "http://api.example.invalid/c"},
+	}
+	if !reflect.DeepEqual(rewrites, expectedRewrites) {
+		t.Fatal("Expected the original and rewritten Locations to be recorded but got: ", rewrites)
+	}
+
+	// Entries without rewriteLocation let the redirect escape to NewHost
+	followed = nil
+	resp, err = client.Get("http://plain.example.invalid/a")
+	testResp(t, resp, err)
+	resp.Body.Close()
+	if len(followed) == 0 || !strings.HasPrefix(followed[0], stub.URL) {
+		t.Fatal("Expected the redirect to go to the stub itself but got: ", followed)
+	}
+}
+
+func TestHarProxyCustomFields(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Test-Case") + "|" + r.Header.Get("X-Run"))
+	}))
+	defer echo.Close()
+
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	harProxy.ApplyConfig(HarProxyConfig{CustomHeaders : []CustomHeader {
+		{Header : "X-Test-Case", Field : "testCase", Strip : true},
+		{Header : "X-Run"},
+	}})
+	harProxy.SetEntryMetadata(func(req *http.Request) map[string]interface{} {
+		if req.URL.Path != "/tagged" {
+			return nil
+		}
+		return map[string]interface{}{"suite" : "smoke"}
+	})
+
+	req, _ := http.NewRequest("GET", echo.URL + "/tagged", nil)
+	req.Header.Set("X-Test-Case", "TC-1043")
+	req.Header.Set("X-Run", "7")
+	resp, err := client.Do(req)
+	testResp(t, resp, err)
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "|7" {
+		t.Fatal("Expected only the stripped header to be removed upstream but got: ", string(body))
+	}
+	resp, err = client.Get(echo.URL + "/plain")
+	testResp(t, resp, err)
+
+	var buffer bytes.Buffer
+	harProxy.WriteHar(&buffer)
+	har := struct {
+		Entries []map[string]json.RawMessage `json:"entries"`
+	}{}
+	if err := json.Unmarshal(buffer.Bytes(), &har); err != nil || len(har.Entries) != 2 {
+		t.Fatal("Expected 2 entries but got: ", buffer.String())
+	}
+	for _, entry := range har.Entries {
+		custom, ok := entry["_custom"]
+		if strings.Contains(string(entry["request"]), "/plain") {
+			if ok {
+				t.Fatal("Expected no custom fields without the headers but got: ", string(custom))
+			}
+			continue
+		}
+		fields := make(map[string]interface{})
+		json.Unmarshal(custom, &fields)
+		expected := map[string]interface{}{"testCase" : "TC-1043", "X-Run" : "7", "suite" : "smoke"}
+		if !reflect.DeepEqual(fields, expected) {
+			t.Fatalf("Expected custom fields %v but got: %s", expected, custom)
+		}
+		if strings.Contains(string(entry["request"]), "TC-1043") {
+			t.Fatal("Expected the stripped header to be missing from the recorded request")
+		}
+	}
+
+	if err := (HarProxyConfig{CustomHeaders : []CustomHeader{{Field : "name"}}}).validate(); err == nil {
+		t.Fatal("Expected error for a custom header without a header name")
+	}
+}
+
+func TestHarProxyRequestMiddleware(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Join(r.Header["X-Order"], ","))
+	}))
+	defer echo.Close()
+	echoUrl, _ := url.Parse(echo.URL)
+
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	harProxy.AddHostEntries([]ProxyHosts{{Host : "echo.invalid", NewHost : echoUrl.Host}})
+
+	appendOrder := func(name string) RequestMiddleware {
+		return func(req *http.Request) (*http.Request, *http.Response) {
+			req.Header.Add("X-Order", name + "@" + req.URL.Host)
+			return req, nil
+		}
+	}
+	reachedLast := false
+	harProxy.UseRequest(appendOrder("first"), func(req *http.Request) (*http.Request, *http.Response) {
+		if req.URL.Path == "/blocked" {
+			return req, goproxy.NewResponse(req, "text/plain", http.StatusForbidden, "blocked")
+		}
+		return req, nil
+	})
+	harProxy.UseRequest(appendOrder("last"), func(req *http.Request) (*http.Request, *http.Response) {
+		reachedLast = req.URL.Path == "/blocked"
+		return req, nil
+	})
+
+	resp, err := client.Get("http://echo.invalid/")
+	testResp(t, resp, err)
+	str, _ := ioutil.ReadAll(resp.Body)
+	expected := fmt.Sprintf("first@%v,last@%v", echoUrl.Host, echoUrl.Host)
+	if string(str) != expected {
+		t.Fatalf("Expected middlewares to run in order after host replacement [%v] but got [%v]", expected, str)
+	}
+
+	resp, err = client.Get("http://echo.invalid/blocked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden || reachedLast {
+		t.Fatal("Expected middleware response to short circuit the chain but got: ", resp.Status)
+	}
+
+	harLog := testLog(t, harProxy.NewHarReader())
+	for _, entry := range harLog.Entries() {
+		if entry.Request.Url == "http://echo.invalid/blocked" {
+			if entry.Response.Status != http.StatusForbidden || entry.Comment == "" || entry.Request.RewrittenTo != "http://" + echoUrl.Host + "/blocked" {
+				t.Fatal("Expected blocked entry to be recorded as synthetic but got: ", entry.Response.Status, entry.Comment)
+			}
+		} else if !strings.Contains(fmt.Sprint(entry.Request.Headers), "first@") {
+			t.Fatal("Expected recorded request to reflect middleware changes but got: ", entry.Request.Headers)
+		}
+	}
+	if len(harLog.Entries()) != 2 {
+		t.Fatal("Expected 2 entries but got: ", len(harLog.Entries()))
+	}
+}
+
+func TestHarProxyResponseMiddleware(t *testing.T) {
+	for _, captureBefore := range []bool{false, true} {
+		harProxy, err := NewHarProxyWithOptions(HarProxyOptions {
+			CaptureSettings : CaptureSettings{CaptureContent : true, CaptureBeforeResponseMiddleware : captureBefore},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, s := newProxyHttpTestServer(harProxy)
+		harProxy.UseResponse(func(req *http.Request, resp *http.Response) *http.Response {
+			body, _ := ioutil.ReadAll(resp.Body)
+			upper := strings.ToUpper(string(body))
+			resp.Body = ioutil.NopCloser(strings.NewReader(upper))
+			resp.ContentLength = int64(len(upper))
+			resp.Header.Set("Content-Length", strconv.Itoa(len(upper)))
+			resp.Header.Set("X-Modified", "true")
+			return resp
+		}, func(req *http.Request, resp *http.Response) *http.Response {
+			panic("middleware failure")
+		})
+
+		resp, err := client.Get(srv.URL + "/bobo")
+		testResp(t, resp, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != "BOBO" || resp.Header.Get("X-Modified") != "true" {
+			t.Fatal("Expected client to get the modified response but got: ", string(body), resp.Header)
+		}
+
+		harLog := testLog(t, harProxy.NewHarReader())
+		s.Close()
+		entry := harLog.Entries()[0]
+		modified := false
+		for _, header := range entry.Response.Headers {
+			modified = modified || header.Name == "X-Modified"
+		}
+		expectedText := "BOBO"
+		if captureBefore {
+			expectedText = "bobo"
+		}
+		if entry.Response.Content.Text != expectedText || modified == captureBefore {
+			t.Fatal("Expected HAR to record the response per capture setting but got: ", entry.Response.Content.Text, modified)
+		}
+	}
+}
+
+func TestHarProxyHandler(t *testing.T) {
+	harProxy := NewHarProxy()
+	s := httptest.NewServer(harProxy.Handler())
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := newProxyHttpTestClient(proxyUrl)
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	if err := harProxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(harProxy.HarLog.Entries()) != 1 {
+		t.Fatal("Expected entry recorded through handler but got: ", len(harProxy.HarLog.Entries()))
+	}
+
+	resp, err = client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	if len(harProxy.HarLog.Entries()) != 1 {
+		t.Fatal("Expected no recording after Close but got: ", len(harProxy.HarLog.Entries()))
+	}
+	if err := harProxy.Close(); err != ErrAlreadyStopped {
+		t.Fatal("Expected ErrAlreadyStopped but got: ", err)
+	}
+}
+
 // HarProxyServer tests
 
-func TestHarProxyServerGetProxyAndDelete(t *testing.T) {
+func TestHarProxyServerGetProxyAndDelete(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	proxyServerDeleteUrl := fmt.Sprintf("%v/proxy/%v", harProxyServer.URL, proxyServerPort.Port)
+	req , reqErr := http.NewRequest("DELETE", proxyServerDeleteUrl, nil)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	resp, respErr := testClient.Do(req)
+	testResp(t, resp, respErr)
+
+	var proxyServerMessage *ProxyServerMessage = new(ProxyServerMessage)
+	json.NewDecoder(resp.Body).Decode(proxyServerMessage)
+
+	if proxyServerMessage.Message != fmt.Sprintf("Deleted proxy for port [%v] succesfully", proxyServerPort.Port) {
+		t.Fatal("Did not get delete message")
+	}
+}
+
+func TestHarProxyServerSendInvalidMessage(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerUrl := fmt.Sprintf("%v/bla", harProxyServer.URL)
+	resp , err := testClient.Get(proxyServerUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Did not get 404 status code")
+	}
+
+	var proxyErrorMessage *ProxyServerErr = new(ProxyServerErr)
+	json.NewDecoder(resp.Body).Decode(proxyErrorMessage)
+
+	if proxyErrorMessage.Error != fmt.Sprintf("No such path: [%v]", "/bla") {
+		t.Fatal("Did not get expected error message")
+	}
+}
+
+func TestHarProxyServerGetInvalidProxy(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerHarUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, 9999)
+	req , err := http.NewRequest("PUT", proxyServerHarUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, respErr := testClient.Do(req)
+	if respErr != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Did not get 404 status code")
+	}
+
+	var proxyErrorMessage *ProxyServerErr = new(ProxyServerErr)
+	json.NewDecoder(resp.Body).Decode(proxyErrorMessage)
+
+	if proxyErrorMessage.Error != fmt.Sprintf("No proxy for port [%v]", 9999) {
+		t.Fatal("Did not get expected error message")
+	}
+}
+
+func TestHarProxyServerMalformedProxyPaths(t *testing.T) {
+	proxyServer, _ := NewProxyServerWithOptions(ProxyServerOptions{})
+	malformed := map[string]string {
+		"/proxy/" 			: "Invalid proxy port [] in path [/proxy/], expected a port from 1 to 65535",
+		"/proxy//har" 		: "Invalid proxy port [] in path [/proxy//har], expected a port from 1 to 65535",
+		"/proxy/abc/har" 	: "Invalid proxy port [abc] in path [/proxy/abc/har], expected a port from 1 to 65535",
+		"/proxy/99999999" 	: "Invalid proxy port [99999999] in path [/proxy/99999999], expected a port from 1 to 65535",
+		"/proxy/8080extra" 	: "Invalid proxy port [8080extra] in path [/proxy/8080extra], expected a port from 1 to 65535",
+		"/proxy/0/har" 		: "Invalid proxy port [0] in path [/proxy/0/har], expected a port from 1 to 65535",
+		"/proxy/65536/har" 	: "Invalid proxy port [65536] in path [/proxy/65536/har], expected a port from 1 to 65535",
+		"/proxy/-1/har" 	: "Invalid proxy port [-1] in path [/proxy/-1/har], expected a port from 1 to 65535",
+		"/proxyfoo" 		: "Invalid proxy path [/proxyfoo]",
+	}
+	for path, expected := range malformed {
+		recorder := httptest.NewRecorder()
+		proxyServer.proxyHandler(recorder, httptest.NewRequest("PUT", path, nil))
+		proxyErrorMessage := ProxyServerErr{}
+		json.NewDecoder(recorder.Body).Decode(&proxyErrorMessage)
+		if recorder.Code != http.StatusBadRequest || proxyErrorMessage.Error != expected {
+			t.Errorf("Expected 400 %q for %v but got: %v %q", expected, path, recorder.Code, proxyErrorMessage.Error)
+		}
+	}
+}
+
+func TestHarProxyServerSendInvalidProxyMessage(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	proxyServerHarUrl := fmt.Sprintf("%v/proxy/%v/bla", harProxyServer.URL, proxyServerPort.Port)
+	req , reqErr := http.NewRequest("PUT", proxyServerHarUrl, nil)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	resp, respErr := testClient.Do(req)
+	if respErr != nil {
+		t.Fatal(respErr)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Did not get 404 status code")
+	}
+
+	var proxyErrorMessage *ProxyServerErr = new(ProxyServerErr)
+	json.NewDecoder(resp.Body).Decode(proxyErrorMessage)
+
+	if proxyErrorMessage.Error != "No such path [/bla] with method PUT" {
+		t.Fatal("Did not get expected error message")
+	}
+}
+
+func TestHarProxyServerGetProxyAndEntries(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	_, err := proxiedClient.Get(srv.URL + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyServerHarUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
+	req , reqErr := http.NewRequest("PUT", proxyServerHarUrl, nil)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	resp, respErr := testClient.Do(req)
+	testResp(t, resp, respErr)
+	testLog(t, resp.Body)
+}
+
+func TestHarProxyServerGetProxyAndEntriesWithResponseContent(t *testing.T) {
+	captureContent = true
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	resp, err := proxiedClient.Get(srv.URL + "/query?result=bla")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt, err  := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("Error reading response body")
+	}
+	if string(txt) != "bla" {
+		t.Fatal("Expect to get bla in response body")
+	}
+
+	proxyServerHarUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
+	req , reqErr := http.NewRequest("PUT", proxyServerHarUrl, nil)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+
+	harLog := testLog(t, resp.Body)
+	if harLog.Entries()[0].Response.Content.Text != "bla" {
+		t.Fatal("Expect to get bla in har response")
+	}
+
+}
+
+func TestHarProxyServerGetProxyAndEntriesWithRequestPostData(t *testing.T) {
+	captureContent = true
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	resp, err := proxiedClient.Post(srv.URL + "/bobo", "form-data", strings.NewReader("bla"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyServerHarUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
+	req , reqErr := http.NewRequest("PUT", proxyServerHarUrl, nil)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+
+	harLog := testLog(t, resp.Body)
+	if harLog.Entries()[0].Request.PostData.Text!= "bla" {
+		t.Fatal("Expect to get bla in har request")
+	}
+
+}
+
+func TestHarProxyServerGetProxyChangeHost(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	proxyServerHostUrl := fmt.Sprintf("%v/proxy/%v/hosts", harProxyServer.URL, proxyServerPort.Port)
+
+	srvUrl , _ := url.Parse(srv.URL)
+	proxyHosts := []ProxyHosts{{Host : "www.google.com", NewHost : srvUrl.Host}}
+	proxyHostsJson, _ := json.Marshal(&proxyHosts)
+	buffer := bytes.NewBuffer(proxyHostsJson)
+	_, err := testClient.Post(proxyServerHostUrl, "application/json", buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := proxiedClient.Get("http://www.google.com")
+	testResp(t, resp, err)
+
+	str, _ := ioutil.ReadAll(resp.Body)
+	if string(str) != "google" {
+		t.Fatal("Failed redirecting request")
+	}
+}
+
+func TestHarProxyServerHostEntries(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	proxyServerHostUrl := fmt.Sprintf("%v/proxy/%v/hosts", harProxyServer.URL, proxyServerPort.Port)
+	proxyHosts := []ProxyHosts{{Host : "a.com", NewHost : "b.com"}, {Host : "myhosts", NewHost : "c.com"}}
+	proxyHostsJson, _ := json.Marshal(&proxyHosts)
+	resp, err := testClient.Post(proxyServerHostUrl, "application/json", bytes.NewBuffer(proxyHostsJson))
+	testResp(t, resp, err)
+
+	getHosts := func() []ProxyHosts {
+		resp, err := testClient.Get(proxyServerHostUrl)
+		testResp(t, resp, err)
+		hosts := make([]ProxyHosts, 0)
+		json.NewDecoder(resp.Body).Decode(&hosts)
+		return hosts
+	}
+	if hosts := getHosts(); !reflect.DeepEqual(hosts, proxyHosts) {
+		t.Fatal("Expected the added hosts entries but got: ", hosts)
+	}
+
+	deleteHosts := func(path string) *http.Response {
+		req, _ := http.NewRequest("DELETE", proxyServerHostUrl + path, nil)
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp = deleteHosts("/myhosts")
+	testResp(t, resp, nil)
+	if hosts := getHosts(); !reflect.DeepEqual(hosts, proxyHosts[:1]) {
+		t.Fatal("Expected only the remaining hosts entry but got: ", hosts)
+	}
+	if resp = deleteHosts("/myhosts"); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Expected 404 removing a missing hosts entry but got: ", resp.Status)
+	}
+	resp = deleteHosts("")
+	testResp(t, resp, nil)
+	if hosts := getHosts(); len(hosts) != 0 {
+		t.Fatal("Expected no hosts entries but got: ", hosts)
+	}
+}
+
+func TestHarProxyServerHostEntriesMatchTypes(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	proxyServerHostUrl := fmt.Sprintf("%v/proxy/%v/hosts", harProxyServer.URL, proxyServerPort.Port)
+
+	invalid := []byte(`[{"host" : "(a", "NewHost" : "b", "matchType" : "regex"}]`)
+	resp, err := testClient.Post(proxyServerHostUrl, "application/json", bytes.NewBuffer(invalid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatal("Expected 422 for an invalid regex but got: ", resp.Status)
+	}
+
+	srvUrl, _ := url.Parse(srv.URL)
+	proxyHosts := []ProxyHosts{{Host : "*.staging.example.com", NewHost : srvUrl.Host, MatchType : MatchWildcard}}
+	proxyHostsJson, _ := json.Marshal(&proxyHosts)
+	resp, err = testClient.Post(proxyServerHostUrl, "application/json", bytes.NewBuffer(proxyHostsJson))
+	testResp(t, resp, err)
+	resp, err = proxiedClient.Get("http://api.staging.example.com:80/bobo")
+	testResp(t, resp, err)
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "bobo" {
+		t.Fatal("Expected the wildcard entry to redirect but got: ", string(body))
+	}
+}
+
+func TestHarProxyAddHostEntriesGrowing(t *testing.T) {
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	srvUrl, _ := url.Parse(srv.URL)
+
+	// More entries than the initial capacity, added concurrently
+	const adders, perAdder = 8, 30
+	var wg sync.WaitGroup
+	for i := 0; i < adders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perAdder; j++ {
+				harProxy.AddHostEntries([]ProxyHosts{{Host : fmt.Sprintf("host%v-%v.invalid", i, j), NewHost : srvUrl.Host}})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if hostEntries := harProxy.HostEntries(); len(hostEntries) != adders * perAdder {
+		t.Fatalf("Expected %v host entries but got: %v", adders * perAdder, len(hostEntries))
+	}
+	for i := 0; i < adders; i++ {
+		for j := 0; j < perAdder; j++ {
+			resp, err := client.Get(fmt.Sprintf("http://host%v-%v.invalid/bobo", i, j))
+			testResp(t, resp, err)
+			resp.Body.Close()
+		}
+	}
+}
+
+func TestHarProxyHostEntriesConcurrent(t *testing.T) {
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	srvUrl, _ := url.Parse(srv.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			host := fmt.Sprintf("host%v.com", i)
+			for j := 0; j < 50; j++ {
+				harProxy.AddHostEntries([]ProxyHosts{{Host : host, NewHost : srvUrl.Host}})
+				harProxy.HostEntries()
+				harProxy.RemoveHostEntry(host)
+				if j % 10 == 0 {
+					harProxy.ClearHostEntries()
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				resp, err := client.Get(srv.URL + "/bobo")
+				testResp(t, resp, err)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	harProxy.ClearHostEntries()
+	harProxy.AddHostEntries([]ProxyHosts{{Host : "a.com", NewHost : "b.com"}, {Host : "a.com", NewHost : "c.com"}})
+	if !harProxy.RemoveHostEntry("a.com") || len(harProxy.HostEntries()) != 0 {
+		t.Fatal("Expected every entry for the host to be removed but got: ", harProxy.HostEntries())
+	}
+	if harProxy.RemoveHostEntry("a.com") {
+		t.Fatal("Expected removing a missing host to return false")
+	}
+}
+
+func TestHarProxyServerNamedProxy(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	resp := createNamedProxy(t, harProxyServer, testClient, "checkout-flow")
+	testResp(t, resp, nil)
+	proxyServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(proxyServerPort)
+	if proxyServerPort.Name != "checkout-flow" {
+		t.Fatal("Expected name in create response but got: ", proxyServerPort.Name)
+	}
+	defer deleteProxyPath(t, harProxyServer, testClient, "/name/checkout-flow")
+
+	resp, err := testClient.Get(harProxyServer.URL + "/proxy")
+	testResp(t, resp, err)
+	var proxyServerPorts []ProxyServerPort
+	json.NewDecoder(resp.Body).Decode(&proxyServerPorts)
+	found := false
+	for _, listed := range proxyServerPorts {
+		if listed.Port == proxyServerPort.Port && listed.Name == "checkout-flow" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Expected named proxy in listing: ", proxyServerPorts)
+	}
+
+	proxiedClient := newPortHttpTestClient(harProxyServer, proxyServerPort.Port)
+	if _, err := proxiedClient.Get(srv.URL + "/bobo"); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PUT", harProxyServer.URL + "/proxy/name/checkout-flow/har", nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	testLog(t, resp.Body)
+}
+
+func TestHarProxyServerNamedProxyDuplicate(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	resp := createNamedProxy(t, harProxyServer, testClient, "duplicate")
+	testResp(t, resp, nil)
+	defer deleteProxyPath(t, harProxyServer, testClient, "/name/duplicate")
+
+	resp = createNamedProxy(t, harProxyServer, testClient, "duplicate")
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatal("Expected 409 for duplicate name but got: ", resp.Status)
+	}
+}
+
+func TestHarProxyServerNamedProxyInvalidName(t *testing.T) {
+	proxyServer, _ := NewProxyServerWithOptions(ProxyServerOptions{})
+	harProxyServer := httptest.NewServer(proxyServer)
+	defer harProxyServer.Close()
+	testClient := &http.Client{}
+
+	// /name/[name] could never reach these
+	for _, name := range []string{"a/b", "/", " ", "\t"} {
+		resp := createNamedProxy(t, harProxyServer, testClient, name)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for name %q but got: %v", name, resp.Status)
+		}
+	}
+	if proxies := proxyServer.proxies.list(); len(proxies) != 0 {
+		t.Fatal("Expected no proxy to be created but got: ", len(proxies))
+	}
+}
+
+func TestHarProxyServerNamedProxyReuseAfterDelete(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	testResp(t, createNamedProxy(t, harProxyServer, testClient, "reused"), nil)
+	deleteProxyPath(t, harProxyServer, testClient, "/name/reused")
+
+	resp, err := testClient.Get(harProxyServer.URL + "/proxy/name/reused/har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Expected 404 for deleted name but got: ", resp.Status)
+	}
+
+	testResp(t, createNamedProxy(t, harProxyServer, testClient, "reused"), nil)
+	deleteProxyPath(t, harProxyServer, testClient, "/name/reused")
+}
+
+func TestHarProxyServerCloneProxy(t *testing.T) {
 	testClient, harProxyServer := newProxyTestServer()
 	defer harProxyServer.Close()
 
 	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
-	proxyServerDeleteUrl := fmt.Sprintf("%v/proxy/%v", harProxyServer.URL, proxyServerPort.Port)
-	req , reqErr := http.NewRequest("DELETE", proxyServerDeleteUrl, nil)
-	if reqErr != nil {
-		t.Fatal(reqErr)
+	srvUrl , _ := url.Parse(srv.URL)
+	proxyHosts := []ProxyHosts{{Host : "www.google.com", NewHost : srvUrl.Host}}
+	proxyHostsJson, _ := json.Marshal(&proxyHosts)
+	proxyServerHostUrl := fmt.Sprintf("%v/proxy/%v/hosts", harProxyServer.URL, proxyServerPort.Port)
+	resp, err := testClient.Post(proxyServerHostUrl, "application/json", bytes.NewBuffer(proxyHostsJson))
+	testResp(t, resp, err)
+
+	proxyServerCloneUrl := fmt.Sprintf("%v/proxy/%v/clone", harProxyServer.URL, proxyServerPort.Port)
+	resp, err = testClient.Post(proxyServerCloneUrl, "", nil)
+	testResp(t, resp, err)
+	cloneServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(cloneServerPort)
+	if cloneServerPort.Port == 0 || cloneServerPort.Port == proxyServerPort.Port {
+		t.Fatal("Expected clone on a new port but got: ", cloneServerPort.Port)
+	}
+
+	resp, err = newPortHttpTestClient(harProxyServer, cloneServerPort.Port).Get("http://www.google.com")
+	testResp(t, resp, err)
+	str, _ := ioutil.ReadAll(resp.Body)
+	if string(str) != "google" {
+		t.Fatal("Expected clone to redirect request using copied host entries")
+	}
+}
+
+func TestHarProxyServerConfigRoundTrip(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	config := HarProxyConfig {
+		Hosts 			: []ProxyHosts{{Host : "www.google.com", NewHost : "localhost:8080"}},
+		CaptureSettings : CaptureSettings{CaptureContent : true},
+		// With every option set, as they are exported with their defaults
+		Sink 			: &SinkOptions{Url : "http://collector.example.com/har", Headers : map[string]string{"Authorization" : "Bearer t"},
+			BatchSize : 10, FlushIntervalMs : 1000, Format : SinkFormatJsonl, MaxRetries : 2, RetryBackoffMs : 100},
+		Statsd 			: &StatsdOptions{Address : "127.0.0.1:8125", Prefix : "ci", SampleRate : 0.5, Tags : true},
+		Tracing 		: &TracingOptions{Endpoint : "http://collector.example.com/v1/traces", ServiceName : "checkout", BatchSize : 10, FlushIntervalMs : 1000},
+	}
+	body, _ := json.Marshal(&ProxyServerCreate{Config : &config})
+	resp, err := testClient.Post(harProxyServer.URL + "/proxy", "application/json", bytes.NewBuffer(body))
+	testResp(t, resp, err)
+	proxyServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(proxyServerPort)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+
+	exported := getConfigBody(t, harProxyServer, testClient, proxyServerPort.Port)
+	body = []byte(fmt.Sprintf("{\"config\": %s}", exported))
+	resp, err = testClient.Post(harProxyServer.URL + "/proxy", "application/json", bytes.NewBuffer(body))
+	testResp(t, resp, err)
+	importedServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(importedServerPort)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", importedServerPort.Port))
+
+	reexported := getConfigBody(t, harProxyServer, testClient, importedServerPort.Port)
+	if string(exported) != string(reexported) {
+		t.Fatalf("Expected identical config after round trip:\n%s\n%s", exported, reexported)
+	}
+	expected, _ := json.Marshal(&config)
+	if strings.TrimSpace(string(exported)) != string(expected) {
+		t.Fatalf("Expected exported config %s but got %s", expected, exported)
+	}
+}
+
+func TestHarProxyServerPutConfigUnknownField(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	proxyServerConfigUrl := fmt.Sprintf("%v/proxy/%v/config", harProxyServer.URL, proxyServerPort.Port)
+	req, _ := http.NewRequest("PUT", proxyServerConfigUrl, strings.NewReader(`{"hostz": []}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := testClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for unknown config field but got: ", resp.Status)
+	}
+	proxyErrorMessage := new(ProxyServerErr)
+	json.NewDecoder(resp.Body).Decode(proxyErrorMessage)
+	if !strings.Contains(proxyErrorMessage.Error, "hostz") {
+		t.Fatal("Expected error to name the unknown field but got: ", proxyErrorMessage.Error)
+	}
+
+	req, _ = http.NewRequest("PUT", proxyServerConfigUrl, strings.NewReader(`{"captureSettings": {"captureContent": true}}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	if !strings.Contains(string(getConfigBody(t, harProxyServer, testClient, proxyServerPort.Port)), `"captureContent":true`) {
+		t.Fatal("Expected PUT config to apply capture settings")
+	}
+}
+
+func TestHarProxyServerRequestBodies(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	hostsUrl := fmt.Sprintf("%v/proxy/%v/hosts", harProxyServer.URL, proxyServerPort.Port)
+
+	post := func(contentType string, body io.Reader) (int, *ProxyServerErr) {
+		req, _ := http.NewRequest("POST", hostsUrl, body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		proxyErrorMessage := new(ProxyServerErr)
+		json.NewDecoder(resp.Body).Decode(proxyErrorMessage)
+		return resp.StatusCode, proxyErrorMessage
+	}
+
+	if status, _ := post("text/plain", strings.NewReader(`[]`)); status != http.StatusUnsupportedMediaType {
+		t.Fatal("Expected 415 for a text body but got: ", status)
+	}
+	if status, _ := post("", strings.NewReader(`[]`)); status != http.StatusUnsupportedMediaType {
+		t.Fatal("Expected 415 for a body without Content-Type but got: ", status)
+	}
+	if status, _ := post("application/json", nil); status != http.StatusBadRequest {
+		t.Fatal("Expected 400 for a missing body but got: ", status)
+	}
+	status, proxyErrorMessage := post("application/json; charset=utf-8", strings.NewReader(`[{"Host": "a.com",, }]`))
+	if status != http.StatusBadRequest || !strings.Contains(proxyErrorMessage.Error, "offset 19") {
+		t.Fatal("Expected 400 naming the offset of malformed JSON but got: ", status, proxyErrorMessage.Error)
+	}
+	status, proxyErrorMessage = post("application/json", strings.NewReader(`[{"Host": 1}]`))
+	if status != http.StatusBadRequest || !strings.Contains(proxyErrorMessage.Error, "Host") {
+		t.Fatal("Expected 400 naming the mistyped field but got: ", status, proxyErrorMessage.Error)
+	}
+
+	tooLarge := io.MultiReader(strings.NewReader(`["`), strings.NewReader(strings.Repeat("a", maxRequestBodySize)), strings.NewReader(`"]`))
+	if status, _ := post("application/json", tooLarge); status != http.StatusRequestEntityTooLarge {
+		t.Fatal("Expected 413 for a body over the limit but got: ", status)
+	}
+
+	hosts := `[{"Host": "a.com", "NewHost": "b.com"}, {"Host": "", "NewHost": "b.com"}, {"Host": "(", "NewHost": "b.com", "matchType": "regex"}]`
+	status, proxyErrorMessage = post("application/json", strings.NewReader(hosts))
+	if status != http.StatusUnprocessableEntity {
+		t.Fatal("Expected 422 for invalid hosts entries but got: ", status)
+	}
+	if len(proxyErrorMessage.Items) != 2 || proxyErrorMessage.Items[0].Index != 1 || proxyErrorMessage.Items[1].Index != 2 {
+		t.Fatal("Expected errors for the second and third entries but got: ", proxyErrorMessage.Items)
+	}
+	resp, err := testClient.Get(hostsUrl)
+	testResp(t, resp, err)
+	addedHosts := make([]ProxyHosts, 0)
+	json.NewDecoder(resp.Body).Decode(&addedHosts)
+	if len(addedHosts) != 0 {
+		t.Fatal("Expected no entry to be added when one is invalid but got: ", addedHosts)
+	}
+}
+
+func getConfigBody(t *testing.T, harProxyServer *httptest.Server, testClient *http.Client, port int) []byte {
+	resp, err := testClient.Get(fmt.Sprintf("%v/proxy/%v/config", harProxyServer.URL, port))
+	testResp(t, resp, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestHarProxyServerCreateProxyPortInUse(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+
+	// The exporters of the proxy which couldn't start are released
+	body, _ := json.Marshal(&ProxyServerCreate {
+		Port 	: proxyServerPort.Port,
+		Sink 	: &SinkOptions{Url : "http://127.0.0.1:1/har"},
+		Statsd 	: &StatsdOptions{Address : "127.0.0.1:8125"},
+		Tracing : &TracingOptions{Endpoint : "http://127.0.0.1:1/v1/traces"},
+	})
+	goroutines := runtime.NumGoroutine()
+	resp, err := testClient.Post(harProxyServer.URL + "/proxy", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatal("Expected 409 for port in use but got: ", resp.Status)
+	}
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > goroutines; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no goroutine to be left but got %v instead of %v", runtime.NumGoroutine(), goroutines)
+		}
+	}
+
+	resp, err = testClient.Get(harProxyServer.URL + "/proxy")
+	testResp(t, resp, err)
+}
+
+func TestHarProxyServerBindAddress(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	body, _ := json.Marshal(&ProxyServerCreate{BindAddress : "127.0.0.1"})
+	resp, err := testClient.Post(harProxyServer.URL + "/proxy", "application/json", bytes.NewBuffer(body))
+	testResp(t, resp, err)
+	proxyServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(proxyServerPort)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	if proxyServerPort.Address != fmt.Sprintf("127.0.0.1:%v", proxyServerPort.Port) {
+		t.Fatal("Expected loopback address in create response but got: ", proxyServerPort.Address)
+	}
+
+	conn, err := net.Dial("tcp", proxyServerPort.Address)
+	if err != nil {
+		t.Fatal("Expected loopback connection to succeed but got: ", err)
+	}
+	conn.Close()
+
+	if ip := nonLoopbackIp(); ip != nil {
+		if conn, err := net.Dial("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(proxyServerPort.Port))); err == nil {
+			conn.Close()
+			t.Fatal("Expected connection through non loopback address to fail")
+		}
+	}
+
+	for _, bindAddress := range []string{"not an address", "192.0.2.1"} {
+		body, _ := json.Marshal(&ProxyServerCreate{BindAddress : bindAddress})
+		resp, err := testClient.Post(harProxyServer.URL + "/proxy", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for bind address [%v] but got: %v", bindAddress, resp.Status)
+		}
+	}
+}
+
+func nonLoopbackIp() net.IP {
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
+
+func TestProxyServerTLS(t *testing.T) {
+	certFile, keyFile, _ := writeSelfSignedCert(t, "server")
+	proxyServer := startProxyServer(t, ProxyServerOptions{CertFile : certFile, KeyFile : keyFile})
+	defer proxyServer.Shutdown(context.Background())
+	serverUrl := "https://" + proxyServer.Addr().String()
+	client := &http.Client{Transport : &http.Transport{TLSClientConfig : acceptAllCerts}}
+
+	resp, err := client.Post(serverUrl + "/proxy", "application/json", nil)
+	testResp(t, resp, err)
+	proxyServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(proxyServerPort)
+
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("%v/proxy/%v/har", serverUrl, proxyServerPort.Port), nil)
+	resp, err = client.Do(req)
+	testResp(t, resp, err)
+	harLog := new(HarLog)
+	if err := json.NewDecoder(resp.Body).Decode(harLog); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("%v/proxy/%v", serverUrl, proxyServerPort.Port), nil)
+	resp, err = client.Do(req)
+	testResp(t, resp, err)
+
+	resp, err = http.Get("http://" + proxyServer.Addr().String() + "/proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected plain HTTP to be rejected with 400 but got: ", resp.Status)
+	}
+}
+
+func TestProxyServerMutualTLS(t *testing.T) {
+	certFile, keyFile, _ := writeSelfSignedCert(t, "server")
+	clientCertFile, clientKeyFile, clientCert := writeSelfSignedCert(t, "client")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	proxyServer := startProxyServer(t, ProxyServerOptions{CertFile : certFile, KeyFile : keyFile, ClientCAs : clientCAs})
+	defer proxyServer.Shutdown(context.Background())
+	serverUrl := "https://" + proxyServer.Addr().String() + "/proxy"
+
+	client := &http.Client{Transport : &http.Transport{TLSClientConfig : acceptAllCerts}}
+	if resp, err := client.Get(serverUrl); err == nil {
+		t.Fatal("Expected request without client certificate to fail but got: ", resp.Status)
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport : &http.Transport{TLSClientConfig : &tls.Config {
+		InsecureSkipVerify 	: true,
+		Certificates 		: []tls.Certificate{keyPair},
+	}}}
+	resp, err := client.Get(serverUrl)
+	testResp(t, resp, err)
+}
+
+func TestProxyServerOptionsInvalid(t *testing.T) {
+	certFile, keyFile, _ := writeSelfSignedCert(t, "server")
+	for _, opts := range []ProxyServerOptions {
+		{Port : -1},
+		{CertFile : certFile},
+		{ClientCAs : x509.NewCertPool()},
+		{RedirectHTTPPort : 8081},
+		{CertFile : certFile, KeyFile : certFile},
+	} {
+		if _, err := NewProxyServerWithOptions(opts); err == nil {
+			t.Errorf("Expected error for options %+v", opts)
+		}
+	}
+	if _, err := NewProxyServerWithOptions(ProxyServerOptions{CertFile : certFile, KeyFile : keyFile}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHttpsRedirectHandler(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost:8081/proxy?a=b", nil)
+	recorder := httptest.NewRecorder()
+	httpsRedirectHandler(8443).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusPermanentRedirect {
+		t.Fatal("Expected redirect but got: ", recorder.Code)
+	}
+	if location := recorder.Header().Get("Location"); location != "https://localhost:8443/proxy?a=b" {
+		t.Fatal("Unexpected redirect location: ", location)
+	}
+}
+
+func TestProxyServerStartAndShutdown(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	proxyServer := startProxyServer(t, ProxyServerOptions{})
+	if proxyServer.Addr() == nil || GetPort(proxyServer.listener) == 0 {
+		t.Fatal("Expected the server to listen on a free port but got: ", proxyServer.Addr())
+	}
+	if err := proxyServer.Start(); err != ErrAlreadyStarted {
+		t.Fatal("Expected ErrAlreadyStarted but got: ", err)
+	}
+	serverUrl := "http://" + proxyServer.Addr().String() + "/proxy"
+	client := &http.Client{Transport : &http.Transport{}}
+
+	resp, err := client.Post(serverUrl, "application/json", nil)
+	testResp(t, resp, err)
+	proxyServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(proxyServerPort)
+	resp.Body.Close()
+
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", proxyServerPort.Port))
+	proxyClient := newProxyHttpTestClient(proxyUrl)
+	resp, err = proxyClient.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	resp.Body.Close()
+
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("%v/%v/har", serverUrl, proxyServerPort.Port), nil)
+	resp, err = client.Do(req)
+	testResp(t, resp, err)
+	harLog := new(HarLog)
+	json.NewDecoder(resp.Body).Decode(harLog)
+	resp.Body.Close()
+	if len(harLog.Entries()) != 1 {
+		t.Fatal("Expected 1 entry but got: ", len(harLog.Entries()))
+	}
+
+	// The proxy left running is shut down with the server
+	resp, err = client.Post(serverUrl, "application/json", nil)
+	testResp(t, resp, err)
+	resp.Body.Close()
+	client.CloseIdleConnections()
+	proxyClient.CloseIdleConnections()
+
+	if err := proxyServer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxyServer.Shutdown(context.Background()); err != ErrAlreadyStopped {
+		t.Fatal("Expected ErrAlreadyStopped but got: ", err)
+	}
+	if _, err := client.Get(serverUrl); err == nil {
+		t.Fatal("Expected the server to stop listening")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runtime.NumGoroutine() > goroutines {
+		t.Fatalf("Expected at most %v goroutines after shutdown but got: %v", goroutines, runtime.NumGoroutine())
+	}
+}
+
+func TestProxyServerShutdownBeforeStart(t *testing.T) {
+	proxyServer, err := NewProxyServerWithOptions(ProxyServerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyServer.Addr() != nil {
+		t.Fatal("Expected no address before Start but got: ", proxyServer.Addr())
+	}
+	if err := proxyServer.Shutdown(context.Background()); err != ErrNotStarted {
+		t.Fatal("Expected ErrNotStarted but got: ", err)
+	}
+}
+
+func TestProxyServerUI(t *testing.T) {
+	testClient, harProxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+	testClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := testClient.Get(harProxyServer.URL + "/ui")
+	if err != nil || resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/ui/" {
+		t.Fatal("Expected /ui to redirect to /ui/ but got: ", resp.Status)
 	}
-	resp, respErr := testClient.Do(req)
-	testResp(t, resp, respErr)
 
-	var proxyServerMessage *ProxyServerMessage = new(ProxyServerMessage)
-	json.NewDecoder(resp.Body).Decode(proxyServerMessage)
+	resp, err = testClient.Get(harProxyServer.URL + "/ui/")
+	testResp(t, resp, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	etag := resp.Header.Get("ETag")
+	if !strings.Contains(string(body), `<script src="app.js">`) || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+			etag == "" || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("Expected the viewer's page, to revalidate, but got %v: %s", resp.Header, body)
+	}
+	req, _ := http.NewRequest("GET", harProxyServer.URL + "/ui/", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = testClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNotModified {
+		t.Fatal("Expected the unchanged page not to be sent again but got: ", resp.Status)
+	}
 
-	if proxyServerMessage.Message != fmt.Sprintf("Deleted proxy for port [%v] succesfully", proxyServerPort.Port) {
-		t.Fatal("Did not get delete message")
+	for _, file := range []string{"app.js", "style.css"} {
+		resp, err = testClient.Get(harProxyServer.URL + "/ui/" + file)
+		testResp(t, resp, err)
+		if resp.Header.Get("ETag") == "" || resp.Header.Get("ETag") == etag {
+			t.Fatalf("Expected an ETag of %v but got: %v", file, resp.Header.Get("ETag"))
+		}
+	}
+	resp, err = testClient.Get(harProxyServer.URL + "/ui/missing.js")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Expected 404 for a missing file but got: ", resp.Status)
 	}
 }
 
-func TestHarProxyServerSendInvalidMessage(t *testing.T) {
+func TestHarProxyServerStream(t *testing.T) {
 	testClient, harProxyServer := newProxyTestServer()
 	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
 
-	proxyServerUrl := fmt.Sprintf("%v/bla", harProxyServer.URL)
-	resp , err := testClient.Get(proxyServerUrl)
-	if err != nil {
-		t.Fatal(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%v/proxy/%v/har/stream", harProxyServer.URL, proxyServerPort.Port), nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := testClient.Do(req)
+	testResp(t, resp, err)
+	if resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatal("Expected an uncompressed event stream but got: ", resp.Header)
 	}
-	if resp.StatusCode != http.StatusNotFound {
-		t.Fatal("Did not get 404 status code")
+	events := bufio.NewReader(resp.Body)
+	// The stream is open once its first comment arrives
+	if line, err := events.ReadString('\n'); err != nil || !strings.HasPrefix(line, ":") {
+		t.Fatal("Expected the opening comment but got: ", line, err)
 	}
 
-	var proxyErrorMessage *ProxyServerErr = new(ProxyServerErr)
-	json.NewDecoder(resp.Body).Decode(proxyErrorMessage)
-
-	if proxyErrorMessage.Error != fmt.Sprintf("No such path: [%v]", "/bla") {
-		t.Fatal("Did not get expected error message")
+	resp, err = proxiedClient.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	for {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		entry := HarEntry{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &entry); err != nil || entry.Request.Url != srv.URL + "/bobo" {
+			t.Fatal("Expected the entry as event data but got: ", line)
+		}
+		break
 	}
 }
 
-func TestHarProxyServerGetInvalidProxy(t *testing.T) {
-	testClient, harProxyServer := newProxyTestServer()
+func TestHarProxyServerHarWindow(t *testing.T) {
+	start := time.Date(2026, 3, 1, 14, 2, 0, 0, time.UTC)
+	clock := testutil.NewFakeClock(start)
+	testClient, harProxyServer := newProxyTestServerWithOptions(ProxyServerOptions{Clock : clock})
 	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	harUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
+	// A request a minute, from 14:02
+	for _, path := range []string{"/bobo", "/query?result=a", "/bobo?b", "/query?result=c"} {
+		resp, err := proxiedClient.Get(srv.URL + path)
+		testResp(t, resp, err)
+		resp.Body.Close()
+		clock.Advance(time.Minute)
+	}
+	get := func(query string) (*http.Response, []HarEntry) {
+		t.Helper()
+		resp, err := testClient.Get(harUrl + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		harLog := HarLog{}
+		json.NewDecoder(resp.Body).Decode(&harLog)
+		entries := harLog.Entries()
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+		})
+		return resp, entries
+	}
 
-	proxyServerHarUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, 9999)
-	req , err := http.NewRequest("PUT", proxyServerHarUrl, nil)
-	if err != nil {
-		t.Fatal(err)
+	resp, entries := get("?from=2026-03-01T14:03:00Z&to=" + strconv.FormatInt(start.Add(3 * time.Minute).UnixNano() / 1e6, 10))
+	if len(entries) != 2 || entries[0].Request.Url != srv.URL + "/query?result=a" || entries[1].Request.Url != srv.URL + "/bobo?b" || resp.Header.Get("X-Total-Entries") != "2" {
+		t.Fatalf("Expected the entries started from 14:03 and before 14:05 but got: %v %+v", resp.Header, entries)
 	}
-	resp, respErr := testClient.Do(req)
-	if respErr != nil {
-		t.Fatal(err)
+	if _, entries = get("?from=2026-03-01T14:03:00.000000001Z&urlPattern=query"); len(entries) != 1 || entries[0].Request.Url != srv.URL + "/query?result=c" {
+		t.Fatalf("Expected the window combined with the url pattern but got: %+v", entries)
 	}
-	if resp.StatusCode != http.StatusNotFound {
-		t.Fatal("Did not get 404 status code")
+	resp, entries = get("?to=2026-03-01T14:05:00Z&offset=1&limit=1")
+	if len(entries) != 1 || entries[0].Request.Url != srv.URL + "/query?result=a" || resp.Header.Get("X-Total-Entries") != "3" {
+		t.Fatalf("Expected the second page of one entry but got: %v %+v", resp.Header, entries)
+	}
+	if _, entries = get(""); len(entries) != 4 {
+		t.Fatal("Expected the filtered gets not to clear the entries but got: ", len(entries))
 	}
 
-	var proxyErrorMessage *ProxyServerErr = new(ProxyServerErr)
-	json.NewDecoder(resp.Body).Decode(proxyErrorMessage)
-
-	if proxyErrorMessage.Error != fmt.Sprintf("No proxy for port [%v]", 9999) {
-		t.Fatal("Did not get expected error message")
+	for _, query := range []string{"?from=14:02", "?to=yesterday", "?limit=-1", "?offset=x", "?urlPattern=("} {
+		if resp, _ := get(query); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v but got: %v", query, resp.Status)
+		}
+	}
+	req, _ := http.NewRequest("PUT", harUrl + "?from=2026-03-01T14:03:00Z", nil)
+	resp, err := testClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400 for clearing part of the entries but got: ", resp.Status)
 	}
 }
 
-func TestHarProxyServerSendInvalidProxyMessage(t *testing.T) {
+// Streams an entry, looks it up by its id, and checks that ids aren't reused once the log was cleared
+func TestHarProxyServerHarEntry(t *testing.T) {
 	testClient, harProxyServer := newProxyTestServer()
 	defer harProxyServer.Close()
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+	entryUrl := func(id interface{}) string {
+		return fmt.Sprintf("%v/proxy/%v/har/entry/%v", harProxyServer.URL, proxyServerPort.Port, id)
+	}
 
-	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
-	proxyServerHarUrl := fmt.Sprintf("%v/proxy/%v/bla", harProxyServer.URL, proxyServerPort.Port)
-	req , reqErr := http.NewRequest("PUT", proxyServerHarUrl, nil)
-	if reqErr != nil {
-		t.Fatal(reqErr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%v/proxy/%v/har/stream", harProxyServer.URL, proxyServerPort.Port), nil)
+	resp, err := testClient.Do(req)
+	testResp(t, resp, err)
+	events := bufio.NewReader(resp.Body)
+	if line, err := events.ReadString('\n'); err != nil || !strings.HasPrefix(line, ":") {
+		t.Fatal("Expected the opening comment but got: ", line, err)
 	}
-	resp, respErr := testClient.Do(req)
-	if respErr != nil {
-		t.Fatal(respErr)
+	for _, path := range []string{"/bobo", "/query?result=hi"} {
+		resp, err = proxiedClient.Get(srv.URL + path)
+		testResp(t, resp, err)
+		resp.Body.Close()
 	}
-	if resp.StatusCode != http.StatusNotFound {
-		t.Fatal("Did not get 404 status code")
+	var eventIds []string
+	var streamed []HarEntry
+	for len(streamed) < 2 {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "id: ") {
+			eventIds = append(eventIds, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+		} else if strings.HasPrefix(line, "data: ") {
+			entry := HarEntry{}
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &entry)
+			streamed = append(streamed, entry)
+		}
+	}
+	ids := map[int64]bool{streamed[0].Id : true, streamed[1].Id : true}
+	if !ids[1] || !ids[2] || len(eventIds) != 2 || eventIds[0] != strconv.FormatInt(streamed[0].Id, 10) || eventIds[1] != strconv.FormatInt(streamed[1].Id, 10) {
+		t.Fatalf("Expected the entries' ids 1 and 2 as event ids but got: %v, %v and %v", eventIds, streamed[0].Id, streamed[1].Id)
 	}
 
-	var proxyErrorMessage *ProxyServerErr = new(ProxyServerErr)
-	json.NewDecoder(resp.Body).Decode(proxyErrorMessage)
+	resp, err = testClient.Get(entryUrl(streamed[1].Id))
+	testResp(t, resp, err)
+	entry := HarEntry{}
+	json.NewDecoder(resp.Body).Decode(&entry)
+	if entry.Id != streamed[1].Id || entry.Request.Url != streamed[1].Request.Url {
+		t.Fatalf("Expected the streamed entry but got: %+v", entry)
+	}
 
-	if proxyErrorMessage.Error != "No such path [/bla] with method PUT" {
-		t.Fatal("Did not get expected error message")
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port), nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = testClient.Get(entryUrl(streamed[1].Id))
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Expected 404 for a cleared entry but got: ", resp.Status)
+	}
+	resp, err = proxiedClient.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	resp.Body.Close()
+	line := ""
+	for !strings.HasPrefix(line, "id: ") {
+		if line, err = events.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if line != "id: 3\n" {
+		t.Fatal("Expected the next id after the cleared ones but got: ", line)
+	}
+	resp, err = testClient.Get(entryUrl(3))
+	testResp(t, resp, err)
+	for _, invalid := range []string{"abc", "0"} {
+		if resp, err = testClient.Get(entryUrl(invalid)); err != nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for entry id %v but got: %v", invalid, resp.Status)
+		}
 	}
 }
 
-func TestHarProxyServerGetProxyAndEntries(t *testing.T) {
-	testClient, harProxyServer := newProxyTestServer()
+func TestProxyServerLogger(t *testing.T) {
+	logger := &capturingLogger{}
+	proxyServer, err := NewProxyServerWithOptions(ProxyServerOptions{Logger : logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	harProxyServer := httptest.NewServer(proxyServer)
 	defer harProxyServer.Close()
+	testClient := &http.Client{}
 
-	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
-	_, err := proxiedClient.Get(srv.URL + "/bobo")
+	resp, err := testClient.Post(harProxyServer.URL + "/proxy", "application/json", nil)
+	testResp(t, resp, err)
+	proxyServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(proxyServerPort)
+	client := newPortHttpTestClient(harProxyServer, proxyServerPort.Port)
+	resp, err = client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port), nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = testClient.Get(harProxyServer.URL + "/proxy/9999/har")
 	if err != nil {
 		t.Fatal(err)
 	}
+	deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
 
-	proxyServerHarUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
-	req , reqErr := http.NewRequest("PUT", proxyServerHarUrl, nil)
-	if reqErr != nil {
-		t.Fatal(reqErr)
+	if !logger.logged("debug", fmt.Sprintf("Serving 1 entries of proxy on port :%v", proxyServerPort.Port)) {
+		t.Error("Expected the served HAR log at debug level")
+	}
+	if !logger.logged("debug", "Added entry " + srv.URL + "/bobo") {
+		t.Error("Expected the proxy to log added entries at debug level")
+	}
+	if !logger.logged("info", "Got request to start new proxy") {
+		t.Error("Expected proxy creation at info level")
+	}
+	if !logger.logged("error", "[No proxy for port [9999]]") {
+		t.Error("Expected the failed request at error level")
+	}
+	if logger.logged("info", "Serving ") || logger.logged("error", "Serving ") {
+		t.Error("Expected the served HAR log at debug level only")
 	}
-	resp, respErr := testClient.Do(req)
-	testResp(t, resp, respErr)
-	testLog(t, resp.Body)
 }
 
-func TestHarProxyServerGetProxyAndEntriesWithResponseContent(t *testing.T) {
-	captureContent = true
-	testClient, harProxyServer := newProxyTestServer()
-	defer harProxyServer.Close()
+// Collects the lines a JsonLogger writes, while it may still be writing
+type jsonLines struct {
+	lock sync.Mutex
+	output bytes.Buffer
+}
 
-	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
-	resp, err := proxiedClient.Get(srv.URL + "/query?result=bla")
-	if err != nil {
+func (lines *jsonLines) Write(p []byte) (int, error) {
+	lines.lock.Lock()
+	defer lines.lock.Unlock()
+	return lines.output.Write(p)
+}
+
+func (lines *jsonLines) parse(t *testing.T) []map[string]interface{} {
+	lines.lock.Lock()
+	defer lines.lock.Unlock()
+	var parsed []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(lines.output.String(), "\n"), "\n") {
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("Expected a JSON line but got: %v", line)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(fields["time"])); err != nil || fields["level"] == nil || fields["event"] == nil {
+			t.Fatalf("Expected time, level and event in every line but got: %v", line)
+		}
+		parsed = append(parsed, fields)
+	}
+	return parsed
+}
+
+func TestJsonLogger(t *testing.T) {
+	lines := &jsonLines{}
+	harProxy, _ := NewHarProxyWithOptions(HarProxyOptions{Logger : NewJsonLogger(lines, LevelDebug), AccessLog : true})
+	if err := harProxy.Start(); err != nil {
 		t.Fatal(err)
 	}
-	txt, err  := ioutil.ReadAll(resp.Body)
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	var access, added map[string]interface{}
+	for _, fields := range lines.parse(t) {
+		if fields["port"] != float64(harProxy.Port) {
+			t.Fatal("Expected the proxy's port in every line but got: ", fields)
+		}
+		switch {
+		case fields["event"] == "request":
+			access = fields
+		case fields["event"] == "log" && fields["message"] == "Added entry " + srv.URL + "/bobo":
+			added = fields
+		}
+	}
+	if access == nil || access["level"] != LevelInfo || access["method"] != "GET" || access["url"] != srv.URL + "/bobo" || access["status"] != float64(200) || access["durationMs"] == nil {
+		t.Fatal("Expected an access log of the request but got: ", access)
+	}
+	if added == nil || added["level"] != LevelDebug {
+		t.Fatal("Expected the added entry logged at debug level but got: ", added)
+	}
+}
+
+func TestJsonLoggerLevels(t *testing.T) {
+	lines := &jsonLines{}
+	proxyServer, _ := NewProxyServerWithOptions(ProxyServerOptions{Logger : NewJsonLogger(lines, LevelError), AccessLog : true})
+	harProxyServer := httptest.NewServer(proxyServer)
+	defer harProxyServer.Close()
+	testClient := &http.Client{}
+	proxyServerPort, client := getProxiedClient(t, harProxyServer, testClient)
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	resp, err = testClient.Get(harProxyServer.URL + "/proxy/9999/har")
 	if err != nil {
-		t.Fatal("Error reading response body")
+		t.Fatal(err)
 	}
-	if string(txt) != "bla" {
-		t.Fatal("Expect to get bla in response body")
+	deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", proxyServerPort.Port))
+
+	events := []string{}
+	for _, fields := range lines.parse(t) {
+		if fields["event"] == "log" && fields["level"] != LevelError {
+			t.Fatal("Expected only errors besides access logs but got: ", fields)
+		}
+		switch fields["event"] {
+		case "log":
+			events = append(events, "error")
+		case "request":
+			events = append(events, fmt.Sprintf("request %v %v %v", fields["port"], fields["url"], fields["status"]))
+		case "apiRequest":
+			_, hasPort := fields["port"]
+			events = append(events, fmt.Sprintf("apiRequest %v %v %v %v", fields["method"], fields["url"], fields["status"], hasPort))
+		}
+	}
+	expected := []string {
+		"apiRequest POST /proxy 200 false",
+		fmt.Sprintf("request %v %v/bobo 200", proxyServerPort.Port, srv.URL),
+		"error",
+		"apiRequest GET /proxy/9999/har 404 false",
+		fmt.Sprintf("apiRequest DELETE /proxy/%v 200 false", proxyServerPort.Port),
 	}
+	// The proxied request is logged once recorded, in the background
+	sort.Strings(events)
+	sort.Strings(expected)
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected access logs of the proxied and API requests but got:\n%v", strings.Join(events, "\n"))
+	}
+}
 
-	proxyServerHarUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
-	req , reqErr := http.NewRequest("PUT", proxyServerHarUrl, nil)
-	if reqErr != nil {
-		t.Fatal(reqErr)
+func TestHarProxyNopLogger(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	// goproxy logs to the stderr it was created with by default
+	stderr, stderrPipe, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
 	}
-	resp, err = testClient.Do(req)
+	realStderr := os.Stderr
+	os.Stderr = stderrPipe
+	harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger})
+	os.Stderr = realStderr
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := harProxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxyUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+	resp, err := client.Get(srv.URL + "/bobo")
 	testResp(t, resp, err)
+	harProxy.OnEntry(func(HarEntry) {
+		panic("callback failure")
+	})
+	resp, err = client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	// Failing round trips, through the proxy and through goproxy's CONNECT tunnel
+	closed := httptest.NewServer(nil)
+	closed.Close()
+	for _, failing := range []string{closed.URL, strings.Replace(closed.URL, "http:", "https:", 1)} {
+		if resp, err := client.Get(failing); err == nil {
+			resp.Body.Close()
+		}
+	}
+	harProxy.WaitForEntries(context.Background())
+	if err := harProxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
 
-	harLog := testLog(t, resp.Body)
-	if harLog.Entries[0].Response.Content.Text != "bla" {
-		t.Fatal("Expect to get bla in har response")
+	// newProxyHttpTestClient logs the proxy url itself
+	if logged := strings.Replace(output.String(), fmt.Sprintf("%v\n", proxyUrl), "", 1); strings.Contains(logged, "\n") {
+		t.Fatal("Expected no output with NopLogger but got: ", logged)
 	}
+	stderrPipe.Close()
+	if logged, _ := ioutil.ReadAll(stderr); len(logged) > 0 {
+		t.Fatal("Expected no output on stderr with NopLogger but got: ", string(logged))
+	}
+}
 
+type capturingLogger struct {
+	lock sync.Mutex
+	lines []string
 }
 
-func TestHarProxyServerGetProxyAndEntriesWithRequestPostData(t *testing.T) {
-	captureContent = true
-	testClient, harProxyServer := newProxyTestServer()
-	defer harProxyServer.Close()
+func (logger *capturingLogger) log(level, format string, args ...interface{}) {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.lines = append(logger.lines, level + " " + fmt.Sprintf(format, args...))
+}
 
-	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
-	resp, err := proxiedClient.Post(srv.URL + "/bobo", "form-data", strings.NewReader("bla"))
+func (logger *capturingLogger) Debugf(format string, args ...interface{}) {
+	logger.log("debug", format, args...)
+}
+
+func (logger *capturingLogger) Infof(format string, args ...interface{}) {
+	logger.log("info", format, args...)
+}
+
+func (logger *capturingLogger) Errorf(format string, args ...interface{}) {
+	logger.log("error", format, args...)
+}
+
+func (logger *capturingLogger) logged(level, prefix string) bool {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	for _, line := range logger.lines {
+		if strings.HasPrefix(line, level + " " + prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProxyServerMetrics(t *testing.T) {
+	proxyServer, err := NewProxyServerWithOptions(ProxyServerOptions{EnableMetrics : true})
 	if err != nil {
 		t.Fatal(err)
 	}
+	harProxyServer := httptest.NewServer(proxyServer)
+	defer harProxyServer.Close()
+	testClient := &http.Client{}
 
-	proxyServerHarUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, proxyServerPort.Port)
-	req , reqErr := http.NewRequest("PUT", proxyServerHarUrl, nil)
-	if reqErr != nil {
-		t.Fatal(reqErr)
-	}
-	resp, err = testClient.Do(req)
+	resp, err := testClient.Post(harProxyServer.URL + "/proxy", "application/json", nil)
 	testResp(t, resp, err)
+	proxyServerPort := new(ProxyServerPort)
+	json.NewDecoder(resp.Body).Decode(proxyServerPort)
+	port := proxyServerPort.Port
+	defer deleteProxyPath(t, harProxyServer, testClient, fmt.Sprintf("/%v", port))
 
-	harLog := testLog(t, resp.Body)
-	if harLog.Entries[0].Request.PostData.Text!= "bla" {
-		t.Fatal("Expect to get bla in har request")
+	harProxy := proxyServer.proxies.get(port)
+	harProxy.UseRequest(func(req *http.Request) (*http.Request, *http.Response) {
+		if req.URL.Path == "/missing" {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNotFound, "missing")
+		}
+		return req, nil
+	})
+	closed := httptest.NewServer(nil)
+	closed.Close()
+
+	client := newPortHttpTestClient(harProxyServer, port)
+	for _, target := range []string{srv.URL + "/bobo", srv.URL + "/bobo", srv.URL + "/missing", closed.URL} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 	}
+	harProxy.WaitForEntries(context.Background())
 
-}
+	resp, err = testClient.Get(harProxyServer.URL + "/metrics")
+	testResp(t, resp, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	metrics := string(body)
+	for _, expected := range []string {
+		"goharproxy_active_proxies 1",
+		fmt.Sprintf("goharproxy_requests_total{port=\"%v\",class=\"2xx\"} 2", port),
+		fmt.Sprintf("goharproxy_requests_total{port=\"%v\",class=\"4xx\"} 1", port),
+		fmt.Sprintf("goharproxy_requests_total{port=\"%v\",class=\"5xx\"} 0", port),
+		fmt.Sprintf("goharproxy_requests_total{port=\"%v\",class=\"error\"} 1", port),
+		fmt.Sprintf("goharproxy_request_duration_seconds_bucket{port=\"%v\",le=\"+Inf\"} 4", port),
+		fmt.Sprintf("goharproxy_request_duration_seconds_count{port=\"%v\"} 4", port),
+		fmt.Sprintf("goharproxy_response_bytes_total{port=\"%v\"} %v", port, 2 * len("bobo") + len("missing")),
+		fmt.Sprintf("goharproxy_in_flight_requests{port=\"%v\"} 0", port),
+		fmt.Sprintf("goharproxy_entries{port=\"%v\"} 4", port),
+	} {
+		if !strings.Contains(metrics, expected + "\n") {
+			t.Errorf("Expected metrics to contain [%v] but got:\n%v", expected, metrics)
+		}
+	}
 
-func TestHarProxyServerGetProxyChangeHost(t *testing.T) {
-	testClient, harProxyServer := newProxyTestServer()
-	defer harProxyServer.Close()
+	withoutMetrics, _ := NewProxyServerWithOptions(ProxyServerOptions{})
+	recorder := httptest.NewRecorder()
+	withoutMetrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatal("Expected no metrics endpoint unless enabled but got: ", recorder.Code)
+	}
+}
 
-	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
-	proxyServerHostUrl := fmt.Sprintf("%v/proxy/%v/hosts", harProxyServer.URL, proxyServerPort.Port)
+func startProxyServer(t *testing.T, opts ProxyServerOptions) *ProxyServer {
+	proxyServer, err := NewProxyServerWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxyServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return proxyServer
+}
 
-	srvUrl , _ := url.Parse(srv.URL)
-	proxyHosts := []ProxyHosts{{Host : "www.google.com", NewHost : srvUrl.Host}}
-	proxyHostsJson, _ := json.Marshal(&proxyHosts)
-	buffer := bytes.NewBuffer(proxyHostsJson)
-	_, err := testClient.Post(proxyServerHostUrl, "application/json", buffer)
+// Writes a self signed certificate and its key to PEM files
+func writeSelfSignedCert(t *testing.T, name string) (certFile, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate {
+		SerialNumber 	: big.NewInt(1),
+		Subject 		: pkix.Name{CommonName : name},
+		NotBefore 		: time.Now().Add(-time.Hour),
+		NotAfter 		: time.Now().Add(time.Hour),
+		IPAddresses 	: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage 		: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage 	: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA 			: true,
+		BasicConstraintsValid : true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
 	if err != nil {
 		t.Fatal(err)
 	}
-	resp, err := proxiedClient.Get("http://www.google.com")
-	testResp(t, resp, err)
 
-	str, _ := ioutil.ReadAll(resp.Body)
-	if string(str) != "google" {
-		t.Fatal("Failed redirecting request")
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, name + ".crt")
+	keyFile = filepath.Join(dir, name + ".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type : "CERTIFICATE", Bytes : der}), 0600); err != nil {
+		t.Fatal(err)
 	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type : "EC PRIVATE KEY", Bytes : keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
 }
 
 func getProxiedClient(t *testing.T, harProxyServer *httptest.Server, testClient *http.Client) (proxyServerPort *ProxyServerPort, client *http.Client) {
@@ -286,17 +7362,39 @@ func getProxiedClient(t *testing.T, harProxyServer *httptest.Server, testClient
 		log.Fatal(e)
 	}
 
-	host, _, _ := net.SplitHostPort(harProxyServer.URL)
-	proxyUrl, _ := url.Parse(host + ":" + strconv.Itoa(proxyServerPort.Port))
-	client = newProxyHttpTestClient(proxyUrl)
+	client = newPortHttpTestClient(harProxyServer, proxyServerPort.Port)
 	return
 }
 
+func newPortHttpTestClient(harProxyServer *httptest.Server, port int) *http.Client {
+	serverUrl, _ := url.Parse(harProxyServer.URL)
+	proxyUrl, _ := url.Parse("http://" + net.JoinHostPort(serverUrl.Hostname(), strconv.Itoa(port)))
+	return newProxyHttpTestClient(proxyUrl)
+}
+
+func createNamedProxy(t *testing.T, harProxyServer *httptest.Server, testClient *http.Client, name string) *http.Response {
+	body, _ := json.Marshal(&ProxyServerCreate{Name : name})
+	resp, err := testClient.Post(harProxyServer.URL + "/proxy", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func deleteProxyPath(t *testing.T, harProxyServer *httptest.Server, testClient *http.Client, path string) {
+	req, err := http.NewRequest("DELETE", harProxyServer.URL + "/proxy" + path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := testClient.Do(req)
+	testResp(t, resp, err)
+}
+
 func testLog(t *testing.T, r io.Reader) *HarLog{
 	var harLog *HarLog = new(HarLog)
 	json.NewDecoder(r).Decode(harLog)
-	log.Printf("Har entries len: %v", len(harLog.Entries))
-	if len(harLog.Entries) == 0 {
+	log.Printf("Har entries len: %v", len(harLog.Entries()))
+	if len(harLog.Entries()) == 0 {
 		t.Fatal("Didn't get valid har entries")
 	}
 	return harLog
@@ -318,7 +7416,12 @@ func oneShotProxy() (client *http.Client, harProxy *HarProxy, s *httptest.Server
 }
 
 func newProxyTestServer() (client *http.Client, s *httptest.Server) {
-	s = httptest.NewServer(http.HandlerFunc(proxyHandler))
+	return newProxyTestServerWithOptions(ProxyServerOptions{})
+}
+
+func newProxyTestServerWithOptions(opts ProxyServerOptions) (client *http.Client, s *httptest.Server) {
+	proxyServer, _ := NewProxyServerWithOptions(opts)
+	s = httptest.NewServer(proxyServer)
 
 	tr := &http.Transport{TLSClientConfig: acceptAllCerts}
 	client = &http.Client{Transport: tr}
@@ -338,3 +7441,199 @@ func newProxyHttpTestClient(proxyUrl *url.URL) (client *http.Client) {
 	client = &http.Client{Transport: tr}
 	return
 }
+
+// Records bursts of 10k entries with the default pool and with a worker per entry, as when every
+// entry got its own goroutine, reporting the peak number of goroutines
+func BenchmarkHarProxyEntryBurst(b *testing.B) {
+	const burst = 10000
+	for _, entryWorkers := range []int{DefaultEntryWorkers(), burst} {
+		b.Run(fmt.Sprintf("workers-%v", entryWorkers), func(b *testing.B) {
+			b.ReportAllocs()
+			peak := 0
+			for i := 0; i < b.N; i++ {
+				harProxy, err := NewHarProxyWithOptions(HarProxyOptions{EntryBuffer : burst, EntryWorkers : entryWorkers, Logger : NopLogger})
+				if err != nil {
+					b.Fatal(err)
+				}
+				harProxy.startProcessing()
+				for j := 0; j < burst; j++ {
+					req := httptest.NewRequest("GET", fmt.Sprintf("http://127.0.0.1/%v", j), nil)
+					resp, _ := stubTransport{}.RoundTrip(req)
+					harProxy.pending.add()
+					harProxy.sendEntry(reqAndResp{req : req, resp : resp, clientUrl : req.URL.String(), serverIpAddress : "127.0.0.1"})
+				}
+				if goroutines := runtime.NumGoroutine(); goroutines > peak {
+					peak = goroutines
+				}
+				harProxy.WaitForEntries(context.Background())
+				harProxy.closeEntryChannel()
+				<-harProxy.entriesDone
+			}
+			b.ReportMetric(float64(peak), "peak-goroutines")
+		})
+	}
+}
+
+// Answers with size bytes, without Content-Length when chunked
+type bodyTransport struct {
+	body []byte
+	chunked bool
+}
+
+func (stub bodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, _ := stubTransport{}.RoundTrip(req)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(stub.body))
+	resp.ContentLength = int64(len(stub.body))
+	if stub.chunked {
+		resp.ContentLength = -1
+	}
+	return resp, nil
+}
+
+// Reports the allocations of proxied requests capturing small, chunked and capped large bodies
+func BenchmarkHarProxyCaptureContent(b *testing.B) {
+	cases := []struct {
+		name string
+		transport bodyTransport
+		maxCaptureBytes int64
+	}{
+		{"small", bodyTransport{body : bytes.Repeat([]byte("a"), 1 << 10)}, 0},
+		{"chunked", bodyTransport{body : bytes.Repeat([]byte("a"), 64 << 10), chunked : true}, 0},
+		{"large-capped", bodyTransport{body : bytes.Repeat([]byte("a"), 4 << 20)}, 64 << 10},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			harProxy, err := NewHarProxyWithOptions(HarProxyOptions {
+				Transport 		: c.transport,
+				Logger 			: NopLogger,
+				MaxEntries 		: 1,
+				CaptureSettings : CaptureSettings{CaptureContent : true, MaxCaptureBytes : c.maxCaptureBytes},
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			client, s := newProxyHttpTestServer(harProxy)
+			defer s.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Get("http://stub.invalid/body")
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				harProxy.WaitForEntries(context.Background())
+			}
+		})
+	}
+}
+
+// Compares the cost of a proxied request through bare goproxy and through a proxy with and without recording
+func BenchmarkHarProxyDisableRecording(b *testing.B) {
+	bare := goproxy.NewProxyHttpServer()
+	bare.Logger = printfLogger{NopLogger}
+	for _, name := range []string{"goproxy", "disabled", "recording"} {
+		b.Run(name, func(b *testing.B) {
+			handler := http.Handler(bare)
+			if name != "goproxy" {
+				harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger, CaptureSettings : CaptureSettings{DisableRecording : name == "disabled"}})
+				if err != nil {
+					b.Fatal(err)
+				}
+				handler = harProxy.Proxy
+			}
+			s := httptest.NewServer(handler)
+			defer s.Close()
+			proxyUrl, _ := url.Parse(s.URL)
+			client := &http.Client{Transport : &http.Transport{Proxy : http.ProxyURL(proxyUrl)}}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Get(srv.URL + "/bobo")
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+// Proxies requests from a client to an httptest backend, without capturing content, capturing it, and
+// capturing it with a filter dropping the entries
+func BenchmarkHarProxyFullPath(b *testing.B) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+	body := strings.Repeat("a", 4096)
+	for _, name := range []string{"capture-off", "capture-on", "filtered"} {
+		b.Run(name, func(b *testing.B) {
+			harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Logger : NopLogger, CaptureSettings : CaptureSettings{CaptureContent : name != "capture-off"}})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if name == "filtered" {
+				harProxy.SetEntryFilter(func(entry *HarEntry) bool { return false })
+			}
+			client, s := newProxyHttpTestServer(harProxy)
+			defer s.Close()
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Post(backend.URL + "/echo", "text/plain", strings.NewReader(body))
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			b.StopTimer()
+			harProxy.WaitForEntries(context.Background())
+		})
+	}
+}
+
+// Reports the p99 latency of proxied requests recorded through an unbuffered and a buffered entry queue
+func BenchmarkHarProxyEntryBuffer(b *testing.B) {
+	for _, entryBuffer := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("buffer-%v", entryBuffer), func(b *testing.B) {
+			harProxy, err := NewHarProxyWithOptions(HarProxyOptions{Transport : stubTransport{}, EntryBuffer : entryBuffer, Logger : NopLogger})
+			if err != nil {
+				b.Fatal(err)
+			}
+			client, s := newProxyHttpTestServer(harProxy)
+			defer s.Close()
+			client.Transport.(*http.Transport).MaxIdleConnsPerHost = 256
+			var latenciesLock sync.Mutex
+			latencies := make([]time.Duration, 0, b.N)
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					start := time.Now()
+					resp, err := client.Get("http://127.0.0.1/bench")
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+					elapsed := time.Since(start)
+					latenciesLock.Lock()
+					latencies = append(latencies, elapsed)
+					latenciesLock.Unlock()
+				}
+			})
+			b.StopTimer()
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			if len(latencies) > 0 {
+				b.ReportMetric(float64(latencies[len(latencies) * 99 / 100].Microseconds()), "p99-us")
+			}
+		})
+	}
+}
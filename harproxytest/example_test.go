@@ -0,0 +1,76 @@
+package harproxytest_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Hellspam/goharproxy"
+	"github.com/Hellspam/goharproxy/harproxytest"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello " + r.URL.Path[1:])
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Requests sent with Client are recorded, Entries returns them once they all are
+func TestStartTestProxy(t *testing.T) {
+	server := newTestServer(t)
+	proxy := harproxytest.StartTestProxy(t)
+
+	for _, path := range []string{"/alice", "/bob"} {
+		resp, err := proxy.Client().Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	entries := proxy.Entries()
+	if len(entries) != 2 || entries[0].Request.Url != server.URL + "/alice" || entries[1].Response.Status != 200 {
+		t.Fatalf("Expected both requests to be recorded but got: %+v", entries)
+	}
+	proxy.Clear()
+	if entries := proxy.Entries(); len(entries) != 0 {
+		t.Fatal("Expected no entries after Clear but got: ", len(entries))
+	}
+}
+
+// Options configure the proxy, e.g. to record the response bodies
+func TestStartTestProxyOptions(t *testing.T) {
+	server := newTestServer(t)
+	proxy := harproxytest.StartTestProxy(t, goharproxy.HarProxyOptions {
+		CaptureSettings : goharproxy.CaptureSettings{CaptureContent : true},
+	})
+
+	resp, err := proxy.Client().Get(server.URL + "/carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	entries := proxy.Entries()
+	if len(entries) != 1 || entries[0].Response.Content == nil || entries[0].Response.Content.Text != "hello carol" {
+		t.Fatalf("Expected the response body to be recorded but got: %+v", entries)
+	}
+}
+
+// The proxy is stopped once the test completes
+func TestStartTestProxyCleanup(t *testing.T) {
+	var proxy *harproxytest.TestProxy
+	t.Run("recording", func(t *testing.T) {
+		proxy = harproxytest.StartTestProxy(t)
+	})
+	if err := proxy.Proxy().Stop(); err != goharproxy.ErrAlreadyStopped {
+		t.Fatal("Expected the proxy to be stopped with its test but got: ", err)
+	}
+}
@@ -0,0 +1,148 @@
+// Package harproxytest starts recording proxies for Go tests.
+//
+//	func TestLogin(t *testing.T) {
+//		proxy := harproxytest.StartTestProxy(t)
+//		resp, err := proxy.Client().Get(server.URL + "/login")
+//		...
+//		entries := proxy.Entries()
+//	}
+package harproxytest
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hellspam/goharproxy"
+)
+
+// How long Entries waits for the entries of completed requests to be recorded
+var WaitTimeout = 10 * time.Second
+
+// TestProxy is a proxy started by StartTestProxy, stopped when its test completes
+type TestProxy struct {
+	t testing.TB
+	proxy *goharproxy.HarProxy
+	client *http.Client
+	logger *testLogger
+}
+
+// StartTestProxy starts a proxy with opts, if given, on a free loopback port, and stops it when the test
+// and its subtests complete. Unless opts set them, the port is 0 and the bind address 127.0.0.1.
+// The test fails if the proxy can't be started, or stopped serving because of an error.
+func StartTestProxy(t testing.TB, opts ...goharproxy.HarProxyOptions) *TestProxy {
+	t.Helper()
+	if len(opts) > 1 {
+		t.Fatalf("harproxytest: expected at most one HarProxyOptions but got %v", len(opts))
+	}
+	var options goharproxy.HarProxyOptions
+	if len(opts) == 1 {
+		options = opts[0]
+	}
+	if options.BindAddr == "" {
+		options.BindAddr = "127.0.0.1"
+	}
+	logger := &testLogger{t : t}
+	if options.Logger == nil {
+		options.Logger = logger
+	}
+	proxy, err := goharproxy.NewHarProxyWithOptions(options)
+	if err != nil {
+		t.Fatalf("harproxytest: creating proxy: %v", err)
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("harproxytest: starting proxy: %v", err)
+	}
+	proxyUrl, err := url.Parse(proxy.URL())
+	if err != nil {
+		proxy.Stop()
+		logger.stop()
+		t.Fatalf("harproxytest: proxy url: %v", err)
+	}
+	testProxy := &TestProxy {
+		t 		: t,
+		proxy 	: proxy,
+		client 	: &http.Client{Transport : &http.Transport{Proxy : http.ProxyURL(proxyUrl)}},
+		logger 	: logger,
+	}
+	t.Cleanup(testProxy.stop)
+	return testProxy
+}
+
+func (testProxy *TestProxy) stop() {
+	testProxy.client.CloseIdleConnections()
+	if err := testProxy.proxy.Err(); err != nil {
+		testProxy.t.Errorf("harproxytest: proxy stopped serving: %v", err)
+	}
+	if err := testProxy.proxy.Stop(); err != nil && err != goharproxy.ErrAlreadyStopped {
+		testProxy.t.Errorf("harproxytest: stopping proxy: %v", err)
+	}
+	testProxy.logger.stop()
+}
+
+// Client returns a client sending its requests through the proxy
+func (testProxy *TestProxy) Client() *http.Client {
+	return testProxy.client
+}
+
+// URL returns the proxy's URL, e.g. to configure clients other than Client
+func (testProxy *TestProxy) URL() string {
+	return testProxy.proxy.URL()
+}
+
+// Proxy returns the underlying proxy, e.g. to add host entries or middlewares
+func (testProxy *TestProxy) Proxy() *goharproxy.HarProxy {
+	return testProxy.proxy
+}
+
+// Entries waits for the entries of the requests which reached the proxy to be recorded, then returns them.
+// The test fails if they are not recorded within WaitTimeout.
+func (testProxy *TestProxy) Entries() []goharproxy.HarEntry {
+	testProxy.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), WaitTimeout)
+	defer cancel()
+	if err := testProxy.proxy.WaitForEntries(ctx); err != nil {
+		testProxy.t.Fatalf("harproxytest: waiting for %v pending entries: %v", testProxy.proxy.PendingEntries(), err)
+	}
+	return testProxy.proxy.HarLog.Entries()
+}
+
+// Clear removes the recorded entries, e.g. between the steps of a test
+func (testProxy *TestProxy) Clear() {
+	testProxy.proxy.ClearEntries()
+}
+
+// Sends the proxy's logs to the test log, shown when the test fails or runs verbosely.
+// Logs after the proxy stopped are dropped, testing panics on logs of a completed test.
+type testLogger struct {
+	t testing.TB
+	stopped bool
+	lock sync.Mutex
+}
+
+func (logger *testLogger) Debugf(format string, args ...interface{}) {}
+
+func (logger *testLogger) Infof(format string, args ...interface{}) {
+	logger.logf(format, args...)
+}
+
+func (logger *testLogger) Errorf(format string, args ...interface{}) {
+	logger.logf("ERROR : " + format, args...)
+}
+
+func (logger *testLogger) logf(format string, args ...interface{}) {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	if !logger.stopped {
+		logger.t.Logf(format, args...)
+	}
+}
+
+func (logger *testLogger) stop() {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.stopped = true
+}
@@ -0,0 +1,155 @@
+package goharproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// How ProxyHosts.Host is matched against request hosts
+const (
+	// Host must equal the request host, the default
+	MatchExact = "exact"
+
+	// Host may contain *, matching any characters, e.g. *.staging.example.com
+	MatchWildcard = "wildcard"
+
+	// Host is a regular expression matching the whole request host,
+	// NewHost may refer to its capture groups as $1 or ${name}
+	MatchRegex = "regex"
+)
+
+// Validate checks MatchType and NewScheme are known and Host compiles for MatchType
+func (hostEntry ProxyHosts) Validate() error {
+	switch hostEntry.NewScheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("unknown scheme [%v] for host [%v]", hostEntry.NewScheme, hostEntry.Host)
+	}
+	switch hostEntry.MatchType {
+	case "", MatchExact:
+		return nil
+	case MatchWildcard, MatchRegex:
+		_, err := hostEntry.compile()
+		return err
+	}
+	return fmt.Errorf("unknown match type [%v] for host [%v]", hostEntry.MatchType, hostEntry.Host)
+}
+
+func (hostEntry ProxyHosts) compile() (*regexp.Regexp, error) {
+	expr := hostEntry.Host
+	if hostEntry.MatchType == MatchWildcard {
+		expr = strings.Replace(regexp.QuoteMeta(expr), `\*`, ".*", -1)
+	}
+	compiled, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v host [%v]: %v", hostEntry.MatchType, hostEntry.Host, err)
+	}
+	return compiled, nil
+}
+
+// A host entry as a proxy holds it, with its wildcard or regex pattern compiled once when it is added
+type hostEntry struct {
+	ProxyHosts
+
+	pattern *regexp.Regexp
+	// Why Host doesn't compile for MatchType
+	err error
+}
+
+func newHostEntries(hosts []ProxyHosts) []hostEntry {
+	entries := make([]hostEntry, len(hosts))
+	for i, host := range hosts {
+		entries[i].ProxyHosts = host
+		if host.MatchType == MatchWildcard || host.MatchType == MatchRegex {
+			entries[i].pattern, entries[i].err = host.compile()
+		}
+	}
+	return entries
+}
+
+func hostsOf(entries []hostEntry) []ProxyHosts {
+	hosts := make([]ProxyHosts, len(entries))
+	for i, entry := range entries {
+		hosts[i] = entry.ProxyHosts
+	}
+	return hosts
+}
+
+// Returns the host a request to host should go to, both are compared without their scheme's default port
+func (hostEntry hostEntry) match(host, scheme string) (string, bool, error) {
+	host = normalizeHost(host, scheme)
+	switch hostEntry.MatchType {
+	case MatchWildcard, MatchRegex:
+		if hostEntry.err != nil {
+			return "", false, hostEntry.err
+		}
+		match := hostEntry.pattern.FindStringSubmatchIndex(host)
+		if match == nil {
+			return "", false, nil
+		}
+		return string(hostEntry.pattern.ExpandString(nil, hostEntry.NewHost, host, match)), true, nil
+	}
+	return hostEntry.NewHost, normalizeHost(hostEntry.Host, scheme) == host, nil
+}
+
+// Strips the port from host when it is the default one of scheme
+func normalizeHost(host, scheme string) string {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	if (port == "80" && scheme != "https") || (port == "443" && scheme == "https") {
+		if strings.Contains(hostname, ":") {
+			return "[" + hostname + "]"
+		}
+		return hostname
+	}
+	return host
+}
+
+// Applies the inverse of the host entry the request to clientUrl matched, if it has RewriteLocation:
+// a Location header of resp redirecting to the host req was sent to is pointed back at the host of clientUrl.
+// Relative Locations stay as they are. Returns the rewrite, nil if there was none.
+func (proxy *HarProxy) rewriteLocation(clientUrl string, req *http.Request, resp *http.Response) *LocationRewrite {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	target, err := url.Parse(location)
+	if err != nil || target.Host == "" {
+		return nil
+	}
+	original, err := url.Parse(clientUrl)
+	if err != nil || original.Host == req.URL.Host {
+		return nil
+	}
+	if !proxy.rewritesLocation(original) {
+		return nil
+	}
+	if target.Scheme == "" {
+		target.Scheme = req.URL.Scheme
+	}
+	if target.Scheme != req.URL.Scheme || normalizeHost(target.Host, target.Scheme) != normalizeHost(req.URL.Host, req.URL.Scheme) {
+		return nil
+	}
+	target.Scheme, target.Host = original.Scheme, original.Host
+	resp.Header.Set("Location", target.String())
+	proxy.logger.Debugf("Rewrote Location %v to %v", location, target)
+	return &LocationRewrite{Original : location, Rewritten : target.String()}
+}
+
+// Whether the host entry a request to clientUrl matches has RewriteLocation
+func (proxy *HarProxy) rewritesLocation(clientUrl *url.URL) bool {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	for _, hostEntry := range proxy.hostEntries {
+		if _, matched, err := hostEntry.match(clientUrl.Host, clientUrl.Scheme); err == nil && matched {
+			return hostEntry.RewriteLocation
+		}
+	}
+	return false
+}
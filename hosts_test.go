@@ -0,0 +1,82 @@
+package goharproxy
+
+import (
+	"testing"
+)
+
+func TestProxyHostsMatch(t *testing.T) {
+	tests := []struct {
+		entry 		ProxyHosts
+		host 		string
+		scheme 		string
+		newHost 	string
+		matched 	bool
+	}{
+		{ProxyHosts{Host : "example.com", NewHost : "localhost:8080"}, "example.com", "http", "localhost:8080", true},
+		{ProxyHosts{Host : "example.com", NewHost : "localhost:8080"}, "example.com:80", "http", "localhost:8080", true},
+		{ProxyHosts{Host : "example.com", NewHost : "localhost:8080"}, "example.com:443", "https", "localhost:8080", true},
+		{ProxyHosts{Host : "example.com:80", NewHost : "localhost:8080"}, "example.com", "http", "localhost:8080", true},
+		{ProxyHosts{Host : "example.com", NewHost : "localhost:8080"}, "example.com:8080", "http", "", false},
+		{ProxyHosts{Host : "example.com", NewHost : "localhost:8080"}, "example.com:443", "http", "", false},
+		{ProxyHosts{Host : "example.com", NewHost : "localhost:8080", MatchType : MatchExact}, "www.example.com", "http", "", false},
+		{ProxyHosts{Host : "*.staging.example.com", NewHost : "localhost:8080", MatchType : MatchWildcard}, "api.staging.example.com", "http", "localhost:8080", true},
+		{ProxyHosts{Host : "*.staging.example.com", NewHost : "localhost:8080", MatchType : MatchWildcard}, "a.b.staging.example.com:80", "http", "localhost:8080", true},
+		{ProxyHosts{Host : "*.staging.example.com", NewHost : "localhost:8080", MatchType : MatchWildcard}, "staging.example.com", "http", "", false},
+		{ProxyHosts{Host : "*.staging.example.com", NewHost : "localhost:8080", MatchType : MatchWildcard}, "api.stagingXexample.com", "http", "", false},
+		{ProxyHosts{Host : `(\w+)\.example\.com`, NewHost : "$1.internal:8080", MatchType : MatchRegex}, "api.example.com", "http", "api.internal:8080", true},
+		{ProxyHosts{Host : `(?P<service>\w+)\.example\.com`, NewHost : "${service}.internal", MatchType : MatchRegex}, "web.example.com:443", "https", "web.internal", true},
+		{ProxyHosts{Host : `\w+\.example\.com`, NewHost : "localhost", MatchType : MatchRegex}, "api.example.com.evil.com", "http", "", false},
+	}
+	for _, test := range tests {
+		newHost, matched, err := newHostEntries([]ProxyHosts{test.entry})[0].match(test.host, test.scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != test.matched || newHost != test.newHost && matched {
+			t.Errorf("Expected %+v on %v://%v to give (%v, %v) but got: (%v, %v)",
+				test.entry, test.scheme, test.host, test.newHost, test.matched, newHost, matched)
+		}
+	}
+}
+
+func TestProxyHostsValidate(t *testing.T) {
+	for _, entry := range []ProxyHosts {
+		{Host : "a.com", MatchType : "glob"},
+		{Host : "(a.com", MatchType : MatchRegex},
+		{Host : "a.com", NewScheme : "ftp"},
+	} {
+		if err := entry.Validate(); err == nil {
+			t.Errorf("Expected error for %+v", entry)
+		}
+	}
+	for _, entry := range []ProxyHosts {
+		{Host : "a.com"},
+		{Host : "*.a.com", MatchType : MatchWildcard},
+		{Host : "(a|b).com", MatchType : MatchRegex},
+		{Host : "a.com", NewScheme : "https"},
+	} {
+		if err := entry.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid but got: %v", entry, err)
+		}
+	}
+}
+
+func TestHostEntriesCompiledOnce(t *testing.T) {
+	harProxy := NewHarProxy()
+	hosts := []ProxyHosts {
+		{Host : "*.a.com", NewHost : "localhost", MatchType : MatchWildcard},
+		{Host : "(a.com", NewHost : "localhost", MatchType : MatchRegex},
+		{Host : "b.com", NewHost : "localhost"},
+	}
+	harProxy.AddHostEntries(hosts)
+	entries := harProxy.hostEntries
+	if entries[0].pattern == nil || entries[1].err == nil || entries[2].pattern != nil {
+		t.Fatalf("Expected the patterns to be compiled when added but got: %+v", entries)
+	}
+	if _, _, err := entries[1].match("a.com", "http"); err == nil {
+		t.Fatal("Expected the invalid pattern to fail matching")
+	}
+	if got := harProxy.HostEntries(); len(got) != 3 || got[0] != hosts[0] || got[1] != hosts[1] {
+		t.Fatal("Expected the host entries as they were added but got: ", got)
+	}
+}
@@ -0,0 +1,291 @@
+package goharproxy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// JMeterOptions controls which entries ConvertHarToJMeter exports and how they are paced
+type JMeterOptions struct {
+	// The test plan's name, defaults to goharproxy
+	Name 		string
+
+	// Only entries whose url matches are exported, all of them when nil
+	UrlPattern 	*regexp.Regexp
+
+	// Waits before each request as long as the client waited after the previous one ended, with a constant timer
+	ThinkTime 	bool
+}
+
+// An element of a .jmx file, in the order JMeter writes them
+type jmxElement struct {
+	XMLName 	xml.Name
+	Attrs 		[]xml.Attr 		`xml:",attr"`
+	Text 		string 			`xml:",chardata"`
+	Children 	[]jmxElement
+}
+
+func jmxNamed(tag, name string, children ...jmxElement) jmxElement {
+	element := jmxElement{XMLName : xml.Name{Local : tag}, Children : children}
+	if name != "" {
+		element.Attrs = []xml.Attr{{Name : xml.Name{Local : "name"}, Value : name}}
+	}
+	return element
+}
+
+func jmxString(name, value string) jmxElement {
+	element := jmxNamed("stringProp", name)
+	element.Text = value
+	return element
+}
+
+func jmxBool(name string, value bool) jmxElement {
+	element := jmxNamed("boolProp", name)
+	element.Text = strconv.FormatBool(value)
+	return element
+}
+
+// A test element, with the gui and test classes JMeter opens it with
+func jmxTestElement(tag, guiClass, testName string, children ...jmxElement) jmxElement {
+	return jmxElement {
+		XMLName 	: xml.Name{Local : tag},
+		Attrs 		: []xml.Attr {
+			{Name : xml.Name{Local : "guiclass"}, Value : guiClass},
+			{Name : xml.Name{Local : "testclass"}, Value : tag},
+			{Name : xml.Name{Local : "testname"}, Value : testName},
+			{Name : xml.Name{Local : "enabled"}, Value : "true"},
+		},
+		Children 	: children,
+	}
+}
+
+// An elementProp, whose attributes are name, then elementType and the others
+func jmxElementProp(name, elementType string, attrs []xml.Attr, children ...jmxElement) jmxElement {
+	element := jmxNamed("elementProp", name, children...)
+	if name == "" {
+		element.Attrs = []xml.Attr{{Name : xml.Name{Local : "name"}}}
+	}
+	element.Attrs = append(element.Attrs, xml.Attr{Name : xml.Name{Local : "elementType"}, Value : elementType})
+	element.Attrs = append(element.Attrs, attrs...)
+	return element
+}
+
+// The children of a test element, each followed by the hashTree of its own children
+func jmxHashTree(elements ...jmxElement) jmxElement {
+	return jmxElement{XMLName : xml.Name{Local : "hashTree"}, Children : elements}
+}
+
+// ConvertHarToJMeter returns a JMeter test plan (.jmx) replaying the requests of harLog's entries, in the order
+// they were recorded, from a single thread group running once. Each request is an HTTP sampler with a header manager
+// for its headers, leaving out hop by hop and HTTP/2 pseudo headers like ToCurl. Form bodies and the query of requests
+// without body are sampler arguments, other bodies are sent raw. Binary and truncated bodies can't be exported,
+// their sampler gets a comment saying what it was instead.
+func ConvertHarToJMeter(harLog *HarLog, opts JMeterOptions) ([]byte, error) {
+	if opts.Name == "" {
+		opts.Name = "goharproxy"
+	}
+	_, entries := harLog.snapshot()
+	var samplers []jmxElement
+	var previous *HarEntry
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Request == nil || opts.UrlPattern != nil && !opts.UrlPattern.MatchString(entry.Request.Url) {
+			continue
+		}
+		requestUrl, err := url.Parse(entry.Request.Url)
+		if err != nil || requestUrl.Host == "" {
+			continue
+		}
+		sampler, children := jmeterSampler(entry.Request, requestUrl)
+		if opts.ThinkTime && previous != nil {
+			previousEnd := previous.StartedDateTime.UnixNano() / 1e6 + previous.Time
+			if gap := entry.StartedDateTime.UnixNano() / 1e6 - previousEnd; gap > 0 {
+				children = append(children, jmxTestElement("ConstantTimer", "ConstantTimerGui", "Think Time", jmxString("ConstantTimer.delay", strconv.FormatInt(gap, 10))), jmxHashTree())
+			}
+		}
+		samplers = append(samplers, sampler, jmxHashTree(children...))
+		previous = entry
+	}
+
+	threadGroup := jmxTestElement("ThreadGroup", "ThreadGroupGui", "Thread Group",
+		jmxString("ThreadGroup.on_sample_error", "continue"),
+		jmxElementProp("ThreadGroup.main_controller", "LoopController", []xml.Attr {
+				{Name : xml.Name{Local : "guiclass"}, Value : "LoopControlPanel"},
+				{Name : xml.Name{Local : "testclass"}, Value : "LoopController"},
+				{Name : xml.Name{Local : "testname"}, Value : "Loop Controller"},
+				{Name : xml.Name{Local : "enabled"}, Value : "true"},
+			},
+			jmxBool("LoopController.continue_forever", false),
+			jmxString("LoopController.loops", "1"),
+		),
+		jmxString("ThreadGroup.num_threads", "1"),
+		jmxString("ThreadGroup.ramp_time", "1"),
+		jmxBool("ThreadGroup.scheduler", false),
+	)
+	testPlan := jmxTestElement("TestPlan", "TestPlanGui", opts.Name,
+		jmxString("TestPlan.comments", "Recorded by goharproxy"),
+		jmxBool("TestPlan.functional_mode", false),
+		jmxBool("TestPlan.serialize_threadgroups", false),
+		jmxElementProp("TestPlan.user_defined_variables", "Arguments", []xml.Attr {
+				{Name : xml.Name{Local : "guiclass"}, Value : "ArgumentsPanel"},
+				{Name : xml.Name{Local : "testclass"}, Value : "Arguments"},
+				{Name : xml.Name{Local : "testname"}, Value : "User Defined Variables"},
+				{Name : xml.Name{Local : "enabled"}, Value : "true"},
+			},
+			jmxNamed("collectionProp", "Arguments.arguments"),
+		),
+	)
+	plan := jmxElement {
+		XMLName : xml.Name{Local : "jmeterTestPlan"},
+		Attrs 	: []xml.Attr {
+			{Name : xml.Name{Local : "version"}, Value : "1.2"},
+			{Name : xml.Name{Local : "properties"}, Value : "5.0"},
+			{Name : xml.Name{Local : "jmeter"}, Value : "5.6.3"},
+		},
+		Children : []jmxElement{jmxHashTree(testPlan, jmxHashTree(threadGroup, jmxHashTree(samplers...)))},
+	}
+
+	var jmx bytes.Buffer
+	jmx.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&jmx)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(&plan); err != nil {
+		return nil, err
+	}
+	jmx.WriteByte('\n')
+	return jmx.Bytes(), nil
+}
+
+// The sampler of a request, and its header manager
+func jmeterSampler(harRequest *HarRequest, requestUrl *url.URL) (jmxElement, []jmxElement) {
+	path := requestUrl.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	var arguments []jmxElement
+	var comment string
+	postData := harRequest.PostData
+	body := requestBody(harRequest)
+	mediaType := ""
+	if postData != nil {
+		mediaType, _, _ = mime.ParseMediaType(postData.MimeType)
+	}
+	rawBody := false
+	switch {
+	case body == "":
+		if requestUrl.RawQuery != "" {
+			arguments = jmeterArguments(requestUrl.RawQuery)
+			if arguments == nil {
+				path += "?" + requestUrl.RawQuery
+			}
+		}
+	case postData.Truncated || !jmxText(body):
+		comment = "The recorded body (" + postData.MimeType + ") wasn't exported, it is binary or was truncated"
+	case mediaType == "application/x-www-form-urlencoded" && jmeterArguments(body) != nil:
+		arguments = jmeterArguments(body)
+	default:
+		rawBody = true
+		arguments = []jmxElement{jmeterArgument("", body, false)}
+	}
+	if body != "" && requestUrl.RawQuery != "" {
+		path += "?" + requestUrl.RawQuery
+	}
+
+	port := requestUrl.Port()
+	if port == "" {
+		port = "80"
+		if requestUrl.Scheme == "https" {
+			port = "443"
+		}
+	}
+	properties := []jmxElement {
+		jmxElementProp("HTTPsampler.Arguments", "Arguments", []xml.Attr {
+				{Name : xml.Name{Local : "guiclass"}, Value : "HTTPArgumentsPanel"},
+				{Name : xml.Name{Local : "testclass"}, Value : "Arguments"},
+				{Name : xml.Name{Local : "enabled"}, Value : "true"},
+			},
+			jmxNamed("collectionProp", "Arguments.arguments", arguments...),
+		),
+		jmxString("HTTPSampler.domain", requestUrl.Hostname()),
+		jmxString("HTTPSampler.port", port),
+		jmxString("HTTPSampler.protocol", requestUrl.Scheme),
+		jmxString("HTTPSampler.path", path),
+		jmxString("HTTPSampler.method", harRequest.Method),
+		jmxBool("HTTPSampler.follow_redirects", false),
+		jmxBool("HTTPSampler.auto_redirects", false),
+		jmxBool("HTTPSampler.use_keepalive", true),
+		jmxBool("HTTPSampler.postBodyRaw", rawBody),
+	}
+	if comment != "" {
+		properties = append(properties, jmxString("TestPlan.comments", comment))
+	}
+	sampler := jmxTestElement("HTTPSamplerProxy", "HttpTestSampleGui", harRequest.Method + " " + requestUrl.EscapedPath(), properties...)
+
+	var headers []jmxElement
+	for _, header := range harRequest.Headers {
+		if curlSkippedHeaders[http.CanonicalHeaderKey(header.Name)] || strings.HasPrefix(header.Name, ":") {
+			continue
+		}
+		headers = append(headers, jmxElementProp("", "Header", nil, jmxString("Header.name", header.Name), jmxString("Header.value", header.Value)))
+	}
+	if len(headers) == 0 {
+		return sampler, nil
+	}
+	headerManager := jmxTestElement("HeaderManager", "HeaderPanel", "HTTP Header Manager", jmxNamed("collectionProp", "HeaderManager.headers", headers...))
+	return sampler, []jmxElement{headerManager, jmxHashTree()}
+}
+
+// The parameters of an urlencoded query or form, in the order they were sent, nil if it can't be decoded
+func jmeterArguments(encoded string) []jmxElement {
+	var arguments []jmxElement
+	for _, param := range strings.Split(encoded, "&") {
+		nameValue := strings.SplitN(param, "=", 2)
+		name, err := url.QueryUnescape(nameValue[0])
+		if err != nil {
+			return nil
+		}
+		value := ""
+		if len(nameValue) == 2 {
+			if value, err = url.QueryUnescape(nameValue[1]); err != nil {
+				return nil
+			}
+		}
+		if !jmxText(name) || !jmxText(value) {
+			return nil
+		}
+		arguments = append(arguments, jmeterArgument(name, value, true))
+	}
+	return arguments
+}
+
+// A sampler argument, encoded by JMeter when sent if encode
+func jmeterArgument(name, value string, encode bool) jmxElement {
+	return jmxElementProp(name, "HTTPArgument", nil,
+		jmxBool("HTTPArgument.always_encode", encode),
+		jmxString("Argument.value", value),
+		jmxString("Argument.metadata", "="),
+		jmxBool("HTTPArgument.use_equals", true),
+		jmxString("Argument.name", name),
+	)
+}
+
+// Text XML can hold, without control characters other than tabs and line breaks
+func jmxText(text string) bool {
+	if !utf8.ValidString(text) {
+		return false
+	}
+	for _, r := range text {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
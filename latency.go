@@ -0,0 +1,259 @@
+package goharproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// When a latency rule's delay is added
+const (
+	// Before the request goes upstream, the default. Such rules can't match the response's Content-Type.
+	PhaseRequest = "request"
+
+	// Once the upstream response headers arrived, before the response is sent to the client
+	PhaseFirstByte = "firstByte"
+
+	// Spread over the response body, as it is copied to the client. Each chunk waits its share of
+	// the delay by the Content-Length, bodies of unknown length wait the whole delay after every chunk.
+	PhaseBody = "body"
+)
+
+// Delays the responses to matching requests, see HarProxyConfig.LatencyRules.
+// The first rule matching a request fires, the entry records it as _latencyRule.
+type LatencyRule struct {
+	// Recorded as the entry's _latencyRule, defaults to the rule's index as latency[index]
+	Name 		string 	`json:"name,omitempty"`
+
+	// Regular expression matched against the request url, empty matches every request
+	UrlPattern 	string 	`json:"urlPattern,omitempty"`
+
+	// Regular expression matched against the response's Content-Type, empty matches any.
+	// Requires PhaseFirstByte or PhaseBody, as the response headers must have arrived.
+	ContentType string 	`json:"contentType,omitempty"`
+
+	DelayMs 	int64 	`json:"delayMs"`
+
+	// Adds up to JitterMs to each delay, drawn with the proxy's seed
+	JitterMs 	int64 	`json:"jitterMs,omitempty"`
+
+	// PhaseRequest when empty, PhaseFirstByte or PhaseBody
+	Phase 		string 	`json:"phase,omitempty"`
+
+	ActivationWindow
+}
+
+func (rule LatencyRule) validate() error {
+	if rule.DelayMs < 0 {
+		return fmt.Errorf("invalid delay [%v] ms", rule.DelayMs)
+	}
+	if rule.JitterMs < 0 {
+		return fmt.Errorf("invalid jitter [%v] ms", rule.JitterMs)
+	}
+	switch rule.Phase {
+	case "", PhaseRequest:
+		if rule.ContentType != "" {
+			return errors.New("contentType requires the firstByte or body phase")
+		}
+	case PhaseFirstByte, PhaseBody:
+	default:
+		return fmt.Errorf("unknown phase [%v], expected %v, %v or %v", rule.Phase, PhaseRequest, PhaseFirstByte, PhaseBody)
+	}
+	if _, err := regexp.Compile(rule.UrlPattern); err != nil {
+		return fmt.Errorf("invalid urlPattern [%v]: %v", rule.UrlPattern, err)
+	}
+	if _, err := regexp.Compile(rule.ContentType); err != nil {
+		return fmt.Errorf("invalid contentType [%v]: %v", rule.ContentType, err)
+	}
+	return rule.ActivationWindow.validate()
+}
+
+// A latency rule as a proxy holds it, with its patterns compiled once when it is set
+type latencyRule struct {
+	LatencyRule
+
+	name string
+	urlPattern *regexp.Regexp
+	contentType *regexp.Regexp
+	activation activation
+	// Why the rule is invalid, it never matches then
+	err error
+}
+
+// Compiles rules, their activation windows given as a duration start at now
+func newLatencyRules(rules []LatencyRule, now time.Time) []latencyRule {
+	compiled := make([]latencyRule, len(rules))
+	for i, rule := range rules {
+		rule.ActivationWindow = rule.ActivationWindow.resolve(now)
+		compiled[i].LatencyRule = rule
+		compiled[i].activation = newActivation(rule.ActivationWindow)
+		compiled[i].name = rule.Name
+		if compiled[i].name == "" {
+			compiled[i].name = "latency[" + strconv.Itoa(i) + "]"
+		}
+		if compiled[i].err = rule.validate(); compiled[i].err != nil {
+			continue
+		}
+		compiled[i].urlPattern = regexp.MustCompile(rule.UrlPattern)
+		compiled[i].contentType = regexp.MustCompile(rule.ContentType)
+	}
+	return compiled
+}
+
+func latencyRulesOf(rules []latencyRule) []LatencyRule {
+	latencyRules := make([]LatencyRule, len(rules))
+	for i, rule := range rules {
+		latencyRules[i] = rule.LatencyRule
+	}
+	return latencyRules
+}
+
+func (rule latencyRule) responsePhase() bool {
+	return rule.Phase == PhaseFirstByte || rule.Phase == PhaseBody
+}
+
+// The delay of a request the rule fired for, with its jitter drawn from random
+func (rule latencyRule) delay(random *lockedRand) time.Duration {
+	delayMs := rule.DelayMs
+	if rule.JitterMs > 0 {
+		delayMs += random.int63n(rule.JitterMs + 1)
+	}
+	return time.Duration(delayMs) * time.Millisecond
+}
+
+// SetLatencyRules replaces the proxy's latency rules, they apply from the next request
+func (proxy *HarProxy) SetLatencyRules(rules []LatencyRule) error {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	compiled := newLatencyRules(rules, proxy.clock.Now())
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.latencyRules = compiled
+	return nil
+}
+
+// LatencyRules returns a copy of the latency rules, in the order they are matched,
+// with the time remaining of their activation windows
+func (proxy *HarProxy) LatencyRules() []LatencyRule {
+	now := proxy.clock.Now()
+	proxy.collectExpiredRules(now)
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	rules := latencyRulesOf(proxy.latencyRules)
+	for i := range rules {
+		rules[i].ActivationWindow = rules[i].ActivationWindow.remaining(now)
+	}
+	return rules
+}
+
+// Returns the first rule matching req, among the request phase rules when resp is nil and the response phase ones otherwise
+func (proxy *HarProxy) matchLatencyRule(req *http.Request, resp *http.Response) *latencyRule {
+	proxy.settingsLock.RLock()
+	rules := proxy.latencyRules
+	proxy.settingsLock.RUnlock()
+	now := proxy.clock.Now()
+	for i := range rules {
+		rule := &rules[i]
+		if rule.err != nil {
+			proxy.logger.Errorf("Skipping latency rule %v: %v", rule.name, rule.err)
+			continue
+		}
+		if !rule.activation.active(now) {
+			if rule.activation.expired(now) {
+				proxy.collectExpiredRules(now)
+			}
+			continue
+		}
+		if rule.responsePhase() != (resp != nil) || !rule.urlPattern.MatchString(req.URL.String()) {
+			continue
+		}
+		if resp != nil && !rule.contentType.MatchString(resp.Header.Get("Content-Type")) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// Delays req by the first request phase rule matching it, returns the name of the rule which fired
+func (proxy *HarProxy) delayRequest(req *http.Request) string {
+	rule := proxy.matchLatencyRule(req, nil)
+	if rule == nil {
+		return ""
+	}
+	proxy.sleep(req.Context(), rule.delay(proxy.random))
+	return rule.name
+}
+
+// Delays resp or paces its body by the first response phase rule matching it, returns the name of the rule which fired.
+// ctx is the client's, waiting stops when it goes away.
+func (proxy *HarProxy) delayResponse(ctx context.Context, req *http.Request, resp *http.Response) string {
+	rule := proxy.matchLatencyRule(req, resp)
+	if rule == nil {
+		return ""
+	}
+	delay := rule.delay(proxy.random)
+	if rule.Phase == PhaseFirstByte {
+		proxy.sleep(ctx, delay)
+	} else if resp.Body != nil {
+		resp.Body = &pacedBody{ReadCloser : resp.Body, proxy : proxy, ctx : ctx, delay : delay, length : resp.ContentLength}
+	}
+	return rule.name
+}
+
+// Waits d on the proxy's clock, returns false if ctx is done first
+func (proxy *HarProxy) sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := proxy.clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// A response body copied to the client at the pace of a PhaseBody latency rule.
+// The share of the delay of a chunk is waited before the next one is read, so the first chunk isn't held back.
+type pacedBody struct {
+	io.ReadCloser
+	proxy *HarProxy
+	ctx context.Context
+	delay time.Duration
+	// The Content-Length, negative when unknown
+	length int64
+
+	// The delay of the chunk read last
+	owed time.Duration
+}
+
+func (body *pacedBody) Read(p []byte) (int, error) {
+	if body.owed > 0 {
+		body.proxy.sleep(body.ctx, body.owed)
+		body.owed = 0
+	}
+	n, err := body.ReadCloser.Read(p)
+	if n > 0 {
+		if body.length > 0 {
+			body.owed = time.Duration(int64(body.delay) * int64(n) / body.length)
+		} else {
+			body.owed = body.delay
+		}
+	}
+	if err == io.EOF && body.owed > 0 {
+		body.proxy.sleep(body.ctx, body.owed)
+		body.owed = 0
+	}
+	return n, err
+}
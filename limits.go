@@ -0,0 +1,177 @@
+package goharproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Caps the upstream requests a proxy makes at once, e.g. to emulate the 6 connections per host of mobile browsers,
+// see HarProxy.SetConnectionLimits. Requests over a cap wait for a slot, the wait is recorded as the entry's blocked time.
+// A request holds its slot until its response body was sent to the client.
+type ConnectionLimits struct {
+	// The most upstream requests at once, 0 means unlimited
+	MaxConcurrent 			int 	`json:"maxConcurrent"`
+
+	// The most upstream requests at once to the same host, 0 means unlimited
+	MaxConcurrentPerHost 	int 	`json:"maxConcurrentPerHost"`
+}
+
+func (limits ConnectionLimits) validate() error {
+	if limits.MaxConcurrent < 0 || limits.MaxConcurrentPerHost < 0 {
+		return fmt.Errorf("invalid connection limits %+v", limits)
+	}
+	return nil
+}
+
+// The slots of connection limits. Changing the limits creates a new limiter,
+// requests holding slots of the previous one release them there.
+type connectionLimiter struct {
+	limits ConnectionLimits
+
+	// Holds a value per request in flight, nil when unlimited
+	all chan struct{}
+
+	// The slots of the hosts with requests in flight or waiting, guarded by lock
+	lock sync.Mutex
+	hosts map[string]*hostSlots
+}
+
+type hostSlots struct {
+	slots chan struct{}
+	// The requests holding or waiting for a slot, the host is forgotten when none are left
+	users int
+}
+
+func newConnectionLimiter(limits ConnectionLimits) *connectionLimiter {
+	limiter := &connectionLimiter{limits : limits, hosts : make(map[string]*hostSlots)}
+	if limits.MaxConcurrent > 0 {
+		limiter.all = make(chan struct{}, limits.MaxConcurrent)
+	}
+	return limiter
+}
+
+// Waits for a slot for a request to host, first for the host then overall.
+// Returns the func releasing it, or ctx.Err() if ctx is done first.
+func (limiter *connectionLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	var perHost *hostSlots
+	if limiter.limits.MaxConcurrentPerHost > 0 {
+		limiter.lock.Lock()
+		perHost = limiter.hosts[host]
+		if perHost == nil {
+			perHost = &hostSlots{slots : make(chan struct{}, limiter.limits.MaxConcurrentPerHost)}
+			limiter.hosts[host] = perHost
+		}
+		perHost.users++
+		limiter.lock.Unlock()
+	}
+	leaveHost := func() {
+		if perHost == nil {
+			return
+		}
+		limiter.lock.Lock()
+		defer limiter.lock.Unlock()
+		if perHost.users--; perHost.users == 0 {
+			delete(limiter.hosts, host)
+		}
+	}
+
+	if perHost != nil {
+		select {
+		case perHost.slots<- struct{}{}:
+		case <-ctx.Done():
+			leaveHost()
+			return nil, ctx.Err()
+		}
+	}
+	if limiter.all != nil {
+		select {
+		case limiter.all<- struct{}{}:
+		case <-ctx.Done():
+			if perHost != nil {
+				<-perHost.slots
+			}
+			leaveHost()
+			return nil, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if limiter.all != nil {
+				<-limiter.all
+			}
+			if perHost != nil {
+				<-perHost.slots
+			}
+			leaveHost()
+		})
+	}, nil
+}
+
+// SetConnectionLimits caps the proxy's upstream requests from the next request, nil removes the caps
+func (proxy *HarProxy) SetConnectionLimits(limits *ConnectionLimits) error {
+	var limiter *connectionLimiter
+	if limits != nil {
+		if err := limits.validate(); err != nil {
+			return err
+		}
+		limiter = newConnectionLimiter(*limits)
+	}
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.connectionLimiter = limiter
+	return nil
+}
+
+// ConnectionLimits returns a copy of the proxy's connection limits, nil if it has none
+func (proxy *HarProxy) ConnectionLimits() *ConnectionLimits {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	if proxy.connectionLimiter == nil {
+		return nil
+	}
+	limits := proxy.connectionLimiter.limits
+	return &limits
+}
+
+// Waits for a connection slot for req, returns the func releasing it and how long it waited.
+// Without connection limits, or if the client went away first, the func does nothing.
+func (proxy *HarProxy) acquireConnection(req *http.Request) (func(), time.Duration, error) {
+	proxy.settingsLock.RLock()
+	limiter := proxy.connectionLimiter
+	proxy.settingsLock.RUnlock()
+	if limiter == nil {
+		return func() {}, 0, nil
+	}
+	start := proxy.clock.Now()
+	release, err := limiter.acquire(req.Context(), req.URL.Host)
+	if err != nil {
+		return func() {}, proxy.clock.Since(start), err
+	}
+	return release, proxy.clock.Since(start), nil
+}
+
+// Releases the connection slot of a response once its body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (body releasingBody) Close() error {
+	defer body.release()
+	return body.ReadCloser.Close()
+}
+
+// Keeps the slot until resp's body is closed, releases it right away for responses without body to copy
+func releaseWithBody(resp *http.Response, release func()) {
+	if resp == nil || resp.Body == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		release()
+		return
+	}
+	resp.Body = releasingBody{ReadCloser : resp.Body, release : release}
+}
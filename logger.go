@@ -0,0 +1,251 @@
+package goharproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger receives everything proxies and the management server log.
+// Set one with HarProxyOptions.Logger or ProxyServerOptions.Logger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Logs to the standard logger, used when no Logger is given
+var DefaultLogger Logger = stdLogger{}
+
+// Discards everything
+var NopLogger Logger = nopLogger{}
+
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) {
+	log.Printf("DEBUG : " + format, args...)
+}
+
+func (stdLogger) Infof(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+func (stdLogger) Errorf(format string, args ...interface{}) {
+	log.Printf("ERROR : " + format, args...)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{}) {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+func orDefaultLogger(logger Logger) Logger {
+	if logger == nil {
+		return DefaultLogger
+	}
+	return logger
+}
+
+// Passes what goproxy and the proxy's http.Server log on to a Logger. Both only log errors,
+// unless goproxy is Verbose, whose request logs are marked INFO.
+type printfLogger struct {
+	logger Logger
+}
+
+func (adapter printfLogger) Printf(format string, args ...interface{}) {
+	message := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	if strings.Contains(message, "INFO: ") {
+		adapter.logger.Infof("%v", message)
+	} else {
+		adapter.logger.Errorf("%v", message)
+	}
+}
+
+func (adapter printfLogger) Write(p []byte) (int, error) {
+	adapter.Printf("%s", p)
+	return len(p), nil
+}
+
+// The levels of a JsonLogger, each logging what the next ones do
+const (
+	LevelDebug = "debug"
+	LevelInfo = "info"
+	LevelError = "error"
+)
+
+var logLevels = map[string]int{LevelDebug : 0, LevelInfo : 1, LevelError : 2}
+
+// JsonLogger writes a JSON object per line: "time", "level", "event" and "message", and "port" for what a proxy logs.
+// Access logs, see HarProxyOptions.AccessLog, have the fields of an AccessLog instead of a message.
+// Set it as HarProxyOptions.Logger or ProxyServerOptions.Logger, the proxies then add their port.
+type JsonLogger struct {
+	out *jsonOutput
+	// The port of the proxy logging, nil for the management server
+	port func() int
+}
+
+// Shared by the loggers of the proxies, which write to the same writer
+type jsonOutput struct {
+	lock sync.Mutex
+	writer io.Writer
+	level int
+}
+
+// NewJsonLogger logs to w what is at least at level, LevelInfo when it isn't one of the levels.
+// Access logs are written whatever the level, they are turned on by HarProxyOptions.AccessLog.
+func NewJsonLogger(w io.Writer, level string) *JsonLogger {
+	minLevel, ok := logLevels[level]
+	if !ok {
+		minLevel = logLevels[LevelInfo]
+	}
+	return &JsonLogger{out : &jsonOutput{writer : w, level : minLevel}}
+}
+
+func (logger *JsonLogger) Debugf(format string, args ...interface{}) {
+	logger.logf(LevelDebug, format, args...)
+}
+
+func (logger *JsonLogger) Infof(format string, args ...interface{}) {
+	logger.logf(LevelInfo, format, args...)
+}
+
+func (logger *JsonLogger) Errorf(format string, args ...interface{}) {
+	logger.logf(LevelError, format, args...)
+}
+
+func (logger *JsonLogger) logf(level string, format string, args ...interface{}) {
+	if logLevels[level] < logger.out.level {
+		return
+	}
+	logger.write(map[string]interface{}{"level" : level, "event" : "log", "message" : fmt.Sprintf(format, args...)})
+}
+
+// LogAccess writes access, at info level
+func (logger *JsonLogger) LogAccess(access AccessLog) {
+	fields := map[string]interface{} {
+		"level" 	 : LevelInfo,
+		"event" 	 : access.Event,
+		"method" 	 : access.Method,
+		"url" 		 : access.Url,
+		"status" 	 : access.Status,
+		"durationMs" : access.DurationMs,
+	}
+	if access.Error != "" {
+		fields["error"] = access.Error
+	}
+	logger.write(fields)
+}
+
+func (logger *JsonLogger) write(fields map[string]interface{}) {
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	if logger.port != nil {
+		fields["port"] = logger.port()
+	}
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	logger.out.lock.Lock()
+	defer logger.out.lock.Unlock()
+	logger.out.writer.Write(append(line, '\n'))
+}
+
+// The logger of proxy, adding its port to what it logs
+func (logger *JsonLogger) forProxy(proxy *HarProxy) *JsonLogger {
+	return &JsonLogger{out : logger.out, port : func() int { return proxy.Port }}
+}
+
+// What an access log says about a request
+type AccessLog struct {
+	// "request" for the requests a proxy recorded, "apiRequest" for the management API's
+	Event 		string
+	Method 		string
+	Url 		string
+	// 0 without response
+	Status 		int
+	DurationMs 	int64
+	// Why there's no response
+	Error 		string
+}
+
+// A Logger writing access logs as structured fields, like the JsonLogger. Access logs go to Infof for other loggers.
+type AccessLogger interface {
+	LogAccess(access AccessLog)
+}
+
+func logAccess(logger Logger, access AccessLog) {
+	if accessLogger, ok := logger.(AccessLogger); ok {
+		accessLogger.LogAccess(access)
+		return
+	}
+	message := fmt.Sprintf("%v %v %v %vms", access.Method, access.Url, access.Status, access.DurationMs)
+	if access.Error != "" {
+		message += " : " + access.Error
+	}
+	logger.Infof("%v", message)
+}
+
+// Logs an access log of every request to the management API
+func accessLogHandler(logger Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter : w, status : http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		logAccess(logger, AccessLog{Event : "apiRequest", Method : r.Method, Url : loggedRequestURI(r), Status : recorder.status, DurationMs : time.Since(start).Milliseconds()})
+	})
+}
+
+// The request uri of an API request without the stream token it may carry
+func loggedRequestURI(r *http.Request) string {
+	query := r.URL.Query()
+	if query.Get(StreamTokenParam) == "" {
+		return r.URL.RequestURI()
+	}
+	query.Del(StreamTokenParam)
+	logged := *r.URL
+	logged.RawQuery = query.Encode()
+	return logged.RequestURI()
+}
+
+// Remembers the status written, for access logs
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	headerWritten bool
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if !recorder.headerWritten {
+		recorder.status = status
+		recorder.headerWritten = true
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(p []byte) (int, error) {
+	recorder.headerWritten = true
+	return recorder.ResponseWriter.Write(p)
+}
+
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (recorder *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := recorder.ResponseWriter.(http.Hijacker); ok {
+		recorder.status = http.StatusSwitchingProtocols
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("goharproxy: response can't be hijacked")
+}
@@ -2,8 +2,16 @@ package main
 
 import (
 	"flag"
-	
+	"log"
+	"io/ioutil"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
 	"github.com/Hellspam/goharproxy"
+	"github.com/Hellspam/goharproxy/grpcserver"
 //	_ "net/http/pprof"
 )
 
@@ -11,12 +19,83 @@ import (
 func main() {
 	port := flag.Int("p", 8080, "Port to listen on")
 	verbose := flag.Bool("v", true, "Verbosity")
+	certFile := flag.String("cert", "", "PEM certificate file, serves the API over TLS")
+	keyFile := flag.String("key", "", "PEM key file for -cert")
+	clientCAFile := flag.String("client-ca", "", "PEM CA file, requires client certificates signed by it")
+	redirectPort := flag.Int("redirect-port", 0, "Port redirecting plain HTTP to the TLS port")
+	metrics := flag.Bool("metrics", false, "Serve Prometheus metrics on /metrics")
+	externalHost := flag.String("external-host", "", "Host clients reach the proxies at, when not the one they reach the API at")
+	browserMob := flag.Bool("browsermob", false, "Serve the BrowserMob Proxy REST API, for its clients")
+	jsonLog := flag.Bool("json-log", false, "Log JSON lines to stderr")
+	accessLog := flag.Bool("access-log", false, "Log every proxied and API request")
+	apiKeysFile := flag.String("api-keys", "", "File of \"owner key\" lines, requires one of the keys and only shows owners their proxies")
+	admins := flag.String("admins", "", "Comma separated owners in -api-keys whose keys manage every proxy")
+	grpcPort := flag.Int("grpc-port", 0, "Port serving the API as a gRPC service too")
 	flag.Parse()
 //	go func() {
 //		log.Println(http.ListenAndServe("localhost:6060", nil))
 //	}()
 	goharproxy.Verbosity = *verbose
-	goharproxy.NewProxyServer(*port)
+	opts := goharproxy.ProxyServerOptions {
+		Port 			 : *port,
+		CertFile 		 : *certFile,
+		KeyFile 		 : *keyFile,
+		RedirectHTTPPort : *redirectPort,
+		EnableMetrics 	 : *metrics,
+		ExternalHost 	 : *externalHost,
+		BrowserMobCompat : *browserMob,
+		AccessLog 		 : *accessLog,
+	}
+	if *jsonLog {
+		level := goharproxy.LevelInfo
+		if *verbose {
+			level = goharproxy.LevelDebug
+		}
+		opts.Logger = goharproxy.NewJsonLogger(os.Stderr, level)
+	}
+	if *clientCAFile != "" {
+		pem, err := ioutil.ReadFile(*clientCAFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.ClientCAs = x509.NewCertPool()
+		if !opts.ClientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in %v", *clientCAFile)
+		}
+	}
+	if *apiKeysFile != "" {
+		lines, err := ioutil.ReadFile(*apiKeysFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.APIKeys = make(map[string]string)
+		for _, line := range strings.Split(string(lines), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			if len(fields) != 2 {
+				log.Fatalf("Invalid line in %v, expected \"owner key\"", *apiKeysFile)
+			}
+			opts.APIKeys[fields[1]] = fields[0]
+		}
+	}
+	if *admins != "" {
+		opts.Admins = strings.Split(*admins, ",")
+	}
+	proxyServer, err := goharproxy.NewProxyServerWithOptions(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *grpcPort != 0 {
+		if err := proxyServer.AddAPIServer(*grpcPort, grpcserver.New(proxyServer)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// ListenAndServe returns nil once stopped with Shutdown, a normal exit
+	if err := proxyServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
 }
 
 
@@ -0,0 +1,94 @@
+package goharproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MergeHarLogs combines logs into a new log, e.g. the HARs of parallel test shards.
+// Pages and entries are ordered by their start time. A page conflicting with the id of a page from
+// an earlier log is renamed, with its entries' pageRef, unless it is the same page, which is kept once.
+// Creators and browsers are joined, logs of different HAR versions can't be merged.
+func MergeHarLogs(logs ...*HarLog) (*HarLog, error) {
+	merged := newHarLog()
+	merged.Version = ""
+	pages := make(map[string]HarPage)
+	var creators, browsers []string
+	var entries []HarEntry
+	for i, harLog := range logs {
+		if harLog == nil {
+			return nil, fmt.Errorf("log %v is nil", i)
+		}
+		harLog.lock.RLock()
+		version, creator, browser := harLog.Version, harLog.Creator, harLog.Browser
+		logPages := append([]HarPage(nil), harLog.Pages...)
+		logEntries := copyEntries(harLog.entries)
+		harLog.lock.RUnlock()
+
+		if version != "" && merged.Version != "" && version != merged.Version {
+			return nil, fmt.Errorf("can't merge HAR versions %v and %v", merged.Version, version)
+		}
+		if version != "" {
+			merged.Version = version
+		}
+		creators = appendDistinct(creators, creator)
+		browsers = appendDistinct(browsers, browser)
+
+		pageIds := make(map[string]string, len(logPages))
+		for _, page := range logPages {
+			id := page.Id
+			for n := 1; ; n++ {
+				existing, taken := pages[id]
+				if !taken || samePage(existing, page) {
+					break
+				}
+				id = fmt.Sprintf("%v_%v", page.Id, i + n)
+			}
+			pageIds[page.Id] = id
+			if _, taken := pages[id]; !taken {
+				page.Id = id
+				pages[id] = page
+				merged.Pages = append(merged.Pages, page)
+			}
+		}
+		for _, entry := range logEntries {
+			if id, ok := pageIds[entry.PageRef]; ok {
+				entry.PageRef = id
+			}
+			entries = append(entries, entry)
+		}
+	}
+	if merged.Version == "" {
+		merged.Version = newHarLog().Version
+	}
+	if len(creators) > 0 {
+		merged.Creator = strings.Join(creators, ", ")
+	}
+	merged.Browser = strings.Join(browsers, ", ")
+
+	sort.SliceStable(merged.Pages, func(i, j int) bool {
+		return merged.Pages[i].StartedDateTime.Before(merged.Pages[j].StartedDateTime)
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+	merged.appendEntries(entries)
+	return merged, nil
+}
+
+func samePage(a, b HarPage) bool {
+	return a.Id == b.Id && a.Title == b.Title && a.StartedDateTime.Equal(b.StartedDateTime)
+}
+
+func appendDistinct(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
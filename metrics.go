@@ -0,0 +1,142 @@
+package goharproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds, in seconds, of the request duration histogram buckets
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Index of failed round trips in proxyMetrics.requests, after the 1xx - 5xx status classes
+const errorClass = 5
+
+var requestClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx", "error"}
+
+// Counters of a single proxy, updated with atomics on the request and entry paths
+type proxyMetrics struct {
+	requests 		[6]int64
+	durationBuckets []int64
+	durationSum 	int64
+	durationCount 	int64
+	bytesIn 		int64
+	bytesOut		int64
+	inFlight 		int64
+	captureBytes 	int64
+
+	// Entries sent for processing and not recorded yet
+	pendingEntries 	int64
+
+	// Entries dropped because the entry queue was full
+	droppedEntries 	int64
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{durationBuckets : make([]int64, len(durationBuckets))}
+}
+
+func (metrics *proxyMetrics) requestStarted() {
+	atomic.AddInt64(&metrics.inFlight, 1)
+}
+
+// Records a finished round trip, resp is nil when it failed
+func (metrics *proxyMetrics) requestDone(req *http.Request, resp *http.Response, duration time.Duration) {
+	atomic.AddInt64(&metrics.inFlight, -1)
+	class := errorClass
+	if resp != nil && resp.StatusCode >= 100 && resp.StatusCode < 600 {
+		class = resp.StatusCode / 100 - 1
+	}
+	atomic.AddInt64(&metrics.requests[class], 1)
+	atomic.AddInt64(&totals.requests, 1)
+	if class == errorClass {
+		atomic.AddInt64(&totals.errors, 1)
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			atomic.AddInt64(&metrics.durationBuckets[i], 1)
+		}
+	}
+	atomic.AddInt64(&metrics.durationSum, int64(duration))
+	atomic.AddInt64(&metrics.durationCount, 1)
+
+	// Unknown lengths (chunked bodies) are not counted
+	if req.ContentLength > 0 {
+		atomic.AddInt64(&metrics.bytesIn, req.ContentLength)
+	}
+	if resp != nil && resp.ContentLength > 0 && !bodilessResponse(resp) {
+		atomic.AddInt64(&metrics.bytesOut, resp.ContentLength)
+	}
+}
+
+// Records a body copied into the HAR log
+func (metrics *proxyMetrics) captured(bytes int64) {
+	atomic.AddInt64(&metrics.captureBytes, bytes)
+	atomic.AddInt64(&totals.captureBytes, bytes)
+}
+
+func (metrics *proxyMetrics) entryAdded() {
+	atomic.AddInt64(&totals.entries, 1)
+}
+
+// Writes the metrics of the given proxies in the Prometheus text format.
+// Only the proxy port is used as label, keeping the cardinality bounded by the number of proxies.
+func writeMetrics(w io.Writer, harProxies []*HarProxy) {
+	fmt.Fprintf(w, "# HELP goharproxy_active_proxies Proxies created by the management server.\n")
+	fmt.Fprintf(w, "# TYPE goharproxy_active_proxies gauge\n")
+	fmt.Fprintf(w, "goharproxy_active_proxies %v\n", len(harProxies))
+
+	writeFamily(w, "goharproxy_requests_total", "counter", "Proxied requests by response status class.")
+	for _, harProxy := range harProxies {
+		for class, name := range requestClasses {
+			fmt.Fprintf(w, "goharproxy_requests_total{port=\"%v\",class=\"%v\"} %v\n",
+				harProxy.Port, name, atomic.LoadInt64(&harProxy.metrics.requests[class]))
+		}
+	}
+
+	writeFamily(w, "goharproxy_request_duration_seconds", "histogram", "Duration of proxied round trips.")
+	for _, harProxy := range harProxies {
+		metrics := harProxy.metrics
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "goharproxy_request_duration_seconds_bucket{port=\"%v\",le=\"%v\"} %v\n",
+				harProxy.Port, strconv.FormatFloat(bound, 'g', -1, 64), atomic.LoadInt64(&metrics.durationBuckets[i]))
+		}
+		count := atomic.LoadInt64(&metrics.durationCount)
+		fmt.Fprintf(w, "goharproxy_request_duration_seconds_bucket{port=\"%v\",le=\"+Inf\"} %v\n", harProxy.Port, count)
+		fmt.Fprintf(w, "goharproxy_request_duration_seconds_sum{port=\"%v\"} %v\n",
+			harProxy.Port, time.Duration(atomic.LoadInt64(&metrics.durationSum)).Seconds())
+		fmt.Fprintf(w, "goharproxy_request_duration_seconds_count{port=\"%v\"} %v\n", harProxy.Port, count)
+	}
+
+	writeProxyValues(w, harProxies, "goharproxy_request_bytes_total", "counter", "Request body bytes sent upstream.",
+		func(metrics *proxyMetrics) *int64 { return &metrics.bytesIn })
+	writeProxyValues(w, harProxies, "goharproxy_response_bytes_total", "counter", "Response body bytes received from upstream.",
+		func(metrics *proxyMetrics) *int64 { return &metrics.bytesOut })
+	writeProxyValues(w, harProxies, "goharproxy_in_flight_requests", "gauge", "Requests waiting for their upstream response.",
+		func(metrics *proxyMetrics) *int64 { return &metrics.inFlight })
+	writeProxyValues(w, harProxies, "goharproxy_pending_entries", "gauge", "Entries of completed requests not recorded yet.",
+		func(metrics *proxyMetrics) *int64 { return &metrics.pendingEntries })
+	writeProxyValues(w, harProxies, "goharproxy_dropped_entries_total", "counter", "Entries dropped because the entry queue was full.",
+		func(metrics *proxyMetrics) *int64 { return &metrics.droppedEntries })
+	writeFamily(w, "goharproxy_entries", "gauge", "Entries held in the HAR log.")
+	for _, harProxy := range harProxies {
+		fmt.Fprintf(w, "goharproxy_entries{port=\"%v\"} %v\n", harProxy.Port, harProxy.HarLog.Len())
+	}
+}
+
+func writeFamily(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, metricType)
+}
+
+func writeProxyValues(w io.Writer, harProxies []*HarProxy, name, metricType, help string, value func(*proxyMetrics) *int64) {
+	writeFamily(w, name, metricType, help)
+	for _, harProxy := range harProxies {
+		fmt.Fprintf(w, "%v{port=\"%v\"} %v\n", name, harProxy.Port, atomic.LoadInt64(value(harProxy.metrics)))
+	}
+}
@@ -0,0 +1,296 @@
+package goharproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Path segments taken for parameters by default, numbers and uuids
+var defaultOpenAPIParamPatterns = []string {
+	`^[0-9]+$`,
+	`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`,
+}
+
+// OpenAPIOptions controls which entries InferOpenAPI documents
+type OpenAPIOptions struct {
+	// The document's title, defaults to goharproxy
+	Title 			string
+
+	// Only entries whose url matches are documented, all of them when nil
+	UrlPattern 		*regexp.Regexp
+
+	// Regular expressions of the path segments which are parameters, numbers and uuids when empty
+	ParamPatterns 	[]string
+}
+
+// A draft OpenAPI 3 document, the paths, operations, parameters and media types observed with example bodies.
+// It has no schemas beyond the examples, it is meant to be completed by hand.
+type OpenAPIDocument struct {
+	OpenAPI string 						`json:"openapi"`
+	Info 	OpenAPIInfo 				`json:"info"`
+	Servers []OpenAPIServer 			`json:"servers,omitempty"`
+	Paths 	map[string]*OpenAPIPathItem `json:"paths"`
+}
+
+type OpenAPIInfo struct {
+	Title 		string 	`json:"title"`
+	Version 	string 	`json:"version"`
+	Description string 	`json:"description,omitempty"`
+}
+
+type OpenAPIServer struct {
+	Url 	string 	`json:"url"`
+}
+
+type OpenAPIPathItem struct {
+	Parameters 	[]OpenAPIParameter 	`json:"parameters,omitempty"`
+	Get 		*OpenAPIOperation 	`json:"get,omitempty"`
+	Put 		*OpenAPIOperation 	`json:"put,omitempty"`
+	Post 		*OpenAPIOperation 	`json:"post,omitempty"`
+	Delete 		*OpenAPIOperation 	`json:"delete,omitempty"`
+	Options 	*OpenAPIOperation 	`json:"options,omitempty"`
+	Head 		*OpenAPIOperation 	`json:"head,omitempty"`
+	Patch 		*OpenAPIOperation 	`json:"patch,omitempty"`
+	Trace 		*OpenAPIOperation 	`json:"trace,omitempty"`
+}
+
+type OpenAPIOperation struct {
+	Parameters 	[]OpenAPIParameter 			`json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody 		`json:"requestBody,omitempty"`
+	Responses 	map[string]*OpenAPIResponse `json:"responses"`
+}
+
+// A path or query parameter, all of them are strings
+type OpenAPIParameter struct {
+	Name 		string 			`json:"name"`
+	In 			string 			`json:"in"`
+	Required 	bool 			`json:"required"`
+	Schema 		OpenAPISchema 	`json:"schema"`
+	Example 	string 			`json:"example,omitempty"`
+}
+
+type OpenAPISchema struct {
+	Type 	string 	`json:"type"`
+}
+
+type OpenAPIRequestBody struct {
+	Content map[string]*OpenAPIMediaType 	`json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string 							`json:"description"`
+	Content 	map[string]*OpenAPIMediaType 	`json:"content,omitempty"`
+}
+
+// The first body seen of a media type, as JSON for JSON bodies and as a string otherwise
+type OpenAPIMediaType struct {
+	Example interface{} 	`json:"example,omitempty"`
+}
+
+// InferOpenAPI returns a draft OpenAPI 3 document of the requests of harLog's entries. Path segments matching
+// the parameter patterns are collapsed into parameters, e.g. /users/123 and /users/456 into /users/{id}.
+// Operations list the query parameters, media types and statuses seen, with the first body of each as example.
+func InferOpenAPI(harLog *HarLog, opts OpenAPIOptions) (OpenAPIDocument, error) {
+	if opts.Title == "" {
+		opts.Title = "goharproxy"
+	}
+	patterns := opts.ParamPatterns
+	if len(patterns) == 0 {
+		patterns = defaultOpenAPIParamPatterns
+	}
+	paramPatterns := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		var err error
+		if paramPatterns[i], err = regexp.Compile(pattern); err != nil {
+			return OpenAPIDocument{}, fmt.Errorf("invalid parameter pattern [%v]: %v", pattern, err)
+		}
+	}
+
+	document := OpenAPIDocument {
+		OpenAPI : "3.0.3",
+		Info 	: OpenAPIInfo{Title : opts.Title, Version : "0.0.0", Description : "Inferred from recorded traffic, a skeleton to complete"},
+		Paths 	: make(map[string]*OpenAPIPathItem),
+	}
+	servers := make(map[string]bool)
+	_, entries := harLog.snapshot()
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Request == nil || opts.UrlPattern != nil && !opts.UrlPattern.MatchString(entry.Request.Url) {
+			continue
+		}
+		requestUrl, err := url.Parse(entry.Request.Url)
+		if err != nil || requestUrl.Host == "" {
+			continue
+		}
+		path, pathParams := openAPIPath(requestUrl, paramPatterns)
+		pathItem := document.Paths[path]
+		if pathItem == nil {
+			pathItem = &OpenAPIPathItem{Parameters : pathParams}
+		}
+		operation := pathItem.operation(entry.Request.Method)
+		if operation == nil {
+			continue
+		}
+		document.Paths[path] = pathItem
+		if server := requestUrl.Scheme + "://" + requestUrl.Host; !servers[server] {
+			servers[server] = true
+			document.Servers = append(document.Servers, OpenAPIServer{Url : server})
+		}
+		operation.add(entry, requestUrl)
+	}
+	// Responses can't be empty, e.g. for requests whose client went away
+	for _, pathItem := range document.Paths {
+		for _, operation := range pathItem.operations() {
+			if len(operation.Responses) == 0 {
+				operation.Responses["default"] = &OpenAPIResponse{Description : "No response recorded"}
+			}
+		}
+	}
+	sort.Slice(document.Servers, func(i, j int) bool {
+		return document.Servers[i].Url < document.Servers[j].Url
+	})
+	return document, nil
+}
+
+// The templated path of requestUrl and its parameters, named id, id2... in order
+func openAPIPath(requestUrl *url.URL, paramPatterns []*regexp.Regexp) (string, []OpenAPIParameter) {
+	var params []OpenAPIParameter
+	segments := strings.Split(requestUrl.EscapedPath(), "/")
+	for i, segment := range segments {
+		if segment == "" || !matchesAny(paramPatterns, segment) {
+			continue
+		}
+		name := "id"
+		if len(params) > 0 {
+			name += strconv.Itoa(len(params) + 1)
+		}
+		params = append(params, OpenAPIParameter{Name : name, In : "path", Required : true, Schema : OpenAPISchema{Type : "string"}, Example : segment})
+		segments[i] = "{" + name + "}"
+	}
+	path := strings.Join(segments, "/")
+	if path == "" {
+		path = "/"
+	}
+	return path, params
+}
+
+// The operation of method, created when first seen, nil for methods OpenAPI doesn't have
+func (pathItem *OpenAPIPathItem) operation(method string) *OpenAPIOperation {
+	var operation **OpenAPIOperation
+	switch method {
+	case "GET":
+		operation = &pathItem.Get
+	case "PUT":
+		operation = &pathItem.Put
+	case "POST":
+		operation = &pathItem.Post
+	case "DELETE":
+		operation = &pathItem.Delete
+	case "OPTIONS":
+		operation = &pathItem.Options
+	case "HEAD":
+		operation = &pathItem.Head
+	case "PATCH":
+		operation = &pathItem.Patch
+	case "TRACE":
+		operation = &pathItem.Trace
+	default:
+		return nil
+	}
+	if *operation == nil {
+		*operation = &OpenAPIOperation{Responses : make(map[string]*OpenAPIResponse)}
+	}
+	return *operation
+}
+
+func (pathItem *OpenAPIPathItem) operations() []*OpenAPIOperation {
+	var operations []*OpenAPIOperation
+	for _, operation := range []*OpenAPIOperation{pathItem.Get, pathItem.Put, pathItem.Post, pathItem.Delete, pathItem.Options, pathItem.Head, pathItem.Patch, pathItem.Trace} {
+		if operation != nil {
+			operations = append(operations, operation)
+		}
+	}
+	return operations
+}
+
+// Adds what entry shows of the operation, its query parameters, body and response
+func (operation *OpenAPIOperation) add(entry *HarEntry, requestUrl *url.URL) {
+	query := requestUrl.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		known := false
+		for _, param := range operation.Parameters {
+			known = known || param.Name == name
+		}
+		if !known {
+			operation.Parameters = append(operation.Parameters, OpenAPIParameter{Name : name, In : "query", Schema : OpenAPISchema{Type : "string"}, Example : query.Get(name)})
+		}
+	}
+
+	if postData := entry.Request.PostData; postData != nil && postData.MimeType != "" {
+		if operation.RequestBody == nil {
+			operation.RequestBody = &OpenAPIRequestBody{Content : make(map[string]*OpenAPIMediaType)}
+		}
+		addOpenAPIExample(operation.RequestBody.Content, postData.MimeType, requestBody(entry.Request), postData.Truncated)
+	}
+
+	if entry.Response == nil || entry.Response.Status == 0 {
+		return
+	}
+	status := strconv.Itoa(entry.Response.Status)
+	response := operation.Responses[status]
+	if response == nil {
+		response = &OpenAPIResponse{Description : http.StatusText(entry.Response.Status)}
+		if response.Description == "" {
+			response.Description = "Status " + status
+		}
+		operation.Responses[status] = response
+	}
+	content := entry.Response.Content
+	if content == nil || content.MimeType == "" || entry.Response.BodySize == 0 && content.Size == 0 {
+		return
+	}
+	if response.Content == nil {
+		response.Content = make(map[string]*OpenAPIMediaType)
+	}
+	text := content.Text
+	if content.Encoding != "" {
+		// Base64 encoded binary content, not worth an example
+		text = ""
+	}
+	addOpenAPIExample(response.Content, content.MimeType, text, content.Truncated)
+}
+
+// Records the media type of mimeType, with body as its example unless one was seen.
+// JSON bodies are kept as JSON, truncated ones aren't examples.
+func addOpenAPIExample(content map[string]*OpenAPIMediaType, mimeType, body string, truncated bool) {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		mediaType = mimeType
+	}
+	mediaTypeObject := content[mediaType]
+	if mediaTypeObject == nil {
+		mediaTypeObject = &OpenAPIMediaType{}
+		content[mediaType] = mediaTypeObject
+	}
+	if mediaTypeObject.Example != nil || body == "" || truncated || !utf8.ValidString(body) {
+		return
+	}
+	if strings.HasSuffix(mediaType, "json") && json.Valid([]byte(body)) {
+		mediaTypeObject.Example = json.RawMessage(body)
+		return
+	}
+	mediaTypeObject.Example = body
+}
@@ -0,0 +1,61 @@
+package goharproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The request header labelling the page of a request's entry, unless HarProxyConfig.PageHeader names another one
+const DefaultPageHeader = "X-Har-Page"
+
+// NewPage adds a page to the proxy's HAR log, the entries of the requests reaching the proxy from then on refer to it
+func (proxy *HarProxy) NewPage(id, title string) {
+	proxy.HarLog.AddPage(HarPage{Id : id, Title : title, StartedDateTime : proxy.clock.Now()})
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.pageRef = id
+}
+
+// PageRef returns the id of the page new entries refer to, empty before NewPage
+func (proxy *HarProxy) PageRef() string {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	return proxy.pageRef
+}
+
+// The name of the page header, empty when there is none
+func (proxy *HarProxy) pageHeaderName() string {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	switch proxy.pageHeader {
+	case "":
+		return DefaultPageHeader
+	case "-":
+		return ""
+	}
+	return proxy.pageHeader
+}
+
+// Removes the page header of req, returning its value
+func (proxy *HarProxy) stripPageHeader(req *http.Request) string {
+	name := proxy.pageHeaderName()
+	if name == "" {
+		return ""
+	}
+	page := strings.TrimSpace(req.Header.Get(name))
+	req.Header.Del(name)
+	return page
+}
+
+// The page of req's entry: the value of its page header, the page being added to the log the first time
+// it is seen with the value as title, otherwise the current page. The header doesn't go upstream.
+func (proxy *HarProxy) requestPageRef(req *http.Request) string {
+	page := proxy.stripPageHeader(req)
+	if page == "" {
+		return proxy.PageRef()
+	}
+	if proxy.HarLog.addPageOnce(HarPage{Id : page, Title : page, StartedDateTime : proxy.clock.Now()}) {
+		proxy.logger.Debugf("Added page %v of a request header to proxy on port :%v", page, proxy.Port)
+	}
+	return page
+}
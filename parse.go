@@ -0,0 +1,344 @@
+package goharproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HarParseError tells which part of a HAR document ParseHar rejected
+type HarParseError struct {
+	// Index of the offending entry, -1 outside of the entries
+	Entry int
+
+	// Path of the offending field within the entry, or within the log outside of the entries, e.g. response.status
+	Field string
+
+	Err error
+}
+
+func (err *HarParseError) Error() string {
+	location := "HAR log"
+	if err.Entry >= 0 {
+		location = fmt.Sprintf("HAR entry %v", err.Entry)
+	}
+	if err.Field != "" {
+		location += " " + err.Field
+	}
+	return fmt.Sprintf("goharproxy: invalid %v: %v", location, err.Err)
+}
+
+func (err *HarParseError) Unwrap() error {
+	return err.Err
+}
+
+// ParseHar reads a HAR document, either written by this package or exported by a browser.
+// The log may be wrapped in a "log" object as in the HAR spec, or in a "harLog" one as in Har.
+// Unknown fields are ignored, numbers given as strings or with fractions are rounded to the int fields,
+// and creator / browser objects become "name version". Content keeps its encoding, see HarContent.Bytes.
+func ParseHar(r io.Reader) (*HarLog, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var document map[string]interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, &HarParseError{Entry : -1, Err : err}
+	}
+	logObject := document
+	for _, key := range []string{"log", "harLog"} {
+		if _, ok := document[key]; ok {
+			nested, err := objectField(document, key)
+			if err != nil || nested == nil {
+				return nil, &HarParseError{Entry : -1, Field : key, Err : errors.New("expected an object")}
+			}
+			logObject = nested
+			break
+		}
+	}
+
+	harLog := newHarLog()
+	if version, ok := logObject["version"]; ok {
+		harLog.Version = fmt.Sprint(version)
+	}
+	for field, target := range map[string]*string{"creator" : &harLog.Creator, "browser" : &harLog.Browser} {
+		if _, ok := logObject[field]; !ok {
+			continue
+		}
+		name, err := parseCreator(logObject[field])
+		if err != nil {
+			return nil, &HarParseError{Entry : -1, Field : field, Err : err}
+		}
+		*target = name
+	}
+
+	pages, err := arrayField(logObject, "pages")
+	if err != nil {
+		return nil, &HarParseError{Entry : -1, Field : "pages", Err : err}
+	}
+	for i, page := range pages {
+		field := fmt.Sprintf("pages[%v]", i)
+		harPage := HarPage{}
+		if err := decodeNormalized(page, &harPage, normalizePage); err != nil {
+			return nil, parseError(-1, field, err)
+		}
+		harLog.Pages = append(harLog.Pages, harPage)
+	}
+
+	entries, err := arrayField(logObject, "entries")
+	if err != nil {
+		return nil, &HarParseError{Entry : -1, Field : "entries", Err : err}
+	}
+	parsed := make([]HarEntry, len(entries))
+	for i, entry := range entries {
+		if err := decodeNormalized(entry, &parsed[i], normalizeEntry); err != nil {
+			return nil, parseError(i, "", err)
+		}
+		if err := validateEntry(parsed[i]); err != nil {
+			return nil, parseError(i, "", err)
+		}
+	}
+	harLog.appendEntries(parsed)
+	return harLog, nil
+}
+
+// A field error found while normalizing, Field is relative to the normalized object
+type fieldError struct {
+	Field string
+	Err error
+}
+
+func (err *fieldError) Error() string {
+	return err.Field + ": " + err.Err.Error()
+}
+
+func parseError(entry int, prefix string, err error) *HarParseError {
+	field := ""
+	var fieldErr *fieldError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &fieldErr):
+		field, err = fieldErr.Field, fieldErr.Err
+	case errors.As(err, &typeErr):
+		field, err = typeErr.Field, fmt.Errorf("expected %v, got %v", typeErr.Type, typeErr.Value)
+	}
+	if prefix != "" && field != "" {
+		field = prefix + "." + field
+	} else if prefix != "" {
+		field = prefix
+	}
+	return &HarParseError{Entry : entry, Field : field, Err : err}
+}
+
+// Normalizes value with normalize, then decodes it into target
+func decodeNormalized(value interface{}, target interface{}, normalize func(map[string]interface{}) error) error {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return errors.New("expected an object")
+	}
+	if err := normalize(object); err != nil {
+		return err
+	}
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+func normalizePage(page map[string]interface{}) error {
+	return normalizeInts(page, "pageTimings", "onContentLoad", "onLoad")
+}
+
+func normalizeEntry(entry map[string]interface{}) error {
+	if err := normalizeInts(entry, "", "time"); err != nil {
+		return err
+	}
+	if err := normalizeInts(entry, "timings", "blocked", "dns", "connect", "send", "wait", "receive", "ssl"); err != nil {
+		return err
+	}
+	if connection, ok := entry["connection"].(json.Number); ok {
+		entry["connection"] = connection.String()
+	}
+	if err := normalizeInts(entry, "request", "bodySize", "headersSize"); err != nil {
+		return err
+	}
+	if err := normalizeInts(entry, "response", "status", "bodySize", "headersSize"); err != nil {
+		return err
+	}
+	if err := normalizeInts(entry, "response.content", "size", "compression"); err != nil {
+		return err
+	}
+	for _, message := range []string{"request", "response"} {
+		if err := normalizeCookies(entry, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rounds the fields of the object at path, a dot separated path from object, to integers.
+// Fields are matched ignoring case, as encoding/json does. Missing objects and fields are left alone.
+func normalizeInts(object map[string]interface{}, path string, fields ...string) error {
+	nested, err := objectAt(object, path)
+	if err != nil || nested == nil {
+		return err
+	}
+	for key, value := range nested {
+		for _, field := range fields {
+			if !strings.EqualFold(key, field) {
+				continue
+			}
+			normalized, err := normalizeInt(value)
+			if err != nil {
+				return &fieldError{Field : joinField(path, key), Err : err}
+			}
+			nested[key] = normalized
+		}
+	}
+	return nil
+}
+
+func normalizeInt(value interface{}) (interface{}, error) {
+	var text string
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case json.Number:
+		text = value.String()
+	case string:
+		text = strings.TrimSpace(value)
+	default:
+		return nil, fmt.Errorf("expected a number, got %v", value)
+	}
+	if _, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return json.Number(text), nil
+	}
+	number, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return nil, fmt.Errorf("expected a number, got %q", text)
+	}
+	return json.Number(strconv.FormatInt(int64(math.Round(number)), 10)), nil
+}
+
+// Browsers write cookie expiry dates in various formats, or leave them empty. Unparseable dates are dropped.
+func normalizeCookies(entry map[string]interface{}, path string) error {
+	message, err := objectAt(entry, path)
+	if err != nil || message == nil {
+		return err
+	}
+	cookies, err := arrayField(message, "cookies")
+	if err != nil {
+		return &fieldError{Field : joinField(path, "cookies"), Err : err}
+	}
+	for _, cookie := range cookies {
+		cookie, ok := cookie.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		expires, ok := cookie["expires"].(string)
+		if !ok {
+			delete(cookie, "expires")
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, expires); err == nil {
+			continue
+		}
+		if parsed, err := http.ParseTime(expires); err == nil {
+			cookie["expires"] = parsed.Format(time.RFC3339Nano)
+		} else {
+			delete(cookie, "expires")
+		}
+	}
+	return nil
+}
+
+func validateEntry(entry HarEntry) error {
+	switch {
+	case entry.Request == nil:
+		return &fieldError{Field : "request", Err : errors.New("missing")}
+	case entry.Request.Method == "":
+		return &fieldError{Field : "request.method", Err : errors.New("missing")}
+	case entry.Request.Url == "":
+		return &fieldError{Field : "request.url", Err : errors.New("missing")}
+	}
+	return nil
+}
+
+// Creators are strings in logs of this package, and {"name", "version"} objects in the HAR spec
+func parseCreator(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case map[string]interface{}:
+		name, _ := value["name"].(string)
+		if version, ok := value["version"].(string); ok && version != "" {
+			return strings.TrimSpace(name + " " + version), nil
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("expected a string or an object, got %v", value)
+}
+
+// Returns the object at the dot separated path in object, nil if some part is missing or null
+func objectAt(object map[string]interface{}, path string) (map[string]interface{}, error) {
+	if path == "" {
+		return object, nil
+	}
+	current := object
+	var walked string
+	for _, key := range strings.Split(path, ".") {
+		walked = joinField(walked, key)
+		nested, err := objectField(current, key)
+		if err != nil {
+			return nil, &fieldError{Field : walked, Err : err}
+		}
+		if nested == nil {
+			return nil, nil
+		}
+		current = nested
+	}
+	return current, nil
+}
+
+func objectField(object map[string]interface{}, key string) (map[string]interface{}, error) {
+	switch value := object[key].(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return value, nil
+	}
+	return nil, errors.New("expected an object")
+}
+
+func arrayField(object map[string]interface{}, key string) ([]interface{}, error) {
+	switch value := object[key].(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		return value, nil
+	}
+	return nil, errors.New("expected an array")
+}
+
+func joinField(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// Bytes returns the content, decoding it if its encoding is base64
+func (content *HarContent) Bytes() ([]byte, error) {
+	if content.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(content.Text)
+	}
+	return []byte(content.Text), nil
+}
@@ -0,0 +1,61 @@
+package goharproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Counts the requests whose entries were not stored yet, from the moment they reach the proxy
+type pendingEntries struct {
+	lock 	sync.Mutex
+	count 	int
+
+	// Closed whenever count drops to 0, replaced when it rises again
+	idle 	chan struct{}
+}
+
+func newPendingEntries() *pendingEntries {
+	idle := make(chan struct{})
+	close(idle)
+	return &pendingEntries{idle : idle}
+}
+
+func (pending *pendingEntries) add() {
+	pending.lock.Lock()
+	defer pending.lock.Unlock()
+	if pending.count == 0 {
+		pending.idle = make(chan struct{})
+	}
+	pending.count++
+}
+
+func (pending *pendingEntries) done() {
+	pending.lock.Lock()
+	defer pending.lock.Unlock()
+	pending.count--
+	if pending.count == 0 {
+		close(pending.idle)
+	}
+}
+
+func (pending *pendingEntries) len() int {
+	pending.lock.Lock()
+	defer pending.lock.Unlock()
+	return pending.count
+}
+
+// Blocks until no entry is pending, ctx is done or expired receives
+func (pending *pendingEntries) wait(ctx context.Context, expired <-chan time.Time) error {
+	pending.lock.Lock()
+	idle := pending.idle
+	pending.lock.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-expired:
+		return context.DeadlineExceeded
+	}
+}
@@ -0,0 +1,268 @@
+package goharproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The schema of the collections ConvertHarToPostman returns
+const postmanSchema = "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"
+
+// PostmanOptions controls which entries ConvertHarToPostman exports and how they are grouped
+type PostmanOptions struct {
+	// The collection's name, defaults to goharproxy
+	Name 		string
+
+	// Only entries whose url matches are exported, all of them when nil
+	UrlPattern 	*regexp.Regexp
+
+	// Groups requests in a folder per "host", the default, or per "page", titled by the page
+	GroupBy 	string
+}
+
+// A Postman Collection v2.1, only with the fields exported requests use
+type PostmanCollection struct {
+	Info 	PostmanInfo 	`json:"info"`
+	Item 	[]PostmanItem 	`json:"item"`
+}
+
+type PostmanInfo struct {
+	Name 	string 	`json:"name"`
+	Schema 	string 	`json:"schema"`
+}
+
+// A folder when it has Item, a request otherwise
+type PostmanItem struct {
+	Name 	string 			`json:"name"`
+	Item 	[]PostmanItem 	`json:"item,omitempty"`
+	Request *PostmanRequest `json:"request,omitempty"`
+}
+
+type PostmanRequest struct {
+	Method 		string 				`json:"method"`
+	Header 		[]PostmanKeyValue 	`json:"header"`
+	Body 		*PostmanBody 		`json:"body,omitempty"`
+	Url 		PostmanUrl 			`json:"url"`
+	Description string 				`json:"description,omitempty"`
+}
+
+type PostmanKeyValue struct {
+	Key 	string 	`json:"key"`
+	Value 	string 	`json:"value"`
+	// For formdata, "text" or "file"
+	Type 	string 	`json:"type,omitempty"`
+	// For formdata files, the name of the uploaded file
+	Src 	string 	`json:"src,omitempty"`
+}
+
+type PostmanUrl struct {
+	Raw 		string 				`json:"raw"`
+	Protocol 	string 				`json:"protocol,omitempty"`
+	Host 		[]string 			`json:"host,omitempty"`
+	Port 		string 				`json:"port,omitempty"`
+	Path 		[]string 			`json:"path,omitempty"`
+	Query 		[]PostmanKeyValue 	`json:"query,omitempty"`
+}
+
+// Mode is raw, urlencoded, formdata or file, the field of the same name holds the body
+type PostmanBody struct {
+	Mode 		string 				`json:"mode"`
+	Raw 		string 				`json:"raw,omitempty"`
+	Urlencoded 	[]PostmanKeyValue 	`json:"urlencoded,omitempty"`
+	Formdata 	[]PostmanKeyValue 	`json:"formdata,omitempty"`
+	File 		*PostmanFile 		`json:"file,omitempty"`
+	Options 	*PostmanBodyOptions `json:"options,omitempty"`
+}
+
+type PostmanFile struct {
+	Src 	string 	`json:"src"`
+}
+
+type PostmanBodyOptions struct {
+	Raw 	PostmanRawOptions 	`json:"raw"`
+}
+
+type PostmanRawOptions struct {
+	// json, xml or text
+	Language 	string 	`json:"language"`
+}
+
+// ConvertHarToPostman returns the requests of harLog's entries as a Postman collection, in folders by host or page.
+// Hop by hop and HTTP/2 pseudo headers are left out, like in ToCurl. Binary bodies can't be exported,
+// the request gets an empty file body and a description saying what it was instead.
+func ConvertHarToPostman(harLog *HarLog, opts PostmanOptions) (PostmanCollection, error) {
+	if opts.GroupBy == "" {
+		opts.GroupBy = "host"
+	}
+	if opts.GroupBy != "host" && opts.GroupBy != "page" {
+		return PostmanCollection{}, fmt.Errorf("invalid postman groupBy [%v], expected host or page", opts.GroupBy)
+	}
+	if opts.Name == "" {
+		opts.Name = "goharproxy"
+	}
+	header, entries := harLog.snapshot()
+	pageTitles := make(map[string]string, len(header.Pages))
+	for _, page := range header.Pages {
+		pageTitles[page.Id] = page.Title
+	}
+
+	collection := PostmanCollection{Info : PostmanInfo{Name : opts.Name, Schema : postmanSchema}, Item : []PostmanItem{}}
+	folders := make(map[string]int)
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Request == nil || opts.UrlPattern != nil && !opts.UrlPattern.MatchString(entry.Request.Url) {
+			continue
+		}
+		item := postmanItem(entry.Request)
+		folder := statsGroupKeys["host"](entry)
+		if opts.GroupBy == "page" {
+			folder = entry.PageRef
+			if title := pageTitles[folder]; title != "" {
+				folder = title
+			}
+		}
+		if folder == "" {
+			collection.Item = append(collection.Item, item)
+			continue
+		}
+		if _, ok := folders[folder]; !ok {
+			folders[folder] = len(collection.Item)
+			collection.Item = append(collection.Item, PostmanItem{Name : folder, Item : []PostmanItem{}})
+		}
+		index := folders[folder]
+		collection.Item[index].Item = append(collection.Item[index].Item, item)
+	}
+	return collection, nil
+}
+
+func postmanItem(harRequest *HarRequest) PostmanItem {
+	request := &PostmanRequest{Method : harRequest.Method, Header : []PostmanKeyValue{}, Url : postmanUrl(harRequest.Url)}
+	request.Body, request.Description = postmanBody(harRequest.PostData)
+	// Postman sends formdata with a boundary of its own
+	formData := request.Body != nil && request.Body.Mode == "formdata"
+	for _, header := range harRequest.Headers {
+		name := http.CanonicalHeaderKey(header.Name)
+		if curlSkippedHeaders[name] || strings.HasPrefix(header.Name, ":") || formData && name == "Content-Type" {
+			continue
+		}
+		request.Header = append(request.Header, PostmanKeyValue{Key : header.Name, Value : header.Value})
+	}
+
+	name := harRequest.Method + " /" + strings.Join(request.Url.Path, "/")
+	return PostmanItem{Name : name, Request : request}
+}
+
+// Splits rawUrl the way Postman does, the host by dots and the path by slashes.
+// Query parameters are kept as they were encoded.
+func postmanUrl(rawUrl string) PostmanUrl {
+	postmanUrl := PostmanUrl{Raw : rawUrl}
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return postmanUrl
+	}
+	postmanUrl.Protocol = parsed.Scheme
+	if hostname := parsed.Hostname(); hostname != "" {
+		postmanUrl.Host = strings.Split(hostname, ".")
+	}
+	postmanUrl.Port = parsed.Port()
+	if path := strings.TrimPrefix(parsed.EscapedPath(), "/"); path != "" {
+		postmanUrl.Path = strings.Split(path, "/")
+	}
+	if parsed.RawQuery != "" {
+		for _, param := range strings.Split(parsed.RawQuery, "&") {
+			nameValue := strings.SplitN(param, "=", 2)
+			query := PostmanKeyValue{Key : nameValue[0]}
+			if len(nameValue) == 2 {
+				query.Value = nameValue[1]
+			}
+			postmanUrl.Query = append(postmanUrl.Query, query)
+		}
+	}
+	return postmanUrl
+}
+
+// The body of a request and, when it can't be exported, the description saying so
+func postmanBody(postData *HarPostData) (*PostmanBody, string) {
+	if postData == nil || postData.Text == "" && len(postData.Params) == 0 {
+		return nil, ""
+	}
+	mediaType, params, _ := mime.ParseMediaType(postData.MimeType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		body := &PostmanBody{Mode : "urlencoded", Urlencoded : []PostmanKeyValue{}}
+		if len(postData.Params) > 0 {
+			for _, param := range postData.Params {
+				body.Urlencoded = append(body.Urlencoded, PostmanKeyValue{Key : param.Name, Value : param.Value})
+			}
+			return body, ""
+		}
+		if _, err := url.ParseQuery(postData.Text); err != nil {
+			break
+		}
+		// In the order they were sent, which ParseQuery loses
+		for _, param := range strings.Split(postData.Text, "&") {
+			nameValue := strings.SplitN(param, "=", 2)
+			key, _ := url.QueryUnescape(nameValue[0])
+			value := ""
+			if len(nameValue) == 2 {
+				value, _ = url.QueryUnescape(nameValue[1])
+			}
+			body.Urlencoded = append(body.Urlencoded, PostmanKeyValue{Key : key, Value : value})
+		}
+		return body, ""
+	case mediaType == "multipart/form-data" && !postData.Truncated:
+		if body := postmanFormData(postData.Text, params["boundary"]); body != nil {
+			return body, ""
+		}
+	}
+	if !pastable(postData.Text) || postData.Truncated {
+		description := fmt.Sprintf("The recorded body of %v bytes (%v) wasn't exported, select a file to send", len(postData.Text), postData.MimeType)
+		if postData.Truncated {
+			description = fmt.Sprintf("The recorded body (%v) was truncated and wasn't exported, select a file to send", postData.MimeType)
+		}
+		return &PostmanBody{Mode : "file", File : &PostmanFile{}}, description
+	}
+	language := "text"
+	switch {
+	case strings.HasSuffix(mediaType, "json"):
+		language = "json"
+	case strings.HasSuffix(mediaType, "xml"):
+		language = "xml"
+	}
+	return &PostmanBody{Mode : "raw", Raw : postData.Text, Options : &PostmanBodyOptions{Raw : PostmanRawOptions{Language : language}}}, ""
+}
+
+// The parts of a multipart form as formdata, files by their name, nil if it can't be parsed
+func postmanFormData(text, boundary string) *PostmanBody {
+	if boundary == "" {
+		return nil
+	}
+	body := &PostmanBody{Mode : "formdata", Formdata : []PostmanKeyValue{}}
+	reader := multipart.NewReader(bytes.NewReader([]byte(text)), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			if err != io.EOF || len(body.Formdata) == 0 {
+				return nil
+			}
+			return body
+		}
+		if part.FileName() != "" {
+			body.Formdata = append(body.Formdata, PostmanKeyValue{Key : part.FormName(), Type : "file", Src : part.FileName()})
+			continue
+		}
+		value, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil
+		}
+		body.Formdata = append(body.Formdata, PostmanKeyValue{Key : part.FormName(), Value : string(value), Type : "text"})
+	}
+}
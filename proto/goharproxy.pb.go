@@ -0,0 +1,873 @@
+// The management API as a gRPC service, mirroring the REST routes of the management server.
+// Served by the grpcserver package. Messages follow the json of the REST API, field names in snake_case.
+//
+// Regenerate goharproxy.pb.go and goharproxy_grpc.pb.go from the repository root with
+//   protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative proto/goharproxy.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: proto/goharproxy.proto
+
+package goharproxypb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ProxyRef struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Port          int32                  `protobuf:"varint,1,opt,name=port,proto3" json:"port,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProxyRef) Reset() {
+	*x = ProxyRef{}
+	mi := &file_proto_goharproxy_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProxyRef) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProxyRef) ProtoMessage() {}
+
+func (x *ProxyRef) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProxyRef.ProtoReflect.Descriptor instead.
+func (*ProxyRef) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ProxyRef) GetPort() int32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+type CreateProxyRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// 0 picks a free port
+	Port            int32            `protobuf:"varint,1,opt,name=port,proto3" json:"port,omitempty"`
+	BindAddress     string           `protobuf:"bytes,2,opt,name=bind_address,json=bindAddress,proto3" json:"bind_address,omitempty"`
+	Name            string           `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
+	CaptureSettings *CaptureSettings `protobuf:"bytes,4,opt,name=capture_settings,json=captureSettings,proto3" json:"capture_settings,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *CreateProxyRequest) Reset() {
+	*x = CreateProxyRequest{}
+	mi := &file_proto_goharproxy_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateProxyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateProxyRequest) ProtoMessage() {}
+
+func (x *CreateProxyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateProxyRequest.ProtoReflect.Descriptor instead.
+func (*CreateProxyRequest) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *CreateProxyRequest) GetPort() int32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *CreateProxyRequest) GetBindAddress() string {
+	if x != nil {
+		return x.BindAddress
+	}
+	return ""
+}
+
+func (x *CreateProxyRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *CreateProxyRequest) GetCaptureSettings() *CaptureSettings {
+	if x != nil {
+		return x.CaptureSettings
+	}
+	return nil
+}
+
+type Proxy struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Port    int32                  `protobuf:"varint,1,opt,name=port,proto3" json:"port,omitempty"`
+	Name    string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Address string                 `protobuf:"bytes,3,opt,name=address,proto3" json:"address,omitempty"`
+	// The owner of the key which created the proxy, see ProxyServerOptions.APIKeys
+	Owner         string `protobuf:"bytes,4,opt,name=owner,proto3" json:"owner,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Proxy) Reset() {
+	*x = Proxy{}
+	mi := &file_proto_goharproxy_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Proxy) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Proxy) ProtoMessage() {}
+
+func (x *Proxy) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Proxy.ProtoReflect.Descriptor instead.
+func (*Proxy) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Proxy) GetPort() int32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *Proxy) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Proxy) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *Proxy) GetOwner() string {
+	if x != nil {
+		return x.Owner
+	}
+	return ""
+}
+
+type DeleteProxyResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteProxyResponse) Reset() {
+	*x = DeleteProxyResponse{}
+	mi := &file_proto_goharproxy_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteProxyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteProxyResponse) ProtoMessage() {}
+
+func (x *DeleteProxyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteProxyResponse.ProtoReflect.Descriptor instead.
+func (*DeleteProxyResponse) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{3}
+}
+
+type ListProxiesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListProxiesRequest) Reset() {
+	*x = ListProxiesRequest{}
+	mi := &file_proto_goharproxy_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListProxiesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListProxiesRequest) ProtoMessage() {}
+
+func (x *ListProxiesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListProxiesRequest.ProtoReflect.Descriptor instead.
+func (*ListProxiesRequest) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{4}
+}
+
+type ListProxiesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Proxies       []*Proxy               `protobuf:"bytes,1,rep,name=proxies,proto3" json:"proxies,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListProxiesResponse) Reset() {
+	*x = ListProxiesResponse{}
+	mi := &file_proto_goharproxy_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListProxiesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListProxiesResponse) ProtoMessage() {}
+
+func (x *ListProxiesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListProxiesResponse.ProtoReflect.Descriptor instead.
+func (*ListProxiesResponse) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ListProxiesResponse) GetProxies() []*Proxy {
+	if x != nil {
+		return x.Proxies
+	}
+	return nil
+}
+
+// ProxyHosts
+type HostEntry struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Host    string                 `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	NewHost string                 `protobuf:"bytes,2,opt,name=new_host,json=newHost,proto3" json:"new_host,omitempty"`
+	// exact when empty, wildcard or regex
+	MatchType          string `protobuf:"bytes,3,opt,name=match_type,json=matchType,proto3" json:"match_type,omitempty"`
+	NewScheme          string `protobuf:"bytes,4,opt,name=new_scheme,json=newScheme,proto3" json:"new_scheme,omitempty"`
+	PreserveHostHeader bool   `protobuf:"varint,5,opt,name=preserve_host_header,json=preserveHostHeader,proto3" json:"preserve_host_header,omitempty"`
+	RewriteLocation    bool   `protobuf:"varint,6,opt,name=rewrite_location,json=rewriteLocation,proto3" json:"rewrite_location,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *HostEntry) Reset() {
+	*x = HostEntry{}
+	mi := &file_proto_goharproxy_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HostEntry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HostEntry) ProtoMessage() {}
+
+func (x *HostEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HostEntry.ProtoReflect.Descriptor instead.
+func (*HostEntry) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *HostEntry) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *HostEntry) GetNewHost() string {
+	if x != nil {
+		return x.NewHost
+	}
+	return ""
+}
+
+func (x *HostEntry) GetMatchType() string {
+	if x != nil {
+		return x.MatchType
+	}
+	return ""
+}
+
+func (x *HostEntry) GetNewScheme() string {
+	if x != nil {
+		return x.NewScheme
+	}
+	return ""
+}
+
+func (x *HostEntry) GetPreserveHostHeader() bool {
+	if x != nil {
+		return x.PreserveHostHeader
+	}
+	return false
+}
+
+func (x *HostEntry) GetRewriteLocation() bool {
+	if x != nil {
+		return x.RewriteLocation
+	}
+	return false
+}
+
+type SetHostsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Port          int32                  `protobuf:"varint,1,opt,name=port,proto3" json:"port,omitempty"`
+	Hosts         []*HostEntry           `protobuf:"bytes,2,rep,name=hosts,proto3" json:"hosts,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetHostsRequest) Reset() {
+	*x = SetHostsRequest{}
+	mi := &file_proto_goharproxy_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetHostsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetHostsRequest) ProtoMessage() {}
+
+func (x *SetHostsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetHostsRequest.ProtoReflect.Descriptor instead.
+func (*SetHostsRequest) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *SetHostsRequest) GetPort() int32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *SetHostsRequest) GetHosts() []*HostEntry {
+	if x != nil {
+		return x.Hosts
+	}
+	return nil
+}
+
+type SetHostsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetHostsResponse) Reset() {
+	*x = SetHostsResponse{}
+	mi := &file_proto_goharproxy_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetHostsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetHostsResponse) ProtoMessage() {}
+
+func (x *SetHostsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetHostsResponse.ProtoReflect.Descriptor instead.
+func (*SetHostsResponse) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{8}
+}
+
+type CaptureSettings struct {
+	state                           protoimpl.MessageState `protogen:"open.v1"`
+	CaptureContent                  bool                   `protobuf:"varint,1,opt,name=capture_content,json=captureContent,proto3" json:"capture_content,omitempty"`
+	CaptureBeforeResponseMiddleware bool                   `protobuf:"varint,2,opt,name=capture_before_response_middleware,json=captureBeforeResponseMiddleware,proto3" json:"capture_before_response_middleware,omitempty"`
+	DisableRecording                bool                   `protobuf:"varint,3,opt,name=disable_recording,json=disableRecording,proto3" json:"disable_recording,omitempty"`
+	MaxCaptureBytes                 int64                  `protobuf:"varint,4,opt,name=max_capture_bytes,json=maxCaptureBytes,proto3" json:"max_capture_bytes,omitempty"`
+	unknownFields                   protoimpl.UnknownFields
+	sizeCache                       protoimpl.SizeCache
+}
+
+func (x *CaptureSettings) Reset() {
+	*x = CaptureSettings{}
+	mi := &file_proto_goharproxy_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CaptureSettings) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CaptureSettings) ProtoMessage() {}
+
+func (x *CaptureSettings) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CaptureSettings.ProtoReflect.Descriptor instead.
+func (*CaptureSettings) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *CaptureSettings) GetCaptureContent() bool {
+	if x != nil {
+		return x.CaptureContent
+	}
+	return false
+}
+
+func (x *CaptureSettings) GetCaptureBeforeResponseMiddleware() bool {
+	if x != nil {
+		return x.CaptureBeforeResponseMiddleware
+	}
+	return false
+}
+
+func (x *CaptureSettings) GetDisableRecording() bool {
+	if x != nil {
+		return x.DisableRecording
+	}
+	return false
+}
+
+func (x *CaptureSettings) GetMaxCaptureBytes() int64 {
+	if x != nil {
+		return x.MaxCaptureBytes
+	}
+	return 0
+}
+
+type SetCaptureSettingsRequest struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Port            int32                  `protobuf:"varint,1,opt,name=port,proto3" json:"port,omitempty"`
+	CaptureSettings *CaptureSettings       `protobuf:"bytes,2,opt,name=capture_settings,json=captureSettings,proto3" json:"capture_settings,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *SetCaptureSettingsRequest) Reset() {
+	*x = SetCaptureSettingsRequest{}
+	mi := &file_proto_goharproxy_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetCaptureSettingsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetCaptureSettingsRequest) ProtoMessage() {}
+
+func (x *SetCaptureSettingsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetCaptureSettingsRequest.ProtoReflect.Descriptor instead.
+func (*SetCaptureSettingsRequest) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *SetCaptureSettingsRequest) GetPort() int32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *SetCaptureSettingsRequest) GetCaptureSettings() *CaptureSettings {
+	if x != nil {
+		return x.CaptureSettings
+	}
+	return nil
+}
+
+// A HAR entry as json, like the entries of the REST API, so that its extensions need no message of their own
+type Entry struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	Sequence     int64                  `protobuf:"varint,1,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	HarEntryJson []byte                 `protobuf:"bytes,2,opt,name=har_entry_json,json=harEntryJson,proto3" json:"har_entry_json,omitempty"`
+	// The entry's _id, never reused by its proxy
+	Id            int64 `protobuf:"varint,3,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Entry) Reset() {
+	*x = Entry{}
+	mi := &file_proto_goharproxy_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Entry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Entry) ProtoMessage() {}
+
+func (x *Entry) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Entry.ProtoReflect.Descriptor instead.
+func (*Entry) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *Entry) GetSequence() int64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *Entry) GetHarEntryJson() []byte {
+	if x != nil {
+		return x.HarEntryJson
+	}
+	return nil
+}
+
+func (x *Entry) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type EntryRef struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Port          int32                  `protobuf:"varint,1,opt,name=port,proto3" json:"port,omitempty"`
+	Id            int64                  `protobuf:"varint,2,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EntryRef) Reset() {
+	*x = EntryRef{}
+	mi := &file_proto_goharproxy_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EntryRef) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EntryRef) ProtoMessage() {}
+
+func (x *EntryRef) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_goharproxy_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EntryRef.ProtoReflect.Descriptor instead.
+func (*EntryRef) Descriptor() ([]byte, []int) {
+	return file_proto_goharproxy_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *EntryRef) GetPort() int32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *EntryRef) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+var File_proto_goharproxy_proto protoreflect.FileDescriptor
+
+const file_proto_goharproxy_proto_rawDesc = "" +
+	"\n" +
+	"\x16proto/goharproxy.proto\x12\rgoharproxy.v1\"\x1e\n" +
+	"\bProxyRef\x12\x12\n" +
+	"\x04port\x18\x01 \x01(\x05R\x04port\"\xaa\x01\n" +
+	"\x12CreateProxyRequest\x12\x12\n" +
+	"\x04port\x18\x01 \x01(\x05R\x04port\x12!\n" +
+	"\fbind_address\x18\x02 \x01(\tR\vbindAddress\x12\x12\n" +
+	"\x04name\x18\x03 \x01(\tR\x04name\x12I\n" +
+	"\x10capture_settings\x18\x04 \x01(\v2\x1e.goharproxy.v1.CaptureSettingsR\x0fcaptureSettings\"_\n" +
+	"\x05Proxy\x12\x12\n" +
+	"\x04port\x18\x01 \x01(\x05R\x04port\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12\x18\n" +
+	"\aaddress\x18\x03 \x01(\tR\aaddress\x12\x14\n" +
+	"\x05owner\x18\x04 \x01(\tR\x05owner\"\x15\n" +
+	"\x13DeleteProxyResponse\"\x14\n" +
+	"\x12ListProxiesRequest\"E\n" +
+	"\x13ListProxiesResponse\x12.\n" +
+	"\aproxies\x18\x01 \x03(\v2\x14.goharproxy.v1.ProxyR\aproxies\"\xd5\x01\n" +
+	"\tHostEntry\x12\x12\n" +
+	"\x04host\x18\x01 \x01(\tR\x04host\x12\x19\n" +
+	"\bnew_host\x18\x02 \x01(\tR\anewHost\x12\x1d\n" +
+	"\n" +
+	"match_type\x18\x03 \x01(\tR\tmatchType\x12\x1d\n" +
+	"\n" +
+	"new_scheme\x18\x04 \x01(\tR\tnewScheme\x120\n" +
+	"\x14preserve_host_header\x18\x05 \x01(\bR\x12preserveHostHeader\x12)\n" +
+	"\x10rewrite_location\x18\x06 \x01(\bR\x0frewriteLocation\"U\n" +
+	"\x0fSetHostsRequest\x12\x12\n" +
+	"\x04port\x18\x01 \x01(\x05R\x04port\x12.\n" +
+	"\x05hosts\x18\x02 \x03(\v2\x18.goharproxy.v1.HostEntryR\x05hosts\"\x12\n" +
+	"\x10SetHostsResponse\"\xe0\x01\n" +
+	"\x0fCaptureSettings\x12'\n" +
+	"\x0fcapture_content\x18\x01 \x01(\bR\x0ecaptureContent\x12K\n" +
+	"\"capture_before_response_middleware\x18\x02 \x01(\bR\x1fcaptureBeforeResponseMiddleware\x12+\n" +
+	"\x11disable_recording\x18\x03 \x01(\bR\x10disableRecording\x12*\n" +
+	"\x11max_capture_bytes\x18\x04 \x01(\x03R\x0fmaxCaptureBytes\"z\n" +
+	"\x19SetCaptureSettingsRequest\x12\x12\n" +
+	"\x04port\x18\x01 \x01(\x05R\x04port\x12I\n" +
+	"\x10capture_settings\x18\x02 \x01(\v2\x1e.goharproxy.v1.CaptureSettingsR\x0fcaptureSettings\"Y\n" +
+	"\x05Entry\x12\x1a\n" +
+	"\bsequence\x18\x01 \x01(\x03R\bsequence\x12$\n" +
+	"\x0ehar_entry_json\x18\x02 \x01(\fR\fharEntryJson\x12\x0e\n" +
+	"\x02id\x18\x03 \x01(\x03R\x02id\".\n" +
+	"\bEntryRef\x12\x12\n" +
+	"\x04port\x18\x01 \x01(\x05R\x04port\x12\x0e\n" +
+	"\x02id\x18\x02 \x01(\x03R\x02id2\xdd\x04\n" +
+	"\fProxyService\x12F\n" +
+	"\vCreateProxy\x12!.goharproxy.v1.CreateProxyRequest\x1a\x14.goharproxy.v1.Proxy\x12J\n" +
+	"\vDeleteProxy\x12\x17.goharproxy.v1.ProxyRef\x1a\".goharproxy.v1.DeleteProxyResponse\x12T\n" +
+	"\vListProxies\x12!.goharproxy.v1.ListProxiesRequest\x1a\".goharproxy.v1.ListProxiesResponse\x129\n" +
+	"\x06GetHar\x12\x17.goharproxy.v1.ProxyRef\x1a\x14.goharproxy.v1.Entry0\x01\x12K\n" +
+	"\bSetHosts\x12\x1e.goharproxy.v1.SetHostsRequest\x1a\x1f.goharproxy.v1.SetHostsResponse\x12^\n" +
+	"\x12SetCaptureSettings\x12(.goharproxy.v1.SetCaptureSettingsRequest\x1a\x1e.goharproxy.v1.CaptureSettings\x12@\n" +
+	"\rStreamEntries\x12\x17.goharproxy.v1.ProxyRef\x1a\x14.goharproxy.v1.Entry0\x01\x129\n" +
+	"\bGetEntry\x12\x17.goharproxy.v1.EntryRef\x1a\x14.goharproxy.v1.EntryB3Z1github.com/Hellspam/goharproxy/proto;goharproxypbb\x06proto3"
+
+var (
+	file_proto_goharproxy_proto_rawDescOnce sync.Once
+	file_proto_goharproxy_proto_rawDescData []byte
+)
+
+func file_proto_goharproxy_proto_rawDescGZIP() []byte {
+	file_proto_goharproxy_proto_rawDescOnce.Do(func() {
+		file_proto_goharproxy_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_proto_goharproxy_proto_rawDesc), len(file_proto_goharproxy_proto_rawDesc)))
+	})
+	return file_proto_goharproxy_proto_rawDescData
+}
+
+var file_proto_goharproxy_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
+var file_proto_goharproxy_proto_goTypes = []any{
+	(*ProxyRef)(nil),                  // 0: goharproxy.v1.ProxyRef
+	(*CreateProxyRequest)(nil),        // 1: goharproxy.v1.CreateProxyRequest
+	(*Proxy)(nil),                     // 2: goharproxy.v1.Proxy
+	(*DeleteProxyResponse)(nil),       // 3: goharproxy.v1.DeleteProxyResponse
+	(*ListProxiesRequest)(nil),        // 4: goharproxy.v1.ListProxiesRequest
+	(*ListProxiesResponse)(nil),       // 5: goharproxy.v1.ListProxiesResponse
+	(*HostEntry)(nil),                 // 6: goharproxy.v1.HostEntry
+	(*SetHostsRequest)(nil),           // 7: goharproxy.v1.SetHostsRequest
+	(*SetHostsResponse)(nil),          // 8: goharproxy.v1.SetHostsResponse
+	(*CaptureSettings)(nil),           // 9: goharproxy.v1.CaptureSettings
+	(*SetCaptureSettingsRequest)(nil), // 10: goharproxy.v1.SetCaptureSettingsRequest
+	(*Entry)(nil),                     // 11: goharproxy.v1.Entry
+	(*EntryRef)(nil),                  // 12: goharproxy.v1.EntryRef
+}
+var file_proto_goharproxy_proto_depIdxs = []int32{
+	9,  // 0: goharproxy.v1.CreateProxyRequest.capture_settings:type_name -> goharproxy.v1.CaptureSettings
+	2,  // 1: goharproxy.v1.ListProxiesResponse.proxies:type_name -> goharproxy.v1.Proxy
+	6,  // 2: goharproxy.v1.SetHostsRequest.hosts:type_name -> goharproxy.v1.HostEntry
+	9,  // 3: goharproxy.v1.SetCaptureSettingsRequest.capture_settings:type_name -> goharproxy.v1.CaptureSettings
+	1,  // 4: goharproxy.v1.ProxyService.CreateProxy:input_type -> goharproxy.v1.CreateProxyRequest
+	0,  // 5: goharproxy.v1.ProxyService.DeleteProxy:input_type -> goharproxy.v1.ProxyRef
+	4,  // 6: goharproxy.v1.ProxyService.ListProxies:input_type -> goharproxy.v1.ListProxiesRequest
+	0,  // 7: goharproxy.v1.ProxyService.GetHar:input_type -> goharproxy.v1.ProxyRef
+	7,  // 8: goharproxy.v1.ProxyService.SetHosts:input_type -> goharproxy.v1.SetHostsRequest
+	10, // 9: goharproxy.v1.ProxyService.SetCaptureSettings:input_type -> goharproxy.v1.SetCaptureSettingsRequest
+	0,  // 10: goharproxy.v1.ProxyService.StreamEntries:input_type -> goharproxy.v1.ProxyRef
+	12, // 11: goharproxy.v1.ProxyService.GetEntry:input_type -> goharproxy.v1.EntryRef
+	2,  // 12: goharproxy.v1.ProxyService.CreateProxy:output_type -> goharproxy.v1.Proxy
+	3,  // 13: goharproxy.v1.ProxyService.DeleteProxy:output_type -> goharproxy.v1.DeleteProxyResponse
+	5,  // 14: goharproxy.v1.ProxyService.ListProxies:output_type -> goharproxy.v1.ListProxiesResponse
+	11, // 15: goharproxy.v1.ProxyService.GetHar:output_type -> goharproxy.v1.Entry
+	8,  // 16: goharproxy.v1.ProxyService.SetHosts:output_type -> goharproxy.v1.SetHostsResponse
+	9,  // 17: goharproxy.v1.ProxyService.SetCaptureSettings:output_type -> goharproxy.v1.CaptureSettings
+	11, // 18: goharproxy.v1.ProxyService.StreamEntries:output_type -> goharproxy.v1.Entry
+	11, // 19: goharproxy.v1.ProxyService.GetEntry:output_type -> goharproxy.v1.Entry
+	12, // [12:20] is the sub-list for method output_type
+	4,  // [4:12] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_proto_goharproxy_proto_init() }
+func file_proto_goharproxy_proto_init() {
+	if File_proto_goharproxy_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_goharproxy_proto_rawDesc), len(file_proto_goharproxy_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   13,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_proto_goharproxy_proto_goTypes,
+		DependencyIndexes: file_proto_goharproxy_proto_depIdxs,
+		MessageInfos:      file_proto_goharproxy_proto_msgTypes,
+	}.Build()
+	File_proto_goharproxy_proto = out.File
+	file_proto_goharproxy_proto_goTypes = nil
+	file_proto_goharproxy_proto_depIdxs = nil
+}
@@ -0,0 +1,416 @@
+// The management API as a gRPC service, mirroring the REST routes of the management server.
+// Served by the grpcserver package. Messages follow the json of the REST API, field names in snake_case.
+//
+// Regenerate goharproxy.pb.go and goharproxy_grpc.pb.go from the repository root with
+//   protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative proto/goharproxy.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.0
+// - protoc             (unknown)
+// source: proto/goharproxy.proto
+
+package goharproxypb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ProxyService_CreateProxy_FullMethodName        = "/goharproxy.v1.ProxyService/CreateProxy"
+	ProxyService_DeleteProxy_FullMethodName        = "/goharproxy.v1.ProxyService/DeleteProxy"
+	ProxyService_ListProxies_FullMethodName        = "/goharproxy.v1.ProxyService/ListProxies"
+	ProxyService_GetHar_FullMethodName             = "/goharproxy.v1.ProxyService/GetHar"
+	ProxyService_SetHosts_FullMethodName           = "/goharproxy.v1.ProxyService/SetHosts"
+	ProxyService_SetCaptureSettings_FullMethodName = "/goharproxy.v1.ProxyService/SetCaptureSettings"
+	ProxyService_StreamEntries_FullMethodName      = "/goharproxy.v1.ProxyService/StreamEntries"
+	ProxyService_GetEntry_FullMethodName           = "/goharproxy.v1.ProxyService/GetEntry"
+)
+
+// ProxyServiceClient is the client API for ProxyService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ProxyServiceClient interface {
+	// POST /proxy
+	CreateProxy(ctx context.Context, in *CreateProxyRequest, opts ...grpc.CallOption) (*Proxy, error)
+	// DELETE /proxy/[port]
+	DeleteProxy(ctx context.Context, in *ProxyRef, opts ...grpc.CallOption) (*DeleteProxyResponse, error)
+	// GET /proxy
+	ListProxies(ctx context.Context, in *ListProxiesRequest, opts ...grpc.CallOption) (*ListProxiesResponse, error)
+	// PUT /proxy/[port]/har, streams the recorded entries and clears them
+	GetHar(ctx context.Context, in *ProxyRef, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Entry], error)
+	// POST /proxy/[port]/hosts
+	SetHosts(ctx context.Context, in *SetHostsRequest, opts ...grpc.CallOption) (*SetHostsResponse, error)
+	// PUT /proxy/[port]/captureSettings
+	SetCaptureSettings(ctx context.Context, in *SetCaptureSettingsRequest, opts ...grpc.CallOption) (*CaptureSettings, error)
+	// GET /proxy/[port]/har/stream, the entries recorded from now on until cancelled or the proxy is deleted
+	StreamEntries(ctx context.Context, in *ProxyRef, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Entry], error)
+	// GET /proxy/[port]/har/entry/[id], NOT_FOUND once the entry was cleared
+	GetEntry(ctx context.Context, in *EntryRef, opts ...grpc.CallOption) (*Entry, error)
+}
+
+type proxyServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewProxyServiceClient(cc grpc.ClientConnInterface) ProxyServiceClient {
+	return &proxyServiceClient{cc}
+}
+
+func (c *proxyServiceClient) CreateProxy(ctx context.Context, in *CreateProxyRequest, opts ...grpc.CallOption) (*Proxy, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Proxy)
+	err := c.cc.Invoke(ctx, ProxyService_CreateProxy_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyServiceClient) DeleteProxy(ctx context.Context, in *ProxyRef, opts ...grpc.CallOption) (*DeleteProxyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteProxyResponse)
+	err := c.cc.Invoke(ctx, ProxyService_DeleteProxy_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyServiceClient) ListProxies(ctx context.Context, in *ListProxiesRequest, opts ...grpc.CallOption) (*ListProxiesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListProxiesResponse)
+	err := c.cc.Invoke(ctx, ProxyService_ListProxies_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyServiceClient) GetHar(ctx context.Context, in *ProxyRef, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Entry], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ProxyService_ServiceDesc.Streams[0], ProxyService_GetHar_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ProxyRef, Entry]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ProxyService_GetHarClient = grpc.ServerStreamingClient[Entry]
+
+func (c *proxyServiceClient) SetHosts(ctx context.Context, in *SetHostsRequest, opts ...grpc.CallOption) (*SetHostsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SetHostsResponse)
+	err := c.cc.Invoke(ctx, ProxyService_SetHosts_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyServiceClient) SetCaptureSettings(ctx context.Context, in *SetCaptureSettingsRequest, opts ...grpc.CallOption) (*CaptureSettings, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CaptureSettings)
+	err := c.cc.Invoke(ctx, ProxyService_SetCaptureSettings_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyServiceClient) StreamEntries(ctx context.Context, in *ProxyRef, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Entry], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ProxyService_ServiceDesc.Streams[1], ProxyService_StreamEntries_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ProxyRef, Entry]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ProxyService_StreamEntriesClient = grpc.ServerStreamingClient[Entry]
+
+func (c *proxyServiceClient) GetEntry(ctx context.Context, in *EntryRef, opts ...grpc.CallOption) (*Entry, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Entry)
+	err := c.cc.Invoke(ctx, ProxyService_GetEntry_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ProxyServiceServer is the server API for ProxyService service.
+// All implementations must embed UnimplementedProxyServiceServer
+// for forward compatibility.
+type ProxyServiceServer interface {
+	// POST /proxy
+	CreateProxy(context.Context, *CreateProxyRequest) (*Proxy, error)
+	// DELETE /proxy/[port]
+	DeleteProxy(context.Context, *ProxyRef) (*DeleteProxyResponse, error)
+	// GET /proxy
+	ListProxies(context.Context, *ListProxiesRequest) (*ListProxiesResponse, error)
+	// PUT /proxy/[port]/har, streams the recorded entries and clears them
+	GetHar(*ProxyRef, grpc.ServerStreamingServer[Entry]) error
+	// POST /proxy/[port]/hosts
+	SetHosts(context.Context, *SetHostsRequest) (*SetHostsResponse, error)
+	// PUT /proxy/[port]/captureSettings
+	SetCaptureSettings(context.Context, *SetCaptureSettingsRequest) (*CaptureSettings, error)
+	// GET /proxy/[port]/har/stream, the entries recorded from now on until cancelled or the proxy is deleted
+	StreamEntries(*ProxyRef, grpc.ServerStreamingServer[Entry]) error
+	// GET /proxy/[port]/har/entry/[id], NOT_FOUND once the entry was cleared
+	GetEntry(context.Context, *EntryRef) (*Entry, error)
+	mustEmbedUnimplementedProxyServiceServer()
+}
+
+// UnimplementedProxyServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedProxyServiceServer struct{}
+
+func (UnimplementedProxyServiceServer) CreateProxy(context.Context, *CreateProxyRequest) (*Proxy, error) {
+	return nil, status.Error(codes.Unimplemented, "method CreateProxy not implemented")
+}
+func (UnimplementedProxyServiceServer) DeleteProxy(context.Context, *ProxyRef) (*DeleteProxyResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method DeleteProxy not implemented")
+}
+func (UnimplementedProxyServiceServer) ListProxies(context.Context, *ListProxiesRequest) (*ListProxiesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListProxies not implemented")
+}
+func (UnimplementedProxyServiceServer) GetHar(*ProxyRef, grpc.ServerStreamingServer[Entry]) error {
+	return status.Error(codes.Unimplemented, "method GetHar not implemented")
+}
+func (UnimplementedProxyServiceServer) SetHosts(context.Context, *SetHostsRequest) (*SetHostsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method SetHosts not implemented")
+}
+func (UnimplementedProxyServiceServer) SetCaptureSettings(context.Context, *SetCaptureSettingsRequest) (*CaptureSettings, error) {
+	return nil, status.Error(codes.Unimplemented, "method SetCaptureSettings not implemented")
+}
+func (UnimplementedProxyServiceServer) StreamEntries(*ProxyRef, grpc.ServerStreamingServer[Entry]) error {
+	return status.Error(codes.Unimplemented, "method StreamEntries not implemented")
+}
+func (UnimplementedProxyServiceServer) GetEntry(context.Context, *EntryRef) (*Entry, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetEntry not implemented")
+}
+func (UnimplementedProxyServiceServer) mustEmbedUnimplementedProxyServiceServer() {}
+func (UnimplementedProxyServiceServer) testEmbeddedByValue()                      {}
+
+// UnsafeProxyServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ProxyServiceServer will
+// result in compilation errors.
+type UnsafeProxyServiceServer interface {
+	mustEmbedUnimplementedProxyServiceServer()
+}
+
+func RegisterProxyServiceServer(s grpc.ServiceRegistrar, srv ProxyServiceServer) {
+	// If the following call panics, it indicates UnimplementedProxyServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ProxyService_ServiceDesc, srv)
+}
+
+func _ProxyService_CreateProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateProxyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyServiceServer).CreateProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyService_CreateProxy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyServiceServer).CreateProxy(ctx, req.(*CreateProxyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyService_DeleteProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProxyRef)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyServiceServer).DeleteProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyService_DeleteProxy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyServiceServer).DeleteProxy(ctx, req.(*ProxyRef))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyService_ListProxies_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListProxiesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyServiceServer).ListProxies(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyService_ListProxies_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyServiceServer).ListProxies(ctx, req.(*ListProxiesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyService_GetHar_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ProxyRef)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ProxyServiceServer).GetHar(m, &grpc.GenericServerStream[ProxyRef, Entry]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ProxyService_GetHarServer = grpc.ServerStreamingServer[Entry]
+
+func _ProxyService_SetHosts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetHostsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyServiceServer).SetHosts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyService_SetHosts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyServiceServer).SetHosts(ctx, req.(*SetHostsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyService_SetCaptureSettings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetCaptureSettingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyServiceServer).SetCaptureSettings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyService_SetCaptureSettings_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyServiceServer).SetCaptureSettings(ctx, req.(*SetCaptureSettingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyService_StreamEntries_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ProxyRef)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ProxyServiceServer).StreamEntries(m, &grpc.GenericServerStream[ProxyRef, Entry]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ProxyService_StreamEntriesServer = grpc.ServerStreamingServer[Entry]
+
+func _ProxyService_GetEntry_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EntryRef)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyServiceServer).GetEntry(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProxyService_GetEntry_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyServiceServer).GetEntry(ctx, req.(*EntryRef))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ProxyService_ServiceDesc is the grpc.ServiceDesc for ProxyService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ProxyService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "goharproxy.v1.ProxyService",
+	HandlerType: (*ProxyServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateProxy",
+			Handler:    _ProxyService_CreateProxy_Handler,
+		},
+		{
+			MethodName: "DeleteProxy",
+			Handler:    _ProxyService_DeleteProxy_Handler,
+		},
+		{
+			MethodName: "ListProxies",
+			Handler:    _ProxyService_ListProxies_Handler,
+		},
+		{
+			MethodName: "SetHosts",
+			Handler:    _ProxyService_SetHosts_Handler,
+		},
+		{
+			MethodName: "SetCaptureSettings",
+			Handler:    _ProxyService_SetCaptureSettings_Handler,
+		},
+		{
+			MethodName: "GetEntry",
+			Handler:    _ProxyService_GetEntry_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetHar",
+			Handler:       _ProxyService_GetHar_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamEntries",
+			Handler:       _ProxyService_StreamEntries_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/goharproxy.proto",
+}
@@ -0,0 +1,200 @@
+package goharproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Changes the query parameters of matching requests before they go upstream, e.g. to strip utm_* tracking parameters
+// or to force debug=true, see HarProxyConfig.QueryRewrites. Every matching rule applies, in order.
+// The parameters left untouched keep their order and encoding. The entry records the url with the query
+// sent upstream, and the one the client requested as request._originalUrl.
+type QueryRewrite struct {
+	// Regular expression matched against the url the client requested, empty matches every request
+	UrlPattern 	string 				`json:"urlPattern,omitempty"`
+
+	// Parameters set to their value, replacing every value they had. New ones are added sorted by name after the others.
+	Set 		map[string]string 	`json:"set,omitempty"`
+
+	// Names of the parameters removed, * matches any characters, e.g. utm_*
+	Remove 		[]string 			`json:"remove,omitempty"`
+}
+
+func (rewrite QueryRewrite) validate() error {
+	if _, err := regexp.Compile(rewrite.UrlPattern); err != nil {
+		return fmt.Errorf("invalid urlPattern [%v]: %v", rewrite.UrlPattern, err)
+	}
+	for name := range rewrite.Set {
+		if name == "" {
+			return errors.New("can't set a parameter without name")
+		}
+	}
+	for _, name := range rewrite.Remove {
+		if name == "" {
+			return errors.New("can't remove a parameter without name")
+		}
+	}
+	return nil
+}
+
+// A query rewrite as a proxy holds it, with its patterns compiled once when it is set
+type queryRewrite struct {
+	QueryRewrite
+
+	urlPattern *regexp.Regexp
+	remove []*regexp.Regexp
+	// The names of Set, sorted
+	setNames []string
+	// Why the rule is invalid, it never matches then
+	err error
+}
+
+func newQueryRewrites(rewrites []QueryRewrite) []queryRewrite {
+	compiled := make([]queryRewrite, len(rewrites))
+	for i, rewrite := range rewrites {
+		compiled[i].QueryRewrite = rewrite
+		if compiled[i].err = rewrite.validate(); compiled[i].err != nil {
+			continue
+		}
+		compiled[i].urlPattern = regexp.MustCompile(rewrite.UrlPattern)
+		compiled[i].remove = compileNames(rewrite.Remove)
+		for name := range rewrite.Set {
+			compiled[i].setNames = append(compiled[i].setNames, name)
+		}
+		sort.Strings(compiled[i].setNames)
+	}
+	return compiled
+}
+
+func queryRewritesOf(rewrites []queryRewrite) []QueryRewrite {
+	queryRewrites := make([]QueryRewrite, len(rewrites))
+	for i, rewrite := range rewrites {
+		queryRewrites[i] = rewrite.QueryRewrite
+	}
+	return queryRewrites
+}
+
+func (rewrite queryRewrite) removes(name string) bool {
+	return matchesName(rewrite.remove, name)
+}
+
+// Compiles names which may contain *, matching any characters
+func compileNames(names []string) []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, len(names))
+	for i, name := range names {
+		patterns[i] = regexp.MustCompile("^(?:" + strings.Replace(regexp.QuoteMeta(name), `\*`, ".*", -1) + ")$")
+	}
+	return patterns
+}
+
+func matchesName(patterns []*regexp.Regexp, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrites the raw query, keeping the parameters it doesn't touch as they are
+func (rewrite queryRewrite) apply(rawQuery string) string {
+	var params []string
+	if rawQuery != "" {
+		params = strings.Split(rawQuery, "&")
+	}
+	kept := make([]string, 0, len(params) + len(rewrite.Set))
+	set := make(map[string]bool, len(rewrite.Set))
+	for _, param := range params {
+		rawName := strings.SplitN(param, "=", 2)[0]
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		if value, ok := rewrite.Set[name]; ok {
+			if !set[name] {
+				kept = append(kept, url.QueryEscape(name) + "=" + url.QueryEscape(value))
+				set[name] = true
+			}
+			continue
+		}
+		if rewrite.removes(name) {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	for _, name := range rewrite.setNames {
+		if !set[name] {
+			kept = append(kept, url.QueryEscape(name) + "=" + url.QueryEscape(rewrite.Set[name]))
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// SetQueryRewrites replaces the proxy's query rewrites, they apply from the next request
+func (proxy *HarProxy) SetQueryRewrites(rewrites []QueryRewrite) error {
+	for _, rewrite := range rewrites {
+		if err := rewrite.validate(); err != nil {
+			return err
+		}
+	}
+	compiled := newQueryRewrites(rewrites)
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.queryRewrites = compiled
+	return nil
+}
+
+// QueryRewrites returns a copy of the query rewrites, in the order they are applied
+func (proxy *HarProxy) QueryRewrites() []QueryRewrite {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	return queryRewritesOf(proxy.queryRewrites)
+}
+
+// Applies the query rewrites matching req's url in turn
+func rewriteQuery(req *http.Request, harProxy *HarProxy) {
+	harProxy.settingsLock.RLock()
+	rewrites := harProxy.queryRewrites
+	harProxy.settingsLock.RUnlock()
+	for i := range rewrites {
+		rewrite := &rewrites[i]
+		if rewrite.err != nil {
+			harProxy.logger.Errorf("Skipping query rewrite %v: %v", i, rewrite.err)
+			continue
+		}
+		if !rewrite.urlPattern.MatchString(req.URL.String()) {
+			continue
+		}
+		rawQuery := rewrite.apply(req.URL.RawQuery)
+		if rawQuery != req.URL.RawQuery {
+			harProxy.logger.Debugf("Rewrote query of %v to %v", req.URL, rawQuery)
+			req.URL.RawQuery = rawQuery
+			req.URL.ForceQuery = false
+		}
+	}
+}
+
+// The urls of an entry, from the one the client requested and the one sent upstream. The entry's url is the
+// requested one with the query sent upstream, the requested one being its _originalUrl when the query changed.
+// Other changes, e.g. of host entries, record the url sent upstream as its _rewrittenTo.
+func entryUrls(clientUrl, upstreamUrl string) (entryUrl, originalUrl, rewrittenTo string) {
+	if clientUrl == upstreamUrl {
+		return clientUrl, "", ""
+	}
+	entryUrl = clientUrl
+	requested, requestedErr := url.Parse(clientUrl)
+	sent, sentErr := url.Parse(upstreamUrl)
+	if requestedErr == nil && sentErr == nil && (requested.RawQuery != sent.RawQuery || requested.ForceQuery != sent.ForceQuery) {
+		requested.RawQuery, requested.ForceQuery = sent.RawQuery, sent.ForceQuery
+		entryUrl, originalUrl = requested.String(), clientUrl
+	}
+	if entryUrl != upstreamUrl {
+		rewrittenTo = upstreamUrl
+	}
+	return entryUrl, originalUrl, rewrittenTo
+}
@@ -0,0 +1,47 @@
+package goharproxy
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The source of every random decision of a proxy's requests, e.g. which responses a status rewrite
+// with a percentage applies to. Proxies given the same seed take the same decisions for the same
+// sequence of requests, see HarProxyOptions.Seed.
+type lockedRand struct {
+	lock sync.Mutex
+	rand *rand.Rand
+	seed int64
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rand : rand.New(rand.NewSource(seed)), seed : seed}
+}
+
+// Seeded with seed, or with a random seed when it is 0
+func newSeededRand(seed int64) *lockedRand {
+	for seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return newLockedRand(seed)
+}
+
+// A number in [0, 1)
+func (random *lockedRand) float64() float64 {
+	random.lock.Lock()
+	defer random.lock.Unlock()
+	return random.rand.Float64()
+}
+
+// A number in [0, n), n must be positive
+func (random *lockedRand) int63n(n int64) int64 {
+	random.lock.Lock()
+	defer random.lock.Unlock()
+	return random.rand.Int63n(n)
+}
+
+// Seed returns the seed of the proxy's random decisions, the one it was created with or the random one picked then
+func (proxy *HarProxy) Seed() int64 {
+	return proxy.random.seed
+}
@@ -0,0 +1,155 @@
+package goharproxy
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/quantum/goproxy"
+)
+
+// The clients a rate limit tracks without MaxClients
+const defaultRateLimitClients = 1024
+
+// Limits the requests of each client of a proxy, by source ip, with a token bucket, see HarProxy.SetRateLimit.
+// Requests over the limit are answered with 429 and a Retry-After header, their entries are marked _rateLimited.
+type RateLimit struct {
+	// The rate at which a client's bucket refills
+	RequestsPerSecond 	float64 	`json:"requestsPerSecond"`
+
+	// The most requests a client can send at once, at least 1
+	Burst 				int 		`json:"burst"`
+
+	// The most clients tracked, the least recently seen one is forgotten for a new one. Defaults to 1024.
+	MaxClients 			int 		`json:"maxClients,omitempty"`
+}
+
+func (limit RateLimit) validate() error {
+	if limit.RequestsPerSecond <= 0 || math.IsInf(limit.RequestsPerSecond, 0) || math.IsNaN(limit.RequestsPerSecond) {
+		return fmt.Errorf("invalid requests per second [%v]", limit.RequestsPerSecond)
+	}
+	if limit.Burst < 1 {
+		return fmt.Errorf("invalid burst [%v], expected at least 1", limit.Burst)
+	}
+	if limit.MaxClients < 0 {
+		return fmt.Errorf("invalid max clients [%v]", limit.MaxClients)
+	}
+	return nil
+}
+
+// The token buckets of a rate limit, by client ip, in least recently used order
+type rateLimiter struct {
+	limit RateLimit
+
+	lock sync.Mutex
+	clients map[string]*list.Element
+	// Of *clientBucket, the most recently used first
+	recent *list.List
+}
+
+type clientBucket struct {
+	client string
+	tokens float64
+	// When tokens was last refilled
+	refilled time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.MaxClients == 0 {
+		limit.MaxClients = defaultRateLimitClients
+	}
+	return &rateLimiter {
+		limit 	: limit,
+		clients : make(map[string]*list.Element),
+		recent 	: list.New(),
+	}
+}
+
+// Takes a token from client's bucket at now. Returns false and how long until the next token if there is none.
+func (limiter *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	var bucket *clientBucket
+	if elem, ok := limiter.clients[client]; ok {
+		limiter.recent.MoveToFront(elem)
+		bucket = elem.Value.(*clientBucket)
+		elapsed := now.Sub(bucket.refilled).Seconds()
+		if elapsed > 0 {
+			bucket.tokens = math.Min(float64(limiter.limit.Burst), bucket.tokens + elapsed * limiter.limit.RequestsPerSecond)
+			bucket.refilled = now
+		}
+	} else {
+		if limiter.recent.Len() >= limiter.limit.MaxClients {
+			oldest := limiter.recent.Back()
+			limiter.recent.Remove(oldest)
+			delete(limiter.clients, oldest.Value.(*clientBucket).client)
+		}
+		bucket = &clientBucket{client : client, tokens : float64(limiter.limit.Burst), refilled : now}
+		limiter.clients[client] = limiter.recent.PushFront(bucket)
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / limiter.limit.RequestsPerSecond * float64(time.Second))
+}
+
+// The number of clients tracked
+func (limiter *rateLimiter) len() int {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.recent.Len()
+}
+
+// SetRateLimit limits the requests of each client of the proxy from the next request, nil removes the limit.
+// Setting it forgets what the clients sent so far.
+func (proxy *HarProxy) SetRateLimit(limit *RateLimit) error {
+	var limiter *rateLimiter
+	if limit != nil {
+		if err := limit.validate(); err != nil {
+			return err
+		}
+		limiter = newRateLimiter(*limit)
+	}
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.rateLimiter = limiter
+	return nil
+}
+
+// RateLimit returns a copy of the proxy's rate limit, nil if it has none
+func (proxy *HarProxy) RateLimit() *RateLimit {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	if proxy.rateLimiter == nil {
+		return nil
+	}
+	limit := proxy.rateLimiter.limit
+	return &limit
+}
+
+// Returns the 429 response for a request of a client over the rate limit, nil if it may go on
+func (proxy *HarProxy) limitRate(req *http.Request) *http.Response {
+	proxy.settingsLock.RLock()
+	limiter := proxy.rateLimiter
+	proxy.settingsLock.RUnlock()
+	if limiter == nil {
+		return nil
+	}
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	allowed, retryAfter := limiter.allow(client, proxy.clock.Now())
+	if allowed {
+		return nil
+	}
+	proxy.logger.Debugf("Rate limiting %v of client %v", req.URL, client)
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusTooManyRequests, "Too many requests")
+	resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return resp
+}
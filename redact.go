@@ -0,0 +1,250 @@
+package goharproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Redacts the captured request and response bodies before their entries are recorded, e.g. passwords sent in
+// JSON fields, see HarProxy.SetBodyRedactions. The bodies sent upstream and to the client are never changed.
+type BodyRedactions struct {
+	// Dotted paths of the values replaced with "[REDACTED]" in JSON bodies, e.g. user.password. A * segment matches
+	// any key or array index, e.g. *.creditCard.number, and paths go through arrays, items.sku matching the sku of every item.
+	JsonPaths 	[]string 		`json:"jsonPaths,omitempty"`
+
+	// Applied in order to the bodies which aren't JSON, or don't parse as JSON e.g. once truncated
+	Patterns 	[]BodyPattern 	`json:"patterns,omitempty"`
+}
+
+// A regular expression replaced in bodies, see BodyRedactions.Patterns
+type BodyPattern struct {
+	Pattern 	string 		`json:"pattern"`
+
+	// Replaces the matches, with $1 and so on expanded to the groups. "[REDACTED]" when nil, the empty string removes them.
+	Replacement *string 	`json:"replacement,omitempty"`
+}
+
+func (redactions BodyRedactions) validate() error {
+	for _, path := range redactions.JsonPaths {
+		for _, segment := range strings.Split(path, ".") {
+			if segment == "" {
+				return fmt.Errorf("invalid json path [%v]", path)
+			}
+		}
+	}
+	for _, pattern := range redactions.Patterns {
+		if pattern.Pattern == "" {
+			return errors.New("empty body redaction pattern")
+		}
+		if _, err := regexp.Compile(pattern.Pattern); err != nil {
+			return fmt.Errorf("invalid body redaction pattern [%v]: %v", pattern.Pattern, err)
+		}
+	}
+	return nil
+}
+
+func (redactions BodyRedactions) copy() BodyRedactions {
+	redactions.JsonPaths = append([]string(nil), redactions.JsonPaths...)
+	redactions.Patterns = append([]BodyPattern(nil), redactions.Patterns...)
+	return redactions
+}
+
+// Body redactions as a proxy holds them, with their paths split and their patterns compiled once when they are set
+type bodyRedactor struct {
+	redactions BodyRedactions
+	paths [][]string
+	patterns []*regexp.Regexp
+	replacements []string
+}
+
+func newBodyRedactor(redactions BodyRedactions) *bodyRedactor {
+	redactor := &bodyRedactor{redactions : redactions.copy()}
+	for _, path := range redactions.JsonPaths {
+		redactor.paths = append(redactor.paths, strings.Split(path, "."))
+	}
+	for _, pattern := range redactions.Patterns {
+		replacement := DefaultAnonymizeReplacement
+		if pattern.Replacement != nil {
+			replacement = *pattern.Replacement
+		}
+		redactor.patterns = append(redactor.patterns, regexp.MustCompile(pattern.Pattern))
+		redactor.replacements = append(redactor.replacements, replacement)
+	}
+	return redactor
+}
+
+// The body text of mimeType redacted
+func (redactor *bodyRedactor) redact(text, mimeType string) string {
+	if mediaType, _, _ := mime.ParseMediaType(mimeType); strings.HasSuffix(mediaType, "/json") || strings.HasSuffix(mediaType, "+json") {
+		if len(redactor.paths) == 0 {
+			return text
+		}
+		if redacted, ok := redactJson(text, redactor.paths); ok {
+			return redacted
+		}
+	}
+	for i, pattern := range redactor.patterns {
+		text = pattern.ReplaceAllString(text, redactor.replacements[i])
+	}
+	return text
+}
+
+// Rewrites the JSON document text, compacted, with the values at paths replaced. False if text isn't one document.
+func redactJson(text string, paths [][]string) (string, bool) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	var redacted bytes.Buffer
+	if err := redactJsonValue(decoder, &redacted, nil, paths); err != nil {
+		return text, false
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return text, false
+	}
+	return redacted.String(), true
+}
+
+// A key, or an array index, on the way to a value of a JSON document
+type jsonSegment struct {
+	name string
+	index bool
+}
+
+// Copies the next value of decoder at path to redacted, or the replacement if one of paths matches it
+func redactJsonValue(decoder *json.Decoder, redacted *bytes.Buffer, path []jsonSegment, paths [][]string) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	for _, redactedPath := range paths {
+		if matchJsonPath(redactedPath, path) {
+			if err := skipJsonValue(decoder, token); err != nil {
+				return err
+			}
+			writeJson(redacted, DefaultAnonymizeReplacement)
+			return nil
+		}
+	}
+	switch token {
+	case json.Delim('{'):
+		redacted.WriteByte('{')
+		for i := 0; decoder.More(); i++ {
+			key, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				redacted.WriteByte(',')
+			}
+			writeJson(redacted, key)
+			redacted.WriteByte(':')
+			if err := redactJsonValue(decoder, redacted, append(path, jsonSegment{name : key.(string)}), paths); err != nil {
+				return err
+			}
+		}
+		redacted.WriteByte('}')
+		_, err = decoder.Token()
+	case json.Delim('['):
+		redacted.WriteByte('[')
+		for i := 0; decoder.More(); i++ {
+			if i > 0 {
+				redacted.WriteByte(',')
+			}
+			if err := redactJsonValue(decoder, redacted, append(path, jsonSegment{name : strconv.Itoa(i), index : true}), paths); err != nil {
+				return err
+			}
+		}
+		redacted.WriteByte(']')
+		_, err = decoder.Token()
+	default:
+		writeJson(redacted, token)
+	}
+	return err
+}
+
+// Whether the dotted path matches the path of a value, * matching any segment and array indexes being skipped
+func matchJsonPath(dotted []string, path []jsonSegment) bool {
+	if len(path) == 0 {
+		return len(dotted) == 0
+	}
+	if len(dotted) > 0 && (dotted[0] == "*" || dotted[0] == path[0].name) && matchJsonPath(dotted[1:], path[1:]) {
+		return true
+	}
+	return path[0].index && matchJsonPath(dotted, path[1:])
+}
+
+// Reads the rest of the value starting with token
+func skipJsonValue(decoder *json.Decoder, token json.Token) error {
+	if token != json.Delim('{') && token != json.Delim('[') {
+		return nil
+	}
+	for depth := 1; depth > 0; {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return nil
+}
+
+// Writes a token as JSON, without escaping HTML characters as json.Marshal does
+func writeJson(redacted *bytes.Buffer, value interface{}) {
+	encoder := json.NewEncoder(redacted)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	redacted.Truncate(redacted.Len() - 1)
+}
+
+// SetBodyRedactions redacts the bodies of the entries recorded from now on, nil records them as they were sent
+func (proxy *HarProxy) SetBodyRedactions(redactions *BodyRedactions) error {
+	var redactor *bodyRedactor
+	if redactions != nil {
+		if err := redactions.validate(); err != nil {
+			return err
+		}
+		redactor = newBodyRedactor(*redactions)
+	}
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.bodyRedactor = redactor
+	return nil
+}
+
+// BodyRedactions returns a copy of the proxy's body redactions, nil if it has none
+func (proxy *HarProxy) BodyRedactions() *BodyRedactions {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	if proxy.bodyRedactor == nil {
+		return nil
+	}
+	redactions := proxy.bodyRedactor.redactions.copy()
+	return &redactions
+}
+
+// Redacts the captured bodies of harEntry, before it is recorded. Form params and base64 encoded bodies are left as they are.
+func (proxy *HarProxy) redactBodies(harEntry *HarEntry) {
+	proxy.settingsLock.RLock()
+	redactor := proxy.bodyRedactor
+	proxy.settingsLock.RUnlock()
+	if redactor == nil {
+		return
+	}
+	if harEntry.Request != nil && harEntry.Request.PostData != nil && harEntry.Request.PostData.Text != "" {
+		harEntry.Request.PostData.Text = redactor.redact(harEntry.Request.PostData.Text, harEntry.Request.PostData.MimeType)
+	}
+	if harEntry.Response != nil && harEntry.Response.Content != nil && harEntry.Response.Content.Encoding == "" && harEntry.Response.Content.Text != "" {
+		harEntry.Response.Content.Text = redactor.redact(harEntry.Response.Content.Text, harEntry.Response.Content.MimeType)
+	}
+}
@@ -0,0 +1,116 @@
+package goharproxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// The proxies of a ProxyServer, by port and by name, with who owns them. Safe for concurrent use by the handlers.
+type proxyRegistry struct {
+	lock sync.RWMutex
+	byPort map[int]*HarProxy
+
+	// Ports of the named proxies
+	byName map[string]int
+
+	// The owners of the proxies created with an API key, by port, see ProxyServerOptions.APIKeys
+	owners map[int]string
+}
+
+func newProxyRegistry() *proxyRegistry {
+	return &proxyRegistry {
+		byPort : make(map[int]*HarProxy),
+		byName : make(map[string]int),
+		owners : make(map[int]string),
+	}
+}
+
+// Returns the proxy on port, nil if there is none
+func (registry *proxyRegistry) get(port int) *HarProxy {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return registry.byPort[port]
+}
+
+// Returns the proxy named name, nil if there is none
+func (registry *proxyRegistry) getByName(name string) *HarProxy {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	port, exists := registry.byName[name]
+	if !exists {
+		return nil
+	}
+	return registry.byPort[port]
+}
+
+// Registers a started proxy owned by owner, empty when it has none. Fails if its name is taken meanwhile.
+func (registry *proxyRegistry) put(harProxy *HarProxy, owner string) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if harProxy.Name != "" {
+		if _, exists := registry.byName[harProxy.Name]; exists {
+			return fmt.Errorf("Proxy named [%v] already exists", harProxy.Name)
+		}
+		registry.byName[harProxy.Name] = harProxy.Port
+	}
+	registry.byPort[harProxy.Port] = harProxy
+	if owner != "" {
+		registry.owners[harProxy.Port] = owner
+	}
+	return nil
+}
+
+// Returns the owner of harProxy, empty if it has none or isn't registered
+func (registry *proxyRegistry) owner(harProxy *HarProxy) string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	if registry.byPort[harProxy.Port] != harProxy {
+		return ""
+	}
+	return registry.owners[harProxy.Port]
+}
+
+// Unregisters harProxy, returns false if it isn't registered, e.g. because it was deleted concurrently
+func (registry *proxyRegistry) delete(harProxy *HarProxy) bool {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if registry.byPort[harProxy.Port] != harProxy {
+		return false
+	}
+	delete(registry.byPort, harProxy.Port)
+	delete(registry.owners, harProxy.Port)
+	if harProxy.Name != "" {
+		delete(registry.byName, harProxy.Name)
+	}
+	return true
+}
+
+// Returns the registered proxies ordered by port
+func (registry *proxyRegistry) list() []*HarProxy {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return sortedByPort(registry.byPort)
+}
+
+// Unregisters every proxy, returns them ordered by port
+func (registry *proxyRegistry) clear() []*HarProxy {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	harProxies := sortedByPort(registry.byPort)
+	registry.byPort = make(map[int]*HarProxy)
+	registry.byName = make(map[string]int)
+	registry.owners = make(map[int]string)
+	return harProxies
+}
+
+func sortedByPort(byPort map[int]*HarProxy) []*HarProxy {
+	harProxies := make([]*HarProxy, 0, len(byPort))
+	for _, harProxy := range byPort {
+		harProxies = append(harProxies, harProxy)
+	}
+	sort.Slice(harProxies, func(i, j int) bool {
+		return harProxies[i].Port < harProxies[j].Port
+	})
+	return harProxies
+}
@@ -0,0 +1,223 @@
+package goharproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayOptions controls which entries Replayer.Replay re-issues, where to and how fast
+type ReplayOptions struct {
+	// Base URL, scheme and host, the requests are sent to instead of their recorded ones, e.g. "http://localhost:8080"
+	Target 		string 		`json:"target"`
+
+	// The number of requests in flight at once, defaults to 1
+	Concurrency int 		`json:"concurrency"`
+
+	// Start requests with the gaps they were recorded with, instead of as fast as possible
+	Paced 		bool 		`json:"paced"`
+
+	// The methods to replay, defaults to GET only so replaying has no side effects unless asked for
+	Methods 	[]string 	`json:"methods"`
+}
+
+func (opts ReplayOptions) validate() error {
+	if opts.Concurrency < 0 {
+		return fmt.Errorf("invalid replay concurrency [%v]", opts.Concurrency)
+	}
+	if opts.Target == "" {
+		return nil
+	}
+	target, err := url.Parse(opts.Target)
+	if err != nil {
+		return err
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("invalid replay target [%v], expected scheme://host", opts.Target)
+	}
+	return nil
+}
+
+func (opts ReplayOptions) replays(method string) bool {
+	if len(opts.Methods) == 0 {
+		return method == "GET"
+	}
+	for _, replayed := range opts.Methods {
+		if strings.EqualFold(replayed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replayer re-issues recorded requests, e.g. to reproduce load or verify a fix.
+// The zero value sends them with http.DefaultTransport.
+type Replayer struct {
+	// Sends the replayed requests, defaults to http.DefaultTransport
+	Transport http.RoundTripper
+
+	// Receives everything the replayer logs, defaults to DefaultLogger
+	Logger Logger
+}
+
+// Replay re-issues the requests of the entries of harLog in the order they were recorded, and records
+// the responses in the returned log, so it can be compared with DiffHarLogs. Requests failing are recorded
+// without response. When ctx is done no more requests are started, the entries completed so far are
+// returned with ctx.Err().
+func (replayer *Replayer) Replay(ctx context.Context, harLog *HarLog, opts ReplayOptions) (*HarLog, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	roundTripper := replayer.Transport
+	if roundTripper == nil {
+		roundTripper = http.DefaultTransport
+	}
+	logger := orDefaultLogger(replayer.Logger)
+	concurrency := opts.Concurrency
+	if concurrency == 0 {
+		concurrency = 1
+	}
+
+	var entries []HarEntry
+	for _, entry := range harLog.Entries() {
+		if entry.Request != nil && opts.replays(entry.Request.Method) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+
+	results := make([]*HarEntry, len(entries))
+	slots := make(chan struct{}, concurrency)
+	var replaying sync.WaitGroup
+	start := time.Now()
+	var err error
+	for i, entry := range entries {
+		if opts.Paced {
+			if err = sleepContext(ctx, time.Until(start.Add(entry.StartedDateTime.Sub(entries[0].StartedDateTime)))); err != nil {
+				break
+			}
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+		replaying.Add(1)
+		go func(i int, entry HarEntry) {
+			defer replaying.Done()
+			defer func() { <-slots }()
+			results[i] = replayEntry(ctx, roundTripper, entry, opts.Target, logger)
+		}(i, entry)
+	}
+	replaying.Wait()
+
+	replayed := newHarLog()
+	for _, result := range results {
+		if result != nil {
+			replayed.appendEntries([]HarEntry{*result})
+		}
+	}
+	return replayed, err
+}
+
+// Sends the request of entry, returns the replayed entry
+func replayEntry(ctx context.Context, roundTripper http.RoundTripper, entry HarEntry, target string, logger Logger) *HarEntry {
+	replayed := &HarEntry{PageRef : entry.PageRef, StartedDateTime : time.Now()}
+	req, err := replayRequest(ctx, entry.Request, target)
+	if err != nil {
+		logger.Errorf("Not replaying %v : %v", entry.Request.Url, err)
+		replayed.Request = entry.Request
+		replayed.Comment = "Replay failed: " + err.Error()
+		return replayed
+	}
+	replayed.Request = parseRequest(req, false, logger)
+	if entry.Request.PostData != nil {
+		replayed.Request.PostData = entry.Request.PostData
+	}
+
+	resp, err := roundTripper.RoundTrip(req)
+	replayed.Time = time.Since(replayed.StartedDateTime).Nanoseconds() / 1e6
+	if err != nil {
+		logger.Infof("Replaying %v failed : %v", req.URL, err)
+		replayed.Comment = "Replay failed: " + err.Error()
+		return replayed
+	}
+	defer resp.Body.Close()
+	replayed.Response = parseResponse(resp, true, logger)
+	replayed.Time = time.Since(replayed.StartedDateTime).Nanoseconds() / 1e6
+	fillIpAddress(req, replayed)
+	return replayed
+}
+
+// Hop by hop headers and headers describing the recorded body or host, set again by the transport
+var unreplayedHeaders = map[string]bool {
+	"Host" 				: true,
+	"Content-Length" 	: true,
+	"Connection" 		: true,
+	"Proxy-Connection" 	: true,
+	"Keep-Alive" 		: true,
+	"Transfer-Encoding" : true,
+	"Accept-Encoding" 	: true,
+}
+
+// Builds the request recorded in harRequest, sent to target when it is set
+func replayRequest(ctx context.Context, harRequest *HarRequest, target string) (*http.Request, error) {
+	requestUrl, err := url.Parse(harRequest.Url)
+	if err != nil {
+		return nil, err
+	}
+	if target != "" {
+		targetUrl, _ := url.Parse(target)
+		requestUrl.Scheme, requestUrl.Host = targetUrl.Scheme, targetUrl.Host
+	}
+	if requestUrl.Scheme == "" || requestUrl.Host == "" {
+		return nil, errors.New("the url is not absolute")
+	}
+
+	var body string
+	if postData := harRequest.PostData; postData != nil {
+		body = postData.Text
+		if body == "" && len(postData.Params) > 0 {
+			form := url.Values{}
+			for _, param := range postData.Params {
+				form.Add(param.Name, param.Value)
+			}
+			body = form.Encode()
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, harRequest.Method, requestUrl.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range harRequest.Headers {
+		if !unreplayedHeaders[http.CanonicalHeaderKey(header.Name)] && !strings.HasPrefix(header.Name, ":") {
+			req.Header.Add(header.Name, header.Value)
+		}
+	}
+	return req, nil
+}
+
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
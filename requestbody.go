@@ -0,0 +1,78 @@
+package goharproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// The largest body accepted by the management API, HAR logs uploaded to /har/diff included
+const maxRequestBodySize = 32 << 20
+
+// Decodes the JSON body of a management request into v, rejecting unknown fields.
+// Writes the error response and returns false if the body is too large, not JSON or malformed.
+// An empty body leaves v as is when optional, otherwise it is an error.
+func (proxyServer *ProxyServer) decodeJsonBody(w http.ResponseWriter, r *http.Request, v interface{}, optional bool) bool {
+	if r.ContentLength == 0 && optional {
+		return true
+	}
+	if contentType := r.Header.Get("Content-Type"); r.ContentLength != 0 || contentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+			proxyServer.writeErrorMessage(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Expected a Content-Type of application/json but got [%v]", contentType))
+			return false
+		}
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == io.EOF && optional {
+		return true
+	}
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &tooLarge):
+		proxyServer.writeErrorMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body larger than %v bytes", tooLarge.Limit))
+	case err == io.EOF:
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, "Missing request body")
+	case err == io.ErrUnexpectedEOF:
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, "Malformed JSON, the body ends early")
+	case errors.As(err, &syntaxErr):
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Malformed JSON at offset %v: %v", syntaxErr.Offset, err))
+	case errors.As(err, &typeErr):
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid value for [%v] at offset %v: %v", typeErr.Field, typeErr.Offset, err))
+	default:
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+	}
+	return false
+}
+
+// Reads r until it gave limit bytes, then fails with a *http.MaxBytesError like http.MaxBytesReader.
+// Bounds what a decompressed body grows to, as the limit of the request body only applies to its compressed bytes.
+func maxBytesReader(r io.Reader, limit int64) io.Reader {
+	return &limitedReader{r : io.LimitReader(r, limit + 1), limit : limit}
+}
+
+type limitedReader struct {
+	r 		io.Reader
+	read 	int64
+	limit 	int64
+}
+
+func (reader *limitedReader) Read(p []byte) (int, error) {
+	n, err := reader.r.Read(p)
+	reader.read += int64(n)
+	if reader.read > reader.limit {
+		return n - int(reader.read - reader.limit), &http.MaxBytesError{Limit : reader.limit}
+	}
+	return n, err
+}
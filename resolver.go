@@ -0,0 +1,128 @@
+package goharproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long a lookup may take before the host is left unresolved
+const lookupTimeout = 2 * time.Second
+
+// The number of lookups running at once, hosts arriving while all run are not looked up
+const maxLookups = 8
+
+// How long resolved addresses, and failed lookups, are kept
+const resolvedTtl = time.Minute
+
+// The number of hosts kept, expired ones are dropped to make room and everything if it's not enough
+const maxResolvedHosts = 1024
+
+// Resolves the server ip of entries whose transport doesn't report the connected address.
+// Lookups run in the background, recording an entry only takes the address if it was resolved by then.
+type ipResolver struct {
+	lookup func(ctx context.Context, host string) ([]net.IP, error)
+	clock Clock
+
+	// Taken by the running lookups
+	slots chan struct{}
+
+	// Guards resolved and resolving
+	lock sync.Mutex
+
+	// The resolved addresses by host, empty if the lookup failed
+	resolved map[string]resolvedIp
+
+	// The hosts being looked up
+	resolving map[string]bool
+}
+
+type resolvedIp struct {
+	ip string
+	expires time.Time
+}
+
+func newIpResolver(lookup func(ctx context.Context, host string) ([]net.IP, error), clock Clock) *ipResolver {
+	if lookup == nil {
+		lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		}
+	}
+	return &ipResolver {
+		lookup 		: lookup,
+		clock 		: clock,
+		slots 		: make(chan struct{}, maxLookups),
+		resolved 	: make(map[string]resolvedIp),
+		resolving 	: make(map[string]bool),
+	}
+}
+
+// Returns the address of the host of hostPort if it is an ip or was resolved, otherwise starts
+// looking it up for the next entries and returns an empty string
+func (resolver *ipResolver) ip(hostPort string) string {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	if host == "" {
+		return ""
+	}
+
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	if resolved, exists := resolver.resolved[host]; exists && resolver.clock.Now().Before(resolved.expires) {
+		return resolved.ip
+	}
+	if resolver.resolving[host] {
+		return ""
+	}
+	select {
+	case resolver.slots <- struct{}{}:
+	default:
+		return ""
+	}
+	resolver.resolving[host] = true
+	go resolver.resolve(host)
+	return ""
+}
+
+func (resolver *ipResolver) resolve(host string) {
+	defer func() { <-resolver.slots }()
+	ctx, cancel := withClockTimeout(context.Background(), resolver.clock, lookupTimeout)
+	ips, err := resolver.lookup(ctx, host)
+	cancel()
+
+	resolved := resolvedIp{expires : resolver.clock.Now().Add(resolvedTtl)}
+	if err == nil {
+		resolved.ip = firstIpv4(ips)
+	}
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	delete(resolver.resolving, host)
+	if len(resolver.resolved) >= maxResolvedHosts {
+		now := resolver.clock.Now()
+		for cached, cachedIp := range resolver.resolved {
+			if !now.Before(cachedIp.expires) {
+				delete(resolver.resolved, cached)
+			}
+		}
+		if len(resolver.resolved) >= maxResolvedHosts {
+			resolver.resolved = make(map[string]resolvedIp)
+		}
+	}
+	resolver.resolved[host] = resolved
+}
+
+// The first IPv4 address, empty if there is none
+func firstIpv4(ips []net.IP) string {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
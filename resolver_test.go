@@ -0,0 +1,52 @@
+package goharproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/Hellspam/goharproxy/testutil"
+)
+
+func TestIpResolverBoundedLookups(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Now())
+	var lookups int32
+	resolver := newIpResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		atomic.AddInt32(&lookups, 1)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, clock)
+	if ip := resolver.ip("127.0.0.1:8080"); ip != "127.0.0.1" {
+		t.Fatal("Expected an ip host to be returned as is but got: ", ip)
+	}
+
+	for i := 0; i < 20; i++ {
+		if ip := resolver.ip(fmt.Sprintf("host-%v:80", i)); ip != "" {
+			t.Fatal("Expected an unresolved host to have no ip but got: ", ip)
+		}
+	}
+	for clock.Timers() < maxLookups {
+		time.Sleep(time.Millisecond)
+	}
+	if lookups := atomic.LoadInt32(&lookups); lookups != maxLookups {
+		t.Fatalf("Expected %v lookups at once but got: %v", maxLookups, lookups)
+	}
+
+	// Timed out lookups free their slots and are not retried until they expire
+	clock.Advance(lookupTimeout)
+	for len(resolver.slots) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	resolver.ip("host-0")
+	if lookups := atomic.LoadInt32(&lookups); lookups != maxLookups {
+		t.Fatal("Expected the failed lookup to be kept but got: ", lookups)
+	}
+	resolver.ip("host-19")
+	clock.Advance(resolvedTtl)
+	resolver.ip("host-0")
+	for atomic.LoadInt32(&lookups) < maxLookups + 2 {
+		time.Sleep(time.Millisecond)
+	}
+}
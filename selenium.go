@@ -0,0 +1,46 @@
+package goharproxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The proxy capability of a WebDriver session, sending the browser's traffic through a proxy
+type SeleniumProxy struct {
+	ProxyType 	string 	`json:"proxyType"`
+	HttpProxy 	string 	`json:"httpProxy"`
+	SslProxy 	string 	`json:"sslProxy"`
+}
+
+// SeleniumProxy returns the WebDriver proxy capability for the proxy reached at externalHost,
+// at the address it binds to when empty
+func (proxy *HarProxy) SeleniumProxy(externalHost string) SeleniumProxy {
+	host := strings.Trim(externalHost, "[]")
+	if host == "" {
+		host = proxy.bindAddr
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(proxy.Port))
+	return SeleniumProxy{ProxyType : "manual", HttpProxy : address, SslProxy : address}
+}
+
+// The host clients reach the proxies at: the configured one, or the one they reached the API at
+func (proxyServer *ProxyServer) externalHost(r *http.Request) string {
+	if proxyServer.opts.ExternalHost != "" {
+		return proxyServer.opts.ExternalHost
+	}
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	return r.Host
+}
+
+func (proxyServer *ProxyServer) getSeleniumProxy(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.SeleniumProxy(proxyServer.externalHost(r)))
+}
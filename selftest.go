@@ -0,0 +1,249 @@
+package goharproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds of SelfTestOptions, so a self test can't take the proxy server down
+const (
+	maxSelfTestRequests = 100000
+	maxSelfTestConcurrency = 256
+	maxSelfTestBodySize = 1 << 20
+)
+
+// SelfTestOptions controls the load generated by HarProxy.SelfTest, zero values are replaced by the defaults
+type SelfTestOptions struct {
+	// The number of requests sent, 100 by default
+	Requests 	int 	`json:"requests"`
+	// How many of them are in flight at once, 8 by default
+	Concurrency int 	`json:"concurrency"`
+	// The size of the body posted and echoed back, 1024 by default
+	BodySize 	int 	`json:"bodySize"`
+}
+
+func (opts *SelfTestOptions) withDefaults() (SelfTestOptions, error) {
+	withDefaults := *opts
+	if withDefaults.Requests == 0 {
+		withDefaults.Requests = 100
+	}
+	if withDefaults.Concurrency == 0 {
+		withDefaults.Concurrency = 8
+	}
+	if withDefaults.BodySize == 0 {
+		withDefaults.BodySize = 1024
+	}
+	switch {
+	case withDefaults.Requests < 0 || withDefaults.Requests > maxSelfTestRequests:
+		return withDefaults, fmt.Errorf("invalid requests [%v], expected at most %v", withDefaults.Requests, maxSelfTestRequests)
+	case withDefaults.Concurrency < 0 || withDefaults.Concurrency > maxSelfTestConcurrency:
+		return withDefaults, fmt.Errorf("invalid concurrency [%v], expected at most %v", withDefaults.Concurrency, maxSelfTestConcurrency)
+	case withDefaults.BodySize < 0 || withDefaults.BodySize > maxSelfTestBodySize:
+		return withDefaults, fmt.Errorf("invalid bodySize [%v], expected at most %v", withDefaults.BodySize, maxSelfTestBodySize)
+	}
+	return withDefaults, nil
+}
+
+// SelfTestReport is the outcome of a self test. Latency holds the percentiles seen by the client in microseconds,
+// Recorded the stats of the entries the proxy recorded, whose times are in milliseconds.
+type SelfTestReport struct {
+	Requests 			int 			`json:"requests"`
+	Concurrency 		int 			`json:"concurrency"`
+	BodySize 			int 			`json:"bodySize"`
+	// Requests which failed or didn't get a 200 back with the body they posted
+	Errors 				int 			`json:"errors"`
+	DurationMs 			int64 			`json:"durationMs"`
+	RequestsPerSecond 	float64 		`json:"requestsPerSecond"`
+	Latency 			SelfTestLatency `json:"latencyUs"`
+	Recorded 			HarStatsGroup 	`json:"recorded"`
+}
+
+type SelfTestLatency struct {
+	P50 int64 `json:"p50"`
+	P90 int64 `json:"p90"`
+	P99 int64 `json:"p99"`
+	Max int64 `json:"max"`
+}
+
+// SelfTest posts opts.Requests requests to a built-in echo server through a clone of the proxy, with its configuration,
+// middlewares and transport, and reports the throughput and latencies. The clone's entries aren't exported nor
+// added to the proxy's log, the proxy doesn't have to be started.
+func (proxy *HarProxy) SelfTest(ctx context.Context, opts SelfTestOptions) (SelfTestReport, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return SelfTestReport{}, err
+	}
+
+	echo, err := newEchoServer()
+	if err != nil {
+		return SelfTestReport{}, err
+	}
+	defer echo.Close()
+
+	clone, err := proxy.Clone()
+	if err != nil {
+		return SelfTestReport{}, err
+	}
+	// The self test's traffic isn't reported anywhere
+	clone.export = nil
+	clone.SetSink(nil)
+	clone.SetStatsd(nil)
+	clone.SetTracing(nil)
+	clone.SetWebhookRules(nil)
+	// Nor answered from recorded responses, it measures the proxy
+	clone.SetStub(nil)
+	if err := clone.Start(); err != nil {
+		return SelfTestReport{}, err
+	}
+	defer clone.Stop()
+	proxyUrl, err := url.Parse(clone.URL())
+	if err != nil {
+		return SelfTestReport{}, err
+	}
+	transport := &http.Transport{Proxy : http.ProxyURL(proxyUrl), MaxIdleConnsPerHost : opts.Concurrency}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport : transport}
+
+	proxy.logger.Infof("Self testing proxy on port :%v with %v requests, %v at once", proxy.Port, opts.Requests, opts.Concurrency)
+	body := bytes.Repeat([]byte("a"), opts.BodySize)
+	echoUrl := "http://" + echo.Addr().String() + "/echo"
+	latencies := make([]int64, opts.Requests)
+	var next, errs int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for worker := 0; worker < opts.Concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := atomic.AddInt64(&next, 1) - 1; i < int64(opts.Requests) && ctx.Err() == nil; i = atomic.AddInt64(&next, 1) - 1 {
+				sent := time.Now()
+				if err := postEcho(ctx, client, echoUrl, body); err != nil {
+					atomic.AddInt64(&errs, 1)
+				}
+				latencies[i] = time.Since(sent).Microseconds()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if err := ctx.Err(); err != nil {
+		return SelfTestReport{}, err
+	}
+	clone.waitForEntries(ctx, WaitEntriesTimeout)
+	stats, err := clone.HarLog.Stats(StatsOptions{})
+	if err != nil {
+		return SelfTestReport{}, err
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report := SelfTestReport {
+		Requests 	: opts.Requests,
+		Concurrency : opts.Concurrency,
+		BodySize 	: opts.BodySize,
+		Errors 		: int(errs),
+		DurationMs 	: elapsed.Milliseconds(),
+		Latency 	: SelfTestLatency {
+			P50 : percentile(latencies, 50),
+			P90 : percentile(latencies, 90),
+			P99 : percentile(latencies, 99),
+		},
+		Recorded 	: stats.Overall,
+	}
+	if len(latencies) > 0 {
+		report.Latency.Max = latencies[len(latencies) - 1]
+	}
+	if elapsed > 0 {
+		report.RequestsPerSecond = float64(opts.Requests) / elapsed.Seconds()
+	}
+	return report, nil
+}
+
+// Posts body to echoUrl, failing unless the echo server sent it back
+func postEcho(ctx context.Context, client *http.Client, echoUrl string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", echoUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	echoed, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("echo server answered %v", resp.StatusCode)
+	}
+	if !bytes.Equal(echoed, body) {
+		return errors.New("echo server sent back another body")
+	}
+	return nil
+}
+
+// An http server on a loopback port writing back the bodies posted to it
+type echoServer struct {
+	listener net.Listener
+	server *http.Server
+}
+
+func newEchoServer() (*echoServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	echo := &echoServer{listener : listener, server : &http.Server{Handler : http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read before writing, HTTP/1 request bodies can't be read once the response started
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	})}}
+	go echo.server.Serve(listener)
+	return echo, nil
+}
+
+func (echo *echoServer) Addr() net.Addr {
+	return echo.listener.Addr()
+}
+
+func (echo *echoServer) Close() error {
+	return echo.server.Close()
+}
+
+// Runs a self test of harProxy with the options of the optional JSON body and writes its report
+func (proxyServer *ProxyServer) selfTestHarProxy(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	var opts SelfTestOptions
+	if !proxyServer.decodeJsonBody(w, r, &opts, true) {
+		return
+	}
+	if _, err := opts.withDefaults(); err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := harProxy.SelfTest(r.Context(), opts)
+	if err != nil {
+		proxyServer.writeErrorMessage(w, http.StatusInternalServerError, fmt.Sprintf("Self test failed: %v", err))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&report)
+}
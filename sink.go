@@ -0,0 +1,343 @@
+package goharproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Batches are posted as a HAR document
+	SinkFormatHar = "har"
+
+	// Batches are posted as JSON Lines, one entry per line
+	SinkFormatJsonl = "jsonl"
+)
+
+// Posts batches of recorded entries to an external collector, e.g. so a CI container's traffic is kept
+// after it is torn down, see HarProxyOptions.Sink and HarProxy.SetSink. Failed posts are retried with
+// a doubling backoff, batches still failing then are dropped. The sink never holds up proxied traffic.
+type SinkOptions struct {
+	// The collector's url, batches are POSTed to it
+	Url 			string 				`json:"url"`
+
+	// Headers set on every post, e.g. Authorization
+	Headers 		map[string]string 	`json:"headers,omitempty"`
+
+	// Entries are posted once this many are waiting, 100 when 0
+	BatchSize 		int 				`json:"batchSize,omitempty"`
+
+	// Waiting entries are posted at least this often, 5s when 0
+	FlushIntervalMs int64 				`json:"flushIntervalMs,omitempty"`
+
+	// SinkFormatHar, the default, or SinkFormatJsonl
+	Format 			string 				`json:"format,omitempty"`
+
+	// Retries of a failed post, 3 when 0
+	MaxRetries 		int 				`json:"maxRetries,omitempty"`
+
+	// The wait before the first retry, doubled for each next one, 500ms when 0
+	RetryBackoffMs 	int64 				`json:"retryBackoffMs,omitempty"`
+}
+
+func (opts SinkOptions) validate() error {
+	sinkUrl, err := url.Parse(opts.Url)
+	if err != nil || (sinkUrl.Scheme != "http" && sinkUrl.Scheme != "https") || sinkUrl.Host == "" {
+		return fmt.Errorf("invalid sink url [%v]", opts.Url)
+	}
+	if opts.BatchSize < 0 || opts.FlushIntervalMs < 0 || opts.MaxRetries < 0 || opts.RetryBackoffMs < 0 {
+		return fmt.Errorf("invalid sink batching %+v", opts)
+	}
+	switch opts.Format {
+	case "", SinkFormatHar, SinkFormatJsonl:
+	default:
+		return fmt.Errorf("invalid sink format [%v], expected %v or %v", opts.Format, SinkFormatHar, SinkFormatJsonl)
+	}
+	return nil
+}
+
+// A copy of the options whose headers can be changed apart
+func (opts SinkOptions) copy() SinkOptions {
+	opts.Headers = copyHeaders(opts.Headers)
+	return opts
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(headers))
+	for name, value := range headers {
+		copied[name] = value
+	}
+	return copied
+}
+
+// Options with the defaults filled in
+func (opts SinkOptions) withDefaults() SinkOptions {
+	if opts.BatchSize == 0 {
+		opts.BatchSize = 100
+	}
+	if opts.FlushIntervalMs == 0 {
+		opts.FlushIntervalMs = 5000
+	}
+	if opts.Format == "" {
+		opts.Format = SinkFormatHar
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.RetryBackoffMs == 0 {
+		opts.RetryBackoffMs = 500
+	}
+	return opts
+}
+
+// What the sinks of a proxy did, kept across sink changes
+type sinkCounters struct {
+	// Entries posted successfully
+	sent int64
+	// Posts which failed, retries included
+	failures int64
+	// Entries given up on, after their last retry or because too many batches were waiting
+	dropped int64
+}
+
+// The batches waiting to be posted, past them new batches are dropped
+const sinkQueuedBatches = 16
+
+// Buffers entries and posts them in batches from its own goroutine
+type httpSink struct {
+	opts SinkOptions
+	client *http.Client
+	logger Logger
+	clock Clock
+	counters *sinkCounters
+	// Encodes a batch into a post body and its content type
+	encode func(batch []HarEntry) ([]byte, string, error)
+
+	lock sync.Mutex
+	// Entries waiting for the next batch
+	buffer []HarEntry
+	closed bool
+
+	batches chan []HarEntry
+	done chan struct{}
+}
+
+// Encodes batches in opts.Format unless encode is set
+func newHttpSink(opts SinkOptions, logger Logger, clock Clock, counters *sinkCounters, encode func([]HarEntry) ([]byte, string, error)) *httpSink {
+	sink := &httpSink {
+		opts 	 : opts.withDefaults(),
+		client 	 : &http.Client{Timeout : 30 * time.Second},
+		logger 	 : logger,
+		clock 	 : clock,
+		counters : counters,
+		batches  : make(chan []HarEntry, sinkQueuedBatches),
+		done 	 : make(chan struct{}),
+		encode 	 : encode,
+	}
+	if sink.encode == nil {
+		sink.encode = sink.encodeFormat
+	}
+	go sink.run()
+	return sink
+}
+
+// Buffers entry, queuing a batch once enough entries are waiting
+func (sink *httpSink) add(entry HarEntry) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.closed {
+		atomic.AddInt64(&sink.counters.dropped, 1)
+		return
+	}
+	sink.buffer = append(sink.buffer, entry)
+	if len(sink.buffer) >= sink.opts.BatchSize {
+		sink.queueBuffer()
+	}
+}
+
+// Must be called with lock held
+func (sink *httpSink) queueBuffer() {
+	if len(sink.buffer) == 0 {
+		return
+	}
+	select {
+	case sink.batches <- sink.buffer:
+	default:
+		sink.logger.Errorf("Dropping %v entries for sink %v, too many batches are waiting", len(sink.buffer), sink.opts.Url)
+		atomic.AddInt64(&sink.counters.dropped, int64(len(sink.buffer)))
+	}
+	sink.buffer = nil
+}
+
+// Posts the queued batches, and the buffered entries every flush interval, until closed
+func (sink *httpSink) run() {
+	defer close(sink.done)
+	interval := time.Duration(sink.opts.FlushIntervalMs) * time.Millisecond
+	timer := sink.clock.NewTimer(interval)
+	defer func() {
+		timer.Stop()
+	}()
+	for {
+		select {
+		case batch, ok := <-sink.batches:
+			if !ok {
+				return
+			}
+			sink.post(batch)
+		case <-timer.C():
+			sink.lock.Lock()
+			sink.queueBuffer()
+			sink.lock.Unlock()
+			timer = sink.clock.NewTimer(interval)
+		}
+	}
+}
+
+// Posts batch, retrying failures after a doubling backoff
+func (sink *httpSink) post(batch []HarEntry) {
+	body, contentType, err := sink.encode(batch)
+	if err != nil {
+		sink.logger.Errorf("Dropping %v entries for sink %v : %v", len(batch), sink.opts.Url, err)
+		atomic.AddInt64(&sink.counters.dropped, int64(len(batch)))
+		return
+	}
+	backoff := time.Duration(sink.opts.RetryBackoffMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		if err = sink.postOnce(body, contentType); err == nil {
+			atomic.AddInt64(&sink.counters.sent, int64(len(batch)))
+			return
+		}
+		atomic.AddInt64(&sink.counters.failures, 1)
+		if attempt == sink.opts.MaxRetries {
+			break
+		}
+		sink.logger.Infof("Posting %v entries to sink %v failed, retrying in %v : %v", len(batch), sink.opts.Url, backoff, err)
+		timer := sink.clock.NewTimer(backoff)
+		<-timer.C()
+		backoff *= 2
+	}
+	sink.logger.Errorf("Dropping %v entries for sink %v after %v retries : %v", len(batch), sink.opts.Url, sink.opts.MaxRetries, err)
+	atomic.AddInt64(&sink.counters.dropped, int64(len(batch)))
+}
+
+func (sink *httpSink) postOnce(body []byte, contentType string) error {
+	req, err := http.NewRequest("POST", sink.opts.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range sink.opts.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector answered %v", resp.Status)
+	}
+	return nil
+}
+
+func (sink *httpSink) encodeFormat(batch []HarEntry) ([]byte, string, error) {
+	var body bytes.Buffer
+	if sink.opts.Format == SinkFormatJsonl {
+		encoder := json.NewEncoder(&body)
+		for i := range batch {
+			if err := encoder.Encode(&batch[i]); err != nil {
+				return nil, "", err
+			}
+		}
+		return body.Bytes(), "application/x-ndjson", nil
+	}
+	harLog := newHarLog()
+	harLog.addEntry(batch...)
+	if _, err := harLog.WriteTo(&body); err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), "application/json", nil
+}
+
+// Queues the buffered entries and waits until every batch was posted or dropped
+func (sink *httpSink) close() {
+	sink.lock.Lock()
+	if sink.closed {
+		sink.lock.Unlock()
+		<-sink.done
+		return
+	}
+	sink.closed = true
+	buffer := sink.buffer
+	sink.buffer = nil
+	sink.lock.Unlock()
+	// Nothing is queued anymore, the last batch waits for room rather than being dropped
+	if len(buffer) > 0 {
+		sink.batches <- buffer
+	}
+	close(sink.batches)
+	<-sink.done
+}
+
+// SetSink posts the entries recorded from now on to a collector, replacing the current sink, nil removes it.
+// The entries the replaced sink holds are still posted.
+func (proxy *HarProxy) SetSink(opts *SinkOptions) error {
+	var sink *httpSink
+	if opts != nil {
+		if err := opts.validate(); err != nil {
+			return err
+		}
+		sink = newHttpSink(opts.copy(), proxy.logger, proxy.clock, &proxy.sinkCounters, nil)
+	}
+	proxy.settingsLock.Lock()
+	previous := proxy.sink
+	proxy.sink = sink
+	proxy.settingsLock.Unlock()
+	if previous != nil {
+		go previous.close()
+	}
+	return nil
+}
+
+// Sink returns the proxy's sink options, with their defaults, nil without sink
+func (proxy *HarProxy) Sink() *SinkOptions {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	if proxy.sink == nil {
+		return nil
+	}
+	opts := proxy.sink.opts.copy()
+	return &opts
+}
+
+// SinkStats returns the entries posted to the proxy's sinks, the failed posts and the entries given up on
+func (proxy *HarProxy) SinkStats() (sent, failures, dropped int64) {
+	return atomic.LoadInt64(&proxy.sinkCounters.sent), atomic.LoadInt64(&proxy.sinkCounters.failures), atomic.LoadInt64(&proxy.sinkCounters.dropped)
+}
+
+func (proxy *HarProxy) sendToSink(entry *HarEntry) {
+	proxy.settingsLock.RLock()
+	sink := proxy.sink
+	proxy.settingsLock.RUnlock()
+	if sink != nil {
+		sink.add(*entry)
+	}
+}
+
+// Posts what the sink holds, once the last entry was recorded
+func (proxy *HarProxy) closeSink() {
+	proxy.settingsLock.RLock()
+	sink := proxy.sink
+	proxy.settingsLock.RUnlock()
+	if sink != nil {
+		sink.close()
+	}
+}
@@ -0,0 +1,222 @@
+package goharproxy
+
+import (
+	"fmt"
+	"math"
+	"mime"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// StatsOptions controls which entries HarLog.Stats aggregates and how they are grouped
+type StatsOptions struct {
+	// Only entries whose url matches are aggregated, all of them when nil
+	UrlPattern 	*regexp.Regexp
+
+	// Groups entries by "host", the default, "status" or "mimeType"
+	GroupBy 	string
+}
+
+// HarStats aggregates the entries of a log, overall and by group
+type HarStats struct {
+	GroupBy string 						`json:"groupBy"`
+	Overall HarStatsGroup 				`json:"overall"`
+	Groups 	map[string]HarStatsGroup 	`json:"groups"`
+}
+
+// Aggregates of a group of entries. Latencies are percentiles of the entries' time, in milliseconds, 0 without entries.
+type HarStatsGroup struct {
+	Count 	int 	`json:"count"`
+	// Entries without response or with a status of 400 and above
+	Errors 	int 	`json:"errors"`
+	// Response body bytes, unknown sizes are not counted
+	Bytes 	int64 	`json:"bytes"`
+	P50 	int64 	`json:"p50"`
+	P90 	int64 	`json:"p90"`
+	P99 	int64 	`json:"p99"`
+}
+
+// HarHostStats aggregates the entries of a request host, see HarLog.HostStats
+type HarHostStats struct {
+	Host 		string 			`json:"host"`
+	Count 		int 			`json:"count"`
+	// Entries without response or with a status of 400 and above
+	Errors 		int 			`json:"errors"`
+	// Entries by status class, 2xx... or error for entries without response
+	Statuses 	map[string]int 	`json:"statuses"`
+	// Response body bytes, unknown sizes are not counted
+	Bytes 		int64 			`json:"bytes"`
+	// The mean and the longest of the entries' time, in milliseconds
+	MeanTime 	float64 		`json:"meanTime"`
+	MaxTime 	int64 			`json:"maxTime"`
+}
+
+// The status class of entry, 2xx... or error without response
+func statusClass(entry *HarEntry) string {
+	if status := entryStatus(*entry); status != 0 {
+		return strconv.Itoa(status / 100) + "xx"
+	}
+	return "error"
+}
+
+// Returns the group of entry, entries without response have status 0 and no mime type
+var statsGroupKeys = map[string]func(entry *HarEntry) string {
+	"host" : func(entry *HarEntry) string {
+		requestUrl, err := url.Parse(entry.Request.Url)
+		if err != nil {
+			return ""
+		}
+		return requestUrl.Host
+	},
+	"status" : func(entry *HarEntry) string {
+		return strconv.Itoa(entryStatus(*entry))
+	},
+	"mimeType" : func(entry *HarEntry) string {
+		if entry.Response == nil || entry.Response.Content == nil {
+			return ""
+		}
+		mediaType, _, err := mime.ParseMediaType(entry.Response.Content.MimeType)
+		if err != nil {
+			return entry.Response.Content.MimeType
+		}
+		return mediaType
+	},
+}
+
+// Stats aggregates the current entries, without clearing them
+func (harLog *HarLog) Stats(opts StatsOptions) (HarStats, error) {
+	if opts.GroupBy == "" {
+		opts.GroupBy = "host"
+	}
+	groupKey, ok := statsGroupKeys[opts.GroupBy]
+	if !ok {
+		return HarStats{}, fmt.Errorf("invalid stats groupBy [%v], expected host, status or mimeType", opts.GroupBy)
+	}
+	overall, groups := harLog.aggregate(opts.UrlPattern, groupKey)
+	stats := HarStats {
+		GroupBy : opts.GroupBy,
+		Overall : overall.group(),
+		Groups 	: make(map[string]HarStatsGroup, len(groups)),
+	}
+	for key, group := range groups {
+		stats.Groups[key] = group.group()
+	}
+	return stats, nil
+}
+
+// HostStats aggregates the current entries whose url matches urlPattern, all of them when nil, by request host,
+// without clearing them. Hosts come by decreasing number of entries, then by name.
+func (harLog *HarLog) HostStats(urlPattern *regexp.Regexp) []HarHostStats {
+	_, groups := harLog.aggregate(urlPattern, statsGroupKeys["host"])
+	hosts := make([]HarHostStats, 0, len(groups))
+	for host, group := range groups {
+		hostStats := HarHostStats{Host : host, Count : group.totals.Count, Errors : group.totals.Errors, Statuses : group.statuses, Bytes : group.totals.Bytes}
+		var total int64
+		for _, time := range group.times {
+			total += time
+			if time > hostStats.MaxTime {
+				hostStats.MaxTime = time
+			}
+		}
+		hostStats.MeanTime = float64(total) / float64(len(group.times))
+		hosts = append(hosts, hostStats)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Count != hosts[j].Count {
+			return hosts[i].Count > hosts[j].Count
+		}
+		return hosts[i].Host < hosts[j].Host
+	})
+	return hosts
+}
+
+// SlowestEntries returns a copy of the n current entries with the longest time whose url matches urlPattern,
+// all of them when nil, slowest first and entries of the same time in the order they started.
+// Requests in progress have no entry yet and aren't counted.
+func (harLog *HarLog) SlowestEntries(n int, urlPattern *regexp.Regexp) []HarEntry {
+	_, entries := harLog.snapshot()
+	slowest := []HarEntry{}
+	for i := range entries {
+		if entries[i].Request != nil && (urlPattern == nil || urlPattern.MatchString(entries[i].Request.Url)) {
+			slowest = append(slowest, entries[i])
+		}
+	}
+	sort.SliceStable(slowest, func(i, j int) bool {
+		if slowest[i].Time != slowest[j].Time {
+			return slowest[i].Time > slowest[j].Time
+		}
+		return slowest[i].StartedDateTime.Before(slowest[j].StartedDateTime)
+	})
+	if n < 0 {
+		n = 0
+	}
+	if n < len(slowest) {
+		slowest = slowest[:n]
+	}
+	return slowest
+}
+
+// Accumulates the current entries whose url matches urlPattern, all of them when nil, overall and by groupKey
+func (harLog *HarLog) aggregate(urlPattern *regexp.Regexp, groupKey func(*HarEntry) string) (statsAccumulator, map[string]*statsAccumulator) {
+	_, entries := harLog.snapshot()
+	var overall statsAccumulator
+	groups := make(map[string]*statsAccumulator)
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Request == nil || urlPattern != nil && !urlPattern.MatchString(entry.Request.Url) {
+			continue
+		}
+		key := groupKey(entry)
+		if groups[key] == nil {
+			groups[key] = &statsAccumulator{}
+		}
+		overall.add(entry)
+		groups[key].add(entry)
+	}
+	return overall, groups
+}
+
+type statsAccumulator struct {
+	totals HarStatsGroup
+	times []int64
+	// Entries by status class
+	statuses map[string]int
+}
+
+func (acc *statsAccumulator) add(entry *HarEntry) {
+	acc.totals.Count++
+	if entry.Response == nil || entry.Response.Status >= 400 {
+		acc.totals.Errors++
+	}
+	if entry.Response != nil && entry.Response.BodySize > 0 {
+		acc.totals.Bytes += entry.Response.BodySize
+	}
+	acc.times = append(acc.times, entry.Time)
+	if acc.statuses == nil {
+		acc.statuses = make(map[string]int)
+	}
+	acc.statuses[statusClass(entry)]++
+}
+
+func (acc *statsAccumulator) group() HarStatsGroup {
+	sort.Slice(acc.times, func(i, j int) bool { return acc.times[i] < acc.times[j] })
+	group := acc.totals
+	group.P50 = percentile(acc.times, 50)
+	group.P90 = percentile(acc.times, 90)
+	group.P99 = percentile(acc.times, 99)
+	return group
+}
+
+// Nearest rank percentile of sorted values, 0 when empty
+func percentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank - 1]
+}
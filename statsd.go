@@ -0,0 +1,270 @@
+package goharproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The datagrams waiting to be sent, past them the metrics of new entries are dropped
+const statsdQueuedDatagrams = 1024
+
+// Sends StatsD metrics of every recorded entry over UDP, e.g. to a local Datadog agent,
+// see HarProxyOptions.Statsd and HarProxy.SetStatsd. Per entry it sends:
+//   - [prefix].request.time, the entry's time in ms
+//   - [prefix].request.count, 1
+//   - [prefix].request.errors, 1 for entries without response
+//   - [prefix].request.bytes_sent and [prefix].request.bytes_received, the request and response body sizes
+// Metrics are bucketed by host and status class (2xx... or error without response), as [metric].[host].[class]
+// or as DogStatsD tags. They are sent from their own goroutine and never hold up entry processing.
+type StatsdOptions struct {
+	// The StatsD server as host:port
+	Address 	string 	`json:"address"`
+
+	// Prepended to every metric name, goharproxy when empty
+	Prefix 		string 	`json:"prefix,omitempty"`
+
+	// The fraction of entries whose metrics are sent, 1 when 0
+	SampleRate 	float64 `json:"sampleRate,omitempty"`
+
+	// Tags the metrics with host and status (DogStatsD), instead of appending them to the metric names
+	Tags 		bool 	`json:"tags,omitempty"`
+}
+
+func (opts StatsdOptions) validate() error {
+	if _, err := net.ResolveUDPAddr("udp", opts.Address); err != nil || opts.Address == "" {
+		return fmt.Errorf("invalid statsd address [%v]", opts.Address)
+	}
+	if opts.SampleRate < 0 || opts.SampleRate > 1 {
+		return fmt.Errorf("invalid statsd sampleRate [%v], expected a number between 0 and 1", opts.SampleRate)
+	}
+	if strings.ContainsAny(opts.Prefix, ":|@#\n") {
+		return fmt.Errorf("invalid statsd prefix [%v]", opts.Prefix)
+	}
+	return nil
+}
+
+// Options with the defaults filled in
+func (opts StatsdOptions) withDefaults() StatsdOptions {
+	if opts.Prefix == "" {
+		opts.Prefix = "goharproxy"
+	}
+	if opts.SampleRate == 0 {
+		opts.SampleRate = 1
+	}
+	return opts
+}
+
+// What the StatsD clients of a proxy did, kept across client changes
+type statsdCounters struct {
+	// Datagrams written, one per entry
+	sent int64
+	// Entries whose metrics weren't sent, because too many datagrams were waiting or the write failed
+	dropped int64
+}
+
+type statsdClient struct {
+	opts StatsdOptions
+	conn net.Conn
+	logger Logger
+	counters *statsdCounters
+	// Picks the sampled entries, apart from the proxy's seeded decisions
+	random *lockedRand
+
+	lock sync.RWMutex
+	closed bool
+
+	datagrams chan []byte
+	done chan struct{}
+}
+
+func newStatsdClient(opts StatsdOptions, logger Logger, counters *statsdCounters) (*statsdClient, error) {
+	conn, err := net.Dial("udp", opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	client := &statsdClient {
+		opts 	  : opts.withDefaults(),
+		conn 	  : conn,
+		logger 	  : logger,
+		counters  : counters,
+		random 	  : newSeededRand(0),
+		datagrams : make(chan []byte, statsdQueuedDatagrams),
+		done 	  : make(chan struct{}),
+	}
+	go client.run()
+	return client, nil
+}
+
+// Queues the metrics of entry, unless it isn't sampled
+func (client *statsdClient) add(entry *HarEntry) {
+	if client.opts.SampleRate < 1 && client.random.float64() >= client.opts.SampleRate {
+		return
+	}
+	datagram := client.format(entry)
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+	if client.closed {
+		return
+	}
+	select {
+	case client.datagrams <- datagram:
+	default:
+		atomic.AddInt64(&client.counters.dropped, 1)
+	}
+}
+
+// The metrics of entry, one per line
+func (client *statsdClient) format(entry *HarEntry) []byte {
+	host := statsGroupKeys["host"](entry)
+	class := statusClass(entry)
+	var bodySent, bodyReceived int64
+	if entry.Request.BodySize > 0 {
+		bodySent = entry.Request.BodySize
+	}
+	if entry.Response != nil && entry.Response.BodySize > 0 {
+		bodyReceived = entry.Response.BodySize
+	}
+
+	suffix, bucket := "", ""
+	if client.opts.SampleRate < 1 {
+		suffix = "|@" + strconv.FormatFloat(client.opts.SampleRate, 'f', -1, 64)
+	}
+	if client.opts.Tags {
+		suffix += "|#host:" + statsdTagValue(host) + ",status:" + class
+	} else {
+		bucket = "." + statsdBucket(host) + "." + class
+	}
+	var datagram bytes.Buffer
+	metric := func(name string, value int64, metricType string) {
+		if datagram.Len() > 0 {
+			datagram.WriteByte('\n')
+		}
+		fmt.Fprintf(&datagram, "%v.request.%v%v:%v|%v%v", client.opts.Prefix, name, bucket, value, metricType, suffix)
+	}
+	metric("time", entry.Time, "ms")
+	metric("count", 1, "c")
+	if entry.Response == nil {
+		metric("errors", 1, "c")
+	}
+	metric("bytes_sent", bodySent, "c")
+	metric("bytes_received", bodyReceived, "c")
+	return datagram.Bytes()
+}
+
+// A host as one metric name segment, e.g. example.com:8080 as example_com_8080
+func statsdBucket(host string) string {
+	if host == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', '[', ']', '\n':
+			return '_'
+		}
+		return r
+	}, host)
+}
+
+func statsdTagValue(host string) string {
+	if host == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '@', '#', '\n':
+			return '_'
+		}
+		return r
+	}, host)
+}
+
+// Writes the queued datagrams until closed
+func (client *statsdClient) run() {
+	defer close(client.done)
+	defer client.conn.Close()
+	for datagram := range client.datagrams {
+		if _, err := client.conn.Write(datagram); err != nil {
+			client.logger.Debugf("Dropping metrics for statsd %v : %v", client.opts.Address, err)
+			atomic.AddInt64(&client.counters.dropped, 1)
+			continue
+		}
+		atomic.AddInt64(&client.counters.sent, 1)
+	}
+}
+
+// Sends the queued datagrams and closes the connection
+func (client *statsdClient) close() {
+	client.lock.Lock()
+	if client.closed {
+		client.lock.Unlock()
+		<-client.done
+		return
+	}
+	client.closed = true
+	close(client.datagrams)
+	client.lock.Unlock()
+	<-client.done
+}
+
+// SetStatsd sends the metrics of the entries recorded from now on to a StatsD server, replacing the current one,
+// nil stops sending them
+func (proxy *HarProxy) SetStatsd(opts *StatsdOptions) error {
+	var client *statsdClient
+	if opts != nil {
+		if err := opts.validate(); err != nil {
+			return err
+		}
+		var err error
+		if client, err = newStatsdClient(*opts, proxy.logger, &proxy.statsdCounters); err != nil {
+			return err
+		}
+	}
+	proxy.settingsLock.Lock()
+	previous := proxy.statsd
+	proxy.statsd = client
+	proxy.settingsLock.Unlock()
+	if previous != nil {
+		go previous.close()
+	}
+	return nil
+}
+
+// Statsd returns the proxy's StatsD options, with their defaults, nil when metrics aren't sent
+func (proxy *HarProxy) Statsd() *StatsdOptions {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	if proxy.statsd == nil {
+		return nil
+	}
+	opts := proxy.statsd.opts
+	return &opts
+}
+
+// StatsdStats returns the datagrams sent to the proxy's StatsD servers and the entries whose metrics were dropped
+func (proxy *HarProxy) StatsdStats() (sent, dropped int64) {
+	return atomic.LoadInt64(&proxy.statsdCounters.sent), atomic.LoadInt64(&proxy.statsdCounters.dropped)
+}
+
+func (proxy *HarProxy) sendToStatsd(entry *HarEntry) {
+	proxy.settingsLock.RLock()
+	client := proxy.statsd
+	proxy.settingsLock.RUnlock()
+	if client != nil {
+		client.add(entry)
+	}
+}
+
+// Sends the queued metrics, once the last entry was recorded
+func (proxy *HarProxy) closeStatsd() {
+	proxy.settingsLock.RLock()
+	client := proxy.statsd
+	proxy.settingsLock.RUnlock()
+	if client != nil {
+		client.close()
+	}
+}
@@ -0,0 +1,158 @@
+package goharproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Changes the status of matching upstream responses, e.g. to test a client's retries, see HarProxyConfig.StatusRewrites.
+// The first rule matching a response applies. The entry records the status the client got, and the upstream one as _originalStatus.
+type StatusRewrite struct {
+	// Regular expression matched against the request url, empty matches every request
+	UrlPattern 	string 		`json:"urlPattern,omitempty"`
+
+	// The upstream status rewritten, 0 matches any
+	FromStatus 	int 		`json:"fromStatus,omitempty"`
+
+	ToStatus 	int 		`json:"toStatus"`
+
+	// The share of the matching responses rewritten, from 0 to 100. 0 rewrites all of them, like 100.
+	Percentage 	float64 	`json:"percentage,omitempty"`
+
+	// Replaces the upstream body when set, the empty string sends an empty body
+	Body 		*string 	`json:"body,omitempty"`
+
+	ActivationWindow
+}
+
+func (rewrite StatusRewrite) validate() error {
+	if rewrite.ToStatus < 100 || rewrite.ToStatus > 999 {
+		return fmt.Errorf("invalid toStatus [%v]", rewrite.ToStatus)
+	}
+	if rewrite.FromStatus != 0 && (rewrite.FromStatus < 100 || rewrite.FromStatus > 999) {
+		return fmt.Errorf("invalid fromStatus [%v]", rewrite.FromStatus)
+	}
+	if rewrite.Percentage < 0 || rewrite.Percentage > 100 {
+		return fmt.Errorf("invalid percentage [%v], expected 0 to 100", rewrite.Percentage)
+	}
+	if _, err := regexp.Compile(rewrite.UrlPattern); err != nil {
+		return fmt.Errorf("invalid urlPattern [%v]: %v", rewrite.UrlPattern, err)
+	}
+	return rewrite.ActivationWindow.validate()
+}
+
+// A status rewrite as a proxy holds it, with its pattern compiled once when it is set
+type statusRewrite struct {
+	StatusRewrite
+
+	urlPattern *regexp.Regexp
+	activation activation
+	// Why the rule is invalid, it never matches then
+	err error
+}
+
+// Compiles rewrites, their activation windows given as a duration start at now
+func newStatusRewrites(rewrites []StatusRewrite, now time.Time) []statusRewrite {
+	compiled := make([]statusRewrite, len(rewrites))
+	for i, rewrite := range rewrites {
+		rewrite.ActivationWindow = rewrite.ActivationWindow.resolve(now)
+		compiled[i].StatusRewrite = rewrite
+		compiled[i].activation = newActivation(rewrite.ActivationWindow)
+		if compiled[i].err = rewrite.validate(); compiled[i].err == nil {
+			compiled[i].urlPattern = regexp.MustCompile(rewrite.UrlPattern)
+		}
+	}
+	return compiled
+}
+
+func statusRewritesOf(rewrites []statusRewrite) []StatusRewrite {
+	statusRewrites := make([]StatusRewrite, len(rewrites))
+	for i, rewrite := range rewrites {
+		statusRewrites[i] = rewrite.StatusRewrite
+	}
+	return statusRewrites
+}
+
+// SetStatusRewrites replaces the proxy's status rewrites, they apply from the next response
+func (proxy *HarProxy) SetStatusRewrites(rewrites []StatusRewrite) error {
+	for _, rewrite := range rewrites {
+		if err := rewrite.validate(); err != nil {
+			return err
+		}
+	}
+	compiled := newStatusRewrites(rewrites, proxy.clock.Now())
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.statusRewrites = compiled
+	return nil
+}
+
+// StatusRewrites returns a copy of the status rewrites, in the order they are matched,
+// with the time remaining of their activation windows
+func (proxy *HarProxy) StatusRewrites() []StatusRewrite {
+	now := proxy.clock.Now()
+	proxy.collectExpiredRules(now)
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	rewrites := statusRewritesOf(proxy.statusRewrites)
+	for i := range rewrites {
+		rewrites[i].ActivationWindow = rewrites[i].ActivationWindow.remaining(now)
+	}
+	return rewrites
+}
+
+// Applies the first status rewrite matching resp, if its percentage draws it. Returns the response
+// sent on, and the upstream status if it was rewritten or 0.
+func (proxy *HarProxy) rewriteStatus(req *http.Request, resp *http.Response) (*http.Response, int) {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, 0
+	}
+	proxy.settingsLock.RLock()
+	rewrites := proxy.statusRewrites
+	proxy.settingsLock.RUnlock()
+	now := proxy.clock.Now()
+	for i := range rewrites {
+		rewrite := &rewrites[i]
+		if rewrite.err != nil {
+			proxy.logger.Errorf("Skipping status rewrite %v: %v", i, rewrite.err)
+			continue
+		}
+		if !rewrite.activation.active(now) {
+			if rewrite.activation.expired(now) {
+				proxy.collectExpiredRules(now)
+			}
+			continue
+		}
+		if rewrite.FromStatus != 0 && rewrite.FromStatus != resp.StatusCode || !rewrite.urlPattern.MatchString(req.URL.String()) {
+			continue
+		}
+		if rewrite.Percentage > 0 && rewrite.Percentage < 100 && proxy.random.float64() * 100 >= rewrite.Percentage {
+			return resp, 0
+		}
+		return rewrittenResponse(resp, rewrite.StatusRewrite), resp.StatusCode
+	}
+	return resp, 0
+}
+
+func rewrittenResponse(resp *http.Response, rewrite StatusRewrite) *http.Response {
+	rewritten := new(http.Response)
+	*rewritten = *resp
+	rewritten.StatusCode = rewrite.ToStatus
+	rewritten.Status = strconv.Itoa(rewrite.ToStatus) + " " + http.StatusText(rewrite.ToStatus)
+	if rewrite.Body == nil {
+		return rewritten
+	}
+	resp.Body.Close()
+	rewritten.Header = resp.Header.Clone()
+	rewritten.Header.Del("Content-Encoding")
+	rewritten.Header.Set("Content-Length", strconv.Itoa(len(*rewrite.Body)))
+	rewritten.TransferEncoding = nil
+	rewritten.ContentLength = int64(len(*rewrite.Body))
+	rewritten.Body = ioutil.NopCloser(strings.NewReader(*rewrite.Body))
+	return rewritten
+}
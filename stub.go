@@ -0,0 +1,304 @@
+package goharproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Unmatched requests are answered with 404, the default
+	StubUnmatchedNotFound = "notFound"
+	// Unmatched requests are sent upstream as without stub
+	StubUnmatchedPassThrough = "passThrough"
+	// Unmatched requests fail like an unreachable upstream, the client gets a 502 and the entry has no response
+	StubUnmatchedFail = "fail"
+)
+
+// The most bytes of a request body read to match it against the recorded ones, larger bodies never match
+const maxStubBodyBytes = 10 << 20
+
+// Answers requests with the responses recorded in a HAR log instead of sending them upstream, e.g. to run
+// a suite offline against what the backend answered once, see HarProxyOptions.Stub and HarProxy.SetStub.
+//
+// A request matches the entries with its method and url, as the client requested it, and optionally the same
+// values of some headers and the same body. Entries matching the same requests answer them in the order they
+// were recorded, the last one repeating. Entries without response, or whose body matters but was truncated,
+// are left out. Recorded cookies are sent again as Set-Cookie headers, without their SameSite and Max-Age.
+type StubOptions struct {
+	// The recorded entries, e.g. from ParseHar
+	Har 			*HarLog 	`json:"-"`
+
+	// Headers whose values must match too, e.g. Authorization
+	MatchHeaders 	[]string 	`json:"matchHeaders,omitempty"`
+
+	// Whether the request body must match the recorded one
+	MatchBody 		bool 		`json:"matchBody,omitempty"`
+
+	// What happens to requests matching no entry, StubUnmatchedNotFound when empty, StubUnmatchedPassThrough or StubUnmatchedFail
+	Unmatched 		string 		`json:"unmatched,omitempty"`
+
+	// Sets the Date header to when the response is served, and moves recorded cookie expiries forward by the time since the entry was recorded
+	RefreshHeaders 	bool 		`json:"refreshHeaders,omitempty"`
+}
+
+func (opts StubOptions) validate() error {
+	if opts.Har == nil {
+		return errors.New("stub without HAR log")
+	}
+	switch opts.Unmatched {
+	case "", StubUnmatchedNotFound, StubUnmatchedPassThrough, StubUnmatchedFail:
+	default:
+		return fmt.Errorf("invalid stub unmatched policy [%v]", opts.Unmatched)
+	}
+	for _, name := range opts.MatchHeaders {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("empty stub match header")
+		}
+	}
+	return nil
+}
+
+func (opts StubOptions) withDefaults() StubOptions {
+	if opts.Unmatched == "" {
+		opts.Unmatched = StubUnmatchedNotFound
+	}
+	return opts
+}
+
+// The responses of a stub, by match key
+type httpStub struct {
+	opts StubOptions
+	lock sync.Mutex
+	responses map[string][]stubResponse
+	// The index of the next response of each key
+	next map[string]int
+}
+
+type stubResponse struct {
+	response *HarResponse
+	recorded time.Time
+}
+
+func newHttpStub(opts StubOptions) *httpStub {
+	stub := &httpStub{opts : opts, responses : make(map[string][]stubResponse), next : make(map[string]int)}
+	_, entries := opts.Har.snapshot()
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Request == nil || entry.Response == nil || entry.Response.Status == 0 {
+			continue
+		}
+		body := ""
+		if opts.MatchBody {
+			if entry.Request.PostData != nil && entry.Request.PostData.Truncated {
+				continue
+			}
+			body = requestBody(entry.Request)
+		}
+		// Matched against the url the client requested, before its query was rewritten
+		requestedUrl := entry.Request.Url
+		if entry.Request.OriginalUrl != "" {
+			requestedUrl = entry.Request.OriginalUrl
+		}
+		key := stub.key(entry.Request.Method, requestedUrl, func(name string) string {
+			var values []string
+			for _, header := range entry.Request.Headers {
+				if strings.EqualFold(header.Name, name) {
+					values = append(values, header.Value)
+				}
+			}
+			return strings.Join(values, ",")
+		}, body)
+		stub.responses[key] = append(stub.responses[key], stubResponse{response : entry.Response, recorded : entry.StartedDateTime})
+	}
+	return stub
+}
+
+// The match key of a request, header returning the joined values of a header
+func (stub *httpStub) key(method, rawUrl string, header func(string) string, body string) string {
+	key := strings.ToUpper(method) + " " + rawUrl
+	for _, name := range stub.opts.MatchHeaders {
+		// Recorded values are unescaped, see parseStringArrMap
+		value := header(name)
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+		key += "\n" + strings.ToLower(name) + ": " + value
+	}
+	if stub.opts.MatchBody {
+		sum := sha256.Sum256([]byte(body))
+		key += "\n" + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+// The recorded response matching req, nil when there is none. Reads the body of req to match it, if it must.
+func (stub *httpStub) match(clientUrl string, req *http.Request) *stubResponse {
+	body := ""
+	if stub.opts.MatchBody && req.Body != nil && req.Body != http.NoBody {
+		read, err := ioutil.ReadAll(io.LimitReader(req.Body, maxStubBodyBytes + 1))
+		req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(read), req.Body))
+		if err != nil || len(read) > maxStubBodyBytes {
+			return nil
+		}
+		body = string(read)
+	}
+	key := stub.key(req.Method, clientUrl, func(name string) string {
+		return strings.Join(req.Header.Values(name), ",")
+	}, body)
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+	responses := stub.responses[key]
+	if len(responses) == 0 {
+		return nil
+	}
+	next := stub.next[key]
+	if next < len(responses) - 1 {
+		stub.next[key] = next + 1
+	}
+	return &responses[next]
+}
+
+// The response to req of a recorded one, now being when it is served
+func (stub *httpStub) response(recorded *stubResponse, req *http.Request, now time.Time) *http.Response {
+	harResponse := recorded.response
+	var body []byte
+	if harResponse.Content != nil {
+		body, _ = harResponse.Content.Bytes()
+	}
+	status := harResponse.StatusText
+	if !strings.HasPrefix(status, strconv.Itoa(harResponse.Status) + " ") {
+		status = fmt.Sprintf("%d %s", harResponse.Status, http.StatusText(harResponse.Status))
+	}
+	resp := &http.Response {
+		Status 			: strings.TrimSpace(status),
+		StatusCode 		: harResponse.Status,
+		Proto 			: "HTTP/1.1",
+		ProtoMajor 		: 1,
+		ProtoMinor 		: 1,
+		Header 			: make(http.Header),
+		Body 			: ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength 	: int64(len(body)),
+		Request 		: req,
+	}
+	// Bodies are recorded as the client got them, decompressed unless they still start with the gzip magic bytes
+	gzipped := len(body) > 1 && body[0] == 0x1f && body[1] == 0x8b
+	for _, header := range harResponse.Headers {
+		switch http.CanonicalHeaderKey(header.Name) {
+		case "Content-Length", "Transfer-Encoding", "Connection":
+			continue
+		case "Content-Encoding":
+			if !gzipped {
+				continue
+			}
+		case "Set-Cookie":
+			// Sent from the cookies, recorded values of several cookies are joined
+			if len(harResponse.Cookies) > 0 {
+				continue
+			}
+		case "Date":
+			if stub.opts.RefreshHeaders {
+				continue
+			}
+		}
+		resp.Header.Add(header.Name, header.Value)
+	}
+	shift := now.Sub(recorded.recorded)
+	for _, harCookie := range harResponse.Cookies {
+		cookie := http.Cookie{Name : harCookie.Name, Value : harCookie.Value, Path : harCookie.Path, Domain : harCookie.Domain, HttpOnly : harCookie.HttpOnly, Secure : harCookie.Secure}
+		if !harCookie.Expires.IsZero() && harCookie.Expires.Year() > 1 {
+			cookie.Expires = harCookie.Expires
+			if stub.opts.RefreshHeaders && shift > 0 {
+				cookie.Expires = cookie.Expires.Add(shift)
+			}
+		}
+		resp.Header.Add("Set-Cookie", cookie.String())
+	}
+	if stub.opts.RefreshHeaders {
+		resp.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+	}
+	return resp
+}
+
+// SetStub answers the requests from now on with the responses recorded in opts.Har, nil sends them upstream again
+func (proxy *HarProxy) SetStub(opts *StubOptions) error {
+	var stub *httpStub
+	if opts != nil {
+		if err := opts.validate(); err != nil {
+			return err
+		}
+		stub = newHttpStub(opts.withDefaults())
+	}
+	proxy.settingsLock.Lock()
+	proxy.stub = stub
+	proxy.settingsLock.Unlock()
+	return nil
+}
+
+// Stub returns the proxy's stub options, with their defaults, nil when requests are sent upstream
+func (proxy *HarProxy) Stub() *StubOptions {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	if proxy.stub == nil {
+		return nil
+	}
+	opts := proxy.stub.opts
+	opts.MatchHeaders = append([]string(nil), opts.MatchHeaders...)
+	return &opts
+}
+
+// StubStats returns the requests answered with a recorded response and those matching none
+func (proxy *HarProxy) StubStats() (served, unmatched int64) {
+	return atomic.LoadInt64(&proxy.stubCounters.served), atomic.LoadInt64(&proxy.stubCounters.unmatched)
+}
+
+type stubCounters struct {
+	served int64
+	unmatched int64
+}
+
+// Answers req from the stub, if there is one. Returns whether req was answered, with the response or error, and
+// whether it matched a recorded entry. Requests which aren't answered go upstream.
+func (proxy *HarProxy) serveStub(clientUrl string, req *http.Request) (answered, matched bool, resp *http.Response, err error) {
+	proxy.settingsLock.RLock()
+	stub := proxy.stub
+	proxy.settingsLock.RUnlock()
+	if stub == nil {
+		return false, false, nil, nil
+	}
+	if recorded := stub.match(clientUrl, req); recorded != nil {
+		atomic.AddInt64(&proxy.stubCounters.served, 1)
+		return true, true, stub.response(recorded, req, proxy.clock.Now()), nil
+	}
+	atomic.AddInt64(&proxy.stubCounters.unmatched, 1)
+	proxy.logger.Debugf("No recorded response matches %v %v", req.Method, clientUrl)
+	switch stub.opts.Unmatched {
+	case StubUnmatchedPassThrough:
+		return false, false, nil, nil
+	case StubUnmatchedFail:
+		return true, false, nil, fmt.Errorf("no recorded response matches %v %v", req.Method, clientUrl)
+	}
+	resp = &http.Response {
+		Status 			: "404 Not Found",
+		StatusCode 		: http.StatusNotFound,
+		Proto 			: "HTTP/1.1",
+		ProtoMajor 		: 1,
+		ProtoMinor 		: 1,
+		Header 			: http.Header{"Content-Type" : {"text/plain; charset=utf-8"}},
+		Request 		: req,
+	}
+	body := "No recorded response matches " + req.Method + " " + clientUrl
+	resp.Body, resp.ContentLength = ioutil.NopCloser(strings.NewReader(body)), int64(len(body))
+	return true, false, resp, nil
+}
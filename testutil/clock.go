@@ -0,0 +1,102 @@
+// Package testutil helps testing code built on goharproxy deterministically
+package testutil
+
+import (
+	"sync"
+	"time"
+)
+
+// Timer is the timer of FakeClock, the same type as goharproxy.Timer
+type Timer = interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// FakeClock implements goharproxy.Clock with a time which only moves when Advance or Set is called.
+// Timers fire when the time reaches their deadline. It is safe for concurrent use.
+type FakeClock struct {
+	lock sync.Mutex
+	now time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a clock stopped at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now : now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) Since(t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
+
+// NewTimer returns a timer firing once the clock is advanced by d, right away if d isn't positive
+func (clock *FakeClock) NewTimer(d time.Duration) Timer {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	timer := &fakeTimer{clock : clock, deadline : clock.now.Add(d), c : make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- clock.now
+		return timer
+	}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward by d, firing the timers it reaches
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.Set(clock.Now().Add(d))
+}
+
+// Set moves the clock to now, firing the timers it reaches. Setting it back in time fires nothing.
+func (clock *FakeClock) Set(now time.Time) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = now
+	pending := clock.timers[:0]
+	for _, timer := range clock.timers {
+		if timer.deadline.After(now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- now
+	}
+	clock.timers = pending
+}
+
+// Timers returns the number of timers which have not fired nor been stopped,
+// e.g. to advance the clock only once the code under test is waiting
+func (clock *FakeClock) Timers() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return len(clock.timers)
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	deadline time.Time
+	c chan time.Time
+}
+
+func (timer *fakeTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+// Stop returns false if the timer already fired or was stopped
+func (timer *fakeTimer) Stop() bool {
+	clock := timer.clock
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	for i, pending := range clock.timers {
+		if pending == timer {
+			clock.timers = append(clock.timers[:i], clock.timers[i + 1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package testutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	short, long, stopped := clock.NewTimer(time.Second), clock.NewTimer(time.Minute), clock.NewTimer(time.Second)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("Expected only the first Stop of a pending timer to succeed")
+	}
+	if clock.Timers() != 2 {
+		t.Fatal("Expected 2 pending timers but got: ", clock.Timers())
+	}
+
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-short.C():
+		t.Fatal("Expected the timer not to fire before its deadline")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	if fired := <-short.C(); !fired.Equal(start.Add(time.Second)) || clock.Since(start) != time.Second {
+		t.Fatal("Expected the timer to fire at its deadline but got: ", fired)
+	}
+	if short.Stop() || clock.Timers() != 1 {
+		t.Fatal("Expected a fired timer not to be pending")
+	}
+
+	clock.Set(start)
+	if clock.Now() != start || clock.Timers() != 1 {
+		t.Fatal("Expected setting the clock back to fire nothing")
+	}
+	clock.Set(start.Add(time.Hour))
+	<-long.C()
+	select {
+	case <-stopped.C():
+		t.Fatal("Expected a stopped timer never to fire")
+	case <-clock.NewTimer(0).C():
+	}
+}
@@ -0,0 +1,297 @@
+package goharproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Exports recorded entries as OpenTelemetry spans over OTLP/HTTP with JSON encoding, so the timing the proxy
+// observes shows up in the traces of the services behind it, see HarProxyOptions.Tracing and HarProxy.SetTracing.
+// Spans are posted in batches like the entries of a sink, with the same retries, and never hold up proxied traffic.
+//
+// Each entry becomes a client span named [method] [host][path] with the status, sizes and server ip address as
+// attributes and the non zero HAR timings as events. A request carrying a W3C traceparent header gets a span
+// in that trace, child of the caller's span, others start a trace of their own.
+type TracingOptions struct {
+	// The collector's traces url, e.g. http://localhost:4318/v1/traces
+	Endpoint 		string 				`json:"endpoint"`
+
+	// Headers set on every post, e.g. an api key
+	Headers 		map[string]string 	`json:"headers,omitempty"`
+
+	// The service.name of the spans' resource, goharproxy when empty
+	ServiceName 	string 				`json:"serviceName,omitempty"`
+
+	// Spans are posted once this many are waiting, 100 when 0
+	BatchSize 		int 				`json:"batchSize,omitempty"`
+
+	// Waiting spans are posted at least this often, 5s when 0
+	FlushIntervalMs int64 				`json:"flushIntervalMs,omitempty"`
+}
+
+func (opts TracingOptions) validate() error {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid tracing endpoint [%v]", opts.Endpoint)
+	}
+	if opts.BatchSize < 0 || opts.FlushIntervalMs < 0 {
+		return fmt.Errorf("invalid tracing batching %+v", opts)
+	}
+	return nil
+}
+
+func (opts TracingOptions) withDefaults() TracingOptions {
+	if opts.ServiceName == "" {
+		opts.ServiceName = "goharproxy"
+	}
+	sinkOpts := opts.sinkOptions().withDefaults()
+	opts.BatchSize, opts.FlushIntervalMs = sinkOpts.BatchSize, sinkOpts.FlushIntervalMs
+	return opts
+}
+
+// A copy of the options whose headers can be changed apart
+func (opts TracingOptions) copy() TracingOptions {
+	opts.Headers = copyHeaders(opts.Headers)
+	return opts
+}
+
+func (opts TracingOptions) sinkOptions() SinkOptions {
+	return SinkOptions{Url : opts.Endpoint, Headers : opts.Headers, BatchSize : opts.BatchSize, FlushIntervalMs : opts.FlushIntervalMs}
+}
+
+// A version 00 traceparent, trace id, parent id and flags, ids not all zeros
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// The OTLP JSON encoding of a span, see opentelemetry-proto's trace.proto. 64 bit integers are strings
+// and ids are hex, as OTLP/HTTP expects.
+type otlpSpan struct {
+	TraceId 			string 			`json:"traceId"`
+	SpanId 				string 			`json:"spanId"`
+	ParentSpanId 		string 			`json:"parentSpanId,omitempty"`
+	Name 				string 			`json:"name"`
+	Kind 				int 			`json:"kind"`
+	StartTimeUnixNano 	string 			`json:"startTimeUnixNano"`
+	EndTimeUnixNano 	string 			`json:"endTimeUnixNano"`
+	Attributes 			[]otlpAttribute `json:"attributes"`
+	Events 				[]otlpEvent 	`json:"events,omitempty"`
+	Status 				otlpStatus 		`json:"status"`
+}
+
+type otlpAttribute struct {
+	Key 	string 		`json:"key"`
+	Value 	otlpValue 	`json:"value"`
+}
+
+// Either StringValue or IntValue is set
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue 	*string `json:"intValue,omitempty"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano 	string 			`json:"timeUnixNano"`
+	Name 			string 			`json:"name"`
+	Attributes 		[]otlpAttribute `json:"attributes"`
+}
+
+type otlpStatus struct {
+	// 0 unset, 2 error
+	Code 	int 	`json:"code,omitempty"`
+	Message string 	`json:"message,omitempty"`
+}
+
+// The span kind of every entry, the proxy is the client of the upstream servers
+const otlpSpanKindClient = 3
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key : key, Value : otlpValue{StringValue : &value}}
+}
+
+func otlpInt(key string, value int64) otlpAttribute {
+	encoded := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key : key, Value : otlpValue{IntValue : &encoded}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// A random id of size bytes, hex encoded
+func otlpId(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// The span of entry, in the trace of its traceparent header when it has a valid one
+func otlpSpanOf(entry *HarEntry) otlpSpan {
+	span := otlpSpan {
+		TraceId 	: otlpId(16),
+		SpanId 		: otlpId(8),
+		Name 		: entry.Request.Method + " " + entry.Request.Url,
+		Kind 		: otlpSpanKindClient,
+		Attributes 	: []otlpAttribute {
+			otlpString("http.request.method", entry.Request.Method),
+			otlpString("url.full", entry.Request.Url),
+		},
+	}
+	for _, header := range entry.Request.Headers {
+		if !strings.EqualFold(header.Name, "traceparent") {
+			continue
+		}
+		if match := traceparentPattern.FindStringSubmatch(strings.TrimSpace(header.Value)); match != nil &&
+				strings.Trim(match[1], "0") != "" && strings.Trim(match[2], "0") != "" {
+			span.TraceId, span.ParentSpanId = match[1], match[2]
+		}
+		break
+	}
+	if requestUrl, err := url.Parse(entry.Request.Url); err == nil {
+		span.Name = entry.Request.Method + " " + requestUrl.Host + requestUrl.EscapedPath()
+		span.Attributes = append(span.Attributes, otlpString("server.address", requestUrl.Hostname()))
+	}
+	if entry.Request.BodySize > 0 {
+		span.Attributes = append(span.Attributes, otlpInt("http.request.body.size", entry.Request.BodySize))
+	}
+	if entry.ServerIpAddress != "" {
+		span.Attributes = append(span.Attributes, otlpString("network.peer.address", entry.ServerIpAddress))
+	}
+	if entry.Response != nil {
+		span.Attributes = append(span.Attributes, otlpInt("http.response.status_code", int64(entry.Response.Status)))
+		if entry.Response.BodySize > 0 {
+			span.Attributes = append(span.Attributes, otlpInt("http.response.body.size", entry.Response.BodySize))
+		}
+		if entry.Response.Status >= 500 {
+			span.Status = otlpStatus{Code : 2}
+		}
+	} else {
+		span.Status = otlpStatus{Code : 2, Message : entry.Error}
+		if entry.Error != "" {
+			span.Attributes = append(span.Attributes, otlpString("error.type", entry.Error))
+		}
+	}
+
+	start := entry.StartedDateTime
+	span.StartTimeUnixNano = otlpTime(start)
+	span.EndTimeUnixNano = otlpTime(start.Add(time.Duration(entry.Time) * time.Millisecond))
+	// Each timing starts when the previous one ends, ssl being the end of connect
+	timings := entry.Timings
+	offset := int64(0)
+	for _, timing := range []struct{ name string; ms int64 } {
+		{"blocked", timings.Blocked}, {"dns", timings.Dns}, {"connect", timings.Connect},
+		{"send", timings.Send}, {"wait", timings.Wait}, {"receive", timings.Receive},
+	} {
+		if timing.ms <= 0 {
+			continue
+		}
+		span.Events = append(span.Events, otlpTimingEvent(start, offset, timing.name, timing.ms))
+		if timing.name == "connect" && timings.Ssl > 0 && timings.Ssl <= timings.Connect {
+			span.Events = append(span.Events, otlpTimingEvent(start, offset + timings.Connect - timings.Ssl, "ssl", timings.Ssl))
+		}
+		offset += timing.ms
+	}
+	return span
+}
+
+func otlpTimingEvent(start time.Time, offsetMs int64, name string, ms int64) otlpEvent {
+	return otlpEvent {
+		TimeUnixNano 	: otlpTime(start.Add(time.Duration(offsetMs) * time.Millisecond)),
+		Name 			: name,
+		Attributes 		: []otlpAttribute{otlpInt("duration_ms", ms)},
+	}
+}
+
+// An ExportTraceServiceRequest of the spans of batch
+func encodeOtlp(serviceName string, batch []HarEntry) ([]byte, string, error) {
+	spans := make([]otlpSpan, len(batch))
+	for i := range batch {
+		spans[i] = otlpSpanOf(&batch[i])
+	}
+	type scopeSpans struct {
+		Scope map[string]string `json:"scope"`
+		Spans []otlpSpan 		`json:"spans"`
+	}
+	type resourceSpans struct {
+		Resource 	map[string][]otlpAttribute 	`json:"resource"`
+		ScopeSpans 	[]scopeSpans 				`json:"scopeSpans"`
+	}
+	body, err := json.Marshal(map[string][]resourceSpans {
+		"resourceSpans" : {{
+			Resource 	: map[string][]otlpAttribute{"attributes" : {otlpString("service.name", serviceName)}},
+			ScopeSpans 	: []scopeSpans{{Scope : map[string]string{"name" : "goharproxy"}, Spans : spans}},
+		}},
+	})
+	return body, "application/json", err
+}
+
+// SetTracing exports the entries recorded from now on as spans, replacing the current exporter, nil stops exporting.
+// The spans the replaced exporter holds are still posted.
+func (proxy *HarProxy) SetTracing(opts *TracingOptions) error {
+	var exporter *httpSink
+	var tracing *TracingOptions
+	if opts != nil {
+		if err := opts.validate(); err != nil {
+			return err
+		}
+		exporter, tracing = proxy.newTracingExporter(*opts)
+	}
+	proxy.settingsLock.Lock()
+	previous := proxy.tracing
+	proxy.tracing, proxy.tracingOptions = exporter, tracing
+	proxy.settingsLock.Unlock()
+	if previous != nil {
+		go previous.close()
+	}
+	return nil
+}
+
+// Returns the exporter of opts and the options it exports with, their defaults filled in
+func (proxy *HarProxy) newTracingExporter(opts TracingOptions) (*httpSink, *TracingOptions) {
+	withDefaults := opts.copy().withDefaults()
+	exporter := newHttpSink(withDefaults.sinkOptions(), proxy.logger, proxy.clock, &proxy.tracingCounters, func(batch []HarEntry) ([]byte, string, error) {
+		return encodeOtlp(withDefaults.ServiceName, batch)
+	})
+	return exporter, &withDefaults
+}
+
+// Tracing returns the proxy's tracing options, with their defaults, nil when spans aren't exported
+func (proxy *HarProxy) Tracing() *TracingOptions {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	if proxy.tracingOptions == nil {
+		return nil
+	}
+	opts := proxy.tracingOptions.copy()
+	return &opts
+}
+
+// TracingStats returns the spans exported, the failed posts and the spans given up on
+func (proxy *HarProxy) TracingStats() (sent, failures, dropped int64) {
+	return atomic.LoadInt64(&proxy.tracingCounters.sent), atomic.LoadInt64(&proxy.tracingCounters.failures), atomic.LoadInt64(&proxy.tracingCounters.dropped)
+}
+
+func (proxy *HarProxy) sendToTracing(entry *HarEntry) {
+	proxy.settingsLock.RLock()
+	exporter := proxy.tracing
+	proxy.settingsLock.RUnlock()
+	if exporter != nil {
+		exporter.add(*entry)
+	}
+}
+
+// Posts the spans still buffered, once the last entry was recorded
+func (proxy *HarProxy) closeTracing() {
+	proxy.settingsLock.RLock()
+	exporter := proxy.tracing
+	proxy.settingsLock.RUnlock()
+	if exporter != nil {
+		exporter.close()
+	}
+}
@@ -0,0 +1,92 @@
+package goharproxy
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// The viewer served on /ui, plain HTML, JS and CSS without build step
+//go:embed ui
+var uiFiles embed.FS
+
+// The buffer of the subscription of a /har/stream client, entries past it are dropped for that client
+const harStreamBuffer = 256
+
+// Serves the embedded viewer. The files change with the binary only, clients revalidate them by their ETag.
+func uiHandler() http.Handler {
+	files, _ := fs.Sub(uiFiles, "ui")
+	etags := make(map[string]string)
+	fs.WalkDir(files, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(files, path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		etags["/" + path] = `"` + hex.EncodeToString(sum[:8]) + `"`
+		return nil
+	})
+	fileServer := http.StripPrefix("/ui", http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ui" {
+			http.Redirect(w, r, "/ui/", http.StatusMovedPermanently)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/ui")
+		if path == "/" {
+			path = "/index.html"
+		}
+		if etag, ok := etags[path]; ok {
+			w.Header().Set("ETag", etag)
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// Streams the entries the proxy records from now on as server-sent events, one json entry per event with
+// the entry's id as event id, until the client goes away or the proxy stops recording
+func (proxyServer *ProxyServer) streamHarEntries(harProxy *HarProxy, r *http.Request, w http.ResponseWriter) {
+	if !proxyServer.authorizeStream(harProxy, r, w) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		proxyServer.writeErrorMessage(w, http.StatusInternalServerError, "Streaming isn't supported")
+		return
+	}
+	entries, cancel := harProxy.Subscribe(harStreamBuffer)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Sent right away, so clients know the stream is open before the first entry
+	fmt.Fprint(w, ": streaming entries\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case entry, ok := <-entries:
+			if !ok {
+				return
+			}
+			encoded, err := json.Marshal(&entry)
+			if err != nil {
+				proxyServer.logger.Errorf("Streaming entry %v : %v", entry.Request.Url, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", entry.Id, encoded); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// The viewer of the management API's proxies, it only uses the public routes:
+// GET /proxy, POST /proxy/[port]/har/streamToken, GET /proxy/[port]/har/stream, GET /proxy/[port]/har and PUT /proxy/[port]/har
+(function () {
+  "use strict";
+
+  // The API key asked for when the server has keys, kept for the browser session
+  var apiKey = sessionStorage.getItem("apiKey") || "";
+
+  var proxies = document.getElementById("proxies");
+  var rows = document.getElementById("entries");
+  var empty = document.getElementById("empty");
+  var filter = document.getElementById("filter");
+  var state = document.getElementById("state");
+
+  // The entries received from the selected proxy, in the order they completed
+  var entries = [];
+  var stream = null;
+
+  function proxyPath() {
+    return "../proxy/" + encodeURIComponent(proxies.value);
+  }
+
+  // Fetches url with the API key, asking for one and retrying once when the server answers 401
+  function apiFetch(url, options, retried) {
+    options = options || {};
+    options.headers = apiKey ? {"X-Api-Key": apiKey} : {};
+    return fetch(url, options).then(function (resp) {
+      if (resp.status !== 401 || retried) {
+        return resp;
+      }
+      apiKey = window.prompt(apiKey ? "Unknown API key, enter another one" : "Enter your API key") || "";
+      sessionStorage.setItem("apiKey", apiKey);
+      return apiFetch(url, options, true);
+    }).then(function (resp) {
+      if (!resp.ok) {
+        throw new Error(resp.status + " " + resp.statusText);
+      }
+      return resp;
+    });
+  }
+
+  function loadProxies() {
+    apiFetch("../proxy").then(function (resp) {
+      return resp.json();
+    }).then(function (list) {
+      var selected = proxies.value;
+      proxies.textContent = "";
+      list.forEach(function (proxy) {
+        var option = document.createElement("option");
+        option.value = proxy.port;
+        option.textContent = proxy.name ? proxy.name + " (" + proxy.port + ")" : proxy.port;
+        proxies.appendChild(option);
+      });
+      if (selected && list.some(function (proxy) { return String(proxy.port) === selected; })) {
+        proxies.value = selected;
+      }
+      if (String(proxies.value) !== selected) {
+        watch();
+      }
+      if (list.length === 0) {
+        state.textContent = "No proxies, create one with POST /proxy";
+      }
+    }).catch(function (err) {
+      state.textContent = "Listing proxies failed: " + err;
+    });
+  }
+
+  // Streams the entries of the selected proxy from now on
+  function watch() {
+    if (stream) {
+      stream.close();
+      stream = null;
+    }
+    entries = [];
+    render();
+    if (!proxies.value) {
+      return;
+    }
+    connect(proxies.value);
+  }
+
+  // Opens the stream of the proxy on port with a new single-use token, since EventSource can't send the
+  // API key, and opens another one when the server ends it
+  function connect(port) {
+    var path = proxyPath();
+    apiFetch(path + "/har/streamToken", {method: "POST"}).then(function (resp) {
+      return resp.json();
+    }).then(function (grant) {
+      var query = "?streamToken=" + encodeURIComponent(grant.token);
+      if (port !== proxies.value || stream) {
+        return;
+      }
+      stream = new EventSource(path + "/har/stream" + query);
+      stream.onopen = function () {
+        state.textContent = "Live";
+      };
+      stream.onerror = function () {
+        state.textContent = "Disconnected, retrying...";
+        // Tokens can't be reused, closed streams are reopened with a new one
+        if (stream && stream.readyState === EventSource.CLOSED) {
+          stream = null;
+          setTimeout(function () {
+            connect(port);
+          }, 2000);
+        }
+      };
+      stream.onmessage = function (event) {
+        entries.push(JSON.parse(event.data));
+        render();
+      };
+    }).catch(function (err) {
+      state.textContent = "Can't stream: " + err.message;
+    });
+  }
+
+  function status(entry) {
+    return entry.response ? entry.response.status : 0;
+  }
+
+  function size(entry) {
+    if (!entry.response) {
+      return "";
+    }
+    var bytes = entry.response.bodySize > 0 ? entry.response.bodySize : (entry.response.content || {}).size || 0;
+    if (bytes < 1024) {
+      return bytes + " B";
+    }
+    return (bytes / 1024).toFixed(1) + " kB";
+  }
+
+  function cell(row, text, className) {
+    var td = document.createElement("td");
+    td.textContent = text;
+    td.title = text;
+    td.className = className;
+    row.appendChild(td);
+    return td;
+  }
+
+  function render() {
+    var pattern = filter.value.toLowerCase();
+    var shown = entries.filter(function (entry) {
+      return entry.request.url.toLowerCase().indexOf(pattern) >= 0;
+    });
+    // The waterfall spans from the first start to the last end of the entries shown
+    var first = Infinity, last = -Infinity;
+    shown.forEach(function (entry) {
+      var start = Date.parse(entry.startedDateTime);
+      first = Math.min(first, start);
+      last = Math.max(last, start + entry.time);
+    });
+    var span = Math.max(last - first, 1);
+
+    rows.textContent = "";
+    shown.forEach(function (entry) {
+      var row = document.createElement("tr");
+      if (status(entry) === 0 || status(entry) >= 400) {
+        row.className = "error";
+      }
+      cell(row, entry.request.method, "method");
+      cell(row, entry.request.url, "url");
+      cell(row, status(entry) || (entry._error ? "failed" : ""), "status");
+      cell(row, size(entry), "size");
+      cell(row, entry.time + " ms", "time");
+      var bar = document.createElement("div");
+      bar.className = "bar";
+      var timing = document.createElement("span");
+      timing.style.left = ((Date.parse(entry.startedDateTime) - first) / span * 100) + "%";
+      timing.style.width = (entry.time / span * 100) + "%";
+      bar.appendChild(timing);
+      cell(row, "", "waterfall").appendChild(bar);
+      rows.appendChild(row);
+    });
+    empty.style.display = shown.length ? "none" : "";
+  }
+
+  function clear() {
+    if (!proxies.value) {
+      return;
+    }
+    // Fetching the HAR clears the proxy's log
+    apiFetch(proxyPath() + "/har", {method: "PUT"}).then(function () {
+      entries = [];
+      render();
+    }).catch(function (err) {
+      state.textContent = "Clearing failed: " + err;
+    });
+  }
+
+  // Saves the proxy's whole HAR log, the entries shown are only those recorded since it was selected
+  function download() {
+    if (!proxies.value) {
+      return;
+    }
+    var port = proxies.value;
+    apiFetch(proxyPath() + "/har").then(function (resp) {
+      return resp.blob();
+    }).then(function (har) {
+      var link = document.createElement("a");
+      link.href = URL.createObjectURL(har);
+      link.download = "proxy-" + port + ".har";
+      link.click();
+      URL.revokeObjectURL(link.href);
+    }).catch(function (err) {
+      state.textContent = "Downloading failed: " + err;
+    });
+  }
+
+  proxies.addEventListener("change", watch);
+  filter.addEventListener("input", render);
+  document.getElementById("refresh").addEventListener("click", loadProxies);
+  document.getElementById("clear").addEventListener("click", clear);
+  document.getElementById("download").addEventListener("click", download);
+  loadProxies();
+})();
@@ -0,0 +1,160 @@
+package goharproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// What the trace of a request's upstream round trip saw, see traceUpstream. Transports built on
+// net/http report it, others leave it empty. A retried request records its last attempt.
+type upstreamTrace struct {
+	// Written by the transport, from the goroutine writing the request too
+	lock sync.Mutex
+
+	// The connection's local address, unique among the open connections, see HarEntry.Connection
+	connection string
+	reused bool
+	wasIdle bool
+
+	// When the connection was got, the whole request written and the first response byte read
+	gotConn time.Time
+	wroteRequest time.Time
+	firstByte time.Time
+}
+
+// Returns req with a trace recording its round trip in trace, now telling the time
+func traceUpstream(req *http.Request, trace *upstreamTrace, now func() time.Time) *http.Request {
+	clientTrace := &httptrace.ClientTrace {
+		GotConn : func(info httptrace.GotConnInfo) {
+			trace.lock.Lock()
+			defer trace.lock.Unlock()
+			if info.Conn != nil && info.Conn.LocalAddr() != nil {
+				trace.connection = info.Conn.LocalAddr().String()
+			}
+			trace.reused, trace.wasIdle = info.Reused, info.WasIdle
+			trace.gotConn, trace.wroteRequest, trace.firstByte = now(), time.Time{}, time.Time{}
+		},
+		WroteRequest : func(httptrace.WroteRequestInfo) {
+			trace.lock.Lock()
+			trace.wroteRequest = now()
+			trace.lock.Unlock()
+		},
+		GotFirstResponseByte : func() {
+			trace.lock.Lock()
+			trace.firstByte = now()
+			trace.lock.Unlock()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), clientTrace))
+}
+
+// Fills the entry's connection and its send, wait and receive timings, end being when the response was sent
+// to the client. Sending starts once the connection was got, a response coming before the request was
+// all written ends it. Timings before the connection, besides blocked, aren't split from the entry's time.
+func (trace *upstreamTrace) record(harEntry *HarEntry, end time.Time) {
+	trace.lock.Lock()
+	defer trace.lock.Unlock()
+	harEntry.Connection = trace.connection
+	harEntry.ConnectionReused, harEntry.ConnectionWasIdle = trace.reused, trace.wasIdle
+	if trace.gotConn.IsZero() || trace.firstByte.IsZero() {
+		return
+	}
+	wrote := trace.wroteRequest
+	if wrote.IsZero() || wrote.After(trace.firstByte) {
+		wrote = trace.firstByte
+	}
+	if wrote.Before(trace.gotConn) {
+		wrote = trace.gotConn
+	}
+	firstByte := trace.firstByte
+	if end.Before(firstByte) {
+		end = firstByte
+	}
+	harEntry.Timings.Send = wrote.Sub(trace.gotConn).Milliseconds()
+	harEntry.Timings.Wait = firstByte.Sub(wrote).Milliseconds()
+	harEntry.Timings.Receive = end.Sub(firstByte).Milliseconds()
+}
+
+// The body of a proxied request as the transport sends it upstream. The bytes are captured for the entry
+// as they are read, rather than beforehand, so the upload isn't held back and is timed as it is sent.
+type upstreamBody struct {
+	// Guards all but rest, the transport may still read the body while the entry is recorded
+	lock sync.Mutex
+	rest io.ReadCloser
+
+	// Keeps the bytes read until sealed, nil when the content isn't captured
+	capture *captureBuffer
+	sealed bool
+	closed bool
+
+	// The Content-Length, negative when unknown
+	length int64
+
+	// The bytes read, whether captured or not, and whether the whole body was
+	read int64
+	eof bool
+}
+
+// Wraps the body of req, capturing it in capture up to its limit, if not nil
+func newUpstreamBody(req *http.Request, capture *captureBuffer) *upstreamBody {
+	body := &upstreamBody{rest : req.Body, capture : capture, length : req.ContentLength}
+	req.Body = body
+	return body
+}
+
+func (body *upstreamBody) Read(p []byte) (int, error) {
+	n, err := body.rest.Read(p)
+	body.lock.Lock()
+	body.read += int64(n)
+	if body.capture != nil && !body.sealed && !body.closed {
+		body.capture.Write(p[:n])
+	}
+	if err == io.EOF {
+		body.eof = true
+	}
+	body.lock.Unlock()
+	return n, err
+}
+
+func (body *upstreamBody) Close() error {
+	body.lock.Lock()
+	if !body.closed {
+		body.closed = true
+		body.capture.release()
+	}
+	body.lock.Unlock()
+	return body.rest.Close()
+}
+
+// Reads what is left of the body up to the capture's limit, for requests which aren't sent upstream
+func (body *upstreamBody) fill() {
+	body.lock.Lock()
+	remaining := int64(math.MaxInt64)
+	if body.capture == nil || body.sealed || body.closed {
+		remaining = 0
+	} else if body.capture.limit > 0 {
+		remaining = body.capture.limit - int64(body.capture.Len())
+	}
+	body.lock.Unlock()
+	if remaining > 0 {
+		io.Copy(ioutil.Discard, io.LimitReader(body, remaining))
+	}
+}
+
+// Stops capturing, so the entry can read the capture, returning the bytes read so far and whether they are all of them.
+// A capture missing the bytes still to be read is marked truncated.
+func (body *upstreamBody) seal() (int64, bool) {
+	body.lock.Lock()
+	defer body.lock.Unlock()
+	body.sealed = true
+	whole := body.eof || body.length >= 0 && body.read >= body.length
+	if !whole && body.capture != nil {
+		body.capture.truncated = true
+	}
+	return body.read, whole
+}
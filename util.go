@@ -3,9 +3,57 @@ package goharproxy
 import (
 	"net"
 	"strconv"
+	"regexp"
 )
 
 func GetPort(l net.Listener) int {
-	port, _ := strconv.Atoi(l.Addr().String()[len("[::]:"):])
+	_, portStr, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(portStr)
 	return port
 }
+
+var hostnameRegex *regexp.Regexp = regexp.MustCompile("^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$")
+
+func validHostname(host string) bool {
+	return len(host) <= 253 && hostnameRegex.MatchString(host)
+}
+
+// Whether every address host resolves to can be bound on this machine
+func isLocalAddress(host string) bool {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil || len(ips) == 0 {
+			return false
+		}
+	}
+
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() && !ip.IsUnspecified() && !containsIp(interfaceAddrs, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsIp(addrs []net.Addr, ip net.IP) bool {
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,393 @@
+package goharproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The document can't be used as a HAR, e.g. an entry without request url or with a bad timestamp
+	HarViolationError = "error"
+
+	// The document strays from the HAR spec in a way most tools cope with, e.g. a missing cache object
+	HarViolationWarning = "warning"
+)
+
+// A way a HAR document breaks the HAR 1.2 spec, see ValidateHarLog
+type HarViolation struct {
+	// Index of the offending entry, -1 outside of the entries
+	Entry 		int 	`json:"entry"`
+
+	// Path of the offending field within the entry, or within the log outside of the entries, e.g. response.status
+	Field 		string 	`json:"field"`
+
+	// HarViolationError or HarViolationWarning
+	Severity 	string 	`json:"severity"`
+
+	Message 	string 	`json:"message"`
+}
+
+// What ValidateHarLog found in a HAR document
+type HarValidationReport struct {
+	// Whether the document has no error, it may have warnings
+	Valid 		bool 			`json:"valid"`
+	Entries 	int 			`json:"entries"`
+	Errors 		int 			`json:"errors"`
+	Warnings 	int 			`json:"warnings"`
+	Violations 	[]HarViolation 	`json:"violations"`
+}
+
+// ValidateHarLog checks a HAR document against the HAR 1.2 spec, reporting every violation in document order.
+// Missing required fields and numbers written as strings are warnings, except the fields an entry means nothing
+// without (startedDateTime, request, its method and url), which are errors like fields of the wrong type,
+// timestamps which aren't ISO 8601, sizes and timings below -1 and the send, wait and receive timings below 0.
+// Like ParseHar it accepts the logs of this package, wrapped in "harLog", and matches field names ignoring case.
+// The error is only set if reading r failed, a document which isn't JSON is reported as a violation.
+func ValidateHarLog(r io.Reader) (*HarValidationReport, error) {
+	validator := &harValidator{report : &HarValidationReport{Violations : []HarViolation{}}}
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var document interface{}
+	err := decoder.Decode(&document)
+	var syntaxErr *json.SyntaxError
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		validator.errorf(-1, "", "the document is empty or ends early")
+	case errors.As(err, &syntaxErr):
+		validator.errorf(-1, "", "malformed JSON at offset %v: %v", syntaxErr.Offset, err)
+	case err != nil:
+		return nil, err
+	default:
+		validator.document(document)
+	}
+	report := validator.report
+	report.Valid = report.Errors == 0
+	return report, nil
+}
+
+type harValidator struct {
+	report *HarValidationReport
+	// The ids of the log's pages, which pageref must be one of
+	pageIds map[string]bool
+}
+
+func (validator *harValidator) add(entry int, field, severity, format string, args ...interface{}) {
+	if severity == HarViolationError {
+		validator.report.Errors++
+	} else {
+		validator.report.Warnings++
+	}
+	validator.report.Violations = append(validator.report.Violations, HarViolation {
+		Entry 		: entry,
+		Field 		: field,
+		Severity 	: severity,
+		Message 	: fmt.Sprintf(format, args...),
+	})
+}
+
+func (validator *harValidator) errorf(entry int, field, format string, args ...interface{}) {
+	validator.add(entry, field, HarViolationError, format, args...)
+}
+
+func (validator *harValidator) warnf(entry int, field, format string, args ...interface{}) {
+	validator.add(entry, field, HarViolationWarning, format, args...)
+}
+
+// The value of field in object, matched ignoring case when there is no exact match
+func lookupField(object map[string]interface{}, field string) (interface{}, bool) {
+	if value, ok := object[field]; ok {
+		return value, true
+	}
+	for key, value := range object {
+		if strings.EqualFold(key, field) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// The field of object if it is an object. Reports it with severity when missing, or as an error when it isn't an object.
+func (validator *harValidator) object(entry int, object map[string]interface{}, path, field, severity string) map[string]interface{} {
+	value, ok := lookupField(object, field)
+	if !ok || value == nil {
+		validator.add(entry, joinField(path, field), severity, "missing")
+		return nil
+	}
+	nested, ok := value.(map[string]interface{})
+	if !ok {
+		validator.errorf(entry, joinField(path, field), "expected an object")
+	}
+	return nested
+}
+
+// Like object, for arrays
+func (validator *harValidator) array(entry int, object map[string]interface{}, path, field, severity string) ([]interface{}, bool) {
+	value, ok := lookupField(object, field)
+	if !ok || value == nil {
+		validator.add(entry, joinField(path, field), severity, "missing")
+		return nil, false
+	}
+	array, ok := value.([]interface{})
+	if !ok {
+		validator.errorf(entry, joinField(path, field), "expected an array")
+	}
+	return array, ok
+}
+
+// Like object, for strings
+func (validator *harValidator) string(entry int, object map[string]interface{}, path, field, severity string) (string, bool) {
+	value, ok := lookupField(object, field)
+	if !ok || value == nil {
+		validator.add(entry, joinField(path, field), severity, "missing")
+		return "", false
+	}
+	text, ok := value.(string)
+	if !ok {
+		validator.errorf(entry, joinField(path, field), "expected a string, got %v", value)
+	}
+	return text, ok
+}
+
+// Like object, for numbers, which are also reported as errors below min
+func (validator *harValidator) number(entry int, object map[string]interface{}, path, field, severity string, min float64) (float64, bool) {
+	value, ok := lookupField(object, field)
+	if !ok || value == nil {
+		validator.add(entry, joinField(path, field), severity, "missing")
+		return 0, false
+	}
+	number, ok := value.(json.Number)
+	// Some browsers write numbers as strings, which ParseHar accepts
+	if text, isText := value.(string); isText && !ok {
+		if _, err := strconv.ParseFloat(strings.TrimSpace(text), 64); err == nil {
+			validator.warnf(entry, joinField(path, field), "expected a number, got the string %q", text)
+			number, ok = json.Number(strings.TrimSpace(text)), true
+		}
+	}
+	if !ok {
+		validator.errorf(entry, joinField(path, field), "expected a number, got %q", value)
+		return 0, false
+	}
+	parsed, err := number.Float64()
+	if err != nil || math.IsInf(parsed, 0) {
+		validator.errorf(entry, joinField(path, field), "expected a number, got %v", number)
+		return 0, false
+	}
+	if parsed < min {
+		validator.errorf(entry, joinField(path, field), "%v is below %v", number, min)
+		return parsed, false
+	}
+	return parsed, true
+}
+
+// Reports a timestamp which isn't ISO 8601
+func (validator *harValidator) timestamp(entry int, object map[string]interface{}, path, field string) {
+	if value, ok := validator.string(entry, object, path, field, HarViolationError); ok {
+		if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+			validator.errorf(entry, joinField(path, field), "expected an ISO 8601 date, got %q", value)
+		}
+	}
+}
+
+func (validator *harValidator) document(document interface{}) {
+	object, ok := document.(map[string]interface{})
+	if !ok {
+		validator.errorf(-1, "", "expected an object")
+		return
+	}
+	var harLog map[string]interface{}
+	wrapped := false
+	for _, key := range []string{"log", "harLog"} {
+		if _, wrapped = object[key]; wrapped {
+			harLog = validator.object(-1, object, "", key, HarViolationError)
+			break
+		}
+	}
+	if !wrapped {
+		if _, ok := lookupField(object, "entries"); !ok {
+			validator.errorf(-1, "log", "missing")
+			return
+		}
+		validator.warnf(-1, "log", "missing, the log isn't wrapped in a log object")
+		harLog = object
+	}
+	if harLog == nil {
+		return
+	}
+
+	if version, ok := validator.string(-1, harLog, "", "version", HarViolationWarning); ok && version != "1.1" && version != "1.2" {
+		validator.warnf(-1, "version", "unknown HAR version %q", version)
+	}
+	validator.creator(harLog, "creator", HarViolationWarning)
+	if _, ok := lookupField(harLog, "browser"); ok {
+		validator.creator(harLog, "browser", HarViolationWarning)
+	}
+
+	validator.pageIds = map[string]bool{}
+	if _, ok := lookupField(harLog, "pages"); ok {
+		pages, _ := validator.array(-1, harLog, "", "pages", HarViolationWarning)
+		for i, page := range pages {
+			validator.page(fmt.Sprintf("pages[%v]", i), page)
+		}
+	}
+
+	entries, _ := validator.array(-1, harLog, "", "entries", HarViolationError)
+	validator.report.Entries = len(entries)
+	for i, entry := range entries {
+		validator.entry(i, entry)
+	}
+}
+
+// The spec's creators are {"name", "version"} objects, this package writes them as "name version"
+func (validator *harValidator) creator(harLog map[string]interface{}, field, severity string) {
+	value, _ := lookupField(harLog, field)
+	if _, ok := value.(string); ok {
+		validator.warnf(-1, field, "expected an object with name and version")
+		return
+	}
+	if creator := validator.object(-1, harLog, "", field, severity); creator != nil {
+		validator.string(-1, creator, field, "name", HarViolationWarning)
+		validator.string(-1, creator, field, "version", HarViolationWarning)
+	}
+}
+
+func (validator *harValidator) page(path string, value interface{}) {
+	page, ok := value.(map[string]interface{})
+	if !ok {
+		validator.errorf(-1, path, "expected an object")
+		return
+	}
+	validator.timestamp(-1, page, path, "startedDateTime")
+	if id, ok := validator.string(-1, page, path, "id", HarViolationError); ok {
+		if validator.pageIds[id] {
+			validator.errorf(-1, joinField(path, "id"), "duplicate page id %q", id)
+		}
+		validator.pageIds[id] = true
+	}
+	validator.string(-1, page, path, "title", HarViolationWarning)
+	if pageTimings := validator.object(-1, page, path, "pageTimings", HarViolationWarning); pageTimings != nil {
+		for _, field := range []string{"onContentLoad", "onLoad"} {
+			if _, ok := lookupField(pageTimings, field); ok {
+				validator.number(-1, pageTimings, joinField(path, "pageTimings"), field, HarViolationWarning, -1)
+			}
+		}
+	}
+}
+
+func (validator *harValidator) entry(index int, value interface{}) {
+	entry, ok := value.(map[string]interface{})
+	if !ok {
+		validator.errorf(index, "", "expected an object")
+		return
+	}
+	if _, ok := lookupField(entry, "pageref"); ok {
+		if pageRef, ok := validator.string(index, entry, "", "pageref", HarViolationWarning); ok && pageRef != "" && !validator.pageIds[pageRef] {
+			validator.warnf(index, "pageref", "no page has id %q", pageRef)
+		}
+	}
+	validator.timestamp(index, entry, "", "startedDateTime")
+	entryTime, hasTime := validator.number(index, entry, "", "time", HarViolationWarning, 0)
+
+	if request := validator.object(index, entry, "", "request", HarViolationError); request != nil {
+		validator.request(index, request)
+	}
+	if value, ok := lookupField(entry, "response"); !ok || value == nil {
+		validator.warnf(index, "response", "missing, as for requests which got no response")
+	} else if response := validator.object(index, entry, "", "response", HarViolationWarning); response != nil {
+		validator.response(index, response)
+	}
+	validator.object(index, entry, "", "cache", HarViolationWarning)
+
+	timings := validator.object(index, entry, "", "timings", HarViolationWarning)
+	if timings == nil {
+		return
+	}
+	total, complete := 0.0, true
+	for _, timing := range []struct{ field string; min float64; optional bool } {
+		{"blocked", -1, true}, {"dns", -1, true}, {"connect", -1, true}, {"ssl", -1, true},
+		{"send", 0, false}, {"wait", 0, false}, {"receive", 0, false},
+	} {
+		if _, ok := lookupField(timings, timing.field); !ok && timing.optional {
+			continue
+		}
+		ms, ok := validator.number(index, timings, "timings", timing.field, HarViolationWarning, timing.min)
+		complete = complete && ok
+		// ssl is also counted in connect
+		if ok && ms > 0 && timing.field != "ssl" {
+			total += ms
+		}
+	}
+	// Timings are rounded to whole ms by some tools, this package included
+	if hasTime && complete && math.Abs(total - entryTime) > 4 {
+		validator.warnf(index, "time", "%v differs from the sum of the timings, %v", entryTime, total)
+	}
+}
+
+func (validator *harValidator) request(index int, request map[string]interface{}) {
+	validator.string(index, request, "request", "method", HarViolationError)
+	if requestUrl, ok := validator.string(index, request, "request", "url", HarViolationError); ok {
+		if parsed, err := url.Parse(requestUrl); err != nil || !parsed.IsAbs() || parsed.Host == "" {
+			validator.errorf(index, "request.url", "expected an absolute url, got %q", requestUrl)
+		}
+	}
+	validator.string(index, request, "request", "httpVersion", HarViolationWarning)
+	validator.nameValues(index, request, "request", "cookies")
+	validator.nameValues(index, request, "request", "headers")
+	validator.nameValues(index, request, "request", "queryString")
+	if _, ok := lookupField(request, "postData"); ok {
+		if postData := validator.object(index, request, "request", "postData", HarViolationWarning); postData != nil {
+			validator.string(index, postData, "request.postData", "mimeType", HarViolationWarning)
+			if _, ok := lookupField(postData, "params"); ok {
+				params, _ := validator.array(index, postData, "request.postData", "params", HarViolationWarning)
+				for i, param := range params {
+					path := fmt.Sprintf("request.postData.params[%v]", i)
+					if param, ok := param.(map[string]interface{}); ok {
+						validator.string(index, param, path, "name", HarViolationError)
+					} else {
+						validator.errorf(index, path, "expected an object")
+					}
+				}
+			}
+		}
+	}
+	validator.number(index, request, "request", "headersSize", HarViolationWarning, -1)
+	validator.number(index, request, "request", "bodySize", HarViolationWarning, -1)
+}
+
+func (validator *harValidator) response(index int, response map[string]interface{}) {
+	if status, ok := validator.number(index, response, "response", "status", HarViolationError, 0); ok && status > 999 {
+		validator.errorf(index, "response.status", "%v isn't an HTTP status", status)
+	}
+	validator.string(index, response, "response", "statusText", HarViolationWarning)
+	validator.string(index, response, "response", "httpVersion", HarViolationWarning)
+	validator.nameValues(index, response, "response", "cookies")
+	validator.nameValues(index, response, "response", "headers")
+	if content := validator.object(index, response, "response", "content", HarViolationWarning); content != nil {
+		validator.number(index, content, "response.content", "size", HarViolationWarning, 0)
+		validator.string(index, content, "response.content", "mimeType", HarViolationWarning)
+	}
+	validator.string(index, response, "response", "redirectURL", HarViolationWarning)
+	validator.number(index, response, "response", "headersSize", HarViolationWarning, -1)
+	validator.number(index, response, "response", "bodySize", HarViolationWarning, -1)
+}
+
+// Checks an array of cookies, headers or query parameters, which all have a name and a value
+func (validator *harValidator) nameValues(index int, object map[string]interface{}, path, field string) {
+	items, _ := validator.array(index, object, path, field, HarViolationWarning)
+	for i, item := range items {
+		itemPath := fmt.Sprintf("%v.%v[%v]", path, field, i)
+		nameValue, ok := item.(map[string]interface{})
+		if !ok {
+			validator.errorf(index, itemPath, "expected an object")
+			continue
+		}
+		validator.string(index, nameValue, itemPath, "name", HarViolationError)
+		validator.string(index, nameValue, itemPath, "value", HarViolationWarning)
+	}
+}
@@ -0,0 +1,299 @@
+package goharproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// The webhook posts in flight at once per proxy, entries matching while they are all busy are counted as suppressed
+const webhookConcurrency = 4
+
+// The wait before the first retry of a failed webhook post, doubled for each next one
+const webhookRetryBackoff = 500 * time.Millisecond
+
+// Posts to a url when a recorded entry matches, e.g. to ping a chat the moment a request returns a 5xx,
+// see HarProxyConfig.Webhooks. Posts are made in the background and never hold up proxied traffic.
+type WebhookRule struct {
+	// Regular expression matched against the entry's url, empty matches every entry
+	UrlPattern 		string 	`json:"urlPattern,omitempty"`
+
+	// The entry's status must be within StatusMin and StatusMax, when they aren't 0.
+	// Entries without response have status 0.
+	StatusMin 		int 	`json:"statusMin,omitempty"`
+	StatusMax 		int 	`json:"statusMax,omitempty"`
+
+	// The url posted to
+	TargetUrl 		string 	`json:"targetUrl"`
+
+	// A text/template of the body, executed with the WebhookPayload of the entry. The json function
+	// encodes a value, e.g. {"text" : {{json .Url}}}. Defaults to the WebhookPayload as json.
+	PayloadTemplate string 	`json:"payloadTemplate,omitempty"`
+
+	// Matching entries are ignored for this long after a post, 0 posts for every matching entry
+	CooldownMs 		int64 	`json:"cooldownMs,omitempty"`
+
+	// Retries of a failed post, at most 10
+	MaxRetries 		int 	`json:"maxRetries,omitempty"`
+}
+
+// What a webhook posts about an entry, as json unless the rule has a PayloadTemplate
+type WebhookPayload struct {
+	Port 			int 		`json:"port"`
+	StartedDateTime time.Time 	`json:"startedDateTime"`
+	Method 			string 		`json:"method"`
+	Url 			string 		`json:"url"`
+	// 0 without response
+	Status 			int 		`json:"status"`
+	Time 			int64 		`json:"time"`
+	ServerIpAddress string 		`json:"serverIpAddress,omitempty"`
+	// The upstream error of entries without response
+	Error 			string 		`json:"error,omitempty"`
+}
+
+var webhookFuncs = template.FuncMap {
+	"json" : func(v interface{}) (string, error) {
+		encoded, err := json.Marshal(v)
+		return string(encoded), err
+	},
+}
+
+func (rule WebhookRule) validate() error {
+	if _, err := regexp.Compile(rule.UrlPattern); err != nil {
+		return fmt.Errorf("invalid urlPattern [%v]: %v", rule.UrlPattern, err)
+	}
+	if rule.StatusMin < 0 || rule.StatusMax < 0 || rule.StatusMax != 0 && rule.StatusMax < rule.StatusMin {
+		return fmt.Errorf("invalid status range [%v, %v]", rule.StatusMin, rule.StatusMax)
+	}
+	targetUrl, err := url.Parse(rule.TargetUrl)
+	if err != nil || (targetUrl.Scheme != "http" && targetUrl.Scheme != "https") || targetUrl.Host == "" {
+		return fmt.Errorf("invalid targetUrl [%v]", rule.TargetUrl)
+	}
+	if _, err := template.New("payload").Funcs(webhookFuncs).Parse(rule.PayloadTemplate); err != nil {
+		return fmt.Errorf("invalid payloadTemplate: %v", err)
+	}
+	if rule.CooldownMs < 0 {
+		return fmt.Errorf("invalid cooldownMs [%v]", rule.CooldownMs)
+	}
+	if rule.MaxRetries < 0 || rule.MaxRetries > 10 {
+		return errors.New("maxRetries must be between 0 and 10")
+	}
+	return nil
+}
+
+// A webhook rule as a proxy holds it, with its pattern and template compiled once when it is set
+type webhookRule struct {
+	WebhookRule
+
+	urlPattern *regexp.Regexp
+	payload *template.Template
+	// Shared by the copies of the rule, guarded by its lock
+	cooldown *webhookCooldown
+	// Why the rule is invalid, it never matches then
+	err error
+}
+
+type webhookCooldown struct {
+	lock sync.Mutex
+	// When the rule last posted
+	last time.Time
+}
+
+func newWebhookRules(rules []WebhookRule) []webhookRule {
+	compiled := make([]webhookRule, len(rules))
+	for i, rule := range rules {
+		compiled[i].WebhookRule = rule
+		compiled[i].cooldown = &webhookCooldown{}
+		if compiled[i].err = rule.validate(); compiled[i].err != nil {
+			continue
+		}
+		compiled[i].urlPattern = regexp.MustCompile(rule.UrlPattern)
+		if rule.PayloadTemplate != "" {
+			compiled[i].payload = template.Must(template.New("payload").Funcs(webhookFuncs).Parse(rule.PayloadTemplate))
+		}
+	}
+	return compiled
+}
+
+func webhookRulesOf(rules []webhookRule) []WebhookRule {
+	webhookRules := make([]WebhookRule, len(rules))
+	for i, rule := range rules {
+		webhookRules[i] = rule.WebhookRule
+	}
+	return webhookRules
+}
+
+func (rule *webhookRule) matches(entry *HarEntry) bool {
+	status := entryStatus(*entry)
+	if rule.StatusMin != 0 && status < rule.StatusMin || rule.StatusMax != 0 && status > rule.StatusMax {
+		return false
+	}
+	return rule.urlPattern.MatchString(entry.Request.Url)
+}
+
+// Whether the rule may post at now, starting its cooldown if so
+func (rule *webhookRule) fire(now time.Time) bool {
+	rule.cooldown.lock.Lock()
+	defer rule.cooldown.lock.Unlock()
+	if rule.CooldownMs > 0 && !rule.cooldown.last.IsZero() && now.Sub(rule.cooldown.last) < time.Duration(rule.CooldownMs) * time.Millisecond {
+		return false
+	}
+	rule.cooldown.last = now
+	return true
+}
+
+// What the webhooks of a proxy did, kept across rule changes
+type webhookCounters struct {
+	sent int64
+	// Posts which failed, retries included
+	failures int64
+	// Matching entries which weren't posted, because of a cooldown or because too many posts were in flight
+	suppressed int64
+}
+
+// SetWebhookRules replaces the proxy's webhook rules, they apply from the next recorded entry
+func (proxy *HarProxy) SetWebhookRules(rules []WebhookRule) error {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	compiled := newWebhookRules(rules)
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.webhookRules = compiled
+	return nil
+}
+
+// AddWebhookRules adds rules after the current ones
+func (proxy *HarProxy) AddWebhookRules(rules []WebhookRule) error {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	compiled := newWebhookRules(rules)
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	proxy.webhookRules = append(proxy.webhookRules[:len(proxy.webhookRules):len(proxy.webhookRules)], compiled...)
+	return nil
+}
+
+// WebhookRules returns a copy of the webhook rules
+func (proxy *HarProxy) WebhookRules() []WebhookRule {
+	proxy.settingsLock.RLock()
+	defer proxy.settingsLock.RUnlock()
+	return webhookRulesOf(proxy.webhookRules)
+}
+
+// WebhookStats returns the webhook posts made, the failed ones and the matching entries which weren't posted
+func (proxy *HarProxy) WebhookStats() (sent, failures, suppressed int64) {
+	return atomic.LoadInt64(&proxy.webhookCounters.sent), atomic.LoadInt64(&proxy.webhookCounters.failures), atomic.LoadInt64(&proxy.webhookCounters.suppressed)
+}
+
+// Starts the posts of the webhook rules matching entry
+func (proxy *HarProxy) triggerWebhooks(entry *HarEntry) {
+	proxy.settingsLock.RLock()
+	rules := proxy.webhookRules
+	proxy.settingsLock.RUnlock()
+	for i := range rules {
+		rule := &rules[i]
+		if rule.err != nil {
+			proxy.logger.Errorf("Skipping webhook rule %v: %v", i, rule.err)
+			continue
+		}
+		if !rule.matches(entry) {
+			continue
+		}
+		if !rule.fire(proxy.clock.Now()) {
+			atomic.AddInt64(&proxy.webhookCounters.suppressed, 1)
+			continue
+		}
+		select {
+		case proxy.webhookSlots <- struct{}{}:
+		default:
+			proxy.logger.Infof("Not posting webhook %v for %v, %v posts are in flight", rule.TargetUrl, entry.Request.Url, webhookConcurrency)
+			atomic.AddInt64(&proxy.webhookCounters.suppressed, 1)
+			continue
+		}
+		body, err := proxy.webhookBody(rule, entry)
+		if err != nil {
+			<-proxy.webhookSlots
+			proxy.logger.Errorf("Webhook payload for %v : %v", entry.Request.Url, err)
+			atomic.AddInt64(&proxy.webhookCounters.failures, 1)
+			continue
+		}
+		go func(targetUrl string, maxRetries int) {
+			defer func() { <-proxy.webhookSlots }()
+			proxy.postWebhook(targetUrl, body, maxRetries)
+		}(rule.TargetUrl, rule.MaxRetries)
+	}
+}
+
+func (proxy *HarProxy) webhookBody(rule *webhookRule, entry *HarEntry) ([]byte, error) {
+	payload := WebhookPayload {
+		Port 			: proxy.Port,
+		StartedDateTime : entry.StartedDateTime,
+		Method 			: entry.Request.Method,
+		Url 			: entry.Request.Url,
+		Status 			: entryStatus(*entry),
+		Time 			: entry.Time,
+		ServerIpAddress : entry.ServerIpAddress,
+		Error 			: entry.Error,
+	}
+	if rule.payload == nil {
+		return json.Marshal(&payload)
+	}
+	var body bytes.Buffer
+	err := rule.payload.Execute(&body, &payload)
+	return body.Bytes(), err
+}
+
+// Posts body to targetUrl, retrying failures after a doubling backoff until the proxy stops
+func (proxy *HarProxy) postWebhook(targetUrl string, body []byte, maxRetries int) {
+	backoff := webhookRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := proxy.postWebhookOnce(targetUrl, body)
+		if err == nil {
+			atomic.AddInt64(&proxy.webhookCounters.sent, 1)
+			return
+		}
+		atomic.AddInt64(&proxy.webhookCounters.failures, 1)
+		if attempt == maxRetries {
+			proxy.logger.Errorf("Posting webhook %v failed after %v retries : %v", targetUrl, maxRetries, err)
+			return
+		}
+		proxy.logger.Infof("Posting webhook %v failed, retrying in %v : %v", targetUrl, backoff, err)
+		timer := proxy.clock.NewTimer(backoff)
+		select {
+		case <-timer.C():
+		case <-proxy.webhookCtx.Done():
+			timer.Stop()
+			proxy.logger.Infof("Not retrying webhook %v, the proxy stopped", targetUrl)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (proxy *HarProxy) postWebhookOnce(targetUrl string, body []byte) error {
+	resp, err := webhookClient.Post(targetUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %v", resp.Status)
+	}
+	return nil
+}
+
+var webhookClient = &http.Client{Timeout : 10 * time.Second}
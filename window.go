@@ -0,0 +1,109 @@
+package goharproxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Limits when a latency rule or a status rewrite applies, e.g. 2s of latency for 30 seconds from now.
+// Without any of its fields the rule always applies. Rules whose window ended are removed from the proxy.
+type ActivationWindow struct {
+	// The rule applies for this long from Start, or from when it is set without Start.
+	// It is turned into End when the rule is set.
+	DurationSeconds 	float64 	`json:"durationSeconds,omitempty"`
+
+	// The rule applies from Start, and until End, when they are set
+	Start 				*time.Time 	`json:"start,omitempty"`
+	End 				*time.Time 	`json:"end,omitempty"`
+
+	// How long until End, when the rules are listed. Ignored when they are set.
+	RemainingSeconds 	*float64 	`json:"remainingSeconds,omitempty"`
+}
+
+func (window ActivationWindow) validate() error {
+	if window.DurationSeconds < 0 || math.IsInf(window.DurationSeconds, 0) || math.IsNaN(window.DurationSeconds) {
+		return fmt.Errorf("invalid durationSeconds [%v]", window.DurationSeconds)
+	}
+	if window.DurationSeconds > 0 && window.End != nil {
+		return errors.New("durationSeconds and end can't both be set")
+	}
+	if window.Start != nil && window.End != nil && !window.End.After(*window.Start) {
+		return fmt.Errorf("end [%v] isn't after start [%v]", window.End, window.Start)
+	}
+	return nil
+}
+
+// The window with DurationSeconds turned into End, counted from now without Start
+func (window ActivationWindow) resolve(now time.Time) ActivationWindow {
+	window.RemainingSeconds = nil
+	if window.DurationSeconds > 0 {
+		if window.Start == nil {
+			window.Start = &now
+		}
+		end := window.Start.Add(time.Duration(window.DurationSeconds * float64(time.Second)))
+		window.End = &end
+		window.DurationSeconds = 0
+	}
+	return window
+}
+
+// The window as listed at now
+func (window ActivationWindow) remaining(now time.Time) ActivationWindow {
+	if window.End != nil {
+		remaining := math.Max(0, window.End.Sub(now).Seconds())
+		window.RemainingSeconds = &remaining
+	}
+	return window
+}
+
+// A resolved window as rules hold it, zero times are unbounded
+type activation struct {
+	start time.Time
+	end time.Time
+}
+
+func newActivation(window ActivationWindow) activation {
+	var active activation
+	if window.Start != nil {
+		active.start = *window.Start
+	}
+	if window.End != nil {
+		active.end = *window.End
+	}
+	return active
+}
+
+func (active activation) active(now time.Time) bool {
+	return (active.start.IsZero() || !now.Before(active.start)) && !active.expired(now)
+}
+
+func (active activation) expired(now time.Time) bool {
+	return !active.end.IsZero() && !now.Before(active.end)
+}
+
+// Removes the latency rules and status rewrites whose window ended at now
+func (proxy *HarProxy) collectExpiredRules(now time.Time) {
+	proxy.settingsLock.Lock()
+	defer proxy.settingsLock.Unlock()
+	latencyRules := make([]latencyRule, 0, len(proxy.latencyRules))
+	for _, rule := range proxy.latencyRules {
+		if !rule.activation.expired(now) {
+			latencyRules = append(latencyRules, rule)
+		}
+	}
+	statusRewrites := make([]statusRewrite, 0, len(proxy.statusRewrites))
+	for _, rewrite := range proxy.statusRewrites {
+		if !rewrite.activation.expired(now) {
+			statusRewrites = append(statusRewrites, rewrite)
+		}
+	}
+	if len(latencyRules) == len(proxy.latencyRules) && len(statusRewrites) == len(proxy.statusRewrites) {
+		return
+	}
+	proxy.logger.Debugf("Removing %v expired latency rules and %v expired status rewrites",
+		len(proxy.latencyRules) - len(latencyRules), len(proxy.statusRewrites) - len(statusRewrites))
+	proxy.latencyRules = latencyRules
+	proxy.statusRewrites = statusRewrites
+}